@@ -0,0 +1,117 @@
+// Package access matches clients against the lists of hosts and networks in the config
+/*
+   A list is made of IPs, CIDR networks, and hostnames, like the hosts,
+   exempt_hosts, and proxy_hosts settings. Resolve looks up the hostnames when
+   the list is loaded, so matching a client never waits on DNS.
+*/
+package access
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// List is a resolved list of hosts and networks
+type List struct {
+	Hosts    []net.IP
+	Networks []*net.IPNet
+}
+
+// ParseIP parses an IP address, dropping any IPv6 zone
+// IPv4 addresses, including IPv4-mapped IPv6 addresses like ::ffff:192.168.1.1,
+// are returned in their 4 byte form so that they match IPv4 entries.
+func ParseIP(s string) net.IP {
+	if i := strings.Index(s, "%"); i != -1 {
+		s = s[:i]
+	}
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// ParseCIDR parses a network in CIDR notation, dropping any IPv6 zone
+// IPv4 networks can leave off trailing zero octets, like 10/8 or 192.168.1/24,
+// and IPv4-mapped IPv6 networks like ::ffff:192.168.1.0/120 are converted to
+// the matching IPv4 network.
+func ParseCIDR(s string) (*net.IPNet, error) {
+	i := strings.LastIndex(s, "/")
+	if i == -1 {
+		return nil, fmt.Errorf("missing prefix length: %s", s)
+	}
+	addr, bits := s[:i], s[i+1:]
+	if j := strings.Index(addr, "%"); j != -1 {
+		addr = addr[:j]
+	}
+	if !strings.Contains(addr, ":") {
+		for n := strings.Count(addr, "."); n < 3; n++ {
+			addr += ".0"
+		}
+	}
+	_, network, err := net.ParseCIDR(addr + "/" + bits)
+	if err != nil {
+		return nil, err
+	}
+	ones, _ := network.Mask.Size()
+	if ip4 := network.IP.To4(); ip4 != nil && len(network.IP) == net.IPv6len && ones >= 96 {
+		network = &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, 32)}
+	}
+	return network, nil
+}
+
+// Resolve converts the entries into IPs and networks, looking up any hostnames
+// Bad networks are logged and skipped, and so are hostnames that don't resolve.
+func Resolve(entries []string) List {
+	var l List
+	for _, h := range entries {
+		// Does it look like a CIDR?
+		if strings.Contains(h, "/") {
+			network, err := ParseCIDR(h)
+			if err != nil {
+				log.Printf("Skipping bad network in hosts: %s", err)
+				continue
+			}
+			l.Networks = append(l.Networks, network)
+			continue
+		}
+
+		// Does it look like an IP?
+		ip := ParseIP(h)
+		if ip != nil {
+			l.Hosts = append(l.Hosts, ip)
+			continue
+		}
+
+		// Does it look like a hostname?
+		ips, err := net.LookupIP(h)
+		if err == nil {
+			for _, ip := range ips {
+				l.Hosts = append(l.Hosts, ParseIP(ip.String()))
+			}
+		}
+	}
+	return l
+}
+
+// Match returns the host or network the IP matched, or "" if it isn't listed
+func (l List) Match(ip net.IP) string {
+	for _, h := range l.Hosts {
+		if h.Equal(ip) {
+			return h.String()
+		}
+	}
+	for _, n := range l.Networks {
+		if n.Contains(ip) {
+			return n.String()
+		}
+	}
+	return ""
+}
+
+// Contains returns true if the IP is one of the hosts or is in one of the networks
+func (l List) Contains(ip net.IP) bool {
+	return l.Match(ip) != ""
+}
@@ -0,0 +1,83 @@
+package access
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseIP(t *testing.T) {
+	tests := []struct {
+		s  string
+		ip string
+	}{
+		{"192.168.1.1", "192.168.1.1"},
+		{"::ffff:192.168.1.1", "192.168.1.1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"2001:db8::1", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		ip := ParseIP(tt.s)
+		if ip.String() != tt.ip {
+			t.Errorf("ParseIP(%q) = %s, expected %s", tt.s, ip, tt.ip)
+		}
+	}
+	if ip := ParseIP("::ffff:192.168.1.1"); len(ip) != net.IPv4len {
+		t.Errorf("Mapped address not converted to IPv4: %#v", ip)
+	}
+	if ip := ParseIP("not.an.ip"); ip != nil {
+		t.Errorf("ParseIP of a hostname returned %s", ip)
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		s       string
+		network string
+	}{
+		{"192.168.1.0/24", "192.168.1.0/24"},
+		{"10/8", "10.0.0.0/8"},
+		{"172.16/12", "172.16.0.0/12"},
+		{"192.168.1/24", "192.168.1.0/24"},
+		{"::ffff:192.168.1.0/120", "192.168.1.0/24"},
+		{"fe80::%eth0/64", "fe80::/64"},
+		{"2001:db8::/32", "2001:db8::/32"},
+	}
+	for _, tt := range tests {
+		network, err := ParseCIDR(tt.s)
+		if err != nil {
+			t.Errorf("ParseCIDR(%q) failed: %s", tt.s, err)
+			continue
+		}
+		if network.String() != tt.network {
+			t.Errorf("ParseCIDR(%q) = %s, expected %s", tt.s, network, tt.network)
+		}
+	}
+	for _, s := range []string{"192.168.1.0", "192.168.1.0/33", "/8"} {
+		if _, err := ParseCIDR(s); err == nil {
+			t.Errorf("ParseCIDR(%q) did not return an error", s)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	l := Resolve([]string{"192.168.1/24", "10.0.0.1", "fe80::1%eth0", "2001:db8::/32", "10.0.0/33"})
+	if len(l.Hosts) != 2 || len(l.Networks) != 2 {
+		t.Fatalf("Wrong list: %v", l)
+	}
+	for _, s := range []string{"192.168.1.20", "::ffff:192.168.1.20", "::ffff:10.0.0.1", "fe80::1%eth1", "2001:db8::5"} {
+		if !l.Contains(ParseIP(s)) {
+			t.Errorf("%s not listed", s)
+		}
+	}
+	for _, s := range []string{"192.168.2.1", "::ffff:10.0.0.2", "fe80::2", "2001:db9::1"} {
+		if l.Contains(ParseIP(s)) {
+			t.Errorf("%s listed", s)
+		}
+	}
+	if m := l.Match(net.ParseIP("192.168.1.20")); m != "192.168.1.0/24" {
+		t.Errorf("Wrong match: %q", m)
+	}
+	if m := (List{}).Match(net.ParseIP("192.168.1.20")); m != "" {
+		t.Errorf("Empty list matched %q", m)
+	}
+}
@@ -0,0 +1,68 @@
+package access
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ReadFiles reads the IPs and networks from the files matching the hosts_file pattern
+/*
+   Example TOML:
+
+   hosts_file = "/etc/letterbox/hosts.d/*.txt"
+
+   Each file has one IP or CIDR network per line, and # starts a comment.
+   Hostnames aren't looked up, they are skipped like other bad lines and
+   returned in bad. The files are read in order of their names.
+*/
+func ReadFiles(pattern string) (entries []string, bad []error, err error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i != -1 {
+				line = line[:i]
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			if err := CheckEntry(line); err != nil {
+				bad = append(bad, fmt.Errorf("%s line %d: %s", path, n, err))
+				continue
+			}
+			entries = append(entries, line)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return entries, bad, nil
+}
+
+// CheckEntry returns an error if the entry isn't an IP or a CIDR network
+func CheckEntry(entry string) error {
+	if strings.Contains(entry, "/") {
+		_, err := ParseCIDR(entry)
+		return err
+	}
+	if ParseIP(entry) == nil {
+		return fmt.Errorf("not an IP or network: %s", entry)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package access
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("10.8.0.0/24 # vpn\n\n  2001:db8::5\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("# dhcp leases\n192.168.1.20\nprinter.lan\n10.0.0/33\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "notes"), []byte("172.16.0.1\n"), 0600)
+
+	entries, bad, err := ReadFiles(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, []string{"192.168.1.20", "10.8.0.0/24", "2001:db8::5"}) {
+		t.Errorf("Wrong entries: %v", entries)
+	}
+	if len(bad) != 2 || !strings.Contains(bad[0].Error(), "a.txt line 3") {
+		t.Errorf("Wrong bad entries: %v", bad)
+	}
+
+	if _, _, err := ReadFiles("[bad"); err == nil {
+		t.Error("Bad pattern didn't fail")
+	}
+}
@@ -0,0 +1,10 @@
+// letterbox - SMTP to Maildir delivery agent
+package main
+
+import (
+	"github.com/bcl/letterbox/server"
+)
+
+func main() {
+	server.Main()
+}
@@ -0,0 +1,477 @@
+// Package config defines the letterbox configuration file
+/*
+   Config holds every setting, with a type for each of its sections. The
+   file is TOML, read by Decode, which also upgrades files written for an
+   older config_version.
+*/
+package config
+
+import (
+	"time"
+)
+
+// Config is the letterbox configuration file
+type Config struct {
+	ConfigVersion      int                 `toml:"config_version"`
+	Hosts              []string            `toml:"hosts"`
+	ExemptHosts        []string            `toml:"exempt_hosts"`
+	ProxyHosts         []string            `toml:"proxy_hosts"`
+	Emails             []string            `toml:"emails"`
+	Groups             map[string][]string `toml:"groups"`
+	StateDir           string              `toml:"state_dir"`
+	Reputation         Reputation          `toml:"reputation"`
+	Timezone           string              `toml:"timezone"`
+	Schedules          map[string][]string `toml:"schedules"`
+	RecipientSchedules map[string]string   `toml:"recipient_schedules"`
+	RecipientMaxSizes  map[string]int64    `toml:"recipient_max_sizes"`
+	Plugins            []Plugin            `toml:"plugins"`
+	Lua                Lua                 `toml:"lua"`
+	TLS                TLS                 `toml:"tls"`
+	Dedup              Dedup               `toml:"dedup"`
+	Greylist           Greylist            `toml:"greylist"`
+	Auth               Auth                `toml:"auth"`
+	Aliases            string              `toml:"aliases"`
+	CatchAll           map[string]string   `toml:"catch_all"`
+	CatchallMaildir    string              `toml:"catchall"`
+	Scan               Scan                `toml:"scan"`
+	Filters            Filters             `toml:"filters"`
+	Clamd              Clamd               `toml:"clamd"`
+	SpamFilter         SpamFilter          `toml:"spam_filter"`
+	Milters            []Milter            `toml:"milters"`
+	WasmFilters        []WasmFilter        `toml:"wasm_filters"`
+	DKIM               DKIM                `toml:"dkim"`
+	Relay              Relay               `toml:"relay"`
+	Queue              Queue               `toml:"queue"`
+	Quota              Quota               `toml:"quota"`
+	RateLimit          RateLimit           `toml:"rate_limit"`
+	DNSBL              DNSBL               `toml:"dnsbl"`
+	Listen             []string            `toml:"listen"`
+	Listeners          []Listener          `toml:"listeners"`
+	Forwards           []Forward           `toml:"forwards"`
+	Pipes              []Pipe              `toml:"pipes"`
+	Backends           []Backend           `toml:"backends"`
+	Webhook            Webhook             `toml:"webhook"`
+	Dovecot            Dovecot             `toml:"dovecot"`
+	Journal            string              `toml:"journal"`           // File to record connections and deliveries in, for letterbox log
+	JournalFormat      string              `toml:"journal_format"`    // jsonl or sqlite, defaults to jsonl
+	JournalRetention   Duration            `toml:"journal_retention"` // How long the SQLite journal keeps entries, 0 keeps them all
+	HostsFile          string              `toml:"hosts_file"`        // Glob of files with more hosts, one IP or network per line
+	SingleCopy         bool                `toml:"single_copy"`       // Write a message to several maildirs once and hardlink it into each
+	Sync               bool                `toml:"sync"`              // fsync messages and their directories before acknowledging them
+	PolicyTags         bool                `toml:"policy_tags"`       // Add an X-Letterbox-Tag header for each policy tag
+	Formats            map[string]string   `toml:"formats"`
+	UntracedRecipients []string            `toml:"untraced_recipients"`
+	Hostname           string              `toml:"hostname"`         // Name to announce on the main listener
+	MaxMessageSize     int64               `toml:"max_message_size"` // Largest message in bytes, 0 for no limit
+	Protocol           string              `toml:"protocol"`         // smtp or lmtp
+	HoldPolicy         string              `toml:"hold_policy"`      // queue or tempfail mail for held users
+	PlusFolders        string              `toml:"plus_folders"`     // create, inbox, or reject unknown user+folder@ folders
+	Format             string              `toml:"format"`           // maildir or mbox
+	MaildirPath        string              `toml:"maildir_path"`     // Template for the path of each user's maildir
+	DeliverAsOwner     bool                `toml:"deliver_as_owner"` // Give mail to the recipient's system account when running as root
+	Owners             map[string]string   `toml:"owners"`           // System account that owns each user's mail, defaults to the user
+	Umask              string              `toml:"umask"`            // Octal umask for new mail, defaults to 0077
+	SPF                string              `toml:"spf"`              // off, mark, or reject
+	SenderDomain       string              `toml:"sender_domain"`    // off, mark, or reject
+	DateCheck          string              `toml:"date_check"`       // off, mark, or reject
+	DateSkew           Duration            `toml:"date_skew"`        // How far the Date header can be from the server's time
+	LogFormat          string              `toml:"log_format"`       // text or json
+	DrainTimeout       Duration            `toml:"drain_timeout"`    // How long to wait for messages when shutting down
+	MetricsAddress     string              `toml:"metrics_address"`  // Address to serve the metrics on, "" to disable
+	User               string              `toml:"user"`             // Account to switch to after opening the listeners as root
+	Group              string              `toml:"group"`            // Group to switch to, defaults to the user's groups
+}
+
+// Duration is a time.Duration that can be read from a TOML string like "24h"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses the duration string
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// Reputation holds the [reputation] section of the config file
+type Reputation struct {
+	HalfLife      Duration `toml:"halflife"`       // Time for a score to decay to half its value
+	GreetingDelay Duration `toml:"greeting_delay"` // Banner delay for each point of a client's score
+	TarpitScore   float64  `toml:"tarpit_score"`   // Score at which clients are tarpitted, 0 disables it
+	TarpitDelay   Duration `toml:"tarpit_delay"`   // Response delay for a client at tarpit_score
+	GreylistScore float64  `toml:"greylist_score"` // Score at which clients are greylisted, 0 disables it
+	MaxDelay      Duration `toml:"max_delay"`      // Longest any delay is allowed to be
+}
+
+// Plugin is one [[plugins]] entry, either a Go plugin or an external command
+type Plugin struct {
+	Path    string   `toml:"path"`
+	Command []string `toml:"command"`
+}
+
+// Lua holds the [lua] section of the config file
+type Lua struct {
+	Script string `toml:"script"` // Path to the Lua script, "" disables scripting
+}
+
+// TLS holds the [tls] section of the config file
+type TLS struct {
+	Cert       string                    `toml:"cert"`        // Path to the PEM encoded certificate chain
+	Key        string                    `toml:"key"`         // Path to the PEM encoded private key
+	MinVersion string                    `toml:"min_version"` // Oldest TLS version to accept, "1.0" to "1.3"
+	ClientCA   string                    `toml:"client_ca"`   // Path to the PEM encoded CAs that sign client certificates
+	Clients    map[string]ClientIdentity `toml:"clients"`     // Client certificate names to what they may send
+}
+
+// ClientIdentity limits what a client with a certificate may send
+// Empty lists don't limit anything.
+type ClientIdentity struct {
+	Senders    []string `toml:"senders"`    // Addresses the client may use in MAIL FROM
+	Recipients []string `toml:"recipients"` // Addresses the client may send to, can include groups
+}
+
+// Dedup holds the [dedup] section of the config file
+type Dedup struct {
+	Window     Duration            `toml:"window"`     // Default window, 0 disables deduplication
+	Recipients map[string]Duration `toml:"recipients"` // Per-recipient windows, 0 disables it for the recipient
+}
+
+// Greylist holds the [greylist] section of the config file
+type Greylist struct {
+	Enabled       bool     `toml:"enabled"`
+	Delay         Duration `toml:"delay"`          // How long an unknown sender has to wait before retrying, defaults to 5m
+	WhitelistDays int      `toml:"whitelist_days"` // How long a sender that retried is accepted without waiting, defaults to 36
+}
+
+// Auth holds the [auth] section of the config file
+type Auth struct {
+	Users              map[string]string `toml:"users"`                // username to bcrypt hash of the password
+	RequireForUnlisted bool              `toml:"require_for_unlisted"` // Let hosts not in the hosts list connect if they authenticate
+	MaxFailures        int               `toml:"max_failures"`         // Failures from an IP or for a user before it is locked out
+	Lockout            Duration          `toml:"lockout"`              // How long a lockout lasts, and how long failures are remembered
+	Backoff            Duration          `toml:"backoff"`              // Delay after the first failure, doubling with each one
+	AllowInsecureAuth  bool              `toml:"allow_insecure_auth"`  // Allow AUTH without TLS, with the passwords sent in the clear
+}
+
+// Scan holds the [scan] section of the config file
+type Scan struct {
+	Command    []string `toml:"command"`     // Scanner to run with the message on stdin, it exits with 1 for spam
+	Timeout    Duration `toml:"timeout"`     // How long the scanner can take, defaults to 60s
+	AsyncHosts []string `toml:"async_hosts"` // Hosts whose mail is delivered first and scanned afterwards
+	Folder     string   `toml:"folder"`      // Folder that spam from async_hosts is moved to, defaults to Junk
+}
+
+// Filters holds the [filters] section of the config file
+type Filters struct {
+	GlobalDir string              `toml:"global_dir"` // Directory of Sieve scripts that can be included, named <name>.sieve
+	Domains   map[string]string   `toml:"domains"`    // Domain to the global script for users without their own filter
+	Folders   map[string][]string `toml:"folders"`    // Domain to the folders every new maildir starts with
+}
+
+// Clamd holds the [clamd] section of the config file
+type Clamd struct {
+	Address    string   `toml:"address"`    // host:port or path of clamd's socket, "" to disable
+	Action     string   `toml:"action"`     // reject or quarantine infected messages
+	Quarantine string   `toml:"quarantine"` // Maildir that quarantined messages are delivered to
+	OnError    string   `toml:"on_error"`   // defer or tag messages when clamd can't scan them
+	Timeout    Duration `toml:"timeout"`    // How long clamd can take, defaults to 30s
+}
+
+// SpamFilter holds the [spam_filter] section of the config file
+type SpamFilter struct {
+	Type          string   `toml:"type"`           // rspamd or spamd
+	Address       string   `toml:"address"`        // rspamd's URL, or host:port or path of spamd's socket, "" to disable
+	Timeout       Duration `toml:"timeout"`        // How long the filter can take, defaults to 30s
+	HeaderScore   float64  `toml:"header_score"`   // Score at which X-Spam-Flag: YES is added, 0 disables it
+	JunkScore     float64  `toml:"junk_score"`     // Score at which mail is delivered to the folder, 0 disables it
+	GreylistScore float64  `toml:"greylist_score"` // Score at which the first try is deferred, 0 disables it
+	RejectScore   float64  `toml:"reject_score"`   // Score at which mail is rejected, 0 disables it
+	GreylistDelay Duration `toml:"greylist_delay"` // How long a greylisted sender has to wait, defaults to 5m
+	Folder        string   `toml:"folder"`         // Folder that junk is delivered to, defaults to Junk
+	OnError       string   `toml:"on_error"`       // defer or accept messages when the filter can't check them
+}
+
+// Milter is one of the [[milters]] in the config file
+type Milter struct {
+	Name       string   `toml:"name"`       // Name for the log, defaults to the address
+	Address    string   `toml:"address"`    // host:port or path of the milter's socket
+	Timeout    Duration `toml:"timeout"`    // How long the milter can take, defaults to 30s
+	OnError    string   `toml:"on_error"`   // defer or accept messages when the milter fails
+	Quarantine string   `toml:"quarantine"` // Maildir for messages it quarantines, the recipients' Junk folders if ""
+}
+
+// WasmFilter is one of the [[wasm_filters]] in the config file
+type WasmFilter struct {
+	Name    string   `toml:"name"`     // Name for the log, defaults to the module's path
+	Module  string   `toml:"module"`   // Path to the WebAssembly module
+	Timeout Duration `toml:"timeout"`  // How long each hook can take, defaults to 5s
+	OnError string   `toml:"on_error"` // defer or accept messages when the module fails
+}
+
+// DKIM holds the [dkim] section of the config file
+type DKIM struct {
+	Verify        bool     `toml:"verify"`         // Check signatures and add an Authentication-Results header
+	RejectDomains []string `toml:"reject_domains"` // Reject mail From: these domains without a valid signature from them
+}
+
+// Relay holds the [relay] section of the config file
+type Relay struct {
+	Host       string   `toml:"host"`        // Smarthost to relay non-local recipients to, relaying is off if empty
+	Port       int      `toml:"port"`        // Smarthost port, defaults to 25
+	Username   string   `toml:"username"`    // Username for AUTH PLAIN, no AUTH if empty
+	Password   string   `toml:"password"`    // Password for AUTH PLAIN
+	RequireTLS bool     `toml:"require_tls"` // Fail instead of relaying without STARTTLS
+	Allow      []string `toml:"allow"`       // Recipients that may be relayed, all of them if empty
+	Deny       []string `toml:"deny"`        // Recipients that may not be relayed, even if allowed
+	MaxHourly  int      `toml:"max_hourly"`  // Recipients relayed in any hour, 0 for no limit
+	MaxDaily   int      `toml:"max_daily"`   // Recipients relayed in any day, 0 for no limit
+
+	Domains map[string]RelayDomain `toml:"domains"` // Limits for each recipient domain, "*" for the domains not listed
+}
+
+// RelayDomain holds the limits on relaying to one recipient domain, from [relay.domains]
+type RelayDomain struct {
+	MaxConnections int `toml:"max_connections"` // Relay connections open at once for the domain, 0 for no limit
+	MaxPerMinute   int `toml:"max_per_minute"`  // Messages relayed to the domain in any minute, 0 for no limit
+	MaxHourly      int `toml:"max_hourly"`      // Messages relayed to the domain in any hour, 0 for no limit
+}
+
+// Queue holds the [queue] section of the config file
+type Queue struct {
+	Dir        string   `toml:"dir"`         // Directory to spool failed deliveries to, the queue is off if empty
+	Retry      Duration `toml:"retry"`       // Delay before the first retry, doubled after each failure, defaults to 1m
+	MaxRetry   Duration `toml:"max_retry"`   // Longest delay between retries, defaults to 1h
+	MaxAge     Duration `toml:"max_age"`     // How long to keep retrying before giving up, defaults to 5 days
+	Bounces    bool     `toml:"bounces"`     // Send the sender a bounce for recipients that are given up on
+	BounceFrom string   `toml:"bounce_from"` // Address bounces are from, defaults to MAILER-DAEMON@<hostname>
+}
+
+// Quota is the [quota] section of the config file
+type Quota struct {
+	Size  int64                `toml:"size"`  // Default quota in bytes, 0 for no limit
+	Count int64                `toml:"count"` // Default quota in messages, 0 for no limit
+	Users map[string]UserQuota `toml:"users"` // Quotas for users that don't use the default
+}
+
+// UserQuota is a user's Maildir++ quota, 0 means no limit
+type UserQuota struct {
+	Size  int64 `toml:"size"`  // bytes
+	Count int64 `toml:"count"` // messages
+}
+
+// RateLimit holds the [rate_limit] section of the config file
+/*
+   Example TOML:
+
+   [rate_limit]
+   messages = 30
+   sender_messages = 10
+   burst = 20
+   connections = 5
+   max_connections = 100
+   connection_wait = "10s"
+*/
+type RateLimit struct {
+	Messages       float64  `toml:"messages"`        // Messages per minute from each client IP, 0 for no limit
+	SenderMessages float64  `toml:"sender_messages"` // Messages per minute from each MAIL FROM address, 0 for no limit
+	Burst          int      `toml:"burst"`           // Messages that can be sent at once, defaults to the per minute rate
+	Connections    int      `toml:"connections"`     // Concurrent connections from each client IP, 0 for no limit
+	MaxConnections int      `toml:"max_connections"` // Concurrent connections from all clients, 0 for no limit
+	ConnectionWait Duration `toml:"connection_wait"` // How long a connection waits for a slot at max_connections, defaults to 10s
+}
+
+// DNSBL holds the [dnsbl] section of the config file
+/*
+   Example TOML:
+
+   [dnsbl]
+   zones = ["zen.spamhaus.org", "bl.spamcop.net"]
+   timeout = "2s"
+   cache_ttl = "15m"
+   action = "tag"
+*/
+type DNSBL struct {
+	Zones    []string `toml:"zones"`     // Blocklists to look up connecting clients in
+	Action   string   `toml:"action"`    // reject listed clients, or tag their mail dnsbl-hit
+	Timeout  Duration `toml:"timeout"`   // How long to wait for the lookups before letting the client in
+	CacheTTL Duration `toml:"cache_ttl"` // How long to remember the result for a client IP
+}
+
+// Listener is an extra address to accept mail on, with its own hostname
+/*
+   Example TOML:
+
+   hostname = "mx.domain.com"
+   listen = ["127.0.0.1:25", "[::1]:25"]
+
+   [[listeners]]
+   address = "192.168.1.2:25"
+   hostname = "mx.other.org"
+
+   [[listeners]]
+   address = "192.168.1.2:587"
+   require_tls = true
+   require_auth = true
+
+   [[listeners]]
+   socket = "/run/letterbox/lmtp.sock"
+   protocol = "lmtp"
+   max_message_size = 52428800
+
+   The hostname is used in the banner, in the Received header, and to greet the
+   smarthost when relaying mail that arrived on the listener. It defaults to the
+   top level hostname, which defaults to the system's hostname.
+
+   The first listen address replaces -host and -port, unless -socket is set,
+   and the others are served like listeners without any settings.
+
+   Every listener shares the same recipients, delivery, and queue, so one
+   letterbox can be the MX, the submission server, and the LMTP server for a
+   mail store at once.
+*/
+type Listener struct {
+	Address        string `toml:"address"`
+	Socket         string `toml:"socket"` // Path to a Unix socket to listen on instead of an address
+	Hostname       string `toml:"hostname"`
+	Protocol       string `toml:"protocol"`         // smtp or lmtp, defaults to the top level protocol
+	MaxMessageSize int64  `toml:"max_message_size"` // Largest message in bytes, defaults to the top level max_message_size
+	RequireTLS     bool   `toml:"require_tls"`      // Refuse mail until the client has used STARTTLS
+	RequireAuth    bool   `toml:"require_auth"`     // Refuse mail from clients that haven't authenticated, even from the hosts list
+}
+
+// Forward is the forwarding rule for one user, from a [[forwards]] section of the config file
+/*
+   Example TOML:
+
+   [[forwards]]
+   user = "bcl"
+   to = ["bcl@provider.com"]
+   keep_local_copy = true
+
+   [[forwards]]
+   user = "alice"
+   to = ["alice@work.com", "group:assistants"]
+
+   [[forwards]]
+   user = "pager"
+   to = ["phone@sms.provider.com"]
+   schedule = "!workhours"
+
+   Users are matched after the aliases file, so an alias pointing at bcl is
+   forwarded too. Forwarded copies go to the relay host, and count against its
+   caps. Outside of its schedule the user's mail is delivered as if there was
+   no forward.
+*/
+type Forward struct {
+	User          string   `toml:"user"`            // User whose mail is forwarded
+	To            []string `toml:"to"`              // Addresses to forward the user's mail to
+	KeepLocalCopy bool     `toml:"keep_local_copy"` // Deliver to the user's maildir as well
+	Schedule      string   `toml:"schedule"`        // Only forward while this schedule is active, "" for always
+}
+
+// Pipe delivers a user's mail to a command instead of their maildir, from a [[pipes]] section of the config file
+/*
+   Example TOML:
+
+   [[pipes]]
+   user = "spamreport"
+   command = ["rspamc", "learn_spam"]
+   timeout = "30s"
+
+   [[pipes]]
+   user = "tickets"
+   command = ["/usr/local/bin/new-ticket", "--queue", "support"]
+
+   Users are matched after the aliases file, like forwards. The command
+   gets the message on stdin, with the Return-Path, Delivered-To, and
+   Received headers, and the envelope in LETTERBOX_ environment variables.
+   With a schedule the mail is only piped while it is active, and goes to
+   the user's maildir the rest of the time.
+*/
+type Pipe struct {
+	User     string   `toml:"user"`     // User whose mail is piped
+	Command  []string `toml:"command"`  // Program to run with the message on stdin
+	Timeout  Duration `toml:"timeout"`  // How long the command can take, defaults to 30s
+	Schedule string   `toml:"schedule"` // Only pipe while this schedule is active, "" for always
+}
+
+// Backend is another place to store users' mail, from a [[backends]] section of the config file
+/*
+   Example TOML:
+
+   [[backends]]
+   name = "archive"
+   type = "maildir"
+   path = "/srv/archive"
+   required = true
+
+   [[backends]]
+   name = "s3"
+   type = "command"
+   command = ["/bin/sh", "-c", "aws s3 cp - s3://mail-archive/$LETTERBOX_USER/$LETTERBOX_QUEUE_ID.eml"]
+
+   [[backends]]
+   name = "tickets"
+   type = "webhook"
+   url = "https://tickets.lan/inbound"
+   users = ["support"]
+   timeout = "10s"
+*/
+type Backend struct {
+	Name     string   `toml:"name"`     // Name for the log
+	Type     string   `toml:"type"`     // maildir, webhook, or command
+	Path     string   `toml:"path"`     // maildir: directory with a maildir for each user
+	URL      string   `toml:"url"`      // webhook: URL to POST the message to
+	Command  []string `toml:"command"`  // command: program to run with the message on stdin
+	Users    []string `toml:"users"`    // Users whose mail is stored, all of them if empty
+	Required bool     `toml:"required"` // Refuse the message if it can't be stored, instead of logging it
+	Timeout  Duration `toml:"timeout"`  // How long the webhook or command can take, defaults to 30s
+}
+
+// Webhook holds the [webhook] section of the config file
+/*
+   Example TOML:
+
+   [webhook]
+   url = "https://ntfy.lan/mail"
+   secret = "enc:..."
+   users = ["monitoring"]
+   timeout = "10s"
+   retries = 3
+
+   After each message is delivered a JSON notice is POSTed to the url. With a
+   secret the body is signed with HMAC-SHA256, in the X-Letterbox-Signature
+   header as sha256=<hex>.
+*/
+type Webhook struct {
+	URL     string   `toml:"url"`     // URL to POST the notices to, no notices if empty
+	Secret  string   `toml:"secret"`  // Key to sign the notices with
+	Users   []string `toml:"users"`   // Users whose deliveries are notified, all of them if empty
+	Timeout Duration `toml:"timeout"` // How long each try can take, defaults to 10s
+	Retries int      `toml:"retries"` // How many times a failed notice is tried again, defaults to 3
+}
+
+// Dovecot tells a dovecot on the same host about new mail, from the [dovecot] section of the config file
+/*
+   Example TOML:
+
+   [dovecot]
+   notify = true
+   doveadm = "/usr/bin/doveadm"
+
+   [dovecot.users]
+   bcl = "bcl@mydomain.com"
+
+   After each delivery to a maildir letterbox runs doveadm index -q for the
+   mailbox, so dovecot's indexer updates the mailbox's index straight away,
+   which wakes up the IMAP IDLE clients watching it. users maps letterbox users
+   to their dovecot login when it isn't the same. Folders are named like
+   dovecot's Maildir++ layout, so .Lists.go is Lists.go, and the inbox is INBOX.
+*/
+type Dovecot struct {
+	Notify  bool              `toml:"notify"`  // Run doveadm after each delivery
+	Doveadm string            `toml:"doveadm"` // Path to doveadm, found on the PATH by default
+	Users   map[string]string `toml:"users"`   // Dovecot login of users with a different name
+	Timeout Duration          `toml:"timeout"` // How long doveadm can take, defaults to 10s
+}
@@ -0,0 +1,25 @@
+package config
+
+import (
+	"github.com/BurntSushi/toml"
+	"testing"
+	"time"
+)
+
+func TestDuration(t *testing.T) {
+	var c Config
+	data := `drain_timeout = "90s"
+
+[dedup]
+window = "24h"
+`
+	if _, err := toml.Decode(data, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.DrainTimeout.Duration != 90*time.Second || c.Dedup.Window.Duration != 24*time.Hour {
+		t.Errorf("Wrong durations: %v %v", c.DrainTimeout, c.Dedup.Window)
+	}
+	if _, err := toml.Decode(`drain_timeout = "soon"`, &c); err == nil {
+		t.Error("Bad duration accepted")
+	}
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+)
+
+// Version is the version of the config file layout that letterbox reads
+// When a change would break existing config files, increment it and add a
+// migration from the old layout to migrations.
+const Version = 1
+
+// migrations upgrade a config file's keys from one version to the next
+// migrations[v] upgrades version v to version v+1.
+var migrations = []func(tree map[string]interface{}) error{
+	// Files without a config_version use the first layout
+	func(tree map[string]interface{}) error { return nil },
+}
+
+// fileVersion returns the config_version of the config file, 0 if it doesn't have one
+func fileVersion(tree map[string]interface{}) (int, error) {
+	v, ok := tree["config_version"]
+	if !ok {
+		return 0, nil
+	}
+	version, ok := v.(int64)
+	if !ok || version < 1 {
+		return 0, fmt.Errorf("bad config_version %v", v)
+	}
+	if version > Version {
+		return 0, fmt.Errorf("config_version %d is newer than this letterbox supports (%d)", version, Version)
+	}
+	return int(version), nil
+}
+
+// Migrate upgrades the keys of a decoded config file to the current version
+// It returns the version the file was at.
+func Migrate(tree map[string]interface{}) (int, error) {
+	version, err := fileVersion(tree)
+	if err != nil {
+		return 0, err
+	}
+	for v := version; v < Version; v++ {
+		if err := migrations[v](tree); err != nil {
+			return 0, fmt.Errorf("migrating config_version %d: %s", v, err)
+		}
+	}
+	tree["config_version"] = int64(Version)
+	return version, nil
+}
+
+// Decode decodes the config file in data into c, migrating it from an older version
+// rewrite, if it isn't nil, can change the file's values before they are
+// decoded, like decrypting them, and returns true if it changed any. Decode
+// returns the version the file was at.
+func Decode(data []byte, c *Config, rewrite func(tree map[string]interface{}) (bool, error)) (int, error) {
+	var tree map[string]interface{}
+	if _, err := toml.Decode(string(data), &tree); err != nil {
+		return 0, err
+	}
+	version, err := Migrate(tree)
+	if err != nil {
+		return 0, err
+	}
+	changed := false
+	if rewrite != nil {
+		if changed, err = rewrite(tree); err != nil {
+			return 0, err
+		}
+	}
+	if version == Version && !changed {
+		_, err = toml.Decode(string(data), c)
+		return version, err
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(tree); err != nil {
+		return 0, err
+	}
+	_, err = toml.Decode(buf.String(), c)
+	return version, err
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	var c Config
+	version, err := Decode([]byte("hosts = [\"127.0.0.1\"]\n"), &c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 || c.ConfigVersion != Version || len(c.Hosts) != 1 {
+		t.Errorf("Unversioned file decoded as version %d: %#v", version, c)
+	}
+
+	// rewrite can change values before they are decoded
+	upper := func(tree map[string]interface{}) (bool, error) {
+		tree["hostname"] = strings.ToUpper(tree["hostname"].(string))
+		return true, nil
+	}
+	c = Config{}
+	version, err = Decode([]byte("config_version = 1\nhostname = \"mx.domain.com\"\n"), &c, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != Version || c.Hostname != "MX.DOMAIN.COM" {
+		t.Errorf("Rewritten file decoded as version %d: %#v", version, c)
+	}
+
+	for _, bad := range []string{"config_version = 99", "config_version = 0", `config_version = "1"`, "hosts = ["} {
+		if _, err := Decode([]byte(bad), &c, nil); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package delivery
+
+// Backend stores the messages letterbox delivers, for a program that embeds letterbox
+type Backend interface {
+	// Store is called with each recipient's copy of a message before it is
+	// delivered to the recipient's maildir. An error refuses the recipient
+	// with a temporary failure, so the sender tries again later.
+	Store(msg Message) error
+}
+
+// Message is one recipient's copy of a message, with the headers letterbox adds
+type Message struct {
+	User    string // user whose maildir the message is delivered to
+	Rcpt    string // recipient from RCPT TO
+	From    string // envelope sender from MAIL FROM
+	QueueID string // ID of the message in the log
+	Data    []byte // the message, with its headers
+}
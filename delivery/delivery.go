@@ -0,0 +1,313 @@
+// Package delivery writes messages to maildirs and mbox files
+/*
+   A Delivery is written like a file. Maildir messages are written to tmp and
+   linked into new by Close, so a reader never sees a partial message, and
+   mbox messages are written to a temporary file and appended to the mbox
+   under its dotlock and flock.
+*/
+package delivery
+
+import (
+	"fmt"
+	"github.com/luksen/maildir"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Delivery writes a message to a maildir's tmp directory and moves it to new when it is complete
+// It is like maildir.Delivery, but it keeps track of where the message is so that
+// it can be scanned and moved after it has been delivered. Deliveries to an mbox
+// are written to a temporary file and appended to the mbox when they are closed.
+type Delivery struct {
+	Dir    maildir.Dir             // maildir the message is delivered to, the first one it was linked into after CloseTo
+	Key    string                  // name of the message file in the maildir
+	Mbox   string                  // mbox file to append the message to instead of a maildir
+	From   string                  // envelope sender for the mbox From_ line
+	Owner  func(path string) error // sets the permissions and owner of the message file and a new mbox, nil to leave them alone
+	Sync   bool                    // fsync the message and its directory before Close returns
+	Top    int64                   // end of the headers written when the delivery started, where InsertHeader adds more
+	Copies int                     // number of maildirs the message was moved to by Close
+	Linked []maildir.Dir           // maildirs the message was linked into by Close
+
+	file   *os.File
+	shared *sharedFile // tmp file shared with other deliveries of the message, nil if it has its own
+}
+
+// sharedFile is a tmp file that several deliveries link into their maildirs, made by Share
+// The first delivery writes it, and it is removed once every delivery
+// sharing it has been closed or aborted.
+type sharedFile struct {
+	writer *Delivery // delivery that writes the file, writes to the others are dropped
+	refs   int       // deliveries that haven't been closed or aborted yet
+	closed bool      // the file has been closed and its owner set
+	err    error     // error writing or closing the file, so no delivery links it
+}
+
+// New starts delivering a new message to the maildir
+func New(dir maildir.Dir) (*Delivery, error) {
+	key, err := maildir.Key()
+	if err != nil {
+		return nil, err
+	}
+	d := &Delivery{Dir: dir, Key: key}
+	d.file, err = os.OpenFile(d.TmpPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Share starts a delivery to another maildir that links this delivery's tmp file instead of writing its own
+// The maildir must be on the same filesystem.
+func (d *Delivery) Share(dir maildir.Dir) (*Delivery, error) {
+	key, err := maildir.Key()
+	if err != nil {
+		return nil, err
+	}
+	if d.shared == nil {
+		d.shared = &sharedFile{writer: d, refs: 1}
+	}
+	d.shared.refs++
+	return &Delivery{Dir: dir, Key: key, Owner: d.Owner, Sync: d.Sync, file: d.file, shared: d.shared}, nil
+}
+
+// TmpPath returns the path of the message while it is being written
+func (d *Delivery) TmpPath() string {
+	if d.Mbox != "" || d.shared != nil {
+		return d.file.Name()
+	}
+	return filepath.Join(string(d.Dir), "tmp", d.Key)
+}
+
+// Path returns the path of the message once it has been delivered
+func (d *Delivery) Path() string {
+	if d.Mbox != "" {
+		return d.Mbox
+	}
+	return filepath.Join(string(d.Dir), "new", d.Key)
+}
+
+// Location returns the maildir or mbox the message is delivered to
+func (d *Delivery) Location() string {
+	if d.Mbox != "" {
+		return d.Mbox
+	}
+	return string(d.Dir)
+}
+
+// Write adds data to the message
+// Deliveries sharing another's tmp file drop the data, it has already been written.
+func (d *Delivery) Write(p []byte) (int, error) {
+	if d.shared == nil {
+		return d.file.Write(p)
+	}
+	if d.shared.writer != d || d.shared.err != nil {
+		return len(p), d.shared.err
+	}
+	n, err := d.file.Write(p)
+	d.shared.err = err
+	return n, err
+}
+
+// InsertHeader adds a header after the ones written when the delivery started
+// Headers from checking the whole message are only known once it has all been
+// written. The rest of the message is moved down the file a chunk at a time,
+// so it doesn't have to be kept in memory. Deliveries sharing another's tmp
+// file leave it to the writer.
+func (d *Delivery) InsertHeader(header []byte) error {
+	if len(header) == 0 {
+		return nil
+	}
+	if d.shared == nil {
+		return insertAt(d.file, d.Top, header)
+	}
+	if d.shared.writer != d || d.shared.err != nil {
+		return d.shared.err
+	}
+	d.shared.err = insertAt(d.file, d.Top, header)
+	return d.shared.err
+}
+
+// insertAt writes p into the file at offset, moving what follows it down
+func insertAt(f *os.File, offset int64, p []byte) error {
+	r, err := os.Open(f.Name())
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	info, err := r.Stat()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	for end := info.Size(); end > offset; {
+		start := end - int64(len(buf))
+		if start < offset {
+			start = offset
+		}
+		chunk := buf[:end-start]
+		if _, err := r.ReadAt(chunk, start); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(chunk, start+int64(len(p))); err != nil {
+			return err
+		}
+		end = start
+	}
+	if _, err := f.WriteAt(p, offset); err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekEnd)
+	return err
+}
+
+// Close finishes writing the message and moves it from tmp to new, or appends it to the mbox
+func (d *Delivery) Close() error {
+	if d.Mbox == "" {
+		return d.CloseTo([]maildir.Dir{d.Dir})
+	}
+	defer os.Remove(d.TmpPath())
+	if err := d.file.Close(); err != nil {
+		return err
+	}
+	if err := d.appendMbox(); err != nil {
+		return err
+	}
+	d.Copies = 1
+	return nil
+}
+
+// CloseTo finishes writing the message and moves it from tmp to new in each of the maildirs
+// They must be on the same filesystem as the delivery's maildir. With no maildirs the
+// message is discarded. Afterwards path returns the first copy of the message.
+func (d *Delivery) CloseTo(dirs []maildir.Dir) error {
+	tmp := d.TmpPath()
+	defer d.release(tmp)
+	if err := d.finish(); err != nil {
+		return err
+	}
+	linked := make(map[maildir.Dir]bool)
+	for _, dir := range dirs {
+		if linked[dir] {
+			continue
+		}
+		if err := Link(tmp, filepath.Join(string(dir), "new", d.Key)); err != nil {
+			return err
+		}
+		if d.Sync {
+			if err := SyncDir(filepath.Join(string(dir), "new")); err != nil {
+				return err
+			}
+		}
+		if len(linked) == 0 {
+			d.Dir = dir
+		}
+		linked[dir] = true
+		d.Linked = append(d.Linked, dir)
+		d.Copies++
+	}
+	return nil
+}
+
+// finish closes the tmp file and sets its owner, once for all the deliveries sharing it
+func (d *Delivery) finish() error {
+	if d.shared == nil {
+		if err := d.closeFile(); err != nil {
+			return err
+		}
+		return d.setOwner(d.TmpPath())
+	}
+	if !d.shared.closed {
+		d.shared.closed = true
+		err := d.closeFile()
+		if err == nil {
+			err = d.setOwner(d.TmpPath())
+		}
+		if d.shared.err == nil {
+			d.shared.err = err
+		}
+	}
+	return d.shared.err
+}
+
+// setOwner calls Owner for a new file, if it is set
+func (d *Delivery) setOwner(path string) error {
+	if d.Owner == nil {
+		return nil
+	}
+	return d.Owner(path)
+}
+
+// closeFile closes the tmp file, syncing it to disk first with sync
+func (d *Delivery) closeFile() error {
+	if d.Sync {
+		if err := d.file.Sync(); err != nil {
+			d.file.Close()
+			return err
+		}
+	}
+	return d.file.Close()
+}
+
+// release removes the tmp file at tmp, once every delivery sharing it is done with it
+func (d *Delivery) release(tmp string) {
+	if d.shared != nil {
+		d.shared.refs--
+		if d.shared.refs > 0 {
+			return
+		}
+		if !d.shared.closed {
+			d.file.Close()
+		}
+	}
+	os.Remove(tmp)
+}
+
+// Unlink removes the copies of the message that Close linked into the maildirs
+// An mbox delivery can't be taken back, it returns an error.
+func (d *Delivery) Unlink() error {
+	if d.Mbox != "" {
+		return fmt.Errorf("can't remove a message appended to %s", d.Mbox)
+	}
+	var firstErr error
+	for _, dir := range d.Linked {
+		err := os.Remove(filepath.Join(string(dir), "new", d.Key))
+		if err == nil && d.Sync {
+			err = SyncDir(filepath.Join(string(dir), "new"))
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	d.Linked = nil
+	d.Copies = 0
+	return firstErr
+}
+
+// Size returns the number of bytes written so far, 0 if it can't be read
+func (d *Delivery) Size() int64 {
+	// The writer of a shared file may have closed it already
+	if d.shared != nil {
+		info, err := os.Stat(d.TmpPath())
+		if err != nil {
+			return 0
+		}
+		return info.Size()
+	}
+	info, err := d.file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Abort stops writing the message and removes it from tmp
+func (d *Delivery) Abort() error {
+	if d.shared != nil {
+		d.release(d.TmpPath())
+		return nil
+	}
+	d.file.Close()
+	return os.Remove(d.TmpPath())
+}
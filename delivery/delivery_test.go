@@ -0,0 +1,182 @@
+package delivery
+
+import (
+	"github.com/luksen/maildir"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := maildir.Dir(filepath.Join(dir, "bcl"))
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	del, err := New(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	del.Write([]byte("Subject: test\r\n\r\nHello\r\n"))
+	if _, err := os.Stat(del.TmpPath()); err != nil {
+		t.Errorf("Message not in tmp while writing: %s", err)
+	}
+	if err := del.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(del.TmpPath()); !os.IsNotExist(err) {
+		t.Error("Message left in tmp after Close")
+	}
+	if data, err := ioutil.ReadFile(del.Path()); err != nil || string(data) != "Subject: test\r\n\r\nHello\r\n" {
+		t.Errorf("Wrong message delivered: %q %v", data, err)
+	}
+
+	del, err = New(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	del.Write([]byte("partial"))
+	if err := del.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(del.TmpPath()); !os.IsNotExist(err) {
+		t.Error("Message left in tmp after Abort")
+	}
+	if _, err := os.Stat(del.Path()); !os.IsNotExist(err) {
+		t.Error("Aborted message was delivered")
+	}
+}
+
+func TestInsertHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := maildir.Dir(filepath.Join(dir, "bcl"))
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	del, err := New(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace := "Return-Path: <sender@domain.com>\r\n"
+	del.Write([]byte(trace))
+	del.Top = int64(len(trace))
+	// The message is bigger than the chunks it is moved in
+	body := "Subject: test\r\n\r\n" + strings.Repeat("Hello\r\n", 10000)
+	del.Write([]byte(body))
+	header := "Authentication-Results: mx.domain.com;\r\n\tdkim=none\r\n"
+	if err := del.InsertHeader([]byte(header)); err != nil {
+		t.Fatal(err)
+	}
+	del.Write([]byte("Bye\r\n"))
+	if err := del.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(del.Path()); err != nil || string(data) != trace+header+body+"Bye\r\n" {
+		t.Errorf("Wrong message delivered: %.200q %v", data, err)
+	}
+}
+
+func TestSharedDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var dels []*Delivery
+	for _, user := range []string{"bcl", "alice", "bob"} {
+		d := maildir.Dir(filepath.Join(dir, user))
+		if err := d.Create(); err != nil {
+			t.Fatal(err)
+		}
+		var del *Delivery
+		if len(dels) == 0 {
+			del, err = New(d)
+		} else {
+			del, err = dels[0].Share(d)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		del.Write([]byte("Subject: test\r\n"))
+		dels = append(dels, del)
+	}
+	if dels[1].TmpPath() != dels[0].TmpPath() || dels[1].Path() == dels[0].Path() {
+		t.Fatalf("Shared deliveries have the wrong paths: %s %s", dels[1].TmpPath(), dels[1].Path())
+	}
+	if data, err := ioutil.ReadFile(dels[0].TmpPath()); err != nil || string(data) != "Subject: test\r\n" {
+		t.Errorf("Shared file written more than once: %q %v", data, err)
+	}
+
+	// Aborting one recipient leaves the file for the others
+	if err := dels[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	dels[1].Abort()
+	if dels[2].Size() != int64(len("Subject: test\r\n")) {
+		t.Errorf("Wrong size of shared file: %d", dels[2].Size())
+	}
+	if err := dels[2].Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dels[0].TmpPath()); !os.IsNotExist(err) {
+		t.Error("Shared file left in tmp")
+	}
+	first, err := os.Stat(dels[0].Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := os.Stat(dels[2].Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(first, last) {
+		t.Error("Message wasn't hardlinked")
+	}
+	if _, err := os.Stat(dels[1].Path()); !os.IsNotExist(err) {
+		t.Error("Aborted recipient got the message")
+	}
+}
+
+func TestSyncDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := maildir.Dir(filepath.Join(dir, "bcl"))
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	del, err := New(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var owned []string
+	del.Sync = true
+	del.Owner = func(path string) error {
+		owned = append(owned, path)
+		return nil
+	}
+	tmp := del.TmpPath()
+	del.Write([]byte("Subject: test\r\n\r\nHello\r\n"))
+	if err := del.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(del.Path()); err != nil || string(data) != "Subject: test\r\n\r\nHello\r\n" {
+		t.Errorf("Wrong message delivered: %q %v", data, err)
+	}
+	if len(owned) != 1 || owned[0] != tmp {
+		t.Errorf("Owner called for %v, expected %s", owned, tmp)
+	}
+}
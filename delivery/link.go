@@ -0,0 +1,79 @@
+package delivery
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// crossDevice returns true if a link or rename failed because the paths are on different filesystems
+// This happens when a maildir's new/ or cur/ is a bind mount, or on overlayfs.
+func crossDevice(err error) bool {
+	var le *os.LinkError
+	return errors.As(err, &le) && le.Err == syscall.EXDEV
+}
+
+// Link hardlinks a message into a maildir, copying it if they are on different filesystems
+func Link(src, dst string) error {
+	err := os.Link(src, dst)
+	if !crossDevice(err) {
+		return err
+	}
+	log.Printf("%s and %s are on different filesystems, copying the message", filepath.Dir(src), filepath.Dir(dst))
+	return copyMessage(src, dst)
+}
+
+// Rename moves a message into a maildir, copying it and removing the original if they are on different filesystems
+func Rename(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !crossDevice(err) {
+		return err
+	}
+	log.Printf("%s and %s are on different filesystems, copying the message", filepath.Dir(src), filepath.Dir(dst))
+	if err := copyMessage(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyMessage copies a message to dst and syncs it to disk
+// The copy is written to a dot file next to dst, which maildir readers
+// ignore, and renamed into place so a partial message is never seen. It keeps
+// the original's permissions, and its owner when letterbox can set it.
+func copyMessage(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".copy")
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		if err := os.Lchown(tmp, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,89 @@
+package delivery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func writeTestMessage(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCrossDevice(t *testing.T) {
+	if !crossDevice(&os.LinkError{Op: "link", Old: "a", New: "b", Err: syscall.EXDEV}) {
+		t.Error("EXDEV not recognized")
+	}
+	if crossDevice(&os.LinkError{Op: "link", Old: "a", New: "b", Err: syscall.EEXIST}) || crossDevice(nil) {
+		t.Error("Other errors treated as EXDEV")
+	}
+}
+
+func TestCopyMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "tmp", "1000.1.host")
+	dst := filepath.Join(dir, "new", "1000.1.host")
+	writeTestMessage(t, src, "Subject: hi\r\n\r\nHi\r\n")
+	os.MkdirAll(filepath.Dir(dst), 0700)
+	if err := copyMessage(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(dst)
+	if err != nil || string(data) != "Subject: hi\r\n\r\nHi\r\n" {
+		t.Errorf("Wrong copy: %q %v", data, err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Dir(dst)); len(files) != 1 {
+		t.Errorf("Temporary copy left behind: %d files", len(files))
+	}
+	if err := copyMessage(src, filepath.Join(dir, "missing", "1000.1.host")); err == nil {
+		t.Error("Copy to a missing directory succeeded")
+	}
+}
+
+// TestRenameAcrossDevices needs a second filesystem, like /dev/shm, to move a message to
+func TestRenameAcrossDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	other, err := ioutil.TempDir("/dev/shm", "letterbox-")
+	if err != nil {
+		t.Skip("No /dev/shm to move messages to")
+	}
+	defer os.RemoveAll(other)
+	src := filepath.Join(dir, "1000.1.host")
+	writeTestMessage(t, src, "Hi\r\n")
+	if err := os.Link(src, filepath.Join(other, "probe")); !crossDevice(err) {
+		t.Skipf("%s and %s are on the same filesystem", dir, other)
+	}
+
+	dst := filepath.Join(other, "1000.1.host")
+	if err := Rename(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("Original not removed: %v", err)
+	}
+	if data, err := ioutil.ReadFile(dst); err != nil || string(data) != "Hi\r\n" {
+		t.Errorf("Wrong message moved: %q %v", data, err)
+	}
+	writeTestMessage(t, src, "Again\r\n")
+	if err := Link(src, filepath.Join(other, "1001.1.host")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("Original removed by Link: %s", err)
+	}
+}
@@ -0,0 +1,150 @@
+package delivery
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// mboxLockTimeout is how long to wait for another program to unlock an mbox
+const mboxLockTimeout = 30 * time.Second
+
+// mboxStaleLock is how old a dotlock can be before it is assumed to be left over from a crash
+const mboxStaleLock = 5 * time.Minute
+
+// NewMbox starts delivering a new message to an mbox file
+// The message is written to a temporary file next to the mbox and appended
+// to it when the delivery is closed.
+func NewMbox(mbox, from string) (*Delivery, error) {
+	f, err := ioutil.TempFile(filepath.Dir(mbox), "."+filepath.Base(mbox)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &Delivery{Mbox: mbox, From: from, file: f}, nil
+}
+
+// mboxFromLine returns the From_ line that starts a message in an mbox
+func mboxFromLine(from string, now time.Time) string {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	return fmt.Sprintf("From %s %s\n", from, now.UTC().Format(time.ANSIC))
+}
+
+// WriteMbox copies a message to an mbox in mboxrd format
+// Line endings are converted to LF, lines starting with From_ or >From_ get
+// another >, and the message is followed by a blank line.
+func WriteMbox(w io.Writer, r io.Reader, from string, now time.Time) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(mboxFromLine(from, now))
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+			if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+				bw.WriteByte('>')
+			}
+			bw.Write(line)
+			bw.WriteByte('\n')
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	bw.WriteByte('\n')
+	return bw.Flush()
+}
+
+// lockMbox takes the dotlock and the flock on an open mbox
+// Both are used because different mail readers use one or the other. The
+// returned function removes them.
+func lockMbox(f *os.File, mbox string) (func(), error) {
+	lock := mbox + ".lock"
+	deadline := time.Now().Add(mboxLockTimeout)
+	for {
+		l, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(l, "%d\n", os.Getpid())
+			l.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > mboxStaleLock {
+			log.Printf("Removing stale lock %s", lock)
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s", lock)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		os.Remove(lock)
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		os.Remove(lock)
+	}, nil
+}
+
+// appendMbox appends the finished message to the delivery's mbox
+// If the write fails the mbox is truncated back to where it was, so a partly
+// written message doesn't corrupt it.
+func (d *Delivery) appendMbox() error {
+	msg, err := os.Open(d.file.Name())
+	if err != nil {
+		return err
+	}
+	defer msg.Close()
+
+	_, err = os.Stat(d.Mbox)
+	created := os.IsNotExist(err)
+	f, err := os.OpenFile(d.Mbox, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if created {
+		if err := d.setOwner(d.Mbox); err != nil {
+			return err
+		}
+		if d.Sync {
+			if err := SyncDir(filepath.Dir(d.Mbox)); err != nil {
+				return err
+			}
+		}
+	}
+	unlock, err := lockMbox(f, d.Mbox)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := WriteMbox(f, msg, d.From, time.Now()); err != nil {
+		f.Truncate(info.Size())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Truncate(info.Size())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package delivery
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteMbox(t *testing.T) {
+	now := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	msg := "Subject: test\r\n\r\nFrom here\r\n>From there\r\nFrom: not a header\r\n Fromage\r\nlast"
+	var buf bytes.Buffer
+	if err := WriteMbox(&buf, strings.NewReader(msg), "bcl@domain.com", now); err != nil {
+		t.Fatal(err)
+	}
+	expected := "From bcl@domain.com Wed Mar  4 05:06:07 2020\n" +
+		"Subject: test\n\n>From here\n>>From there\nFrom: not a header\n Fromage\nlast\n\n"
+	if buf.String() != expected {
+		t.Errorf("WriteMbox = %q, expected %q", buf.String(), expected)
+	}
+
+	if line := mboxFromLine("", now); !strings.HasPrefix(line, "From MAILER-DAEMON ") {
+		t.Errorf("Null sender From_ line is %q", line)
+	}
+}
+
+func TestAppendMbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mbox := filepath.Join(dir, "bcl.mbox")
+
+	// Deliveries running at the same time don't mix up their messages
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d, err := NewMbox(mbox, "sender@domain.com")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for j := 0; j < 100; j++ {
+				fmt.Fprintf(d, "message %d line %d\r\n", i, j)
+			}
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	data, err := ioutil.ReadFile(mbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := strings.Split(string(data), "\n\nFrom ")
+	if len(messages) != 10 {
+		t.Fatalf("%d messages in the mbox, expected 10", len(messages))
+	}
+	for _, m := range messages {
+		lines := strings.Split(strings.TrimSpace(m), "\n")[1:]
+		prefix := strings.Fields(lines[0])[1]
+		for _, line := range lines {
+			if strings.Fields(line)[1] != prefix {
+				t.Fatalf("Messages %s and %s are interleaved", prefix, strings.Fields(line)[1])
+			}
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, ".bcl.mbox.tmp*")); len(files) != 0 {
+		t.Errorf("%d temporary files left", len(files))
+	}
+
+	// A stale dotlock is removed
+	lock := mbox + ".lock"
+	if err := ioutil.WriteFile(lock, []byte("1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * mboxStaleLock)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewMbox(mbox, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Write([]byte("Subject: after the lock\r\n\r\n"))
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Error("Dotlock left behind")
+	}
+}
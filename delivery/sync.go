@@ -0,0 +1,15 @@
+package delivery
+
+import (
+	"os"
+)
+
+// SyncDir fsyncs a directory, so the files created, linked, or renamed in it are on disk
+func SyncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,22 @@
+package delivery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := SyncDir(dir); err != nil {
+		t.Errorf("Syncing %s failed: %s", dir, err)
+	}
+	if err := SyncDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Syncing a missing directory didn't fail")
+	}
+}
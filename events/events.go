@@ -0,0 +1,216 @@
+// Package events defines the delivery events letterbox sends to plugins
+/*
+   Plugins are either Go plugins built with -buildmode=plugin, or long-running
+   external processes that exchange JSON with letterbox over stdin and stdout.
+
+   A Go plugin must export a NewHandler function:
+
+       func NewHandler() events.Handler
+
+   An external process is sent one Event per line as JSON on its stdin. For
+   connect and rcpt events it must reply with one Reply per line on stdout,
+   delivered and reject events are notifications and expect no reply.
+*/
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"plugin"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	Connect   = "connect"
+	Rcpt      = "rcpt"
+	Delivered = "delivered"
+	Reject    = "reject"
+)
+
+// Reason codes for reject events, so that rejections can be counted and
+// filtered without parsing the reason text
+const (
+	ReasonHostNotAllowed = "host-not-allowed" // client IP isn't in the hosts list
+	ReasonAuthRequired   = "auth-required"    // client has to authenticate before sending
+	ReasonRcptNotAllowed = "rcpt-not-allowed" // recipient isn't in the emails list or relay rules
+	ReasonCertNotAllowed = "cert-not-allowed" // client certificate may not use the sender or recipient
+	ReasonSchedule       = "schedule"         // recipient is outside of its schedule
+	ReasonNoSuchFolder   = "no-such-folder"   // plus address folder doesn't exist
+	ReasonPlugin         = "plugin"           // a plugin rejected it
+	ReasonLua            = "lua"              // the Lua script rejected it
+	ReasonSpamScore      = "spam-score"       // the scanner said the message is spam
+	ReasonScanFailed     = "scan-failed"      // the scanner couldn't scan the message
+	ReasonShuttingDown   = "shutting-down"    // letterbox is shutting down
+	ReasonSPFFail        = "spf-fail"         // SPF failed, or couldn't be checked, for the sender's domain
+	ReasonDKIMFail       = "dkim-fail"        // no valid DKIM signature from a domain in dkim.reject_domains
+	ReasonMailboxFull    = "mailbox-full"     // the recipient's mailbox is over its quota
+	ReasonAuthFailed     = "auth-failed"      // AUTH with the wrong username or password
+	ReasonAuthLocked     = "auth-locked"      // AUTH from an IP or for a username that failed too many times
+	ReasonRateLimit      = "rate-limit"       // the client IP or sender is over its connection or message rate limit
+	ReasonDNSBL          = "dnsbl"            // the client IP is on a DNS blocklist
+	ReasonSenderDomain   = "sender-domain"    // the sender's domain doesn't exist or accept mail, or couldn't be looked up
+	ReasonTLSRequired    = "tls-required"     // the listener requires STARTTLS before sending
+	ReasonDate           = "bad-date"         // the Date header is too far from the server's time, or invalid
+	ReasonVirus          = "virus"            // clamd found a virus in the message
+	ReasonGreylist       = "greylist"         // the sender is greylisted, or the spam filter's score greylisted the message
+	ReasonMilter         = "milter"           // a milter rejected the message
+	ReasonTooBig         = "too-big"          // the message is larger than the recipient_max_sizes limit
+	ReasonHeld           = "held"             // delivery to the recipient is paused with letterbox hold
+	ReasonBadMailbox     = "bad-mailbox"      // the recipient's name can't be used for its maildir
+	ReasonWasm           = "wasm"             // a WebAssembly filter rejected it
+)
+
+// Event describes something that happened during an SMTP session
+// Fields that don't apply to the event are left empty.
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	ClientIP   string    `json:"client_ip"`
+	Helo       string    `json:"helo,omitempty"`
+	TLSVersion string    `json:"tls_version,omitempty"`
+	TLSCipher  string    `json:"tls_cipher,omitempty"`
+	AuthUser   string    `json:"auth_user,omitempty"`
+	From       string    `json:"from,omitempty"`
+	Rcpt       string    `json:"rcpt,omitempty"`
+	Maildir    string    `json:"maildir,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Code       string    `json:"code,omitempty"` // one of the Reason codes, for reject events
+}
+
+// Handler receives events from letterbox
+// Returning an error from OnConnect or OnRcpt rejects the connection or recipient,
+// the error's text is used as the reason.
+type Handler interface {
+	OnConnect(ev Event) error
+	OnRcpt(ev Event) error
+	OnDelivered(ev Event)
+	OnReject(ev Event)
+}
+
+// Reply is the response from an external process to a connect or rcpt event
+type Reply struct {
+	Action  string `json:"action"` // "accept" or "reject"
+	Message string `json:"message,omitempty"`
+}
+
+// LoadPlugin opens a Go plugin and returns the Handler from its NewHandler function
+func LoadPlugin(path string) (Handler, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup("NewHandler")
+	if err != nil {
+		return nil, err
+	}
+	newHandler, ok := sym.(func() Handler)
+	if !ok {
+		return nil, fmt.Errorf("%s: NewHandler is %T, not func() events.Handler", path, sym)
+	}
+	return newHandler(), nil
+}
+
+// Process is a Handler that passes events to an external process
+type Process struct {
+	sync.Mutex
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+// StartProcess runs the command and returns a Handler that sends events to it
+// The process' stderr is passed through to letterbox's stderr.
+func StartProcess(command []string) (*Process, error) {
+	if len(command) == 0 {
+		return nil, errors.New("empty plugin command")
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &Process{cmd: cmd, in: in, out: bufio.NewReader(out)}, nil
+}
+
+// send writes the event to the process and, if wantReply is true, reads its reply
+func (p *Process) send(ev Event, wantReply bool) (Reply, error) {
+	var reply Reply
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return reply, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if _, err := p.in.Write(append(data, '\n')); err != nil {
+		return reply, err
+	}
+	if !wantReply {
+		return reply, nil
+	}
+	line, err := p.out.ReadBytes('\n')
+	if err != nil {
+		return reply, err
+	}
+	err = json.Unmarshal(line, &reply)
+	return reply, err
+}
+
+// decide sends an event that needs a reply and turns a reject into an error
+// If the process fails the event is accepted, a broken plugin shouldn't stop mail.
+func (p *Process) decide(ev Event) error {
+	reply, err := p.send(ev, true)
+	if err != nil {
+		log.Printf("Error from plugin %s: %s", p.cmd.Path, err)
+		return nil
+	}
+	if reply.Action == "reject" {
+		if reply.Message == "" {
+			reply.Message = "rejected by plugin"
+		}
+		return errors.New(reply.Message)
+	}
+	return nil
+}
+
+// OnConnect passes the connect event to the process
+func (p *Process) OnConnect(ev Event) error {
+	return p.decide(ev)
+}
+
+// OnRcpt passes the rcpt event to the process
+func (p *Process) OnRcpt(ev Event) error {
+	return p.decide(ev)
+}
+
+// OnDelivered passes the delivered event to the process
+func (p *Process) OnDelivered(ev Event) {
+	p.send(ev, false)
+}
+
+// OnReject passes the reject event to the process
+func (p *Process) OnReject(ev Event) {
+	p.send(ev, false)
+}
+
+// Close closes the process' stdin and waits for it to exit
+func (p *Process) Close() error {
+	p.in.Close()
+	return p.cmd.Wait()
+}
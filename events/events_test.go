@@ -0,0 +1,41 @@
+package events
+
+import (
+	"testing"
+)
+
+func TestProcess(t *testing.T) {
+	// Reject every event that needs a reply
+	p, err := StartProcess([]string{"sh", "-c", `while read ev; do
+		case "$ev" in
+		*'"type":"connect"'*|*'"type":"rcpt"'*) echo '{"action":"reject","message":"not today"}';;
+		esac
+	done`})
+	if err != nil {
+		t.Fatalf("Error starting process: %s", err)
+	}
+
+	p.OnReject(Event{Type: Reject, ClientIP: "10.0.0.1"})
+	if err := p.OnConnect(Event{Type: Connect, ClientIP: "10.0.0.1"}); err == nil || err.Error() != "not today" {
+		t.Errorf("Connect not rejected: %v", err)
+	}
+	p.OnDelivered(Event{Type: Delivered, ClientIP: "10.0.0.1"})
+	if err := p.OnRcpt(Event{Type: Rcpt, ClientIP: "10.0.0.1", Rcpt: "user@domain.com"}); err == nil {
+		t.Error("Rcpt not rejected")
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("Error closing process: %s", err)
+	}
+}
+
+func TestProcessAccept(t *testing.T) {
+	p, err := StartProcess([]string{"sh", "-c", `while read ev; do echo '{"action":"accept"}'; done`})
+	if err != nil {
+		t.Fatalf("Error starting process: %s", err)
+	}
+	defer p.Close()
+
+	if err := p.OnRcpt(Event{Type: Rcpt, ClientIP: "10.0.0.1", Rcpt: "user@domain.com"}); err != nil {
+		t.Errorf("Rcpt rejected: %s", err)
+	}
+}
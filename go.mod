@@ -1,9 +1,12 @@
 module github.com/bcl/letterbox
 
-go 1.13
+go 1.22.0
 
 require (
 	github.com/BurntSushi/toml v0.3.1
-	github.com/bradfitz/go-smtpd v0.0.0-20170404230938-deb6d6237625
 	github.com/luksen/maildir v0.0.0-20180118131156-1859503b54bd
+	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/tetratelabs/wazero v1.9.0
+	github.com/yuin/gopher-lua v0.0.0-20200816102855-ee81675732da
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
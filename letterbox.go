@@ -0,0 +1,29 @@
+// Package letterbox runs an SMTP to maildir delivery agent inside another Go program
+/*
+   The letterbox command is built from cmd/letterbox. The packages under this
+   one hold its parts: config has the settings from letterbox.toml, access
+   matches clients against host lists, delivery writes maildirs and mbox
+   files, and server accepts and delivers the mail.
+
+       s := letterbox.Server{
+           Config:          config.Config{Hosts: []string{"127.0.0.1"}, Emails: []string{"bcl@example.com"}},
+           Maildirs:        "/var/spool/maildirs",
+           DeliveryBackend: archive,
+       }
+       log.Fatal(s.ListenAndServe("127.0.0.1:2525"))
+*/
+package letterbox
+
+import (
+	"github.com/bcl/letterbox/delivery"
+	"github.com/bcl/letterbox/server"
+)
+
+// Server is letterbox run from another Go program, see server.Server
+type Server = server.Server
+
+// DeliveryBackend stores each recipient's copy of a message before it is delivered to the maildir
+type DeliveryBackend = delivery.Backend
+
+// Message is one recipient's copy of a message, as given to a DeliveryBackend
+type Message = delivery.Message
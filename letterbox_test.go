@@ -0,0 +1,30 @@
+package letterbox
+
+import (
+	"github.com/bcl/letterbox/config"
+	"net"
+	"strings"
+	"testing"
+)
+
+// discard is a DeliveryBackend that accepts every message
+type discard struct{}
+
+func (discard) Store(msg Message) error {
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := Server{
+		Config:          config.Config{Protocol: "uucp"},
+		DeliveryBackend: discard{},
+	}
+	if err := s.Serve(ln); err == nil || !strings.Contains(err.Error(), "unknown protocol") {
+		t.Errorf("Bad config not refused: %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// aliases maps lowercase local names to their targets, read from the aliases file
+var aliases map[string][]string
+var aliasesLock sync.RWMutex
+
+// readAliases reads an /etc/aliases style file
+/*
+   Each line is a name, a colon, and a comma separated list of targets.
+   Lines starting with whitespace continue the previous line, and # starts a comment.
+   Targets that are commands, files, or includes are skipped. Targets can also be
+   group:name to use one of the config's address groups.
+
+   root: bcl
+   postmaster: root
+   admins: bcl, alice@other.domain
+
+   Targets at domains that aren't in the emails list, like alice@other.domain,
+   are forwarded to through the relay host instead of being delivered here.
+*/
+func readAliases(r io.Reader) (map[string][]string, error) {
+	result := make(map[string][]string)
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, line := range lines {
+		i := strings.Index(line, ":")
+		if i == -1 {
+			log.Printf("Skipping bad aliases line: %q", line)
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:i]))
+		var targets []string
+		for _, t := range strings.Split(line[i+1:], ",") {
+			t = strings.Trim(strings.TrimSpace(t), `"`)
+			if t == "" {
+				continue
+			}
+			if strings.HasPrefix(t, "|") || strings.HasPrefix(t, "/") || strings.HasPrefix(t, ":include:") {
+				log.Printf("Skipping unsupported alias target for %s: %s", name, t)
+				continue
+			}
+			targets = append(targets, t)
+		}
+		expanded, err := expandGroups(currentGroups(), targets)
+		if err != nil {
+			log.Printf("Skipping alias %s: %s", name, err)
+			continue
+		}
+		result[name] = append(result[name], expanded...)
+	}
+	return result, nil
+}
+
+// loadAliases reads the aliases file from the config and replaces the current aliases
+func loadAliases() error {
+	if cfg.Aliases == "" {
+		return nil
+	}
+	f, err := os.Open(cfg.Aliases)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	a, err := readAliases(f)
+	if err != nil {
+		return err
+	}
+	// Targets at other domains are forwarded through the relay host
+	if cfg.Relay.Host == "" {
+		emails := currentEmails()
+		for name, targets := range a {
+			for _, t := range targets {
+				if remoteTarget(emails, t) {
+					return fmt.Errorf("alias %s forwards to %s, which needs a relay host", name, t)
+				}
+			}
+		}
+	}
+	aliasesLock.Lock()
+	aliases = a
+	aliasesLock.Unlock()
+	return nil
+}
+
+// reloadAliases reads the aliases file again, keeping the current aliases if there is an error
+func reloadAliases() {
+	if cfg.Aliases == "" {
+		return
+	}
+	if err := loadAliases(); err != nil {
+		log.Printf("Error reloading aliases, keeping the old ones: %s", err)
+		return
+	}
+	log.Printf("Reloaded aliases from %s", cfg.Aliases)
+}
+
+// localPart returns the part of an address before the @
+func localPart(address string) string {
+	if i := strings.LastIndex(address, "@"); i != -1 {
+		return address[:i]
+	}
+	return address
+}
+
+// localDomain returns true if mail for the domain is delivered here, because it is used in the emails list
+func localDomain(emails []string, domain string) bool {
+	domain = strings.ToLower(domain)
+	for _, entry := range emails {
+		i := strings.LastIndex(entry, "@")
+		if i == -1 {
+			continue
+		}
+		if ok, _ := path.Match(strings.ToLower(entry[i+1:]), domain); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteTarget returns true if the alias target is an address at a domain that isn't delivered here
+func remoteTarget(emails []string, target string) bool {
+	i := strings.LastIndex(target, "@")
+	return i != -1 && !localDomain(emails, target[i+1:])
+}
+
+// resolveAlias returns the users that mail for name should be delivered to
+// Aliases are followed until they reach a name that isn't an alias, or
+// an alias that includes itself, like "bcl: bcl, alice". Each user is only
+// returned once. Targets at other domains are left out, they are forwarded.
+func resolveAlias(name string) []string {
+	users, _ := expandAlias(name)
+	return users
+}
+
+// aliasForwards returns the addresses at other domains that mail for name is forwarded to
+func aliasForwards(name string) []string {
+	_, remote := expandAlias(name)
+	return remote
+}
+
+// expandAlias returns the local users and the addresses at other domains that the alias reaches
+func expandAlias(name string) ([]string, []string) {
+	emails := currentEmails()
+	aliasesLock.RLock()
+	defer aliasesLock.RUnlock()
+
+	var users, remote []string
+	seen := make(map[string]bool)
+	var resolve func(name string)
+	resolve = func(name string) {
+		key := strings.ToLower(name)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		targets, ok := aliases[key]
+		if !ok {
+			users = append(users, name)
+			return
+		}
+		for _, t := range targets {
+			if remoteTarget(emails, t) {
+				if !seen[strings.ToLower(t)] {
+					seen[strings.ToLower(t)] = true
+					remote = append(remote, t)
+				}
+				continue
+			}
+			t = localPart(t)
+			if strings.ToLower(t) == key {
+				users = append(users, t)
+				continue
+			}
+			resolve(t)
+		}
+	}
+	resolve(name)
+	return users, remote
+}
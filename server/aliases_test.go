@@ -0,0 +1,139 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/smtpd"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testAliases = `
+# Basic system aliases
+postmaster:	root
+root: bcl
+admins: bcl,
+	alice@other.domain, group:ops
+loop1: loop2
+loop2: loop1
+keep: keep, bcl
+cron: "|/usr/bin/cronmail", bcl
+`
+
+func TestAliases(t *testing.T) {
+	cfg.Groups = map[string][]string{"ops": {"carol@domain.com"}}
+	cfg.Emails = []string{"bcl@domain.com"}
+	defer func() { cfg = config.Config{} }()
+	a, err := readAliases(strings.NewReader(testAliases))
+	if err != nil {
+		t.Fatalf("Error reading aliases: %s", err)
+	}
+	if !reflect.DeepEqual(a["admins"], []string{"bcl", "alice@other.domain", "carol@domain.com"}) {
+		t.Errorf("Wrong admins alias: %#v", a["admins"])
+	}
+	if !reflect.DeepEqual(a["cron"], []string{"bcl"}) {
+		t.Errorf("Pipe target not skipped: %#v", a["cron"])
+	}
+
+	aliases = a
+	defer func() { aliases = nil }()
+	tests := []struct {
+		name  string
+		users []string
+	}{
+		{"Postmaster", []string{"bcl"}},
+		{"admins", []string{"bcl", "carol"}},
+		{"nobody", []string{"nobody"}},
+		{"loop1", nil},
+		{"keep", []string{"keep", "bcl"}},
+	}
+	for _, tt := range tests {
+		if users := resolveAlias(tt.name); !reflect.DeepEqual(users, tt.users) {
+			t.Errorf("Wrong users for %s: %#v", tt.name, users)
+		}
+	}
+	if remote := aliasForwards("admins"); !reflect.DeepEqual(remote, []string{"alice@other.domain"}) {
+		t.Errorf("Wrong forwards for admins: %#v", remote)
+	}
+	if remote := aliasForwards("root"); remote != nil {
+		t.Errorf("Wrong forwards for root: %#v", remote)
+	}
+}
+
+func TestAliasForwards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+		aliases = nil
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"admins@domain.com", "bcl@domain.com"}
+	cfg.Aliases = filepath.Join(dir, "aliases")
+	if err := ioutil.WriteFile(cfg.Aliases, []byte("admins: bcl, alice@other.domain\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Forwarding to alice needs a relay host
+	if err := loadAliases(); err == nil {
+		t.Error("Alias to another domain loaded without a relay host")
+	}
+
+	smarthost, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer smarthost.Close()
+	received := make(chan *smarthostEnvelope, 1)
+	sh := &smtpd.Server{
+		Hostname: "smarthost",
+		OnNewMail: func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+			return &smarthostEnvelope{helo: c.Hello(), done: received}, nil
+		},
+	}
+	go sh.Serve(smarthost)
+	_, port, _ := net.SplitHostPort(smarthost.Addr().String())
+	cfg.Relay.Host = "127.0.0.1"
+	cfg.Relay.Port, _ = strconv.Atoi(port)
+	if err := loadAliases(); err != nil {
+		t.Fatal(err)
+	}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+
+	// bcl gets a copy, and alice's is relayed instead of going to a local alice
+	message := []byte("Subject: admins\r\n\r\nHello\r\n")
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"admins@domain.com"}, message); err != nil {
+		t.Fatalf("Message not accepted: %s", err)
+	}
+	env := <-received
+	if strings.Join(env.rcpts, ",") != "alice@other.domain" {
+		t.Errorf("Smarthost got %v", env.rcpts)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new")); len(files) != 1 {
+		t.Errorf("bcl has %d messages", len(files))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "alice")); !os.IsNotExist(err) {
+		t.Error("Delivered to a local alice")
+	}
+}
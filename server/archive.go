@@ -0,0 +1,363 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveDir is the directory under the maildirs that holds the archive bundles
+const archiveDir = ".archives"
+
+// archiveEntry describes one message in a bundle's index
+type archiveEntry struct {
+	Path      string    `json:"path"` // path relative to the user's maildir when it was packed
+	MessageID string    `json:"message_id,omitempty"`
+	From      string    `json:"from,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Date      time.Time `json:"date"` // when the message was delivered
+	Size      int64     `json:"size"`
+}
+
+// bundlePath returns the path of the user's bundle for the month, like 2020-09, without an extension
+func bundlePath(root, user, month string) string {
+	return filepath.Join(root, archiveDir, user, filepath.Base(month))
+}
+
+// readArchiveIndex reads the index of one of the user's bundles
+func readArchiveIndex(root, user, month string) ([]archiveEntry, error) {
+	var index []archiveEntry
+	data, err := ioutil.ReadFile(bundlePath(root, user, month) + ".json")
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &index)
+	return index, err
+}
+
+// listArchives returns the months of the user's bundles, oldest first
+func listArchives(root, user string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(root, archiveDir, user, "*.tar.gz"))
+	if err != nil {
+		return nil, err
+	}
+	var months []string
+	for _, path := range paths {
+		months = append(months, strings.TrimSuffix(filepath.Base(path), ".tar.gz"))
+	}
+	sort.Strings(months)
+	return months, nil
+}
+
+// readArchiveMessages calls fn with the index path and contents of each message in a bundle
+func readArchiveMessages(path string, fn func(name string, data []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr.Name, data); err != nil {
+			return err
+		}
+	}
+}
+
+// newArchiveEntry indexes a message by its headers
+func newArchiveEntry(rel string, info os.FileInfo, data []byte) archiveEntry {
+	entry := archiveEntry{Path: rel, Date: info.ModTime().UTC(), Size: int64(len(data))}
+	if msg, err := mail.ReadMessage(strings.NewReader(string(data))); err == nil {
+		entry.MessageID = msgIDRE.FindString(msg.Header.Get("Message-Id"))
+		entry.From = decodeHeader(msg.Header.Get("From"))
+		entry.Subject = decodeHeader(msg.Header.Get("Subject"))
+	}
+	return entry
+}
+
+// packArchives moves the user's messages delivered before the cutoff into a bundle for each month
+// A bundle that already exists is rewritten with the new messages added to
+// it. The messages are only removed from the maildir once their bundle and
+// its index have been written. It returns the number of messages packed.
+func packArchives(root, userDir, user string, before time.Time) (int, error) {
+	messages, err := userMessages(userDir)
+	if err != nil {
+		return 0, err
+	}
+	months := make(map[string][]string)
+	infos := make(map[string]os.FileInfo)
+	for _, m := range messages {
+		info, err := os.Stat(filepath.Join(userDir, m))
+		if err != nil {
+			return 0, err
+		}
+		if !info.ModTime().Before(before) {
+			continue
+		}
+		month := info.ModTime().UTC().Format("2006-01")
+		months[month] = append(months[month], m)
+		infos[m] = info
+	}
+	if len(months) == 0 {
+		return 0, nil
+	}
+	if err := os.MkdirAll(filepath.Join(root, archiveDir, user), 0700); err != nil {
+		return 0, err
+	}
+
+	packed := 0
+	for month, names := range months {
+		if err := writeBundle(root, userDir, user, month, names, infos); err != nil {
+			return packed, err
+		}
+		for _, m := range names {
+			if err := os.Remove(filepath.Join(userDir, m)); err != nil {
+				return packed, err
+			}
+			packed++
+		}
+	}
+	return packed, nil
+}
+
+// writeBundle writes the month's bundle with the messages added, and its index
+func writeBundle(root, userDir, user, month string, names []string, infos map[string]os.FileInfo) error {
+	path := bundlePath(root, user, month)
+	index, err := readArchiveIndex(root, user, month)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+month+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	zw := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(zw)
+	add := func(name string, mtime time.Time, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: mtime, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	// Copy the messages that were packed before
+	if _, err := os.Stat(path + ".tar.gz"); err == nil {
+		dates := make(map[string]time.Time)
+		for _, e := range index {
+			dates[e.Path] = e.Date
+		}
+		err := readArchiveMessages(path+".tar.gz", func(name string, data []byte) error {
+			return add(name, dates[name], data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, m := range names {
+		data, err := ioutil.ReadFile(filepath.Join(userDir, m))
+		if err != nil {
+			return err
+		}
+		if err := add(m, infos[m].ModTime(), data); err != nil {
+			return err
+		}
+		index = append(index, newArchiveEntry(m, infos[m], data))
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	sort.Slice(index, func(i, j int) bool { return index[i].Date.Before(index[j].Date) })
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The index is written before the bundle is replaced, so that every
+	// message in a bundle is in its index
+	if err := ioutil.WriteFile(path+".json", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path+".tar.gz")
+}
+
+// restoreArchive puts messages from the month's bundle back into the maildir
+// With a message id only that message is restored. Messages that are still
+// in the maildir are left alone, and the bundle is kept. It returns the
+// number of messages restored.
+func restoreArchive(root, userDir, user, month, id string) (int, error) {
+	index, err := readArchiveIndex(root, user, month)
+	if err != nil {
+		return 0, err
+	}
+	wanted := make(map[string]bool)
+	for _, e := range index {
+		if id == "" || e.MessageID == id {
+			wanted[e.Path] = true
+		}
+	}
+	if len(wanted) == 0 {
+		return 0, fmt.Errorf("%s is not in the %s bundle", id, month)
+	}
+	current, err := userMessages(userDir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	existing := make(map[string]bool)
+	for _, m := range current {
+		existing[filepath.Join(filepath.Dir(filepath.Dir(m)), messageKey(filepath.Base(m)))] = true
+	}
+
+	restored := 0
+	err = readArchiveMessages(bundlePath(root, user, month)+".tar.gz", func(name string, data []byte) error {
+		// Names come from the bundle, so they can't be trusted to stay in the maildir
+		rel := filepath.Clean(name)
+		if !wanted[name] || filepath.IsAbs(rel) || strings.HasPrefix(rel, "..") {
+			return nil
+		}
+		if existing[filepath.Join(filepath.Dir(filepath.Dir(rel)), messageKey(filepath.Base(rel)))] {
+			return nil
+		}
+		dst := filepath.Join(userDir, rel)
+		for _, sub := range []string{"tmp", "new", "cur"} {
+			if err := os.MkdirAll(filepath.Join(filepath.Dir(filepath.Dir(dst)), sub), 0700); err != nil {
+				return err
+			}
+		}
+		if err := ioutil.WriteFile(dst, data, 0600); err != nil {
+			return err
+		}
+		restored++
+		return nil
+	})
+	return restored, err
+}
+
+// archiveCommand packs old messages into compressed monthly bundles, and lists and restores them
+/*
+   letterbox archive pack [-days 365] <user>
+   letterbox archive list <user> [month]
+   letterbox archive restore <user> <month> [message-id]
+*/
+func archiveCommand(args []string) error {
+	usage := fmt.Errorf("usage: archive pack [-days 365] <user> | list <user> [month] | restore <user> <month> [message-id]")
+	if len(args) < 2 {
+		return usage
+	}
+	if err := loadCommandConfig(); err != nil {
+		return err
+	}
+	switch args[0] {
+	case "pack":
+		flags := flag.NewFlagSet("archive pack", flag.ExitOnError)
+		days := flags.Int("days", 365, "Pack messages delivered more than this many days ago")
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 || *days < 1 {
+			return usage
+		}
+		user := filepath.Base(filepath.Clean(flags.Arg(0)))
+		userDir, err := maildirPath(user)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(userDir); err != nil {
+			return err
+		}
+		n, err := packArchives(cmdline.Maildirs, userDir, user, time.Now().AddDate(0, 0, -*days))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Packed %d messages\n", n)
+		if n > 0 {
+			if _, _, _, err := recalcQuota(userDir, nil); err != nil {
+				return err
+			}
+		}
+	case "list":
+		if len(args) > 3 {
+			return usage
+		}
+		user := filepath.Base(filepath.Clean(args[1]))
+		if len(args) == 3 {
+			index, err := readArchiveIndex(cmdline.Maildirs, user, args[2])
+			if err != nil {
+				return err
+			}
+			for _, e := range index {
+				fmt.Printf("%s\t%s\t%s\t%s\t%s\n", e.Date.Format(time.RFC3339), e.MessageID, e.From, e.Subject, e.Path)
+			}
+			return nil
+		}
+		months, err := listArchives(cmdline.Maildirs, user)
+		if err != nil {
+			return err
+		}
+		for _, month := range months {
+			index, err := readArchiveIndex(cmdline.Maildirs, user, month)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\t%d messages\n", month, len(index))
+		}
+	case "restore":
+		if len(args) != 3 && len(args) != 4 {
+			return usage
+		}
+		user := filepath.Base(filepath.Clean(args[1]))
+		userDir, err := maildirPath(user)
+		if err != nil {
+			return err
+		}
+		var id string
+		if len(args) == 4 {
+			id = args[3]
+		}
+		n, err := restoreArchive(cmdline.Maildirs, userDir, user, args[2], id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored %d messages\n", n)
+		if n > 0 {
+			if _, _, _, err := recalcQuota(userDir, nil); err != nil {
+				return err
+			}
+		}
+	default:
+		return usage
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestArchives(t *testing.T) {
+	root, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	userDir := filepath.Join(root, "bcl")
+	old := time.Date(2019, 3, 10, 12, 0, 0, 0, time.UTC)
+	for _, m := range []struct {
+		path    string
+		content string
+		mtime   time.Time
+	}{
+		{"cur/1000.1.host:2,S", "Message-Id: <1@host>\r\nSubject: one\r\n\r\nOne\r\n", old},
+		{".Cron/cur/1001.1.host:2,", "Message-Id: <2@host>\r\nSubject: two\r\n\r\nTwo\r\n", old.Add(time.Hour)},
+		{"new/1002.1.host", "Message-Id: <3@host>\r\nSubject: three\r\n\r\nThree\r\n", old.AddDate(0, 1, 0)},
+		{"new/1003.1.host", "Message-Id: <4@host>\r\nSubject: four\r\n\r\nFour\r\n", time.Now()},
+	} {
+		path := filepath.Join(userDir, m.path)
+		writeTestMessage(t, path, m.content)
+		os.Chtimes(path, m.mtime, m.mtime)
+	}
+
+	n, err := packArchives(root, userDir, "bcl", time.Now().AddDate(0, 0, -30))
+	if err != nil || n != 3 {
+		t.Fatalf("Wrong number of messages packed: %d %v", n, err)
+	}
+	remaining, _ := userMessages(userDir)
+	if !reflect.DeepEqual(remaining, []string{"new/1003.1.host"}) {
+		t.Errorf("Wrong messages left in the maildir: %v", remaining)
+	}
+	months, err := listArchives(root, "bcl")
+	if err != nil || !reflect.DeepEqual(months, []string{"2019-03", "2019-04"}) {
+		t.Fatalf("Wrong bundles: %v %v", months, err)
+	}
+	index, err := readArchiveIndex(root, "bcl", "2019-03")
+	if err != nil || len(index) != 2 || index[0].MessageID != "<1@host>" || index[0].Subject != "one" || index[1].Path != ".Cron/cur/1001.1.host:2," {
+		t.Fatalf("Wrong index: %#v %v", index, err)
+	}
+
+	// Packing again adds to the month's bundle
+	writeTestMessage(t, filepath.Join(userDir, "cur", "1004.1.host:2,S"), "Message-Id: <5@host>\r\n\r\nFive\r\n")
+	os.Chtimes(filepath.Join(userDir, "cur", "1004.1.host:2,S"), old.Add(2*time.Hour), old.Add(2*time.Hour))
+	if n, err := packArchives(root, userDir, "bcl", time.Now().AddDate(0, 0, -30)); err != nil || n != 1 {
+		t.Fatalf("Wrong number of messages packed: %d %v", n, err)
+	}
+	if index, _ := readArchiveIndex(root, "bcl", "2019-03"); len(index) != 3 {
+		t.Errorf("Message not added to the bundle: %#v", index)
+	}
+
+	// One message, then the rest of the month, can be put back
+	if n, err := restoreArchive(root, userDir, "bcl", "2019-03", "<2@host>"); err != nil || n != 1 {
+		t.Fatalf("Wrong number of messages restored: %d %v", n, err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(userDir, ".Cron", "cur", "1001.1.host:2,"))
+	if err != nil || string(data) != "Message-Id: <2@host>\r\nSubject: two\r\n\r\nTwo\r\n" {
+		t.Errorf("Wrong message restored: %q %v", data, err)
+	}
+	if n, err := restoreArchive(root, userDir, "bcl", "2019-03", ""); err != nil || n != 2 {
+		t.Errorf("Wrong number of messages restored: %d %v", n, err)
+	}
+	if _, err := restoreArchive(root, userDir, "bcl", "2019-03", "<9@host>"); err == nil {
+		t.Error("Restoring a missing message succeeded")
+	}
+
+	// Archives are not searched as maildirs
+	count := 0
+	walkMessages(root, func(string) error { count++; return nil })
+	if count != 4 {
+		t.Errorf("Wrong number of messages in the maildirs: %d", count)
+	}
+}
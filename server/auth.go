@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"github.com/bcl/letterbox/smtpd"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+)
+
+// dummyHash is compared against when the user is unknown, so that it takes as long as a known user
+var dummyHash []byte
+
+// authEnabled returns true if there are any users that can authenticate
+func authEnabled() bool {
+	return len(cfg.Auth.Users) > 0
+}
+
+// setupAuth checks that the users' password hashes are valid bcrypt hashes
+func setupAuth() error {
+	for user, hash := range cfg.Auth.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("bad password hash for %s: %s", user, err)
+		}
+	}
+	if authEnabled() && dummyHash == nil {
+		var err error
+		dummyHash, err = bcrypt.GenerateFromPassword([]byte("letterbox"), bcrypt.DefaultCost)
+		return err
+	}
+	return nil
+}
+
+// checkAuthTLS checks that clients can use AUTH without sending their passwords in the clear
+// AUTH is only offered once the connection uses TLS, so users without a
+// certificate to start it could never authenticate.
+func checkAuthTLS(serverTLS *tls.Config) error {
+	if authEnabled() && serverTLS == nil && !cfg.Auth.AllowInsecureAuth {
+		return fmt.Errorf("[auth.users] need a TLS certificate for STARTTLS, or allow_insecure_auth")
+	}
+	return nil
+}
+
+// onAuth checks the username and password against the bcrypt hashes from the config
+/*
+   Example TOML:
+
+   [auth]
+   require_for_unlisted = true
+   max_failures = 5
+   lockout = "15m"
+   allow_insecure_auth = false
+
+   [auth.users]
+   printer = "$2a$10$..."
+*/
+func onAuth(c smtpd.Connection, username, password string) bool {
+	hash, ok := cfg.Auth.Users[username]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		logDebugf("AUTH from %s for unknown user %s", c.Addr(), username)
+		authFailed(c, username)
+		return false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		logDebugf("AUTH from %s for %s failed: %s", c.Addr(), username, err)
+		authFailed(c, username)
+		return false
+	}
+	logDebugf("AUTH from %s as %s", c.Addr(), username)
+	authLimits.succeeded(connIP(c), username)
+	return true
+}
+
+// passwdCommand reads a password from stdin and prints its bcrypt hash for the [auth.users] config
+/*
+   letterbox passwd < password.txt
+*/
+func passwdCommand(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: passwd < password")
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return fmt.Errorf("empty password")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(hash))
+	return nil
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/smtpd"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startAuthServer starts a server that requires clients to authenticate as user/password
+func startAuthServer(t *testing.T) net.Listener {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth = config.Auth{
+		Users:              map[string]string{"user": string(hash)},
+		RequireForUnlisted: true,
+		Backoff:            config.Duration{Duration: time.Millisecond},
+	}
+	authLimits = newAuthLimiter()
+	if err := setupAuth(); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpd.Server{
+		Hostname:        "localhost",
+		OnNewConnection: onNewConnection,
+		OnNewMail:       onNewMail,
+		OnAuth:          onAuth,
+		OnAuthAttempt:   onAuthAttempt,
+		// The tests connect without TLS
+		AllowInsecureAuth: true,
+	}
+	go s.Serve(ln)
+	return ln
+}
+
+func TestAuthPlain(t *testing.T) {
+	ln := startAuthServer(t)
+	defer ln.Close()
+	defer func() { cfg.Auth = config.Auth{} }()
+
+	// A failed AUTH makes net/smtp quit, so each attempt needs its own connection
+	auth := func(username, password string) (*smtp.Client, error) {
+		client, err := smtp.Dial(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, client.Auth(smtp.PlainAuth("", username, password, "127.0.0.1"))
+	}
+	if client, err := auth("user", "wrong"); err == nil {
+		t.Error("AUTH with wrong password succeeded")
+		client.Close()
+	}
+	if client, err := auth("nobody", "password"); err == nil {
+		t.Error("AUTH with unknown user succeeded")
+		client.Close()
+	}
+
+	client, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if ok, mechs := client.Extension("AUTH"); !ok || !strings.Contains(mechs, "PLAIN") {
+		t.Fatalf("AUTH PLAIN not advertised: %q", mechs)
+	}
+
+	// Unlisted host must authenticate first
+	if err := client.Mail("sender@domain.com"); err == nil || !strings.HasPrefix(err.Error(), "530") {
+		t.Fatalf("MAIL FROM without AUTH: %v", err)
+	}
+	if err := client.Auth(smtp.PlainAuth("", "user", "password", "127.0.0.1")); err != nil {
+		t.Fatalf("AUTH failed: %s", err)
+	}
+	if err := client.Mail("sender@domain.com"); err != nil {
+		t.Fatalf("MAIL FROM after AUTH: %s", err)
+	}
+}
+
+func TestAuthLogin(t *testing.T) {
+	ln := startAuthServer(t)
+	defer ln.Close()
+	defer func() { cfg.Auth = config.Auth{} }()
+
+	conn, err := textproto.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expect := func(code int) {
+		t.Helper()
+		if _, _, err := conn.ReadResponse(code); err != nil {
+			t.Fatalf("Expected %d: %s", code, err)
+		}
+	}
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	expect(220)
+	conn.PrintfLine("EHLO localhost")
+	expect(250)
+	conn.PrintfLine("AUTH LOGIN")
+	expect(334)
+	conn.PrintfLine(b64("user"))
+	expect(334)
+	conn.PrintfLine(b64("password"))
+	expect(235)
+	conn.PrintfLine("AUTH LOGIN " + b64("user"))
+	expect(503)
+}
+
+func TestAuthNeedsTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		cfg = config.Config{}
+		allowedList = access.List{}
+		certs = nil
+	}()
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Hosts = []string{"127.0.0.1"}
+	parseHosts()
+	cfg.Auth = config.Auth{Users: map[string]string{"user": string(hash)}}
+	authLimits = newAuthLimiter()
+	if err := setupAuth(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAuthTLS(nil); err == nil {
+		t.Error("Users without TLS accepted")
+	}
+	cfg.TLS.Cert, cfg.TLS.Key = writeTestCert(t, dir, "localhost")
+	serverTLS, err := setupTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAuthTLS(serverTLS); err != nil {
+		t.Errorf("Users with TLS refused: %s", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("localhost", serverTLS).Serve(ln)
+
+	// Without TLS AUTH isn't offered, and is refused
+	conn, err := textproto.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.ReadResponse(220)
+	conn.PrintfLine("EHLO localhost")
+	if _, msg, err := conn.ReadResponse(250); err != nil || strings.Contains(msg, "AUTH") {
+		t.Errorf("AUTH offered without TLS: %q %v", msg, err)
+	}
+	conn.PrintfLine("AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00password")))
+	if _, msg, err := conn.ReadResponse(538); err != nil || !strings.HasPrefix(msg, "5.7.11") {
+		t.Errorf("AUTH without TLS not refused: %q %v", msg, err)
+	}
+
+	// After STARTTLS it is
+	client, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("STARTTLS failed: %s", err)
+	}
+	if ok, _ := client.Extension("AUTH"); !ok {
+		t.Error("AUTH not offered after STARTTLS")
+	}
+	if err := client.Auth(smtp.PlainAuth("", "user", "password", "127.0.0.1")); err != nil {
+		t.Errorf("AUTH after STARTTLS failed: %s", err)
+	}
+
+	// A listener that starts with TLS offers it straight away
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsLn := tls.NewListener(plain, serverTLS)
+	defer tlsLn.Close()
+	go newServer("localhost", serverTLS).Serve(tlsLn)
+	c, err := tls.Dial("tcp", tlsLn.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = smtp.NewClient(c, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		t.Error("STARTTLS offered on a TLS connection")
+	}
+	if err := client.Auth(smtp.PlainAuth("", "user", "password", "127.0.0.1")); err != nil {
+		t.Errorf("AUTH over TLS failed: %s", err)
+	}
+}
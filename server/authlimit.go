@@ -0,0 +1,182 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/events"
+	"github.com/bcl/letterbox/smtpd"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultMaxAuthFailures and defaultAuthLockout are used when max_failures and lockout aren't set
+const (
+	defaultMaxAuthFailures = 5
+	defaultAuthLockout     = 15 * time.Minute
+)
+
+// defaultAuthBackoff is the delay after the first failed AUTH when auth.backoff isn't set
+// It doubles with each failure, up to maxAuthBackoff.
+const (
+	defaultAuthBackoff = time.Second
+	maxAuthBackoff     = 30 * time.Second
+)
+
+// errAuthLocked is the reply to AUTH from a client or for a user that is locked out
+var errAuthLocked = smtpd.SMTPError("454 4.7.0 Error: too many failed authentication attempts, try again later")
+
+// authFailures is the recent failures from one IP or for one username
+type authFailures struct {
+	count  int
+	last   time.Time
+	locked time.Time // locked out until this time
+}
+
+// authLimiter counts the failed AUTH attempts from each IP and for each username
+// Each IP and username is locked out separately, so guessing one user's password
+// from many IPs and guessing many users' passwords from one IP are both stopped.
+type authLimiter struct {
+	sync.Mutex
+	ips   map[string]*authFailures
+	users map[string]*authFailures
+}
+
+// authLimits is the limiter for all of the listeners
+var authLimits = newAuthLimiter()
+
+// newAuthLimiter returns an empty limiter
+func newAuthLimiter() *authLimiter {
+	return &authLimiter{ips: make(map[string]*authFailures), users: make(map[string]*authFailures)}
+}
+
+// maxAuthFailures returns auth.max_failures, or its default
+func maxAuthFailures() int {
+	if cfg.Auth.MaxFailures > 0 {
+		return cfg.Auth.MaxFailures
+	}
+	return defaultMaxAuthFailures
+}
+
+// authLockout returns auth.lockout, or its default
+func authLockout() time.Duration {
+	if cfg.Auth.Lockout.Duration > 0 {
+		return cfg.Auth.Lockout.Duration
+	}
+	return defaultAuthLockout
+}
+
+// locked returns true if the IP or the username is locked out
+func (l *authLimiter) locked(ip, username string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, f := range []*authFailures{l.ips[ip], l.users[username]} {
+		if f != nil && now.Before(f.locked) {
+			return true
+		}
+	}
+	return false
+}
+
+// failed records a failure for the IP and username
+// It returns how long to wait before replying, and true if this failure locked one of them out.
+func (l *authLimiter) failed(ip, username string, now time.Time) (time.Duration, bool) {
+	l.Lock()
+	defer l.Unlock()
+	lockout := authLockout()
+	l.expire(now, lockout)
+
+	var delay time.Duration
+	locked := false
+	record := func(m map[string]*authFailures, key string) {
+		f := m[key]
+		if f == nil {
+			f = &authFailures{}
+			m[key] = f
+		}
+		f.count++
+		f.last = now
+		if d := backoffDelay(f.count); d > delay {
+			delay = d
+		}
+		if f.count >= maxAuthFailures() {
+			f.count = 0
+			f.locked = now.Add(lockout)
+			locked = true
+		}
+	}
+	if ip != "" {
+		record(l.ips, ip)
+	}
+	record(l.users, username)
+	return delay, locked
+}
+
+// backoffDelay returns the delay after count failures, doubling from auth.backoff up to maxAuthBackoff
+func backoffDelay(count int) time.Duration {
+	delay := cfg.Auth.Backoff.Duration
+	if delay == 0 {
+		delay = defaultAuthBackoff
+	}
+	for i := 1; i < count && delay < maxAuthBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxAuthBackoff {
+		delay = maxAuthBackoff
+	}
+	return delay
+}
+
+// expire forgets the failures older than the lockout, caller must hold the lock
+func (l *authLimiter) expire(now time.Time, lockout time.Duration) {
+	for _, m := range []map[string]*authFailures{l.ips, l.users} {
+		for key, f := range m {
+			if now.Sub(f.last) > lockout && !now.Before(f.locked) {
+				delete(m, key)
+			}
+		}
+	}
+}
+
+// succeeded forgets the failures for the IP and username after they authenticate
+func (l *authLimiter) succeeded(ip, username string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.ips, ip)
+	delete(l.users, username)
+}
+
+// connIP returns the client's IP, "" for the Unix socket
+func connIP(c smtpd.Connection) string {
+	client, _, err := net.SplitHostPort(c.Addr().String())
+	if err != nil {
+		return ""
+	}
+	if ip := access.ParseIP(client); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// authFailed records a failed AUTH and waits before the failure is sent, to slow down guessing
+func authFailed(c smtpd.Connection, username string) {
+	ip := connIP(c)
+	delay, locked := authLimits.failed(ip, username, time.Now())
+	authFailureCount.Add(1)
+	reject(net.ParseIP(ip), newConnInfo(c), "", "", events.ReasonAuthFailed, "AUTH for "+username+" failed")
+	if locked {
+		log.Printf("Too many failed AUTH from %s or for %s, locking out for %s", ip, username, authLockout())
+	}
+	time.Sleep(delay)
+}
+
+// onAuthAttempt refuses AUTH from an IP or for a user that is locked out, without checking the password
+func onAuthAttempt(c smtpd.Connection, username string) error {
+	ip := connIP(c)
+	if !authLimits.locked(ip, username, time.Now()) {
+		return nil
+	}
+	authLockouts.Add(1)
+	reject(net.ParseIP(ip), newConnInfo(c), "", "", events.ReasonAuthLocked, "AUTH for "+username+" locked out")
+	return errAuthLocked
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/config"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthLimiter(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	cfg.Auth.MaxFailures = 3
+	cfg.Auth.Lockout = config.Duration{Duration: 10 * time.Minute}
+	l := newAuthLimiter()
+	now := time.Now()
+
+	// Failures for one user from several IPs lock out the user, but not the IPs
+	for i, ip := range []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"} {
+		_, locked := l.failed(ip, "bcl", now)
+		if locked != (i == 2) {
+			t.Errorf("Failure %d locked = %v", i+1, locked)
+		}
+	}
+	if !l.locked("192.168.1.4", "bcl", now) {
+		t.Error("User not locked out")
+	}
+	if l.locked("192.168.1.1", "other", now) {
+		t.Error("IP locked out by failures for another user")
+	}
+	if l.locked("192.168.1.4", "bcl", now.Add(11*time.Minute)) {
+		t.Error("Lockout didn't end")
+	}
+
+	// Failures from one IP for several users lock out the IP
+	for _, user := range []string{"a", "b", "c"} {
+		l.failed("10.0.0.1", user, now)
+	}
+	if !l.locked("10.0.0.1", "d", now) {
+		t.Error("IP not locked out")
+	}
+
+	// Success forgets the failures
+	l.failed("10.0.0.2", "e", now)
+	l.failed("10.0.0.2", "e", now)
+	l.succeeded("10.0.0.2", "e")
+	if _, locked := l.failed("10.0.0.2", "e", now); locked {
+		t.Error("Failures remembered after success")
+	}
+
+	// Old failures are forgotten
+	l.failed("10.0.0.3", "f", now)
+	l.failed("10.0.0.3", "f", now)
+	if _, locked := l.failed("10.0.0.3", "f", now.Add(11*time.Minute)); locked {
+		t.Error("Failures older than the lockout counted")
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	for count, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: maxAuthBackoff} {
+		if delay := backoffDelay(count); delay != expected {
+			t.Errorf("backoffDelay(%d) = %s, expected %s", count, delay, expected)
+		}
+	}
+	cfg.Auth.Backoff = config.Duration{Duration: time.Millisecond}
+	if delay := backoffDelay(2); delay != 2*time.Millisecond {
+		t.Errorf("backoffDelay(2) = %s with 1ms backoff", delay)
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+	ln := startAuthServer(t)
+	defer ln.Close()
+	defer func() { cfg.Auth = config.Auth{} }()
+	cfg.Auth.MaxFailures = 2
+	failures, lockouts := authFailureCount.Value(), authLockouts.Value()
+
+	auth := func(password string) error {
+		client, err := smtp.Dial(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		return client.Auth(smtp.PlainAuth("", "user", password, "127.0.0.1"))
+	}
+	for i := 0; i < 2; i++ {
+		if err := auth("wrong"); err == nil || !strings.HasPrefix(err.Error(), "535") {
+			t.Fatalf("Wrong password: %v", err)
+		}
+	}
+	// The right password is refused during the lockout
+	if err := auth("password"); err == nil || !strings.HasPrefix(err.Error(), "454") || !strings.Contains(err.Error(), "4.7.0") {
+		t.Fatalf("AUTH during lockout: %v", err)
+	}
+	if authFailureCount.Value() != failures+2 || authLockouts.Value() != lockouts+1 {
+		t.Errorf("Metrics counted %d failures and %d lockouts", authFailureCount.Value()-failures, authLockouts.Value()-lockouts)
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/delivery"
+	"github.com/bcl/letterbox/smtpd"
+	"github.com/luksen/maildir"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// defaultBackendTimeout is used when a backend's timeout isn't set
+const defaultBackendTimeout = 30 * time.Second
+
+// deliveryBackend is the DeliveryBackend of the Server embedding letterbox, nil when letterbox is run as a command
+var deliveryBackend delivery.Backend
+
+// errBackendFailed is the reply when a required backend couldn't store the message
+var errBackendFailed = smtpd.SMTPError("451 4.3.0 Error: message could not be stored")
+
+// checkBackends checks the [[backends]] config
+func checkBackends() error {
+	names := make(map[string]bool)
+	for _, b := range cfg.Backends {
+		if b.Name == "" {
+			return fmt.Errorf("backend without a name")
+		}
+		if names[b.Name] {
+			return fmt.Errorf("backend %s is listed twice", b.Name)
+		}
+		names[b.Name] = true
+		switch b.Type {
+		case "maildir":
+			if b.Path == "" {
+				return fmt.Errorf("backend %s needs a path", b.Name)
+			}
+		case "webhook":
+			if b.URL == "" {
+				return fmt.Errorf("backend %s needs a url", b.Name)
+			}
+		case "command":
+			if len(b.Command) == 0 {
+				return fmt.Errorf("backend %s needs a command", b.Name)
+			}
+		default:
+			return fmt.Errorf("backend %s has unknown type %q", b.Name, b.Type)
+		}
+	}
+	return nil
+}
+
+// userBackends returns the backends that store the user's mail
+func userBackends(user string) []config.Backend {
+	var backends []config.Backend
+	for _, b := range cfg.Backends {
+		if len(b.Users) == 0 || stringListed(b.Users, user) {
+			backends = append(backends, b)
+		}
+	}
+	return backends
+}
+
+// stringListed returns true if s is in the list
+func stringListed(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// storeBackend stores the message in the backend
+func storeBackend(b config.Backend, msg delivery.Message) error {
+	timeout := b.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultBackendTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch b.Type {
+	case "maildir":
+		if err := os.MkdirAll(b.Path, 0700); err != nil {
+			return err
+		}
+		dir := maildir.Dir(filepath.Join(b.Path, msg.User))
+		if err := dir.Create(); err != nil {
+			return err
+		}
+		d, err := newDelivery(dir)
+		if err != nil {
+			return err
+		}
+		if _, err := d.Write(msg.Data); err != nil {
+			d.Abort()
+			return err
+		}
+		return d.Close()
+	case "webhook":
+		req, err := http.NewRequest("POST", b.URL, bytes.NewReader(msg.Data))
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "message/rfc822")
+		req.Header.Set("X-Letterbox-User", msg.User)
+		req.Header.Set("X-Letterbox-Rcpt", msg.Rcpt)
+		req.Header.Set("X-Letterbox-From", msg.From)
+		req.Header.Set("X-Letterbox-Queue-Id", msg.QueueID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s returned %s", b.URL, resp.Status)
+		}
+		return nil
+	case "command":
+		cmd := exec.CommandContext(ctx, b.Command[0], b.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(msg.Data)
+		cmd.Env = append(os.Environ(),
+			"LETTERBOX_USER="+msg.User,
+			"LETTERBOX_RCPT="+msg.Rcpt,
+			"LETTERBOX_FROM="+msg.From,
+			"LETTERBOX_QUEUE_ID="+msg.QueueID)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %s", err, bytes.TrimSpace(out))
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown backend type %q", b.Type)
+}
+
+// storeBackends stores the message in the user's required backends, or in the best-effort ones
+// A required backend that fails returns an error, so the recipient can be
+// refused before it is delivered anywhere else. Best-effort failures are only
+// logged.
+func storeBackends(conn connInfo, backends []config.Backend, msg delivery.Message, required bool) error {
+	for _, b := range backends {
+		if b.Required != required {
+			continue
+		}
+		if err := storeBackend(b, msg); err != nil {
+			conn.logf("Error storing message for %s in %s: %s", msg.User, b.Name, err)
+			if required {
+				return errBackendFailed
+			}
+			continue
+		}
+		logEvent(conn, "stored", "rcpt", "<"+msg.Rcpt+">", "user", msg.User, "backend", b.Name)
+	}
+	return nil
+}
+
+// storeRequired stores the i'th delivery in the embedding program's DeliveryBackend and the user's required backends
+func (e *env) storeRequired(i int) error {
+	backends := userBackends(e.destUsers[i])
+	if len(backends) == 0 && deliveryBackend == nil {
+		return nil
+	}
+	msg := e.backendMessage(i)
+	if deliveryBackend != nil {
+		if err := deliveryBackend.Store(msg); err != nil {
+			e.conn.logf("Error storing message for %s: %s", msg.User, err)
+			return errBackendFailed
+		}
+	}
+	return storeBackends(e.conn, backends, msg, true)
+}
+
+// storeBestEffort stores the i'th delivery in the user's best-effort backends, without waiting for them
+func (e *env) storeBestEffort(i int) {
+	backends := userBackends(e.destUsers[i])
+	if len(backends) == 0 {
+		return
+	}
+	go storeBackends(e.conn, backends, e.backendMessage(i), false)
+}
+
+// backendMessage returns the copy of the i'th delivery for the backends
+func (e *env) backendMessage(i int) delivery.Message {
+	data := e.data.Bytes()
+	if !e.untraced[i] {
+		data = append(deliveryHeader(e.from, e.destRcpts[i]), e.traced()...)
+	}
+	return delivery.Message{User: e.destUsers[i], Rcpt: e.destRcpts[i], From: e.from, QueueID: e.conn.queueID, Data: data}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckBackends(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	cfg.Backends = []config.Backend{
+		{Name: "archive", Type: "maildir", Path: "/srv/archive"},
+		{Name: "hook", Type: "webhook", URL: "http://127.0.0.1/", Users: []string{"bcl"}},
+	}
+	if err := checkBackends(); err != nil {
+		t.Errorf("Good backends refused: %s", err)
+	}
+	if backends := userBackends("bcl"); len(backends) != 2 {
+		t.Errorf("userBackends(bcl) = %v", backends)
+	}
+	if backends := userBackends("alice"); len(backends) != 1 || backends[0].Name != "archive" {
+		t.Errorf("userBackends(alice) = %v", backends)
+	}
+
+	bad := [][]config.Backend{
+		{{Type: "maildir", Path: "/srv/archive"}},
+		{{Name: "archive", Type: "maildir"}},
+		{{Name: "hook", Type: "webhook"}},
+		{{Name: "cmd", Type: "command"}},
+		{{Name: "s3", Type: "s3"}},
+		{{Name: "a", Type: "maildir", Path: "/a"}, {Name: "a", Type: "maildir", Path: "/b"}},
+	}
+	for _, backends := range bad {
+		cfg.Backends = backends
+		if err := checkBackends(); err == nil {
+			t.Errorf("Bad backends accepted: %v", backends)
+		}
+	}
+}
+
+func TestBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	if err := os.Mkdir(cmdline.Maildirs, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	posted := make(chan string, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		posted <- r.Header.Get("X-Letterbox-User") + " " + string(data)
+	}))
+	defer hook.Close()
+
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com", "alice@domain.com"}
+	cfg.Backends = []config.Backend{
+		{Name: "archive", Type: "maildir", Path: filepath.Join(dir, "archive"), Required: true},
+		{Name: "copy", Type: "command", Command: []string{"/bin/sh", "-c", "cat > " + filepath.Join(dir, "copy") + ".$LETTERBOX_USER"}, Users: []string{"bcl"}},
+		{Name: "hook", Type: "webhook", URL: hook.URL, Users: []string{"bcl"}},
+		{Name: "broken", Type: "command", Command: []string{"/bin/false"}},
+	}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+
+	// A best-effort backend failing doesn't stop delivery
+	message := []byte("Subject: stored\r\n\r\nHello\r\n")
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com"}, message); err != nil {
+		t.Fatalf("Message not accepted: %s", err)
+	}
+	for _, sub := range []string{"maildirs/bcl/new", "archive/bcl/new"} {
+		if files, _ := ioutil.ReadDir(filepath.Join(dir, sub)); len(files) != 1 {
+			t.Errorf("%s has %d messages", sub, len(files))
+		}
+	}
+	select {
+	case got := <-posted:
+		if !strings.HasPrefix(got, "bcl ") || !strings.HasSuffix(got, "\r\nSubject: stored\r\n\r\nHello\r\n") {
+			t.Errorf("Webhook got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Webhook not called")
+	}
+	var data []byte
+	for i := 0; i < 50 && len(data) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		data, _ = ioutil.ReadFile(filepath.Join(dir, "copy.bcl"))
+	}
+	if !strings.HasSuffix(string(data), "\r\nSubject: stored\r\n\r\nHello\r\n") {
+		t.Errorf("Command got %q", data)
+	}
+
+	// A required backend failing refuses the recipient, and nothing is delivered
+	if err := ioutil.WriteFile(filepath.Join(dir, "archive", "alice"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"alice@domain.com"}, message)
+	if err == nil || !strings.HasPrefix(err.Error(), "451") || !strings.Contains(err.Error(), "4.3.0") {
+		t.Errorf("Failed required backend not passed on: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "maildirs", "alice", "new")); len(files) != 0 {
+		t.Error("Delivered to alice after the archive failed")
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"path"
+	"strings"
+)
+
+// isPattern returns true if the emails entry is a pattern instead of an address
+func isPattern(entry string) bool {
+	return strings.ContainsAny(entry, "*?[")
+}
+
+// matchPatterns returns true if the address matches one of the patterns in the emails list
+// Patterns use shell wildcards, like *@domain.com or camera-*@lan, and are
+// matched without regard to case.
+func matchPatterns(emails []string, address string) bool {
+	address = strings.ToLower(address)
+	for _, entry := range emails {
+		if !isPattern(entry) {
+			continue
+		}
+		if ok, _ := path.Match(strings.ToLower(entry), address); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// catchAllMaildir returns the maildir for an address accepted by a pattern, if its domain has one
+/*
+   Example TOML:
+
+   emails = ["bcl@domain.com", "*@devices.lan", "*@family.org"]
+
+   [catch_all]
+   "devices.lan" = "devices"
+
+   Mail to any address at devices.lan is delivered to the devices maildir, and
+   mail to family.org goes to a maildir for each local part. Addresses that are
+   listed exactly still get their own maildir.
+*/
+func catchAllMaildir(emails []string, address string) (string, bool) {
+	for _, user := range emails {
+		if address == user {
+			return "", false
+		}
+	}
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return "", false
+	}
+	for domain, dir := range cfg.CatchAll {
+		if strings.EqualFold(domain, address[at+1:]) {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// recipientUsers returns the users whose maildirs mail for the whitelisted address is delivered to
+/*
+   Example TOML:
+
+   catchall = "spam"
+
+   Recipients that aren't in the emails list, and can't be relayed, are
+   accepted for the catchall maildir instead of being rejected.
+*/
+func recipientUsers(emails []string, address string) []string {
+	return resolveAlias(recipientName(emails, address))
+}
+
+// recipientName returns the name that mail for the whitelisted address is delivered to, before it goes through the aliases
+func recipientName(emails []string, address string) string {
+	if dir, ok := catchAllMaildir(emails, address); ok {
+		return dir
+	}
+	if _, _, ok := whitelisted(emails, address); !ok && cfg.CatchallMaildir != "" {
+		return cfg.CatchallMaildir
+	}
+	return localPart(address)
+}
+
+// mailboxUsers returns the users the address is delivered to whose mail goes into their mailboxes
+// Users whose mail is only forwarded or piped don't use their mailboxes, so
+// their holds and quotas don't matter.
+func mailboxUsers(emails []string, address string) []string {
+	var users []string
+	for _, user := range recipientUsers(emails, address) {
+		if targets, keep := forwardTargets(user); len(targets) > 0 && !keep {
+			continue
+		}
+		if _, ok := userPipe(user); ok {
+			continue
+		}
+		users = append(users, path.Base(path.Clean(user)))
+	}
+	return users
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchPatterns(t *testing.T) {
+	emails := []string{"bcl@domain.com", "*@devices.lan", "camera-?@lan", "[ab]*@letters.org"}
+	matched := []string{"printer@devices.lan", "Printer@DEVICES.lan", "camera-1@lan", "alice@letters.org"}
+	for _, address := range matched {
+		if !matchPatterns(emails, address) {
+			t.Errorf("%s didn't match", address)
+		}
+	}
+	// Exact entries aren't patterns
+	unmatched := []string{"bcl@domain.com", "printer@devices.lan.evil.com", "camera-10@lan", "carol@letters.org"}
+	for _, address := range unmatched {
+		if matchPatterns(emails, address) {
+			t.Errorf("%s matched", address)
+		}
+	}
+}
+
+func TestCatchAllMaildir(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	cfg.CatchAll = map[string]string{"devices.lan": "devices"}
+	emails := []string{"*@devices.lan", "*@family.org", "router@devices.lan"}
+
+	if dir, ok := catchAllMaildir(emails, "printer@Devices.LAN"); !ok || dir != "devices" {
+		t.Errorf("catchAllMaildir = %q, %v", dir, ok)
+	}
+	if _, ok := catchAllMaildir(emails, "router@devices.lan"); ok {
+		t.Error("Listed address went to the catch-all maildir")
+	}
+	if _, ok := catchAllMaildir(emails, "mom@family.org"); ok {
+		t.Error("Domain without a catch-all maildir used one")
+	}
+	if users := recipientUsers(emails, "printer@devices.lan"); !reflect.DeepEqual(users, []string{"devices"}) {
+		t.Errorf("recipientUsers = %v", users)
+	}
+	if users := recipientUsers(emails, "mom@family.org"); !reflect.DeepEqual(users, []string{"mom"}) {
+		t.Errorf("recipientUsers = %v", users)
+	}
+}
+
+func TestCatchAllDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"*@devices.lan", "*@family.org"}
+	cfg.CatchAll = map[string]string{"devices.lan": "devices"}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("localhost", nil).Serve(ln)
+
+	rcpts := []string{"printer@devices.lan", "camera+motion@devices.lan", "mom@family.org"}
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", rcpts, []byte("Subject: test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com"}, []byte("Subject: test\r\n\r\nHello\r\n")); err == nil {
+		t.Error("Address that doesn't match a pattern was accepted")
+	}
+
+	for _, d := range []string{"devices/new", "devices/.motion/new", "mom/new"} {
+		if files, _ := ioutil.ReadDir(filepath.Join(dir, d)); len(files) != 1 {
+			t.Errorf("Expected 1 message in %s, found %d", d, len(files))
+		}
+	}
+	for _, d := range []string{"printer", "camera"} {
+		if _, err := os.Stat(filepath.Join(dir, d)); !os.IsNotExist(err) {
+			t.Errorf("Catch-all address delivered to its own maildir %s", d)
+		}
+	}
+}
+
+func TestCatchallMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	cfg.CatchallMaildir = "spam"
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("localhost", nil).Serve(ln)
+
+	rcpts := []string{"bcl@domain.com", "root@printer.lan", "admin@router.lan"}
+	if err := smtp.SendMail(ln.Addr().String(), nil, "printer@printer.lan", rcpts, []byte("Subject: toner\r\n\r\nLow\r\n")); err != nil {
+		t.Fatalf("Unknown recipients not accepted: %s", err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new")); len(files) != 1 {
+		t.Errorf("Expected 1 message for bcl, found %d", len(files))
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "spam", "new"))
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 message in the catchall maildir, found %d", len(files))
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "spam", "new", files[0].Name()))
+	if !strings.Contains(string(data), "Delivered-To: root@printer.lan\r\n") {
+		t.Errorf("Catchall message doesn't say who it was for: %q", data)
+	}
+	for _, d := range []string{"root", "admin"} {
+		if _, err := os.Stat(filepath.Join(dir, d)); !os.IsNotExist(err) {
+			t.Errorf("Unknown recipient delivered to its own maildir %s", d)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"github.com/bcl/letterbox/access"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// configChecks check the settings that don't need anything set up first
+// They are run before letterbox starts, and by letterbox check.
+var configChecks = []func() error{
+	checkSPFMode,
+	checkSenderDomainMode,
+	checkDateCheckMode,
+	checkForwards,
+	checkPipes,
+	checkHoldPolicy,
+	checkBackends,
+	checkWebhook,
+	checkDovecot,
+	checkPlusFolders,
+	checkMaildirPath,
+	checkOwnership,
+	checkClamd,
+	checkDNSBL,
+	checkMilters,
+	checkWasmFilters,
+	checkJournal,
+	checkSpamFilter,
+	checkRcptSizes,
+	checkFilters,
+	checkFormats,
+}
+
+// checkProtocol checks the protocol setting
+func checkProtocol() error {
+	if cfg.Protocol != "" && !strings.EqualFold(cfg.Protocol, "smtp") && !strings.EqualFold(cfg.Protocol, "lmtp") {
+		return fmt.Errorf("unknown protocol: %s", cfg.Protocol)
+	}
+	return nil
+}
+
+// checkHostList returns a problem for each entry in the list that is a bad network, or a hostname that doesn't resolve
+// access.Resolve skips these, so a typo would otherwise quietly leave a host out.
+func checkHostList(name string, list []string) []error {
+	var problems []error
+	for _, h := range list {
+		if strings.Contains(h, "/") {
+			if _, err := access.ParseCIDR(h); err != nil {
+				problems = append(problems, fmt.Errorf("%s: %s", name, err))
+			}
+			continue
+		}
+		if access.ParseIP(h) != nil {
+			continue
+		}
+		if _, err := net.LookupIP(h); err != nil {
+			problems = append(problems, fmt.Errorf("%s: can't resolve %s: %s", name, h, err))
+		}
+	}
+	return problems
+}
+
+// checkWritableDir returns an error if letterbox can't write files in the directory
+// With create a missing directory is fine if it can be created, like the
+// queue dir which letterbox creates when it starts.
+func checkWritableDir(dir string, create bool) error {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) && create {
+		// Find the closest directory that exists, that is where it will be created
+		parent := filepath.Dir(filepath.Clean(dir))
+		for parent != filepath.Dir(parent) {
+			if _, err := os.Stat(parent); err == nil {
+				break
+			}
+			parent = filepath.Dir(parent)
+		}
+		return checkWritableDir(parent, false)
+	} else if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".letterbox-check-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %s", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkCertificate loads the TLS certificate, key, and client CAs, and checks that the certificate hasn't expired
+func checkCertificate(now time.Time) error {
+	serverTLS, err := setupTLS()
+	if err != nil || serverTLS == nil {
+		return err
+	}
+	if err := checkListeners(serverTLS); err != nil {
+		return err
+	}
+	certs.RLock()
+	defer certs.RUnlock()
+	leaf, err := x509.ParseCertificate(certs.cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate %s expired on %s", cfg.TLS.Cert, leaf.NotAfter.Format("2006-01-02"))
+	}
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate %s isn't valid until %s", cfg.TLS.Cert, leaf.NotBefore.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// checkConfig runs every check on the loaded config, and returns the problems found
+func checkConfig(now time.Time) []error {
+	var problems []error
+	add := func(what string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %s", what, err))
+		}
+	}
+	add("config", checkLogFormat())
+	for _, check := range configChecks {
+		add("config", check())
+	}
+	add("config", checkProtocol())
+	add("config", checkQueue())
+	add("schedules", parseSchedules())
+	add("aliases", loadAliases())
+	add("auth", setupAuth())
+	add("wasm_filters", setupWasmFilters())
+	problems = append(problems, checkHostList("hosts", cfg.Hosts)...)
+	if cfg.HostsFile != "" {
+		_, bad, err := access.ReadFiles(cfg.HostsFile)
+		add("hosts_file", err)
+		for _, err := range bad {
+			add("hosts_file", err)
+		}
+	}
+	problems = append(problems, checkHostList("exempt_hosts", cfg.ExemptHosts)...)
+	problems = append(problems, checkHostList("proxy_hosts", cfg.ProxyHosts)...)
+	add("maildirs", checkWritableDir(cmdline.Maildirs, false))
+	if cfg.StateDir != "" {
+		add("state_dir", checkWritableDir(cfg.StateDir, false))
+	}
+	if queueEnabled() {
+		add("queue", checkWritableDir(cfg.Queue.Dir, true))
+	}
+	if cfg.TLS.Cert != "" || cfg.TLS.Key != "" {
+		add("tls", checkCertificate(now))
+	} else {
+		add("config", checkListeners(nil))
+	}
+	return problems
+}
+
+// checkCommand checks the config file, and the directories and certificates it uses
+// It prints each problem and fails if there were any, so it can be used as
+// ExecStartPre in letterbox's systemd unit.
+/*
+   letterbox check [-config letterbox.toml]
+*/
+func checkCommand(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.StringVar(&cmdline.Config, "config", cmdline.Config, "Path to the configuration file to check")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: check [-config letterbox.toml]")
+	}
+	f, err := os.Open(cmdline.Config)
+	if err != nil {
+		return err
+	}
+	cfg, err = readConfig(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %s", cmdline.Config, err)
+	}
+	problems := checkConfig(time.Now())
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", cmdline.Config, p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("problems found in %s: %d", cmdline.Config, len(problems))
+	}
+	fmt.Printf("%s: OK\n", cmdline.Config)
+	return nil
+}
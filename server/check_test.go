@@ -0,0 +1,109 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		certs = nil
+	}()
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	if err := os.Mkdir(cmdline.Maildirs, 0700); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeTestCert(t, dir, "mx.domain.com")
+	cfg = config.Config{
+		Hosts: []string{"127.0.0.1", "192.168.1.0/24"},
+		TLS:   config.TLS{Cert: certFile, Key: keyFile},
+		Queue: config.Queue{Dir: filepath.Join(dir, "spool", "queue")},
+	}
+	if problems := checkConfig(time.Now()); len(problems) != 0 {
+		t.Errorf("Good config has problems: %v", problems)
+	}
+
+	cfg.Hosts = []string{"192.168.1.0/33", "no-such-host.invalid"}
+	cfg.SPF = "maybe"
+	cfg.StateDir = filepath.Join(dir, "missing")
+	cmdline.Maildirs = certFile
+	problems := checkConfig(time.Now().Add(2 * time.Hour))
+	var all []string
+	for _, p := range problems {
+		all = append(all, p.Error())
+	}
+	text := strings.Join(all, "\n")
+	for _, want := range []string{"config: unknown spf", "hosts: ", "no-such-host.invalid", "maildirs: " + certFile + " is not a directory", "state_dir: ", "tls: certificate " + certFile + " expired"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Problem %q not found in:\n%s", want, text)
+		}
+	}
+	if len(problems) != 6 {
+		t.Errorf("Wrong number of problems: %d\n%s", len(problems), text)
+	}
+}
+
+func TestCheckWritableDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := checkWritableDir(dir, false); err != nil {
+		t.Errorf("Writable dir refused: %s", err)
+	}
+	if err := checkWritableDir(filepath.Join(dir, "a", "b"), false); err == nil {
+		t.Error("Missing dir accepted")
+	}
+	if err := checkWritableDir(filepath.Join(dir, "a", "b"), true); err != nil {
+		t.Errorf("Dir that can be created refused: %s", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Check left files behind: %v", files)
+	}
+}
+
+func TestCheckCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile, maildirs := cmdline.Config, cmdline.Maildirs
+	defer func() {
+		cmdline.Config, cmdline.Maildirs = configFile, maildirs
+		cfg = config.Config{}
+	}()
+	cmdline.Maildirs = dir
+	path := filepath.Join(dir, "letterbox.toml")
+	if err := ioutil.WriteFile(path, []byte("hosts = [\"127.0.0.1\"]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCommand([]string{"-config", path}); err != nil {
+		t.Errorf("Good config failed: %s", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("hosts = [\"127.0.0.1\"]\nformat = \"mh\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCommand([]string{"-config", path}); err == nil || !strings.HasSuffix(err.Error(), ": 1") {
+		t.Errorf("Bad config passed: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("hosts = [\"127.0.0.1\"\n"), 0600); err == nil {
+		if err := checkCommand([]string{"-config", path}); err == nil {
+			t.Error("Config that can't be parsed passed")
+		}
+	}
+}
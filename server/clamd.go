@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/bcl/letterbox/smtpd"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultClamdTimeout is used when the clamd timeout isn't set
+const defaultClamdTimeout = 30 * time.Second
+
+// clamdChunkSize is the most that is sent to clamd in one INSTREAM chunk
+const clamdChunkSize = 64 * 1024
+
+// clamdEnabled returns true if messages are scanned by clamd
+func clamdEnabled() bool {
+	return cfg.Clamd.Address != ""
+}
+
+// clamdAction returns what to do with infected messages
+func clamdAction() string {
+	if cfg.Clamd.Action == "" {
+		return "reject"
+	}
+	return strings.ToLower(cfg.Clamd.Action)
+}
+
+// clamdOnError returns what to do with messages that clamd couldn't scan
+func clamdOnError() string {
+	if cfg.Clamd.OnError == "" {
+		return "defer"
+	}
+	return strings.ToLower(cfg.Clamd.OnError)
+}
+
+// checkClamd checks the [clamd] config
+/*
+   Example TOML:
+
+   [clamd]
+   address = "/run/clamav/clamd.ctl"
+   action = "quarantine"
+   quarantine = "virus"
+   on_error = "tag"
+   timeout = "30s"
+
+   address is a Unix socket path, or host:port for clamd's TCP socket. Infected
+   messages are rejected with the name of the signature, or with "quarantine"
+   accepted and delivered only to the quarantine maildir. If clamd can't be
+   reached or fails, "defer" asks the sender to try again later and "tag"
+   delivers the message with an X-Virus-Status header saying it is unscanned.
+*/
+func checkClamd() error {
+	if !clamdEnabled() {
+		return nil
+	}
+	switch clamdAction() {
+	case "reject":
+	case "quarantine":
+		if cfg.Clamd.Quarantine == "" {
+			return fmt.Errorf("clamd action quarantine needs a quarantine maildir")
+		}
+	default:
+		return fmt.Errorf("unknown clamd action: %s", cfg.Clamd.Action)
+	}
+	switch clamdOnError() {
+	case "defer", "tag":
+		return nil
+	}
+	return fmt.Errorf("unknown clamd on_error setting: %s", cfg.Clamd.OnError)
+}
+
+// clamdNetwork returns the network to dial for the clamd address
+func clamdNetwork(address string) string {
+	if strings.HasPrefix(address, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// clamdScan sends the message to clamd with INSTREAM
+// It returns the name of the signature if the message is infected, or "" if
+// it is clean.
+func clamdScan(msg []byte) (string, error) {
+	timeout := cfg.Clamd.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultClamdTimeout
+	}
+	conn, err := net.DialTimeout(clamdNetwork(cfg.Clamd.Address), cfg.Clamd.Address, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	size := make([]byte, 4)
+	for len(msg) > 0 {
+		n := len(msg)
+		if n > clamdChunkSize {
+			n = clamdChunkSize
+		}
+		binary.BigEndian.PutUint32(size, uint32(n))
+		if _, err := conn.Write(size); err != nil {
+			return "", err
+		}
+		if _, err := conn.Write(msg[:n]); err != nil {
+			return "", err
+		}
+		msg = msg[n:]
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	reply, err := ioutil.ReadAll(io.LimitReader(conn, 4096))
+	if err != nil {
+		return "", err
+	}
+	return parseClamdReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseClamdReply returns the signature from a reply like "stream: Eicar-Signature FOUND"
+func parseClamdReply(reply string) (string, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// virusCheck scans the message with clamd, returning the X-Virus-Status header to add
+// A message that can't be scanned is deferred, or tagged as unscanned with
+// on_error = "tag". The signature is returned for infected messages, which
+// are rejected or quarantined by the caller.
+func (e *env) virusCheck() ([]byte, string, error) {
+	signature, err := clamdScan(e.data.Bytes())
+	if err != nil {
+		e.conn.logf("Error scanning message with clamd: %s", err)
+		if clamdOnError() == "tag" {
+			return foldHeader("X-Virus-Status", "Unscanned (clamd unavailable)"), "", nil
+		}
+		return nil, "", smtpd.SMTPError("451 4.3.0 Error: message could not be scanned for viruses")
+	}
+	if signature != "" {
+		return foldHeader("X-Virus-Status", fmt.Sprintf("Infected (%s)", cleanHeloName(signature))), signature, nil
+	}
+	return foldHeader("X-Virus-Status", "Clean"), "", nil
+}
+
+// virusError returns the reply for an infected message that is rejected
+func virusError(signature string) error {
+	return smtpd.SMTPError(fmt.Sprintf("550 5.7.1 Error: message contains a virus (%s)", cleanHeloName(signature)))
+}
+
+// quarantine delivers the message to the quarantine maildir instead of its recipients
+// The other deliveries are aborted, and the message is accepted for every
+// recipient so the sender doesn't try again. kv says why, for the log.
+func (e *env) quarantine(name string, kv ...string) error {
+	e.Abort()
+	path, err := e.quarantineCopy(name)
+	if err != nil {
+		e.conn.logf("Error quarantining message: %s", err)
+		return e.abort(smtpd.SMTPError("451 4.3.0 Error: message could not be quarantined"))
+	}
+	logEvent(e.conn, "quarantined", append(kv, "path", path)...)
+	return nil
+}
+
+// quarantineCopy writes the message, with the headers letterbox added, to the quarantine maildir
+func (e *env) quarantineCopy(name string) (string, error) {
+	dir, err := userMaildir(name, "")
+	if err != nil {
+		return "", err
+	}
+	d, err := newDelivery(dir)
+	if err != nil {
+		return "", err
+	}
+	d.Owner = mailOwner(name)
+	if _, err := d.Write(e.traced()); err != nil {
+		d.Abort()
+		return "", err
+	}
+	if err := d.Close(); err != nil {
+		return "", err
+	}
+	return d.Location(), nil
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startFakeClamd serves INSTREAM on ln, finding a virus in messages that contain EICAR
+func startFakeClamd(ln net.Listener) {
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					c.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var msg []byte
+				size := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(r, size); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size)
+					if n == 0 {
+						break
+					}
+					chunk := make([]byte, n)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					msg = append(msg, chunk...)
+				}
+				if bytes.Contains(msg, []byte("EICAR")) {
+					c.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+				} else {
+					c.Write([]byte("stream: OK\x00"))
+				}
+			}(c)
+		}
+	}()
+}
+
+func TestParseClamdReply(t *testing.T) {
+	if sig, err := parseClamdReply("stream: OK"); sig != "" || err != nil {
+		t.Errorf("OK = %q, %v", sig, err)
+	}
+	if sig, err := parseClamdReply("stream: Win.Test.EICAR_HDB-1 FOUND"); sig != "Win.Test.EICAR_HDB-1" || err != nil {
+		t.Errorf("FOUND = %q, %v", sig, err)
+	}
+	if _, err := parseClamdReply("INSTREAM size limit exceeded. ERROR"); err == nil {
+		t.Error("ERROR reply accepted")
+	}
+}
+
+func TestCheckClamd(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	for _, c := range []config.Clamd{
+		{Address: "127.0.0.1:3310", Action: "delete"},
+		{Address: "127.0.0.1:3310", Action: "quarantine"},
+		{Address: "127.0.0.1:3310", OnError: "accept"},
+	} {
+		cfg.Clamd = c
+		if err := checkClamd(); err == nil {
+			t.Errorf("Bad clamd config accepted: %#v", c)
+		}
+	}
+	cfg.Clamd = config.Clamd{Address: "/run/clamav/clamd.ctl", Action: "quarantine", Quarantine: "virus", OnError: "tag"}
+	if err := checkClamd(); err != nil {
+		t.Errorf("Good clamd config refused: %s", err)
+	}
+}
+
+func TestClamdScanning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	parseHosts()
+
+	clamd, err := net.Listen("unix", filepath.Join(dir, "clamd.ctl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clamd.Close()
+	startFakeClamd(clamd)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	send := func(body string) error {
+		return smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com"}, []byte("Subject: test\r\n\r\n"+body+"\r\n"))
+	}
+	// inbox returns the messages delivered to the maildir, joined together
+	inbox := func(user string) (int, string) {
+		files, _ := ioutil.ReadDir(filepath.Join(dir, user, "new"))
+		var all string
+		for _, f := range files {
+			data, _ := ioutil.ReadFile(filepath.Join(dir, user, "new", f.Name()))
+			all += string(data)
+		}
+		return len(files), all
+	}
+
+	cfg.Clamd = config.Clamd{Address: clamd.Addr().String()}
+	if err := send("Hello"); err != nil {
+		t.Fatalf("Clean message refused: %s", err)
+	}
+	err = send("EICAR test")
+	if err == nil || !strings.HasPrefix(err.Error(), "550") || !strings.Contains(err.Error(), "Eicar-Signature") {
+		t.Errorf("Infected message not rejected: %v", err)
+	}
+	if n, data := inbox("bcl"); n != 1 || !strings.Contains(data, "X-Virus-Status: Clean\r\nSubject: test\r\n") {
+		t.Errorf("Wrong deliveries: %d %q", n, data)
+	}
+
+	cfg.Clamd.Action = "quarantine"
+	cfg.Clamd.Quarantine = "virus"
+	if err := send("EICAR test"); err != nil {
+		t.Fatalf("Quarantined message refused: %s", err)
+	}
+	if n, _ := inbox("bcl"); n != 1 {
+		t.Errorf("Quarantined message delivered to the recipient")
+	}
+	if n, data := inbox("virus"); n != 1 || !strings.Contains(data, "X-Virus-Status: Infected (Eicar-Signature)\r\n") {
+		t.Errorf("Wrong quarantine: %d %q", n, data)
+	}
+
+	// Without clamd the message is deferred, or delivered unscanned with on_error = "tag"
+	cfg.Clamd = config.Clamd{Address: filepath.Join(dir, "missing.ctl")}
+	if err := send("Hello"); err == nil || !strings.HasPrefix(err.Error(), "451") {
+		t.Errorf("Unscanned message not deferred: %v", err)
+	}
+	cfg.Clamd.OnError = "tag"
+	if err := send("Hello"); err != nil {
+		t.Fatalf("Unscanned message refused with on_error = tag: %s", err)
+	}
+	if n, data := inbox("bcl"); n != 2 || !strings.Contains(data, "X-Virus-Status: Unscanned (clamd unavailable)\r\n") {
+		t.Errorf("Unscanned message not tagged: %d %q", n, data)
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// loadClientCA reads the PEM encoded CA certificates that client certificates must be signed by
+func loadClientCA(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// setupClientIdentities expands the groups in the client identities' recipients
+/*
+   Example TOML:
+
+   [tls.clients."printer.lan"]
+   senders = ["printer@lan"]
+   recipients = ["bcl@mydomain.com", "group:admins"]
+*/
+func setupClientIdentities() error {
+	if len(cfg.TLS.Clients) > 0 && cfg.TLS.ClientCA == "" {
+		return fmt.Errorf("tls.clients needs a tls.client_ca")
+	}
+	for name, id := range cfg.TLS.Clients {
+		rcpts, err := expandGroups(currentGroups(), id.Recipients)
+		if err != nil {
+			return fmt.Errorf("tls.clients.%s: %s", name, err)
+		}
+		id.Recipients = rcpts
+		cfg.TLS.Clients[name] = id
+	}
+	return nil
+}
+
+// certIdentity returns the name of the client identity that matches the client's certificate
+// The certificate's common name is checked first, then its DNS and email
+// subject alternative names. It returns "" if the client didn't send a
+// verified certificate or none of its names are configured.
+func certIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, name := range names {
+		if _, ok := cfg.TLS.Clients[name]; ok && name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// identityAllows returns true if the address is in the list, or the list is empty
+func identityAllows(list []string, address string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, a := range list {
+		if strings.EqualFold(a, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// identitySenderAllowed returns true if the client identity may use the MAIL FROM address
+func identitySenderAllowed(identity, from string) bool {
+	return identity == "" || identityAllows(cfg.TLS.Clients[identity].Senders, from)
+}
+
+// identityRcptAllowed returns true if the client identity may send to the recipient
+func identityRcptAllowed(identity, rcpt string) bool {
+	return identity == "" || identityAllows(cfg.TLS.Clients[identity].Recipients, rcpt)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto/tls"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/smtpd"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClientCertIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		cfg = config.Config{}
+		certs = nil
+	}()
+	os.Mkdir(filepath.Join(dir, "server"), 0700)
+	os.Mkdir(filepath.Join(dir, "client"), 0700)
+	cfg.TLS.Cert, cfg.TLS.Key = writeTestCert(t, filepath.Join(dir, "server"), "localhost")
+	clientCert, clientKey := writeTestCert(t, filepath.Join(dir, "client"), "printer.lan")
+	cfg.TLS.ClientCA = clientCert
+	cfg.TLS.Clients = map[string]config.ClientIdentity{
+		"printer.lan": {Senders: []string{"printer@lan"}, Recipients: []string{"group:admins"}},
+	}
+	cfg.Groups = map[string][]string{"admins": {"bcl@domain.com"}}
+	cfg.Emails = []string{"bcl@domain.com", "alice@domain.com"}
+	cfg.Auth.RequireForUnlisted = true
+	serverTLS, err := setupTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := &smtpd.Server{
+		Hostname:        "localhost",
+		OnNewConnection: onNewConnection,
+		OnNewMail:       onNewMail,
+		TLSConfig:       serverTLS,
+	}
+	go s.Serve(ln)
+
+	dial := func(withCert bool) *smtp.Client {
+		client, err := smtp.Dial(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &tls.Config{InsecureSkipVerify: true}
+		if withCert {
+			cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		if err := client.StartTLS(config); err != nil {
+			t.Fatalf("STARTTLS failed: %s", err)
+		}
+		return client
+	}
+
+	// Without a certificate an unlisted host has to authenticate
+	client := dial(false)
+	if err := client.Mail("printer@lan"); err == nil || !strings.HasPrefix(err.Error(), "530") {
+		t.Errorf("MAIL FROM without a certificate: %v", err)
+	}
+	client.Close()
+
+	client = dial(true)
+	defer client.Close()
+	if err := client.Mail("other@lan"); err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Errorf("MAIL FROM with a sender that isn't allowed: %v", err)
+	}
+	if err := client.Mail("printer@lan"); err != nil {
+		t.Fatalf("MAIL FROM with an allowed sender: %s", err)
+	}
+	if err := client.Rcpt("alice@domain.com"); err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Errorf("RCPT TO a recipient that isn't allowed: %v", err)
+	}
+	if err := client.Rcpt("bcl@domain.com"); err != nil {
+		t.Errorf("RCPT TO an allowed recipient: %s", err)
+	}
+}
+
+func TestSetupClientIdentities(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	cfg.TLS.Clients = map[string]config.ClientIdentity{"printer.lan": {}}
+	if err := setupClientIdentities(); err == nil {
+		t.Error("Client identities without a client_ca did not return an error")
+	}
+	cfg.TLS.ClientCA = "ca.pem"
+	cfg.TLS.Clients = map[string]config.ClientIdentity{"printer.lan": {Recipients: []string{"group:missing"}}}
+	if err := setupClientIdentities(); err == nil {
+		t.Error("Unknown group did not return an error")
+	}
+}
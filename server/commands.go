@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// commands are the maintenance commands that can be run instead of the server
+// They are passed the arguments after the command name.
+var commands = map[string]func(args []string) error{
+	"archive":  archiveCommand,
+	"check":    checkCommand,
+	"config":   configCommand,
+	"hold":     holdCommand,
+	"log":      logCommand,
+	"migrate":  migrateCommand,
+	"passwd":   passwdCommand,
+	"quota":    quotaCommand,
+	"search":   searchCommand,
+	"send":     sendCommand,
+	"sendmail": sendmailCommand,
+	"snapshot": snapshotCommand,
+	"tags":     tagsCommand,
+	"thread":   threadCommand,
+	"watch":    watchCommand,
+}
+
+// runCommand runs the command named by the first argument
+func runCommand(args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q, available commands: %v", args[0], names)
+	}
+	return cmd(args[1:])
+}
+
+// loadCommandConfig reads the config file for commands that use settings like maildir_path
+// A missing config file leaves the defaults.
+func loadCommandConfig() error {
+	f, err := os.Open(cmdline.Config)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	cfg, err = readConfig(f)
+	if err != nil {
+		return err
+	}
+	return checkMaildirPath()
+}
+
+// walkMessages calls fn with the path of every message in the maildirs under root
+// Snapshots are skipped.
+func walkMessages(root string, fn func(path string) error) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == snapshotDir {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		dir := filepath.Base(filepath.Dir(path))
+		if dir != "new" && dir != "cur" {
+			return nil
+		}
+		return fn(path)
+	})
+}
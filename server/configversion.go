@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// decodeConfig decodes the config file into c, migrating it from an older version
+// and decrypting its enc: values first
+func decodeConfig(data []byte, c *config.Config) error {
+	version, err := config.Decode(data, c, decryptSecrets)
+	if err != nil {
+		return err
+	}
+	if version != config.Version {
+		log.Printf("Config file is version %d, run 'letterbox config migrate' to update it to %d", version, config.Version)
+	}
+	return nil
+}
+
+// configCommand rewrites the config file in the current layout
+// The old file is kept with a .bak extension. Comments aren't kept in the new file.
+func configCommand(args []string) error {
+	if len(args) > 0 && (args[0] == "genkey" || args[0] == "encrypt") {
+		return secretCommand(args)
+	}
+	if len(args) == 0 || args[0] != "migrate" {
+		return fmt.Errorf("usage: config migrate [-n] | genkey | encrypt < value")
+	}
+	flags := flag.NewFlagSet("config migrate", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "Print the migrated config instead of writing it")
+	flags.Parse(args[1:])
+
+	data, err := ioutil.ReadFile(cmdline.Config)
+	if err != nil {
+		return err
+	}
+	var tree map[string]interface{}
+	if _, err := toml.Decode(string(data), &tree); err != nil {
+		return err
+	}
+	version, err := config.Migrate(tree)
+	if err != nil {
+		return err
+	}
+	if version == config.Version && !*dryRun {
+		fmt.Printf("%s is already version %d\n", cmdline.Config, config.Version)
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(tree); err != nil {
+		return err
+	}
+	// Make sure letterbox can read the result before replacing the file
+	var c config.Config
+	if _, err := toml.Decode(buf.String(), &c); err != nil {
+		return fmt.Errorf("migrated config is invalid: %s", err)
+	}
+	if *dryRun {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+
+	info, err := os.Stat(cmdline.Config)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(cmdline.Config+".bak", data, info.Mode()); err != nil {
+		return err
+	}
+	tmp := cmdline.Config + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), info.Mode()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, cmdline.Config); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	fmt.Printf("Migrated %s from version %d to %d, the old file is %s.bak\n", cmdline.Config, version, config.Version, cmdline.Config)
+	return nil
+}
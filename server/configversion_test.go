@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testConfig has most kinds of values used in the config file
+const testConfig = `hosts = ["192.168.101.0/24", "127.0.0.1"]
+emails = ["root@frobozz.org"]
+drain_timeout = "10s"
+max_message_size = 1048576
+
+[reputation]
+tarpit_score = 5.0
+
+[[listeners]]
+address = "192.168.1.2:25"
+hostname = "mx.other.org"
+`
+
+func TestConfigVersion(t *testing.T) {
+	// Files without a version are migrated to the current one
+	old, err := readConfig(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.ConfigVersion != config.Version {
+		t.Errorf("Unversioned config is version %d", old.ConfigVersion)
+	}
+	current, err := readConfig(strings.NewReader("config_version = 1\n" + testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(old, current) {
+		t.Errorf("Migrated config %#v doesn't match %#v", old, current)
+	}
+
+	for _, bad := range []string{"config_version = 99", "config_version = 0", `config_version = "1"`} {
+		if _, err := readConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestConfigMigrateCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(configFile string) { cmdline.Config = configFile }(cmdline.Config)
+	cmdline.Config = filepath.Join(dir, "letterbox.toml")
+	if err := ioutil.WriteFile(cmdline.Config, []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := configCommand([]string{"migrate"}); err != nil {
+		t.Fatal(err)
+	}
+	if backup, _ := ioutil.ReadFile(cmdline.Config + ".bak"); string(backup) != testConfig {
+		t.Errorf("Backup doesn't match the old config: %q", backup)
+	}
+	data, err := ioutil.ReadFile(cmdline.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("config_version = 1\n")) {
+		t.Errorf("Migrated config has no config_version: %s", data)
+	}
+	migrated, err := readConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := readConfig(strings.NewReader(testConfig))
+	if !reflect.DeepEqual(migrated, expected) {
+		t.Errorf("Migrated config %#v doesn't match %#v", migrated, expected)
+	}
+
+	// A current file is left alone
+	os.Remove(cmdline.Config + ".bak")
+	if err := configCommand([]string{"migrate"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cmdline.Config + ".bak"); err == nil {
+		t.Error("Current config was rewritten")
+	}
+
+	if err := configCommand(nil); err == nil {
+		t.Error("config without migrate accepted")
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"crypto/tls"
+	"github.com/bcl/letterbox/smtpd"
+	"strings"
+)
+
+// connInfo holds what is known about the client's connection besides its IP
+// It is passed to the plugins and the Lua script so that policy can depend on
+// how the client connected, not just where from.
+type connInfo struct {
+	id         string // ID of the connection, for the log
+	queueID    string // ID of the message being sent, for the log
+	helo       string // hostname from HELO, EHLO, or LHLO
+	hostname   string // hostname letterbox announced on the listener the client connected to
+	tlsVersion string // TLS version like "1.3", empty without STARTTLS
+	tlsCipher  string // TLS cipher suite name, empty without STARTTLS
+	authUser   string // username from AUTH, empty if the client didn't authenticate
+	identity   string // name of the client identity its TLS certificate matched, if any
+}
+
+// newConnInfo collects the details of the connection
+func newConnInfo(c smtpd.Connection) connInfo {
+	conn := connInfo{
+		id:       c.ID(),
+		helo:     c.Hello(),
+		hostname: c.LocalHostname(),
+		authUser: c.AuthUser(),
+	}
+	if state := c.TLS(); state != nil {
+		conn.tlsVersion = tlsVersionName(state.Version)
+		conn.tlsCipher = tls.CipherSuiteName(state.CipherSuite)
+		conn.identity = certIdentity(state)
+	}
+	return conn
+}
+
+// String returns the connection details for logging
+func (conn connInfo) String() string {
+	fields := []string{"helo=" + conn.helo}
+	if conn.tlsVersion != "" {
+		fields = append(fields, "tls="+conn.tlsVersion, "cipher="+conn.tlsCipher)
+	}
+	if conn.authUser != "" {
+		fields = append(fields, "auth="+conn.authUser)
+	}
+	if conn.identity != "" {
+		fields = append(fields, "cert="+conn.identity)
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+// testConn is a smtpd.Connection with fixed details
+type testConn struct {
+	helo     string
+	tls      *tls.ConnectionState
+	authUser string
+}
+
+func (c testConn) Addr() net.Addr            { return &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 25} }
+func (c testConn) Close() error              { return nil }
+func (c testConn) LocalAddr() net.Addr       { return &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 25} }
+func (c testConn) TLS() *tls.ConnectionState { return c.tls }
+func (c testConn) AuthUser() string          { return c.authUser }
+func (c testConn) Hello() string             { return c.helo }
+func (c testConn) LocalHostname() string     { return "mx.domain.com" }
+func (c testConn) LMTP() bool                { return false }
+func (c testConn) ID() string                { return "c0ffee" }
+
+func TestNewConnInfo(t *testing.T) {
+	conn := newConnInfo(testConn{helo: "printer.lan"})
+	if conn.helo != "printer.lan" || conn.hostname != "mx.domain.com" || conn.tlsVersion != "" || conn.authUser != "" {
+		t.Errorf("Wrong connection info: %#v", conn)
+	}
+	if s := conn.String(); s != "helo=printer.lan" {
+		t.Errorf("Wrong string: %q", s)
+	}
+
+	state := &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256}
+	conn = newConnInfo(testConn{helo: "printer.lan", tls: state, authUser: "printer"})
+	if conn.tlsVersion != "1.3" || conn.tlsCipher != "TLS_AES_128_GCM_SHA256" || conn.authUser != "printer" {
+		t.Errorf("Wrong connection info: %#v", conn)
+	}
+	if s := conn.String(); s != "helo=printer.lan tls=1.3 cipher=TLS_AES_128_GCM_SHA256 auth=printer" {
+		t.Errorf("Wrong string: %q", s)
+	}
+}
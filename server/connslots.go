@@ -0,0 +1,139 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/events"
+	"github.com/bcl/letterbox/smtpd"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultConnectionWait is used when the rate_limit connection_wait isn't set
+const defaultConnectionWait = 10 * time.Second
+
+// errServerBusy is the reply to a client that couldn't get a connection slot in time
+var errServerBusy = smtpd.SMTPError("421 4.3.2 Error: too many connections, try again later")
+
+// slotWaiter is a connection waiting for a slot
+type slotWaiter struct {
+	id      string
+	ip      string
+	granted chan struct{} // closed when the slot is handed to the connection
+}
+
+// connSlots shares the max_connections slots between the clients
+// When they are all in use new connections wait, and a slot that frees up
+// goes to the waiting connection whose IP holds the fewest slots, so a client
+// with no sessions gets in ahead of one that already holds several. Ties go
+// to the connection that has waited longest.
+type connSlots struct {
+	sync.Mutex
+	holders map[string]string // client IP of each connection ID holding a slot
+	held    map[string]int    // number of slots held by each client IP
+	waiters []*slotWaiter
+}
+
+var serverSlots = newConnSlots()
+
+// newConnSlots returns connSlots with no connections
+func newConnSlots() *connSlots {
+	return &connSlots{holders: make(map[string]string), held: make(map[string]int)}
+}
+
+// acquire takes a slot for the connection, waiting up to wait for one to free up
+// It returns false if there was no slot in time.
+func (s *connSlots) acquire(id, ip string, max int, wait time.Duration) bool {
+	s.Lock()
+	if len(s.holders) < max && len(s.waiters) == 0 {
+		s.grant(id, ip)
+		s.Unlock()
+		return true
+	}
+	w := &slotWaiter{id: id, ip: ip, granted: make(chan struct{})}
+	s.waiters = append(s.waiters, w)
+	s.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-w.granted:
+	case <-timer.C:
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	select {
+	case <-w.granted:
+		// It was handed a slot, maybe just as the wait ran out
+		return true
+	default:
+	}
+	for i, other := range s.waiters {
+		if other == w {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			break
+		}
+	}
+	return false
+}
+
+// grant records that the connection holds a slot
+// It must be called with the lock held.
+func (s *connSlots) grant(id, ip string) {
+	s.holders[id] = ip
+	s.held[ip]++
+}
+
+// release frees the connection's slot, if it has one, and hands it to the fairest waiter
+func (s *connSlots) release(id string) {
+	s.Lock()
+	defer s.Unlock()
+	ip, ok := s.holders[id]
+	if !ok {
+		return
+	}
+	delete(s.holders, id)
+	if s.held[ip]--; s.held[ip] <= 0 {
+		delete(s.held, ip)
+	}
+	s.handOff()
+}
+
+// handOff gives the slot that was freed to the waiter whose IP holds the fewest slots
+// It must be called with the lock held.
+func (s *connSlots) handOff() {
+	if len(s.waiters) == 0 {
+		return
+	}
+	best := 0
+	for i, w := range s.waiters {
+		if s.held[w.ip] < s.held[s.waiters[best].ip] {
+			best = i
+		}
+	}
+	w := s.waiters[best]
+	s.waiters = append(s.waiters[:best], s.waiters[best+1:]...)
+	s.grant(w.id, w.ip)
+	close(w.granted)
+}
+
+// connectionWait returns how long a connection waits for a slot when they are all in use
+func connectionWait() time.Duration {
+	if cfg.RateLimit.ConnectionWait.Duration == 0 {
+		return defaultConnectionWait
+	}
+	return cfg.RateLimit.ConnectionWait.Duration
+}
+
+// serverBusy returns an error if letterbox has max_connections open and no slot frees up in time
+// Exempt hosts don't use up a slot.
+func serverBusy(clientIP net.IP, conn connInfo) error {
+	if cfg.RateLimit.MaxConnections == 0 || hostExempt(clientIP) {
+		return nil
+	}
+	if serverSlots.acquire(conn.id, clientIP.String(), cfg.RateLimit.MaxConnections, connectionWait()) {
+		return nil
+	}
+	reject(clientIP, conn, "", "", events.ReasonRateLimit, "Too many connections to the server")
+	return errServerBusy
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bufio"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnSlotsFairness(t *testing.T) {
+	s := newConnSlots()
+	if !s.acquire("a1", "192.168.1.5", 2, time.Second) || !s.acquire("a2", "192.168.1.5", 2, time.Second) {
+		t.Fatal("Free slots not acquired")
+	}
+	if s.acquire("a3", "192.168.1.5", 2, 10*time.Millisecond) {
+		t.Fatal("Slot acquired over max_connections")
+	}
+
+	// The busy client starts waiting first, but the one without sessions gets the slot
+	busy := make(chan bool)
+	quiet := make(chan bool)
+	go func() { busy <- s.acquire("a4", "192.168.1.5", 2, 200*time.Millisecond) }()
+	time.Sleep(20 * time.Millisecond)
+	go func() { quiet <- s.acquire("b1", "192.168.1.6", 2, time.Second) }()
+	time.Sleep(20 * time.Millisecond)
+	s.release("a1")
+	if !<-quiet {
+		t.Error("Client without sessions didn't get the free slot")
+	}
+	if <-busy {
+		t.Error("Busy client got a slot")
+	}
+
+	// Releasing unknown and already released connections doesn't free anything
+	s.release("a1")
+	s.release("a3")
+	if s.acquire("c1", "192.168.1.7", 2, 10*time.Millisecond) {
+		t.Error("Slot acquired over max_connections")
+	}
+	s.release("b1")
+	if !s.acquire("c1", "192.168.1.7", 2, 10*time.Millisecond) {
+		t.Error("Released slot not acquired")
+	}
+	if len(s.holders) != 2 || s.held["192.168.1.5"] != 1 || s.held["192.168.1.6"] != 0 || len(s.waiters) != 0 {
+		t.Errorf("Wrong slots: %v %v %d", s.holders, s.held, len(s.waiters))
+	}
+}
+
+func TestServerBusy(t *testing.T) {
+	defer func() {
+		cfg = config.Config{}
+		allowedList = access.List{}
+		serverSlots = newConnSlots()
+	}()
+	cfg.Hosts = []string{"127.0.0.3"}
+	cfg.RateLimit = config.RateLimit{MaxConnections: 1, ConnectionWait: config.Duration{Duration: 100 * time.Millisecond}}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+
+	// Other tests leave connections from 127.0.0.1 open, so connect from 127.0.0.3
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.3")}}
+	conn, err := dialer.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := smtp.NewClient(conn, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := dialer.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	banner, _ := bufio.NewReader(second).ReadString('\n')
+	second.Close()
+	if !strings.HasPrefix(banner, "421 4.3.2") {
+		t.Errorf("Connection over max_connections got %q", banner)
+	}
+
+	// Once the first client leaves there is room again
+	client.Quit()
+	third, err := dialer.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	banner, _ = bufio.NewReader(third).ReadString('\n')
+	if !strings.HasPrefix(banner, "220") {
+		t.Errorf("Connection after a slot freed up got %q", banner)
+	}
+}
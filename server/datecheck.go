@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bcl/letterbox/smtpd"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// dateResult is the result of comparing a message's Date header to the server's clock
+type dateResult string
+
+// The results of checkDate
+const (
+	datePass    dateResult = "pass"    // the Date is within date_skew of the server's time
+	dateNone    dateResult = "none"    // the message has no Date header
+	dateInvalid dateResult = "invalid" // the Date header can't be parsed
+	dateFuture  dateResult = "future"  // the Date is more than date_skew ahead
+	datePast    dateResult = "past"    // the Date is more than date_skew behind
+)
+
+// defaultDateSkew is used when date_skew isn't set
+const defaultDateSkew = 72 * time.Hour
+
+// dateCheckMode returns what to do with the result of the Date header check
+/*
+   Example TOML:
+
+   date_check = "reject"
+   date_skew = "48h"
+
+   "off" doesn't check the Date header, and is the default. "mark" adds an
+   X-Date-Check header with the result, for the scanner to score. "reject"
+   also refuses messages whose Date is more than date_skew, 72h by default,
+   ahead of or behind the server's time, or can't be parsed. Messages without
+   a Date header are only marked.
+*/
+func dateCheckMode() string {
+	if cfg.DateCheck == "" {
+		return "off"
+	}
+	return strings.ToLower(cfg.DateCheck)
+}
+
+// checkDateCheckMode checks the date_check setting
+func checkDateCheckMode() error {
+	switch dateCheckMode() {
+	case "off", "mark", "reject":
+		return nil
+	}
+	return fmt.Errorf("unknown date_check setting: %s", cfg.DateCheck)
+}
+
+// dateSkew returns how far the Date header can be from the server's time
+func dateSkew() time.Duration {
+	if cfg.DateSkew.Duration == 0 {
+		return defaultDateSkew
+	}
+	return cfg.DateSkew.Duration
+}
+
+// checkDate compares the message's Date header to now
+// It returns the result, and how far the Date is from now.
+func checkDate(headers mail.Header, now time.Time) (dateResult, time.Duration) {
+	if headers.Get("Date") == "" {
+		return dateNone, 0
+	}
+	date, err := headers.Date()
+	if err != nil {
+		return dateInvalid, 0
+	}
+	offset := date.Sub(now)
+	switch {
+	case offset > dateSkew():
+		return dateFuture, offset
+	case offset < -dateSkew():
+		return datePast, -offset
+	}
+	return datePass, 0
+}
+
+// dateCheckHeader checks the Date header, returning the X-Date-Check header to add or nil
+// It is called at the end of the message's header, and the result is kept for
+// dateRejected.
+func (e *env) dateCheckHeader(now time.Time) []byte {
+	if dateCheckMode() == "off" || e.headers == nil {
+		return nil
+	}
+	var offset time.Duration
+	e.dateCheck, offset = checkDate(e.headers, now)
+	var comment string
+	switch e.dateCheck {
+	case datePass:
+		comment = "within " + dateSkew().String() + " of the server"
+	case dateNone:
+		comment = "no Date header"
+	case dateInvalid:
+		comment = "Date header can't be parsed"
+	case dateFuture:
+		comment = offset.Truncate(time.Minute).String() + " ahead of the server"
+	case datePast:
+		comment = offset.Truncate(time.Minute).String() + " behind the server"
+	}
+	return foldHeader("X-Date-Check", fmt.Sprintf("%s (%s)", e.dateCheck, comment))
+}
+
+// dateRejected returns an error if the Date header failed the check and date_check is reject
+func (e *env) dateRejected() error {
+	if dateCheckMode() != "reject" {
+		return nil
+	}
+	switch e.dateCheck {
+	case dateFuture:
+		return smtpd.SMTPError("550 5.7.1 Error: message Date is too far in the future")
+	case datePast:
+		return smtpd.SMTPError("550 5.7.1 Error: message Date is too far in the past")
+	case dateInvalid:
+		return smtpd.SMTPError("550 5.7.1 Error: message Date header is invalid")
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckDate(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		date   string
+		result dateResult
+	}{
+		{"Tue, 02 Jan 2024 10:04:05 -0500", datePass},
+		{"Thu, 04 Jan 2024 15:04:05 +0000", datePass},
+		{"Sat, 06 Jan 2024 15:04:05 +0000", dateFuture},
+		{"Mon, 01 Jan 1990 00:00:00 +0000", datePast},
+		{"yesterday", dateInvalid},
+		{"", dateNone},
+	}
+	for _, tt := range tests {
+		headers := mail.Header{}
+		if tt.date != "" {
+			headers["Date"] = []string{tt.date}
+		}
+		if result, _ := checkDate(headers, now); result != tt.result {
+			t.Errorf("checkDate(%q) = %s, expected %s", tt.date, result, tt.result)
+		}
+	}
+
+	cfg.DateSkew = config.Duration{Duration: time.Hour}
+	headers := mail.Header{"Date": []string{"Tue, 02 Jan 2024 17:34:05 +0000"}}
+	if result, offset := checkDate(headers, now); result != dateFuture || offset != 150*time.Minute {
+		t.Errorf("checkDate with a 1h skew = %s %s", result, offset)
+	}
+
+	cfg.DateCheck = "sometimes"
+	if err := checkDateCheckMode(); err == nil {
+		t.Error("Unknown date_check accepted")
+	}
+}
+
+func TestDateCheckMail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com", "tickets@domain.com"}
+	cfg.UntracedRecipients = []string{"tickets"}
+	cfg.DateCheck = "reject"
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+
+	ancient := []byte("Date: Mon, 01 Jan 1990 00:00:00 +0000\r\nSubject: old\r\n\r\nHello\r\n")
+	err = smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com"}, ancient)
+	if err == nil || !strings.HasPrefix(err.Error(), "550") || !strings.Contains(err.Error(), "past") {
+		t.Errorf("Message with an ancient Date not rejected: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new")); len(files) != 0 {
+		t.Errorf("Rejected message delivered")
+	}
+	current := []byte("Date: " + time.Now().Format(time.RFC1123Z) + "\r\nSubject: now\r\n\r\nHello\r\n")
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com", "tickets@domain.com"}, current); err != nil {
+		t.Fatalf("Message with the current Date rejected: %s", err)
+	}
+
+	// mark only adds the header, at the end of the message's header
+	cfg.DateCheck = "mark"
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com"}, ancient); err != nil {
+		t.Fatalf("Message with an ancient Date rejected with date_check = mark: %s", err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new"))
+	if len(files) != 2 {
+		t.Fatalf("%d messages delivered, expected 2", len(files))
+	}
+	var messages string
+	for _, f := range files {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "bcl", "new", f.Name()))
+		messages += string(data)
+	}
+	for _, h := range []string{"Subject: now\r\nX-Date-Check: pass (within 72h0m0s of the server)\r\n\r\n", "Subject: old\r\nX-Date-Check: past ("} {
+		if !strings.Contains(messages, h) {
+			t.Errorf("%q missing from %q", h, messages)
+		}
+	}
+
+	// Untraced recipients don't get the header
+	files, _ = ioutil.ReadDir(filepath.Join(dir, "tickets", "new"))
+	if len(files) != 1 {
+		t.Fatalf("%d messages delivered to tickets, expected 1", len(files))
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "tickets", "new", files[0].Name())); string(data) != string(current) {
+		t.Errorf("Untraced message changed: %q", data)
+	}
+}
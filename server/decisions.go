@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxDecisions is how many of the recent decisions are kept
+const maxDecisions = 200
+
+// hostMatches counts the connections allowed by each hosts entry, and rejections counts each reject code
+var (
+	hostMatches = expvar.NewMap("host_matches")
+	rejections  = expvar.NewMap("rejections")
+)
+
+// decision is why a client was let in, or why it or its mail was rejected
+type decision struct {
+	Time    time.Time `json:"time"`
+	IP      string    `json:"ip,omitempty"`
+	Conn    string    `json:"conn"`
+	Allowed bool      `json:"allowed"`
+	Match   string    `json:"match,omitempty"` // hosts entry that let the client in
+	Code    string    `json:"code,omitempty"`  // reject code, like host-not-allowed
+	Reason  string    `json:"reason,omitempty"`
+	From    string    `json:"from,omitempty"`
+	Rcpt    string    `json:"rcpt,omitempty"`
+}
+
+// decisionLog is a ring buffer of the most recent decisions
+type decisionLog struct {
+	sync.Mutex
+	entries []decision
+	next    int // index the next decision is written to once the buffer is full
+}
+
+var decisions = &decisionLog{}
+
+// add records a decision, replacing the oldest one when the log is full
+func (d *decisionLog) add(dec decision) {
+	d.Lock()
+	defer d.Unlock()
+	if len(d.entries) < maxDecisions {
+		d.entries = append(d.entries, dec)
+		return
+	}
+	d.entries[d.next] = dec
+	d.next = (d.next + 1) % maxDecisions
+}
+
+// recent returns the decisions, oldest first, only for the client IP if ip isn't empty
+func (d *decisionLog) recent(ip string) []decision {
+	d.Lock()
+	defer d.Unlock()
+	list := []decision{}
+	for i := range d.entries {
+		dec := d.entries[(d.next+i)%len(d.entries)]
+		if ip == "" || dec.IP == ip {
+			list = append(list, dec)
+		}
+	}
+	return list
+}
+
+// recordAllowed counts the hosts entry that let the client in, and adds it to the recent decisions
+func recordAllowed(clientIP net.IP, conn connInfo, match string) {
+	hostMatches.Add(match, 1)
+	decisions.add(decision{Time: time.Now(), IP: clientIP.String(), Conn: conn.id, Allowed: true, Match: match})
+	writeJournal(journalEntry{Kind: "connect", Conn: conn.id, IP: clientIP.String(), Disposition: "accepted", Match: match})
+}
+
+// recordRejected counts the reject code, and adds the rejection to the recent decisions
+func recordRejected(ip string, conn connInfo, from, rcpt, code, reason string) {
+	rejections.Add(code, 1)
+	decisions.add(decision{Time: time.Now(), IP: ip, Conn: conn.id, Code: code, Reason: reason, From: from, Rcpt: rcpt})
+	writeJournal(journalEntry{Kind: "reject", Conn: conn.id, QueueID: conn.queueID, IP: ip, From: from, Rcpt: rcpt, Code: code, Reason: reason})
+}
+
+// serveDecisions serves the recent decisions as JSON, only for one client with ?ip=192.168.1.5
+func serveDecisions(w http.ResponseWriter, r *http.Request) {
+	ip := r.URL.Query().Get("ip")
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(decisions.recent(ip))
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"net"
+	"net/http/httptest"
+	"net/smtp"
+	"testing"
+)
+
+func TestDecisionLog(t *testing.T) {
+	d := &decisionLog{}
+	for i := 0; i < maxDecisions+5; i++ {
+		d.add(decision{IP: fmt.Sprintf("10.0.0.%d", i%2), Code: fmt.Sprint(i)})
+	}
+	all := d.recent("")
+	if len(all) != maxDecisions || all[0].Code != "5" || all[len(all)-1].Code != fmt.Sprint(maxDecisions+4) {
+		t.Errorf("Wrong decisions kept: %d, first %q, last %q", len(all), all[0].Code, all[len(all)-1].Code)
+	}
+	if one := d.recent("10.0.0.1"); len(one) != maxDecisions/2 {
+		t.Errorf("Wrong number of decisions for one IP: %d", len(one))
+	}
+}
+
+func TestDecisions(t *testing.T) {
+	defer func() {
+		cfg = config.Config{}
+		allowedList = access.List{}
+		decisions = &decisionLog{}
+	}()
+	decisions = &decisionLog{}
+	cfg.Hosts = []string{"127.0.0.0/8"}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	c, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	// A client that isn't listed is rejected
+	cfg.Hosts = []string{"192.168.1.1"}
+	parseHosts()
+	if c, err := smtp.Dial(ln.Addr().String()); err == nil {
+		c.Quit()
+	}
+
+	w := httptest.NewRecorder()
+	serveDecisions(w, httptest.NewRequest("GET", "/decisions?ip=127.0.0.1", nil))
+	var list []decision
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || !list[0].Allowed || list[0].Match != "127.0.0.0/8" || list[1].Allowed || list[1].Code != "host-not-allowed" {
+		t.Errorf("Wrong decisions: %#v", list)
+	}
+	if hostMatches.Get("127.0.0.0/8") == nil || rejections.Get("host-not-allowed") == nil {
+		t.Errorf("Decisions not counted: %s %s", hostMatches, rejections)
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// dedupCache remembers the Message-IDs delivered to each recipient until their window expires
+type dedupCache struct {
+	sync.Mutex
+	expires map[string]time.Time
+}
+
+var dedup = &dedupCache{expires: make(map[string]time.Time)}
+
+// dedupWindow returns how long to suppress duplicates for the recipient
+/*
+   Example TOML:
+
+   [dedup]
+   window = "1h"
+
+   [dedup.recipients]
+   "monitor@domain.com" = "0s"
+   "bcl@domain.com" = "24h"
+*/
+func dedupWindow(rcpt string) time.Duration {
+	if w, ok := cfg.Dedup.Recipients[rcpt]; ok {
+		return w.Duration
+	}
+	return cfg.Dedup.Window.Duration
+}
+
+// duplicate returns true if the message has already been delivered to the
+// recipient within its window, otherwise it remembers the delivery.
+// Messages without a Message-ID are never duplicates.
+func (d *dedupCache) duplicate(rcpt, msgID string, now time.Time) bool {
+	window := dedupWindow(rcpt)
+	if window <= 0 || msgID == "" {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	for k, exp := range d.expires {
+		if !exp.After(now) {
+			delete(d.expires, k)
+		}
+	}
+	key := rcpt + " " + msgID
+	if _, ok := d.expires[key]; ok {
+		return true
+	}
+	d.expires[key] = now.Add(window)
+	return false
+}
+
+// forget removes the delivery of the message to the recipient, when it was taken back
+func (d *dedupCache) forget(rcpt, msgID string) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.expires, rcpt+" "+msgID)
+}
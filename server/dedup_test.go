@@ -0,0 +1,46 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/config"
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	cfg.Dedup = config.Dedup{
+		Window: config.Duration{Duration: time.Hour},
+		Recipients: map[string]config.Duration{
+			"monitor@domain.com": {Duration: 0},
+			"bcl@domain.com":     {Duration: 24 * time.Hour},
+		},
+	}
+	defer func() { cfg.Dedup = config.Dedup{} }()
+	d := &dedupCache{expires: make(map[string]time.Time)}
+	now := time.Now()
+
+	if d.duplicate("user@domain.com", "<1@x>", now) {
+		t.Error("First delivery is a duplicate")
+	}
+	if !d.duplicate("user@domain.com", "<1@x>", now.Add(time.Minute)) {
+		t.Error("Second delivery is not a duplicate")
+	}
+	if d.duplicate("other@domain.com", "<1@x>", now) {
+		t.Error("Delivery to another recipient is a duplicate")
+	}
+	if d.duplicate("user@domain.com", "<1@x>", now.Add(2*time.Hour)) {
+		t.Error("Delivery after the window is a duplicate")
+	}
+	if d.duplicate("user@domain.com", "", now) || d.duplicate("user@domain.com", "", now) {
+		t.Error("Message without a Message-ID is a duplicate")
+	}
+
+	// Per-recipient windows
+	d.duplicate("monitor@domain.com", "<2@x>", now)
+	if d.duplicate("monitor@domain.com", "<2@x>", now) {
+		t.Error("Duplicate suppressed for recipient with suppression off")
+	}
+	d.duplicate("bcl@domain.com", "<3@x>", now)
+	if !d.duplicate("bcl@domain.com", "<3@x>", now.Add(12*time.Hour)) {
+		t.Error("Duplicate not suppressed within recipient's window")
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/delivery"
+	"github.com/luksen/maildir"
+)
+
+// singleCopy returns true if a message to several maildirs is written once and hardlinked into each
+/*
+   Example TOML:
+
+   single_copy = true
+
+   Only copies with the same headers are shared, so each recipient keeps
+   its Delivered-To header: the users a recipient's aliases expand to share
+   one copy, and recipients in untraced_recipients share a copy without
+   letterbox's headers. Mbox deliveries, and
+   maildirs on another filesystem, still get their own copy. It is off with
+   deliver_as_owner, since the copies belong to different accounts.
+*/
+func singleCopy() bool {
+	return cfg.SingleCopy && !cfg.DeliverAsOwner
+}
+
+// newDelivery starts delivering a new message to the maildir
+func newDelivery(dir maildir.Dir) (*delivery.Delivery, error) {
+	d, err := delivery.New(dir)
+	if err != nil {
+		return nil, err
+	}
+	d.Sync = syncEnabled()
+	return d, nil
+}
+
+// newMboxDelivery starts delivering a new message to an mbox file
+func newMboxDelivery(mbox, from string) (*delivery.Delivery, error) {
+	d, err := delivery.NewMbox(mbox, from)
+	if err != nil {
+		return nil, err
+	}
+	d.Sync = syncEnabled()
+	return d, nil
+}
+
+// mailOwner returns the Owner for a delivery to the user, which gives the new mail files to the user's account
+func mailOwner(user string) func(path string) error {
+	return func(path string) error {
+		return setMailOwner(path, false, user)
+	}
+}
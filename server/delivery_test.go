@@ -0,0 +1,150 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/smtpd"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSingleCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		aliases = nil
+	}()
+	cmdline.Maildirs = dir
+	cfg.Emails = []string{"team@domain.com", "bob@domain.com", "tickets@domain.com"}
+	cfg.UntracedRecipients = []string{"tickets@domain.com"}
+	cfg.SingleCopy = true
+	aliases = map[string][]string{"team": {"bcl", "alice"}}
+
+	opts := sendmailOptions{from: "root@localhost", rcpts: []string{"team@domain.com", "tickets@domain.com", "bob@domain.com"}}
+	if err := injectMessage(localConn{user: "cron", id: "c0ffee"}, opts, strings.NewReader("Subject: alert\n\ndisk full\n")); err != nil {
+		t.Fatal(err)
+	}
+	infos := make(map[string]os.FileInfo)
+	for user, deliveredTo := range map[string]string{"bcl": "team@domain.com", "alice": "team@domain.com", "bob": "bob@domain.com", "tickets": ""} {
+		files, err := ioutil.ReadDir(filepath.Join(dir, user, "new"))
+		if err != nil || len(files) != 1 {
+			t.Fatalf("Message not delivered to %s: %v", user, err)
+		}
+		path := filepath.Join(dir, user, "new", files[0].Name())
+		infos[user], _ = os.Stat(path)
+		data, _ := ioutil.ReadFile(path)
+		if deliveredTo != "" && !strings.Contains(string(data), "Delivered-To: "+deliveredTo+"\r\n") {
+			t.Errorf("Copy for %s doesn't have Delivered-To %s: %q", user, deliveredTo, data)
+		}
+		if deliveredTo == "" && strings.Contains(string(data), "Delivered-To") {
+			t.Errorf("Untraced copy for %s has Delivered-To: %q", user, data)
+		}
+	}
+	if !os.SameFile(infos["bcl"], infos["alice"]) {
+		t.Error("Copies for the alias weren't hardlinked")
+	}
+	if os.SameFile(infos["bcl"], infos["bob"]) {
+		t.Error("Copies for different recipients share a file")
+	}
+	if os.SameFile(infos["bcl"], infos["tickets"]) {
+		t.Error("Untraced copy shares the traced file")
+	}
+}
+
+func TestDeliveryTakenBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		dedup = &dedupCache{expires: make(map[string]time.Time)}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Emails = []string{"bcl@domain.com", "bob@domain.com"}
+	cfg.Dedup.Window = config.Duration{Duration: time.Hour}
+
+	conn := localConn{user: "cron", id: "c0ffee"}
+	envelope, err := onNewMail(conn, localAddress("root@localhost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"bcl@domain.com", "bob@domain.com"} {
+		if err := envelope.AddRecipient(localAddress(rcpt)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := envelope.BeginData(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"Message-Id: <1@domain.com>\r\n", "\r\n", "hello\r\n"} {
+		if err := envelope.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Linking into bob's maildir fails after bcl's copy has been delivered
+	os.RemoveAll(filepath.Join(dir, "bob", "new"))
+	ioutil.WriteFile(filepath.Join(dir, "bob", "new"), nil, 0600)
+	if err := envelope.Close(); err == nil {
+		t.Fatal("Close didn't fail")
+	}
+	for i, err := range envelope.(smtpd.RecipientResults).RecipientErrors() {
+		if err == nil {
+			t.Errorf("Recipient %d didn't fail", i)
+		}
+	}
+	for _, path := range []string{"bcl/new", "bcl/tmp", "bob/tmp"} {
+		if files, _ := ioutil.ReadDir(filepath.Join(dir, path)); len(files) != 0 {
+			t.Errorf("%d files left in %s", len(files), path)
+		}
+	}
+	if dedup.duplicate("bcl@domain.com", "<1@domain.com>", time.Now()) {
+		t.Error("Sending the message again is a duplicate")
+	}
+}
+
+func TestBeginDataAborted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Emails = []string{"bcl@domain.com", "bob@domain.com"}
+
+	conn := localConn{user: "cron", id: "c0ffee"}
+	envelope, err := onNewMail(conn, localAddress("root@localhost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"bcl@domain.com", "bob@domain.com"} {
+		if err := envelope.AddRecipient(localAddress(rcpt)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// bob's maildir can't be created after bcl's delivery has been started
+	ioutil.WriteFile(filepath.Join(dir, "bob"), nil, 0600)
+	if err := envelope.BeginData(); err == nil {
+		t.Fatal("BeginData didn't fail")
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "tmp")); len(files) != 0 {
+		t.Errorf("%d files left in bcl/tmp", len(files))
+	}
+}
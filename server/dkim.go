@@ -0,0 +1,511 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"github.com/bcl/letterbox/smtpd"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dkimMaxSignatures is the most signatures that are checked on one message
+const dkimMaxSignatures = 5
+
+// dkimMinRSABits is the smallest RSA key that is trusted, RFC 8301 section 3.2
+const dkimMinRSABits = 1024
+
+// dkimEnabled returns true if signatures are checked
+/*
+   Example TOML:
+
+   [dkim]
+   verify = true
+   reject_domains = ["paypal.com", "mybank.com"]
+
+   Listing reject_domains turns on verify.
+*/
+func dkimEnabled() bool {
+	return cfg.DKIM.Verify || len(cfg.DKIM.RejectDomains) > 0
+}
+
+// dkimResult is the result of checking one signature
+// result is pass, fail, temperror, or permerror as used in Authentication-Results.
+type dkimResult struct {
+	result   string
+	domain   string // d= tag
+	selector string // s= tag
+	b        string // start of the b= tag, to tell signatures apart
+	reason   string // why it didn't pass
+}
+
+// dkimSignature is a parsed DKIM-Signature header
+type dkimSignature struct {
+	field    string            // the header field as it was received
+	tags     map[string]string // tag values, with folding whitespace left in
+	hash     crypto.Hash
+	keyType  string // rsa or ed25519
+	relaxedH bool   // relaxed header canonicalization
+	relaxedB bool   // relaxed body canonicalization
+}
+
+// dkimWSP matches runs of whitespace for relaxed canonicalization
+var dkimWSP = regexp.MustCompile(`[ \t]+`)
+
+// dkimBTag matches the b= tag's value so it can be removed before hashing
+var dkimBTag = regexp.MustCompile(`([:;][ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+// splitMessage splits a message into its header fields, each ending in CRLF
+// with any folding kept, and its body. Bare LF line endings are treated as CRLF.
+func splitMessage(message []byte) ([]string, string) {
+	lines := strings.Split(string(message), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	var fields []string
+	i := 0
+	for ; i < len(lines) && lines[i] != ""; i++ {
+		if (lines[i][0] == ' ' || lines[i][0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += lines[i] + "\r\n"
+			continue
+		}
+		fields = append(fields, lines[i]+"\r\n")
+	}
+	if i >= len(lines)-1 {
+		return fields, ""
+	}
+	return fields, strings.Join(lines[i+1:], "\r\n")
+}
+
+// fieldName returns the lowercase name of a header field
+func fieldName(field string) string {
+	if i := strings.Index(field, ":"); i != -1 {
+		return strings.ToLower(strings.TrimSpace(field[:i]))
+	}
+	return ""
+}
+
+// parseTags parses a DKIM tag=value list, like the signature header or a key record
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		i := strings.Index(part, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("bad tag %q", strings.TrimSpace(part))
+		}
+		name := strings.TrimSpace(part[:i])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(part[i+1:])
+	}
+	return tags, nil
+}
+
+// stripWSP removes all whitespace, for base64 values that have been folded
+func stripWSP(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// canonHeader canonicalizes a header field for hashing
+func canonHeader(field string, relaxed bool) string {
+	if !relaxed {
+		return field
+	}
+	i := strings.Index(field, ":")
+	value := strings.NewReplacer("\r\n", "").Replace(field[i+1:])
+	value = strings.TrimSpace(dkimWSP.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(field[:i])) + ":" + value + "\r\n"
+}
+
+// canonBody canonicalizes the body for hashing
+// Trailing empty lines are removed, and with relaxed runs of whitespace become
+// a single space and whitespace at the end of lines is removed.
+func canonBody(body string, relaxed bool) string {
+	lines := strings.Split(body, "\r\n")
+	if relaxed {
+		for i := range lines {
+			lines[i] = strings.TrimRight(dkimWSP.ReplaceAllString(lines[i], " "), " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if relaxed {
+			return ""
+		}
+		return "\r\n"
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// parseSignature parses and checks the tags of a DKIM-Signature header field
+func parseSignature(field string) (*dkimSignature, error) {
+	tags, err := parseTags(field[strings.Index(field, ":")+1:])
+	if err != nil {
+		return nil, err
+	}
+	sig := &dkimSignature{field: field, tags: tags}
+	for _, name := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[name] == "" {
+			return sig, fmt.Errorf("missing %s= tag", name)
+		}
+	}
+	if tags["v"] != "1" {
+		return sig, fmt.Errorf("unknown version %q", tags["v"])
+	}
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		sig.keyType, sig.hash = "rsa", crypto.SHA256
+	case "rsa-sha1":
+		// SHA-1 signatures can be forged, RFC 8301 section 3.1
+		return sig, fmt.Errorf("rsa-sha1 signatures aren't accepted")
+	case "ed25519-sha256":
+		sig.keyType, sig.hash = "ed25519", crypto.SHA256
+	default:
+		return sig, fmt.Errorf("unknown algorithm %q", tags["a"])
+	}
+	canon := strings.ToLower(tags["c"])
+	if canon == "" {
+		canon = "simple/simple"
+	}
+	header, body := canon, "simple"
+	if i := strings.Index(canon, "/"); i != -1 {
+		header, body = canon[:i], canon[i+1:]
+	}
+	for _, c := range []string{header, body} {
+		if c != "simple" && c != "relaxed" {
+			return sig, fmt.Errorf("unknown canonicalization %q", tags["c"])
+		}
+	}
+	sig.relaxedH, sig.relaxedB = header == "relaxed", body == "relaxed"
+
+	signed := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		if strings.EqualFold(strings.TrimSpace(name), "from") {
+			signed = true
+		}
+	}
+	if !signed {
+		return sig, fmt.Errorf("From isn't signed")
+	}
+	return sig, nil
+}
+
+// dkimKey looks up the public key for the signature
+// The error result is temperror if the lookup failed, and permerror if the key is missing or bad.
+func dkimKey(sig *dkimSignature) (crypto.PublicKey, string, error) {
+	name := sig.tags["s"] + "._domainkey." + sig.tags["d"]
+	txts, err := resolver.LookupTXT(name)
+	if err != nil {
+		return nil, "temperror", err
+	}
+	if len(txts) == 0 {
+		return nil, "permerror", fmt.Errorf("no key at %s", name)
+	}
+	tags, err := parseTags(txts[0])
+	if err != nil {
+		return nil, "permerror", err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, "permerror", fmt.Errorf("unknown key version %q", v)
+	}
+	keyType := strings.ToLower(tags["k"])
+	if keyType == "" {
+		keyType = "rsa"
+	}
+	if keyType != sig.keyType {
+		return nil, "permerror", fmt.Errorf("key is %s, signature is %s", keyType, sig.keyType)
+	}
+	data, err := base64.StdEncoding.DecodeString(stripWSP(tags["p"]))
+	if err != nil {
+		return nil, "permerror", fmt.Errorf("bad key: %s", err)
+	}
+	if len(data) == 0 {
+		return nil, "permerror", fmt.Errorf("key has been revoked")
+	}
+	if keyType == "ed25519" {
+		if len(data) != ed25519.PublicKeySize {
+			return nil, "permerror", fmt.Errorf("bad ed25519 key")
+		}
+		return ed25519.PublicKey(data), "", nil
+	}
+	var rsaKey *rsa.PublicKey
+	key, err := x509.ParsePKIXPublicKey(data)
+	if err != nil {
+		if rsaKey, err = x509.ParsePKCS1PublicKey(data); err != nil {
+			return nil, "permerror", fmt.Errorf("bad key: %s", err)
+		}
+	} else if k, ok := key.(*rsa.PublicKey); ok {
+		rsaKey = k
+	} else {
+		return nil, "permerror", fmt.Errorf("key isn't an RSA key")
+	}
+	if bits := rsaKey.N.BitLen(); bits < dkimMinRSABits {
+		return nil, "permerror", fmt.Errorf("%d bit RSA key is too short", bits)
+	}
+	return rsaKey, "", nil
+}
+
+// signedHeaders returns the canonicalized header fields listed in the h= tag
+// Fields with the same name are used from the bottom up, and names listed
+// more times than they appear are skipped.
+func (sig *dkimSignature) signedHeaders(fields []string) string {
+	used := make(map[int]bool)
+	var b strings.Builder
+	for _, name := range strings.Split(sig.tags["h"], ":") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && fieldName(fields[i]) == name {
+				used[i] = true
+				b.WriteString(canonHeader(fields[i], sig.relaxedH))
+				break
+			}
+		}
+	}
+	// The signature itself is hashed last, without its b= value or final CRLF
+	unsigned := dkimBTag.ReplaceAllString(sig.field, "$1")
+	b.WriteString(strings.TrimSuffix(canonHeader(unsigned, sig.relaxedH), "\r\n"))
+	return b.String()
+}
+
+// digest returns the SHA-256 hash of the data
+func (sig *dkimSignature) digest(data string) []byte {
+	sum := sha256.Sum256([]byte(data))
+	return sum[:]
+}
+
+// verify checks one signature against the message's header fields and the hash of its body
+func (sig *dkimSignature) verify(fields []string, body *dkimBodyHash, now time.Time) (string, error) {
+	if x := sig.tags["x"]; x != "" {
+		if expires, err := strconv.ParseInt(x, 10, 64); err == nil && now.Unix() > expires {
+			return "fail", fmt.Errorf("signature expired")
+		}
+	}
+
+	sum := body.sum()
+	if l := sig.tags["l"]; l != "" {
+		n, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || n < 0 || n > body.length {
+			return "permerror", fmt.Errorf("bad body length %q", l)
+		}
+	}
+	bh, err := base64.StdEncoding.DecodeString(stripWSP(sig.tags["bh"]))
+	if err != nil {
+		return "permerror", fmt.Errorf("bad body hash: %s", err)
+	}
+	if string(sum) != string(bh) {
+		return "fail", fmt.Errorf("body hash did not verify")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(stripWSP(sig.tags["b"]))
+	if err != nil {
+		return "permerror", fmt.Errorf("bad signature: %s", err)
+	}
+	key, result, err := dkimKey(sig)
+	if err != nil {
+		return result, err
+	}
+	hashed := sig.digest(sig.signedHeaders(fields))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(k, sig.hash, hashed, signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, hashed, signature) {
+			err = fmt.Errorf("ed25519 verification error")
+		}
+	}
+	if err != nil {
+		return "fail", fmt.Errorf("signature did not verify")
+	}
+	return "pass", nil
+}
+
+// dkimVerifier checks a message's DKIM signatures
+// It is made from the message's header, and the body is hashed for each
+// signature as it is written, so checking them at the end of DATA doesn't
+// have to read the whole message again.
+type dkimVerifier struct {
+	fields []string         // header fields, for the signed headers
+	sigs   []*dkimSignature // signatures to check, nil if one couldn't be parsed at all
+	errs   []error          // why each signature can't be checked
+	bodies []*dkimBodyHash  // body hash for each signature that can be checked
+}
+
+// newDKIMVerifier parses the signatures in the message header
+func newDKIMVerifier(header []byte) *dkimVerifier {
+	fields, _ := splitMessage(header)
+	v := &dkimVerifier{fields: fields}
+	for _, field := range fields {
+		if fieldName(field) != "dkim-signature" {
+			continue
+		}
+		if len(v.sigs) == dkimMaxSignatures {
+			break
+		}
+		sig, err := parseSignature(field)
+		var body *dkimBodyHash
+		if err == nil {
+			body = newDKIMBodyHash(sig)
+		}
+		v.sigs = append(v.sigs, sig)
+		v.errs = append(v.errs, err)
+		v.bodies = append(v.bodies, body)
+	}
+	return v
+}
+
+// writeBody hashes one line of the body for each signature
+func (v *dkimVerifier) writeBody(line []byte) {
+	for _, body := range v.bodies {
+		if body != nil {
+			body.write(line)
+		}
+	}
+}
+
+// results checks the signatures once the whole body has been written, returning nothing if the message isn't signed
+func (v *dkimVerifier) results(now time.Time) []dkimResult {
+	var results []dkimResult
+	for i, sig := range v.sigs {
+		var r dkimResult
+		if sig != nil {
+			r.domain = strings.ToLower(sig.tags["d"])
+			r.selector = sig.tags["s"]
+			r.b = stripWSP(sig.tags["b"])
+			if len(r.b) > 8 {
+				r.b = r.b[:8]
+			}
+		}
+		err := v.errs[i]
+		if err != nil {
+			r.result = "permerror"
+		} else {
+			r.result, err = sig.verify(v.fields, v.bodies[i], now)
+		}
+		if err != nil {
+			r.reason = err.Error()
+			logDebugf("DKIM signature from %s: %s: %s", r.domain, r.result, r.reason)
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// verifyDKIM checks the DKIM signatures on a whole message, returning nothing if it isn't signed
+func verifyDKIM(message []byte, now time.Time) []dkimResult {
+	lines := bytes.SplitAfter(message, []byte("\n"))
+	i := 0
+	for ; i < len(lines) && len(bytes.TrimRight(lines[i], "\r\n")) > 0; i++ {
+	}
+	v := newDKIMVerifier(bytes.Join(lines[:i], nil))
+	if i < len(lines) {
+		for _, line := range lines[i+1:] {
+			v.writeBody(line)
+		}
+	}
+	return v.results(now)
+}
+
+// domainWithin returns true if domain is parent or a subdomain of it
+func domainWithin(domain, parent string) bool {
+	domain, parent = strings.ToLower(domain), strings.ToLower(parent)
+	return domain == parent || strings.HasSuffix(domain, "."+parent)
+}
+
+// headerFromDomain returns the domain of the message's From address
+func headerFromDomain(headers mail.Header) string {
+	from := headers.Get("From")
+	if addr, err := mail.ParseAddress(from); err == nil {
+		from = addr.Address
+	}
+	return strings.ToLower(strings.Trim(from[strings.LastIndex(from, "@")+1:], "> \t"))
+}
+
+// dkimPolicy returns an error if the From domain is in reject_domains and no signature from it passed
+// Signatures from a parent of the From domain count, so mail.paypal.com can be
+// signed by paypal.com.
+func dkimPolicy(fromDomain string, results []dkimResult) error {
+	for _, listed := range cfg.DKIM.RejectDomains {
+		if fromDomain == "" || !domainWithin(fromDomain, listed) {
+			continue
+		}
+		temp := false
+		for _, r := range results {
+			if !domainWithin(fromDomain, r.domain) {
+				continue
+			}
+			if r.result == "pass" {
+				return nil
+			}
+			temp = temp || r.result == "temperror"
+		}
+		if temp {
+			return smtpd.SMTPError("451 4.7.5 Error: DKIM key for " + fromDomain + " could not be retrieved")
+		}
+		return smtpd.SMTPError("550 5.7.20 Error: no valid DKIM signature from " + fromDomain)
+	}
+	return nil
+}
+
+// quoteValue returns s as a quoted-string for a header, RFC 5322 section 3.2.4
+// Quotes and backslashes are escaped, and control characters like CR and LF,
+// which could end the header, are dropped.
+func quoteValue(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+		case c < ' ' || c == 0x7f:
+			continue
+		}
+		b.WriteRune(c)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// authResultsHeader returns the Authentication-Results header for the DKIM and SPF results
+func (e *env) authResultsHeader(results []dkimResult) []byte {
+	hostname := e.conn.hostname
+	if hostname == "" {
+		hostname = localHostname()
+	}
+	var methods []string
+	for _, r := range results {
+		m := "dkim=" + r.result
+		if r.reason != "" {
+			m += " reason=" + quoteValue(r.reason)
+		}
+		if r.domain != "" {
+			m += fmt.Sprintf(" header.d=%s header.s=%s header.b=%s", r.domain, r.selector, r.b)
+		}
+		methods = append(methods, m)
+	}
+	if len(results) == 0 {
+		methods = append(methods, "dkim=none")
+	}
+	if e.spf != "" {
+		methods = append(methods, fmt.Sprintf("spf=%s smtp.mailfrom=%s", e.spf, spfSender(e.from, e.conn.helo)))
+	}
+	return foldHeader("Authentication-Results", hostname+";\r\n\t"+strings.Join(methods, ";\r\n\t"))
+}
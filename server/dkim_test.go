@@ -0,0 +1,301 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMessage is signed by the DKIM tests
+const testMessage = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+// signMessage adds a DKIM-Signature header to the message, with the key in the resolver's records
+func signMessage(t *testing.T, message, tags string, key crypto.Signer) string {
+	fields, body := splitMessage([]byte(message))
+	sig, err := parseSignature("DKIM-Signature: " + tags + "; bh=x; b=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	canonical := canonBody(body, sig.relaxedB)
+	if l, err := strconv.Atoi(sig.tags["l"]); err == nil {
+		canonical = canonical[:l]
+	}
+	bh := base64.StdEncoding.EncodeToString(sig.digest(canonical))
+	sig.field = "DKIM-Signature: " + tags + "; bh=" + bh + ";\r\n\tb="
+	hashed := sig.digest(sig.signedHeaders(fields))
+	opts := crypto.SignerOpts(sig.hash)
+	if sig.keyType == "ed25519" {
+		opts = crypto.Hash(0)
+	}
+	signature, err := key.Sign(rand.Reader, hashed, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig.field + base64.StdEncoding.EncodeToString(signature) + "\r\n" + message
+}
+
+// dkimKeys returns an RSA and an ed25519 key, and a resolver with their records
+func dkimKeys(t *testing.T) (*rsa.PrivateKey, ed25519.PrivateKey, fakeResolver) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A 512 bit key is too short to be trusted, it isn't used to sign anything
+	short, err := x509.MarshalPKIXPublicKey(&rsa.PublicKey{N: new(big.Int).SetBit(big.NewInt(1), 511, 1), E: 65537})
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := fakeResolver{
+		txt: map[string][]string{
+			"test._domainkey.football.example.com":  {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)},
+			"short._domainkey.football.example.com": {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(short)},
+			"ed._domainkey.football.example.com":    {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPublic)},
+			"revoked._domainkey.example.com":        {"v=DKIM1; p="},
+		},
+		fail: map[string]bool{"down._domainkey.example.com": true},
+	}
+	return rsaKey, edKey, r
+}
+
+func TestCanonicalization(t *testing.T) {
+	// The examples from RFC 6376 section 3.4.5
+	fields, body := splitMessage([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	if len(fields) != 2 {
+		t.Fatalf("Wrong header fields: %q", fields)
+	}
+	if got := canonHeader(fields[0], true) + canonHeader(fields[1], true); got != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("Relaxed header = %q", got)
+	}
+	if got := canonHeader(fields[1], false); got != "B : Y\t\r\n\tZ  \r\n" {
+		t.Errorf("Simple header = %q", got)
+	}
+	if got := canonBody(body, true); got != " C\r\nD E\r\n" {
+		t.Errorf("Relaxed body = %q", got)
+	}
+	if got := canonBody(body, false); got != " C \r\nD \t E\r\n" {
+		t.Errorf("Simple body = %q", got)
+	}
+	if got := canonBody("", false); got != "\r\n" {
+		t.Errorf("Simple empty body = %q", got)
+	}
+	if got := canonBody("", true); got != "" {
+		t.Errorf("Relaxed empty body = %q", got)
+	}
+
+	// Bare LF line endings are treated as CRLF
+	fields, body = splitMessage([]byte("A: X\n\nbody\n"))
+	if len(fields) != 1 || fields[0] != "A: X\r\n" || body != "body\r\n" {
+		t.Errorf("splitMessage with LF = %q %q", fields, body)
+	}
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	rsaKey, edKey, r := dkimKeys(t)
+	defer func(r dnsResolver) { resolver = r }(resolver)
+	resolver = r
+	now := time.Now()
+
+	tests := []struct {
+		tags   string
+		key    crypto.Signer
+		result string
+	}{
+		{"v=1; a=rsa-sha256; c=relaxed/relaxed; d=football.example.com; s=test; h=from:to:subject", rsaKey, "pass"},
+		{"v=1; a=rsa-sha256; d=football.example.com; s=test; h=from:to:subject:date", rsaKey, "pass"},
+		{"v=1; a=rsa-sha256; c=relaxed; d=football.example.com; s=test; h=From", rsaKey, "pass"},
+		{"v=1; a=ed25519-sha256; c=relaxed/relaxed; d=football.example.com; s=ed; h=from:to", edKey, "pass"},
+		{"v=1; a=rsa-sha256; d=football.example.com; s=ed; h=from", rsaKey, "permerror"},
+		{"v=1; a=rsa-sha256; d=football.example.com; s=missing; h=from", rsaKey, "permerror"},
+		{"v=1; a=rsa-sha256; d=example.com; s=revoked; h=from", rsaKey, "permerror"},
+		{"v=1; a=rsa-sha256; d=football.example.com; s=short; h=from", rsaKey, "permerror"},
+		{"v=1; a=rsa-sha256; d=example.com; s=down; h=from", rsaKey, "temperror"},
+		{"v=1; a=rsa-sha256; d=football.example.com; s=test; h=from; x=1000", rsaKey, "fail"},
+		{"v=1; a=rsa-sha256; d=football.example.com; s=test; h=from; l=10", rsaKey, "pass"},
+	}
+	for _, tt := range tests {
+		results := verifyDKIM([]byte(signMessage(t, testMessage, tt.tags, tt.key)), now)
+		if len(results) != 1 || results[0].result != tt.result {
+			t.Errorf("verifyDKIM(%s) = %v, expected %s", tt.tags, results, tt.result)
+		}
+	}
+
+	// Changing the body or a signed header breaks the signature
+	tags := "v=1; a=rsa-sha256; c=relaxed/relaxed; d=football.example.com; s=test; h=from:subject"
+	signed := signMessage(t, testMessage, tags, rsaKey)
+	for _, changed := range []string{
+		strings.Replace(signed, "hungry", "thirsty", 1),
+		strings.Replace(signed, "dinner", "lunch", 1),
+	} {
+		if results := verifyDKIM([]byte(changed), now); len(results) != 1 || results[0].result != "fail" {
+			t.Errorf("Changed message = %v, expected fail", results)
+		}
+	}
+	// Relaxed canonicalization allows whitespace changes, and unsigned headers can be added
+	changed := "X-Added: yes\r\n" + strings.Replace(signed, "Subject: Is", "Subject:   Is", 1)
+	if results := verifyDKIM([]byte(changed), now); len(results) != 1 || results[0].result != "pass" {
+		t.Errorf("Relaxed message = %v, expected pass", results)
+	}
+
+	// Signatures that don't sign From, or are missing tags, are permerror
+	for _, field := range []string{
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=test; h=subject; bh=x; b=x\r\n",
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; h=from; bh=x; b=x\r\n",
+		"DKIM-Signature: v=2; a=rsa-sha256; d=example.com; s=test; h=from; bh=x; b=x\r\n",
+		"DKIM-Signature: v=1; a=dsa-sha256; d=example.com; s=test; h=from; bh=x; b=x\r\n",
+		"DKIM-Signature: v=1; a=rsa-sha1; d=football.example.com; s=test; h=from; bh=x; b=x\r\n",
+	} {
+		if results := verifyDKIM([]byte(field+testMessage), now); len(results) != 1 || results[0].result != "permerror" {
+			t.Errorf("verifyDKIM(%q) = %v, expected permerror", field, results)
+		}
+	}
+
+	if results := verifyDKIM([]byte(testMessage), now); len(results) != 0 {
+		t.Errorf("Unsigned message = %v", results)
+	}
+}
+
+func TestDKIMPolicy(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	cfg.DKIM.RejectDomains = []string{"example.com"}
+
+	pass := []dkimResult{{result: "pass", domain: "example.com"}}
+	tests := []struct {
+		from    string
+		results []dkimResult
+		code    string
+	}{
+		{"example.com", pass, ""},
+		{"mail.example.com", pass, ""},
+		{"other.com", nil, ""},
+		{"", nil, ""},
+		{"example.com", nil, "550"},
+		{"example.com", []dkimResult{{result: "pass", domain: "attacker.com"}}, "550"},
+		{"example.com", []dkimResult{{result: "fail", domain: "example.com"}}, "550"},
+		{"example.com", []dkimResult{{result: "pass", domain: "mail.example.com"}}, "550"},
+		{"example.com", []dkimResult{{result: "temperror", domain: "example.com"}}, "451"},
+	}
+	for _, tt := range tests {
+		err := dkimPolicy(tt.from, tt.results)
+		if tt.code == "" && err != nil {
+			t.Errorf("dkimPolicy(%s, %v) = %s, expected nil", tt.from, tt.results, err)
+		}
+		if tt.code != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.code)) {
+			t.Errorf("dkimPolicy(%s, %v) = %v, expected %s", tt.from, tt.results, err, tt.code)
+		}
+	}
+
+	headers := mail.Header{"From": {"Joe <Joe@Football.Example.com>"}}
+	if domain := headerFromDomain(headers); domain != "football.example.com" {
+		t.Errorf("headerFromDomain = %q", domain)
+	}
+}
+
+func TestAuthResultsHeader(t *testing.T) {
+	e := &env{from: "joe@football.example.com", conn: connInfo{helo: "mail.example.com", hostname: "mx.domain.com"}, spf: spfPass}
+	results := []dkimResult{
+		{result: "pass", domain: "football.example.com", selector: "test", b: "abcdefgh"},
+		{result: "fail", domain: "example.com", selector: "s1", b: "12345678", reason: "body hash did not verify"},
+	}
+	expected := "Authentication-Results: mx.domain.com;\r\n" +
+		"\tdkim=pass header.d=football.example.com header.s=test header.b=abcdefgh;\r\n" +
+		"\tdkim=fail reason=\"body hash did not verify\" header.d=example.com header.s=s1\r\n" +
+		" header.b=12345678;\r\n" +
+		"\tspf=pass smtp.mailfrom=joe@football.example.com\r\n"
+	if got := string(e.authResultsHeader(results)); got != expected {
+		t.Errorf("authResultsHeader = %q, expected %q", got, expected)
+	}
+
+	// Quotes in the reason are escaped, and line breaks can't end the header
+	results = []dkimResult{{result: "permerror", reason: "unknown key version \"x\"\r\nX-Spam: no"}}
+	if got := string(e.authResultsHeader(results)); !strings.Contains(got, `dkim=permerror reason="unknown key version \"x\"X-Spam: no";`) {
+		t.Errorf("Escaped authResultsHeader = %q", got)
+	}
+
+	e.spf = ""
+	if got := string(e.authResultsHeader(nil)); got != "Authentication-Results: mx.domain.com;\r\n\tdkim=none\r\n" {
+		t.Errorf("Unsigned authResultsHeader = %q", got)
+	}
+}
+
+func TestDKIMMail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rsaKey, _, r := dkimKeys(t)
+	maildirs := cmdline.Maildirs
+	defer func(r dnsResolver) {
+		resolver = r
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}(resolver)
+	resolver = r
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	cfg.DKIM.RejectDomains = []string{"football.example.com"}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+
+	err = smtp.SendMail(ln.Addr().String(), nil, "joe@football.example.com", []string{"bcl@domain.com"}, []byte(testMessage))
+	if err == nil || !strings.HasPrefix(err.Error(), "550") || !strings.Contains(err.Error(), "5.7.20") {
+		t.Errorf("Unsigned mail not rejected: %v", err)
+	}
+
+	signed := signMessage(t, testMessage, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=football.example.com; s=test; h=from:to:subject", rsaKey)
+	if err := smtp.SendMail(ln.Addr().String(), nil, "joe@football.example.com", []string{"bcl@domain.com"}, []byte(signed)); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new"))
+	if len(files) != 1 {
+		t.Fatal("Message not delivered")
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "bcl", "new", files[0].Name()))
+	if !strings.Contains(string(data), "Authentication-Results: mx.domain.com;\r\n\tdkim=pass header.d=football.example.com header.s=test") {
+		t.Errorf("Authentication-Results header missing: %q", data)
+	}
+	if !strings.HasSuffix(string(data), signed) || strings.Index(string(data), "Authentication-Results") > strings.Index(string(data), "DKIM-Signature") {
+		t.Errorf("Authentication-Results not above the original headers: %q", data)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"strconv"
+)
+
+// dkimBodyHash canonicalizes and hashes a message body one line at a time, as it arrives
+// It gives the same hash as canonBody, without keeping the body or a
+// canonical copy of it in memory.
+type dkimBodyHash struct {
+	relaxed  bool
+	limit    int64 // bytes to hash from the l= tag, -1 for the whole body
+	h        hash.Hash
+	length   int64 // bytes of canonical body so far, including any past the limit
+	blank    int   // empty lines held back, they are only part of the body if more text follows
+	finished bool
+}
+
+// newDKIMBodyHash returns the SHA-256 body hash for the signature's canonicalization and body length
+func newDKIMBodyHash(sig *dkimSignature) *dkimBodyHash {
+	b := &dkimBodyHash{relaxed: sig.relaxedB, limit: -1, h: sha256.New()}
+	// A bad l= tag is reported by verify, the whole body is hashed meanwhile
+	if l, err := strconv.ParseInt(sig.tags["l"], 10, 64); err == nil && l >= 0 {
+		b.limit = l
+	}
+	return b
+}
+
+// write adds one line of the body, with or without its line ending
+func (b *dkimBodyHash) write(line []byte) {
+	line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+	if b.relaxed {
+		line = bytes.TrimRight(dkimWSP.ReplaceAll(line, []byte(" ")), " ")
+	}
+	if len(line) == 0 {
+		b.blank++
+		return
+	}
+	for ; b.blank > 0; b.blank-- {
+		b.hash([]byte("\r\n"))
+	}
+	b.hash(line)
+	b.hash([]byte("\r\n"))
+}
+
+// hash adds canonical body data to the hash, up to the limit
+func (b *dkimBodyHash) hash(data []byte) {
+	if b.limit >= 0 && b.length+int64(len(data)) > b.limit {
+		if b.length < b.limit {
+			b.h.Write(data[:b.limit-b.length])
+		}
+	} else {
+		b.h.Write(data)
+	}
+	b.length += int64(len(data))
+}
+
+// sum returns the hash of the canonical body, once all of it has been written
+// An empty body is a single CRLF with simple canonicalization.
+func (b *dkimBodyHash) sum() []byte {
+	if !b.finished && b.length == 0 && !b.relaxed {
+		b.hash([]byte("\r\n"))
+	}
+	b.finished = true
+	return b.h.Sum(nil)
+}
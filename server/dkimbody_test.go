@@ -0,0 +1,35 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDKIMBodyHash(t *testing.T) {
+	bodies := []string{
+		"",
+		"\r\n\r\n",
+		" C \r\nD \t E\r\n\r\n\r\n",
+		"Hi.\r\n\r\nWe lost the game.\r\n\r\nJoe.\r\n",
+		"no line ending",
+	}
+	for _, tags := range []string{"a=rsa-sha256; c=simple/simple", "a=rsa-sha256; c=relaxed/relaxed", "a=ed25519-sha256; c=simple/relaxed", "a=rsa-sha256; c=relaxed/simple; l=5"} {
+		sig, err := parseSignature("DKIM-Signature: v=1; d=example.com; s=s; h=from; bh=x; b=x; " + tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, body := range bodies {
+			canonical := canonBody(body, sig.relaxedB)
+			if len(canonical) > 5 && sig.tags["l"] != "" {
+				canonical = canonical[:5]
+			}
+			b := newDKIMBodyHash(sig)
+			for _, line := range strings.SplitAfter(body, "\r\n") {
+				b.write([]byte(line))
+			}
+			if got, expected := b.sum(), sig.digest(canonical); string(got) != string(expected) {
+				t.Errorf("%s: hash of %q didn't match canonBody", tags, body)
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bcl/letterbox/events"
+	"github.com/bcl/letterbox/smtpd"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultDNSBLTimeout and defaultDNSBLCacheTTL are used when timeout and cache_ttl aren't set
+const (
+	defaultDNSBLTimeout  = 2 * time.Second
+	defaultDNSBLCacheTTL = 15 * time.Minute
+)
+
+// dnsblResult is the cached result of looking up a client IP
+type dnsblResult struct {
+	zone    string // the zone that lists the IP, "" if it isn't listed
+	reason  string // the zone's TXT record for the IP
+	expires time.Time
+}
+
+// dnsblCache holds the recent results, keyed by client IP
+var dnsblCache = struct {
+	sync.Mutex
+	results map[string]dnsblResult
+}{results: make(map[string]dnsblResult)}
+
+// dnsblName returns the name to look up for the IP in the zone
+// IPv4 addresses have their octets reversed, IPv6 addresses their nibbles.
+func dnsblName(ip net.IP, zone string) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", ip4[3], ip4[2], ip4[1], ip4[0], zone)
+	}
+	ip6 := ip.To16()
+	var parts []string
+	for i := len(ip6) - 1; i >= 0; i-- {
+		parts = append(parts, fmt.Sprintf("%x.%x", ip6[i]&0xf, ip6[i]>>4))
+	}
+	return strings.Join(parts, ".") + "." + zone
+}
+
+// dnsblLookup returns the reason the zone lists the IP, and true if it is listed
+// Only answers in 127.0.0.0/8 count. 127.255.255.0/24 is used by some lists to
+// say the query was refused, which is logged and not counted.
+func dnsblLookup(r dnsResolver, ip net.IP, zone string) (string, bool) {
+	name := dnsblName(ip, zone)
+	ips, err := r.LookupIP(name)
+	if err != nil {
+		log.Printf("Error looking up %s in %s: %s", ip, zone, err)
+		return "", false
+	}
+	listed := false
+	for _, a := range ips {
+		a4 := a.To4()
+		if a4 == nil || a4[0] != 127 {
+			continue
+		}
+		if a4[1] == 255 && a4[2] == 255 {
+			log.Printf("%s refused the lookup for %s: %s", zone, ip, a4)
+			continue
+		}
+		listed = true
+	}
+	if !listed {
+		return "", false
+	}
+	reason := "listed"
+	if txts, err := r.LookupTXT(name); err == nil && len(txts) > 0 {
+		reason = txts[0]
+	}
+	return reason, true
+}
+
+// dnsblCheck looks up the IP in all of the zones at once, waiting up to the timeout
+// The first zone in the config that lists it is returned. Lookups that are
+// still running after the timeout keep the resolver they started with.
+func dnsblCheck(ip net.IP) dnsblResult {
+	zones := cfg.DNSBL.Zones
+	r := resolver
+	type answer struct {
+		reason string
+		listed bool
+	}
+	answers := make([]chan answer, len(zones))
+	for i, zone := range zones {
+		answers[i] = make(chan answer, 1)
+		go func(ch chan answer, zone string) {
+			reason, listed := dnsblLookup(r, ip, zone)
+			ch <- answer{reason, listed}
+		}(answers[i], zone)
+	}
+
+	timeout := cfg.DNSBL.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultDNSBLTimeout
+	}
+	deadline := time.After(timeout)
+	for i, ch := range answers {
+		select {
+		case a := <-ch:
+			if a.listed {
+				return dnsblResult{zone: zones[i], reason: a.reason}
+			}
+		case <-deadline:
+			log.Printf("Timed out looking up %s in %s", ip, zones[i])
+			return dnsblResult{}
+		}
+	}
+	return dnsblResult{}
+}
+
+// dnsblListed returns the zone that lists the client IP and its reason, "" if none of them do
+// Results are cached for cache_ttl, so a client that connects several times is only looked up once.
+func dnsblListed(ip net.IP, now time.Time) (string, string) {
+	if len(cfg.DNSBL.Zones) == 0 || ip == nil {
+		return "", ""
+	}
+	key := ip.String()
+	dnsblCache.Lock()
+	r, ok := dnsblCache.results[key]
+	dnsblCache.Unlock()
+	if ok && now.Before(r.expires) {
+		return r.zone, r.reason
+	}
+
+	r = dnsblCheck(ip)
+	ttl := cfg.DNSBL.CacheTTL.Duration
+	if ttl == 0 {
+		ttl = defaultDNSBLCacheTTL
+	}
+	r.expires = now.Add(ttl)
+	dnsblCache.Lock()
+	for k, old := range dnsblCache.results {
+		if !now.Before(old.expires) {
+			delete(dnsblCache.results, k)
+		}
+	}
+	dnsblCache.results[key] = r
+	dnsblCache.Unlock()
+	return r.zone, r.reason
+}
+
+// dnsblAction returns what to do with clients on a blocklist, "" if there are no blocklists
+func dnsblAction() string {
+	if len(cfg.DNSBL.Zones) == 0 {
+		return ""
+	}
+	if cfg.DNSBL.Action == "" {
+		return "reject"
+	}
+	return strings.ToLower(cfg.DNSBL.Action)
+}
+
+// checkDNSBL checks the dnsbl action
+func checkDNSBL() error {
+	switch dnsblAction() {
+	case "", "reject", "tag":
+		return nil
+	}
+	return fmt.Errorf("unknown dnsbl action: %s", cfg.DNSBL.Action)
+}
+
+// dnsblBlocked returns an error if the client is on one of the blocklists
+// Clients in hosts or exempt_hosts aren't looked up. With the tag action the
+// client is let in, and its mail is tagged by tagClient.
+func dnsblBlocked(clientIP net.IP, conn connInfo) error {
+	if dnsblAction() != "reject" || hostAllowed(clientIP) || hostExempt(clientIP) {
+		return nil
+	}
+	zone, reason := dnsblListed(clientIP, time.Now())
+	if zone == "" {
+		return nil
+	}
+	reputation.penalize(clientIP, rejectPenalty)
+	reject(clientIP, conn, "", "", events.ReasonDNSBL, "Listed by "+zone+": "+reason)
+	return smtpd.SMTPError(fmt.Sprintf("554 5.7.1 Service unavailable; client [%s] blocked using %s; %s", clientIP, zone, reason))
+}
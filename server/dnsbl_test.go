@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bufio"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowResolver waits before answering, like a DNS server that is down
+type slowResolver struct {
+	fakeResolver
+	delay time.Duration
+}
+
+func (r slowResolver) LookupIP(name string) ([]net.IP, error) {
+	time.Sleep(r.delay)
+	return r.fakeResolver.LookupIP(name)
+}
+
+// resetDNSBL restores the config, resolver, and cache after a test
+func resetDNSBL(saved dnsResolver) {
+	cfg = config.Config{}
+	resolver = saved
+	allowedList = access.List{}
+	dnsblCache.Lock()
+	dnsblCache.results = make(map[string]dnsblResult)
+	dnsblCache.Unlock()
+}
+
+func TestDNSBLName(t *testing.T) {
+	tests := []struct {
+		ip   string
+		name string
+	}{
+		{"192.0.2.99", "99.2.0.192.bl.example.com"},
+		{"::ffff:192.0.2.99", "99.2.0.192.bl.example.com"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.bl.example.com"},
+	}
+	for _, tt := range tests {
+		if name := dnsblName(net.ParseIP(tt.ip), "bl.example.com"); name != tt.name {
+			t.Errorf("dnsblName(%s) = %s, expected %s", tt.ip, name, tt.name)
+		}
+	}
+}
+
+func TestDNSBLListed(t *testing.T) {
+	defer resetDNSBL(resolver)
+	resolver = fakeResolver{
+		ip: map[string][]string{
+			"2.2.0.192.one.example.com": {"127.0.0.2"},
+			"3.2.0.192.one.example.com": {"127.255.255.254"},
+			"4.2.0.192.two.example.com": {"127.0.0.4"},
+		},
+		txt: map[string][]string{
+			"2.2.0.192.one.example.com": {"Listed, see https://one.example.com/2"},
+		},
+		fail: map[string]bool{"5.2.0.192.one.example.com": true},
+	}
+	cfg.DNSBL.Zones = []string{"one.example.com", "two.example.com"}
+	now := time.Now()
+
+	tests := []struct {
+		ip     string
+		zone   string
+		reason string
+	}{
+		{"192.0.2.1", "", ""},
+		{"192.0.2.2", "one.example.com", "Listed, see https://one.example.com/2"},
+		{"192.0.2.3", "", ""}, // refused query
+		{"192.0.2.4", "two.example.com", "listed"},
+		{"192.0.2.5", "", ""}, // lookup error
+	}
+	for _, tt := range tests {
+		zone, reason := dnsblListed(net.ParseIP(tt.ip), now)
+		if zone != tt.zone || reason != tt.reason {
+			t.Errorf("dnsblListed(%s) = %q, %q, expected %q, %q", tt.ip, zone, reason, tt.zone, tt.reason)
+		}
+	}
+
+	// Results are cached until cache_ttl
+	resolver = fakeResolver{}
+	if zone, _ := dnsblListed(net.ParseIP("192.0.2.2"), now.Add(time.Minute)); zone != "one.example.com" {
+		t.Error("Cached listing not used")
+	}
+	if zone, _ := dnsblListed(net.ParseIP("192.0.2.2"), now.Add(defaultDNSBLCacheTTL)); zone != "" {
+		t.Error("Expired listing used")
+	}
+}
+
+func TestDNSBLTimeout(t *testing.T) {
+	defer resetDNSBL(resolver)
+	resolver = slowResolver{
+		fakeResolver: fakeResolver{ip: map[string][]string{"2.2.0.192.one.example.com": {"127.0.0.2"}}},
+		delay:        time.Second,
+	}
+	cfg.DNSBL.Zones = []string{"one.example.com"}
+	cfg.DNSBL.Timeout = config.Duration{Duration: 10 * time.Millisecond}
+
+	start := time.Now()
+	if zone, _ := dnsblListed(net.ParseIP("192.0.2.2"), start); zone != "" {
+		t.Errorf("Listed by %s after timing out", zone)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Lookup took %s", elapsed)
+	}
+}
+
+func TestDNSBLReject(t *testing.T) {
+	defer resetDNSBL(resolver)
+	resolver = fakeResolver{
+		ip:  map[string][]string{"2.0.0.127.bl.example.com": {"127.0.0.2"}},
+		txt: map[string][]string{"2.0.0.127.bl.example.com": {"Test listing"}},
+	}
+	cfg.DNSBL.Zones = []string{"bl.example.com"}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}
+	conn, err := dialer.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	banner, _ := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if !strings.HasPrefix(banner, "554 5.7.1") || !strings.Contains(banner, "bl.example.com; Test listing") {
+		t.Errorf("Listed client got %q", banner)
+	}
+}
+
+func TestDNSBLTag(t *testing.T) {
+	defer resetDNSBL(resolver)
+	resolver = fakeResolver{
+		ip: map[string][]string{"1.1.168.192.bl.example.com": {"127.0.0.2"}},
+	}
+	cfg.DNSBL.Zones = []string{"bl.example.com"}
+	cfg.DNSBL.Action = "tag"
+	if err := checkDNSBL(); err != nil {
+		t.Fatal(err)
+	}
+
+	clientIP := net.ParseIP("192.168.1.1")
+	if err := dnsblBlocked(clientIP, connInfo{id: "c0ffee"}); err != nil {
+		t.Errorf("Listed client blocked with the tag action: %s", err)
+	}
+	e := &env{clientIP: clientIP, conn: newConnInfo(testConn{authUser: "bcl"})}
+	e.tagClient(testConn{authUser: "bcl"})
+	if !reflect.DeepEqual(e.tags, []string{"authenticated", "dnsbl-hit"}) {
+		t.Errorf("Wrong tags: %v", e.tags)
+	}
+
+	cfg.DNSBL.Action = "drop"
+	if err := checkDNSBL(); err == nil {
+		t.Error("Unknown action accepted")
+	}
+}
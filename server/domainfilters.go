@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// globalSieveScript reads and parses a script from the filters global_dir
+func globalSieveScript(name string) ([]sieveCommand, error) {
+	if cfg.Filters.GlobalDir == "" {
+		return nil, fmt.Errorf("no filters global_dir for %s", name)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(cfg.Filters.GlobalDir, name+".sieve"))
+	if err != nil {
+		return nil, err
+	}
+	commands, err := parseSieve(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return commands, nil
+}
+
+// domainScript returns the name of the default filter for the user's domain, or ""
+func domainScript(user string) string {
+	domain := userDomain(user)
+	for d, script := range cfg.Filters.Domains {
+		if strings.EqualFold(d, domain) {
+			return script
+		}
+	}
+	return ""
+}
+
+// domainFolders returns the folders that new maildirs in the user's domain start with
+func domainFolders(user string) []string {
+	domain := userDomain(user)
+	for d, folders := range cfg.Filters.Folders {
+		if strings.EqualFold(d, domain) {
+			return folders
+		}
+	}
+	return nil
+}
+
+// createDomainFolders creates the folders for the user's domain in their new maildir
+// Errors are logged, since the folders are created again when mail is filed into them.
+func createDomainFolders(user string) {
+	for _, name := range domainFolders(user) {
+		folder, err := sieveFolder(name)
+		if err != nil || folder == "" {
+			continue
+		}
+		if _, err := maildirFolder(user, folder); err != nil {
+			log.Printf("Error creating %s folder for %s: %s", folder, user, err)
+		}
+	}
+}
+
+// checkFilters checks the [filters] config
+/*
+   Example TOML:
+
+   [filters]
+   global_dir = "/etc/letterbox/sieve"
+
+   [filters.domains]
+   "domain.com" = "domain"
+
+   [filters.folders]
+   "domain.com" = ["System", "Lists/Cron"]
+
+   Users in domain.com without their own filter have their mail sorted by
+   /etc/letterbox/sieve/domain.sieve. Users with a filter can use it with
+   include :global "domain", before or after their own rules. New maildirs in
+   domain.com start with the System and Lists/Cron folders. A user's domain
+   is the domain of their address in the emails list.
+*/
+func checkFilters() error {
+	for domain, script := range cfg.Filters.Domains {
+		if !sieveScriptRE.MatchString(script) {
+			return fmt.Errorf("bad filter name for %s: %s", domain, script)
+		}
+		if _, err := globalSieveScript(script); err != nil {
+			return fmt.Errorf("filter for %s: %s", domain, err)
+		}
+	}
+	for domain, folders := range cfg.Filters.Folders {
+		for _, name := range folders {
+			if folder, err := sieveFolder(name); err != nil || folder == "" {
+				return fmt.Errorf("bad folder for %s: %q", domain, name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { cfg = config.Config{} }()
+	if err := ioutil.WriteFile(filepath.Join(dir, "domain.sieve"), []byte("keep;"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.sieve"), []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []config.Filters{
+		{Domains: map[string]string{"domain.com": "domain"}},
+		{GlobalDir: dir, Domains: map[string]string{"domain.com": "missing"}},
+		{GlobalDir: dir, Domains: map[string]string{"domain.com": "broken"}},
+		{GlobalDir: dir, Domains: map[string]string{"domain.com": "../domain"}},
+		{Folders: map[string][]string{"domain.com": {"../Junk"}}},
+	} {
+		cfg.Filters = c
+		if err := checkFilters(); err == nil {
+			t.Errorf("Bad filters config accepted: %#v", c)
+		}
+	}
+	cfg.Filters = config.Filters{
+		GlobalDir: dir,
+		Domains:   map[string]string{"domain.com": "domain"},
+		Folders:   map[string][]string{"domain.com": {"System", "Lists/Cron"}},
+	}
+	if err := checkFilters(); err != nil {
+		t.Errorf("Good filters config refused: %s", err)
+	}
+}
+
+func TestDomainFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com", "alice@domain.com", "bob@other.org"}
+	parseHosts()
+	global := filepath.Join(dir, "sieve")
+	if err := os.Mkdir(global, 0700); err != nil {
+		t.Fatal(err)
+	}
+	script := `require "fileinto"; if header :contains "subject" "Cron" { fileinto "System"; }`
+	if err := ioutil.WriteFile(filepath.Join(global, "domain.sieve"), []byte(script), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Filters = config.Filters{
+		GlobalDir: global,
+		Domains:   map[string]string{"Domain.com": "domain"},
+		Folders:   map[string][]string{"domain.com": {"System", "Lists/Cron"}},
+	}
+
+	// alice has her own filter, which replaces the domain's
+	if err := os.MkdirAll(filepath.Join(cmdline.Maildirs, "alice"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cmdline.Maildirs, "alice", sieveFile), []byte("keep;"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	msg := []byte("Subject: Cron <root@host> backup\r\n\r\nDone\r\n")
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com", "alice@domain.com", "bob@other.org"}, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(path string) int {
+		files, _ := ioutil.ReadDir(filepath.Join(cmdline.Maildirs, path))
+		return len(files)
+	}
+	expected := map[string]int{
+		"bcl/new":         0,
+		"bcl/.System/new": 1,
+		"alice/new":       1,
+		"bob/new":         1,
+	}
+	for path, n := range expected {
+		if got := count(path); got != n {
+			t.Errorf("%d messages in %s, expected %d", got, path, n)
+		}
+	}
+
+	// New maildirs in domain.com start with its folders
+	for _, folder := range []string{"bcl/.System", "bcl/.Lists.Cron/cur"} {
+		if _, err := os.Stat(filepath.Join(cmdline.Maildirs, folder)); err != nil {
+			t.Errorf("%s not created: %s", folder, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cmdline.Maildirs, "bob", ".System")); err == nil {
+		t.Errorf("domain.com folders created for other.org")
+	}
+}
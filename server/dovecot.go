@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/luksen/maildir"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultDoveadmTimeout is used when the dovecot timeout isn't set
+const defaultDoveadmTimeout = 10 * time.Second
+
+// doveadmPath returns the doveadm command to run
+func doveadmPath() string {
+	if cfg.Dovecot.Doveadm == "" {
+		return "doveadm"
+	}
+	return cfg.Dovecot.Doveadm
+}
+
+// checkDovecot checks that doveadm can be found when notify is set
+func checkDovecot() error {
+	if !cfg.Dovecot.Notify {
+		return nil
+	}
+	if _, err := exec.LookPath(doveadmPath()); err != nil {
+		return fmt.Errorf("dovecot notify: %s", err)
+	}
+	return nil
+}
+
+// dovecotMailbox returns dovecot's name for the maildir folder, INBOX for the user's inbox
+func dovecotMailbox(dir maildir.Dir) string {
+	name := filepath.Base(string(dir))
+	if !strings.HasPrefix(name, ".") || name == "." {
+		return "INBOX"
+	}
+	if mailbox, err := decodeMailboxName(name[1:]); err == nil {
+		return mailbox
+	}
+	return name[1:]
+}
+
+// notifyDovecot asks dovecot to index the maildirs the message was delivered to
+// doveadm runs in the background so the client isn't kept waiting for it,
+// and a failure is only logged since the message has been delivered.
+func notifyDovecot(conn connInfo, user string, dirs []maildir.Dir) {
+	if !cfg.Dovecot.Notify || len(dirs) == 0 {
+		return
+	}
+	login := user
+	if l, ok := cfg.Dovecot.Users[user]; ok {
+		login = l
+	}
+	timeout := cfg.Dovecot.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultDoveadmTimeout
+	}
+	doveadm := doveadmPath()
+	for _, dir := range dirs {
+		go func(mailbox string) {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			out, err := exec.CommandContext(ctx, doveadm, "index", "-u", login, "-q", mailbox).CombinedOutput()
+			if err != nil {
+				conn.logf("Error notifying dovecot of mail for %s in %s: %s: %s", login, mailbox, err, bytes.TrimSpace(out))
+			}
+		}(dovecotMailbox(dir))
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/config"
+	"github.com/luksen/maildir"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDovecotMailbox(t *testing.T) {
+	for dir, expected := range map[string]string{
+		"/var/spool/maildirs/bcl":               "INBOX",
+		"/var/spool/maildirs/bcl/.Junk":         "Junk",
+		"/var/spool/maildirs/bcl/.Lists.go/":    "Lists.go",
+		"/var/spool/maildirs/bcl/.Entw&APw-rfe": "Entwürfe",
+	} {
+		if got := dovecotMailbox(maildir.Dir(dir)); got != expected {
+			t.Errorf("dovecotMailbox(%s) = %s, expected %s", dir, got, expected)
+		}
+	}
+}
+
+func TestNotifyDovecot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { cfg = config.Config{} }()
+
+	// The fake doveadm records its arguments, one file per run
+	doveadm := filepath.Join(dir, "doveadm")
+	script := "#!/bin/sh\necho \"$@\" > " + dir + "/tmp.$$ && mv " + dir + "/tmp.$$ " + dir + "/run.$$\n"
+	if err := ioutil.WriteFile(doveadm, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Dovecot = config.Dovecot{Notify: true, Doveadm: filepath.Join(dir, "missing")}
+	if err := checkDovecot(); err == nil {
+		t.Error("Missing doveadm accepted")
+	}
+	cfg.Dovecot = config.Dovecot{Notify: true, Doveadm: doveadm, Users: map[string]string{"bcl": "bcl@domain.com"}}
+	if err := checkDovecot(); err != nil {
+		t.Fatal(err)
+	}
+
+	notifyDovecot(connInfo{}, "bcl", []maildir.Dir{"/maildirs/bcl", "/maildirs/bcl/.Lists"})
+	var runs []string
+	for deadline := time.Now().Add(5 * time.Second); len(runs) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		runs, _ = filepath.Glob(filepath.Join(dir, "run.*"))
+	}
+	var args []string
+	for _, run := range runs {
+		data, _ := ioutil.ReadFile(run)
+		args = append(args, strings.TrimSpace(string(data)))
+	}
+	sort.Strings(args)
+	if len(args) != 2 || args[0] != "index -u bcl@domain.com -q INBOX" || args[1] != "index -u bcl@domain.com -q Lists" {
+		t.Errorf("Wrong doveadm runs: %q", args)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bounceRcpt is a recipient that a bounce reports as failed
+type bounceRcpt struct {
+	rcpt       string
+	status     string // RFC 3463 status code, like 5.1.1
+	diagnostic string // reply from the smarthost, "" if there wasn't one
+}
+
+// expiredStatus is the status of recipients that were still queued after max_age
+const expiredStatus = "5.4.7"
+
+// bouncesEnabled returns true if failed queued deliveries are reported to the sender
+func bouncesEnabled() bool {
+	return cfg.Queue.Bounces
+}
+
+// bounceFrom returns the address bounces are sent from
+func bounceFrom() string {
+	if cfg.Queue.BounceFrom == "" {
+		return "MAILER-DAEMON@" + localHostname()
+	}
+	return cfg.Queue.BounceFrom
+}
+
+// replyStatus returns the enhanced status code from a 5xx reply, or 5.0.0 if it doesn't have one
+func replyStatus(reply string) string {
+	if i := strings.Index(reply, " "); i != -1 && enhancedCodeRE.MatchString(reply[i+1:]) {
+		return strings.Fields(reply[i+1:])[0]
+	}
+	return "5.0.0"
+}
+
+// bounceMessage returns an RFC 3464 delivery status notification for the failed recipients
+// It has a text part for people, a message/delivery-status part for
+// programs, and the original message's header.
+func bounceMessage(id, from string, arrival time.Time, rcpts []bounceRcpt, original []byte, now time.Time) []byte {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	var text bytes.Buffer
+	fmt.Fprintf(&text, "This is the mail system at %s.\r\n\r\n", localHostname())
+	fmt.Fprintf(&text, "Your message could not be delivered to these recipients:\r\n\r\n")
+	for _, r := range rcpts {
+		reason := r.diagnostic
+		if reason == "" {
+			reason = "gave up after retrying until the message expired"
+		}
+		fmt.Fprintf(&text, "<%s>: %s\r\n", r.rcpt, reason)
+	}
+	part, _ := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	part.Write(text.Bytes())
+
+	var status bytes.Buffer
+	status.Write(foldHeader("Reporting-MTA", "dns; "+localHostname()))
+	status.Write(foldHeader("X-Letterbox-Queue-ID", id))
+	status.Write(foldHeader("Arrival-Date", arrival.Format(time.RFC1123Z)))
+	for _, r := range rcpts {
+		status.WriteString("\r\n")
+		status.Write(foldHeader("Final-Recipient", "rfc822; "+r.rcpt))
+		status.Write(foldHeader("Action", "failed"))
+		status.Write(foldHeader("Status", r.status))
+		if r.diagnostic != "" {
+			status.Write(foldHeader("Diagnostic-Code", "smtp; "+r.diagnostic))
+		}
+	}
+	part, _ = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	part.Write(status.Bytes())
+
+	fields, _ := splitMessage(original)
+	part, _ = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/rfc822-headers"}})
+	part.Write([]byte(strings.Join(fields, "")))
+	w.Close()
+
+	var msg bytes.Buffer
+	msg.Write(foldHeader("From", "Mail Delivery System <"+bounceFrom()+">"))
+	msg.Write(foldHeader("To", "<"+from+">"))
+	msg.Write(foldHeader("Subject", "Undelivered Mail Returned to Sender"))
+	msg.Write(foldHeader("Date", now.Format(time.RFC1123Z)))
+	msg.Write(foldHeader("Message-Id", fmt.Sprintf("<%s.%s@%s>", now.Format("20060102150405"), newLogID(), localHostname())))
+	msg.Write(foldHeader("Auto-Submitted", "auto-replied"))
+	msg.Write(foldHeader("MIME-Version", "1.0"))
+	msg.Write(foldHeader("Content-Type", fmt.Sprintf("multipart/report; report-type=delivery-status; boundary=%q", w.Boundary())))
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes()
+}
+
+// bounce queues a delivery status notification to the sender of the entry
+// The bounce is relayed to the sender from the null sender, through the
+// queue so that it is retried like any other relayed message. Messages from
+// the null sender, like other bounces, are never bounced.
+func bounce(entry *queueEntry, rcpts []bounceRcpt, data []byte, now time.Time) error {
+	if !bouncesEnabled() || len(rcpts) == 0 {
+		return nil
+	}
+	conn := connInfo{queueID: entry.ID}
+	if entry.From == "" {
+		logDebugf("Not bouncing %s, it has no sender", entry.ID)
+		return nil
+	}
+	id := newLogID()
+	msg := bounceMessage(entry.ID, entry.From, entry.Created, rcpts, data, now)
+	if err := enqueue(id, "", []queuedDelivery{{Rcpt: entry.From, Relay: true}}, msg, 0, now); err != nil {
+		return err
+	}
+	logEvent(conn, "bounced", "to", "<"+entry.From+">", "rcpts", strconv.Itoa(len(rcpts)), "bounce_id", id)
+	return nil
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/smtpd"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplyStatus(t *testing.T) {
+	tests := map[string]string{
+		"550 5.1.1 No such user":    "5.1.1",
+		"554 5.7.1":                 "5.7.1",
+		"550 No such user":          "5.0.0",
+		"550 5.1.1.1 Too many dots": "5.0.0",
+	}
+	for reply, status := range tests {
+		if got := replyStatus(reply); got != status {
+			t.Errorf("replyStatus(%q) = %q, expected %q", reply, got, status)
+		}
+	}
+}
+
+func TestBounceMessage(t *testing.T) {
+	arrival := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	rcpts := []bounceRcpt{
+		{rcpt: "bad@remote.com", status: "5.1.1", diagnostic: "550 5.1.1 No such user"},
+		{rcpt: "bcl@domain.com", status: expiredStatus},
+	}
+	original := []byte("Received: from client\r\nSubject: hello\r\n\r\nSecret body\r\n")
+	data := bounceMessage("abc123", "sender@domain.com", arrival, rcpts, original, arrival.Add(time.Hour))
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("To") != "<sender@domain.com>" || msg.Header.Get("Auto-Submitted") != "auto-replied" || !strings.HasPrefix(msg.Header.Get("From"), "Mail Delivery System <MAILER-DAEMON@") {
+		t.Errorf("Wrong headers: %v", msg.Header)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("Wrong Content-Type: %s", msg.Header.Get("Content-Type"))
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	var types, parts []string
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(p)
+		types = append(types, p.Header.Get("Content-Type"))
+		parts = append(parts, string(body))
+	}
+	if strings.Join(types, ",") != "text/plain; charset=utf-8,message/delivery-status,text/rfc822-headers" {
+		t.Fatalf("Wrong parts: %v", types)
+	}
+	if !strings.Contains(parts[0], "<bad@remote.com>: 550 5.1.1 No such user\r\n") || !strings.Contains(parts[0], "<bcl@domain.com>: gave up") {
+		t.Errorf("Wrong text part: %q", parts[0])
+	}
+	for _, field := range []string{
+		"Arrival-Date: Tue, 02 Jan 2024 15:04:05 +0000\r\n",
+		"\r\nFinal-Recipient: rfc822; bad@remote.com\r\nAction: failed\r\nStatus: 5.1.1\r\nDiagnostic-Code: smtp; 550 5.1.1 No such user\r\n",
+		"\r\nFinal-Recipient: rfc822; bcl@domain.com\r\nAction: failed\r\nStatus: 5.4.7\r\n",
+	} {
+		if !strings.Contains(parts[1], field) {
+			t.Errorf("%q missing from the delivery status %q", field, parts[1])
+		}
+	}
+	if parts[2] != "Received: from client\r\nSubject: hello\r\n" {
+		t.Errorf("Wrong original headers: %q", parts[2])
+	}
+}
+
+func TestBounces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		relayCaps = &relayCounter{}
+	}()
+	// Maildirs can't be created under a file, so local deliveries fail
+	cmdline.Maildirs = filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(cmdline.Maildirs, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	smarthost, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer smarthost.Close()
+	received := make(chan *smarthostEnvelope, 10)
+	var froms []string
+	sh := &smtpd.Server{
+		Hostname: "smarthost",
+		OnNewMail: func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+			froms = append(froms, from.Email())
+			return &smarthostEnvelope{helo: c.Hello(), done: received}, nil
+		},
+	}
+	go sh.Serve(smarthost)
+	_, port, _ := net.SplitHostPort(smarthost.Addr().String())
+	cfg.Relay.Host = "127.0.0.1"
+	cfg.Relay.Port, _ = strconv.Atoi(port)
+	cfg.Queue = config.Queue{Dir: filepath.Join(dir, "queue"), Bounces: true}
+	if err := setupQueue(); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries returns the envelopes waiting in the queue
+	entries := func() []queueEntry {
+		paths, _ := filepath.Glob(filepath.Join(cfg.Queue.Dir, "*.json"))
+		var list []queueEntry
+		for _, path := range paths {
+			data, _ := ioutil.ReadFile(path)
+			var entry queueEntry
+			json.Unmarshal(data, &entry)
+			list = append(list, entry)
+		}
+		return list
+	}
+
+	// A recipient the smarthost refuses is bounced right away
+	now := time.Now()
+	msg := []byte("Subject: hello\r\n\r\nHi\r\n")
+	if err := enqueue("relayed", "sender@domain.com", []queuedDelivery{{Rcpt: "bad@remote.com", Relay: true}}, msg, 0, now); err != nil {
+		t.Fatal(err)
+	}
+	// Bounces aren't bounced
+	if err := enqueue("bounce", "", []queuedDelivery{{Rcpt: "bad@remote.com", Relay: true}}, msg, 0, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := processQueue(now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	queued := entries()
+	if len(queued) != 1 || queued[0].From != "" || len(queued[0].Deliveries) != 1 || queued[0].Deliveries[0].Rcpt != "sender@domain.com" || !queued[0].Deliveries[0].Relay {
+		t.Fatalf("Bounce not queued: %#v", queued)
+	}
+	if err := processQueue(now.Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case env := <-received:
+		if len(env.rcpts) != 1 || env.rcpts[0] != "sender@domain.com" || froms[len(froms)-1] != "" ||
+			!strings.Contains(env.data.String(), "Status: 5.1.1\r\nDiagnostic-Code: smtp; 550 5.1.1 No such user\r\n") {
+			t.Errorf("Wrong bounce relayed: %v %v %q", froms, env.rcpts, env.data.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Bounce not relayed")
+	}
+	if queued := entries(); len(queued) != 0 {
+		t.Errorf("Queue not empty: %#v", queued)
+	}
+
+	// A local delivery that expires is bounced when it is given up on
+	if err := enqueue("local", "sender@domain.com", []queuedDelivery{{User: "bcl", Rcpt: "bcl@domain.com"}}, msg, 0, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := processQueue(now.Add(30 * 24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Queue.Dir, queueFailedDir, "local.json")); err != nil {
+		t.Errorf("Expired message not moved to failed: %s", err)
+	}
+	queued = entries()
+	if len(queued) != 1 || queued[0].From != "" || queued[0].Deliveries[0].Rcpt != "sender@domain.com" {
+		t.Fatalf("Bounce for expired message not queued: %#v", queued)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(cfg.Queue.Dir, queued[0].ID+".eml"))
+	if !strings.Contains(string(data), "Final-Recipient: rfc822; bcl@domain.com\r\nAction: failed\r\nStatus: 5.4.7\r\n") {
+		t.Errorf("Wrong bounce for expired message: %q", data)
+	}
+
+	// Bounces are sent through the relay from the queue
+	cfg.Relay.Host = ""
+	if err := setupQueue(); err == nil {
+		t.Error("Bounces without a relay host accepted")
+	}
+}
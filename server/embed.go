@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/delivery"
+	"net"
+	"sync"
+)
+
+// errServerRunning is returned when a second Server is started in the same program
+var errServerRunning = errors.New("letterbox is already running in this program")
+
+// embedded is the Server that is running, letterbox's settings are package variables so there can only be one
+var embedded struct {
+	sync.Mutex
+	server *Server
+}
+
+// Server is letterbox run from another Go program instead of the letterbox command
+/*
+   Config holds the same settings as letterbox.toml, and DeliveryBackend is
+   given each recipient's copy of the messages before they are delivered to
+   the maildirs:
+
+       s := server.Server{
+           Config:   config.Config{Hosts: []string{"127.0.0.1"}, Emails: []string{"bcl@example.com"}},
+           Maildirs: "/var/spool/maildirs",
+       }
+       go s.ListenAndServe("127.0.0.1:2525")
+       ...
+       s.Stop()
+
+   letterbox keeps its settings in package variables, so only one Server can
+   run in a program at a time, and it logs with the log package's standard
+   logger. Once it has stopped the same or another Server can be started. The
+   signal handling, privileges, metrics and upgrades of the letterbox command
+   are left to the program.
+*/
+type Server struct {
+	Config          config.Config    // settings, the groups in Emails are expanded by Serve
+	Maildirs        string           // top level of the user maildirs
+	DeliveryBackend delivery.Backend // stores each recipient's copy before it is delivered, nil to only use the maildirs
+
+	cancel context.CancelFunc // stops the queue, reputation and hosts file loops
+	loops  sync.WaitGroup     // the loops that are still running
+	done   chan struct{}      // closed once Serve has cleaned up
+}
+
+// ListenAndServe listens on the TCP address, like 127.0.0.1:2525, and serves it
+func (s *Server) ListenAndServe(address string) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts SMTP connections on the listener and delivers their mail, until the listener is closed or Stop is called
+// The [[listeners]] and extra listen addresses in the Config are served too.
+func (s *Server) Serve(ln net.Listener) error {
+	embedded.Lock()
+	if embedded.server != nil {
+		embedded.Unlock()
+		return errServerRunning
+	}
+	embedded.server = s
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel, s.done = cancel, make(chan struct{})
+	embedded.Unlock()
+	defer s.cleanup()
+
+	c := s.Config
+	emails, err := expandGroups(c.Groups, c.Emails)
+	if err != nil {
+		return err
+	}
+	c.Emails = emails
+	cfg = c
+	cmdline.Maildirs = s.Maildirs
+	deliveryBackend = s.DeliveryBackend
+	serverTLS, err := setup()
+	if err != nil {
+		return err
+	}
+	listeners, err := openListeners()
+	if err != nil {
+		return err
+	}
+	s.run(ctx, watchHostsFiles)
+	if queueEnabled() {
+		s.run(ctx, runQueue)
+	}
+	s.run(ctx, runReputation)
+	srv := newServer(serverHostname(), serverTLS)
+	addListener(ln)
+	countCommands(srv, ln.Addr().String())
+	serveListeners(listeners, serverTLS)
+	err = srv.Serve(listenProxy(ln))
+	if shuttingDown() {
+		return nil
+	}
+	return err
+}
+
+// run starts the loop, which runs until the context is done
+func (s *Server) run(ctx context.Context, loop func(context.Context)) {
+	s.loops.Add(1)
+	go func() {
+		defer s.loops.Done()
+		loop(ctx)
+	}()
+}
+
+// cleanup stops the loops and closes the listeners once Serve returns, so that a Server can be started again
+func (s *Server) cleanup() {
+	s.cancel()
+	s.loops.Wait()
+	embedded.Lock()
+	defer embedded.Unlock()
+	resetDrain()
+	embedded.server = nil
+	close(s.done)
+}
+
+// Stop stops accepting mail, waits up to drain_timeout for the messages being received, and returns once Serve has returned
+func (s *Server) Stop() {
+	embedded.Lock()
+	if embedded.server != s {
+		embedded.Unlock()
+		return
+	}
+	// Serve can't clean up and let another Server start until the shutdown is done
+	shutdown(drainTimeout())
+	done := s.done
+	embedded.Unlock()
+	<-done
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"errors"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/delivery"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBackend records the messages it stores, and refuses the ones for alice
+type testBackend struct {
+	sync.Mutex
+	stored []delivery.Message
+}
+
+func (b *testBackend) Store(msg delivery.Message) error {
+	if msg.User == "alice" {
+		return errors.New("alice is full")
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.stored = append(b.stored, msg)
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+		deliveryBackend = nil
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	backend := &testBackend{}
+	s := Server{
+		Config: config.Config{
+			Hosts:  []string{"127.0.0.1"},
+			Emails: []string{"group:friends", "bcl@domain.com"},
+			Groups: map[string][]string{"friends": {"alice@domain.com"}},
+		},
+		Maildirs:        dir,
+		DeliveryBackend: backend,
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+	defer s.Stop()
+
+	message := []byte("Subject: embedded\r\n\r\nHello\r\n")
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com"}, message); err != nil {
+		t.Fatalf("Message not accepted: %s", err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new")); len(files) != 1 {
+		t.Errorf("bcl has %d messages", len(files))
+	}
+	backend.Lock()
+	if len(backend.stored) != 1 {
+		t.Fatalf("Backend stored %d messages", len(backend.stored))
+	}
+	msg := backend.stored[0]
+	backend.Unlock()
+	if msg.User != "bcl" || msg.Rcpt != "bcl@domain.com" || msg.From != "sender@domain.com" || msg.QueueID == "" {
+		t.Errorf("Backend got %+v", msg)
+	}
+	if !strings.HasSuffix(string(msg.Data), "\r\nSubject: embedded\r\n\r\nHello\r\n") {
+		t.Errorf("Backend got %q", msg.Data)
+	}
+
+	// The backend refusing a recipient stops its delivery, the group was expanded to find alice
+	err = smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"alice@domain.com"}, message)
+	if err == nil || !strings.HasPrefix(err.Error(), "451") {
+		t.Errorf("Refused message not passed on: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "alice", "new")); len(files) != 0 {
+		t.Error("Delivered to alice after the backend failed")
+	}
+
+	if err := (&Server{}).Serve(ln); err != errServerRunning {
+		t.Errorf("Second Server started: %v", err)
+	}
+
+	// Once it has stopped it can be started again
+	s.Stop()
+	if err := <-served; err != nil {
+		t.Errorf("Serve returned %s", err)
+	}
+	if _, err := smtp.Dial(ln.Addr().String()); err == nil {
+		t.Error("Listener still open after Stop")
+	}
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { served <- s.Serve(ln) }()
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com"}, message); err != nil {
+		t.Fatalf("Message not accepted after restarting: %s", err)
+	}
+	s.Stop()
+	if err := <-served; err != nil {
+		t.Errorf("Serve returned %s", err)
+	}
+}
+
+func TestServerLoops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+
+	// The queue, reputation and hosts file loops stop with the Server
+	before := runtime.NumGoroutine()
+	for i := 0; i < 3; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := Server{
+			Config: config.Config{
+				Hosts:     []string{"127.0.0.1"},
+				Emails:    []string{"bcl@domain.com"},
+				HostsFile: filepath.Join(dir, "hosts"),
+				Queue:     config.Queue{Dir: filepath.Join(dir, "queue")},
+			},
+			Maildirs: dir,
+		}
+		served := make(chan error, 1)
+		go func() { served <- s.Serve(ln) }()
+		c, err := smtp.Dial(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Quit()
+		s.Stop()
+		if err := <-served; err != nil {
+			t.Fatalf("Serve returned %s", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines before, %d after", before, after)
+	}
+}
@@ -0,0 +1,881 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github.com/bcl/letterbox/delivery"
+	"github.com/bcl/letterbox/events"
+	"github.com/bcl/letterbox/smtpd"
+	"github.com/luksen/maildir"
+	"net"
+	"net/mail"
+	"path"
+	"strings"
+	"time"
+)
+
+// smtpd.Envelope interface, with some extra data for letterbox delivery
+type env struct {
+	rcpts        []smtpd.MailAddress
+	destDirs     []*maildir.Dir
+	deliveries   []*delivery.Delivery
+	destRcpts    []string                // recipient of each delivery
+	destUsers    []string                // user whose maildir each delivery is in
+	destFolders  []string                // folder of the user's maildir each delivery is in
+	untraced     []bool                  // true for deliveries that get the message without letterbox's headers
+	rcptErrors   map[string]error        // delivery errors for each recipient, set by Close
+	outcomes     map[string]*rcptOutcome // what was done with each recipient's copies, set by Close
+	results      []deliveryResult        // result for each recipient, set once Close is done
+	from         string                  // envelope sender from MAIL FROM
+	clientIP     net.IP                  // IP of the connected client
+	emails       []string                // whitelist from the config when the envelope started
+	conn         connInfo                // HELO, TLS, and AUTH details of the connection
+	header       []byte                  // raw message header, collected until the end of the headers
+	headers      mail.Header             // parsed message header, set at the end of the headers
+	inBody       bool                    // true once the blank line after the headers has been written
+	dkim         *dkimVerifier           // DKIM signatures in the header, their bodies hashed as they are written
+	originIP     net.IP                  // IP of the first untrusted host in the Received chain, nil if it is unknown
+	relayRcpts   []string                // recipients that are relayed to the smarthost instead of delivered
+	forwards     []forwardRcpt           // addresses the local recipients' mail is forwarded to through the smarthost
+	pipes        []pipeRcpt              // local recipients whose mail is piped to a command instead of delivered
+	held         []queuedDelivery        // deliveries to held users, queued at the end of DATA
+	data         bytes.Buffer            // copy of the message for the smarthost and the retry queue
+	received     []byte                  // Received header added to each copy of the message
+	client       smtpd.Connection        // connection the message arrives on, closed to abandon it at shutdown
+	spf          spfResult               // result of the SPF check, "" if it wasn't checked
+	domainCheck  domainResult            // result of the sender domain check, "" if it wasn't checked
+	dateCheck    dateResult              // result of the Date header check, "" if it wasn't checked
+	refusedErr   error                   // set by BeginData over LMTP if a recipient's mailbox is full or its delivery is held
+	lmtp         bool                    // the client speaks LMTP, and gets a reply for each recipient
+	junk         bool                    // the spam filter's score reached junk_score, set by Close
+	declared     int64                   // size from the SIZE parameter of MAIL FROM, 0 if there wasn't one
+	smtputf8     bool                    // MAIL FROM had the SMTPUTF8 parameter
+	tags         []string                // policy tags attached by the checks
+	tagsWritten  int                     // number of tags already written as headers
+	inSpoofedTag bool                    // the header line being written is part of an X-Letterbox-Tag from the client
+	size         int64                   // bytes of the message written so far
+	sizeLimits   map[string]int64        // recipient_max_sizes limit of each recipient that has one
+	tooBig       map[string]bool         // recipients the message is too big for, set by Close
+}
+
+// relayed returns true if the recipient is being relayed to the smarthost
+func (e *env) relayed(rcpt string) bool {
+	for _, r := range e.relayRcpts {
+		if r == rcpt {
+			return true
+		}
+	}
+	return false
+}
+
+// AddRecipient is called when RCPT TO is received
+// It checks the email against the whitelist and rejects it if it is not an exact match,
+// unless it can be relayed to the smarthost.
+func (e *env) AddRecipient(rcpt smtpd.MailAddress) error {
+	tarpit(e.clientIP)
+
+	if !identityRcptAllowed(e.conn.identity, rcpt.Email()) {
+		logDebugf("Client certificate %s may not send to %s", e.conn.identity, rcpt.Email())
+		reject(e.clientIP, e.conn, e.from, rcpt.Email(), events.ReasonCertNotAllowed, "Recipient not allowed for client certificate")
+		return smtpd.SMTPError("550 5.7.1 Recipient not allowed for this client certificate")
+	}
+
+	// Match the recipient against the email whitelist
+	user, folder, local := whitelisted(e.emails, rcpt.Email())
+	relay := !local && relayAllowed(rcpt.Email())
+	catchall := !local && !relay && cfg.CatchallMaildir != ""
+	if catchall {
+		user, local = rcpt.Email(), true
+	}
+	if local && badMailbox(e.emails, user) {
+		logDebugf("Recipient %s has a bad mailbox name", rcpt.Email())
+		reject(e.clientIP, e.conn, e.from, rcpt.Email(), events.ReasonBadMailbox, errBadMailbox.Error())
+		return errBadMailbox
+	}
+	if local || relay {
+		// With a queue the message is accepted, and held until the schedule is active
+		if name, ok := cfg.RecipientSchedules[user]; local && ok && !queueEnabled() && !scheduleActive(name, time.Now()) {
+			logDebugf("Recipient %s is outside of schedule %s", user, name)
+			reject(e.clientIP, e.conn, e.from, rcpt.Email(), events.ReasonSchedule, "Mailbox not accepting mail at this time")
+			return smtpd.SMTPError("450 4.2.1 Mailbox not accepting mail at this time")
+		}
+		if err := e.checkRcptSize(rcpt.Email(), user, local); err != nil {
+			return err
+		}
+		// Only the held or full recipient is refused, the others in the message are still delivered
+		if local {
+			if held := rcptHeld(e.emails, user); held != "" {
+				e.conn.logf("Delivery to %s is held, refusing mail to %s", held, rcpt.Email())
+				reject(e.clientIP, e.conn, e.from, rcpt.Email(), events.ReasonHeld, errHeld.Error())
+				return errHeld
+			}
+			if full := rcptFull(e.emails, user); full != "" {
+				e.conn.logf("Mailbox for %s is full, refusing mail to %s", full, rcpt.Email())
+				reject(e.clientIP, e.conn, e.from, rcpt.Email(), events.ReasonMailboxFull, errMailboxFull.Error())
+				return errMailboxFull
+			}
+		}
+		if local && folder != "" && folderMode() == "reject" {
+			for _, name := range recipientUsers(e.emails, user) {
+				if !folderExists(path.Base(path.Clean(name)), folder) {
+					logDebugf("Recipient %s has no folder %s", name, folder)
+					reject(e.clientIP, e.conn, e.from, rcpt.Email(), events.ReasonNoSuchFolder, "No such folder")
+					return smtpd.SMTPError("550 5.1.1 Error: no such folder")
+				}
+			}
+		}
+		if err := luaRcpt(e, rcpt.Email()); err != nil {
+			reject(e.clientIP, e.conn, e.from, rcpt.Email(), events.ReasonLua, err.Error())
+			return err
+		}
+		if _, err := e.runWasmFilters("rcpt", rcpt.Email(), nil); err != nil {
+			reject(e.clientIP, e.conn, e.from, rcpt.Email(), events.ReasonWasm, err.Error())
+			return err
+		}
+		if err := pluginRcpt(e.clientIP, e.conn, e.from, rcpt.Email()); err != nil {
+			reject(e.clientIP, e.conn, e.from, rcpt.Email(), events.ReasonPlugin, err.Error())
+			return smtpd.SMTPError("550 5.7.1 " + err.Error())
+		}
+		if local && e.greylisted(rcpt.Email(), time.Now()) {
+			logDebugf("Greylisting %s from %s for %s", e.clientIP, e.from, rcpt.Email())
+			reject(e.clientIP, e.conn, e.from, rcpt.Email(), events.ReasonGreylist, "Greylisted")
+			return smtpd.SMTPError("450 4.7.1 Error: greylisted, please try again later")
+		}
+		e.rcpts = append(e.rcpts, rcpt)
+		if relay {
+			e.relayRcpts = append(e.relayRcpts, rcpt.Email())
+			logEvent(e.conn, "rcpt", "rcpt", "<"+rcpt.Email()+">", "relay", "true")
+			return nil
+		}
+		if catchall {
+			logEvent(e.conn, "rcpt", "rcpt", "<"+rcpt.Email()+">", "catchall", cfg.CatchallMaildir)
+			return nil
+		}
+		logEvent(e.conn, "rcpt", "rcpt", "<"+rcpt.Email()+">", "user", user)
+		return nil
+	}
+	reputation.penalize(e.clientIP, rejectPenalty)
+	reject(e.clientIP, e.conn, e.from, rcpt.Email(), events.ReasonRcptNotAllowed, "Recipient not in whitelist")
+	return errors.New("Recipient not in whitelist")
+}
+
+// BeginData is called when DATA is received
+// It sanitizes the revipient email and creates any missing maildirs
+func (e *env) BeginData() error {
+	if len(e.rcpts) == 0 {
+		return smtpd.SMTPError("554 5.5.1 Error: no valid recipients")
+	}
+	if shuttingDown() {
+		reject(e.clientIP, e.conn, e.from, "", events.ReasonShuttingDown, "Shutting down")
+		return smtpd.SMTPError("421 4.3.2 Error: shutting down")
+	}
+
+	e.received = append(e.receivedSPFHeader(), e.senderDomainHeader()...)
+	e.received = append(e.received, e.receivedHeader(e.lmtp, time.Now())...)
+	e.rcptErrors = make(map[string]error)
+
+	// Only deliver one copy to each user, even if several recipients alias to them
+	delivered := make(map[string]bool)
+	for _, rcpt := range e.rcpts {
+		if !strings.Contains(rcpt.Email(), "@") {
+			logDebugf("Skipping recipient: %s", rcpt)
+			continue
+		}
+		if e.relayed(rcpt.Email()) {
+			continue
+		}
+
+		// user+folder@domain is delivered to the user's folder
+		address, folder := rcpt.Email(), ""
+		if listed, f, ok := whitelisted(e.emails, address); ok {
+			address, folder = listed, f
+		}
+		// Without a queue the recipient was only accepted inside its schedule
+		schedule := cfg.RecipientSchedules[address]
+		if schedule != "" && (!queueEnabled() || scheduleActive(schedule, time.Now())) {
+			schedule = ""
+		}
+
+		// Reroute mail based on the catch-all maildirs and the aliases file
+		users := recipientUsers(e.emails, address)
+		if remote := aliasForwards(recipientName(e.emails, address)); len(remote) > 0 {
+			e.addForwards(rcpt.Email(), remote, len(users) > 0)
+		}
+		for _, user := range users {
+			// Eliminate anything that looks like a path
+			user = path.Base(path.Clean(user))
+			if delivered[user+"/"+folder] {
+				continue
+			}
+			delivered[user+"/"+folder] = true
+			if targets, keep := forwardTargets(user); len(targets) > 0 {
+				e.addForwards(rcpt.Email(), targets, keep)
+				if !keep {
+					continue
+				}
+			}
+			if p, ok := userPipe(user); ok {
+				e.pipes = append(e.pipes, pipeRcpt{rcpt: rcpt.Email(), user: user, pipe: p})
+				continue
+			}
+			if schedule != "" {
+				e.held = append(e.held, queuedDelivery{User: user, Folder: folder, Rcpt: rcpt.Email(), Untraced: untraced(rcpt.Email(), user), Schedule: schedule})
+				continue
+			}
+			if userHeld(user) {
+				if holdPolicy() == "queue" {
+					e.held = append(e.held, queuedDelivery{User: user, Folder: folder, Rcpt: rcpt.Email(), Untraced: untraced(rcpt.Email(), user)})
+					continue
+				}
+				// Held since RCPT, an SMTP client can only be refused the whole message
+				e.conn.logf("Delivery to %s is held, refusing mail to %s", user, rcpt.Email())
+				reject(e.clientIP, e.conn, e.from, rcpt.Email(), events.ReasonHeld, errHeld.Error())
+				if !e.lmtp {
+					e.Abort()
+					return errHeld
+				}
+				e.rcptErrors[rcpt.Email()] = errHeld
+				e.refusedErr = errHeld
+				continue
+			}
+
+			if mailboxFull(user, 1) {
+				e.conn.logf("Mailbox for %s is full, refusing mail to %s", user, rcpt.Email())
+				reject(e.clientIP, e.conn, e.from, rcpt.Email(), events.ReasonMailboxFull, errMailboxFull.Error())
+				if !e.lmtp {
+					e.Abort()
+					return errMailboxFull
+				}
+				e.rcptErrors[rcpt.Email()] = errMailboxFull
+				e.refusedErr = errMailboxFull
+				continue
+			}
+
+			// Add a new maildir for each recipient
+			// If the queue is enabled a nil delivery is queued at the end of DATA.
+			var userDir maildir.Dir
+			var del *delivery.Delivery
+			var err error
+			raw := untraced(rcpt.Email(), user)
+			if deliveryFormat(user) == "mbox" {
+				userDir = maildir.Dir(mboxPath(user, folder))
+				if del, err = newMboxDelivery(string(userDir), e.from); err != nil {
+					e.conn.logf("Error creating delivery for %s: %s", user, err)
+					if !queueEnabled() {
+						e.Abort()
+						return smtpd.SMTPError("450 4.2.0 Error: mailbox unavailable")
+					}
+				}
+			} else if userDir, err = userMaildir(user, folder); err != nil {
+				e.conn.logf("Error creating maildir for %s: %s", user, err)
+				if !queueEnabled() {
+					e.Abort()
+					return smtpd.SMTPError("450 4.2.0 Error: maildir unavailable")
+				}
+			} else if del, err = e.newDelivery(userDir, raw, rcpt.Email()); err != nil {
+				e.conn.logf("Error creating delivery for %s: %s", user, err)
+				if !queueEnabled() {
+					e.Abort()
+					return smtpd.SMTPError("450 4.2.0 Error: maildir unavailable")
+				}
+			}
+			if del != nil {
+				del.Owner = mailOwner(user)
+			}
+			if del != nil && !raw {
+				header := deliveryHeader(e.from, rcpt.Email())
+				if _, err = del.Write(append(header, e.received...)); err != nil {
+					e.conn.logf("Error writing to %s: %s", userDir, err)
+					del.Abort()
+					del = nil
+					if !queueEnabled() {
+						e.Abort()
+						return smtpd.SMTPError("450 4.2.0 Error: maildir unavailable")
+					}
+				} else {
+					del.Top = int64(len(header) + len(e.received))
+				}
+			}
+			e.destDirs = append(e.destDirs, &userDir)
+			e.deliveries = append(e.deliveries, del)
+			e.destRcpts = append(e.destRcpts, rcpt.Email())
+			e.destUsers = append(e.destUsers, user)
+			e.destFolders = append(e.destFolders, folder)
+			e.untraced = append(e.untraced, raw)
+		}
+	}
+	if len(e.deliveries) == 0 && len(e.relayRcpts) == 0 && len(e.forwards) == 0 && len(e.pipes) == 0 && len(e.held) == 0 {
+		e.Abort()
+		if e.refusedErr != nil {
+			return e.refusedErr
+		}
+		return smtpd.SMTPError("554 5.5.1 Error: no valid recipients")
+	}
+
+	trackData(e)
+	return nil
+}
+
+// Write is called for each line of the email
+// It supports writing to multiple recipients at the same time.
+func (e *env) Write(line []byte) error {
+	e.size += int64(len(line))
+	// Headers from checking the message's header go at the end of it
+	var checks []byte
+	if !e.inBody {
+		if len(bytes.TrimSpace(line)) == 0 {
+			e.inBody = true
+			e.endHeader()
+			checks = e.dateCheckHeader(time.Now())
+			e.tagHeader()
+			checks = append(checks, e.tagHeaders()...)
+		} else {
+			e.header = append(e.header, line...)
+			if e.spoofedTag(line) {
+				return nil
+			}
+		}
+	} else if e.dkim != nil {
+		e.dkim.writeBody(line)
+	}
+	if len(e.relayRcpts) > 0 || len(e.forwards) > 0 || len(e.pipes) > 0 || len(cfg.Backends) > 0 || deliveryBackend != nil || queueEnabled() || checksBody() {
+		e.data.Write(checks)
+		e.data.Write(line)
+	}
+	// With clamd, the spam filter, or milters the message is written by Close,
+	// after the headers they add
+	if checksBody() {
+		return nil
+	}
+	return e.writeDeliveries(checks, line)
+}
+
+// checksBody returns true if the whole message is checked before it is written to the deliveries
+// DKIM hashes the body as it is written, so it doesn't need the message kept in memory.
+func checksBody() bool {
+	return clamdEnabled() || spamFilterEnabled() || miltersEnabled()
+}
+
+// newDelivery starts delivering the message for the recipient to a user's maildir
+// With single_copy it shares the tmp file of an earlier delivery that gets
+// the same headers instead of writing another, one for the same recipient or
+// another untraced one when raw is true.
+func (e *env) newDelivery(dir maildir.Dir, raw bool, rcpt string) (*delivery.Delivery, error) {
+	if singleCopy() {
+		for i, d := range e.deliveries {
+			if d != nil && d.Mbox == "" && e.untraced[i] == raw && (raw || e.destRcpts[i] == rcpt) {
+				return d.Share(dir)
+			}
+		}
+	}
+	return newDelivery(dir)
+}
+
+// writeDeliveries writes data to every delivery, after the trace headers for the ones that get them
+// If the queue is enabled a delivery that fails is left for the queue,
+// otherwise all of the deliveries are aborted.
+func (e *env) writeDeliveries(trace, data []byte) error {
+	for i, del := range e.deliveries {
+		if del == nil {
+			continue
+		}
+		msg := data
+		if len(trace) > 0 && !e.untraced[i] {
+			msg = append(append([]byte{}, trace...), data...)
+		}
+		_, err := del.Write(msg)
+		if err != nil {
+			e.conn.logf("Error writing to %s: %s", del.Dir, err)
+			// The queue has a copy of the message, so only this delivery has to be retried
+			if queueEnabled() {
+				del.Abort()
+				e.deliveries[i] = nil
+				continue
+			}
+			// Delivery failed, need to remove all the deliveries
+			e.Abort()
+			return err
+		}
+	}
+	return nil
+}
+
+// insertTrace adds the headers from checking the whole message to the deliveries that have already been written
+func (e *env) insertTrace(trace []byte) error {
+	for i, del := range e.deliveries {
+		if del == nil || e.untraced[i] {
+			continue
+		}
+		if err := del.InsertHeader(trace); err != nil {
+			e.conn.logf("Error writing to %s: %s", del.Dir, err)
+			if queueEnabled() {
+				del.Abort()
+				e.deliveries[i] = nil
+				continue
+			}
+			e.Abort()
+			return err
+		}
+	}
+	return nil
+}
+
+// endHeader is called when the blank line separating the header from the body is written
+// It parses the collected header and finds the originating IP from the Received chain
+func (e *env) endHeader() {
+	var received []string
+	hdr, err := mail.ReadMessage(bytes.NewReader(append(e.header, '\r', '\n')))
+	if err != nil {
+		logDebugf("Error parsing message header: %s", err)
+	} else {
+		received = hdr.Header["Received"]
+		e.headers = hdr.Header
+	}
+	e.originIP = originatingIP(e.clientIP, received)
+	if e.originIP == nil {
+		logDebugf("Message originated from an unknown host")
+	} else {
+		logDebugf("Message originated from %s", e.originIP)
+	}
+	if dkimEnabled() {
+		e.dkim = newDKIMVerifier(e.header)
+	}
+}
+
+// Close is called when the connection is closed
+// The server really should call this with error status from outside
+// we have no way to know if this is in response to an error or not.
+func (e *env) Close() error {
+	defer untrackData(e)
+	headers := e.headers
+	if headers == nil {
+		headers = mail.Header{}
+	}
+	if e.rcptErrors == nil {
+		e.rcptErrors = make(map[string]error)
+	}
+	defer e.recordResults()
+	// Headers from checking the whole message go above the original headers,
+	// and on the copies for the smarthost and the queue
+	var trace []byte
+	if err := e.dropOversized(); err != nil {
+		return e.abort(err)
+	}
+	if dkimEnabled() {
+		// A message without a body never ended its header
+		if e.dkim == nil {
+			e.dkim = newDKIMVerifier(e.header)
+		}
+		results := e.dkim.results(time.Now())
+		if err := dkimPolicy(headerFromDomain(headers), results); err != nil {
+			reject(e.clientIP, e.conn, e.from, "", events.ReasonDKIMFail, err.Error())
+			return e.abort(err)
+		}
+		authResults := e.authResultsHeader(results)
+		e.received = append(e.received, authResults...)
+		trace = append(trace, authResults...)
+	}
+	if err := e.dateRejected(); err != nil {
+		reject(e.clientIP, e.conn, e.from, "", events.ReasonDate, err.Error())
+		return e.abort(err)
+	}
+	e.setTagHeaders(headers)
+	if err := luaData(e, headers); err != nil {
+		reject(e.clientIP, e.conn, e.from, "", events.ReasonLua, err.Error())
+		return e.abort(err)
+	}
+	added, err := e.runWasmFilters("data", "", headers)
+	if err != nil {
+		reject(e.clientIP, e.conn, e.from, "", events.ReasonWasm, err.Error())
+		return e.abort(err)
+	}
+	e.received = append(e.received, added...)
+	trace = append(trace, added...)
+	if clamdEnabled() {
+		status, signature, err := e.virusCheck()
+		if err != nil {
+			reject(e.clientIP, e.conn, e.from, "", events.ReasonScanFailed, err.Error())
+			return e.abort(err)
+		}
+		e.received = append(e.received, status...)
+		trace = append(trace, status...)
+		if signature != "" {
+			reputation.penalize(e.clientIP, virusPenalty)
+		}
+		if signature != "" && clamdAction() == "reject" {
+			err := virusError(signature)
+			reject(e.clientIP, e.conn, e.from, "", events.ReasonVirus, err.Error())
+			return e.abort(err)
+		} else if signature != "" {
+			return e.quarantine(cfg.Clamd.Quarantine, "signature", signature)
+		}
+	}
+	if spamFilterEnabled() {
+		status, err := e.spamCheck(time.Now())
+		if err != nil {
+			code := events.ReasonScanFailed
+			if err == errSpam {
+				code = events.ReasonSpamScore
+				reputation.penalize(e.clientIP, spamPenalty)
+			} else if err == errGreylisted {
+				code = events.ReasonGreylist
+			}
+			reject(e.clientIP, e.conn, e.from, "", code, err.Error())
+			return e.abort(err)
+		}
+		e.received = append(e.received, status...)
+		trace = append(trace, status...)
+	}
+	if miltersEnabled() {
+		added, verdict, err := e.milterCheck()
+		if err != nil {
+			reject(e.clientIP, e.conn, e.from, "", events.ReasonScanFailed, err.Error())
+			return e.abort(err)
+		}
+		e.received = append(e.received, added...)
+		trace = append(trace, added...)
+		switch verdict.action {
+		case "reject":
+			reject(e.clientIP, e.conn, e.from, "", events.ReasonMilter, verdict.reply.Error())
+			return e.abort(verdict.reply)
+		case "discard":
+			e.Abort()
+			logEvent(e.conn, "discarded", "milter", verdict.milter)
+			return nil
+		case "quarantine":
+			if verdict.maildir != "" {
+				return e.quarantine(verdict.maildir, "milter", verdict.milter, "reason", verdict.reason)
+			}
+			logEvent(e.conn, "quarantined", "milter", verdict.milter, "reason", verdict.reason, "folder", spamFolder())
+			e.junk = true
+		}
+	}
+	if e.junk {
+		e.addTag("junk")
+		reputation.penalize(e.clientIP, junkPenalty)
+	}
+	tags := e.tagHeaders()
+	e.received = append(e.received, tags...)
+	trace = append(trace, tags...)
+	e.setTagHeaders(headers)
+	if checksBody() {
+		if err := e.writeDeliveries(trace, e.data.Bytes()); err != nil {
+			return e.abort(err)
+		}
+	} else if err := e.insertTrace(trace); err != nil {
+		return e.abort(err)
+	}
+
+	// Mail from the scan.async_hosts is scanned after it has been delivered
+	async := scanEnabled() && scanAfterDelivery(e.clientIP)
+	if scanEnabled() && !async {
+		if err := e.scan(); err != nil {
+			code := events.ReasonScanFailed
+			if err == errSpam {
+				code = events.ReasonSpamScore
+				reputation.penalize(e.clientIP, spamPenalty)
+			}
+			reject(e.clientIP, e.conn, e.from, "", code, err.Error())
+			return e.abort(err)
+		}
+	}
+
+	// Deliver to every recipient, or to none of them if writing one of the
+	// copies fails without a queue to take it, so the client can send the
+	// message again without duplicating it. Maildirs go first, since the
+	// copies already linked into them can be taken back and mbox appends can't.
+	// Recipients whose mailboxes were already full have been refused, and
+	// the ones that fail once others have their copies are settled at the end.
+	firstErr := e.refusedErr
+	if firstErr == nil && len(e.tooBig) > 0 {
+		firstErr = errRcptTooBig
+	}
+	var scanPaths, scanUsers []string
+	var queued []queuedDelivery
+	var landed []landedDelivery
+	var failed error
+	retry := make(map[string][]queuedDelivery)
+	msgID := headers.Get("Message-Id")
+	now := time.Now()
+	skip, refused := e.refuseCopies(msgID, now)
+	if refused != nil && !e.lmtp && !bouncesEnabled() {
+		// Without bounces the sender can only be told by refusing the whole message
+		return e.refuseAll(msgID, refused)
+	}
+	if firstErr == nil {
+		firstErr = refused
+	}
+
+	// Recipients that aren't local, and forwarded copies, are sent on to the
+	// smarthost once the local copies are delivered. Those over the relay caps,
+	// or whose domain is over its limits or backing off, are queued, or without
+	// a queue refused for now, along with the rest of the message for an SMTP
+	// client.
+	relayRcpts := append([]string{}, e.relayRcpts...)
+	for _, f := range e.forwards {
+		relayRcpts = append(relayRcpts, f.to)
+	}
+	deferRelay := func(rcpts []string, err error) {
+		for _, rcpt := range rcpts {
+			if queueEnabled() {
+				queued = append(queued, queuedDelivery{Rcpt: rcpt, Relay: true, Helo: e.conn.hostname})
+				e.journalDelivery(rcpt, "queued", "")
+				continue
+			}
+			if err := e.relayFailed(rcpt, err); firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if n := relayCaps.take(len(relayRcpts), now); n < len(relayRcpts) {
+		e.conn.logf("Relay limit reached, deferring %d recipients", len(relayRcpts)-n)
+		if !queueEnabled() && !e.lmtp {
+			relayCaps.release(n)
+			return e.refuseAll(msgID, errRelayLimit)
+		}
+		deferRelay(relayRcpts[n:], errRelayLimit)
+		relayRcpts = relayRcpts[:n]
+	}
+	relayRcpts, deferred := relayDomains.admit(relayRcpts, now)
+	if len(deferred) > 0 {
+		e.conn.logf("Domain relay limit reached, deferring %d recipients", len(deferred))
+		relayCaps.release(len(deferred))
+		if !queueEnabled() && !e.lmtp {
+			relayCaps.release(len(relayRcpts))
+			relayDomains.release(relayRcpts)
+			return e.refuseAll(msgID, errDomainDeferred)
+		}
+		deferRelay(deferred, errDomainDeferred)
+	}
+	for _, i := range e.deliveryOrder() {
+		del := e.deliveries[i]
+		if failed != nil || skip[i] {
+			if del != nil {
+				del.Abort()
+			}
+			continue
+		}
+		var size int64
+		if del != nil {
+			size = del.Size()
+		}
+		// A required backend that can't store the message refuses the
+		// recipient before it is delivered anywhere.
+		if err := e.storeRequired(i); err != nil {
+			if del != nil {
+				del.Abort()
+			}
+			if e.rcptErrors[e.destRcpts[i]] == nil {
+				e.rcptErrors[e.destRcpts[i]] = err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			retry[e.destRcpts[i]] = append(retry[e.destRcpts[i]], queuedDelivery{User: e.destUsers[i], Folder: e.destFolders[i], Rcpt: e.destRcpts[i], Untraced: e.untraced[i]})
+			continue
+		}
+		var err error
+		discarded := false
+		if del == nil {
+			err = errors.New("maildir unavailable")
+		} else if e.junk && del.Mbox == "" {
+			// Junk goes to the spam folder, or the inbox if it can't be created
+			dirs := []maildir.Dir{del.Dir}
+			if junk, ferr := maildirFolder(e.destUsers[i], spamFolder()); ferr != nil {
+				e.conn.logf("Error creating %s folder for %s: %s", spamFolder(), e.destUsers[i], ferr)
+			} else {
+				dirs[0] = junk
+			}
+			err = del.CloseTo(dirs)
+		} else if e.destFolders[i] == "" && del.Mbox == "" {
+			// The user's filter decides where mail for the inbox goes
+			dirs := filterDirs(e.destUsers[i], del.Dir, &sieveMessage{headers, e.from, e.destRcpts[i]})
+			discarded = len(dirs) == 0
+			err = del.CloseTo(dirs)
+		} else {
+			err = del.Close()
+		}
+		if err != nil && queueEnabled() {
+			e.conn.logf("Error delivering to %s, queueing it: %s", *e.destDirs[i], err)
+			queued = append(queued, queuedDelivery{User: e.destUsers[i], Folder: e.destFolders[i], Rcpt: e.destRcpts[i], Untraced: e.untraced[i]})
+			e.journalDelivery(e.destRcpts[i], "queued", "")
+			plusTags.record(e.destUsers[i], e.destFolders[i], e.from, now)
+			e.storeBestEffort(i)
+			continue
+		}
+		if err != nil && e.mboxLanded(landed) {
+			// The mboxes that already have the message can't be taken back
+			e.conn.logf("Error delivering to %s: %s", *e.destDirs[i], err)
+			e.rcptErrors[e.destRcpts[i]] = errDeliveryFailed
+			if firstErr == nil {
+				firstErr = errDeliveryFailed
+			}
+			continue
+		}
+		if err != nil {
+			e.conn.logf("Error delivering to %s: %s", *e.destDirs[i], err)
+			failed = err
+			continue
+		}
+		landed = append(landed, landedDelivery{i, size, discarded})
+	}
+	if failed != nil {
+		return e.takeBack(landed, msgID, failed)
+	}
+	for _, l := range landed {
+		i, del, size, discarded := l.index, e.deliveries[l.index], l.size, l.discarded
+		plusTags.record(e.destUsers[i], e.destFolders[i], e.from, now)
+		if discarded {
+			logEvent(e.conn, "discarded", "rcpt", "<"+e.destRcpts[i]+">", "user", e.destUsers[i])
+			e.journalDelivery(e.destRcpts[i], "discarded", "")
+			continue
+		}
+		if err := addQuotaUsage(e.destUsers[i], size*int64(del.Copies), int64(del.Copies)); err != nil {
+			e.conn.logf("Error updating quota for %s: %s", e.destUsers[i], err)
+		}
+		logEvent(e.conn, "delivered", "rcpt", "<"+e.destRcpts[i]+">", "path", del.Location())
+		e.journalDelivery(e.destRcpts[i], "delivered", del.Path())
+		pluginDelivered(e.clientIP, e.conn, e.from, e.destRcpts[i], del.Location())
+		notifyDelivered(e.conn, e.destUsers[i], e.destRcpts[i], e.from, del.Path(), headers, size)
+		notifyDovecot(e.conn, e.destUsers[i], del.Linked)
+		e.storeBestEffort(i)
+		if del.Mbox == "" {
+			scanPaths = append(scanPaths, del.Path())
+			scanUsers = append(scanUsers, e.destUsers[i])
+		}
+	}
+	if async {
+		go scanDelivered(e.clientIP, scanPaths, scanUsers)
+	}
+	if err := e.runPipes(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	for _, q := range e.held {
+		if q.Schedule != "" {
+			logEvent(e.conn, "held", "rcpt", "<"+q.Rcpt+">", "user", q.User, "schedule", q.Schedule)
+			e.journalDelivery(q.Rcpt, "held", "")
+			continue
+		}
+		logEvent(e.conn, "held", "rcpt", "<"+q.Rcpt+">", "user", q.User)
+		e.journalDelivery(q.Rcpt, "held", "")
+	}
+	queued = append(queued, e.held...)
+	if len(queued) > 0 {
+		if err := enqueue(e.conn.queueID, e.from, queued, e.traced(), len(e.received), now); err != nil {
+			e.conn.logf("Error queueing message: %s", err)
+			err = smtpd.SMTPError("451 4.3.0 Error: maildir unavailable")
+			for _, q := range queued {
+				e.rcptErrors[q.Rcpt] = err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if len(relayRcpts) > 0 {
+		failed := relayByDomain(e.conn.hostname, e.from, relayRcpts, e.traced())
+		for _, rcpt := range relayRcpts {
+			err := failed[rcpt]
+			if f := e.forwarded(rcpt); err == nil && f != nil {
+				logEvent(e.conn, "forwarded", "rcpt", "<"+f.rcpt+">", "to", "<"+rcpt+">", "host", cfg.Relay.Host)
+				e.journalDelivery(f.rcpt, "forwarded", rcpt)
+				continue
+			}
+			if err == nil {
+				logEvent(e.conn, "relayed", "rcpt", "<"+rcpt+">", "host", cfg.Relay.Host)
+				e.journalDelivery(rcpt, "relayed", "")
+				continue
+			}
+			e.conn.logf("Error relaying to %s: %s", rcpt, err)
+			if err := e.relayFailed(rcpt, err); firstErr == nil {
+				firstErr = err
+			}
+			if f := e.forwarded(rcpt); f != nil {
+				retry[f.rcpt] = append(retry[f.rcpt], queuedDelivery{Rcpt: rcpt, Relay: true, Helo: e.conn.hostname})
+			} else {
+				retry[rcpt] = append(retry[rcpt], queuedDelivery{Rcpt: rcpt, Relay: true, Helo: e.conn.hostname})
+			}
+		}
+	}
+	return e.settle(firstErr, len(landed) > 0, retry, now)
+}
+
+// landedDelivery is a delivery that Close has linked into its maildirs or appended to its mbox
+type landedDelivery struct {
+	index     int   // index of the delivery in env.deliveries
+	size      int64 // size of the message, for the quota
+	discarded bool  // the user's filter discarded the message
+}
+
+// deliveryOrder returns the indexes of the deliveries with the maildirs first and the mboxes last
+func (e *env) deliveryOrder() []int {
+	var maildirs, mboxes []int
+	for i, del := range e.deliveries {
+		if del != nil && del.Mbox != "" {
+			mboxes = append(mboxes, i)
+		} else {
+			maildirs = append(maildirs, i)
+		}
+	}
+	return append(maildirs, mboxes...)
+}
+
+// takeBack removes the copies of the message that were delivered before a delivery failed, and fails every recipient with err
+// Nothing else is done with the message, so the client sending it again
+// doesn't leave duplicates. Copies already appended to an mbox stay.
+func (e *env) takeBack(landed []landedDelivery, msgID string, err error) error {
+	for _, l := range landed {
+		del := e.deliveries[l.index]
+		if uerr := del.Unlink(); uerr != nil {
+			e.conn.logf("Error removing the copy for %s: %s", e.destRcpts[l.index], uerr)
+		}
+	}
+	for _, rcpt := range e.destRcpts {
+		dedup.forget(rcpt, msgID)
+	}
+	for _, rcpt := range e.rcpts {
+		e.rcptErrors[rcpt.Email()] = err
+	}
+	return err
+}
+
+// traced returns the message with the Received header, for the smarthost and the queue
+func (e *env) traced() []byte {
+	return append(append([]byte{}, e.received...), e.data.Bytes()...)
+}
+
+// Abort is called when the message is rejected during DATA
+// It removes the partly written message from each maildir's tmp directory.
+func (e *env) Abort() {
+	defer untrackData(e)
+	for _, del := range e.deliveries {
+		if del != nil {
+			del.Abort()
+		}
+	}
+	e.deliveries = nil
+}
+
+// abort removes the partly delivered message and fails all of the recipients with err
+func (e *env) abort(err error) error {
+	e.Abort()
+	for _, rcpt := range e.rcpts {
+		e.rcptErrors[rcpt.Email()] = err
+	}
+	return err
+}
+
+// RecipientErrors returns the result of delivering to each recipient, for LMTP
+// Recipients that BeginData skipped are rejected.
+func (e *env) RecipientErrors() []error {
+	errs := make([]error, len(e.rcpts))
+	for i, rcpt := range e.rcpts {
+		if !strings.Contains(rcpt.Email(), "@") {
+			errs[i] = smtpd.SMTPError("550 5.1.1 Error: bad recipient address")
+		} else {
+			errs[i] = e.rcptErrors[rcpt.Email()]
+		}
+	}
+	return errs
+}
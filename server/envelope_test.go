@@ -0,0 +1,220 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/smtpd"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSMTPUTF8(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bücher@domain.com"}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	conn, err := textproto.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expect := func(code int) string {
+		t.Helper()
+		_, msg, err := conn.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("Expected %d: %s", code, err)
+		}
+		return msg
+	}
+
+	expect(220)
+	conn.PrintfLine("EHLO localhost")
+	if msg := expect(250); !strings.Contains(msg, "\nSMTPUTF8") || !strings.Contains(msg, "\n8BITMIME") || !strings.Contains(msg, "\nPIPELINING") {
+		t.Errorf("Extensions not advertised: %q", msg)
+	} else if strings.Contains(msg, "DSN") {
+		t.Errorf("DSN advertised: %q", msg)
+	}
+	conn.PrintfLine("MAIL FROM:<jürgen@example.com>")
+	expect(553)
+	conn.PrintfLine("MAIL FROM:<sender@example.com> BODY=BINARYMIME")
+	expect(555)
+	conn.PrintfLine("MAIL FROM:<sender@example.com>\r\nRCPT TO:bcl")
+	expect(250)
+	if msg := expect(501); !strings.HasPrefix(msg, "5.1.3 Bad recipient") {
+		t.Errorf("Wrong reply to a bad recipient: %q", msg)
+	}
+	conn.PrintfLine("RSET")
+	expect(250)
+
+	// Pipelined, the replies come back in order
+	conn.PrintfLine("MAIL FROM:<jürgen@example.com> BODY=8BITMIME SMTPUTF8\r\nRCPT TO:<bücher+entwürfe@domain.com>\r\nDATA")
+	expect(250)
+	expect(250)
+	expect(354)
+	conn.PrintfLine("Subject: Grüße\r\n\r\nÜber\r\n.")
+	expect(250)
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "bücher", ".entw&APw-rfe", "new"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Message not delivered to the folder: %v", err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "bücher", ".entw&APw-rfe", "new", files[0].Name()))
+	for _, s := range []string{"Return-Path: <jürgen@example.com>", "Delivered-To: bücher+entwürfe@domain.com", "with UTF8SMTP;", "Subject: Grüße\r\n\r\nÜber\r\n"} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("Missing %q in message: %q", s, data)
+		}
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := &smtpd.Server{
+		Hostname:        "localhost",
+		OnNewConnection: onNewConnection,
+		OnNewMail:       onNewMail,
+		MaxMessageSize:  100,
+	}
+	go s.Serve(ln)
+
+	conn, err := textproto.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expect := func(code int) string {
+		t.Helper()
+		_, msg, err := conn.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("Expected %d: %s", code, err)
+		}
+		return msg
+	}
+
+	expect(220)
+	conn.PrintfLine("EHLO localhost")
+	if msg := expect(250); !strings.Contains(msg, "SIZE 100") {
+		t.Errorf("SIZE not advertised: %q", msg)
+	}
+	conn.PrintfLine("MAIL FROM:<sender@domain.com> SIZE=1000")
+	expect(552)
+
+	conn.PrintfLine("MAIL FROM:<sender@domain.com>")
+	expect(250)
+	conn.PrintfLine("RCPT TO:<bcl@domain.com>")
+	expect(250)
+	conn.PrintfLine("DATA")
+	expect(354)
+	conn.PrintfLine("Subject: big\r\n\r\n%s\r\n%s\r\n.", strings.Repeat("x", 60), strings.Repeat("y", 60))
+	expect(552)
+
+	// The rest of the message was read, so the session carries on
+	conn.PrintfLine("MAIL FROM:<sender@domain.com>")
+	expect(250)
+	for _, sub := range []string{"tmp", "new"} {
+		if files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", sub)); len(files) != 0 {
+			t.Errorf("Oversized message left in %s", sub)
+		}
+	}
+}
+
+func TestHeadersPreserved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := &smtpd.Server{
+		Hostname:        "localhost",
+		OnNewConnection: onNewConnection,
+		OnNewMail:       onNewMail,
+	}
+	go s.Serve(ln)
+
+	// DKIM signatures cover the header bytes, so folding, spacing, case and
+	// order must all come through untouched for the signature to verify.
+	message := "DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/simple; d=domain.com;\r\n" +
+		"\ts=sel; h=from:to:subject; bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		"\tb=dGVzdA==\r\n" +
+		"from:   Sender <sender@domain.com>  \r\n" +
+		"To: bcl@domain.com\r\n" +
+		"Subject: a subject that is long enough that the sender folded it\r\n" +
+		" onto a second line\r\n" +
+		"X-Empty:\r\n" +
+		"\r\n" +
+		".leading dot\r\n" +
+		"body\r\n"
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com"}, []byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new"))
+	if len(files) != 1 {
+		t.Fatal("Message not delivered")
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "bcl", "new", files[0].Name()))
+	if !strings.HasSuffix(string(data), "\r\n"+message) {
+		t.Errorf("Message changed during delivery:\n%q\n%q", data, message)
+	}
+	if !strings.HasPrefix(string(data), "Return-Path: <sender@domain.com>\r\nDelivered-To: bcl@domain.com\r\nReceived: from ") {
+		t.Errorf("Trace headers missing: %q", data)
+	}
+}
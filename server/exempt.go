@@ -0,0 +1,26 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"net"
+)
+
+// exemptList is the clients that skip the reputation delays and penalties
+// It is protected by configLock.
+var exemptList access.List
+
+// hostExempt returns true if the IP is in the exempt_hosts list
+/*
+   Example TOML:
+
+   exempt_hosts = ["192.168.1.1", "10.0.0.0/8", "relay.isp.net"]
+
+   Exempt hosts are never delayed, tarpitted, or rate limited and their score isn't raised
+   when they are rejected. They still have to be in the hosts list, or
+   authenticate, to send mail, and their mail is still scanned.
+*/
+func hostExempt(ip net.IP) bool {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return exemptList.Contains(ip)
+}
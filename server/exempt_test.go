@@ -0,0 +1,58 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHostExempt(t *testing.T) {
+	savedReputation := reputation
+	defer func() {
+		cfg = config.Config{}
+		allowedList = access.List{}
+		exemptList = access.List{}
+		reputation = savedReputation
+	}()
+	cfg.ExemptHosts = []string{"192.168.1.1", "10.0.0.0/8"}
+	parseHosts()
+
+	for _, ip := range []string{"192.168.1.1", "10.1.2.3", "::ffff:10.1.2.3"} {
+		if !hostExempt(access.ParseIP(ip)) {
+			t.Errorf("%s not exempt", ip)
+		}
+	}
+	if hostExempt(net.ParseIP("192.168.1.2")) {
+		t.Error("192.168.1.2 is exempt")
+	}
+	// Exempt doesn't mean allowed
+	if hostAllowed(net.ParseIP("192.168.1.1")) {
+		t.Error("Exempt host is allowed without being in hosts")
+	}
+
+	// Exempt hosts aren't penalized or delayed
+	reputation = newReputationDB("", 0)
+	exempt, other := net.ParseIP("10.1.2.3"), net.ParseIP("172.16.0.1")
+	reputation.penalize(exempt, 5)
+	reputation.penalize(other, 5)
+	if score := reputation.score(exempt); score != 0 {
+		t.Errorf("Exempt host was penalized: %f", score)
+	}
+	if score := reputation.score(other); score < 4.99 {
+		t.Errorf("Other host wasn't penalized: %f", score)
+	}
+	reputation.entries[exempt.String()] = &reputationEntry{Score: 5, Updated: time.Now()}
+	cfg.Reputation = config.Reputation{
+		GreetingDelay: config.Duration{Duration: time.Second},
+		TarpitScore:   1,
+		TarpitDelay:   config.Duration{Duration: time.Second},
+	}
+	start := time.Now()
+	greetingDelay(exempt)
+	tarpit(exempt)
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Exempt host was delayed for %s", d)
+	}
+}
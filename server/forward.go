@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// forwardRcpt is an address a message is forwarded to, and the recipient it was sent to
+type forwardRcpt struct {
+	to   string
+	rcpt string
+	keep bool // the recipient also gets a local copy
+}
+
+// checkForwards checks that the forwarding rules can be used
+func checkForwards() error {
+	seen := make(map[string]bool)
+	for _, f := range cfg.Forwards {
+		user := f.User
+		if user == "" {
+			return fmt.Errorf("forwards entry without a user")
+		}
+		if seen[user] {
+			return fmt.Errorf("forwards user %s is listed twice", user)
+		}
+		seen[user] = true
+		if len(f.To) == 0 {
+			return fmt.Errorf("forwards user %s has no addresses", user)
+		}
+		if cfg.Relay.Host == "" {
+			return fmt.Errorf("forwards user %s needs a relay host", user)
+		}
+		targets, err := expandGroups(currentGroups(), f.To)
+		if err != nil {
+			return fmt.Errorf("forwards user %s: %s", user, err)
+		}
+		for _, t := range targets {
+			if !strings.Contains(t, "@") {
+				return fmt.Errorf("forwards user %s: %s is not an address", user, t)
+			}
+		}
+	}
+	return nil
+}
+
+// forwardTargets returns the addresses to forward the user's mail to, and true to keep a local copy
+// A forward outside of its schedule isn't used.
+func forwardTargets(user string) ([]string, bool) {
+	for _, f := range cfg.Forwards {
+		if f.User != user {
+			continue
+		}
+		if f.Schedule != "" && !scheduleActive(f.Schedule, time.Now()) {
+			return nil, true
+		}
+		targets, err := expandGroups(currentGroups(), f.To)
+		if err != nil {
+			return nil, true
+		}
+		return targets, f.KeepLocalCopy
+	}
+	return nil, true
+}
+
+// addForwards adds the addresses the recipient's mail is forwarded to
+// Each address is only sent one copy, even if several recipients forward to it.
+func (e *env) addForwards(rcpt string, targets []string, keep bool) {
+	for _, to := range targets {
+		if e.relayed(to) || e.forwarded(to) != nil {
+			continue
+		}
+		e.forwards = append(e.forwards, forwardRcpt{to: to, rcpt: rcpt, keep: keep})
+	}
+}
+
+// relayFailed records the error for an address the smarthost didn't take, returning it
+// A failed forward fails the recipient it was for, unless the recipient got a
+// local copy, in which case it is only logged and nil is returned.
+func (e *env) relayFailed(to string, err error) error {
+	rcpt := to
+	if f := e.forwarded(to); f != nil {
+		if f.keep {
+			return nil
+		}
+		rcpt = f.rcpt
+	}
+	e.rcptErrors[rcpt] = err
+	return err
+}
+
+// forwarded returns the forward to the address, or nil if it isn't forwarded to
+func (e *env) forwarded(to string) *forwardRcpt {
+	for i := range e.forwards {
+		if strings.EqualFold(e.forwards[i].to, to) {
+			return &e.forwards[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/smtpd"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCheckForwards(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	cfg.Groups = map[string][]string{"team": {"one@work.com", "two@work.com"}}
+	cfg.Forwards = []config.Forward{{User: "bcl", To: []string{"bcl@provider.com", "group:team"}}}
+	if err := checkForwards(); err == nil {
+		t.Error("Forward without a relay host accepted")
+	}
+	cfg.Relay.Host = "smtp.provider.com"
+	if err := checkForwards(); err != nil {
+		t.Errorf("Good forward refused: %s", err)
+	}
+	if targets, keep := forwardTargets("bcl"); len(targets) != 3 || keep {
+		t.Errorf("forwardTargets(bcl) = %v, %v", targets, keep)
+	}
+	if targets, keep := forwardTargets("alice"); targets != nil || !keep {
+		t.Errorf("forwardTargets(alice) = %v, %v", targets, keep)
+	}
+
+	bad := [][]config.Forward{
+		{{To: []string{"bcl@provider.com"}}},
+		{{User: "bcl"}},
+		{{User: "bcl", To: []string{"bcl"}}},
+		{{User: "bcl", To: []string{"group:missing"}}},
+		{{User: "bcl", To: []string{"bcl@provider.com"}}, {User: "bcl", To: []string{"bcl@other.com"}}},
+	}
+	for _, forwards := range bad {
+		cfg.Forwards = forwards
+		if err := checkForwards(); err == nil {
+			t.Errorf("Bad forwards accepted: %v", forwards)
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+
+	smarthost, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer smarthost.Close()
+	received := make(chan *smarthostEnvelope, 2)
+	sh := &smtpd.Server{
+		Hostname: "smarthost",
+		OnNewMail: func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+			return &smarthostEnvelope{helo: c.Hello(), done: received}, nil
+		},
+	}
+	go sh.Serve(smarthost)
+	_, port, _ := net.SplitHostPort(smarthost.Addr().String())
+
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com", "alice@domain.com", "carol@domain.com"}
+	cfg.Relay.Host = "127.0.0.1"
+	cfg.Relay.Port, _ = strconv.Atoi(port)
+	cfg.Forwards = []config.Forward{
+		{User: "bcl", To: []string{"bcl@provider.com"}, KeepLocalCopy: true},
+		{User: "alice", To: []string{"alice@work.com"}},
+		{User: "carol", To: []string{"bad@work.com"}},
+	}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+
+	message := []byte("Subject: forwarded\r\n\r\nHello\r\n")
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com", "alice@domain.com"}, message); err != nil {
+		t.Fatalf("Message not accepted: %s", err)
+	}
+	// Each domain is sent its own copy
+	var rcpts []string
+	for i := 0; i < 2; i++ {
+		env := <-received
+		rcpts = append(rcpts, env.rcpts...)
+		if !strings.HasSuffix(env.data.String(), "\r\nSubject: forwarded\r\n\r\nHello\r\n") {
+			t.Errorf("Smarthost got the wrong message: %q", env.data.String())
+		}
+	}
+	sort.Strings(rcpts)
+	if strings.Join(rcpts, ",") != "alice@work.com,bcl@provider.com" {
+		t.Errorf("Smarthost got %v", rcpts)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new")); len(files) != 1 {
+		t.Error("Local copy not kept for bcl")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "alice")); !os.IsNotExist(err) {
+		t.Error("Local copy kept for alice")
+	}
+
+	// A forward the smarthost refuses fails the recipient when there is no local copy
+	err = smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"carol@domain.com"}, message)
+	if err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Errorf("Refused forward not passed on: %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultWhitelistDays is used when the greylist whitelist_days isn't set
+const defaultWhitelistDays = 36
+
+// greylistSaveInterval is how often the time an accepted sender was last seen is saved
+const greylistSaveInterval = time.Hour
+
+// greylistEntry is what is known about one client IP, sender, and recipient
+type greylistEntry struct {
+	First  time.Time `json:"first"`            // when it was first tried
+	Passed time.Time `json:"passed,omitempty"` // when it was last accepted, zero until it has retried
+}
+
+// greylistDB remembers the client IP, sender, and recipient of mail from unknown senders
+// The first try is deferred, and once it has been retried after the delay
+// mail for the same recipient is accepted until it hasn't been seen for
+// whitelist_days.
+type greylistDB struct {
+	sync.Mutex
+	entries map[string]*greylistEntry
+	path    string // Path to save the entries to, or "" to only keep them in memory
+}
+
+var greylistTriples = newGreylistDB("")
+
+// newGreylistDB returns an empty greylistDB
+func newGreylistDB(path string) *greylistDB {
+	return &greylistDB{entries: make(map[string]*greylistEntry), path: path}
+}
+
+// greylistDelay returns how long an unknown sender has to wait before it is accepted
+func greylistDelay() time.Duration {
+	if cfg.Greylist.Delay.Duration == 0 {
+		return defaultGreylistDelay
+	}
+	return cfg.Greylist.Delay.Duration
+}
+
+// greylistWhitelist returns how long a sender that retried is remembered
+func greylistWhitelist() time.Duration {
+	days := cfg.Greylist.WhitelistDays
+	if days == 0 {
+		days = defaultWhitelistDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// tryLater returns true if the recipient should be deferred
+/*
+   Example TOML:
+
+   [greylist]
+   enabled = true
+   delay = "5m"
+   whitelist_days = 36
+
+   The first time a client IP sends from a sender to a recipient it is told
+   to try again later, and so are tries before the delay has passed. A
+   sender that doesn't retry within a day starts over.
+*/
+func (g *greylistDB) tryLater(ip net.IP, from, rcpt string, now time.Time) bool {
+	key := ip.String() + " " + strings.ToLower(from) + " " + strings.ToLower(rcpt)
+
+	g.Lock()
+	defer g.Unlock()
+	g.expire(now)
+	e, ok := g.entries[key]
+	var changed bool
+	switch {
+	case !ok:
+		g.entries[key] = &greylistEntry{First: now}
+		changed = true
+	case !e.Passed.IsZero() || now.Sub(e.First) >= greylistDelay():
+		// Senders that are already accepted are only saved again once an
+		// hour, so that busy senders don't rewrite the file for every RCPT
+		changed = e.Passed.IsZero() || now.Sub(e.Passed) >= greylistSaveInterval
+		e.Passed = now
+	}
+	if changed {
+		if err := g.save(); err != nil {
+			log.Printf("Error saving greylist: %s", err)
+		}
+	}
+	return g.entries[key].Passed.IsZero()
+}
+
+// expire removes the senders that didn't retry in time, and the accepted ones not seen for whitelist_days
+// It must be called with the lock held.
+func (g *greylistDB) expire(now time.Time) {
+	for key, e := range g.entries {
+		if e.Passed.IsZero() && now.Sub(e.First) > greylistDelay()+greylistExpiry {
+			delete(g.entries, key)
+		} else if !e.Passed.IsZero() && now.Sub(e.Passed) > greylistWhitelist() {
+			delete(g.entries, key)
+		}
+	}
+}
+
+// load reads the entries from the state file, a missing file is not an error
+func (g *greylistDB) load() error {
+	if g.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(g.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	g.Lock()
+	defer g.Unlock()
+	return json.Unmarshal(data, &g.entries)
+}
+
+// save writes the entries to the state file
+// It must be called with the lock held.
+func (g *greylistDB) save() error {
+	if g.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(g.entries)
+	if err != nil {
+		return err
+	}
+	tmp := g.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, g.path)
+}
+
+// setupGreylist creates the greylist and loads the saved entries from the state_dir
+func setupGreylist() error {
+	var statePath string
+	if cfg.StateDir != "" {
+		statePath = path.Join(cfg.StateDir, "greylist.json")
+	}
+	greylistTriples = newGreylistDB(statePath)
+	return greylistTriples.load()
+}
+
+// greylisted returns true if the local recipient should be deferred by the greylist
+// Clients with a low reputation are greylisted even if it isn't enabled.
+// Exempt hosts, clients that authenticated, and local clients on the Unix
+// socket or without an IP are never greylisted.
+func (e *env) greylisted(rcpt string, now time.Time) bool {
+	if e.conn.authUser != "" || e.clientIP == nil || localSocket(e.client) || hostExempt(e.clientIP) {
+		return false
+	}
+	if !cfg.Greylist.Enabled && !lowReputation(e.clientIP) {
+		return false
+	}
+	return greylistTriples.tryLater(e.clientIP, e.from, rcpt, now)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGreylistDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		cfg = config.Config{}
+		greylistTriples = newGreylistDB("")
+	}()
+	cfg.StateDir = dir
+	cfg.Greylist = config.Greylist{Enabled: true, WhitelistDays: 2}
+	if err := setupGreylist(); err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("192.168.1.5")
+	now := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	if !greylistTriples.tryLater(ip, "sender@remote.com", "bcl@domain.com", now) {
+		t.Error("First try not deferred")
+	}
+	if !greylistTriples.tryLater(ip, "sender@remote.com", "bcl@domain.com", now.Add(time.Minute)) {
+		t.Error("Retry before the delay not deferred")
+	}
+	if greylistTriples.tryLater(ip, "Sender@remote.com", "BCL@domain.com", now.Add(10*time.Minute)) {
+		t.Error("Retry after the delay deferred")
+	}
+	if !greylistTriples.tryLater(ip, "sender@remote.com", "other@domain.com", now.Add(10*time.Minute)) {
+		t.Error("New recipient not deferred")
+	}
+
+	// The entries are saved, and accepted senders are remembered for whitelist_days
+	if err := setupGreylist(); err != nil {
+		t.Fatal(err)
+	}
+	if greylistTriples.tryLater(ip, "sender@remote.com", "bcl@domain.com", now.Add(36*time.Hour)) {
+		t.Error("Whitelisted sender deferred")
+	}
+	if !greylistTriples.tryLater(ip, "sender@remote.com", "bcl@domain.com", now.Add(36*time.Hour+49*time.Hour)) {
+		t.Error("Sender not seen for whitelist_days not deferred")
+	}
+
+	// Accepted senders are only saved again once an hour
+	statePath := filepath.Join(dir, "greylist.json")
+	os.Remove(statePath)
+	greylistTriples.tryLater(ip, "sender@remote.com", "bcl@domain.com", now.Add(36*time.Hour+50*time.Hour))
+	greylistTriples.tryLater(ip, "sender@remote.com", "bcl@domain.com", now.Add(36*time.Hour+51*time.Hour))
+	if _, err := os.Stat(statePath); err != nil {
+		t.Error("Accepted sender not saved")
+	}
+	os.Remove(statePath)
+	greylistTriples.tryLater(ip, "sender@remote.com", "bcl@domain.com", now.Add(36*time.Hour+51*time.Hour+time.Minute))
+	if _, err := os.Stat(statePath); err == nil {
+		t.Error("Greylist saved for a sender seen a minute ago")
+	}
+
+	// A sender that doesn't retry within a day starts over
+	later := now.Add(100 * time.Hour)
+	greylistTriples.tryLater(ip, "slow@remote.com", "bcl@domain.com", later)
+	if !greylistTriples.tryLater(ip, "slow@remote.com", "bcl@domain.com", later.Add(25*time.Hour)) {
+		t.Error("Late retry not deferred")
+	}
+}
+
+func TestGreylistUnknownSenders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+		exemptList = access.List{}
+		greylistTriples = newGreylistDB("")
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	cfg.Greylist = config.Greylist{Enabled: true, Delay: config.Duration{Duration: time.Nanosecond}}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	send := func() error {
+		return smtp.SendMail(ln.Addr().String(), nil, "sender@remote.com", []string{"bcl@domain.com"}, []byte("Subject: test\r\n\r\nHi\r\n"))
+	}
+	if err := send(); err == nil || !strings.HasPrefix(err.Error(), "450") {
+		t.Errorf("First try not greylisted: %v", err)
+	}
+	if err := send(); err != nil {
+		t.Errorf("Retry refused: %s", err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new"))
+	if len(files) != 1 {
+		t.Errorf("Wrong number of messages delivered: %d", len(files))
+	}
+
+	// Exempt hosts are never greylisted
+	greylistTriples = newGreylistDB("")
+	exemptList = access.List{Hosts: []net.IP{net.ParseIP("127.0.0.1")}}
+	if err := send(); err != nil {
+		t.Errorf("Exempt host greylisted: %s", err)
+	}
+}
+
+func TestGreylistLocal(t *testing.T) {
+	defer func() {
+		cfg = config.Config{}
+		greylistTriples = newGreylistDB("")
+	}()
+	cfg.Greylist = config.Greylist{Enabled: true}
+
+	now := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	for _, ip := range []net.IP{nil, net.ParseIP("192.168.1.5")} {
+		e := &env{from: "root@localhost", clientIP: ip, client: localConn{id: "c0ffee"}}
+		if e.greylisted("bcl@domain.com", now) {
+			t.Errorf("Local client with IP %v greylisted", ip)
+		}
+	}
+}
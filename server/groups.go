@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// groupPrefix marks an entry in an address list as a reference to a named group
+const groupPrefix = "group:"
+
+// expandGroups replaces group:name entries in the list with the group's addresses
+// Groups may include other groups, duplicate addresses are only returned once.
+/*
+   Example TOML:
+
+   emails = ["group:admins", "user@domain.com"]
+
+   [groups]
+   admins = ["root@domain.com", "bcl@domain.com"]
+   everyone = ["group:admins", "guest@domain.com"]
+*/
+func expandGroups(groups map[string][]string, list []string) ([]string, error) {
+	var expanded []string
+	seen := make(map[string]bool)
+	var expand func(list []string, parents []string) error
+	expand = func(list []string, parents []string) error {
+		for _, entry := range list {
+			if !strings.HasPrefix(entry, groupPrefix) {
+				if !seen[entry] {
+					seen[entry] = true
+					expanded = append(expanded, entry)
+				}
+				continue
+			}
+			name := strings.TrimPrefix(entry, groupPrefix)
+			members, ok := groups[name]
+			if !ok {
+				return fmt.Errorf("unknown group %q", name)
+			}
+			for _, p := range parents {
+				if p == name {
+					return fmt.Errorf("group %q includes itself", name)
+				}
+			}
+			if err := expand(members, append(parents, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := expand(list, nil); err != nil {
+		return nil, err
+	}
+	return expanded, nil
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandGroups(t *testing.T) {
+	groups := map[string][]string{
+		"admins":   {"root@domain.com", "bcl@domain.com"},
+		"everyone": {"group:admins", "guest@domain.com", "bcl@domain.com"},
+		"loop":     {"group:loop2"},
+		"loop2":    {"group:loop"},
+	}
+
+	expanded, err := expandGroups(groups, []string{"user@domain.com", "group:everyone"})
+	if err != nil {
+		t.Fatalf("Error expanding groups: %s", err)
+	}
+	expected := []string{"user@domain.com", "root@domain.com", "bcl@domain.com", "guest@domain.com"}
+	if !reflect.DeepEqual(expanded, expected) {
+		t.Errorf("Wrong expansion: %#v", expanded)
+	}
+
+	if _, err := expandGroups(groups, []string{"group:missing"}); err == nil {
+		t.Error("Unknown group did not return an error")
+	}
+	if _, err := expandGroups(groups, []string{"group:loop"}); err == nil {
+		t.Error("Group loop did not return an error")
+	}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bcl/letterbox/smtpd"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// holdsDir is the directory in the state_dir with a file for each user whose delivery is held
+// Files are used so that the hold command can pause and resume a user while
+// letterbox is running.
+const holdsDir = "holds"
+
+// errHeld is the reply for a held user's mail with hold_policy = "tempfail", or without a queue
+var errHeld = smtpd.SMTPError("450 4.2.1 Error: mailbox is temporarily unavailable")
+
+// checkHoldPolicy checks the hold_policy setting
+func checkHoldPolicy() error {
+	switch cfg.HoldPolicy {
+	case "", "tempfail":
+	case "queue":
+		if !queueEnabled() {
+			return fmt.Errorf("hold_policy = \"queue\" needs a queue dir")
+		}
+	default:
+		return fmt.Errorf("unknown hold_policy %q", cfg.HoldPolicy)
+	}
+	return nil
+}
+
+// holdPolicy returns what happens to a held user's mail, queue or tempfail
+// It defaults to queue when the retry queue is enabled.
+/*
+   Example TOML:
+
+   hold_policy = "queue"
+*/
+func holdPolicy() string {
+	if cfg.HoldPolicy == "" {
+		if queueEnabled() {
+			return "queue"
+		}
+		return "tempfail"
+	}
+	return cfg.HoldPolicy
+}
+
+// holdPath returns the file that marks the user's delivery as held, "" without a state_dir
+func holdPath(user string) string {
+	if cfg.StateDir == "" {
+		return ""
+	}
+	return path.Join(cfg.StateDir, holdsDir, path.Base(path.Clean(user)))
+}
+
+// userHeld returns true if delivery to the user is paused
+func userHeld(user string) bool {
+	p := holdPath(user)
+	if p == "" {
+		return false
+	}
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// rcptHeld returns the first user the address is delivered to whose mail is held and refused, "" if there isn't one
+// With hold_policy = "queue" held mail is accepted and queued instead.
+func rcptHeld(emails []string, address string) string {
+	if holdPolicy() == "queue" {
+		return ""
+	}
+	for _, user := range mailboxUsers(emails, address) {
+		if userHeld(user) {
+			return user
+		}
+	}
+	return ""
+}
+
+// holdUser pauses delivery to the user
+func holdUser(user string, now time.Time) error {
+	p := holdPath(user)
+	if p == "" {
+		return fmt.Errorf("holds need a state_dir")
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, []byte(now.Format(time.RFC3339)+"\n"), 0600)
+}
+
+// releaseUser resumes delivery to the user, and makes the user's queued mail due now
+// It returns the number of queued messages for the user.
+func releaseUser(user string, now time.Time) (int, error) {
+	p := holdPath(user)
+	if p == "" {
+		return 0, fmt.Errorf("holds need a state_dir")
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if !queueEnabled() {
+		return 0, nil
+	}
+	return flushUser(user, now)
+}
+
+// flushUser makes the queued messages with deliveries for the user due now
+func flushUser(user string, now time.Time) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(cfg.Queue.Dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	flushed := 0
+	for _, p := range paths {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		var entry queueEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			continue
+		}
+		for _, q := range entry.Deliveries {
+			if !q.Relay && q.User == user {
+				entry.Next = now
+				if err := saveEntry(&entry); err != nil {
+					return flushed, err
+				}
+				flushed++
+				break
+			}
+		}
+	}
+	return flushed, nil
+}
+
+// heldUsers returns the users whose delivery is paused, and when it was paused
+func heldUsers() (map[string]string, error) {
+	held := make(map[string]string)
+	if cfg.StateDir == "" {
+		return held, nil
+	}
+	files, err := ioutil.ReadDir(path.Join(cfg.StateDir, holdsDir))
+	if os.IsNotExist(err) {
+		return held, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		data, _ := ioutil.ReadFile(path.Join(cfg.StateDir, holdsDir, f.Name()))
+		held[f.Name()] = strings.TrimSpace(string(data))
+	}
+	return held, nil
+}
+
+// serveHolds lists the held users as JSON
+// The metrics listener isn't authenticated, so holds are only changed with
+// the hold command.
+func serveHolds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	held, err := heldUsers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(held)
+}
+
+// holdCommand pauses and resumes delivery to users, and lists the held users
+/*
+   letterbox hold add <user>
+   letterbox hold release <user>
+   letterbox hold list
+*/
+func holdCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: hold add|release <user> | hold list")
+	}
+	if err := loadCommandConfig(); err != nil {
+		return err
+	}
+	switch {
+	case args[0] == "add" && len(args) == 2:
+		return holdUser(args[1], time.Now())
+	case args[0] == "release" && len(args) == 2:
+		n, err := releaseUser(args[1], time.Now())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Released %s, %d queued messages will be delivered\n", args[1], n)
+	case args[0] == "list" && len(args) == 1:
+		held, err := heldUsers()
+		if err != nil {
+			return err
+		}
+		var users []string
+		for user := range held {
+			users = append(users, user)
+		}
+		sort.Strings(users)
+		for _, user := range users {
+			fmt.Printf("%s\theld since %s\n", user, held[user])
+		}
+	default:
+		return fmt.Errorf("usage: hold add|release <user> | hold list")
+	}
+	return nil
+}
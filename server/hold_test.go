@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckHoldPolicy(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	for _, policy := range []string{"queue", "bounce"} {
+		cfg.HoldPolicy = policy
+		if err := checkHoldPolicy(); err == nil {
+			t.Errorf("Bad hold_policy %q accepted", policy)
+		}
+	}
+	cfg.Queue.Dir = "/var/spool/letterbox"
+	if err := checkHoldPolicy(); err == nil {
+		t.Error("Unknown hold_policy accepted")
+	}
+	cfg.HoldPolicy = "queue"
+	if err := checkHoldPolicy(); err != nil {
+		t.Errorf("hold_policy with a queue refused: %s", err)
+	}
+	cfg.HoldPolicy = ""
+	if holdPolicy() != "queue" {
+		t.Errorf("Wrong default hold_policy with a queue: %s", holdPolicy())
+	}
+}
+
+func TestHolds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com", "alice@domain.com"}
+	cfg.StateDir = filepath.Join(dir, "state")
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	send := func(rcpts ...string) error {
+		return smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", rcpts, []byte("Subject: test\r\n\r\nHi\r\n"))
+	}
+	count := func(user string) int {
+		files, _ := ioutil.ReadDir(filepath.Join(cmdline.Maildirs, user, "new"))
+		return len(files)
+	}
+
+	// The metrics listener can't change the holds
+	w := httptest.NewRecorder()
+	serveHolds(w, httptest.NewRequest("POST", "/holds?user=bcl", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /holds returned %d", w.Code)
+	}
+
+	// Held by the hold command, without a queue the user's mail is deferred
+	if err := holdUser("bcl", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	serveHolds(w, httptest.NewRequest("GET", "/holds", nil))
+	var held map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &held); err != nil || len(held) != 1 || held["bcl"] == "" {
+		t.Fatalf("Wrong held users: %s %v", w.Body.String(), err)
+	}
+	if err := send("bcl@domain.com"); err == nil || !strings.HasPrefix(err.Error(), "450") {
+		t.Errorf("Mail for held user not deferred: %v", err)
+	}
+	if err := send("alice@domain.com"); err != nil {
+		t.Errorf("Mail for another user refused: %s", err)
+	}
+	if count("bcl") != 0 || count("alice") != 1 {
+		t.Errorf("Wrong deliveries: bcl %d, alice %d", count("bcl"), count("alice"))
+	}
+
+	// Sent to both, only bcl is refused at RCPT and alice gets one copy
+	c, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("sender@domain.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("alice@domain.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("bcl@domain.com"); err == nil || !strings.HasPrefix(err.Error(), "450") {
+		t.Errorf("Held recipient not refused at RCPT: %v", err)
+	}
+	wc, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wc.Write([]byte("Subject: test\r\n\r\nHi\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Errorf("Message for the other recipient refused: %s", err)
+	}
+	c.Quit()
+	if count("bcl") != 0 || count("alice") != 2 {
+		t.Errorf("Wrong deliveries with a held recipient: bcl %d, alice %d", count("bcl"), count("alice"))
+	}
+
+	// With a queue it waits there until the user is released
+	cfg.Queue = config.Queue{Dir: filepath.Join(dir, "queue")}
+	if err := setupQueue(); err != nil {
+		t.Fatal(err)
+	}
+	if err := send("bcl@domain.com", "alice@domain.com"); err != nil {
+		t.Errorf("Mail for held user not queued: %s", err)
+	}
+	if err := processQueue(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if count("bcl") != 0 || count("alice") != 3 {
+		t.Errorf("Wrong deliveries while held: bcl %d, alice %d", count("bcl"), count("alice"))
+	}
+	n, err := releaseUser("bcl", time.Now())
+	if err != nil || n != 1 {
+		t.Fatalf("Wrong number of messages flushed: %d %v", n, err)
+	}
+	if err := processQueue(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if count("bcl") != 1 {
+		t.Errorf("Queued message not delivered after release: %d", count("bcl"))
+	}
+	if held, _ := heldUsers(); len(held) != 0 {
+		t.Errorf("User still held: %v", held)
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/bcl/letterbox/access"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// hostsFilePoll is how often the hosts files are checked for changes
+const hostsFilePoll = 5 * time.Second
+
+// fileHosts are the entries read from the hosts_file files, added to cfg.Hosts
+// They are protected by configLock.
+var fileHosts []string
+
+// hostsFilesState returns the names, sizes, and modification times of the hosts files
+// It changes when a file is edited, added, or removed.
+func hostsFilesState(pattern string) string {
+	paths, _ := filepath.Glob(pattern)
+	sort.Strings(paths)
+	var state []string
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			state = append(state, fmt.Sprintf("%s %d %d", path, info.Size(), info.ModTime().UnixNano()))
+		}
+	}
+	return strings.Join(state, "\n")
+}
+
+// loadHostsFiles reads the hosts files when letterbox starts, before parseHosts
+func loadHostsFiles() error {
+	if cfg.HostsFile == "" {
+		return nil
+	}
+	entries, bad, err := access.ReadFiles(cfg.HostsFile)
+	if err != nil {
+		return err
+	}
+	for _, err := range bad {
+		log.Printf("Skipping bad entry in %s", err)
+	}
+	configLock.Lock()
+	fileHosts = entries
+	configLock.Unlock()
+	return nil
+}
+
+// configHosts returns the hosts from the config and the hosts files
+func configHosts(hosts []string) []string {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return append(append([]string{}, hosts...), fileHosts...)
+}
+
+// reloadHostsFiles reads the hosts files again and replaces the allowed hosts
+// The old entries are kept if a file can't be read.
+func reloadHostsFiles() {
+	entries, bad, err := access.ReadFiles(cfg.HostsFile)
+	if err != nil {
+		log.Printf("Error reloading %s, keeping the old hosts: %s", cfg.HostsFile, err)
+		return
+	}
+	for _, err := range bad {
+		log.Printf("Skipping bad entry in %s", err)
+	}
+	configLock.RLock()
+	all := append(append([]string{}, cfg.Hosts...), entries...)
+	configLock.RUnlock()
+	allowed := access.Resolve(all)
+
+	configLock.Lock()
+	old := fileHosts
+	fileHosts = entries
+	allowedList = allowed
+	configLock.Unlock()
+
+	log.Printf("Reloaded hosts from %s", cfg.HostsFile)
+	logDiff("hosts_file", old, entries)
+}
+
+// watchHostsFiles reloads the hosts files whenever they change, until the context is done
+// Other programs, like VPN provisioning or DHCP hooks, can manage the files
+// without touching the config or signalling letterbox.
+func watchHostsFiles(ctx context.Context) {
+	if cfg.HostsFile == "" {
+		return
+	}
+	state := hostsFilesState(cfg.HostsFile)
+	ticker := time.NewTicker(hostsFilePoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s := hostsFilesState(cfg.HostsFile); s != state {
+			state = s
+			reloadHostsFiles()
+		}
+	}
+}
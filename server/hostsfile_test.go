@@ -0,0 +1,51 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReloadHostsFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		cfg = config.Config{}
+		fileHosts = nil
+		allowedList = access.List{}
+	}()
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.HostsFile = filepath.Join(dir, "*.txt")
+	ioutil.WriteFile(filepath.Join(dir, "vpn.txt"), []byte("10.8.0.0/24\n"), 0600)
+	if err := loadHostsFiles(); err != nil {
+		t.Fatal(err)
+	}
+	parseHosts()
+	if !hostAllowed(net.ParseIP("127.0.0.1")) || !hostAllowed(net.ParseIP("10.8.0.9")) {
+		t.Fatal("Hosts file not loaded")
+	}
+
+	state := hostsFilesState(cfg.HostsFile)
+	ioutil.WriteFile(filepath.Join(dir, "dhcp.txt"), []byte("192.168.1.20\n"), 0600)
+	if hostsFilesState(cfg.HostsFile) == state {
+		t.Error("New file didn't change the state")
+	}
+	os.Remove(filepath.Join(dir, "vpn.txt"))
+	out := captureOutput(reloadHostsFiles, false)
+	for _, s := range []string{"Added to hosts_file: 192.168.1.20", "Removed from hosts_file: 10.8.0.0/24"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Missing %q in log:\n%s", s, out)
+		}
+	}
+	if hostAllowed(net.ParseIP("10.8.0.9")) || !hostAllowed(net.ParseIP("192.168.1.20")) || !hostAllowed(net.ParseIP("127.0.0.1")) {
+		t.Error("Hosts not reloaded")
+	}
+}
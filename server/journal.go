@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalEntry is one line of the delivery journal
+type journalEntry struct {
+	Time        time.Time `json:"time"`
+	Kind        string    `json:"kind"` // connect, reject, or delivery
+	Conn        string    `json:"conn,omitempty"`
+	QueueID     string    `json:"queue_id,omitempty"`
+	IP          string    `json:"ip,omitempty"`
+	From        string    `json:"from,omitempty"`
+	Rcpt        string    `json:"rcpt,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Path        string    `json:"path,omitempty"`        // maildir file or mbox the message was delivered to
+	Disposition string    `json:"disposition,omitempty"` // what happened to the delivery, like delivered, queued, or relayed
+	Match       string    `json:"match,omitempty"`       // hosts entry that let the client in
+	Code        string    `json:"code,omitempty"`        // reject code
+	Reason      string    `json:"reason,omitempty"`
+	Tags        []string  `json:"tags,omitempty"` // policy tags of the message
+}
+
+// journalLock keeps lines from different sessions from being interleaved
+var journalLock sync.Mutex
+
+// writeJournal appends the entry to the journal, if there is one
+/*
+   Example TOML:
+
+   journal = "/var/lib/letterbox/journal.jsonl"
+
+   Each accepted and rejected connection, rejected recipient, and delivery is
+   added to the file as a line of JSON, or a row of an SQLite database with
+   journal_format = "sqlite", and letterbox log queries it.
+*/
+func writeJournal(entry journalEntry) {
+	if cfg.Journal == "" {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if journalFormat() == "sqlite" {
+		if err := insertJournal(cfg.Journal, entry); err != nil {
+			log.Printf("Error writing journal: %s", err)
+		}
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding journal entry: %s", err)
+		return
+	}
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	f, err := os.OpenFile(cfg.Journal, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("Error opening journal: %s", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("Error writing journal: %s", err)
+	}
+}
+
+// journalDelivery adds what happened to the message for one recipient to the journal
+// It is also remembered for the recipient's result.
+func (e *env) journalDelivery(rcpt, disposition, path string) {
+	e.noteOutcome(rcpt, disposition, path)
+	var ip string
+	if e.clientIP != nil {
+		ip = e.clientIP.String()
+	}
+	writeJournal(journalEntry{
+		Kind:        "delivery",
+		Conn:        e.conn.id,
+		QueueID:     e.conn.queueID,
+		IP:          ip,
+		From:        e.from,
+		Rcpt:        rcpt,
+		Size:        e.size,
+		Path:        path,
+		Disposition: disposition,
+		Tags:        e.tags,
+	})
+}
+
+// journalQuery selects journal entries, empty fields match everything
+type journalQuery struct {
+	since time.Time
+	until time.Time
+	from  string
+	rcpt  string
+	ip    string
+	kind  string
+	tag   string
+}
+
+// matches returns true if the entry is selected by the query
+// Senders and recipients match if they contain the query's, ignoring case,
+// so a domain like @example.com matches all of its addresses.
+func (q journalQuery) matches(entry journalEntry) bool {
+	switch {
+	case !q.since.IsZero() && entry.Time.Before(q.since):
+		return false
+	case !q.until.IsZero() && !entry.Time.Before(q.until):
+		return false
+	case q.from != "" && !strings.Contains(strings.ToLower(entry.From), strings.ToLower(q.from)):
+		return false
+	case q.rcpt != "" && !strings.Contains(strings.ToLower(entry.Rcpt), strings.ToLower(q.rcpt)):
+		return false
+	case q.ip != "" && entry.IP != q.ip:
+		return false
+	case q.kind != "" && entry.Kind != q.kind:
+		return false
+	case q.tag != "" && !hasTag(entry.Tags, q.tag):
+		return false
+	}
+	return true
+}
+
+// hasTag returns true if the tag is one of the tags, ignoring case
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// readJournal calls fn with each journal entry the query selects, oldest first
+func readJournal(path string, q journalQuery, fn func(entry journalEntry)) error {
+	if journalFormat() == "sqlite" {
+		return selectJournal(path, q, fn)
+	}
+	return readJSONLJournal(path, q, fn)
+}
+
+// readJSONLJournal calls fn with each entry of a JSONL journal the query selects
+// Lines that can't be parsed, like one cut short by a crash, are skipped.
+func readJSONLJournal(path string, q journalQuery, fn func(entry journalEntry)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			logDebugf("Skipping journal line: %s", err)
+			continue
+		}
+		if q.matches(entry) {
+			fn(entry)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseJournalDate parses a date like 2024-01-31 in local time, or a full RFC 3339 time
+func parseJournalDate(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// logCommand prints the journal entries selected by date, sender, recipient, client IP, kind, or policy tag
+/*
+   letterbox log [-since 2024-01-01] [-until 2024-01-31] [-from a@b.com] [-rcpt bcl@] [-ip 192.168.1.5] [-kind result] [-tag dnsbl-hit]
+   letterbox log -import journal.jsonl
+
+   -import copies the entries of a JSONL journal into the SQLite one.
+*/
+func logCommand(args []string) error {
+	flags := flag.NewFlagSet("log", flag.ExitOnError)
+	since := flags.String("since", "", "Only entries from this date, like 2024-01-01, or time on")
+	until := flags.String("until", "", "Only entries up to the end of this date, or before this time")
+	from := flags.String("from", "", "Only entries with a sender containing this")
+	rcpt := flags.String("rcpt", "", "Only entries with a recipient containing this")
+	ip := flags.String("ip", "", "Only entries for this client IP")
+	kind := flags.String("kind", "", "Only connect, reject, delivery, or result entries")
+	tag := flags.String("tag", "", "Only entries for messages with this policy tag")
+	jsonl := flags.String("import", "", "Copy the entries of this JSONL journal into the SQLite journal")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: log [-since date] [-until date] [-from sender] [-rcpt recipient] [-ip address] [-kind kind] [-tag tag] | log -import journal.jsonl")
+	}
+	if err := loadCommandConfig(); err != nil {
+		return err
+	}
+	if cfg.Journal == "" {
+		return fmt.Errorf("no journal is set in the config")
+	}
+	if err := checkJournal(); err != nil {
+		return err
+	}
+	defer closeJournalDB()
+	if *jsonl != "" {
+		if journalFormat() != "sqlite" {
+			return fmt.Errorf("-import needs journal_format = \"sqlite\"")
+		}
+		n, err := importJournal(*jsonl, cfg.Journal)
+		fmt.Printf("Imported %d entries from %s\n", n, *jsonl)
+		return err
+	}
+
+	q := journalQuery{from: *from, rcpt: *rcpt, kind: *kind, tag: *tag}
+	if parsed := net.ParseIP(*ip); parsed != nil {
+		q.ip = parsed.String()
+	} else if *ip != "" {
+		return fmt.Errorf("bad -ip %q", *ip)
+	}
+	if *since != "" {
+		t, err := parseJournalDate(*since)
+		if err != nil {
+			return fmt.Errorf("bad -since %q", *since)
+		}
+		q.since = t
+	}
+	if *until != "" {
+		t, err := parseJournalDate(*until)
+		if err != nil {
+			return fmt.Errorf("bad -until %q", *until)
+		}
+		// A date includes the whole day
+		if !strings.Contains(*until, "T") {
+			t = t.AddDate(0, 0, 1)
+		}
+		q.until = t
+	}
+	return readJournal(cfg.Journal, q, func(e journalEntry) {
+		result := e.Disposition
+		if e.Kind == "reject" {
+			result = e.Code
+		}
+		detail := e.Path
+		if e.Kind == "reject" || e.Kind == "result" && e.Reason != "" {
+			detail = e.Reason
+		} else if e.Kind == "connect" {
+			detail = e.Match
+		}
+		var size string
+		if e.Size > 0 {
+			size = strconv.FormatInt(e.Size, 10)
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Kind, result, e.QueueID, e.IP, e.From, e.Rcpt, size, detail)
+	})
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournal(t *testing.T) {
+	for _, format := range []string{"jsonl", "sqlite"} {
+		t.Run(format, func(t *testing.T) { testJournal(t, format) })
+	}
+}
+
+// testJournal checks the journal entries of a delivered and a rejected message in the format
+func testJournal(t *testing.T, format string) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+		closeJournalDB()
+	}()
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	cfg.Journal = filepath.Join(dir, "journal."+format)
+	cfg.JournalFormat = format
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	msg := []byte("Subject: test\r\n\r\nHi\r\n")
+	if err := smtp.SendMail(ln.Addr().String(), nil, "alice@example.com", []string{"bcl@domain.com"}, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := smtp.SendMail(ln.Addr().String(), nil, "bob@example.org", []string{"nobody@domain.com"}, msg); err == nil {
+		t.Fatal("Unknown recipient accepted")
+	}
+
+	var entries []journalEntry
+	if err := readJournal(cfg.Journal, journalQuery{}, func(e journalEntry) { entries = append(entries, e) }); err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string][]journalEntry)
+	for _, e := range entries {
+		kinds[e.Kind] = append(kinds[e.Kind], e)
+	}
+	if len(kinds["connect"]) != 2 || kinds["connect"][0].IP != "127.0.0.1" || kinds["connect"][0].Disposition != "accepted" {
+		t.Errorf("Wrong connections: %#v", kinds["connect"])
+	}
+	if len(kinds["reject"]) != 1 || kinds["reject"][0].Rcpt != "nobody@domain.com" || kinds["reject"][0].From != "bob@example.org" {
+		t.Errorf("Wrong rejections: %#v", kinds["reject"])
+	}
+	if len(kinds["delivery"]) != 1 {
+		t.Fatalf("Wrong deliveries: %#v", kinds["delivery"])
+	}
+	d := kinds["delivery"][0]
+	if d.From != "alice@example.com" || d.Rcpt != "bcl@domain.com" || d.Disposition != "delivered" || d.QueueID == "" || d.Size == 0 {
+		t.Errorf("Wrong delivery: %#v", d)
+	}
+	if !strings.HasPrefix(d.Path, filepath.Join(cmdline.Maildirs, "bcl", "new")) {
+		t.Errorf("Wrong delivery path: %s", d.Path)
+	} else if _, err := os.Stat(d.Path); err != nil {
+		t.Errorf("Delivered message not at its path: %s", err)
+	}
+	if len(kinds["result"]) != 1 || kinds["result"][0].Disposition != resultDelivered || kinds["result"][0].Path != d.Path {
+		t.Errorf("Wrong results: %#v", kinds["result"])
+	}
+
+	// Queries by sender, recipient, and date
+	count := func(q journalQuery) int {
+		n := 0
+		readJournal(cfg.Journal, q, func(journalEntry) { n++ })
+		return n
+	}
+	if n := count(journalQuery{from: "@EXAMPLE.com"}); n != 2 {
+		t.Errorf("Wrong number of entries from example.com: %d", n)
+	}
+	if n := count(journalQuery{rcpt: "nobody@"}); n != 1 {
+		t.Errorf("Wrong number of entries for nobody: %d", n)
+	}
+	if n := count(journalQuery{since: time.Now().Add(time.Hour)}); n != 0 {
+		t.Errorf("Entries from the future: %d", n)
+	}
+	if n := count(journalQuery{until: time.Now().Add(-time.Hour)}); n != 0 {
+		t.Errorf("Entries from before the test: %d", n)
+	}
+}
+
+func TestParseJournalDate(t *testing.T) {
+	day, err := parseJournalDate("2024-01-31")
+	if err != nil || !day.Equal(time.Date(2024, 1, 31, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("Wrong date: %s %v", day, err)
+	}
+	when, err := parseJournalDate("2024-01-31T12:30:00Z")
+	if err != nil || !when.Equal(time.Date(2024, 1, 31, 12, 30, 0, 0, time.UTC)) {
+		t.Errorf("Wrong time: %s %v", when, err)
+	}
+	if _, err := parseJournalDate("last tuesday"); err == nil {
+		t.Error("Bad date accepted")
+	}
+}
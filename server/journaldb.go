@@ -0,0 +1,228 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3" // the sqlite3 driver, it needs cgo
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalTimeFormat is how times are stored in the SQLite journal, fixed width so they sort as text
+const journalTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// journalPruneInterval is how often entries older than journal_retention are deleted
+const journalPruneInterval = time.Hour
+
+// journalSchema creates the SQLite journal's table, with a column for each journalEntry field
+const journalSchema = `
+CREATE TABLE IF NOT EXISTS journal (
+	id INTEGER PRIMARY KEY,
+	time TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	conn TEXT NOT NULL DEFAULT '',
+	queue_id TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '',
+	sender TEXT NOT NULL DEFAULT '',
+	rcpt TEXT NOT NULL DEFAULT '',
+	size INTEGER NOT NULL DEFAULT 0,
+	path TEXT NOT NULL DEFAULT '',
+	disposition TEXT NOT NULL DEFAULT '',
+	host_match TEXT NOT NULL DEFAULT '',
+	code TEXT NOT NULL DEFAULT '',
+	reason TEXT NOT NULL DEFAULT '',
+	tags TEXT NOT NULL DEFAULT '[]'
+);
+CREATE INDEX IF NOT EXISTS journal_time ON journal (time);
+CREATE INDEX IF NOT EXISTS journal_queue_id ON journal (queue_id);
+`
+
+// journalDB is the open SQLite journal
+var journalDB struct {
+	sync.Mutex
+	path   string
+	db     *sql.DB
+	pruned time.Time
+}
+
+// journalFormat returns the format of the journal, jsonl or sqlite
+/*
+   Example TOML:
+
+   journal = "/var/lib/letterbox/journal.db"
+   journal_format = "sqlite"
+   journal_retention = "2160h"
+
+   The SQLite journal uses write-ahead logging and syncs each entry, so the
+   entries written before a crash are kept. Entries older than
+   journal_retention are deleted, 0 keeps them all.
+*/
+func journalFormat() string {
+	if cfg.JournalFormat == "" {
+		return "jsonl"
+	}
+	return strings.ToLower(cfg.JournalFormat)
+}
+
+// checkJournal checks the journal settings
+func checkJournal() error {
+	switch journalFormat() {
+	case "jsonl":
+		if cfg.JournalRetention.Duration != 0 {
+			return fmt.Errorf("journal_retention needs journal_format = \"sqlite\"")
+		}
+	case "sqlite":
+		if cfg.Journal == "" {
+			return fmt.Errorf("journal_format is sqlite without a journal")
+		}
+	default:
+		return fmt.Errorf("unknown journal_format: %s", cfg.JournalFormat)
+	}
+	if cfg.JournalRetention.Duration < 0 {
+		return fmt.Errorf("journal_retention can't be negative")
+	}
+	return nil
+}
+
+// openJournalDB returns the SQLite journal at path, opening it and creating its table the first time
+func openJournalDB(path string) (*sql.DB, error) {
+	journalDB.Lock()
+	defer journalDB.Unlock()
+	if journalDB.db != nil && journalDB.path == path {
+		return journalDB.db, nil
+	}
+	if journalDB.db != nil {
+		journalDB.db.Close()
+		journalDB.db = nil
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_synchronous=FULL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// One writer at a time, SQLite serializes them anyway
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(journalSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	journalDB.path, journalDB.db, journalDB.pruned = path, db, time.Time{}
+	return db, nil
+}
+
+// closeJournalDB closes the SQLite journal, if it is open
+func closeJournalDB() {
+	journalDB.Lock()
+	defer journalDB.Unlock()
+	if journalDB.db != nil {
+		journalDB.db.Close()
+		journalDB.db = nil
+	}
+}
+
+// insertJournal adds the entry to the SQLite journal, deleting the expired entries once an hour
+func insertJournal(path string, entry journalEntry) error {
+	db, err := openJournalDB(path)
+	if err != nil {
+		return err
+	}
+	tags, err := json.Marshal(entry.Tags)
+	if err != nil {
+		return err
+	}
+	if entry.Tags == nil {
+		tags = []byte("[]")
+	}
+	_, err = db.Exec(`INSERT INTO journal (time, kind, conn, queue_id, ip, sender, rcpt, size, path, disposition, host_match, code, reason, tags)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.Time.UTC().Format(journalTimeFormat), entry.Kind, entry.Conn, entry.QueueID, entry.IP, entry.From, entry.Rcpt,
+		entry.Size, entry.Path, entry.Disposition, entry.Match, entry.Code, entry.Reason, string(tags))
+	if err != nil {
+		return err
+	}
+	journalDB.Lock()
+	due := time.Since(journalDB.pruned) >= journalPruneInterval
+	if due {
+		journalDB.pruned = time.Now()
+	}
+	journalDB.Unlock()
+	if due && cfg.JournalRetention.Duration > 0 {
+		if err := pruneJournal(db, time.Now().Add(-cfg.JournalRetention.Duration)); err != nil {
+			log.Printf("Error deleting old journal entries: %s", err)
+		}
+	}
+	return nil
+}
+
+// pruneJournal deletes the entries from before the time
+func pruneJournal(db *sql.DB, before time.Time) error {
+	res, err := db.Exec("DELETE FROM journal WHERE time < ?", before.UTC().Format(journalTimeFormat))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		logDebugf("Deleted %d journal entries from before %s", n, before.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// selectJournal calls fn with each entry of the SQLite journal the query selects, oldest first
+func selectJournal(path string, q journalQuery, fn func(entry journalEntry)) error {
+	db, err := openJournalDB(path)
+	if err != nil {
+		return err
+	}
+	// The dates are narrowed down with the index, the rest is matched like the JSONL journal
+	query := `SELECT time, kind, conn, queue_id, ip, sender, rcpt, size, path, disposition, host_match, code, reason, tags
+		FROM journal WHERE time >= ?`
+	args := []interface{}{q.since.UTC().Format(journalTimeFormat)}
+	if !q.until.IsZero() {
+		query += " AND time < ?"
+		args = append(args, q.until.UTC().Format(journalTimeFormat))
+	}
+	rows, err := db.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry journalEntry
+		var when, tags string
+		err := rows.Scan(&when, &entry.Kind, &entry.Conn, &entry.QueueID, &entry.IP, &entry.From, &entry.Rcpt,
+			&entry.Size, &entry.Path, &entry.Disposition, &entry.Match, &entry.Code, &entry.Reason, &tags)
+		if err != nil {
+			return err
+		}
+		if entry.Time, err = time.Parse(journalTimeFormat, when); err != nil {
+			return err
+		}
+		entry.Time = entry.Time.Local()
+		if err := json.Unmarshal([]byte(tags), &entry.Tags); err != nil {
+			return err
+		}
+		if q.matches(entry) {
+			fn(entry)
+		}
+	}
+	return rows.Err()
+}
+
+// importJournal copies the entries of a JSONL journal into the SQLite journal
+func importJournal(from, to string) (int, error) {
+	var n int
+	var insertErr error
+	err := readJSONLJournal(from, journalQuery{}, func(entry journalEntry) {
+		if insertErr != nil {
+			return
+		}
+		if insertErr = insertJournal(to, entry); insertErr == nil {
+			n++
+		}
+	})
+	if insertErr != nil {
+		return n, insertErr
+	}
+	return n, err
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckJournal(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	bad := []config.Config{
+		{Journal: "/var/lib/letterbox/journal.jsonl", JournalRetention: config.Duration{Duration: time.Hour}},
+		{JournalFormat: "sqlite"},
+		{Journal: "/var/lib/letterbox/journal.db", JournalFormat: "csv"},
+		{Journal: "/var/lib/letterbox/journal.db", JournalFormat: "sqlite", JournalRetention: config.Duration{Duration: -time.Hour}},
+	}
+	for _, c := range bad {
+		cfg = c
+		if err := checkJournal(); err == nil {
+			t.Errorf("No error for %+v", c)
+		}
+	}
+	cfg = config.Config{Journal: "/var/lib/letterbox/journal.db", JournalFormat: "SQLite", JournalRetention: config.Duration{Duration: time.Hour}}
+	if err := checkJournal(); err != nil {
+		t.Errorf("Error for a good journal: %s", err)
+	}
+}
+
+func TestJournalRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		cfg = config.Config{}
+		closeJournalDB()
+	}()
+	cfg.Journal = filepath.Join(dir, "journal.db")
+	cfg.JournalFormat = "sqlite"
+	cfg.JournalRetention = config.Duration{Duration: 24 * time.Hour}
+
+	// Entries are only deleted once an hour, the first one written isn't checked yet
+	now := time.Now()
+	writeJournal(journalEntry{Time: now.Add(-48 * time.Hour), Kind: "delivery", Rcpt: "old@domain.com"})
+	journalDB.Lock()
+	journalDB.pruned = time.Time{}
+	journalDB.Unlock()
+	writeJournal(journalEntry{Time: now, Kind: "delivery", Rcpt: "new@domain.com", Tags: []string{"invoice"}})
+	var rcpts []string
+	if err := readJournal(cfg.Journal, journalQuery{}, func(e journalEntry) { rcpts = append(rcpts, e.Rcpt) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(rcpts) != 1 || rcpts[0] != "new@domain.com" {
+		t.Errorf("Wrong entries kept: %v", rcpts)
+	}
+	if n := 0; readJournal(cfg.Journal, journalQuery{tag: "Invoice"}, func(journalEntry) { n++ }) != nil || n != 1 {
+		t.Errorf("Tagged entry not found")
+	}
+
+	// The journal is written ahead, so its entries survive a crash
+	db, err := openJournalDB(cfg.Journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("Journal mode is %q: %v", mode, err)
+	}
+}
+
+func TestImportJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		cfg = config.Config{}
+		closeJournalDB()
+	}()
+	jsonl := filepath.Join(dir, "journal.jsonl")
+	cfg.Journal = jsonl
+	writeJournal(journalEntry{Kind: "connect", IP: "192.168.1.5", Match: "192.168.1.0/24", Disposition: "accepted"})
+	writeJournal(journalEntry{Kind: "reject", IP: "192.168.1.5", From: "a@b.com", Code: "dnsbl", Reason: "listed"})
+	if err := ioutil.WriteFile(jsonl+".tmp", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Journal = filepath.Join(dir, "journal.db")
+	cfg.JournalFormat = "sqlite"
+	n, err := importJournal(jsonl, cfg.Journal)
+	if err != nil || n != 2 {
+		t.Fatalf("Imported %d entries: %v", n, err)
+	}
+	var entries []journalEntry
+	if err := readJournal(cfg.Journal, journalQuery{ip: "192.168.1.5"}, func(e journalEntry) { entries = append(entries, e) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Match != "192.168.1.0/24" || entries[1].Code != "dnsbl" || entries[1].From != "a@b.com" {
+		t.Errorf("Wrong imported entries: %#v", entries)
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/events"
+	"github.com/bcl/letterbox/smtpd"
+	"log"
+	"net"
+	"strings"
+)
+
+// listenerName returns the listener's address or socket, for errors and the log
+func listenerName(l config.Listener) string {
+	if l.Socket != "" {
+		return l.Socket
+	}
+	return l.Address
+}
+
+// mainAddress returns the address of the main listener, the Unix socket if -socket is set
+func mainAddress() string {
+	if cmdline.Socket != "" {
+		return cmdline.Socket
+	}
+	if len(cfg.Listen) > 0 {
+		return cfg.Listen[0]
+	}
+	return fmt.Sprintf("%s:%d", cmdline.Host, cmdline.Port)
+}
+
+// extraListeners returns the listeners to serve besides the main one
+func extraListeners() []config.Listener {
+	var listeners []config.Listener
+	for i, address := range cfg.Listen {
+		if i == 0 && cmdline.Socket == "" {
+			continue
+		}
+		listeners = append(listeners, config.Listener{Address: address})
+	}
+	return append(listeners, cfg.Listeners...)
+}
+
+// checkListeners checks that the listeners' requirements can be met
+func checkListeners(serverTLS *tls.Config) error {
+	for _, l := range cfg.Listeners {
+		if (l.Address == "") == (l.Socket == "") {
+			return fmt.Errorf("listener %s needs either an address or a socket", listenerName(l))
+		}
+		switch strings.ToLower(l.Protocol) {
+		case "", "smtp", "lmtp":
+		default:
+			return fmt.Errorf("listener %s has unknown protocol %q", listenerName(l), l.Protocol)
+		}
+		if l.MaxMessageSize < 0 {
+			return fmt.Errorf("listener %s has a negative max_message_size", listenerName(l))
+		}
+		if l.RequireTLS && serverTLS == nil {
+			return fmt.Errorf("listener %s requires TLS without a certificate", listenerName(l))
+		}
+		if l.RequireAuth && !authEnabled() && (serverTLS == nil || serverTLS.ClientCAs == nil) {
+			return fmt.Errorf("listener %s requires authentication without auth or client certificates", listenerName(l))
+		}
+	}
+	return nil
+}
+
+// serverHostname returns the hostname for the main listener
+func serverHostname() string {
+	if cfg.Hostname != "" {
+		return cfg.Hostname
+	}
+	return localHostname()
+}
+
+// newServer returns a server with letterbox's handlers that announces itself as hostname
+func newServer(hostname string, serverTLS *tls.Config) *smtpd.Server {
+	s := &smtpd.Server{
+		Hostname:        hostname,
+		OnNewConnection: onNewConnection,
+		OnNewMail:       onNewMail,
+		OnClose:         onClose,
+		TLSConfig:       serverTLS,
+		LMTP:            lmtpEnabled(),
+		MaxMessageSize:  cfg.MaxMessageSize,
+	}
+	if authEnabled() {
+		s.OnAuth = onAuth
+		s.OnAuthAttempt = onAuthAttempt
+		s.AllowInsecureAuth = cfg.Auth.AllowInsecureAuth
+	}
+	return s
+}
+
+// openListeners opens the extra listeners from the config
+// All of them are opened before any are served, so a bad address is reported
+// before letterbox starts accepting mail.
+func openListeners() ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, l := range extraListeners() {
+		network := "tcp"
+		if l.Socket != "" {
+			network = "unix"
+		} else if l.Address == "" {
+			return nil, fmt.Errorf("listener is missing an address")
+		}
+		ln, err := openListener(network, listenerName(l))
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// serveListeners starts serving on the extra listeners opened by openListeners
+func serveListeners(listeners []net.Listener, serverTLS *tls.Config) {
+	for _, ln := range listeners {
+		addListener(ln)
+	}
+	configs := extraListeners()
+	for i, ln := range listeners {
+		s := newListenerServer(configs[i], serverTLS)
+		log.Printf("letterbox: %s as %s", ln.Addr(), s.Hostname)
+		countCommands(s, ln.Addr().String())
+		go func(s *smtpd.Server, ln net.Listener) {
+			if err := s.Serve(listenProxy(ln)); err != nil && !shuttingDown() {
+				log.Printf("Serve %s: %v", ln.Addr(), err)
+			}
+		}(s, ln)
+	}
+}
+
+// newListenerServer returns the server for an extra listener, refusing mail that doesn't meet its requirements
+func newListenerServer(l config.Listener, serverTLS *tls.Config) *smtpd.Server {
+	hostname := l.Hostname
+	if hostname == "" {
+		hostname = serverHostname()
+	}
+	s := newServer(hostname, serverTLS)
+	if l.Protocol != "" {
+		s.LMTP = strings.EqualFold(l.Protocol, "lmtp")
+	}
+	if l.MaxMessageSize > 0 {
+		s.MaxMessageSize = l.MaxMessageSize
+	}
+	if l.RequireTLS || l.RequireAuth {
+		s.OnNewMail = func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+			if err := listenerRefused(l, c, from.Email()); err != nil {
+				return nil, err
+			}
+			return onNewMail(c, from)
+		}
+	}
+	return s
+}
+
+// listenerRefused returns an error if the client hasn't used STARTTLS or authenticated, when the listener requires it
+// A client certificate counts as authenticating.
+func listenerRefused(l config.Listener, c smtpd.Connection, from string) error {
+	conn := newConnInfo(c)
+	var clientIP net.IP
+	if client, _, err := net.SplitHostPort(c.Addr().String()); err == nil {
+		clientIP = access.ParseIP(client)
+	}
+	if l.RequireTLS && c.TLS() == nil {
+		reject(clientIP, conn, from, "", events.ReasonTLSRequired, "STARTTLS required")
+		return smtpd.SMTPError("530 5.7.0 Must issue a STARTTLS command first")
+	}
+	if l.RequireAuth && c.AuthUser() == "" && conn.identity == "" {
+		reject(clientIP, conn, from, "", events.ReasonAuthRequired, "Authentication required")
+		return smtpd.SMTPError("530 5.7.0 Authentication required")
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"crypto/tls"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenerHostname(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.other.org", nil).Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	banner := make([]byte, 512)
+	n, _ := conn.Read(banner)
+	conn.Close()
+	if !strings.HasPrefix(string(banner[:n]), "220 mx.other.org ") {
+		t.Errorf("Wrong banner: %q", banner[:n])
+	}
+
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com"}, []byte("Subject: test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new"))
+	if len(files) != 1 {
+		t.Fatal("Message not delivered")
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "bcl", "new", files[0].Name()))
+	if !strings.Contains(string(data), "\tby mx.other.org (letterbox) with ESMTP;") {
+		t.Errorf("Received header doesn't use the listener's hostname: %q", data)
+	}
+}
+
+func TestOpenListeners(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+
+	cfg.Listeners = []config.Listener{{Hostname: "mx.other.org"}}
+	if _, err := openListeners(); err == nil {
+		t.Error("Listener without an address accepted")
+	}
+
+	// The port is already in use
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cfg.Listeners = []config.Listener{{Address: ln.Addr().String()}}
+	if _, err := openListeners(); err == nil {
+		t.Error("Listener on a port that is in use accepted")
+	}
+}
+
+func TestListenAddresses(t *testing.T) {
+	socket := cmdline.Socket
+	defer func() {
+		cfg = config.Config{}
+		cmdline.Socket = socket
+	}()
+	cmdline.Socket = ""
+	cfg.Listen = []string{"127.0.0.1:25", "[::1]:2525"}
+	cfg.Listeners = []config.Listener{{Address: "192.168.1.2:25", Hostname: "mx.other.org"}}
+	if mainAddress() != "127.0.0.1:25" {
+		t.Errorf("Main address is %s", mainAddress())
+	}
+	listeners := extraListeners()
+	if len(listeners) != 2 || listeners[0].Address != "[::1]:2525" || listeners[1].Hostname != "mx.other.org" {
+		t.Errorf("Extra listeners are %v", listeners)
+	}
+
+	// With a socket every listen address is an extra listener
+	cmdline.Socket = "/run/letterbox.sock"
+	if mainAddress() != "/run/letterbox.sock" || len(extraListeners()) != 3 {
+		t.Errorf("Main address is %s, extra listeners are %v", mainAddress(), extraListeners())
+	}
+}
+
+func TestListenerRequirements(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+		certs = nil
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	parseHosts()
+
+	if err := checkListeners(nil); err != nil {
+		t.Errorf("Listeners without requirements refused: %s", err)
+	}
+	cfg.Listeners = []config.Listener{{Address: "127.0.0.1:2525", RequireTLS: true}}
+	if err := checkListeners(nil); err == nil {
+		t.Error("require_tls accepted without a certificate")
+	}
+	cfg.Listeners = []config.Listener{{Address: "127.0.0.1:2525", RequireAuth: true}}
+	if err := checkListeners(nil); err == nil {
+		t.Error("require_auth accepted without auth")
+	}
+
+	cfg.TLS.Cert, cfg.TLS.Key = writeTestCert(t, dir, "localhost")
+	serverTLS, err := setupTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listeners = []config.Listener{{Address: "127.0.0.1:2525", RequireTLS: true}}
+	if err := checkListeners(serverTLS); err != nil {
+		t.Errorf("require_tls refused with a certificate: %s", err)
+	}
+
+	serve := func(l config.Listener) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go newListenerServer(l, serverTLS).Serve(ln)
+		return ln.Addr().String()
+	}
+	send := func(addr string, startTLS bool) error {
+		client, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if startTLS {
+			if err := client.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+				t.Fatalf("STARTTLS failed: %s", err)
+			}
+		}
+		return client.Mail("sender@domain.com")
+	}
+
+	tlsAddr := serve(config.Listener{RequireTLS: true})
+	err = send(tlsAddr, false)
+	if err == nil || !strings.HasPrefix(err.Error(), "530") || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("Mail without STARTTLS not refused: %v", err)
+	}
+	if err := send(tlsAddr, true); err != nil {
+		t.Errorf("Mail with STARTTLS refused: %s", err)
+	}
+
+	// Allowed hosts still have to authenticate
+	authAddr := serve(config.Listener{RequireAuth: true})
+	err = send(authAddr, true)
+	if err == nil || !strings.HasPrefix(err.Error(), "530") || !strings.Contains(err.Error(), "Authentication required") {
+		t.Errorf("Mail without AUTH not refused: %v", err)
+	}
+}
+
+func TestListenerRoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	parseHosts()
+
+	for _, l := range []config.Listener{{}, {Address: "127.0.0.1:25", Socket: "/run/lmtp.sock"}, {Address: "127.0.0.1:25", Protocol: "qmqp"}, {Address: "127.0.0.1:25", MaxMessageSize: -1}} {
+		cfg.Listeners = []config.Listener{l}
+		if err := checkListeners(nil); err == nil {
+			t.Errorf("Bad listener %#v accepted", l)
+		}
+	}
+
+	// An SMTP MX and an LMTP socket for the mail store, with a smaller size limit
+	socket := filepath.Join(dir, "lmtp.sock")
+	cfg.Listeners = []config.Listener{
+		{Address: "127.0.0.1:0"},
+		{Socket: socket, Protocol: "lmtp", MaxMessageSize: 100},
+	}
+	if err := checkListeners(nil); err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := openListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+	serveListeners(listeners, nil)
+
+	if err := smtp.SendMail(listeners[0].Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com"}, []byte("Subject: smtp\r\n\r\nHi\r\n")); err != nil {
+		t.Errorf("Mail over SMTP refused: %s", err)
+	}
+
+	conn, err := textproto.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expect := func(code int) {
+		t.Helper()
+		if _, _, err := conn.ReadResponse(code); err != nil {
+			t.Fatalf("Expected %d: %s", code, err)
+		}
+	}
+	expect(220)
+	conn.PrintfLine("LHLO localhost")
+	expect(250)
+	conn.PrintfLine("MAIL FROM:<sender@domain.com> SIZE=1000")
+	expect(552)
+	conn.PrintfLine("MAIL FROM:<sender@domain.com>")
+	expect(250)
+	conn.PrintfLine("RCPT TO:<bcl@domain.com>")
+	expect(250)
+	conn.PrintfLine("DATA")
+	expect(354)
+	conn.PrintfLine("Subject: lmtp\r\n\r\nHi\r\n.")
+	expect(250)
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "bcl", "new"))
+	if err != nil || len(files) != 2 {
+		t.Errorf("Wrong number of messages delivered: %d %v", len(files), err)
+	}
+}
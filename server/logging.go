@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFormat returns the format of the log, text or json
+/*
+   Example TOML:
+
+   log_format = "json"
+
+   "text" is the default. With "json" each line is an object with a time and
+   either a msg, or an event with the connection and queue IDs and its details.
+*/
+func logFormat() string {
+	if cfg.LogFormat == "" {
+		return "text"
+	}
+	return strings.ToLower(cfg.LogFormat)
+}
+
+// checkLogFormat checks the log_format setting
+func checkLogFormat() error {
+	switch logFormat() {
+	case "text", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown log_format setting: %s", cfg.LogFormat)
+}
+
+// newLogID returns a random ID for a message, like the ones smtpd gives connections
+func newLogID() string {
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		// Unique enough to find the message in the log
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// jsonLogWriter writes log lines as JSON objects
+// Lines from the log package become {"time": ..., "msg": ...}, events are
+// written with their fields by logEvent.
+type jsonLogWriter struct {
+	sync.Mutex
+	out io.Writer
+}
+
+// jsonLog is the writer the log package uses when log_format is json, nil for text
+var jsonLog *jsonLogWriter
+
+// Write is called by the log package with each line
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	if err := w.write("msg", strings.TrimSuffix(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// write writes an object with the time and the key/value pairs, in order
+func (w *jsonLogWriter) write(kv ...string) error {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	t, _ := json.Marshal(time.Now().Format(time.RFC3339Nano))
+	buf.Write(t)
+	for i := 0; i+1 < len(kv); i += 2 {
+		k, _ := json.Marshal(kv[i])
+		v, _ := json.Marshal(kv[i+1])
+		buf.WriteByte(',')
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteString("}\n")
+	w.Lock()
+	defer w.Unlock()
+	_, err := w.out.Write(buf.Bytes())
+	return err
+}
+
+// logFileWriter writes to the -log file, and can reopen it after it has been rotated
+type logFileWriter struct {
+	sync.Mutex
+	path string
+	f    *os.File
+}
+
+// logFile is the -log file, nil when logging to stderr
+var logFile *logFileWriter
+
+// openLogFile opens the log file for appending, creating it if needed
+func openLogFile(path string) (*logFileWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &logFileWriter{path: path, f: f}, nil
+}
+
+// Write writes a line to the current log file
+func (w *logFileWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	return w.f.Write(p)
+}
+
+// Close closes the log file
+func (w *logFileWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.f.Close()
+}
+
+// reopen opens the log file's path again and switches to it
+// logrotate renames the file and sends SIGUSR1, so later lines go to a new
+// file at the same path. If it can't be opened the old file is kept.
+func (w *logFileWriter) reopen() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	w.Lock()
+	old := w.f
+	w.f = f
+	w.Unlock()
+	return old.Close()
+}
+
+// reopenLogFile reopens the -log file, after it has been rotated
+func reopenLogFile() {
+	if logFile == nil {
+		return
+	}
+	if err := logFile.reopen(); err != nil {
+		log.Printf("Error reopening log file %s: %s", logFile.path, err)
+		return
+	}
+	log.Printf("letterbox: reopened log file %s", logFile.path)
+}
+
+// setupLogging sends the log to out, as JSON if log_format is json
+func setupLogging(out io.Writer) {
+	if logFormat() != "json" {
+		jsonLog = nil
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(out)
+		return
+	}
+	jsonLog = &jsonLogWriter{out: out}
+	log.SetFlags(0)
+	log.SetOutput(jsonLog)
+}
+
+// logEvent logs an event in a connection or a message's life with its details
+// kv are key/value pairs, with the text of the line in msg if there is one.
+// Empty values are left out, and the connection and queue IDs are added so
+// that every line for a message can be found by its queue ID. Text logs get
+// "event conn=ID queue_id=ID key=value ...: msg".
+func logEvent(conn connInfo, event string, kv ...string) {
+	fields := []string{"event", event, "conn", conn.id, "queue_id", conn.queueID}
+	fields = append(fields, kv...)
+	var kept []string
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i+1] != "" {
+			kept = append(kept, fields[i], fields[i+1])
+		}
+	}
+	if jsonLog != nil {
+		jsonLog.write(kept...)
+		return
+	}
+	var line []string
+	var msg string
+	for i := 0; i+1 < len(kept); i += 2 {
+		k, v := kept[i], kept[i+1]
+		switch {
+		case k == "event":
+			line = append(line, v)
+		case k == "msg":
+			msg = v
+		case strings.ContainsAny(v, " \"="):
+			line = append(line, k+"="+strconv.Quote(v))
+		default:
+			line = append(line, k+"="+v)
+		}
+	}
+	if msg != "" && len(line) > 0 {
+		line[len(line)-1] += ":"
+	}
+	if msg != "" {
+		line = append(line, msg)
+	}
+	log.Print(strings.Join(line, " "))
+}
+
+// logf logs a message about the connection, with its IDs
+func (conn connInfo) logf(format string, v ...interface{}) {
+	logEvent(conn, "", "msg", fmt.Sprintf(format, v...))
+}
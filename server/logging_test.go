@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogEventText(t *testing.T) {
+	defer func() { log.SetOutput(os.Stderr); log.SetFlags(log.LstdFlags) }()
+	var buf bytes.Buffer
+	setupLogging(&buf)
+	log.SetFlags(0)
+
+	conn := connInfo{id: "c0ffee", queueID: "abc123"}
+	logEvent(conn, "rcpt", "rcpt", "<bcl@domain.com>", "user", "")
+	reject(net.ParseIP("192.168.1.5"), conn, "a@b.com", "x@domain.com", "rcpt-not-allowed", "Recipient not in whitelist")
+	connInfo{queueID: "abc123"}.logf("Error writing to %s", "bcl")
+	expected := "rcpt conn=c0ffee queue_id=abc123 rcpt=<bcl@domain.com>\n" +
+		"reject conn=c0ffee queue_id=abc123 code=rcpt-not-allowed ip=192.168.1.5 from=<a@b.com> rcpt=<x@domain.com>: Recipient not in whitelist\n" +
+		"queue_id=abc123: Error writing to bcl\n"
+	if buf.String() != expected {
+		t.Errorf("Text log is %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestLogEventJSON(t *testing.T) {
+	defer func() {
+		cfg = config.Config{}
+		setupLogging(os.Stderr)
+	}()
+	cfg.LogFormat = "json"
+	var buf bytes.Buffer
+	setupLogging(&buf)
+
+	logEvent(connInfo{id: "c0ffee", queueID: "abc123"}, "delivered", "rcpt", "<bcl@domain.com>", "path", "/var/spool/maildirs/bcl/new/1")
+	log.Printf("Plain \"line\"")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines: %q", buf.String())
+	}
+	var event, plain map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &plain); err != nil {
+		t.Fatal(err)
+	}
+	if event["event"] != "delivered" || event["conn"] != "c0ffee" || event["queue_id"] != "abc123" || event["path"] != "/var/spool/maildirs/bcl/new/1" {
+		t.Errorf("Wrong event: %v", event)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, event["time"]); err != nil {
+		t.Errorf("Bad time: %s", err)
+	}
+	if plain["msg"] != "Plain \"line\"" || plain["time"] == "" {
+		t.Errorf("Wrong plain line: %v", plain)
+	}
+
+	cfg.LogFormat = "xml"
+	if err := checkLogFormat(); err == nil {
+		t.Error("Unknown log_format accepted")
+	}
+}
+
+func TestLogMessageIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+		setupLogging(os.Stderr)
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	cfg.LogFormat = "json"
+	parseHosts()
+	var buf bytes.Buffer
+	setupLogging(&buf)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com"}, []byte("Subject: test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every event for the connection has its ID, and the ones for the message its queue ID
+	var conn, queueID string
+	seen := make(map[string]bool)
+	for i := 0; i < 50 && !seen["close"]; i++ {
+		time.Sleep(10 * time.Millisecond)
+		jsonLog.Lock()
+		out := buf.String()
+		jsonLog.Unlock()
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			var ev map[string]string
+			if err := json.Unmarshal([]byte(line), &ev); err != nil {
+				t.Fatalf("Bad log line %q: %s", line, err)
+			}
+			if ev["event"] == "connect" && conn == "" {
+				conn = ev["conn"]
+			}
+			if ev["conn"] != conn || ev["event"] == "" {
+				continue
+			}
+			if ev["event"] == "mail" {
+				queueID = ev["queue_id"]
+			}
+			if ev["event"] != "connect" && ev["event"] != "close" && (queueID == "" || ev["queue_id"] != queueID) {
+				t.Errorf("Event without the queue ID %q: %q", queueID, line)
+			}
+			seen[ev["event"]] = true
+		}
+	}
+	for _, event := range []string{"connect", "mail", "rcpt", "delivered", "close"} {
+		if !seen[event] {
+			t.Errorf("No %s event in %q", event, buf.String())
+		}
+	}
+}
+
+func TestReopenLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { logFile = nil }()
+	path := filepath.Join(dir, "letterbox.log")
+	w, err := openLogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	logFile = w
+
+	w.Write([]byte("before\n"))
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("still old\n"))
+	reopenLogFile()
+	w.Write([]byte("after\n"))
+
+	if data, _ := ioutil.ReadFile(path + ".1"); string(data) != "before\nstill old\n" {
+		t.Errorf("Rotated file has %q", data)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "after\n" {
+		t.Errorf("New file has %q", data)
+	}
+
+	// The old file is kept if the path can't be opened
+	os.Remove(path)
+	os.Mkdir(path, 0700)
+	if err := w.reopen(); err == nil {
+		t.Error("Reopened a directory")
+	}
+	if _, err := w.Write([]byte("kept\n")); err != nil {
+		t.Errorf("Old file closed after a failed reopen: %s", err)
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bcl/letterbox/smtpd"
+	lua "github.com/yuin/gopher-lua"
+	"net"
+	"strings"
+	"sync"
+)
+
+// luaScript runs the hook functions from the operator's Lua script
+// A Lua state can only be used by one goroutine at a time so calls are serialized.
+type luaScript struct {
+	sync.Mutex
+	state *lua.LState
+}
+
+var script *luaScript
+
+// loadLuaScript runs the script so that it can define its hook functions
+func loadLuaScript(path string) (*luaScript, error) {
+	L := lua.NewState()
+	if err := L.DoFile(path); err != nil {
+		L.Close()
+		return nil, err
+	}
+	return &luaScript{state: L}, nil
+}
+
+// setupLua loads the script from the config, if there is one
+func setupLua() error {
+	if cfg.Lua.Script == "" {
+		return nil
+	}
+	s, err := loadLuaScript(cfg.Lua.Script)
+	if err != nil {
+		return err
+	}
+	script = s
+	return nil
+}
+
+// luaStrings converts a slice of strings to a Lua array
+func (s *luaScript) luaStrings(values []string) *lua.LTable {
+	t := s.state.NewTable()
+	for _, v := range values {
+		t.Append(lua.LString(v))
+	}
+	return t
+}
+
+// envTable returns the Lua table describing the envelope that is passed to the hooks
+/*
+   The table has these fields:
+
+   client_ip   IP of the connected client
+   helo        hostname the client sent with HELO, EHLO, or LHLO
+   tls_version TLS version like "1.3", only set if the client used STARTTLS
+   tls_cipher  TLS cipher suite name, only set if the client used STARTTLS
+   auth_user   username the client authenticated as, only set after AUTH
+   origin_ip   IP of the first untrusted host in the Received chain, or "unknown" if a
+               trusted relay didn't record it, only set for data
+   from        envelope sender
+   rcpt        recipient being checked, only set for rcpt
+   recipients  array of the accepted recipients
+   headers     table of lowercase header names to an array of their values, only set for data
+*/
+func (s *luaScript) envTable(e *env, rcpt string, headers map[string][]string) *lua.LTable {
+	t := s.state.NewTable()
+	ipString := func(ip net.IP) lua.LValue {
+		if ip == nil {
+			return lua.LNil
+		}
+		return lua.LString(ip.String())
+	}
+	t.RawSetString("client_ip", ipString(e.clientIP))
+	if headers != nil && e.originIP == nil {
+		t.RawSetString("origin_ip", lua.LString("unknown"))
+	} else {
+		t.RawSetString("origin_ip", ipString(e.originIP))
+	}
+	t.RawSetString("helo", lua.LString(e.conn.helo))
+	optString := func(name, value string) {
+		if value != "" {
+			t.RawSetString(name, lua.LString(value))
+		}
+	}
+	optString("tls_version", e.conn.tlsVersion)
+	optString("tls_cipher", e.conn.tlsCipher)
+	optString("auth_user", e.conn.authUser)
+	t.RawSetString("from", lua.LString(e.from))
+	if rcpt != "" {
+		t.RawSetString("rcpt", lua.LString(rcpt))
+	}
+	var rcpts []string
+	for _, r := range e.rcpts {
+		rcpts = append(rcpts, r.Email())
+	}
+	t.RawSetString("recipients", s.luaStrings(rcpts))
+	if headers != nil {
+		h := s.state.NewTable()
+		for name, values := range headers {
+			h.RawSetString(strings.ToLower(name), s.luaStrings(values))
+		}
+		t.RawSetString("headers", h)
+	}
+	return t
+}
+
+// call runs the named hook with the envelope table
+// The hook returns an action, "accept", "reject", "tempfail", or "tag", and an
+// optional message. "tag" accepts and adds the message as a policy tag. A
+// missing hook, or a hook that returns nothing, accepts.
+func (s *luaScript) call(hook string, e *env, rcpt string, headers map[string][]string) error {
+	s.Lock()
+	defer s.Unlock()
+	L := s.state
+	fn := L.GetGlobal(hook)
+	if fn.Type() != lua.LTFunction {
+		return nil
+	}
+	err := L.CallByParam(lua.P{Fn: fn, NRet: 2, Protect: true}, s.envTable(e, rcpt, headers))
+	if err != nil {
+		// A broken script shouldn't lose mail, let the sender try again
+		return smtpd.SMTPError(fmt.Sprintf("451 4.3.0 Error running %s hook: %s", hook, err))
+	}
+	action, message := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+
+	msg := ""
+	if message != lua.LNil {
+		msg = " " + message.String()
+	}
+	switch action.String() {
+	case "reject":
+		return smtpd.SMTPError("550 5.7.1" + msg)
+	case "tempfail":
+		return smtpd.SMTPError("451 4.7.1" + msg)
+	case "tag":
+		if message != lua.LNil {
+			e.addTag(message.String())
+		}
+	}
+	return nil
+}
+
+// luaRcpt runs the script's rcpt hook, if there is a script
+func luaRcpt(e *env, rcpt string) error {
+	if script == nil {
+		return nil
+	}
+	return script.call("rcpt", e, rcpt, nil)
+}
+
+// luaData runs the script's data hook at the end of DATA, if there is a script
+func luaData(e *env, headers map[string][]string) error {
+	if script == nil {
+		return nil
+	}
+	return script.call("data", e, "", headers)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/smtpd"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testScript = `
+function rcpt(env)
+  if env.rcpt == "blocked@domain.com" then
+    return "reject", "no mail for you"
+  end
+  if env.client_ip == "10.0.0.1" then
+    return "tempfail"
+  end
+  if env.auth_user == "printer" and env.tls_version == nil then
+    return "reject", "printer must use TLS from " .. env.helo
+  end
+end
+
+function data(env)
+  local subject = env.headers["subject"]
+  if subject and string.find(subject[1], "SPAM") then
+    return "reject", "looks like spam from " .. env.from
+  end
+  if subject and string.find(subject[1], "invoice") then
+    return "tag", "Invoice"
+  end
+end
+`
+
+func TestLuaHooks(t *testing.T) {
+	f, err := ioutil.TempFile("", "letterbox-*.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(testScript)
+	f.Close()
+
+	s, err := loadLuaScript(f.Name())
+	if err != nil {
+		t.Fatalf("Error loading script: %s", err)
+	}
+	script = s
+	defer func() { script = nil }()
+
+	e := &env{from: "sender@domain.com", clientIP: net.ParseIP("192.168.1.1")}
+	if err := luaRcpt(e, "user@domain.com"); err != nil {
+		t.Errorf("Recipient rejected: %s", err)
+	}
+	err = luaRcpt(e, "blocked@domain.com")
+	if se, ok := err.(smtpd.SMTPError); !ok || !strings.HasPrefix(string(se), "550 ") || !strings.Contains(string(se), "no mail for you") {
+		t.Errorf("Recipient not rejected: %v", err)
+	}
+	e.clientIP = net.ParseIP("10.0.0.1")
+	if se, ok := luaRcpt(e, "user@domain.com").(smtpd.SMTPError); !ok || !strings.HasPrefix(string(se), "451 ") {
+		t.Errorf("Recipient not temporarily failed: %v", se)
+	}
+
+	e.clientIP = net.ParseIP("192.168.1.1")
+	e.conn = connInfo{helo: "printer.lan", authUser: "printer"}
+	err = luaRcpt(e, "user@domain.com")
+	if err == nil || !strings.Contains(err.Error(), "printer must use TLS from printer.lan") {
+		t.Errorf("Recipient without TLS not rejected: %v", err)
+	}
+	e.conn.tlsVersion = "1.3"
+	if err := luaRcpt(e, "user@domain.com"); err != nil {
+		t.Errorf("Recipient with TLS rejected: %s", err)
+	}
+
+	headers := mail.Header{"Subject": {"Buy SPAM now"}}
+	err = luaData(e, headers)
+	if err == nil || !strings.Contains(err.Error(), "looks like spam from sender@domain.com") {
+		t.Errorf("Message not rejected: %v", err)
+	}
+	if err := luaData(e, mail.Header{"Subject": {"Hello"}}); err != nil {
+		t.Errorf("Message rejected: %s", err)
+	}
+	if err := luaData(e, mail.Header{"Subject": {"Your invoice"}}); err != nil || len(e.tags) != 1 || e.tags[0] != "invoice" {
+		t.Errorf("Message not tagged: %v %v", e.tags, err)
+	}
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bcl/letterbox/smtpd"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// errBadMailbox is the reply for recipients whose name can't be used for their maildir
+var errBadMailbox = smtpd.SMTPError("550 5.1.3 Error: bad recipient mailbox name")
+
+// maildirPathData is what a maildir_path template can use
+type maildirPathData struct {
+	User   string // the user, after aliases
+	Domain string // the domain of the user's address in the emails list
+	Home   string // the home directory of the system user with the same name
+}
+
+// safePathComponent makes s safe to use as one component of a path
+// Slashes and NUL are replaced, and names that would move up or stay in the
+// same directory are replaced with _.
+func safePathComponent(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == 0 {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" || s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+// validMailboxName returns true if the user's maildir can be named after it
+// Names that are . or .., that start with a dot like maildir folders and
+// snapshot directories, or that have a path separator would put the mail
+// somewhere other than the user's own maildir.
+func validMailboxName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// badMailbox returns true if the name of a user the address is delivered to can't be used for a maildir
+// Plus address folders are already limited by folderRE.
+func badMailbox(emails []string, address string) bool {
+	for _, name := range recipientUsers(emails, address) {
+		if !validMailboxName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// userDomain returns the domain of the user's address in the emails list
+// Exact addresses are used first, then patterns like *@domain.com that match
+// the user. It is localhost if neither is found.
+func userDomain(name string) string {
+	emails := currentEmails()
+	for _, entry := range emails {
+		if !isPattern(entry) && strings.EqualFold(localPart(entry), name) && strings.Contains(entry, "@") {
+			return strings.ToLower(entry[strings.LastIndex(entry, "@")+1:])
+		}
+	}
+	for _, entry := range emails {
+		i := strings.LastIndex(entry, "@")
+		if i == -1 || isPattern(entry[i+1:]) {
+			continue
+		}
+		if matchPatterns([]string{entry}, name+entry[i:]) {
+			return strings.ToLower(entry[i+1:])
+		}
+	}
+	return "localhost"
+}
+
+// maildirPath returns the path of the user's maildir
+/*
+   Example TOML:
+
+   maildir_path = "{{.Domain}}/{{.User}}/Maildir"
+
+   The template can use .User, .Domain, and .Home, the home directory of the
+   system user with the same name, so "{{.Home}}/Maildir" delivers to the
+   users' home directories. Relative paths are under -maildirs. .User and
+   .Domain are escaped so they are always one component of the path. Without
+   it the maildir is <maildirs>/<user>.
+*/
+func maildirPath(name string) (string, error) {
+	if cfg.MaildirPath == "" {
+		return path.Join(cmdline.Maildirs, name), nil
+	}
+	data := maildirPathData{User: safePathComponent(name), Domain: safePathComponent(userDomain(name))}
+	if strings.Contains(cfg.MaildirPath, ".Home") {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		data.Home = u.HomeDir
+	}
+	return expandMaildirPath(data)
+}
+
+// expandMaildirPath returns the maildir_path template filled in with data
+func expandMaildirPath(data maildirPathData) (string, error) {
+	tmpl, err := template.New("maildir_path").Option("missingkey=error").Parse(cfg.MaildirPath)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	dir := buf.String()
+	if !path.IsAbs(dir) {
+		dir = path.Join(cmdline.Maildirs, dir)
+	}
+	return path.Clean(dir), nil
+}
+
+// checkMaildirPath checks the maildir_path template
+// Each user needs their own maildir, so it has to use .User or .Home.
+func checkMaildirPath() error {
+	if cfg.MaildirPath == "" {
+		return nil
+	}
+	tmpl, err := template.New("maildir_path").Parse(cfg.MaildirPath)
+	if err != nil {
+		return fmt.Errorf("bad maildir_path: %s", err)
+	}
+	if !strings.Contains(cfg.MaildirPath, ".User") && !strings.Contains(cfg.MaildirPath, ".Home") {
+		return fmt.Errorf("maildir_path must use .User or .Home")
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, maildirPathData{User: "user", Domain: "domain.com", Home: "/home/user"}); err != nil {
+		return fmt.Errorf("bad maildir_path: %s", err)
+	}
+	return nil
+}
+
+// knownUsers returns the users with an address in the emails list, after aliases
+// Users only matched by patterns, like *@domain.com, aren't known until mail
+// arrives for them.
+func knownUsers() []string {
+	var users []string
+	seen := make(map[string]bool)
+	for _, entry := range currentEmails() {
+		if isPattern(entry) || !validMailboxName(localPart(entry)) {
+			continue
+		}
+		for _, name := range resolveAlias(localPart(entry)) {
+			if !seen[name] && validMailboxName(name) {
+				seen[name] = true
+				users = append(users, name)
+			}
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// maildirRoots returns the directories that hold the users' maildirs, for commands that look at all of them
+// They are -maildirs, and the maildirs of the known users that maildir_path
+// puts somewhere else, like their home directories.
+func maildirRoots() ([]string, error) {
+	dirs, err := patternMaildirs()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range knownUsers() {
+		dir, err := maildirPath(name)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, dir)
+	}
+	roots := []string{cmdline.Maildirs}
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		if !seen[dir] && !underDir(cmdline.Maildirs, dir) {
+			seen[dir] = true
+			roots = append(roots, dir)
+		}
+	}
+	return roots, nil
+}
+
+// patternMaildirs returns the maildirs that maildir_path could have made for any user
+// A template using .Home can't be matched, the users are only known from the
+// emails list.
+func patternMaildirs() ([]string, error) {
+	if cfg.MaildirPath == "" || strings.Contains(cfg.MaildirPath, ".Home") {
+		return nil, nil
+	}
+	pattern, err := expandMaildirPath(maildirPathData{User: "*", Domain: "*"})
+	if err != nil {
+		return nil, err
+	}
+	return filepath.Glob(pattern)
+}
+
+// maildirPathRE returns a regexp for the maildirs from maildir_path, with the user as its first group
+func maildirPathRE() (*regexp.Regexp, error) {
+	pattern, err := expandMaildirPath(maildirPathData{User: "\x00u", Domain: "\x00d"})
+	if err != nil {
+		return nil, err
+	}
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, regexp.QuoteMeta("\x00u"), "([^/]+)", 1)
+	re = strings.Replace(re, regexp.QuoteMeta("\x00u"), "[^/]+", -1)
+	re = strings.Replace(re, regexp.QuoteMeta("\x00d"), "[^/]+", -1)
+	return regexp.Compile("^" + re + "/")
+}
+
+// underDir returns true if p is dir or inside it
+func underDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// maildirUser returns the user whose maildir has the message at p, and the folder it is in
+// The known users' maildirs are checked first, and then p is matched against
+// maildir_path, or taken to be in <maildirs>/<user> without it.
+func maildirUser(p string) (string, string) {
+	folder := func(rel string) string {
+		parts := strings.Split(rel, string(filepath.Separator))
+		if len(parts) > 2 && strings.HasPrefix(parts[0], ".") {
+			return parts[0][1:]
+		}
+		return ""
+	}
+	for _, name := range knownUsers() {
+		if dir, err := maildirPath(name); err == nil && underDir(dir, p) {
+			rel, _ := filepath.Rel(dir, p)
+			return name, folder(rel)
+		}
+	}
+	if cfg.MaildirPath != "" && !strings.Contains(cfg.MaildirPath, ".Home") {
+		if re, err := maildirPathRE(); err == nil {
+			if m := re.FindStringSubmatch(p); m != nil {
+				return m[1], folder(p[len(m[0]):])
+			}
+		}
+		return "", ""
+	}
+	rel, err := filepath.Rel(cmdline.Maildirs, p)
+	if err != nil || !underDir(cmdline.Maildirs, p) {
+		return "", ""
+	}
+	parts := strings.SplitN(rel, string(filepath.Separator), 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], folder(parts[1])
+}
+
+// userRoots returns the user's maildir, or the directories with all of the users' maildirs if user is ""
+func userRoots(user string) ([]string, error) {
+	if user == "" {
+		return maildirRoots()
+	}
+	dir, err := maildirPath(filepath.Base(filepath.Clean(user)))
+	if err != nil {
+		return nil, err
+	}
+	return []string{dir}, nil
+}
+
+// walkRoots calls fn with the path of every message in the maildirs under the roots
+// Roots that don't exist, like the maildir of a user without mail, are skipped.
+func walkRoots(roots []string, fn func(path string) error) error {
+	for _, root := range roots {
+		if err := walkMessages(root, fn); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
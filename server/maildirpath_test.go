@@ -0,0 +1,269 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSafePathComponent(t *testing.T) {
+	tests := map[string]string{
+		"bcl":        "bcl",
+		"domain.com": "domain.com",
+		"../etc":     ".._etc",
+		"a/b":        "a_b",
+		"..":         "_",
+		".":          "_",
+		"":           "_",
+	}
+	for s, expected := range tests {
+		if got := safePathComponent(s); got != expected {
+			t.Errorf("safePathComponent(%q) = %q, expected %q", s, got, expected)
+		}
+	}
+}
+
+func TestMaildirPath(t *testing.T) {
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+	}()
+	cmdline.Maildirs = "/var/spool/maildirs"
+	cfg.Emails = []string{"bcl@Domain.com", "camera-*@devices.lan"}
+
+	tests := []struct {
+		template string
+		user     string
+		path     string
+	}{
+		{"", "bcl", "/var/spool/maildirs/bcl"},
+		{"{{.Domain}}/{{.User}}/Maildir", "bcl", "/var/spool/maildirs/domain.com/bcl/Maildir"},
+		{"{{.Domain}}/{{.User}}", "camera-1", "/var/spool/maildirs/devices.lan/camera-1"},
+		{"{{.Domain}}/{{.User}}", "nobody", "/var/spool/maildirs/localhost/nobody"},
+		{"/srv/mail/{{.User}}", "..", "/srv/mail/_"},
+	}
+	for _, tt := range tests {
+		cfg.MaildirPath = tt.template
+		if err := checkMaildirPath(); err != nil {
+			t.Errorf("checkMaildirPath(%q) failed: %s", tt.template, err)
+		}
+		if got, err := maildirPath(tt.user); err != nil || got != tt.path {
+			t.Errorf("maildirPath(%q) with %q = %q, %v, expected %q", tt.user, tt.template, got, err, tt.path)
+		}
+	}
+
+	if u, err := user.Current(); err == nil {
+		cfg.MaildirPath = "{{.Home}}/Maildir"
+		if got, err := maildirPath(u.Username); err != nil || got != filepath.Join(u.HomeDir, "Maildir") {
+			t.Errorf("maildirPath with .Home = %q, %v", got, err)
+		}
+	}
+
+	for _, bad := range []string{"{{.Domain}}", "{{.User", "{{.Nobody}}/{{.User}}"} {
+		cfg.MaildirPath = bad
+		if err := checkMaildirPath(); err == nil {
+			t.Errorf("Bad maildir_path %q accepted", bad)
+		}
+	}
+}
+
+func TestMaildirPathDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	cfg.MaildirPath = "{{.Domain}}/{{.User}}/Maildir"
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	for _, rcpt := range []string{"bcl@domain.com", "bcl+lists@domain.com"} {
+		if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{rcpt}, []byte("Subject: hi\r\n\r\nHello\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []string{"Maildir/new", "Maildir/.lists/new"} {
+		if files, _ := ioutil.ReadDir(filepath.Join(dir, "domain.com", "bcl", d)); len(files) != 1 {
+			t.Errorf("%d messages in %s, expected 1", len(files), d)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bcl")); !os.IsNotExist(err) {
+		t.Errorf("Default maildir was created: %v", err)
+	}
+}
+
+func TestValidMailboxName(t *testing.T) {
+	tests := map[string]bool{
+		"bcl":        true,
+		"first.last": true,
+		"..":         false,
+		".":          false,
+		".snapshots": false,
+		"a/b":        false,
+		`a\b`:        false,
+		"":           false,
+	}
+	for name, expected := range tests {
+		if got := validMailboxName(name); got != expected {
+			t.Errorf("validMailboxName(%q) = %v, expected %v", name, got, expected)
+		}
+	}
+}
+
+func TestBadMailboxRefused(t *testing.T) {
+	for _, template := range []string{"", "{{.Domain}}/{{.User}}"} {
+		func() {
+			dir, err := ioutil.TempDir("", "letterbox-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			maildirs := cmdline.Maildirs
+			defer func() {
+				cmdline.Maildirs = maildirs
+				cfg = config.Config{}
+				allowedList = access.List{}
+			}()
+			cmdline.Maildirs = filepath.Join(dir, "maildirs")
+			if err := os.Mkdir(cmdline.Maildirs, 0700); err != nil {
+				t.Fatal(err)
+			}
+			cfg.Hosts = []string{"127.0.0.1"}
+			cfg.Emails = []string{"*@family.org"}
+			cfg.MaildirPath = template
+			parseHosts()
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go newServer("mx.domain.com", nil).Serve(ln)
+			message := []byte("Subject: hi\r\n\r\nHello\r\n")
+			for _, rcpt := range []string{"..@family.org", ".@family.org", ".snapshots@family.org", `a\b@family.org`} {
+				err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{rcpt}, message)
+				if err == nil || !strings.HasPrefix(err.Error(), "550") || !strings.Contains(err.Error(), "5.1.3") {
+					t.Errorf("%q with maildir_path %q not refused: %v", rcpt, template, err)
+				}
+			}
+			// Nothing was created outside of a user's maildir
+			for _, d := range []string{dir, cmdline.Maildirs, filepath.Join(cmdline.Maildirs, "family.org")} {
+				for _, sub := range []string{"new", "tmp", "cur", ".snapshots"} {
+					if _, err := os.Stat(filepath.Join(d, sub)); err == nil {
+						t.Errorf("%s was created with maildir_path %q", filepath.Join(d, sub), template)
+					}
+				}
+			}
+			if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"kid@family.org"}, message); err != nil {
+				t.Errorf("Good recipient refused with maildir_path %q: %s", template, err)
+			}
+		}()
+	}
+}
+
+func TestMaildirPathCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs, configFile := cmdline.Maildirs, cmdline.Config
+	defer func() {
+		cmdline.Maildirs, cmdline.Config = maildirs, configFile
+		cfg = config.Config{}
+	}()
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	// The commands keep the settings below without a config file
+	cmdline.Config = filepath.Join(dir, "missing.toml")
+	cfg.Emails = []string{"bcl@domain.com", "alice@other.com", "*@family.org"}
+
+	deliver := func(user, folder string) string {
+		d, err := userMaildir(user, folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		del, err := newDelivery(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		del.Write([]byte("Subject: test\r\n\r\nHello\r\n"))
+		if err := del.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return del.Path()
+	}
+
+	for _, template := range []string{"{{.Domain}}/{{.User}}/Maildir", filepath.Join(dir, "home", "{{.User}}", "Maildir")} {
+		cfg.MaildirPath = template
+		bcl := deliver("bcl", "")
+		alice := deliver("alice", "Lists")
+		// A user only matched by a pattern has no known maildir
+		kid := deliver("kid", "")
+
+		var found []string
+		roots, err := userRoots("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		walkRoots(roots, func(p string) error { found = append(found, p); return nil })
+		if len(found) != 3 {
+			t.Errorf("Found %v with %q", found, template)
+		}
+		roots, err = userRoots("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		found = nil
+		walkRoots(roots, func(p string) error { found = append(found, p); return nil })
+		if len(found) != 1 || found[0] != alice {
+			t.Errorf("Found %v for alice with %q", found, template)
+		}
+
+		if user, folder := maildirUser(bcl); user != "bcl" || folder != "" {
+			t.Errorf("maildirUser(%q) = %q, %q", bcl, user, folder)
+		}
+		if user, folder := maildirUser(alice); user != "alice" || folder != "Lists" {
+			t.Errorf("maildirUser(%q) = %q, %q", alice, user, folder)
+		}
+		if user, _ := maildirUser(kid); user == "" {
+			t.Errorf("maildirUser(%q) found no user", kid)
+		}
+
+		// Snapshots are taken of the maildir from the template
+		if err := snapshotCommand([]string{"create", "bcl"}); err != nil {
+			t.Fatal(err)
+		}
+		ids, err := listSnapshots(cmdline.Maildirs, "bcl")
+		if err != nil || len(ids) == 0 {
+			t.Fatalf("No snapshot with %q: %v", template, err)
+		}
+		manifest, err := readManifest(cmdline.Maildirs, "bcl", ids[len(ids)-1])
+		if err != nil || len(manifest.Messages) != 1 {
+			t.Errorf("Wrong snapshot with %q: %#v %v", template, manifest, err)
+		}
+		os.RemoveAll(cmdline.Maildirs)
+		os.RemoveAll(filepath.Join(dir, "home"))
+	}
+}
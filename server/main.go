@@ -0,0 +1,484 @@
+// letterbox - SMTP to Maildir delivery agent
+/*
+Copyright (c) 2019, Brian C. Lane <bcl@brianlane.com>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+	* Redistributions of source code must retain the above copyright notice,
+	  this list of conditions and the following disclaimer.
+	* Redistributions in binary form must reproduce the above copyright notice,
+	  this list of conditions and the following disclaimer in the documentation
+	  and/or other materials provided with the distribution.
+	* Neither the name of the <ORGANIZATION> nor the names of its contributors
+	  may be used to endorse or promote products derived from this software without
+	  specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/events"
+	"github.com/bcl/letterbox/smtpd"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+/* commandline flags */
+type cmdlineArgs struct {
+	Config    string // Path to configuration file
+	Host      string // Host IP or name to bind to
+	Port      int    // Port to bind to
+	Maildirs  string // Path to top level of the user Maildirs
+	Logfile   string // Path to logfile
+	Debug     bool   // Log debugging information
+	LMTP      bool   // Speak LMTP instead of SMTP
+	Socket    string // Path to a Unix socket to listen on instead of Host and Port
+	SecretKey string // Path to the key that decrypts enc: values in the config
+}
+
+/* commandline defaults */
+var cmdline = cmdlineArgs{
+	Config:    "letterbox.toml",
+	Host:      "127.0.0.1",
+	Port:      2525,
+	Maildirs:  "/var/spool/maildirs",
+	Logfile:   "",
+	Debug:     false,
+	LMTP:      false,
+	Socket:    "",
+	SecretKey: "",
+}
+
+/* parseArgs handles parsing the cmdline args and setting values in the global cmdline struct */
+func parseArgs() {
+	flag.StringVar(&cmdline.Config, "config", cmdline.Config, "Path to configutation file")
+	flag.StringVar(&cmdline.Host, "host", cmdline.Host, "Host IP or name to bind to")
+	flag.IntVar(&cmdline.Port, "port", cmdline.Port, "Port to bind to")
+	flag.StringVar(&cmdline.Maildirs, "maildirs", cmdline.Maildirs, "Path to the top level of the user Maildirs")
+	flag.StringVar(&cmdline.Logfile, "log", cmdline.Logfile, "Path to logfile")
+	flag.BoolVar(&cmdline.Debug, "debug", cmdline.Debug, "Log debugging information")
+	flag.BoolVar(&cmdline.LMTP, "lmtp", cmdline.LMTP, "Speak LMTP instead of SMTP")
+	flag.StringVar(&cmdline.Socket, "socket", cmdline.Socket, "Path to a Unix socket to listen on instead of host and port")
+	flag.StringVar(&cmdline.SecretKey, "secret-key", cmdline.SecretKey, "Path to the key for encrypted config values, instead of LETTERBOX_SECRET_KEY")
+
+	flag.Parse()
+}
+
+// Only log if -debug has been passed to the program
+func logDebugf(format string, v ...interface{}) {
+	if cmdline.Debug {
+		log.Printf(format, v...)
+	}
+}
+
+var cfg config.Config
+
+// allowedList is the resolved hosts list and hosts files, the clients that can send mail
+// It is protected by configLock.
+var allowedList access.List
+
+// readConfig reads a TOML configuration file and returns a slice of settings
+/*
+   Example TOML file:
+
+   config_version = 1
+   hosts = ["192.168.101.0/24", "fozzy.brianlane.com", "192.168.103.15"]
+   emails = ["user@domain.com", "root@domain.com", "group:admins"]
+   state_dir = "/var/lib/letterbox"
+   aliases = "/etc/aliases"
+
+   [reputation]
+   halflife = "24h"
+   greeting_delay = "1s"
+   tarpit_score = 5.0
+   tarpit_delay = "10s"
+   greylist_score = 8.0
+   max_delay = "60s"
+
+   [groups]
+   admins = ["bcl@domain.com", "admin@domain.com"]
+
+   [schedules]
+   workhours = ["Mon-Fri 09:00-17:00"]
+
+   [recipient_schedules]
+   "pager@domain.com" = "!workhours"
+*/
+func readConfig(r io.Reader) (config.Config, error) {
+	var c config.Config
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return c, err
+	}
+	if err := decodeConfig(data, &c); err != nil {
+		return c, err
+	}
+	emails, err := expandGroups(c.Groups, c.Emails)
+	if err != nil {
+		return c, err
+	}
+	c.Emails = emails
+	return c, nil
+}
+
+// parseHosts fills the global allowedList from the cfg.Hosts list and the hosts files,
+// exemptList from the cfg.ExemptHosts list, and proxyList from the cfg.ProxyHosts list
+func parseHosts() {
+	allowed := access.Resolve(configHosts(cfg.Hosts))
+	exempt := access.Resolve(cfg.ExemptHosts)
+	proxies := access.Resolve(cfg.ProxyHosts)
+	configLock.Lock()
+	allowedList, exemptList, proxyList = allowed, exempt, proxies
+	configLock.Unlock()
+}
+
+// onNewConnection is called when a client connects to letterbox
+// It checks the client IP against the allowedList,
+// rejecting the connection if it doesn't match. If auth.require_for_unlisted is
+// set the connection is allowed, and the client has to authenticate before MAIL FROM.
+func onNewConnection(c smtpd.Connection) error {
+	conn := connInfo{id: c.ID()}
+	// Access to the Unix socket is controlled by its permissions
+	if localSocket(c) {
+		logEvent(conn, "connect", "socket", c.LocalAddr().String(), "listener", c.LocalHostname())
+		return nil
+	}
+	client, _, err := net.SplitHostPort(c.Addr().String())
+	if err != nil {
+		conn.logf("Problem parsing client address %s: %s", c.Addr().String(), err)
+		return errors.New("Problem parsing client address")
+	}
+	clientIP := access.ParseIP(client)
+	logEvent(conn, "connect", "ip", clientIP.String(), "listener", c.LocalHostname())
+	if err := connectionLimited(clientIP, conn); err != nil {
+		return err
+	}
+	if err := dnsblBlocked(clientIP, conn); err != nil {
+		return err
+	}
+	greetingDelay(clientIP)
+	match := hostMatch(clientIP)
+	if match == "" && (authEnabled() || len(cfg.TLS.Clients) > 0) && cfg.Auth.RequireForUnlisted {
+		match = "require_for_unlisted"
+	}
+	if match != "" {
+		if err := pluginConnect(clientIP); err != nil {
+			logDebugf("Connection from %s rejected by plugin: %s\n", clientIP.String(), err)
+			reject(clientIP, conn, "", "", events.ReasonPlugin, err.Error())
+			return err
+		}
+		logDebugf("Connection from %s allowed by %s\n", clientIP.String(), match)
+		recordAllowed(clientIP, conn, match)
+		return nil
+	}
+
+	logDebugf("Connection from %s rejected\n", clientIP.String())
+	reputation.penalize(clientIP, rejectPenalty)
+	reject(clientIP, conn, "", "", events.ReasonHostNotAllowed, "Client IP not allowed")
+	return errors.New("Client IP not allowed")
+}
+
+// lmtpEnabled returns true if letterbox speaks LMTP instead of SMTP
+func lmtpEnabled() bool {
+	return cmdline.LMTP || strings.EqualFold(cfg.Protocol, "lmtp")
+}
+
+// localSocket returns true if the client is connected to the Unix socket
+func localSocket(c smtpd.Connection) bool {
+	return c.Addr().Network() == "unix"
+}
+
+// listen returns the listener for the server, the Unix socket if -socket is set
+func listen() (net.Listener, error) {
+	if cmdline.Socket == "" {
+		return openListener("tcp", mainAddress())
+	}
+	return openListener("unix", cmdline.Socket)
+}
+
+// hostAllowed checks an IP against the allowedList
+func hostAllowed(ip net.IP) bool {
+	return hostMatch(ip) != ""
+}
+
+// hostMatch returns the allowedList entry the IP matched, or "" if it isn't allowed
+func hostMatch(ip net.IP) string {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return allowedList.Match(ip)
+}
+
+// onNewMail is called when a new connection is allowed
+// it creates a new envelope struct which is used to hold the information about
+// the recipients.
+func onNewMail(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+	conn := newConnInfo(c)
+	conn.queueID = newLogID()
+	logDebugf("letterbox: new mail from %q %s", from, conn)
+	var clientIP net.IP
+	if client, _, err := net.SplitHostPort(c.Addr().String()); err == nil {
+		clientIP = access.ParseIP(client)
+	}
+	if shuttingDown() {
+		reject(clientIP, conn, from.Email(), "", events.ReasonShuttingDown, "Shutting down")
+		return nil, smtpd.SMTPError("421 4.3.2 Error: shutting down")
+	}
+	if err := messageLimited(clientIP, conn, from.Email(), time.Now()); err != nil {
+		return nil, err
+	}
+	// Hosts that aren't in the hosts list are only let in to authenticate,
+	// with AUTH or a client certificate
+	if !localSocket(c) && !hostAllowed(clientIP) && c.AuthUser() == "" && conn.identity == "" {
+		reject(clientIP, conn, from.Email(), "", events.ReasonAuthRequired, "Authentication required")
+		return nil, smtpd.SMTPError("530 5.7.0 Authentication required")
+	}
+	if !identitySenderAllowed(conn.identity, from.Email()) {
+		logDebugf("Client certificate %s may not send from %s", conn.identity, from.Email())
+		reject(clientIP, conn, from.Email(), "", events.ReasonCertNotAllowed, "Sender not allowed for client certificate")
+		return nil, smtpd.SMTPError("550 5.7.1 Sender not allowed for this client certificate")
+	}
+
+	// Clients that authenticated, or are on the Unix socket, aren't checked
+	var spf spfResult
+	if spfMode() != "off" && !localSocket(c) && c.AuthUser() == "" && conn.identity == "" {
+		spf = checkSPF(clientIP, from.Email(), conn.helo)
+		logDebugf("SPF result for %s from %s: %s", from.Email(), clientIP, spf)
+		if spfMode() == "reject" && spf == spfFail {
+			reject(clientIP, conn, from.Email(), "", events.ReasonSPFFail, "SPF check failed")
+			return nil, smtpd.SMTPError("550 5.7.23 Error: SPF check failed")
+		}
+		if spfMode() == "reject" && spf == spfTemperror {
+			reject(clientIP, conn, from.Email(), "", events.ReasonSPFFail, "SPF check could not be completed")
+			return nil, smtpd.SMTPError("451 4.7.24 Error: SPF check could not be completed")
+		}
+	}
+	var domainCheck domainResult
+	if senderDomainMode() != "off" && !localSocket(c) && c.AuthUser() == "" && conn.identity == "" {
+		domainCheck = checkSenderDomain(from.Email())
+		logDebugf("Sender domain result for %s: %s", from.Email(), domainCheck)
+		if err := senderDomainRejected(clientIP, conn, from.Email(), domainCheck); err != nil {
+			return nil, err
+		}
+	}
+	var ip string
+	if clientIP != nil {
+		ip = clientIP.String()
+	}
+	logEvent(conn, "mail", "from", "<"+from.Email()+">", "ip", ip, "helo", conn.helo, "tls", conn.tlsVersion, "auth", conn.authUser, "cert", conn.identity)
+	e := &env{from: from.Email(), clientIP: clientIP, conn: conn, emails: currentEmails(), client: c, lmtp: c.LMTP(), spf: spf, domainCheck: domainCheck}
+	e.tagClient(c)
+	return e, nil
+}
+
+// setup loads the hosts, scores, scripts and other state that cfg refers to, and checks its settings
+// It returns the TLS config for the listeners, and an error that says which step
+// failed, for Main to log after "Error".
+func setup() (*tls.Config, error) {
+	if err := loadHostsFiles(); err != nil {
+		return nil, fmt.Errorf("reading hosts files: %s", err)
+	}
+	parseHosts()
+	if err := setupReputation(); err != nil {
+		return nil, fmt.Errorf("loading reputation scores: %s", err)
+	}
+	if err := setupTags(); err != nil {
+		return nil, fmt.Errorf("loading tag counts: %s", err)
+	}
+	if err := setupGreylist(); err != nil {
+		return nil, fmt.Errorf("loading greylist: %s", err)
+	}
+	if err := parseSchedules(); err != nil {
+		return nil, fmt.Errorf("parsing schedules: %s", err)
+	}
+	if err := loadPlugins(); err != nil {
+		return nil, fmt.Errorf("loading plugins: %s", err)
+	}
+	if err := setupLua(); err != nil {
+		return nil, fmt.Errorf("loading Lua script: %s", err)
+	}
+	if err := setupWasmFilters(); err != nil {
+		return nil, fmt.Errorf("loading wasm filters: %s", err)
+	}
+	if err := loadAliases(); err != nil {
+		return nil, fmt.Errorf("reading aliases: %s", err)
+	}
+	for _, check := range configChecks {
+		if err := check(); err != nil {
+			return nil, fmt.Errorf("in config: %s", err)
+		}
+	}
+	if err := setupQueue(); err != nil {
+		return nil, fmt.Errorf("creating queue: %s", err)
+	}
+	if err := setupScan(); err != nil {
+		return nil, fmt.Errorf("in scan config: %s", err)
+	}
+	if err := setupAuth(); err != nil {
+		return nil, fmt.Errorf("in auth config: %s", err)
+	}
+	serverTLS, err := setupTLS()
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %s", err)
+	}
+	if err := checkAuthTLS(serverTLS); err != nil {
+		return nil, fmt.Errorf("in auth config: %s", err)
+	}
+	if err := checkProtocol(); err != nil {
+		return nil, fmt.Errorf("in config: %s", err)
+	}
+	if err := checkListeners(serverTLS); err != nil {
+		return nil, fmt.Errorf("in config: %s", err)
+	}
+	return serverTLS, nil
+}
+
+// Main runs letterbox with the commandline arguments, as the server, a
+// maintenance command, or sendmail when it is installed under that name
+func Main() {
+	// Installed as sendmail, letterbox delivers the message on stdin
+	if path.Base(os.Args[0]) == "sendmail" {
+		if err := sendmailCommand(os.Args[1:]); err != nil {
+			log.Fatalf("sendmail: %s", err)
+		}
+		return
+	}
+	parseArgs()
+
+	// Run a maintenance command instead of the server
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatalf("Error running %s: %s", flag.Arg(0), err)
+		}
+		return
+	}
+
+	// Setup logging to a file if selected
+	var logOut io.Writer = os.Stderr
+	if len(cmdline.Logfile) > 0 {
+		f, err := openLogFile(cmdline.Logfile)
+		if err != nil {
+			log.Fatalf("Error opening logfile: %s", err)
+		}
+		defer f.Close()
+		log.SetOutput(f)
+		logFile, logOut = f, f
+	}
+
+	if err := setupUpgrade(); err != nil {
+		log.Fatalf("Error using the listeners from the old letterbox: %s", err)
+	}
+	if err := systemdListeners(); err != nil {
+		log.Fatalf("Error using the systemd sockets: %s", err)
+	}
+
+	var err error
+	cfgFile, err := os.Open(cmdline.Config)
+	if err != nil {
+		log.Fatalf("Error opening config file: %s", err)
+	}
+	cfg, err = readConfig(cfgFile)
+	cfgFile.Close()
+	if err != nil {
+		log.Fatalf("Error reading config file %s: %s\n", cmdline.Config, err)
+	}
+	if err := checkLogFormat(); err != nil {
+		log.Fatalf("Error in config: %s", err)
+	}
+	setupLogging(logOut)
+	serverTLS, err := setup()
+	if err != nil {
+		log.Fatalf("Error %s", err)
+	}
+	log.Printf("letterbox: %s", mainAddress())
+	log.Println("Allowed Hosts")
+	for _, h := range allowedList.Hosts {
+		log.Printf("    %s\n", h.String())
+	}
+	log.Println("Allowed Networks")
+	for _, n := range allowedList.Networks {
+		log.Printf("    %s\n", n.String())
+	}
+	if len(cfg.ExemptHosts) > 0 {
+		log.Println("Exempt Hosts")
+		for _, h := range exemptList.Hosts {
+			log.Printf("    %s\n", h.String())
+		}
+		for _, n := range exemptList.Networks {
+			log.Printf("    %s\n", n.String())
+		}
+	}
+	if len(cfg.ProxyHosts) > 0 {
+		log.Println("Proxy Hosts")
+		for _, h := range proxyList.Hosts {
+			log.Printf("    %s\n", h.String())
+		}
+		for _, n := range proxyList.Networks {
+			log.Printf("    %s\n", n.String())
+		}
+	}
+	go handleSignals()
+	go watchHostsFiles(context.Background())
+
+	// Everything is listening before root privileges are dropped, and nothing is served until afterwards
+	ln, err := listen()
+	if err != nil {
+		log.Fatalf("Listen: %v", err)
+	}
+	listeners, err := openListeners()
+	if err != nil {
+		log.Fatalf("Listen: %v", err)
+	}
+	metricsLn, err := listenMetrics()
+	if err != nil {
+		log.Fatalf("Listen: %v", err)
+	}
+	if err := dropPrivileges(); err != nil {
+		log.Fatalf("Error dropping privileges: %s", err)
+	}
+
+	if queueEnabled() {
+		go runQueue(context.Background())
+	}
+	go runReputation(context.Background())
+	s := newServer(serverHostname(), serverTLS)
+	addListener(ln)
+	countCommands(s, ln.Addr().String())
+	serveMetrics(metricsLn)
+	serveListeners(listeners, serverTLS)
+	finishUpgrade()
+	notifyReady()
+	err = s.Serve(listenProxy(ln))
+	if shuttingDown() {
+		// handleSignals exits once the messages have been delivered
+		select {}
+	}
+	if err != nil {
+		log.Fatalf("Serve: %v", err)
+	}
+}
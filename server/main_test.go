@@ -1,11 +1,16 @@
-package main
+package server
 
 import (
 	"bytes"
 	"fmt"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/smtpd"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/textproto"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -136,3 +141,99 @@ func TestReadConfig(t *testing.T) {
 	}
 
 }
+
+func TestLMTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Socket = ""
+		cmdline.Maildirs = maildirs
+		cfg.Emails = nil
+	}()
+	cmdline.Socket = filepath.Join(dir, "lmtp.sock")
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	if err := os.Mkdir(cmdline.Maildirs, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Emails = []string{"bcl@domain.com", "alice@domain.com"}
+
+	ln, err := listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := &smtpd.Server{
+		Hostname:        "localhost",
+		OnNewConnection: onNewConnection,
+		OnNewMail:       onNewMail,
+		LMTP:            true,
+	}
+	go s.Serve(ln)
+
+	conn, err := textproto.Dial("unix", cmdline.Socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expect := func(code int) {
+		t.Helper()
+		if _, _, err := conn.ReadResponse(code); err != nil {
+			t.Fatalf("Expected %d: %s", code, err)
+		}
+	}
+
+	expect(220)
+	conn.PrintfLine("EHLO localhost")
+	expect(500)
+	conn.PrintfLine("LHLO localhost")
+	expect(250)
+	conn.PrintfLine("MAIL FROM:<sender@domain.com>")
+	expect(250)
+	conn.PrintfLine("RCPT TO:<bcl@domain.com>")
+	expect(250)
+	conn.PrintfLine("RCPT TO:<nobody@domain.com>")
+	expect(550)
+	conn.PrintfLine("RCPT TO:<alice@domain.com>")
+	expect(250)
+	conn.PrintfLine("DATA")
+	expect(354)
+	conn.PrintfLine("Subject: test\r\n\r\nHello\r\n.")
+
+	// One reply for each accepted recipient, in order
+	for _, rcpt := range []string{"bcl@domain.com", "alice@domain.com"} {
+		if _, msg, err := conn.ReadResponse(250); err != nil || !strings.Contains(msg, "<"+rcpt+">") {
+			t.Fatalf("Wrong reply for %s: %s %v", rcpt, msg, err)
+		}
+	}
+	for _, user := range []string{"bcl", "alice"} {
+		if files, err := ioutil.ReadDir(filepath.Join(cmdline.Maildirs, user, "new")); err != nil || len(files) != 1 {
+			t.Errorf("Message not delivered to %s: %v", user, err)
+		}
+	}
+}
+
+func TestHostAllowed(t *testing.T) {
+	defer func() {
+		cfg.Hosts = nil
+		allowedList = access.List{}
+	}()
+	cfg.Hosts = []string{"192.168.1/24", "10.0.0.1", "fe80::1%eth0", "2001:db8::/32"}
+	parseHosts()
+
+	allowed := []string{"192.168.1.20", "::ffff:192.168.1.20", "::ffff:10.0.0.1", "fe80::1%eth1", "2001:db8::5"}
+	for _, s := range allowed {
+		if !hostAllowed(access.ParseIP(s)) {
+			t.Errorf("%s not allowed", s)
+		}
+	}
+	denied := []string{"192.168.2.1", "::ffff:10.0.0.2", "fe80::2", "2001:db9::1"}
+	for _, s := range denied {
+		if hostAllowed(access.ParseIP(s)) {
+			t.Errorf("%s allowed", s)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"path"
+)
+
+// deliveryFormat returns maildir or mbox, the format of the user's mailbox
+/*
+   Example TOML:
+
+   format = "maildir"
+
+   [formats]
+   legacy = "mbox"
+
+   formats is keyed by the user the mail is delivered to, after aliases.
+*/
+func deliveryFormat(user string) string {
+	if f, ok := cfg.Formats[user]; ok {
+		return f
+	}
+	if cfg.Format == "" {
+		return "maildir"
+	}
+	return cfg.Format
+}
+
+// checkFormats returns an error if a format in the config is unknown
+func checkFormats() error {
+	formats := []string{deliveryFormat("")}
+	for _, f := range cfg.Formats {
+		formats = append(formats, f)
+	}
+	for _, f := range formats {
+		if f != "maildir" && f != "mbox" {
+			return fmt.Errorf("unknown format: %s", f)
+		}
+	}
+	return nil
+}
+
+// mboxPath returns the mbox file for the user's folder
+// The inbox is user.mbox and folders are user.folder.mbox, in the top of the maildirs.
+// With plus_folders = "inbox" mail for a folder that doesn't exist goes to the inbox.
+func mboxPath(user, folder string) string {
+	inbox := path.Join(cmdline.Maildirs, user+".mbox")
+	if folder == "" {
+		return inbox
+	}
+	if !folderExists(user, folder) && folderMode() == "inbox" {
+		return inbox
+	}
+	return path.Join(cmdline.Maildirs, user+"."+folder+".mbox")
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMboxMail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com", "user@domain.com"}
+	cfg.Formats = map[string]string{"bcl": "mbox"}
+	parseHosts()
+	if err := checkFormats(); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+
+	msg := []byte("Subject: hello\r\n\r\nFrom the mbox\r\n")
+	rcpts := []string{"bcl@domain.com", "bcl+lists@domain.com", "user@domain.com"}
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", rcpts, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"bcl.mbox", "bcl.lists.mbox"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(data), "From sender@domain.com ") || !strings.Contains(string(data), "\nReturn-Path: <sender@domain.com>\n") ||
+			!strings.Contains(string(data), "\nReceived: from ") || !strings.Contains(string(data), "\n>From the mbox\n\n") {
+			t.Errorf("Unexpected %s:\n%s", name, data)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bcl")); !os.IsNotExist(err) {
+		t.Error("Maildir created for an mbox user")
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "user", "new")); len(files) != 1 {
+		t.Errorf("%d messages in the maildir, expected 1", len(files))
+	}
+
+	cfg.Format = "mbx"
+	if err := checkFormats(); err == nil {
+		t.Error("Unknown format accepted")
+	}
+}
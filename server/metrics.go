@@ -0,0 +1,68 @@
+package server
+
+import (
+	"expvar"
+	"github.com/bcl/letterbox/smtpd"
+	"log"
+	"net"
+	"net/http"
+)
+
+// smtpCommands and smtpReplies count the commands and reply codes on each listener
+// They are maps from the listener's address to a map from the verb or code to its count.
+var (
+	smtpCommands = expvar.NewMap("smtp_commands")
+	smtpReplies  = expvar.NewMap("smtp_replies")
+)
+
+// authFailureCount and authLockouts count failed AUTH attempts, and attempts refused because of a lockout
+var (
+	authFailureCount = expvar.NewInt("auth_failures")
+	authLockouts     = expvar.NewInt("auth_lockouts")
+)
+
+// countCommands counts the commands and replies on a server in the metrics
+// listener is the address it is serving, and is used to tell the listeners apart.
+func countCommands(s *smtpd.Server, listener string) {
+	commands, replies := new(expvar.Map).Init(), new(expvar.Map).Init()
+	smtpCommands.Set(listener, commands)
+	smtpReplies.Set(listener, replies)
+	s.OnCommand = func(verb string) {
+		commands.Add(verb, 1)
+	}
+	s.OnReply = func(code string) {
+		replies.Add(code, 1)
+	}
+}
+
+// listenMetrics opens the metrics_address, returning nil if it isn't set
+/*
+   Example TOML:
+
+   metrics_address = "127.0.0.1:9025"
+
+   The address should not be reachable from the internet.
+*/
+func listenMetrics() (net.Listener, error) {
+	if cfg.MetricsAddress == "" {
+		return nil, nil
+	}
+	return openListener("tcp", cfg.MetricsAddress)
+}
+
+// serveMetrics serves the metrics as JSON from /debug/vars on the listener from listenMetrics
+func serveMetrics(ln net.Listener) {
+	if ln == nil {
+		return
+	}
+	log.Printf("letterbox: metrics on %s", ln.Addr())
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/tags", serveTagStats)
+	mux.HandleFunc("/decisions", serveDecisions)
+	mux.HandleFunc("/holds", serveHolds)
+	mux.HandleFunc("/results", serveResults)
+	go func() {
+		log.Printf("Serve metrics: %v", http.Serve(ln, mux))
+	}()
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"testing"
+)
+
+func TestCountCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := newServer("mx.domain.com", nil)
+	countCommands(s, ln.Addr().String())
+	go s.Serve(ln)
+
+	c, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("sender@domain.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"bcl@domain.com", "nobody@domain.com", "root@domain.com"} {
+		c.Rcpt(rcpt)
+	}
+	c.Verify("root@domain.com")
+	c.Quit()
+
+	commands := smtpCommands.Get(ln.Addr().String()).(*expvar.Map)
+	replies := smtpReplies.Get(ln.Addr().String()).(*expvar.Map)
+	for name, expected := range map[string]int64{"EHLO": 1, "MAIL": 1, "RCPT": 3, "UNKNOWN": 1, "QUIT": 1} {
+		if v, ok := commands.Get(name).(*expvar.Int); !ok || v.Value() != expected {
+			t.Errorf("%s count = %v, expected %d", name, commands.Get(name), expected)
+		}
+	}
+	for code, expected := range map[string]int64{"220": 1, "250": 3, "550": 2, "502": 1, "221": 1} {
+		if v, ok := replies.Get(code).(*expvar.Int); !ok || v.Value() != expected {
+			t.Errorf("%s count = %v, expected %d", code, replies.Get(code), expected)
+		}
+	}
+
+	// The counts are served as JSON
+	w := httptest.NewRecorder()
+	expvar.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	var vars struct {
+		Commands map[string]map[string]int64 `json:"smtp_commands"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars.Commands[ln.Addr().String()]["RCPT"] != 3 {
+		t.Errorf("Wrong metrics: %s", w.Body)
+	}
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/bcl/letterbox/delivery"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// migrateSource is a mailbox from another mail server to import into a user's maildir
+type migrateSource struct {
+	user string
+	path string
+	mbox bool // an mbox file, otherwise a maildir and its Maildir++ folders
+}
+
+// migrateSummary counts what happened to the messages of one source
+type migrateSummary struct {
+	imported int
+	skipped  int // already imported by an earlier run
+	failed   int
+}
+
+// isMaildir returns true if dir has the cur and new directories of a maildir
+func isMaildir(dir string) bool {
+	for _, sub := range []string{"cur", "new"} {
+		if fi, err := os.Stat(filepath.Join(dir, sub)); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// findMigrateSources returns the mailboxes at path
+// path can be one mbox file, a spool directory of mbox files named after their
+// users like /var/mail, one maildir, or a directory of maildirs named after
+// their users. user is only used for a single mailbox, which is otherwise
+// imported for the user it is named after.
+func findMigrateSources(path, user string) ([]migrateSource, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if user == "" {
+		user = filepath.Base(filepath.Clean(path))
+	}
+	if fi.Mode().IsRegular() {
+		return []migrateSource{{user: user, path: path, mbox: true}}, nil
+	}
+	if isMaildir(path) {
+		return []migrateSource{{user: user, path: path}}, nil
+	}
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var sources []migrateSource
+	for _, info := range infos {
+		name := info.Name()
+		p := filepath.Join(path, name)
+		switch {
+		case strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".lock"):
+			continue
+		case info.Mode().IsRegular():
+			sources = append(sources, migrateSource{user: name, path: p, mbox: true})
+		case info.IsDir() && isMaildir(p):
+			sources = append(sources, migrateSource{user: name, path: p})
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no mbox files or maildirs in %s", path)
+	}
+	return sources, nil
+}
+
+// readMbox calls fn with each message in an mboxrd or mboxo file
+// The From_ lines are removed, and the > added in front of From_ lines in the
+// body is taken off again.
+func readMbox(r io.Reader, fn func(msg []byte) error) error {
+	br := bufio.NewReader(r)
+	var msg []byte
+	started := false
+	flush := func() error {
+		if !started {
+			return nil
+		}
+		// writeMbox adds a blank line after every message
+		msg = bytes.TrimSuffix(msg, []byte("\n"))
+		err := fn(msg)
+		msg = nil
+		return err
+	}
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				if err := flush(); err != nil {
+					return err
+				}
+				started = true
+			case !started:
+				// Nothing before the first From_ line belongs to a message
+			case bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")):
+				msg = append(msg, line[1:]...)
+			default:
+				msg = append(msg, line...)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+// mboxMessageSeen returns true if the Status header of a message from an mbox says it has been read
+func mboxMessageSeen(msg []byte) bool {
+	for _, line := range bytes.Split(msg, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			break
+		}
+		if bytes.HasPrefix(bytes.ToLower(line), []byte("status:")) {
+			return bytes.ContainsRune(line[len("status:"):], 'R')
+		}
+	}
+	return false
+}
+
+// migrateName returns the maildir filename for an imported message
+// It is made from a hash of the message, so running the import again finds
+// the messages that were already imported instead of copying them twice.
+func migrateName(msg []byte) string {
+	sum := sha1.Sum(msg)
+	return fmt.Sprintf("migrated.%s.%s,S=%d", hex.EncodeToString(sum[:12]), localHostname(), len(msg))
+}
+
+// importMessage writes a message into the maildir, in cur with flags if it isn't new
+// It returns false if the message was already there.
+func importMessage(dir, owner, name, flags string, msg []byte, dryRun bool) (bool, error) {
+	for _, sub := range []string{"new", "cur"} {
+		matches, _ := filepath.Glob(filepath.Join(dir, sub, name+"*"))
+		for _, m := range matches {
+			if messageKey(filepath.Base(m)) == name {
+				return false, nil
+			}
+		}
+	}
+	if dryRun {
+		return true, nil
+	}
+	dest := filepath.Join(dir, "new", name)
+	if flags != "" {
+		dest = filepath.Join(dir, "cur", name+":"+flags)
+	}
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, msg, 0600); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	if err := setMailOwner(tmp, false, owner); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, delivery.Rename(tmp, dest)
+}
+
+// migrateDir returns the maildir under the user's to import a message into, creating it unless dryRun is set
+// folder is the Maildir++ folder name, empty for the inbox. Names already in
+// modified UTF-7 are decoded first, so they aren't encoded twice.
+func migrateDir(user, folder string, dryRun bool) (string, error) {
+	if name, err := decodeMailboxName(folder); err == nil {
+		folder = name
+	}
+	if dryRun {
+		inbox, err := maildirPath(user)
+		if err != nil || folder == "" {
+			return inbox, err
+		}
+		return filepath.Join(inbox, "."+encodeMailboxName(folder)), nil
+	}
+	if folder == "" {
+		dir, err := userMaildir(user, "")
+		return string(dir), err
+	}
+	dir, err := maildirFolder(user, folder)
+	return string(dir), err
+}
+
+// migrateMbox imports the messages in an mbox file into the user's inbox
+// Messages the mbox's Status header marks as read are imported as seen.
+func migrateMbox(src migrateSource, dryRun bool) (migrateSummary, error) {
+	var sum migrateSummary
+	dir, err := migrateDir(src.user, "", dryRun)
+	if err != nil {
+		return sum, err
+	}
+	f, err := os.Open(src.path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	err = readMbox(f, func(msg []byte) error {
+		flags := ""
+		if mboxMessageSeen(msg) {
+			flags = "2,S"
+		}
+		imported, err := importMessage(dir, src.user, migrateName(msg), flags, msg, dryRun)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Error importing a message from %s: %s\n", src.path, err)
+			sum.failed++
+		case imported:
+			sum.imported++
+		default:
+			sum.skipped++
+		}
+		return nil
+	})
+	return sum, err
+}
+
+// migrateMaildir imports the messages in a maildir, and its folders, into the user's maildir
+// Messages keep their flags and folder. Folders can be Maildir++ .folder
+// directories, or plain subdirectories which become folders of the same name.
+func migrateMaildir(src migrateSource, dryRun bool) (migrateSummary, error) {
+	var sum migrateSummary
+	err := walkMessages(src.path, func(path string) error {
+		rel, err := filepath.Rel(src.path, filepath.Dir(filepath.Dir(path)))
+		if err != nil {
+			return err
+		}
+		folder := ""
+		if rel != "." {
+			folder = strings.TrimPrefix(strings.Replace(rel, string(filepath.Separator), ".", -1), ".")
+		}
+		dir, err := migrateDir(src.user, folder, dryRun)
+		if err != nil {
+			return err
+		}
+		msg, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", path, err)
+			sum.failed++
+			return nil
+		}
+		name := filepath.Base(path)
+		flags := ""
+		if i := strings.Index(name, ":"); i != -1 {
+			flags = name[i+1:]
+		} else if filepath.Base(filepath.Dir(path)) == "cur" {
+			flags = "2,"
+		}
+		imported, err := importMessage(dir, src.user, messageKey(name), flags, msg, dryRun)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Error importing %s: %s\n", path, err)
+			sum.failed++
+		case imported:
+			sum.imported++
+		default:
+			sum.skipped++
+		}
+		return nil
+	})
+	return sum, err
+}
+
+// migrateCommand imports mail from an existing mbox spool or maildirs into letterbox's maildirs
+/*
+   letterbox migrate [-n] [-user bcl] /var/mail
+
+   Each user's maildirsize is rebuilt afterwards, so quotas count the imported
+   messages. Running it again only imports messages that are new since the
+   last run.
+*/
+func migrateCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "Only report what would be imported")
+	user := flags.String("user", "", "User to import a single mbox or maildir for, instead of the one it is named after")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: migrate [-n] [-user name] <mbox, spool directory, or maildirs>")
+	}
+	if *user != "" {
+		*user = filepath.Base(filepath.Clean(*user))
+	}
+	if err := loadCommandConfig(); err != nil {
+		return err
+	}
+	sources, err := findMigrateSources(flags.Arg(0), *user)
+	if err != nil {
+		return err
+	}
+	if *user != "" && len(sources) > 1 {
+		return fmt.Errorf("-user can only be used with a single mbox or maildir")
+	}
+
+	var total migrateSummary
+	for _, src := range sources {
+		var sum migrateSummary
+		if src.mbox {
+			sum, err = migrateMbox(src, *dryRun)
+		} else {
+			sum, err = migrateMaildir(src, *dryRun)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error importing %s: %s\n", src.path, err)
+			sum.failed++
+		}
+		fmt.Printf("%s: %d imported, %d already imported, %d failed from %s\n", src.user, sum.imported, sum.skipped, sum.failed, src.path)
+		if !*dryRun && sum.imported > 0 {
+			if inbox, err := maildirPath(src.user); err != nil {
+				fmt.Fprintf(os.Stderr, "Error updating the quota for %s: %s\n", src.user, err)
+			} else if _, bytes, messages, err := recalcQuota(inbox, nil); err != nil {
+				fmt.Fprintf(os.Stderr, "Error updating the quota for %s: %s\n", src.user, err)
+			} else {
+				fmt.Printf("%s: %d bytes in %d messages\n", src.user, bytes, messages)
+			}
+		}
+		total.imported += sum.imported
+		total.skipped += sum.skipped
+		total.failed += sum.failed
+	}
+	fmt.Printf("%d users, %d imported, %d already imported, %d failed\n", len(sources), total.imported, total.skipped, total.failed)
+	if total.failed > 0 {
+		return fmt.Errorf("%d messages could not be imported", total.failed)
+	}
+	return nil
+}
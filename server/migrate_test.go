@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"github.com/bcl/letterbox/delivery"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadMbox(t *testing.T) {
+	messages := []string{
+		"Subject: one\nStatus: RO\n\nFrom here on\n>From there\n",
+		"Subject: two\n\nHello\n",
+	}
+	var buf bytes.Buffer
+	buf.WriteString("junk before the first message\n")
+	for _, msg := range messages {
+		if err := delivery.WriteMbox(&buf, strings.NewReader(msg), "sender@domain.com", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var read []string
+	err := readMbox(&buf, func(msg []byte) error {
+		read = append(read, string(msg))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 || read[0] != messages[0] || read[1] != messages[1] {
+		t.Errorf("Read %q from the mbox", read)
+	}
+	if !mboxMessageSeen([]byte(read[0])) || mboxMessageSeen([]byte(read[1])) {
+		t.Error("Wrong Status for the messages")
+	}
+}
+
+func TestFindMigrateSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestMessage(t, filepath.Join(dir, "spool", "bcl"), "From a@b.com Mon Jan  1 00:00:00 2024\nSubject: one\n\n")
+	writeTestMessage(t, filepath.Join(dir, "spool", "bcl.lock"), "")
+	writeTestMessage(t, filepath.Join(dir, "spool", "alice", "new", "1.host"), "Subject: two\n\n")
+	os.MkdirAll(filepath.Join(dir, "spool", "alice", "cur"), 0700)
+
+	sources, err := findMigrateSources(filepath.Join(dir, "spool"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 2 || sources[0].user != "alice" || sources[0].mbox || sources[1].user != "bcl" || !sources[1].mbox {
+		t.Errorf("Wrong sources: %v", sources)
+	}
+	sources, err = findMigrateSources(filepath.Join(dir, "spool", "alice"), "carol")
+	if err != nil || len(sources) != 1 || sources[0].user != "carol" || sources[0].mbox {
+		t.Errorf("Wrong sources for one maildir: %v %v", sources, err)
+	}
+	if _, err := findMigrateSources(filepath.Join(dir, "missing"), ""); err == nil {
+		t.Error("Missing path accepted")
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() { cmdline.Maildirs = maildirs }()
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	if err := os.Mkdir(cmdline.Maildirs, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	spool := filepath.Join(dir, "spool")
+	writeTestMessage(t, filepath.Join(spool, "bcl"),
+		"From a@b.com Mon Jan  1 00:00:00 2024\nSubject: one\nStatus: RO\n\nHello\n\n"+
+			"From a@b.com Mon Jan  1 00:01:00 2024\nSubject: two\n\nHello again\n\n")
+	writeTestMessage(t, filepath.Join(spool, "alice", "new", "1000.1.host"), "Subject: new\n\n")
+	writeTestMessage(t, filepath.Join(spool, "alice", "cur", "1001.1.host:2,S"), "Subject: read\n\n")
+	writeTestMessage(t, filepath.Join(spool, "alice", ".Sent", "cur", "1002.1.host:2,S"), "Subject: sent\n\n")
+
+	// A dry run doesn't write anything
+	if err := migrateCommand([]string{"-n", spool}); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := ioutil.ReadDir(cmdline.Maildirs); len(infos) != 0 {
+		t.Errorf("Dry run created %d files", len(infos))
+	}
+
+	if err := migrateCommand([]string{spool}); err != nil {
+		t.Fatal(err)
+	}
+	for path, count := range map[string]int{
+		"bcl/new":         1,
+		"bcl/cur":         1,
+		"alice/new":       1,
+		"alice/cur":       1,
+		"alice/.Sent/cur": 1,
+	} {
+		if infos, _ := ioutil.ReadDir(filepath.Join(cmdline.Maildirs, path)); len(infos) != count {
+			t.Errorf("%s has %d messages, expected %d", path, len(infos), count)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cmdline.Maildirs, "alice", "cur", "1001.1.host:2,S")); err != nil {
+		t.Errorf("Message flags not kept: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(cmdline.Maildirs, "alice", ".Sent", "maildirfolder")); err != nil {
+		t.Errorf("Folder not created: %s", err)
+	}
+	if _, size, count, err := readMaildirsize(filepath.Join(cmdline.Maildirs, "bcl")); err != nil || count != 2 || size == 0 {
+		t.Errorf("maildirsize has %d bytes in %d messages: %v", size, count, err)
+	}
+
+	// Running it again doesn't import the messages twice
+	if err := migrateCommand([]string{spool}); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := ioutil.ReadDir(filepath.Join(cmdline.Maildirs, "bcl", "new")); len(infos) != 1 {
+		t.Errorf("bcl/new has %d messages after importing again", len(infos))
+	}
+
+	if err := migrateCommand([]string{"-user", "carol", spool}); err == nil {
+		t.Error("-user accepted for a spool directory")
+	}
+}
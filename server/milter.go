@@ -0,0 +1,482 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/smtpd"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultMilterTimeout is used when a milter's timeout isn't set
+const defaultMilterTimeout = 30 * time.Second
+
+// milterVersion is the version of the milter protocol letterbox speaks
+const milterVersion = 6
+
+// milterMaxPacket limits the size of a packet from a milter
+const milterMaxPacket = 1024 * 1024
+
+// milterChunkSize is the most body that is sent in one packet
+const milterChunkSize = 65535
+
+// Milter commands sent by letterbox
+const (
+	milterCmdOptNeg  = 'O'
+	milterCmdMacro   = 'D'
+	milterCmdConnect = 'C'
+	milterCmdHelo    = 'H'
+	milterCmdMail    = 'M'
+	milterCmdRcpt    = 'R'
+	milterCmdData    = 'T'
+	milterCmdHeader  = 'L'
+	milterCmdEOH     = 'N'
+	milterCmdBody    = 'B'
+	milterCmdEOB     = 'E'
+	milterCmdQuit    = 'Q'
+)
+
+// Milter responses
+const (
+	milterAccept     = 'a'
+	milterContinue   = 'c'
+	milterDiscard    = 'd'
+	milterReject     = 'r'
+	milterTempfail   = 't'
+	milterReplyCode  = 'y'
+	milterSkip       = 's'
+	milterProgress   = 'p'
+	milterAddHeader  = 'h'
+	milterInsHeader  = 'i'
+	milterQuarantine = 'q'
+)
+
+// Actions a milter may take at the end of the message
+const (
+	milterActAddHeaders = 0x01
+	milterActQuarantine = 0x20
+)
+
+// Protocol flags, for steps the milter doesn't want or won't reply to
+const (
+	milterNoConnect = 0x1
+	milterNoHelo    = 0x2
+	milterNoMail    = 0x4
+	milterNoRcpt    = 0x8
+	milterNoBody    = 0x10
+	milterNoHeaders = 0x20
+	milterNoEOH     = 0x40
+	milterNRHeader  = 0x80
+	milterNoUnknown = 0x100
+	milterNoData    = 0x200
+	milterSkipBody  = 0x400
+	milterNRConnect = 0x1000
+	milterNRHelo    = 0x2000
+	milterNRMail    = 0x4000
+	milterNRRcpt    = 0x8000
+	milterNRData    = 0x10000
+	milterNRUnknown = 0x20000
+	milterNREOH     = 0x40000
+	milterNRBody    = 0x80000
+)
+
+// milterProtocols are the protocol flags letterbox can handle
+const milterProtocols = milterNoConnect | milterNoHelo | milterNoMail | milterNoRcpt | milterNoBody | milterNoHeaders |
+	milterNoEOH | milterNRHeader | milterNoUnknown | milterNoData | milterSkipBody | milterNRConnect | milterNRHelo |
+	milterNRMail | milterNRRcpt | milterNRData | milterNRUnknown | milterNREOH | milterNRBody
+
+// milterActions are the modifications letterbox lets milters make
+const milterActions = milterActAddHeaders | milterActQuarantine
+
+// milterNoResponse is returned by step for commands the milter doesn't reply to
+const milterNoResponse = 0
+
+// milterVerdict is what the milters decided to do with a message
+type milterVerdict struct {
+	milter  string // name of the milter that decided
+	action  string // "" to deliver it, reject, discard, or quarantine
+	reply   error  // SMTP reply for reject
+	reason  string // why it was quarantined
+	maildir string // quarantine maildir, "" for the recipients' Junk folders
+}
+
+// miltersEnabled returns true if messages are passed to milters
+func miltersEnabled() bool {
+	return len(cfg.Milters) > 0
+}
+
+// milterName returns the milter's name for the log
+func milterName(m config.Milter) string {
+	if m.Name == "" {
+		return m.Address
+	}
+	return m.Name
+}
+
+// milterOnError returns what to do with messages the milter failed on
+func milterOnError(m config.Milter) string {
+	if m.OnError == "" {
+		return "defer"
+	}
+	return strings.ToLower(m.OnError)
+}
+
+// checkMilters checks the [[milters]] config
+/*
+   Example TOML:
+
+   [[milters]]
+   name = "rspamd"
+   address = "127.0.0.1:11332"
+   on_error = "accept"
+
+   [[milters]]
+   name = "clamav"
+   address = "/run/clamav/clamav-milter.ctl"
+   quarantine = "virus"
+   timeout = "1m"
+
+   Each milter is passed the connection, envelope, headers, and body once the
+   whole message has arrived, in the order they are listed. The first one that
+   rejects, discards, or quarantines the message decides, and the headers they
+   add are added to it. If a milter fails, "defer" asks the sender to try again
+   later and "accept" skips it.
+*/
+func checkMilters() error {
+	for _, m := range cfg.Milters {
+		if m.Address == "" {
+			return fmt.Errorf("milter %s has no address", m.Name)
+		}
+		switch milterOnError(m) {
+		case "defer", "accept":
+		default:
+			return fmt.Errorf("unknown on_error setting for milter %s: %s", milterName(m), m.OnError)
+		}
+	}
+	return nil
+}
+
+// milterConn is a connection to a milter
+type milterConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	protocol uint32 // protocol flags the milter asked for
+}
+
+// milterNetwork returns the network to dial for the milter's address
+func milterNetwork(address string) string {
+	if strings.HasPrefix(address, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// dialMilter connects to the milter and negotiates the options
+func dialMilter(m config.Milter) (*milterConn, error) {
+	timeout := m.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultMilterTimeout
+	}
+	conn, err := net.DialTimeout(milterNetwork(m.Address), m.Address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	mc := &milterConn{conn: conn, r: bufio.NewReader(conn)}
+
+	opts := make([]byte, 12)
+	binary.BigEndian.PutUint32(opts, milterVersion)
+	binary.BigEndian.PutUint32(opts[4:], milterActions)
+	binary.BigEndian.PutUint32(opts[8:], milterProtocols)
+	if err := mc.send(milterCmdOptNeg, opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	cmd, data, err := mc.read()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if cmd != milterCmdOptNeg || len(data) < 12 {
+		conn.Close()
+		return nil, fmt.Errorf("bad option negotiation reply %q", cmd)
+	}
+	mc.protocol = binary.BigEndian.Uint32(data[8:]) & milterProtocols
+	return mc, nil
+}
+
+// send writes a packet with the command and its data
+func (mc *milterConn) send(cmd byte, data []byte) error {
+	packet := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(len(data)+1))
+	packet[4] = cmd
+	_, err := mc.conn.Write(append(packet, data...))
+	return err
+}
+
+// read reads a packet, returning its command and data
+func (mc *milterConn) read() (byte, []byte, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(mc.r, size); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(size)
+	if n == 0 || n > milterMaxPacket {
+		return 0, nil, fmt.Errorf("bad packet length %d", n)
+	}
+	packet := make([]byte, n)
+	if _, err := io.ReadFull(mc.r, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+// reply reads the milter's response to a command, skipping progress reports
+func (mc *milterConn) reply() (byte, []byte, error) {
+	for {
+		cmd, data, err := mc.read()
+		if err != nil || cmd != milterProgress {
+			return cmd, data, err
+		}
+	}
+}
+
+// step sends a command before the end of the message, unless the milter
+// asked to skip it, and returns its response. milterNoResponse is returned
+// when the milter doesn't reply to the command.
+func (mc *milterConn) step(skip, noReply uint32, cmd byte, data []byte) (byte, []byte, error) {
+	if mc.protocol&skip != 0 {
+		return milterContinue, nil, nil
+	}
+	if err := mc.send(cmd, data); err != nil {
+		return 0, nil, err
+	}
+	if mc.protocol&noReply != 0 {
+		return milterNoResponse, nil, nil
+	}
+	return mc.reply()
+}
+
+// milterMacros returns a macro packet for the command
+func milterMacros(cmd byte, kv ...string) []byte {
+	return append([]byte{cmd}, cstrings(kv...)...)
+}
+
+// cstrings joins the strings as NUL terminated C strings
+func cstrings(s ...string) []byte {
+	var data []byte
+	for _, v := range s {
+		data = append(append(data, v...), 0)
+	}
+	return data
+}
+
+// milterConnectData returns the CONNECT packet's hostname, family, port, and address
+func milterConnectData(ip net.IP) []byte {
+	if ip == nil {
+		return append(cstrings("localhost"), 'U', 0, 0, 0)
+	}
+	family := byte('6')
+	if ip.To4() != nil {
+		family = '4'
+	}
+	data := append(cstrings("["+ip.String()+"]"), family, 0, 0)
+	return append(data, cstrings(ip.String())...)
+}
+
+// milterReplyError returns the SMTP reply for a reject, tempfail, or replycode response
+func milterReplyError(cmd byte, data []byte) error {
+	if cmd == milterReplyCode {
+		reply := strings.TrimRight(string(data), "\x00")
+		if i := strings.IndexAny(reply, "\r\n"); i != -1 {
+			reply = reply[:i]
+		}
+		if len(reply) > 4 && (reply[0] == '4' || reply[0] == '5') {
+			return smtpd.SMTPError(reply)
+		}
+	}
+	if cmd == milterTempfail {
+		return smtpd.SMTPError("451 4.7.1 Error: message deferred by a content filter")
+	}
+	return smtpd.SMTPError("550 5.7.1 Error: message rejected by a content filter")
+}
+
+// milterHeaderField returns an add or insert header response as a header field
+func milterHeaderField(cmd byte, data []byte) []byte {
+	if cmd == milterInsHeader {
+		if len(data) < 4 {
+			return nil
+		}
+		data = data[4:]
+	}
+	parts := strings.SplitN(strings.TrimRight(string(data), "\x00"), "\x00", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil
+	}
+	value := strings.Replace(strings.Replace(parts[1], "\r\n", "\n", -1), "\n", "\r\n", -1)
+	return foldHeader(parts[0], value)
+}
+
+// milterStep is a command sent to a milter before the message's header
+type milterStep struct {
+	skip, noReply uint32 // protocol flags for skipping it and not replying to it
+	cmd           byte
+	data          []byte
+	macros        []byte // macros sent before the command, nil for none
+}
+
+// runMilter passes the message to the milter and returns the headers it added
+// The verdict's action is "" if the milter accepted the message.
+func (e *env) runMilter(m config.Milter) ([]byte, milterVerdict, error) {
+	verdict := milterVerdict{milter: milterName(m), maildir: m.Quarantine}
+	mc, err := dialMilter(m)
+	if err != nil {
+		return nil, verdict, err
+	}
+	defer mc.conn.Close()
+	defer mc.send(milterCmdQuit, nil)
+
+	// decided sets the verdict for a response that ends the message, returning true if it did
+	decided := func(cmd byte, data []byte) bool {
+		switch cmd {
+		case milterAccept:
+			return true
+		case milterDiscard:
+			verdict.action = "discard"
+			return true
+		case milterReject, milterTempfail, milterReplyCode:
+			verdict.action = "reject"
+			verdict.reply = milterReplyError(cmd, data)
+			return true
+		}
+		return false
+	}
+
+	fields, body := splitMessage(e.data.Bytes())
+	steps := []milterStep{
+		{milterNoConnect, milterNRConnect, milterCmdConnect, milterConnectData(e.clientIP), milterMacros(milterCmdConnect, "j", e.conn.hostname, "{daemon_name}", "letterbox")},
+		{milterNoHelo, milterNRHelo, milterCmdHelo, cstrings(e.conn.helo), nil},
+		{milterNoMail, milterNRMail, milterCmdMail, cstrings("<" + e.from + ">"), milterMacros(milterCmdMail, "{auth_authen}", e.conn.authUser, "{mail_addr}", e.from)},
+	}
+	for _, rcpt := range e.rcpts {
+		steps = append(steps, milterStep{milterNoRcpt, milterNRRcpt, milterCmdRcpt, cstrings("<" + rcpt.Email() + ">"), milterMacros(milterCmdRcpt, "{rcpt_addr}", rcpt.Email())})
+	}
+	for _, s := range steps {
+		if s.macros != nil {
+			if err := mc.send(milterCmdMacro, s.macros); err != nil {
+				return nil, verdict, err
+			}
+		}
+		cmd, data, err := mc.step(s.skip, s.noReply, s.cmd, s.data)
+		if err != nil {
+			return nil, verdict, err
+		}
+		// A rejected recipient is left for the other milters and letterbox to decide
+		if s.cmd == milterCmdRcpt && (cmd == milterReject || cmd == milterTempfail || cmd == milterReplyCode) {
+			continue
+		}
+		if decided(cmd, data) {
+			return nil, verdict, nil
+		}
+	}
+
+	if err := mc.send(milterCmdMacro, milterMacros(milterCmdData, "i", e.conn.queueID)); err != nil {
+		return nil, verdict, err
+	}
+	cmd, data, err := mc.step(milterNoData, milterNRData, milterCmdData, nil)
+	if err != nil {
+		return nil, verdict, err
+	} else if decided(cmd, data) {
+		return nil, verdict, nil
+	}
+	for _, field := range fields {
+		i := strings.Index(field, ":")
+		if i == -1 {
+			continue
+		}
+		value := strings.TrimLeft(strings.TrimSuffix(field[i+1:], "\r\n"), " ")
+		cmd, data, err := mc.step(milterNoHeaders, milterNRHeader, milterCmdHeader, cstrings(field[:i], strings.Replace(value, "\r\n", "\n", -1)))
+		if err != nil {
+			return nil, verdict, err
+		} else if decided(cmd, data) {
+			return nil, verdict, nil
+		}
+	}
+	cmd, data, err = mc.step(milterNoEOH, milterNREOH, milterCmdEOH, nil)
+	if err != nil {
+		return nil, verdict, err
+	} else if decided(cmd, data) {
+		return nil, verdict, nil
+	}
+	for chunk := []byte(body); len(chunk) > 0; {
+		n := len(chunk)
+		if n > milterChunkSize {
+			n = milterChunkSize
+		}
+		cmd, data, err := mc.step(milterNoBody, milterNRBody, milterCmdBody, chunk[:n])
+		if err != nil {
+			return nil, verdict, err
+		} else if cmd == milterSkip {
+			break
+		} else if decided(cmd, data) {
+			return nil, verdict, nil
+		}
+		chunk = chunk[n:]
+	}
+
+	// The end of the message gets the modifications, then the final response
+	if err := mc.send(milterCmdEOB, nil); err != nil {
+		return nil, verdict, err
+	}
+	var added []byte
+	for {
+		cmd, data, err := mc.reply()
+		if err != nil {
+			return nil, verdict, err
+		}
+		switch cmd {
+		case milterAddHeader, milterInsHeader:
+			added = append(added, milterHeaderField(cmd, data)...)
+		case milterQuarantine:
+			verdict.action = "quarantine"
+			verdict.reason = strings.TrimRight(string(data), "\x00")
+		case milterContinue:
+			return added, verdict, nil
+		default:
+			if decided(cmd, data) {
+				if cmd == milterAccept {
+					return added, verdict, nil
+				}
+				return nil, verdict, nil
+			}
+			logDebugf("Ignoring milter %s response %q", verdict.milter, cmd)
+		}
+	}
+}
+
+// milterCheck passes the message to each milter in turn
+// It returns the headers they added, and the verdict of the first one that
+// didn't accept the message. A milter that fails defers the message, or is
+// skipped with on_error = "accept".
+func (e *env) milterCheck() ([]byte, milterVerdict, error) {
+	var added []byte
+	for _, m := range cfg.Milters {
+		headers, verdict, err := e.runMilter(m)
+		if err != nil {
+			e.conn.logf("Error from milter %s: %s", milterName(m), err)
+			if milterOnError(m) == "accept" {
+				continue
+			}
+			return nil, verdict, smtpd.SMTPError("451 4.3.0 Error: message could not be checked by a content filter")
+		}
+		added = append(added, headers...)
+		if verdict.action != "" {
+			return added, verdict, nil
+		}
+	}
+	return added, milterVerdict{}, nil
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMilter decides what to do with messages by the word in their body
+// It asks not to be sent HELO and not to reply to headers, and records the
+// headers and envelope it was sent.
+type fakeMilter struct {
+	sync.Mutex
+	seen []string
+}
+
+// packet writes a milter packet
+func (f *fakeMilter) packet(c net.Conn, cmd byte, data []byte) {
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(data)+1))
+	c.Write(append(append(size, cmd), data...))
+}
+
+// serve answers the milter commands on ln
+func (f *fakeMilter) serve(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			r := bufio.NewReader(c)
+			var body string
+			for {
+				size := make([]byte, 4)
+				if _, err := io.ReadFull(r, size); err != nil {
+					return
+				}
+				packet := make([]byte, binary.BigEndian.Uint32(size))
+				if _, err := io.ReadFull(r, packet); err != nil {
+					return
+				}
+				cmd, data := packet[0], packet[1:]
+				switch cmd {
+				case 'O':
+					opts := make([]byte, 12)
+					binary.BigEndian.PutUint32(opts, 6)
+					binary.BigEndian.PutUint32(opts[4:], milterActAddHeaders|milterActQuarantine)
+					binary.BigEndian.PutUint32(opts[8:], milterNoHelo|milterNRHeader)
+					f.packet(c, 'O', opts)
+				case 'D':
+				case 'H':
+					f.Lock()
+					f.seen = append(f.seen, "HELO")
+					f.Unlock()
+				case 'M', 'R', 'L':
+					f.Lock()
+					f.seen = append(f.seen, string(cmd)+" "+strings.Replace(strings.TrimRight(string(data), "\x00"), "\x00", ": ", 1))
+					f.Unlock()
+					if cmd != 'L' {
+						f.packet(c, 'c', nil)
+					}
+				case 'B':
+					body += string(data)
+					f.packet(c, 'c', nil)
+				case 'E':
+					switch {
+					case strings.Contains(body, "reject"):
+						f.packet(c, 'y', []byte("550 5.7.1 Go away\x00"))
+					case strings.Contains(body, "tempfail"):
+						f.packet(c, 't', nil)
+					case strings.Contains(body, "discard"):
+						f.packet(c, 'd', nil)
+					case strings.Contains(body, "quarantine"):
+						f.packet(c, 'h', []byte("X-Milter\x00suspicious\x00"))
+						f.packet(c, 'q', []byte("looks odd\x00"))
+						f.packet(c, 'c', nil)
+					default:
+						f.packet(c, 'p', nil)
+						f.packet(c, 'h', []byte("X-Milter\x00checked\x00"))
+						f.packet(c, 'a', nil)
+					}
+				case 'Q':
+					return
+				default:
+					f.packet(c, 'c', nil)
+				}
+			}
+		}(c)
+	}
+}
+
+func TestMilterHelpers(t *testing.T) {
+	if data := milterConnectData(net.ParseIP("192.168.1.5")); string(data) != "[192.168.1.5]\x004\x00\x00192.168.1.5\x00" {
+		t.Errorf("Wrong IPv4 connect data: %q", data)
+	}
+	if data := milterConnectData(net.ParseIP("2001:db8::1")); string(data) != "[2001:db8::1]\x006\x00\x002001:db8::1\x00" {
+		t.Errorf("Wrong IPv6 connect data: %q", data)
+	}
+	if field := milterHeaderField(milterAddHeader, []byte("X-Spam\x00yes\x00")); string(field) != "X-Spam: yes\r\n" {
+		t.Errorf("Wrong added header: %q", field)
+	}
+	if field := milterHeaderField(milterInsHeader, []byte("\x00\x00\x00\x01X-Spam\x00yes\n\tand more\x00")); string(field) != "X-Spam: yes\r\n\tand more\r\n" {
+		t.Errorf("Wrong inserted header: %q", field)
+	}
+	tests := []struct {
+		cmd   byte
+		data  string
+		reply string
+	}{
+		{milterReplyCode, "554 5.7.1 No thanks\x00", "554 5.7.1 No thanks"},
+		{milterReplyCode, "250 OK\x00", "550 5.7.1 Error: message rejected by a content filter"},
+		{milterTempfail, "", "451 4.7.1 Error: message deferred by a content filter"},
+		{milterReject, "", "550 5.7.1 Error: message rejected by a content filter"},
+	}
+	for _, tt := range tests {
+		if err := milterReplyError(tt.cmd, []byte(tt.data)); err.Error() != tt.reply {
+			t.Errorf("milterReplyError(%q, %q) = %q", tt.cmd, tt.data, err)
+		}
+	}
+}
+
+func TestCheckMilters(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	for _, m := range []config.Milter{
+		{Name: "rspamd"},
+		{Address: "127.0.0.1:11332", OnError: "tag"},
+	} {
+		cfg.Milters = []config.Milter{m}
+		if err := checkMilters(); err == nil {
+			t.Errorf("Bad milter config accepted: %#v", m)
+		}
+	}
+	cfg.Milters = []config.Milter{{Name: "rspamd", Address: "127.0.0.1:11332", OnError: "accept"}}
+	if err := checkMilters(); err != nil {
+		t.Errorf("Good milter config refused: %s", err)
+	}
+}
+
+func TestMilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	parseHosts()
+
+	milter := &fakeMilter{}
+	mln, err := net.Listen("unix", filepath.Join(dir, "milter.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mln.Close()
+	go milter.serve(mln)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	send := func(body string) error {
+		return smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com"}, []byte("Subject: test\r\n\r\n"+body+"\r\n"))
+	}
+	// folder returns the messages delivered to the user's maildir folder, joined together
+	folder := func(user, name string) (int, string) {
+		files, _ := ioutil.ReadDir(filepath.Join(dir, user, name, "new"))
+		var all string
+		for _, f := range files {
+			data, _ := ioutil.ReadFile(filepath.Join(dir, user, name, "new", f.Name()))
+			all += string(data)
+		}
+		return len(files), all
+	}
+
+	cfg.Milters = []config.Milter{{Name: "fake", Address: mln.Addr().String()}}
+	if err := send("hello"); err != nil {
+		t.Fatalf("Accepted message refused: %s", err)
+	}
+	milter.Lock()
+	seen := strings.Join(milter.seen, "\n")
+	milter.Unlock()
+	if seen != "M <sender@domain.com>\nR <bcl@domain.com>\nL Subject: test" {
+		t.Errorf("Milter was sent %q", seen)
+	}
+	if err := send("reject"); err == nil || !strings.HasPrefix(err.Error(), "550") || !strings.Contains(err.Error(), "Go away") {
+		t.Errorf("Rejected message not refused: %v", err)
+	}
+	if err := send("tempfail"); err == nil || !strings.HasPrefix(err.Error(), "451") {
+		t.Errorf("Tempfailed message not deferred: %v", err)
+	}
+	if err := send("discard"); err != nil {
+		t.Errorf("Discarded message refused: %s", err)
+	}
+	if err := send("quarantine"); err != nil {
+		t.Errorf("Quarantined message refused: %s", err)
+	}
+	if n, data := folder("bcl", ""); n != 1 || !strings.Contains(data, "X-Milter: checked\r\n") {
+		t.Errorf("Wrong inbox: %d %q", n, data)
+	}
+	if n, data := folder("bcl", ".Junk"); n != 1 || !strings.Contains(data, "X-Milter: suspicious\r\n") {
+		t.Errorf("Wrong junk folder: %d %q", n, data)
+	}
+
+	// With a quarantine maildir the message is only delivered there
+	cfg.Milters[0].Quarantine = "quarantine"
+	if err := send("quarantine"); err != nil {
+		t.Errorf("Quarantined message refused: %s", err)
+	}
+	if n, _ := folder("bcl", ".Junk"); n != 1 {
+		t.Errorf("Quarantined message delivered to the recipient")
+	}
+	if n, _ := folder("quarantine", ""); n != 1 {
+		t.Errorf("Message not quarantined")
+	}
+
+	// A milter that can't be reached defers the message, unless on_error = "accept"
+	cfg.Milters = append(cfg.Milters, config.Milter{Address: filepath.Join(dir, "missing.sock")})
+	if err := send("hello"); err == nil || !strings.HasPrefix(err.Error(), "451") {
+		t.Errorf("Message not deferred without the milter: %v", err)
+	}
+	cfg.Milters[1].OnError = "accept"
+	if err := send("hello"); err != nil {
+		t.Errorf("Message refused with on_error = accept: %s", err)
+	}
+	if n, _ := folder("bcl", ""); n != 2 {
+		t.Errorf("Message not delivered with on_error = accept")
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"github.com/luksen/maildir"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// defaultUmask keeps mail readable only by its owner
+const defaultUmask = 0077
+
+// mailUmask returns the umask for the maildirs, mboxes, and messages letterbox creates
+func mailUmask() os.FileMode {
+	if cfg.Umask == "" {
+		return defaultUmask
+	}
+	mask, err := strconv.ParseUint(cfg.Umask, 8, 32)
+	if err != nil {
+		return defaultUmask
+	}
+	return os.FileMode(mask) & os.ModePerm
+}
+
+// checkOwnership checks the umask and deliver_as_owner settings
+func checkOwnership() error {
+	if cfg.Umask != "" {
+		if mask, err := strconv.ParseUint(cfg.Umask, 8, 32); err != nil || mask > 0777 {
+			return fmt.Errorf("bad umask: %s", cfg.Umask)
+		}
+	}
+	if cfg.DeliverAsOwner && cfg.User != "" {
+		return fmt.Errorf("deliver_as_owner needs letterbox to keep running as root, it can't be used with user")
+	}
+	return nil
+}
+
+// ownerIDs returns the uid and gid of the system account that owns the user's mail
+/*
+   Example TOML:
+
+   deliver_as_owner = true
+   umask = "0007"
+
+   [owners]
+   family = "alice"
+
+   When letterbox runs as root, new maildirs, folders, mboxes, and messages
+   are given to the system account with the same name as the user they are
+   delivered to, after aliases, or the account from owners. Users without an
+   account keep mail owned by root. The umask sets their permissions, and
+   defaults to 0077 so only the owner can read them.
+*/
+func ownerIDs(name string) (int, int, bool) {
+	if !cfg.DeliverAsOwner || name == "" || os.Geteuid() != 0 {
+		return 0, 0, false
+	}
+	account := name
+	if a, ok := cfg.Owners[name]; ok {
+		account = a
+	}
+	u, err := user.Lookup(account)
+	if err != nil {
+		logDebugf("No account to own mail for %s: %s", name, err)
+		return 0, 0, false
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, false
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, false
+	}
+	return uid, gid, true
+}
+
+// setMailOwner sets the permissions of a new mail file or directory, and gives it to the user's account
+// An empty user is mail that isn't delivered to a user, like a backend's, which is left alone.
+func setMailOwner(path string, dir bool, name string) error {
+	if name == "" {
+		return nil
+	}
+	mode := 0666 &^ mailUmask()
+	if dir {
+		mode = 0777 &^ mailUmask()
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if uid, gid, ok := ownerIDs(name); ok {
+		return os.Lchown(path, uid, gid)
+	}
+	return nil
+}
+
+// createUserMaildir creates the user's maildir or folder, setting its owner if it is new
+// It returns true if the maildir didn't exist before.
+func createUserMaildir(name string, dir maildir.Dir) (bool, error) {
+	_, err := os.Stat(string(dir))
+	created := os.IsNotExist(err)
+	if err := dir.Create(); err != nil {
+		return created, err
+	}
+	if !created {
+		return false, nil
+	}
+	for _, sub := range []string{"", "tmp", "new", "cur"} {
+		if err := setMailOwner(filepath.Join(string(dir), sub), true, name); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestCheckOwnership(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	if mailUmask() != 0077 {
+		t.Errorf("Default umask is %o", mailUmask())
+	}
+	cfg.Umask = "027"
+	if err := checkOwnership(); err != nil || mailUmask() != 0027 {
+		t.Errorf("umask 027 = %o, %v", mailUmask(), err)
+	}
+	for _, bad := range []string{"9", "1777", "rw-"} {
+		cfg.Umask = bad
+		if err := checkOwnership(); err == nil {
+			t.Errorf("Bad umask %q accepted", bad)
+		}
+	}
+	cfg = config.Config{DeliverAsOwner: true, User: "letterbox"}
+	if err := checkOwnership(); err == nil {
+		t.Error("deliver_as_owner accepted with user")
+	}
+}
+
+func TestDeliverAsOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Only root can give mail to other accounts")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("No nobody account")
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com", "nosuchaccount@domain.com"}
+	cfg.DeliverAsOwner = true
+	cfg.Owners = map[string]string{"bcl": "nobody"}
+	cfg.Umask = "0027"
+	cfg.Formats = map[string]string{"nosuchaccount": "mbox"}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	for _, rcpt := range []string{"bcl@domain.com", "bcl+lists@domain.com", "nosuchaccount@domain.com"} {
+		if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{rcpt}, []byte("Subject: hi\r\n\r\nHello\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// checkOwner checks the path's owner and permissions
+	checkOwner := func(path string, owner int, mode os.FileMode) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if st := fi.Sys().(*syscall.Stat_t); int(st.Uid) != owner || fi.Mode().Perm() != mode {
+			t.Errorf("%s is owned by %d with mode %o, expected %d with %o", path, st.Uid, fi.Mode().Perm(), owner, mode)
+		}
+	}
+	inbox := filepath.Join(dir, "bcl")
+	for _, d := range []string{"", "new", "cur", "tmp", ".lists", ".lists/new"} {
+		checkOwner(filepath.Join(inbox, d), uid, 0750)
+	}
+	checkOwner(filepath.Join(inbox, ".lists", "maildirfolder"), uid, 0640)
+	for _, d := range []string{"new", ".lists/new"} {
+		files, _ := ioutil.ReadDir(filepath.Join(inbox, d))
+		if len(files) != 1 {
+			t.Fatalf("%d messages in %s", len(files), d)
+		}
+		checkOwner(filepath.Join(inbox, d, files[0].Name()), uid, 0640)
+	}
+
+	// Users without an account keep mail owned by root
+	checkOwner(filepath.Join(dir, "nosuchaccount.mbox"), 0, 0640)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/smtpd"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// pipeRcpt is a recipient whose mail is piped to a command
+type pipeRcpt struct {
+	rcpt string
+	user string
+	pipe config.Pipe
+}
+
+// defaultPipeTimeout is used when a pipe's timeout isn't set
+const defaultPipeTimeout = 30 * time.Second
+
+// pipeFailures are the sysexits.h exit codes that refuse the message for good
+// Any other failure, including EX_TEMPFAIL and a timeout, defers it so the
+// client tries again later.
+var pipeFailures = map[int]string{
+	65: "554 5.6.0 Error: message refused by delivery command", // EX_DATAERR
+	67: "550 5.1.1 Error: no such user",                        // EX_NOUSER
+	68: "550 5.1.2 Error: no such host",                        // EX_NOHOST
+	77: "550 5.7.1 Error: delivery not permitted",              // EX_NOPERM
+}
+
+// errPipeFailed is the reply when a delivery command fails, or exits with EX_TEMPFAIL
+var errPipeFailed = smtpd.SMTPError("451 4.3.0 Error: delivery command failed")
+
+// checkPipes checks the [[pipes]] config
+func checkPipes() error {
+	seen := make(map[string]bool)
+	for _, p := range cfg.Pipes {
+		if p.User == "" {
+			return fmt.Errorf("pipes entry without a user")
+		}
+		if seen[p.User] {
+			return fmt.Errorf("pipes user %s is listed twice", p.User)
+		}
+		seen[p.User] = true
+		if len(p.Command) == 0 {
+			return fmt.Errorf("pipes user %s needs a command", p.User)
+		}
+	}
+	return nil
+}
+
+// userPipe returns the command the user's mail is piped to
+func userPipe(user string) (config.Pipe, bool) {
+	for _, p := range cfg.Pipes {
+		if p.User == user {
+			if p.Schedule != "" && !scheduleActive(p.Schedule, time.Now()) {
+				return config.Pipe{}, false
+			}
+			return p, true
+		}
+	}
+	return config.Pipe{}, false
+}
+
+// runPipe runs the pipe's command with the message on stdin
+// It returns the SMTP error for the recipient, from the command's exit
+// code. Its output is logged when it fails.
+func runPipe(p config.Pipe, conn connInfo, env []string, data []byte) error {
+	timeout := p.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultPipeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		conn.logf("Delivery command for %s timed out after %s", p.User, timeout)
+		return errPipeFailed
+	}
+	conn.logf("Delivery command for %s failed: %s: %s", p.User, err, bytes.TrimSpace(out))
+	if exit, ok := err.(*exec.ExitError); ok {
+		if reply, ok := pipeFailures[exit.ExitCode()]; ok {
+			return smtpd.SMTPError(reply)
+		}
+	}
+	return errPipeFailed
+}
+
+// runPipes pipes the message to the command of each recipient that has one
+// Each recipient's failure is recorded for LMTP, and the first one is
+// returned.
+func (e *env) runPipes() error {
+	var firstErr error
+	for _, p := range e.pipes {
+		data := e.data.Bytes()
+		if !untraced(p.rcpt, p.user) {
+			data = append(deliveryHeader(e.from, p.rcpt), e.traced()...)
+		}
+		var clientIP string
+		if e.clientIP != nil {
+			clientIP = e.clientIP.String()
+		}
+		env := []string{
+			"LETTERBOX_USER=" + p.user,
+			"LETTERBOX_RCPT=" + p.rcpt,
+			"LETTERBOX_FROM=" + e.from,
+			"LETTERBOX_QUEUE_ID=" + e.conn.queueID,
+			"LETTERBOX_CLIENT_IP=" + clientIP,
+			"LETTERBOX_HELO=" + e.conn.helo,
+			"LETTERBOX_SIZE=" + strconv.Itoa(len(data)),
+		}
+		if err := runPipe(p.pipe, e.conn, env, data); err != nil {
+			if e.rcptErrors[p.rcpt] == nil {
+				e.rcptErrors[p.rcpt] = err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		logEvent(e.conn, "piped", "rcpt", "<"+p.rcpt+">", "user", p.user, "command", p.pipe.Command[0])
+		e.journalDelivery(p.rcpt, "piped", "")
+	}
+	return firstErr
+}
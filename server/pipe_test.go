@@ -0,0 +1,102 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckPipes(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	for _, pipes := range [][]config.Pipe{
+		{{Command: []string{"cat"}}},
+		{{User: "tickets"}},
+		{{User: "tickets", Command: []string{"cat"}}, {User: "tickets", Command: []string{"cat"}}},
+	} {
+		cfg.Pipes = pipes
+		if err := checkPipes(); err == nil {
+			t.Errorf("Bad pipes accepted: %#v", pipes)
+		}
+	}
+	cfg.Pipes = []config.Pipe{{User: "tickets", Command: []string{"cat"}}}
+	if err := checkPipes(); err != nil {
+		t.Errorf("Good pipes refused: %s", err)
+	}
+}
+
+func TestPipes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com", "tickets@domain.com"}
+	out := filepath.Join(dir, "out")
+	cfg.Pipes = []config.Pipe{{
+		User: "tickets",
+		// The body says what the command does
+		Command: []string{"/bin/sh", "-c", `msg=$(cat); case "$msg" in
+			*nouser*) exit 67;;
+			*tempfail*) exit 75;;
+			*slow*) exec sleep 5;;
+			esac
+			printf '%s\n%s\n%s\n' "$LETTERBOX_RCPT" "$LETTERBOX_FROM" "$msg" > ` + out},
+		Timeout: config.Duration{Duration: 500 * time.Millisecond},
+	}}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	send := func(body string) error {
+		return smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"tickets@domain.com"}, []byte("Subject: test\r\n\r\n"+body+"\r\n"))
+	}
+
+	if err := send("hello"); err != nil {
+		t.Fatalf("Piped message refused: %s", err)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil || !strings.HasPrefix(string(data), "tickets@domain.com\nsender@domain.com\nReturn-Path: <sender@domain.com>\r\nDelivered-To: tickets@domain.com\r\nReceived: ") || !strings.Contains(string(data), "\r\n\r\nhello\r\n") {
+		t.Errorf("Wrong message piped: %q %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(cmdline.Maildirs, "tickets")); !os.IsNotExist(err) {
+		t.Errorf("Piped message delivered to a maildir: %v", err)
+	}
+
+	// Exit codes from sysexits.h refuse it for good, other failures defer it
+	if err := send("nouser"); err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Errorf("EX_NOUSER not refused: %v", err)
+	}
+	if err := send("tempfail"); err == nil || !strings.HasPrefix(err.Error(), "451") {
+		t.Errorf("EX_TEMPFAIL not deferred: %v", err)
+	}
+	if err := send("slow"); err == nil || !strings.HasPrefix(err.Error(), "451") {
+		t.Errorf("Timeout not deferred: %v", err)
+	}
+
+	// Other recipients still get their copy, and the message is accepted so they don't get it twice
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com", "tickets@domain.com"}, []byte("Subject: test\r\n\r\ntempfail\r\n")); err != nil {
+		t.Errorf("Message refused after it was delivered: %s", err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(cmdline.Maildirs, "bcl", "new")); len(files) != 1 {
+		t.Errorf("Wrong number of messages delivered to bcl: %d", len(files))
+	}
+}
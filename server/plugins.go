@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"github.com/bcl/letterbox/events"
+	"net"
+	"time"
+)
+
+// eventHandlers are the loaded plugins, called in the order they are listed in the config
+var eventHandlers []events.Handler
+
+// loadPlugins loads the Go plugins and starts the external processes from the config
+/*
+   Example TOML:
+
+   [[plugins]]
+   path = "/usr/lib/letterbox/policy.so"
+
+   [[plugins]]
+   command = ["/usr/local/bin/letterbox-policy", "-v"]
+*/
+func loadPlugins() error {
+	for _, p := range cfg.Plugins {
+		var h events.Handler
+		var err error
+		switch {
+		case p.Path != "" && len(p.Command) > 0:
+			return errors.New("plugins need either a path or a command, not both")
+		case p.Path != "":
+			h, err = events.LoadPlugin(p.Path)
+		case len(p.Command) > 0:
+			h, err = events.StartProcess(p.Command)
+		default:
+			return errors.New("plugins need a path or a command")
+		}
+		if err != nil {
+			return err
+		}
+		eventHandlers = append(eventHandlers, h)
+	}
+	return nil
+}
+
+// newEvent returns an event of type t for the client
+func newEvent(t string, clientIP net.IP, conn connInfo) events.Event {
+	ev := events.Event{
+		Type:       t,
+		Time:       time.Now(),
+		Helo:       conn.helo,
+		TLSVersion: conn.tlsVersion,
+		TLSCipher:  conn.tlsCipher,
+		AuthUser:   conn.authUser,
+	}
+	if clientIP != nil {
+		ev.ClientIP = clientIP.String()
+	}
+	return ev
+}
+
+// pluginConnect passes a new connection to the plugins, any of which can reject it
+func pluginConnect(clientIP net.IP) error {
+	ev := newEvent(events.Connect, clientIP, connInfo{})
+	for _, h := range eventHandlers {
+		if err := h.OnConnect(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pluginRcpt passes a recipient to the plugins, any of which can reject it
+func pluginRcpt(clientIP net.IP, conn connInfo, from, rcpt string) error {
+	ev := newEvent(events.Rcpt, clientIP, conn)
+	ev.From = from
+	ev.Rcpt = rcpt
+	for _, h := range eventHandlers {
+		if err := h.OnRcpt(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pluginDelivered tells the plugins that a message was delivered to a recipient's maildir
+func pluginDelivered(clientIP net.IP, conn connInfo, from, rcpt, maildir string) {
+	ev := newEvent(events.Delivered, clientIP, conn)
+	ev.From = from
+	ev.Rcpt = rcpt
+	ev.Maildir = maildir
+	for _, h := range eventHandlers {
+		h.OnDelivered(ev)
+	}
+}
+
+// pluginReject tells the plugins that a connection or recipient was rejected
+func pluginReject(clientIP net.IP, conn connInfo, from, rcpt, code, reason string) {
+	ev := newEvent(events.Reject, clientIP, conn)
+	ev.From = from
+	ev.Rcpt = rcpt
+	ev.Code = code
+	ev.Reason = reason
+	for _, h := range eventHandlers {
+		h.OnReject(ev)
+	}
+}
+
+// reject logs a rejection with its reason code and tells the plugins about it
+// code is one of the events.Reason codes, reason is the text sent to the client.
+func reject(clientIP net.IP, conn connInfo, from, rcpt, code, reason string) {
+	var ip string
+	if clientIP != nil {
+		ip = clientIP.String()
+	}
+	logEvent(conn, "reject", "code", code, "ip", ip, "from", "<"+from+">", "rcpt", "<"+rcpt+">", "msg", reason)
+	recordRejected(ip, conn, from, rcpt, code, reason)
+	pluginReject(clientIP, conn, from, rcpt, code, reason)
+}
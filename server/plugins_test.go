@@ -0,0 +1,76 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/events"
+	"net"
+	"net/smtp"
+	"sync"
+	"testing"
+)
+
+// recordingHandler is an events.Handler that remembers the reject events
+type recordingHandler struct {
+	sync.Mutex
+	rejects []events.Event
+}
+
+func (h *recordingHandler) OnConnect(ev events.Event) error { return nil }
+func (h *recordingHandler) OnRcpt(ev events.Event) error    { return nil }
+func (h *recordingHandler) OnDelivered(ev events.Event)     {}
+func (h *recordingHandler) OnReject(ev events.Event) {
+	h.Lock()
+	defer h.Unlock()
+	h.rejects = append(h.rejects, ev)
+}
+
+func TestRejectCodes(t *testing.T) {
+	defer func() {
+		cfg = config.Config{}
+		allowedList = access.List{}
+		eventHandlers = nil
+	}()
+	h := &recordingHandler{}
+	eventHandlers = []events.Handler{h}
+	cfg.Emails = []string{"bcl@domain.com"}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("localhost", nil).Serve(ln)
+
+	// Not in the hosts list
+	if client, err := smtp.Dial(ln.Addr().String()); err == nil {
+		client.Mail("sender@domain.com")
+		client.Close()
+	}
+
+	cfg.Hosts = []string{"127.0.0.1"}
+	parseHosts()
+	client, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Mail("sender@domain.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt("stranger@domain.com"); err == nil {
+		t.Error("Recipient not in the whitelist was accepted")
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if len(h.rejects) != 2 {
+		t.Fatalf("Expected 2 reject events, got %v", h.rejects)
+	}
+	if ev := h.rejects[0]; ev.Code != events.ReasonHostNotAllowed || ev.ClientIP != "127.0.0.1" {
+		t.Errorf("Wrong event for an unlisted host: %#v", ev)
+	}
+	if ev := h.rejects[1]; ev.Code != events.ReasonRcptNotAllowed || ev.Rcpt != "stranger@domain.com" || ev.From != "sender@domain.com" {
+		t.Errorf("Wrong event for an unlisted recipient: %#v", ev)
+	}
+}
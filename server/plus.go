@@ -0,0 +1,167 @@
+package server
+
+import (
+	"fmt"
+	"github.com/luksen/maildir"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// folderRE matches the folder names that can be used with plus addressing
+// Letters and digits can be from any script, for UTF-8 addresses.
+var folderRE = regexp.MustCompile(`^[\p{L}\p{N}_-]+(\.[\p{L}\p{N}_-]+)*$`)
+
+// splitPlus splits a user+folder@domain address into user@domain and folder
+// Addresses without a tag, or with a tag that isn't a usable folder name, are
+// returned unchanged with an empty folder.
+func splitPlus(address string) (string, string) {
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return address, ""
+	}
+	i := strings.Index(address[:at], "+")
+	if i == -1 {
+		return address, ""
+	}
+	folder := address[i+1 : at]
+	if !folderRE.MatchString(folder) {
+		return address, ""
+	}
+	return address[:i] + address[at:], folder
+}
+
+// whitelisted returns the whitelisted address that rcpt matches and the folder to deliver to
+// An exact match wins, so listed addresses that contain a + keep working. Otherwise
+// the tag is stripped from user+folder@domain and the rest must be in the list.
+// Entries can also be patterns like *@domain.com, and then the address itself
+// is returned.
+func whitelisted(emails []string, rcpt string) (string, string, bool) {
+	for _, user := range emails {
+		if rcpt == user {
+			return user, "", true
+		}
+	}
+	base, folder := splitPlus(rcpt)
+	if folder != "" {
+		for _, user := range emails {
+			if base == user {
+				return user, folder, true
+			}
+		}
+		if matchPatterns(emails, base) {
+			return base, folder, true
+		}
+	}
+	if matchPatterns(emails, rcpt) {
+		return rcpt, "", true
+	}
+	return "", "", false
+}
+
+// folderMode returns what to do with mail for a folder that doesn't exist yet
+/*
+   Example TOML:
+
+   plus_folders = "reject"
+
+   "create" makes a new folder, and is the default. "inbox" delivers to the
+   user's inbox instead, and "reject" refuses the recipient.
+*/
+func folderMode() string {
+	if cfg.PlusFolders == "" {
+		return "create"
+	}
+	return strings.ToLower(cfg.PlusFolders)
+}
+
+// checkPlusFolders checks the plus_folders setting
+func checkPlusFolders() error {
+	switch folderMode() {
+	case "create", "inbox", "reject":
+		return nil
+	}
+	return fmt.Errorf("unknown plus_folders setting: %s", cfg.PlusFolders)
+}
+
+// folderExists returns true if the user's maildir has the Maildir++ folder, or the user's folder mbox exists
+func folderExists(user, folder string) bool {
+	if deliveryFormat(user) == "mbox" {
+		fi, err := os.Stat(path.Join(cmdline.Maildirs, user+"."+folder+".mbox"))
+		return err == nil && fi.Mode().IsRegular()
+	}
+	inbox, err := maildirPath(user)
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(path.Join(inbox, "."+encodeMailboxName(folder)))
+	return err == nil && fi.IsDir()
+}
+
+// userInbox returns the user's inbox, creating it and the directories above it if needed
+// With deliver_as_owner the directories above it can be searched by everyone,
+// so the owner can reach it.
+func userInbox(user string) (maildir.Dir, error) {
+	dir, err := maildirPath(user)
+	if err != nil {
+		return "", err
+	}
+	inbox := maildir.Dir(dir)
+	parentMode := os.FileMode(0700)
+	if cfg.DeliverAsOwner {
+		parentMode = 0711
+	}
+	if err := os.MkdirAll(path.Dir(dir), parentMode); err != nil {
+		return inbox, err
+	}
+	created, err := createUserMaildir(user, inbox)
+	if err != nil {
+		return inbox, err
+	}
+	if created {
+		createDomainFolders(user)
+	}
+	return inbox, nil
+}
+
+// userMaildir returns the maildir to deliver to for the user and folder, creating it if needed
+// An empty folder is the user's inbox.
+func userMaildir(user, folder string) (maildir.Dir, error) {
+	inbox, err := userInbox(user)
+	if err != nil {
+		return inbox, err
+	}
+	if folder == "" {
+		return inbox, nil
+	}
+	if !folderExists(user, folder) && folderMode() == "inbox" {
+		return inbox, nil
+	}
+	return maildirFolder(user, folder)
+}
+
+// maildirFolder returns one of the user's folders, creating it if needed
+// Folders are Maildir++ style, .folder under the inbox, with a maildirfolder
+// file to mark them. The name is in modified UTF-7 on disk.
+func maildirFolder(user, folder string) (maildir.Dir, error) {
+	inbox, err := userInbox(user)
+	if err != nil {
+		return inbox, err
+	}
+	dir := maildir.Dir(path.Join(string(inbox), "."+encodeMailboxName(folder)))
+	if _, err := createUserMaildir(user, dir); err != nil {
+		return dir, err
+	}
+	marker := path.Join(string(dir), "maildirfolder")
+	if _, err := os.Stat(marker); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(marker, nil, 0600); err != nil {
+			return dir, err
+		}
+		if err := setMailOwner(marker, false, user); err != nil {
+			return dir, err
+		}
+	}
+	return dir, nil
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitPlus(t *testing.T) {
+	tests := []struct {
+		address string
+		base    string
+		folder  string
+	}{
+		{"bcl@domain.com", "bcl@domain.com", ""},
+		{"bcl+alerts@domain.com", "bcl@domain.com", "alerts"},
+		{"bcl+lists.go@domain.com", "bcl@domain.com", "lists.go"},
+		{"bcl+@domain.com", "bcl+@domain.com", ""},
+		{"bcl+../etc@domain.com", "bcl+../etc@domain.com", ""},
+		{"bcl+a/b@domain.com", "bcl+a/b@domain.com", ""},
+		{"bcl+alerts", "bcl+alerts", ""},
+		{"bücher+entwürfe@domain.com", "bücher@domain.com", "entwürfe"},
+	}
+	for _, tt := range tests {
+		base, folder := splitPlus(tt.address)
+		if base != tt.base || folder != tt.folder {
+			t.Errorf("splitPlus(%q) = %q, %q, expected %q, %q", tt.address, base, folder, tt.base, tt.folder)
+		}
+	}
+}
+
+func TestWhitelisted(t *testing.T) {
+	emails := []string{"bcl@domain.com", "alice+work@domain.com", "*@devices.lan"}
+
+	tests := []struct {
+		rcpt   string
+		user   string
+		folder string
+		ok     bool
+	}{
+		{"bcl@domain.com", "bcl@domain.com", "", true},
+		{"bcl+alerts@domain.com", "bcl@domain.com", "alerts", true},
+		{"alice+work@domain.com", "alice+work@domain.com", "", true},
+		{"alice+home@domain.com", "", "", false},
+		{"bob+alerts@domain.com", "", "", false},
+		{"camera@devices.lan", "camera@devices.lan", "", true},
+		{"camera+motion@devices.lan", "camera@devices.lan", "motion", true},
+		{"camera@other.lan", "", "", false},
+	}
+	for _, tt := range tests {
+		user, folder, ok := whitelisted(emails, tt.rcpt)
+		if user != tt.user || folder != tt.folder || ok != tt.ok {
+			t.Errorf("whitelisted(%q) = %q, %q, %v", tt.rcpt, user, folder, ok)
+		}
+	}
+}
+
+func TestUserMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg.PlusFolders = ""
+	}()
+	cmdline.Maildirs = dir
+
+	// Unknown folders are created by default
+	d, err := userMaildir("bcl", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(d) != filepath.Join(dir, "bcl", ".alerts") {
+		t.Errorf("Wrong folder: %s", d)
+	}
+	for _, name := range []string{"new", "cur", "tmp", "maildirfolder"} {
+		if _, err := os.Stat(filepath.Join(string(d), name)); err != nil {
+			t.Errorf("Folder is missing %s: %s", name, err)
+		}
+	}
+
+	// Unknown folders fall back to the inbox, existing ones are still used
+	cfg.PlusFolders = "inbox"
+	if d, err := userMaildir("bcl", "other"); err != nil || string(d) != filepath.Join(dir, "bcl") {
+		t.Errorf("Unknown folder not delivered to inbox: %s %v", d, err)
+	}
+	if d, err := userMaildir("bcl", "alerts"); err != nil || string(d) != filepath.Join(dir, "bcl", ".alerts") {
+		t.Errorf("Existing folder not used: %s %v", d, err)
+	}
+	if !folderExists("bcl", "alerts") || folderExists("bcl", "other") {
+		t.Error("folderExists is wrong")
+	}
+
+	cfg.PlusFolders = "bogus"
+	if err := checkPlusFolders(); err == nil {
+		t.Error("Bad plus_folders setting did not return an error")
+	}
+}
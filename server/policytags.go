@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"github.com/bcl/letterbox/smtpd"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// policyTagHeader is the header each policy tag is written as
+const policyTagHeader = "X-Letterbox-Tag"
+
+// policyTagRE matches the names that can be used as policy tags
+var policyTagRE = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// policyTagsEnabled returns true if policy tags are written to the messages
+/*
+   Example TOML:
+
+   policy_tags = true
+
+   Each tag is added to the message as an X-Letterbox-Tag header, so Sieve
+   scripts and mail clients can file or search by them, and X-Letterbox-Tag
+   headers the client sent are removed. Tags are recorded in the journal
+   whether or not they are written to the messages.
+*/
+func policyTagsEnabled() bool {
+	return cfg.PolicyTags
+}
+
+// addTag attaches a policy tag to the message
+// Names are lowercased, and ones that aren't letters, digits, ., _, and -
+// are skipped. Each tag is only added once.
+func (e *env) addTag(name string) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !policyTagRE.MatchString(name) {
+		logDebugf("Skipping bad policy tag %q", name)
+		return
+	}
+	for _, t := range e.tags {
+		if t == name {
+			return
+		}
+	}
+	e.tags = append(e.tags, name)
+}
+
+// tagClient adds the tags for how the client connected, and for the checks of MAIL FROM
+func (e *env) tagClient(c smtpd.Connection) {
+	switch {
+	case localSocket(c):
+		e.addTag("local")
+	case hostAllowed(e.clientIP):
+		e.addTag("trusted-network")
+	}
+	if e.clientIP != nil && hostExempt(e.clientIP) {
+		e.addTag("exempt-host")
+	}
+	if e.conn.authUser != "" || e.conn.identity != "" {
+		e.addTag("authenticated")
+	}
+	if dnsblAction() == "tag" && e.clientIP != nil && !hostAllowed(e.clientIP) && !hostExempt(e.clientIP) {
+		if zone, _ := dnsblListed(e.clientIP, time.Now()); zone != "" {
+			e.addTag("dnsbl-hit")
+		}
+	}
+	switch e.spf {
+	case spfFail, spfSoftfail:
+		e.addTag("spf-" + string(e.spf))
+	}
+	switch e.domainCheck {
+	case domainNone, domainNullMX:
+		e.addTag("sender-domain-" + string(e.domainCheck))
+	}
+}
+
+// tagHeader adds the tags for the checks of the message's header
+func (e *env) tagHeader() {
+	switch e.dateCheck {
+	case dateInvalid, dateFuture, datePast:
+		e.addTag("bad-date")
+	}
+}
+
+// tagHeaders returns the X-Letterbox-Tag headers for the tags that haven't been written yet
+func (e *env) tagHeaders() []byte {
+	if !policyTagsEnabled() {
+		return nil
+	}
+	var b bytes.Buffer
+	for _, t := range e.tags[e.tagsWritten:] {
+		b.Write(foldHeader(policyTagHeader, t))
+	}
+	e.tagsWritten = len(e.tags)
+	return b.Bytes()
+}
+
+// spoofedTag returns true if the header line is part of an X-Letterbox-Tag header the client sent
+// Only letterbox may set the tags, so they are dropped from the message when
+// policy_tags is on.
+func (e *env) spoofedTag(line []byte) bool {
+	if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+		return e.inSpoofedTag
+	}
+	e.inSpoofedTag = policyTagsEnabled() && len(line) > len(policyTagHeader) &&
+		strings.EqualFold(string(line[:len(policyTagHeader)+1]), policyTagHeader+":")
+	return e.inSpoofedTag
+}
+
+// setTagHeaders replaces the client's X-Letterbox-Tag headers with the message's tags, for the filters
+func (e *env) setTagHeaders(headers mail.Header) {
+	if !policyTagsEnabled() {
+		return
+	}
+	delete(headers, policyTagHeader)
+	if len(e.tags) > 0 {
+		headers[policyTagHeader] = append([]string{}, e.tags...)
+	}
+}
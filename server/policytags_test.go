@@ -0,0 +1,113 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAddTag(t *testing.T) {
+	e := &env{}
+	for _, name := range []string{"dnsbl-hit", " Trusted-Network ", "dnsbl-hit", "bad tag", "-dash", "spf-fail"} {
+		e.addTag(name)
+	}
+	if !reflect.DeepEqual(e.tags, []string{"dnsbl-hit", "trusted-network", "spf-fail"}) {
+		t.Errorf("Wrong tags: %v", e.tags)
+	}
+
+	defer func() { cfg = config.Config{} }()
+	if h := e.tagHeaders(); h != nil {
+		t.Errorf("Tag headers written without policy_tags: %q", h)
+	}
+	cfg.PolicyTags = true
+	e.tagsWritten = 0
+	if h := string(e.tagHeaders()); h != "X-Letterbox-Tag: dnsbl-hit\r\nX-Letterbox-Tag: trusted-network\r\nX-Letterbox-Tag: spf-fail\r\n" {
+		t.Errorf("Wrong tag headers: %q", h)
+	}
+	e.addTag("junk")
+	if h := string(e.tagHeaders()); h != "X-Letterbox-Tag: junk\r\n" {
+		t.Errorf("Tags written twice: %q", h)
+	}
+}
+
+func TestSpoofedTag(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	cfg.PolicyTags = true
+	e := &env{}
+	for _, tt := range []struct {
+		line    string
+		spoofed bool
+	}{
+		{"Subject: hi\r\n", false},
+		{"x-letterbox-tag: trusted-network\r\n", true},
+		{"\tfolded\r\n", true},
+		{"X-Letterbox-Tagged: no\r\n", false},
+		{" folded\r\n", false},
+	} {
+		if spoofed := e.spoofedTag([]byte(tt.line)); spoofed != tt.spoofed {
+			t.Errorf("spoofedTag(%q) = %v", tt.line, spoofed)
+		}
+	}
+}
+
+func TestPolicyTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	cfg.Journal = filepath.Join(dir, "journal.jsonl")
+	cfg.DateCheck = "mark"
+	cfg.PolicyTags = true
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	msg := []byte("Date: Mon, 02 Jan 2006 15:04:05 +0000\r\nX-Letterbox-Tag: vip\r\n\tadmin\r\nSubject: test\r\n\r\nHi\r\n")
+	if err := smtp.SendMail(ln.Addr().String(), nil, "alice@example.com", []string{"bcl@domain.com"}, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(cmdline.Maildirs, "bcl", "new"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Message not delivered: %v", err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(cmdline.Maildirs, "bcl", "new", files[0].Name()))
+	if !strings.Contains(string(data), "X-Letterbox-Tag: trusted-network\r\nX-Letterbox-Tag: bad-date\r\n\r\nHi") {
+		t.Errorf("Tags not added at the end of the header: %q", data)
+	}
+	if strings.Contains(string(data), "vip") || strings.Contains(string(data), "admin") {
+		t.Errorf("Client's tag not removed: %q", data)
+	}
+
+	var tagged []journalEntry
+	readJournal(cfg.Journal, journalQuery{tag: "BAD-DATE"}, func(e journalEntry) { tagged = append(tagged, e) })
+	if len(tagged) != 2 || !reflect.DeepEqual(tagged[0].Tags, []string{"trusted-network", "bad-date"}) {
+		t.Errorf("Wrong tagged journal entries: %#v", tagged)
+	}
+	n := 0
+	readJournal(cfg.Journal, journalQuery{tag: "dnsbl-hit"}, func(journalEntry) { n++ })
+	if n != 0 {
+		t.Errorf("%d entries for a tag the message doesn't have", n)
+	}
+}
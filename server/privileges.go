@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// runAs returns the uid, gid, and supplementary groups of the user and group from the config
+func runAs() (int, int, []int, error) {
+	u, err := user.Lookup(cfg.User)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	var groups []int
+	if cfg.Group != "" {
+		g, err := user.LookupGroup(cfg.Group)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, nil, err
+		}
+	} else if ids, err := u.GroupIds(); err == nil {
+		// The user's other groups, like one that can read the TLS key
+		for _, id := range ids {
+			if g, err := strconv.Atoi(id); err == nil {
+				groups = append(groups, g)
+			}
+		}
+	}
+	if len(groups) == 0 {
+		groups = []int{gid}
+	}
+	return uid, gid, groups, nil
+}
+
+// fileOwner returns the uid that owns the file
+func fileOwner(path string) (int, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("can't read the owner of %s", path)
+	}
+	return int(st.Uid), nil
+}
+
+// checkMaildirOwners returns an error if the top of the maildirs isn't owned by uid
+// Users' maildirs owned by someone else are logged, because delivery to them will fail.
+func checkMaildirOwners(uid int) error {
+	owner, err := fileOwner(cmdline.Maildirs)
+	if err != nil {
+		return err
+	}
+	if owner != uid {
+		return fmt.Errorf("%s is owned by uid %d, not %s (uid %d)", cmdline.Maildirs, owner, cfg.User, uid)
+	}
+	files, err := ioutil.ReadDir(cmdline.Maildirs)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if st, ok := f.Sys().(*syscall.Stat_t); ok && f.IsDir() && int(st.Uid) != uid {
+			log.Printf("Warning: %s is owned by uid %d, not %s", filepath.Join(cmdline.Maildirs, f.Name()), st.Uid, cfg.User)
+		}
+	}
+	return nil
+}
+
+// dropPrivileges switches to the user and group from the config when letterbox is started as root
+/*
+   Example TOML:
+
+   user = "letterbox"
+   group = "mail"
+
+   It is called once the listeners are open, so letterbox can bind port 25 and
+   then handle mail as an unprivileged user. The group defaults to the user's
+   primary group, plus the other groups the user is in. The maildirs must be
+   owned by the user. The queue directory is created as root, so it is given
+   to the user. syscall.Setuid and Setgid only change every thread on Linux
+   since Go 1.16, before that they return EOPNOTSUPP.
+*/
+func dropPrivileges() error {
+	if cfg.User == "" {
+		return nil
+	}
+	uid, gid, groups, err := runAs()
+	if err != nil {
+		return err
+	}
+	if os.Geteuid() != 0 {
+		// Already running as the user, after an upgrade or when started by systemd
+		if os.Geteuid() == uid {
+			return checkMaildirOwners(uid)
+		}
+		return fmt.Errorf("not running as root, can't switch to %s", cfg.User)
+	}
+	if queueEnabled() {
+		for _, dir := range []string{cfg.Queue.Dir, filepath.Join(cfg.Queue.Dir, queueFailedDir)} {
+			if err := os.Chown(dir, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+	// The group has to be changed while still root
+	if err := syscall.Setgroups(groups); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return err
+	}
+	log.Printf("letterbox: running as %s (uid %d, gid %d)", cfg.User, uid, gid)
+	return checkMaildirOwners(uid)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"testing"
+)
+
+func TestRunAs(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	u, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	cfg.User = u.Username
+	uid, gid, groups, err := runAs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strconv.Itoa(uid) != u.Uid || strconv.Itoa(gid) != u.Gid || len(groups) == 0 {
+		t.Errorf("runAs = %d, %d, %v for %s", uid, gid, groups, u.Username)
+	}
+
+	cfg.User = "no-such-letterbox-user"
+	if _, _, _, err := runAs(); err == nil {
+		t.Error("Unknown user accepted")
+	}
+	if err := dropPrivileges(); err == nil {
+		t.Error("Dropped privileges to an unknown user")
+	}
+	cfg.User = u.Username
+	cfg.Group = "no-such-letterbox-group"
+	if _, _, _, err := runAs(); err == nil {
+		t.Error("Unknown group accepted")
+	}
+}
+
+func TestCheckMaildirOwners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() { cmdline.Maildirs = maildirs }()
+	cmdline.Maildirs = dir
+
+	if err := checkMaildirOwners(os.Getuid()); err != nil {
+		t.Errorf("Maildirs owned by the user refused: %s", err)
+	}
+	if err := checkMaildirOwners(os.Getuid() + 1); err == nil {
+		t.Error("Maildirs owned by someone else accepted")
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/bcl/letterbox/access"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyList is the proxies that send a PROXY protocol header
+// It is protected by configLock.
+var proxyList access.List
+
+// proxyHeaderTimeout is how long a proxy has to send the PROXY header
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts a version 2 PROXY header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// hostProxy returns true if the IP is in the proxy_hosts list
+/*
+   Example TOML:
+
+   proxy_hosts = ["10.0.0.5", "10.1.0.0/24"]
+
+   Connections from a proxy must start with a PROXY protocol version 1 or 2
+   header, as sent by HAProxy's send-proxy or send-proxy-v2, and the client
+   address from it is used instead of the proxy's. Connections from other
+   hosts are used as they are, so clients can't claim another address.
+*/
+func hostProxy(ip net.IP) bool {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return proxyList.Contains(ip)
+}
+
+// proxyListener accepts connections that may come through a proxy
+type proxyListener struct {
+	net.Listener
+}
+
+// listenProxy returns the listener, reading PROXY headers from the proxy_hosts if it is TCP
+func listenProxy(ln net.Listener) net.Listener {
+	if ln.Addr().Network() != "tcp" {
+		return ln
+	}
+	return proxyListener{ln}
+}
+
+// Accept returns the next connection
+// The PROXY header is read when the connection is first used, so a slow proxy
+// doesn't hold up the other connections.
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok || !hostProxy(addr.IP) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn is a connection from a proxy, which is reported as coming from the client
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr // the client's address from the header, or the proxy's if it didn't send one
+	err    error    // error reading the header, returned by Read
+}
+
+// readHeader reads the PROXY header the first time it is called
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		addr, err := readProxyHeader(c.r)
+		if err != nil {
+			c.err = fmt.Errorf("bad PROXY header from %s: %s", c.remote, err)
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+}
+
+// RemoteAddr returns the client's address from the PROXY header
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remote
+}
+
+// Read reads from the connection after the PROXY header
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY header, returning the client's address
+// A nil address means the proxy sent the connection on its own behalf, like a
+// health check, and the proxy's address should be used.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	return readProxyV1(r)
+}
+
+// readProxyV1 reads a text header like "PROXY TCP4 192.168.1.5 10.0.0.1 56324 25\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("no header line")
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("no header line")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("bad header line %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("bad source address in %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads a binary header
+// Only the source address is used, the TLVs after the addresses are skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unknown version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	// LOCAL connections are the proxy's own, like health checks
+	if header[12]&0xf == 0 {
+		return nil, nil
+	}
+	if header[12]&0xf != 1 {
+		return nil, fmt.Errorf("unknown command %d", header[12]&0xf)
+	}
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// Other families, like Unix sockets, have no client IP to use
+	return nil, nil
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header returns a version 2 PROXY header for a TCP connection from src
+func proxyV2Header(src *net.TCPAddr) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	if ip4 := src.IP.To4(); ip4 != nil {
+		header = append(header, 0x21, 0x11, 0, 12)
+		header = append(header, ip4...)
+		header = append(header, 10, 0, 0, 1)
+	} else {
+		header = append(header, 0x21, 0x21, 0, 36)
+		header = append(header, src.IP.To16()...)
+		header = append(header, net.ParseIP("::1").To16()...)
+	}
+	port := make([]byte, 4)
+	binary.BigEndian.PutUint16(port, uint16(src.Port))
+	binary.BigEndian.PutUint16(port[2:], 25)
+	return append(header, port...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		addr   string // "" for the proxy's own address
+		bad    bool
+	}{
+		{"PROXY TCP4 192.168.1.5 10.0.0.1 56324 25\r\n", "192.168.1.5:56324", false},
+		{"PROXY TCP6 2001:db8::5 2001:db8::1 56324 25\r\n", "[2001:db8::5]:56324", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("192.168.1.5"), Port: 56324})), "192.168.1.5:56324", false},
+		{string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::5"), Port: 56324})), "[2001:db8::5]:56324", false},
+		{string(proxyV2Signature) + "\x20\x00\x00\x00", "", false},
+		{"EHLO client.lan\r\n", "", true},
+		{"PROXY TCP4 not-an-ip 10.0.0.1 56324 25\r\n", "", true},
+		{"PROXY TCP4 192.168.1.5 10.0.0.1 56324\r\n", "", true},
+		{"PROXY TCP4 192.168.1.5 10.0.0.1 56324 25", "", true},
+		{string(proxyV2Signature) + "\x31\x11\x00\x00", "", true},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReader(strings.NewReader(tt.header + "EHLO client.lan\r\n"))
+		addr, err := readProxyHeader(r)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("Bad header %q accepted", tt.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Header %q refused: %s", tt.header, err)
+			continue
+		}
+		if (addr == nil && tt.addr != "") || (addr != nil && addr.String() != tt.addr) {
+			t.Errorf("Header %q gave %v, expected %q", tt.header, addr, tt.addr)
+		}
+		if rest, _ := r.ReadString('\n'); rest != "EHLO client.lan\r\n" {
+			t.Errorf("Header %q left %q", tt.header, rest)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		parseHosts()
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"192.168.1.5"}
+	cfg.ProxyHosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(listenProxy(ln))
+
+	// send sends a message through a connection that starts with header
+	send := func(c net.Conn, header []byte) error {
+		defer c.Close()
+		if _, err := c.Write(header); err != nil {
+			t.Fatal(err)
+		}
+		client, err := smtp.NewClient(c, "mx.domain.com")
+		if err != nil {
+			return err
+		}
+		if err := client.Mail("sender@domain.com"); err != nil {
+			return err
+		}
+		if err := client.Rcpt("bcl@domain.com"); err != nil {
+			return err
+		}
+		w, err := client.Data()
+		if err != nil {
+			return err
+		}
+		w.Write([]byte("Subject: proxied\r\n\r\nHello\r\n"))
+		if err := w.Close(); err != nil {
+			return err
+		}
+		return client.Quit()
+	}
+
+	for _, header := range [][]byte{
+		[]byte("PROXY TCP4 192.168.1.5 127.0.0.1 56324 25\r\n"),
+		proxyV2Header(&net.TCPAddr{IP: net.ParseIP("192.168.1.5"), Port: 56324}),
+	} {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := send(c, header); err != nil {
+			t.Fatalf("Message through the proxy refused: %s", err)
+		}
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new"))
+	if len(files) != 2 {
+		t.Fatalf("%d messages delivered", len(files))
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "bcl", "new", files[0].Name()))
+	if !strings.Contains(string(data), "[192.168.1.5]") || strings.Contains(string(data), "127.0.0.1") {
+		t.Errorf("Received header doesn't have the client's address: %q", data)
+	}
+
+	// The proxy's own connections keep its address, which isn't in the hosts list
+	if c, err := net.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	} else if err := send(c, []byte("PROXY UNKNOWN\r\n")); err == nil {
+		t.Error("Health check connection used a client address")
+	}
+
+	// Other hosts can't claim an address
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}
+	if c, err := d.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	} else if err := send(c, []byte("PROXY TCP4 192.168.1.5 127.0.0.1 56324 25\r\n")); err == nil {
+		t.Error("PROXY header accepted from a host that isn't a proxy")
+	}
+}
@@ -0,0 +1,407 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bcl/letterbox/delivery"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for the queue's retry timing
+const (
+	defaultQueueRetry    = time.Minute
+	defaultQueueMaxRetry = time.Hour
+	defaultQueueMaxAge   = 5 * 24 * time.Hour
+)
+
+// queueFailedDir is the directory in the queue that messages are moved to when they are too old
+const queueFailedDir = "failed"
+
+// queuedDelivery is one maildir that a queued message still has to be delivered to
+// or, with Relay set, a recipient that still has to be relayed to the smarthost.
+type queuedDelivery struct {
+	User     string `json:"user,omitempty"`
+	Folder   string `json:"folder,omitempty"`
+	Rcpt     string `json:"rcpt"`
+	Untraced bool   `json:"untraced,omitempty"` // deliver without the Received and other trace headers
+	Relay    bool   `json:"relay,omitempty"`    // relay to the smarthost, held back by the relay caps
+	Helo     string `json:"helo,omitempty"`     // name to greet the smarthost with
+	Schedule string `json:"schedule,omitempty"` // recipient schedule the delivery waits for
+}
+
+// queueEntry is the envelope of a queued message, stored next to the message as id.json
+type queueEntry struct {
+	ID         string           `json:"id"`
+	From       string           `json:"from"`
+	Deliveries []queuedDelivery `json:"deliveries"`
+	Trace      int              `json:"trace,omitempty"` // length of the trace headers at the start of the message
+	Created    time.Time        `json:"created"`
+	Attempts   int              `json:"attempts"`
+	Next       time.Time        `json:"next"`
+}
+
+// queueEnabled returns true if failed deliveries are queued
+func queueEnabled() bool {
+	return cfg.Queue.Dir != ""
+}
+
+// setupQueue creates the queue directory
+/*
+   Example TOML:
+
+   [queue]
+   dir = "/var/spool/letterbox/queue"
+   retry = "1m"
+   max_retry = "1h"
+   max_age = "120h"
+   bounces = true
+   bounce_from = "postmaster@domain.com"
+*/
+func setupQueue() error {
+	if err := checkQueue(); err != nil || !queueEnabled() {
+		return err
+	}
+	return os.MkdirAll(filepath.Join(cfg.Queue.Dir, queueFailedDir), 0700)
+}
+
+// checkQueue checks the [queue] config
+func checkQueue() error {
+	if cfg.Queue.Bounces && !queueEnabled() {
+		return fmt.Errorf("queue bounces need a queue dir")
+	}
+	if cfg.Queue.Bounces && cfg.Relay.Host == "" {
+		return fmt.Errorf("queue bounces are sent through the relay, they need a relay host")
+	}
+	return nil
+}
+
+// retryDelay returns how long to wait before the next attempt, after attempts failures
+func retryDelay(attempts int) time.Duration {
+	delay, max := cfg.Queue.Retry.Duration, cfg.Queue.MaxRetry.Duration
+	if delay == 0 {
+		delay = defaultQueueRetry
+	}
+	if max == 0 {
+		max = defaultQueueMaxRetry
+	}
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path
+// With sync the file and its directory are synced to disk.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil && syncEnabled() {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if syncEnabled() {
+		return delivery.SyncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// saveEntry writes the queue entry's envelope
+func saveEntry(entry *queueEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(cfg.Queue.Dir, entry.ID+".json"), data)
+}
+
+// enqueue spools the message to the queue to be delivered to the maildirs later
+// The message is written before its envelope, so the queue runner never sees
+// an envelope without its message. id is the message's queue ID from the log.
+// trace is the length of the headers letterbox added to the start of data,
+// which are left off for untraced recipients.
+func enqueue(id, from string, deliveries []queuedDelivery, data []byte, trace int, now time.Time) error {
+	if err := writeFileAtomic(filepath.Join(cfg.Queue.Dir, id+".eml"), data); err != nil {
+		return err
+	}
+	entry := &queueEntry{
+		ID:         id,
+		From:       from,
+		Deliveries: deliveries,
+		Trace:      trace,
+		Created:    now,
+		Attempts:   1,
+		Next:       now.Add(retryDelay(1)),
+	}
+	if err := saveEntry(entry); err != nil {
+		os.Remove(filepath.Join(cfg.Queue.Dir, id+".eml"))
+		return err
+	}
+	logEvent(connInfo{queueID: id}, "queued", "deliveries", strconv.Itoa(len(deliveries)), "retry", entry.Next.Format(time.RFC3339))
+	return nil
+}
+
+// deliverMessage writes the message to the queued recipient's maildir or mbox
+// It returns the finished delivery, for where the message went.
+func deliverMessage(q queuedDelivery, from string, data []byte) (*delivery.Delivery, error) {
+	user, folder := q.User, q.Folder
+	var d *delivery.Delivery
+	if deliveryFormat(user) == "mbox" {
+		var err error
+		if d, err = newMboxDelivery(mboxPath(user, folder), from); err != nil {
+			return nil, err
+		}
+	} else {
+		dir, err := userMaildir(user, folder)
+		if err != nil {
+			return nil, err
+		}
+		if d, err = newDelivery(dir); err != nil {
+			return nil, err
+		}
+	}
+	d.Owner = mailOwner(user)
+	if _, err := d.Write(data); err != nil {
+		d.Abort()
+		return nil, err
+	}
+	var err error
+	if folder != "" || d.Mbox != "" {
+		err = d.Close()
+	} else {
+		var headers mail.Header
+		if msg, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+			headers = msg.Header
+		}
+		err = d.CloseTo(filterDirs(user, d.Dir, &sieveMessage{headers, from, q.Rcpt}))
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The message was accepted before the mailbox filled up, so it is delivered even if it goes over quota
+	if err := addQuotaUsage(user, int64(len(data)*d.Copies), int64(d.Copies)); err != nil {
+		log.Printf("Error updating quota for %s: %s", user, err)
+	}
+	return d, nil
+}
+
+// retryEntry tries the entry's remaining deliveries and updates or removes it
+func retryEntry(entry *queueEntry, now time.Time) error {
+	msgPath := filepath.Join(cfg.Queue.Dir, entry.ID+".eml")
+	data, err := ioutil.ReadFile(msgPath)
+	if err != nil {
+		return err
+	}
+
+	conn := connInfo{queueID: entry.ID}
+	var remaining, relayed []queuedDelivery
+	for _, q := range entry.Deliveries {
+		if q.Relay {
+			relayed = append(relayed, q)
+			continue
+		}
+		if userHeld(q.User) {
+			logDebugf("Delivery to %s is held, keeping queued %s", q.User, entry.ID)
+			remaining = append(remaining, q)
+			continue
+		}
+		if q.Schedule != "" && !scheduleActive(q.Schedule, now) {
+			logDebugf("Delivery to %s is outside of schedule %s, keeping queued %s", q.User, q.Schedule, entry.ID)
+			remaining = append(remaining, q)
+			continue
+		}
+		msg := append(deliveryHeader(entry.From, q.Rcpt), data...)
+		if q.Untraced && entry.Trace <= len(data) {
+			msg = data[entry.Trace:]
+		}
+		d, err := deliverMessage(q, entry.From, msg)
+		if err != nil {
+			conn.logf("Error delivering queued message to %s: %s", q.User, err)
+			remaining = append(remaining, q)
+			continue
+		}
+		logEvent(conn, "delivered", "rcpt", "<"+q.Rcpt+">", "path", d.Location())
+		writeJournal(journalEntry{Kind: "delivery", QueueID: entry.ID, From: entry.From, Rcpt: q.Rcpt, Size: int64(len(msg)), Path: d.Path(), Disposition: "delivered"})
+		pluginDelivered(nil, connInfo{}, entry.From, q.Rcpt, d.Location())
+		var header mail.Header
+		if m, err := mail.ReadMessage(bytes.NewReader(msg)); err == nil {
+			header = m.Header
+		}
+		notifyDelivered(conn, q.User, q.Rcpt, entry.From, d.Path(), header, int64(len(msg)))
+		notifyDovecot(conn, q.User, d.Linked)
+	}
+	relayRemaining, bounced := retryRelay(entry, relayed, data, now)
+	remaining = append(remaining, relayRemaining...)
+	entryPath := filepath.Join(cfg.Queue.Dir, entry.ID+".json")
+	if len(remaining) == 0 {
+		if err := bounce(entry, bounced, data, now); err != nil {
+			conn.logf("Error queueing bounce: %s", err)
+		}
+		os.Remove(entryPath)
+		return os.Remove(msgPath)
+	}
+
+	entry.Deliveries = remaining
+	entry.Attempts++
+	maxAge := cfg.Queue.MaxAge.Duration
+	if maxAge == 0 {
+		maxAge = defaultQueueMaxAge
+	}
+	if now.Sub(entry.Created) > maxAge && !waitingOnSchedules(remaining, now) {
+		var users []string
+		for _, q := range remaining {
+			if q.Relay {
+				users = append(users, q.Rcpt)
+			} else {
+				users = append(users, q.User)
+			}
+			bounced = append(bounced, bounceRcpt{rcpt: q.Rcpt, status: expiredStatus})
+		}
+		conn.logf("Giving up on queued message for %s after %d attempts", strings.Join(users, ", "), entry.Attempts)
+		if err := bounce(entry, bounced, data, now); err != nil {
+			conn.logf("Error queueing bounce: %s", err)
+		}
+		if err := saveEntry(entry); err != nil {
+			return err
+		}
+		failed := filepath.Join(cfg.Queue.Dir, queueFailedDir)
+		if err := os.Rename(msgPath, filepath.Join(failed, entry.ID+".eml")); err != nil {
+			return err
+		}
+		return os.Rename(entryPath, filepath.Join(failed, entry.ID+".json"))
+	}
+	if err := bounce(entry, bounced, data, now); err != nil {
+		conn.logf("Error queueing bounce: %s", err)
+	}
+	entry.Next = now.Add(retryDelay(entry.Attempts))
+	return saveEntry(entry)
+}
+
+// waitingOnSchedules returns true if all of the deliveries are only waiting for their recipient schedules
+// They aren't given up on, however long the schedule keeps them queued.
+func waitingOnSchedules(deliveries []queuedDelivery, now time.Time) bool {
+	for _, q := range deliveries {
+		if q.Schedule == "" || scheduleActive(q.Schedule, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// retryRelay relays the queued recipients that fit under the relay caps and their domain's limits, returning the ones left to relay
+// Recipients the smarthost refuses permanently are dropped, and returned to be bounced.
+func retryRelay(entry *queueEntry, deliveries []queuedDelivery, data []byte, now time.Time) ([]queuedDelivery, []bounceRcpt) {
+	if len(deliveries) == 0 {
+		return nil, nil
+	}
+	n := relayCaps.take(len(deliveries), now)
+	if n == 0 {
+		logDebugf("Relay limit reached, holding queued %s", entry.ID)
+		return deliveries, nil
+	}
+	var rcpts []string
+	for _, q := range deliveries[:n] {
+		rcpts = append(rcpts, q.Rcpt)
+	}
+	rcpts, deferred := relayDomains.admit(rcpts, now)
+	relayCaps.release(len(deferred))
+	var failed map[string]error
+	if len(rcpts) > 0 {
+		failed = relayByDomain(deliveries[0].Helo, entry.From, rcpts, data)
+	}
+	held := make(map[string]bool)
+	for _, rcpt := range deferred {
+		held[rcpt] = true
+	}
+	conn := connInfo{queueID: entry.ID}
+	var remaining []queuedDelivery
+	var bounced []bounceRcpt
+	for _, q := range deliveries[:n] {
+		err := failed[q.Rcpt]
+		switch {
+		case held[q.Rcpt]:
+			logDebugf("Domain relay limit reached for %s, holding queued %s", q.Rcpt, entry.ID)
+			remaining = append(remaining, q)
+		case err == nil:
+			logEvent(conn, "relayed", "rcpt", "<"+q.Rcpt+">", "host", cfg.Relay.Host)
+			writeJournal(journalEntry{Kind: "delivery", QueueID: entry.ID, From: entry.From, Rcpt: q.Rcpt, Size: int64(len(data)), Disposition: "relayed"})
+		case strings.HasPrefix(err.Error(), "5"):
+			conn.logf("Giving up on relaying queued message to %s: %s", q.Rcpt, err)
+			writeJournal(journalEntry{Kind: "delivery", QueueID: entry.ID, From: entry.From, Rcpt: q.Rcpt, Disposition: "bounced", Reason: err.Error()})
+			bounced = append(bounced, bounceRcpt{rcpt: q.Rcpt, status: replyStatus(err.Error()), diagnostic: err.Error()})
+		default:
+			conn.logf("Error relaying queued message to %s: %s", q.Rcpt, err)
+			remaining = append(remaining, q)
+		}
+	}
+	return append(remaining, deliveries[n:]...), bounced
+}
+
+// processQueue retries every queued message that is due
+func processQueue(now time.Time) error {
+	paths, err := filepath.Glob(filepath.Join(cfg.Queue.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("Error reading %s: %s", path, err)
+			continue
+		}
+		var entry queueEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			log.Printf("Error reading %s: %s", path, err)
+			continue
+		}
+		if entry.Next.After(now) {
+			continue
+		}
+		if err := retryEntry(&entry, now); err != nil {
+			connInfo{queueID: entry.ID}.logf("Error retrying queued message: %s", err)
+		}
+	}
+	return nil
+}
+
+// runQueue retries the queued messages until the context is done
+func runQueue(ctx context.Context) {
+	interval := retryDelay(1)
+	if interval > 30*time.Second {
+		interval = 30 * time.Second
+	}
+	for {
+		if err := processQueue(time.Now()); err != nil {
+			log.Printf("Error processing queue: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
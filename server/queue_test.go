@@ -0,0 +1,112 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/smtpd"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	defer func() { cfg.Queue = config.Queue{} }()
+	cfg.Queue.Retry = config.Duration{Duration: time.Minute}
+	cfg.Queue.MaxRetry = config.Duration{Duration: 10 * time.Minute}
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for i, d := range expected {
+		if delay := retryDelay(i + 1); delay != d {
+			t.Errorf("retryDelay(%d) = %s, expected %s", i+1, delay, d)
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	os.Mkdir(cmdline.Maildirs, 0700)
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com", "alice@domain.com"}
+	cfg.Queue.Dir = filepath.Join(dir, "queue")
+	parseHosts()
+	if err := setupQueue(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file where bcl's maildir should be makes delivery to it fail
+	blocker := filepath.Join(cmdline.Maildirs, "bcl")
+	if err := ioutil.WriteFile(blocker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := &smtpd.Server{
+		Hostname:        "localhost",
+		OnNewConnection: onNewConnection,
+		OnNewMail:       onNewMail,
+	}
+	go s.Serve(ln)
+	message := "Subject: queued\r\n\r\nHello\r\n"
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com", "alice@domain.com"}, []byte(message)); err != nil {
+		t.Fatalf("Message not accepted: %s", err)
+	}
+
+	if files, _ := ioutil.ReadDir(filepath.Join(cmdline.Maildirs, "alice", "new")); len(files) != 1 {
+		t.Error("Message not delivered to alice")
+	}
+	entries, _ := filepath.Glob(filepath.Join(cfg.Queue.Dir, "*.json"))
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 queued message: %v", entries)
+	}
+
+	// Not due yet, and still failing when it is
+	processQueue(time.Now())
+	processQueue(time.Now().Add(2 * time.Minute))
+	if entries, _ := filepath.Glob(filepath.Join(cfg.Queue.Dir, "*.json")); len(entries) != 1 {
+		t.Fatalf("Queued message removed while delivery is failing: %v", entries)
+	}
+
+	os.Remove(blocker)
+	processQueue(time.Now().Add(time.Hour))
+	if entries, _ := filepath.Glob(filepath.Join(cfg.Queue.Dir, "*")); len(entries) != 1 {
+		t.Errorf("Queue not empty after delivery: %v", entries)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(cmdline.Maildirs, "bcl", "new"))
+	if len(files) != 1 {
+		t.Fatal("Queued message not delivered to bcl")
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(cmdline.Maildirs, "bcl", "new", files[0].Name()))
+	if !strings.HasSuffix(string(data), message) || !strings.Contains(string(data), "Delivered-To: bcl@domain.com\r\n") {
+		t.Errorf("Wrong message delivered from the queue: %q", data)
+	}
+
+	// Messages that are too old are moved to failed
+	ioutil.WriteFile(filepath.Join(cmdline.Maildirs, "carol"), nil, 0600)
+	created := time.Now().Add(-6 * 24 * time.Hour)
+	if err := enqueue(newLogID(), "sender@domain.com", []queuedDelivery{{User: "carol", Rcpt: "carol@domain.com"}}, []byte(message), 0, created); err != nil {
+		t.Fatal(err)
+	}
+	processQueue(time.Now())
+	if entries, _ := filepath.Glob(filepath.Join(cfg.Queue.Dir, queueFailedDir, "*")); len(entries) != 2 {
+		t.Errorf("Expired message not moved to failed: %v", entries)
+	}
+}
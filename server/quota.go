@@ -0,0 +1,301 @@
+package server
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/bcl/letterbox/smtpd"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maildirsizeFile is the Maildir++ quota file in the top of each user's maildir
+const maildirsizeFile = "maildirsize"
+
+// maildirQuota is a Maildir++ quota, 0 means no limit
+type maildirQuota struct {
+	Size  int64 `toml:"size"`  // bytes
+	Count int64 `toml:"count"` // messages
+}
+
+// quotaStaleAge is how old maildirsize can be before a delivery that would go
+// over quota recalculates it, in case messages were deleted without updating it
+const quotaStaleAge = 15 * time.Minute
+
+// quotaMaxFileSize is the size at which maildirsize is rewritten, to keep it from growing forever
+const quotaMaxFileSize = 5120
+
+// errMailboxFull is returned for recipients whose mailbox is over quota
+var errMailboxFull = smtpd.SMTPError("552 5.2.2 Error: mailbox full")
+
+// parseQuota parses a Maildir++ quota definition like "1000000S,1000C"
+func parseQuota(s string) (maildirQuota, error) {
+	var q maildirQuota
+	for _, part := range strings.Split(strings.TrimSpace(s), ",") {
+		if part == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(part[:len(part)-1], 10, 64)
+		if err != nil || n < 0 {
+			return maildirQuota{}, fmt.Errorf("bad quota definition: %q", s)
+		}
+		switch part[len(part)-1] {
+		case 'S':
+			q.Size = n
+		case 'C':
+			q.Count = n
+		default:
+			return maildirQuota{}, fmt.Errorf("bad quota definition: %q", s)
+		}
+	}
+	return q, nil
+}
+
+// String returns the quota in the format used on the first line of maildirsize
+func (q maildirQuota) String() string {
+	var parts []string
+	if q.Size > 0 {
+		parts = append(parts, fmt.Sprintf("%dS", q.Size))
+	}
+	if q.Count > 0 {
+		parts = append(parts, fmt.Sprintf("%dC", q.Count))
+	}
+	return strings.Join(parts, ",")
+}
+
+// readMaildirsize returns the quota and the usage recorded in the user's maildirsize file
+// The usage is the sum of all the lines after the quota definition, which
+// includes the negative lines added when messages are removed.
+func readMaildirsize(userDir string) (maildirQuota, int64, int64, error) {
+	var q maildirQuota
+	var size, count int64
+	f, err := os.Open(filepath.Join(userDir, maildirsizeFile))
+	if err != nil {
+		return q, 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if scanner.Scan() {
+		if q, err = parseQuota(scanner.Text()); err != nil {
+			return q, 0, 0, err
+		}
+	}
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return q, 0, 0, fmt.Errorf("bad maildirsize line: %q", scanner.Text())
+		}
+		s, err1 := strconv.ParseInt(fields[0], 10, 64)
+		c, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return q, 0, 0, fmt.Errorf("bad maildirsize line: %q", scanner.Text())
+		}
+		size += s
+		count += c
+	}
+	return q, size, count, scanner.Err()
+}
+
+// messageSize returns the size of a message, from the S= in its filename if it has one
+func messageSize(path string, info os.FileInfo) int64 {
+	name := filepath.Base(path)
+	if i := strings.Index(name, ":"); i != -1 {
+		name = name[:i]
+	}
+	for _, field := range strings.Split(name, ",")[1:] {
+		if strings.HasPrefix(field, "S=") {
+			if n, err := strconv.ParseInt(field[2:], 10, 64); err == nil {
+				return n
+			}
+		}
+	}
+	return info.Size()
+}
+
+// maildirUsage adds up the size and number of messages in the user's maildir and its folders
+func maildirUsage(userDir string) (int64, int64, error) {
+	var size, count int64
+	err := walkMessages(userDir, func(path string) error {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			// Moved or deleted by the user's mail client while walking
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size += messageSize(path, info)
+		count++
+		return nil
+	})
+	return size, count, err
+}
+
+// recalcQuota rebuilds the user's maildirsize file from the messages in the maildir
+// The quota definition from the old file is kept unless q is passed. It returns
+// the quota and usage that were written.
+func recalcQuota(userDir string, q *maildirQuota) (maildirQuota, int64, int64, error) {
+	var quota maildirQuota
+	if q != nil {
+		quota = *q
+	} else if old, _, _, err := readMaildirsize(userDir); err == nil {
+		quota = old
+	} else if !os.IsNotExist(err) {
+		// A corrupt file is what this is meant to fix, so only the quota is lost
+		fmt.Fprintf(os.Stderr, "Ignoring the old %s: %s\n", maildirsizeFile, err)
+	}
+	size, count, err := maildirUsage(userDir)
+	if err != nil {
+		return quota, 0, 0, err
+	}
+	data := fmt.Sprintf("%s\n%d %d\n", quota, size, count)
+	return quota, size, count, writeFileAtomic(filepath.Join(userDir, maildirsizeFile), []byte(data))
+}
+
+// userQuota returns the quota for the user
+/*
+   Example TOML:
+
+   [quota]
+   size = 1073741824
+   count = 50000
+
+   [quota.users.bcl]
+   size = 10737418240
+
+   A user listed in quota.users uses only their own settings, so bcl has no
+   limit on the number of messages.
+*/
+func userQuota(user string) maildirQuota {
+	if q, ok := cfg.Quota.Users[user]; ok {
+		return maildirQuota(q)
+	}
+	return maildirQuota{Size: cfg.Quota.Size, Count: cfg.Quota.Count}
+}
+
+// exceeded returns true if adding a message of msgSize bytes would go over the quota
+func (q maildirQuota) exceeded(size, count, msgSize int64) bool {
+	return (q.Size > 0 && size+msgSize > q.Size) || (q.Count > 0 && count+1 > q.Count)
+}
+
+// quotaUsage returns the size and number of messages in the user's maildir from maildirsize
+// The file is recalculated if it is missing, unreadable, too big, has a different
+// quota, or says the user is full but hasn't been rewritten for quotaStaleAge.
+func quotaUsage(user string, q maildirQuota) (int64, int64, error) {
+	userDir, err := maildirPath(user)
+	if err != nil {
+		return 0, 0, err
+	}
+	fileQuota, size, count, err := readMaildirsize(userDir)
+	if err == nil && fileQuota == q {
+		info, err := os.Stat(filepath.Join(userDir, maildirsizeFile))
+		if err == nil && info.Size() <= quotaMaxFileSize &&
+			(!q.exceeded(size, count, 1) || time.Since(info.ModTime()) < quotaStaleAge) {
+			return size, count, nil
+		}
+	}
+	_, size, count, err = recalcQuota(userDir, &q)
+	return size, count, err
+}
+
+// addQuotaUsage records a message that was delivered to the user in maildirsize
+// If the file is missing it is left for quotaUsage to create.
+func addQuotaUsage(user string, size, count int64) error {
+	userDir, err := maildirPath(user)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(userDir, maildirsizeFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %d\n", size, count)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// mailboxFull returns true if the user's mailbox can't take a message of msgSize bytes
+// Errors reading the usage are logged and the message is allowed.
+func mailboxFull(user string, msgSize int64) bool {
+	// Quotas are kept in the maildir
+	if deliveryFormat(user) == "mbox" {
+		return false
+	}
+	q := userQuota(user)
+	if q.Size == 0 && q.Count == 0 {
+		return false
+	}
+	size, count, err := quotaUsage(user, q)
+	if err != nil {
+		log.Printf("Error reading quota for %s: %s", user, err)
+		return false
+	}
+	return q.exceeded(size, count, msgSize)
+}
+
+// rcptFull returns the first user the address is delivered to whose mailbox is full, "" if there isn't one
+// Held users are skipped, their mail is queued until they are released.
+func rcptFull(emails []string, address string) string {
+	for _, user := range mailboxUsers(emails, address) {
+		if !userHeld(user) && mailboxFull(user, 1) {
+			return user
+		}
+	}
+	return ""
+}
+
+// quotaCommand manages the Maildir++ quota files
+/*
+   letterbox quota recalc [-size bytes] [-count messages] <user>
+
+   recalc rebuilds the user's maildirsize file from the messages in the maildir,
+   keeping the old quota unless -size or -count is passed.
+*/
+func quotaCommand(args []string) error {
+	if len(args) == 0 || args[0] != "recalc" {
+		return fmt.Errorf("usage: quota recalc [-size bytes] [-count messages] <user>")
+	}
+	flags := flag.NewFlagSet("quota recalc", flag.ExitOnError)
+	size := flags.Int64("size", -1, "Quota in bytes, 0 for no limit")
+	count := flags.Int64("count", -1, "Quota in messages, 0 for no limit")
+	flags.Parse(args[1:])
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: quota recalc [-size bytes] [-count messages] <user>")
+	}
+	if err := loadCommandConfig(); err != nil {
+		return err
+	}
+	userDir, err := maildirPath(filepath.Base(filepath.Clean(flags.Arg(0))))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(userDir); err != nil {
+		return err
+	}
+
+	var q *maildirQuota
+	if *size >= 0 || *count >= 0 {
+		old, _, _, _ := readMaildirsize(userDir)
+		if *size >= 0 {
+			old.Size = *size
+		}
+		if *count >= 0 {
+			old.Count = *count
+		}
+		q = &old
+	}
+	quota, bytes, messages, err := recalcQuota(userDir, q)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d bytes in %d messages, quota %q\n", bytes, messages, quota.String())
+	return nil
+}
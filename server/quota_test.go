@@ -0,0 +1,250 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuota(t *testing.T) {
+	tests := map[string]maildirQuota{
+		"1000000S,1000C": {Size: 1000000, Count: 1000},
+		"5000S":          {Size: 5000},
+		"10C\n":          {Count: 10},
+		"":               {},
+	}
+	for s, expected := range tests {
+		q, err := parseQuota(s)
+		if err != nil || q != expected {
+			t.Errorf("parseQuota(%q) = %v, %v expected %v", s, q, err, expected)
+		}
+	}
+	for _, s := range []string{"1000X", "S", "-5S", "abcS"} {
+		if q, err := parseQuota(s); err == nil {
+			t.Errorf("parseQuota(%q) = %v, expected an error", s, q)
+		}
+	}
+	if s := (maildirQuota{Size: 1000000, Count: 1000}).String(); s != "1000000S,1000C" {
+		t.Errorf("Wrong quota string: %q", s)
+	}
+}
+
+func TestRecalcQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(path string, size int) {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0700)
+		if err := ioutil.WriteFile(filepath.Join(dir, path), make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("new/1", 100)
+	write("cur/2:2,S", 200)
+	write(".Junk/cur/3,S=1000:2,S", 50)
+	write("tmp/4", 400)
+	// A stale file that has lost track of the messages
+	ioutil.WriteFile(filepath.Join(dir, maildirsizeFile), []byte("5000S,10C\n100 1\n9999 20\n-50 -1\n"), 0600)
+
+	q, size, count, err := readMaildirsize(dir)
+	if err != nil || q != (maildirQuota{Size: 5000, Count: 10}) || size != 10049 || count != 20 {
+		t.Fatalf("readMaildirsize = %v %d %d %v", q, size, count, err)
+	}
+
+	q, size, count, err = recalcQuota(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q != (maildirQuota{Size: 5000, Count: 10}) || size != 1300 || count != 3 {
+		t.Errorf("recalcQuota = %v %d %d", q, size, count)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, maildirsizeFile))
+	if string(data) != "5000S,10C\n1300 3\n" {
+		t.Errorf("Wrong maildirsize: %q", data)
+	}
+
+	// A new quota replaces the old one
+	if _, _, _, err := recalcQuota(dir, &maildirQuota{Count: 100}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(dir, maildirsizeFile))
+	if string(data) != "100C\n1300 3\n" {
+		t.Errorf("Wrong maildirsize: %q", data)
+	}
+
+	// A corrupt file is rebuilt without a quota
+	ioutil.WriteFile(filepath.Join(dir, maildirsizeFile), []byte("garbage\n"), 0600)
+	if q, _, _, err := recalcQuota(dir, nil); err != nil || q != (maildirQuota{}) {
+		t.Errorf("Corrupt maildirsize not rebuilt: %v %v", q, err)
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(dir, maildirsizeFile))
+	if string(data) != "\n1300 3\n" {
+		t.Errorf("Wrong maildirsize: %q", data)
+	}
+}
+
+func TestQuotaUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Quota = config.Quota{Size: 1000, Count: 10, Users: map[string]config.UserQuota{"big": {Size: 5000}}}
+
+	if q := userQuota("bcl"); q != (maildirQuota{Size: 1000, Count: 10}) {
+		t.Errorf("Default quota = %v", q)
+	}
+	if q := userQuota("big"); q != (maildirQuota{Size: 5000}) {
+		t.Errorf("User quota = %v", q)
+	}
+
+	userDir := filepath.Join(dir, "bcl")
+	os.MkdirAll(filepath.Join(userDir, "new"), 0700)
+	ioutil.WriteFile(filepath.Join(userDir, "new", "1"), make([]byte, 600), 0600)
+
+	// A missing maildirsize is created
+	if mailboxFull("bcl", 400) || !mailboxFull("bcl", 401) {
+		t.Error("Wrong space left in the mailbox")
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(userDir, maildirsizeFile))
+	if string(data) != "1000S,10C\n600 1\n" {
+		t.Errorf("Wrong maildirsize: %q", data)
+	}
+
+	// Deliveries are added to it
+	if err := addQuotaUsage("bcl", 300, 1); err != nil {
+		t.Fatal(err)
+	}
+	if size, count, err := quotaUsage("bcl", userQuota("bcl")); err != nil || size != 900 || count != 2 {
+		t.Errorf("quotaUsage = %d %d %v", size, count, err)
+	}
+
+	// A full mailbox is only recalculated once the file is stale
+	ioutil.WriteFile(filepath.Join(userDir, maildirsizeFile), []byte("1000S,10C\n2000 1\n"), 0600)
+	if !mailboxFull("bcl", 1) {
+		t.Error("Full mailbox not full")
+	}
+	old := time.Now().Add(-quotaStaleAge - time.Minute)
+	os.Chtimes(filepath.Join(userDir, maildirsizeFile), old, old)
+	if mailboxFull("bcl", 1) {
+		t.Error("Stale maildirsize not recalculated")
+	}
+
+	// A changed quota rewrites the file
+	cfg.Quota.Count = 1
+	if !mailboxFull("bcl", 1) {
+		t.Error("New quota not used")
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(userDir, maildirsizeFile))
+	if string(data) != "1000S,1C\n600 1\n" {
+		t.Errorf("Wrong maildirsize: %q", data)
+	}
+
+	// Users without a quota are never full
+	cfg.Quota = config.Quota{}
+	if mailboxFull("bcl", 1000000) {
+		t.Error("Mailbox without a quota is full")
+	}
+}
+
+func TestQuotaMail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com", "big@domain.com"}
+	cfg.Quota = config.Quota{Count: 2, Users: map[string]config.UserQuota{"big": {Size: 1000}}}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	send := func(rcpt, msg string) error {
+		return smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{rcpt}, []byte(msg))
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := send("bcl@domain.com", "Subject: test\r\n\r\nHello\r\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = send("bcl@domain.com", "Subject: test\r\n\r\nHello\r\n")
+	if err == nil || !strings.HasPrefix(err.Error(), "552") {
+		t.Errorf("Mail to a full mailbox not refused: %v", err)
+	}
+
+	// Only the full recipient is refused, at RCPT, and the others get the message once
+	c, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("sender@domain.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("bcl@domain.com"); err == nil || !strings.HasPrefix(err.Error(), "552") {
+		t.Errorf("Full mailbox not refused at RCPT: %v", err)
+	}
+	if err := c.Rcpt("big@domain.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Subject: test\r\n\r\nHello\r\n"))
+	if err := w.Close(); err != nil {
+		t.Errorf("Message refused: %s", err)
+	}
+	c.Quit()
+
+	_, size, count, err := readMaildirsize(filepath.Join(dir, "bcl"))
+	if err != nil || count != 2 || size == 0 {
+		t.Errorf("maildirsize = %d %d %v", size, count, err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new")); len(files) != 2 {
+		t.Errorf("%d messages delivered, expected 2", len(files))
+	}
+
+	// A message bigger than the space left is refused at the end of DATA
+	err = send("big@domain.com", "Subject: big\r\n\r\n"+strings.Repeat("x", 2000)+"\r\n")
+	if err == nil || !strings.HasPrefix(err.Error(), "552") {
+		t.Errorf("Message over quota not refused: %v", err)
+	}
+	if err := send("big@domain.com", "Subject: small\r\n\r\nHello\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "big", "new")); len(files) != 2 {
+		t.Errorf("%d messages delivered, expected 2", len(files))
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "big", "tmp")); len(files) != 0 {
+		t.Errorf("%d messages left in tmp", len(files))
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/events"
+	"github.com/bcl/letterbox/smtpd"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errTooManyConnections and errTooManyMessages are the replies to clients over the limits
+var (
+	errTooManyConnections = smtpd.SMTPError("421 4.7.0 Error: too many connections from your IP")
+	errTooManyMessages    = smtpd.SMTPError("450 4.7.1 Error: too many messages, slow down")
+)
+
+// tokenBucket holds the tokens for one client IP or sender, as of updated
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter is a set of token buckets that fill at the same rate
+type rateLimiter struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+// messageLimits and senderLimits limit the messages from each client IP and each sender
+var (
+	messageLimits = newRateLimiter()
+	senderLimits  = newRateLimiter()
+)
+
+// newRateLimiter returns a rate limiter with no buckets
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// rateBurst returns how many tokens a bucket filling at perMinute holds
+func rateBurst(perMinute float64) float64 {
+	if cfg.RateLimit.Burst > 0 {
+		return float64(cfg.RateLimit.Burst)
+	}
+	if perMinute < 1 {
+		return 1
+	}
+	return perMinute
+}
+
+// take removes a token from the key's bucket, returning false if it is empty
+// Buckets start full and refill at perMinute tokens a minute.
+func (l *rateLimiter) take(key string, perMinute float64, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	burst := rateBurst(perMinute)
+	refill := func(b *tokenBucket) {
+		b.tokens += now.Sub(b.updated).Minutes() * perMinute
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.updated = now
+	}
+
+	// Full buckets are the same as missing ones, so drop them now and then
+	if now.Sub(l.pruned) > time.Minute {
+		for k, b := range l.buckets {
+			if refill(b); b.tokens >= burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, updated: now}
+		l.buckets[key] = b
+	}
+	refill(b)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// connCounts is the number of open connections from each client IP
+var connCounts = struct {
+	sync.Mutex
+	ips map[string]int
+}{ips: make(map[string]int)}
+
+// openConnection counts a new connection from the IP, returning false if there are too many
+// The connection is counted even if it is refused, closeConnection uncounts it.
+func openConnection(ip string) bool {
+	connCounts.Lock()
+	defer connCounts.Unlock()
+	connCounts.ips[ip]++
+	return cfg.RateLimit.Connections == 0 || connCounts.ips[ip] <= cfg.RateLimit.Connections
+}
+
+// closeConnection uncounts a connection from the IP
+func closeConnection(ip string) {
+	connCounts.Lock()
+	defer connCounts.Unlock()
+	if connCounts.ips[ip]--; connCounts.ips[ip] <= 0 {
+		delete(connCounts.ips, ip)
+	}
+}
+
+// onClose is called when a client disconnects
+func onClose(c smtpd.Connection) {
+	logEvent(connInfo{id: c.ID()}, "close")
+	if ip := connIP(c); ip != "" {
+		closeConnection(ip)
+	}
+	serverSlots.release(c.ID())
+}
+
+// connectionLimited returns an error if the client has too many connections open, or the server does
+func connectionLimited(clientIP net.IP, conn connInfo) error {
+	if !openConnection(clientIP.String()) && !hostExempt(clientIP) {
+		reject(clientIP, conn, "", "", events.ReasonRateLimit, "Too many connections")
+		return errTooManyConnections
+	}
+	return serverBusy(clientIP, conn)
+}
+
+// messageLimited returns an error if the client or sender has sent too many messages
+// It is called for each MAIL FROM, and uses up one message whether or not the mail is accepted.
+func messageLimited(clientIP net.IP, conn connInfo, from string, now time.Time) error {
+	if clientIP != nil && hostExempt(clientIP) {
+		return nil
+	}
+	limit := cfg.RateLimit
+	if limit.Messages > 0 && clientIP != nil && !messageLimits.take(clientIP.String(), limit.Messages, now) {
+		reject(clientIP, conn, from, "", events.ReasonRateLimit, "Too many messages from the client")
+		return errTooManyMessages
+	}
+	if limit.SenderMessages > 0 && !senderLimits.take(strings.ToLower(from), limit.SenderMessages, now) {
+		reject(clientIP, conn, from, "", events.ReasonRateLimit, "Too many messages from the sender")
+		return errTooManyMessages
+	}
+	return nil
+}
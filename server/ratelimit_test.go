@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bufio"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	l := newRateLimiter()
+	now := time.Now()
+
+	// The bucket starts with a minute's worth
+	for i := 0; i < 6; i++ {
+		if !l.take("192.168.1.1", 6, now) {
+			t.Fatalf("Message %d refused", i+1)
+		}
+	}
+	if l.take("192.168.1.1", 6, now) {
+		t.Error("Message over the burst accepted")
+	}
+	if !l.take("192.168.1.2", 6, now) {
+		t.Error("Other client limited")
+	}
+	// One is added every 10 seconds
+	if !l.take("192.168.1.1", 6, now.Add(10*time.Second)) || l.take("192.168.1.1", 6, now.Add(10*time.Second)) {
+		t.Error("Bucket didn't refill at the rate")
+	}
+	// Full buckets are dropped
+	l.take("192.168.1.3", 6, now.Add(time.Hour))
+	if len(l.buckets) != 1 {
+		t.Errorf("%d buckets left after pruning", len(l.buckets))
+	}
+
+	cfg.RateLimit.Burst = 2
+	l = newRateLimiter()
+	if !l.take("a@b.com", 60, now) || !l.take("a@b.com", 60, now) || l.take("a@b.com", 60, now) {
+		t.Error("Burst not used")
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	defer func() {
+		cfg = config.Config{}
+		allowedList = access.List{}
+		messageLimits = newRateLimiter()
+		senderLimits = newRateLimiter()
+	}()
+	cfg.Hosts = []string{"127.0.0.2"}
+	cfg.RateLimit = config.RateLimit{Messages: 2, SenderMessages: 1, Connections: 1}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+
+	// Other tests leave connections from 127.0.0.1 open, so connect from 127.0.0.2
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}
+	dial := func() *smtp.Client {
+		conn, err := dialer.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := smtp.NewClient(conn, "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	client := dial()
+	// Only one connection at a time
+	second, err := dialer.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	banner, _ := bufio.NewReader(second).ReadString('\n')
+	second.Close()
+	if !strings.HasPrefix(banner, "421 4.7.0") {
+		t.Errorf("Second connection got %q", banner)
+	}
+
+	// One message from the sender, and two from the client
+	if err := client.Mail("one@domain.com"); err != nil {
+		t.Fatal(err)
+	}
+	client.Reset()
+	if err := client.Mail("one@domain.com"); err == nil || !strings.HasPrefix(err.Error(), "450") || !strings.Contains(err.Error(), "4.7.1") {
+		t.Errorf("Second message from the sender: %v", err)
+	}
+	// The refused message still used up one of the client's
+	if err := client.Mail("two@domain.com"); err == nil || !strings.HasPrefix(err.Error(), "450") || !strings.Contains(err.Error(), "4.7.1") {
+		t.Errorf("Third message from the client: %v", err)
+	}
+	client.Quit()
+
+	// The connection is uncounted when it closes
+	for i := 0; i < 50; i++ {
+		connCounts.Lock()
+		n := connCounts.ips["127.0.0.2"]
+		connCounts.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dial().Quit()
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bcl/letterbox/events"
+	"github.com/bcl/letterbox/smtpd"
+	"strings"
+)
+
+/* Example TOML:
+recipient_max_sizes = { "pager@domain.com" = 65536 }
+*/
+
+var errRcptTooBig = smtpd.SMTPError("552 5.3.4 Error: message too big for this recipient")
+
+// checkRcptSizes makes sure the recipient_max_sizes limits are positive, and no larger than max_message_size
+func checkRcptSizes() error {
+	for rcpt, limit := range cfg.RecipientMaxSizes {
+		if limit <= 0 {
+			return fmt.Errorf("recipient_max_sizes for %s must be larger than 0", rcpt)
+		}
+		if cfg.MaxMessageSize > 0 && limit > cfg.MaxMessageSize {
+			return fmt.Errorf("recipient_max_sizes for %s is larger than max_message_size", rcpt)
+		}
+	}
+	return nil
+}
+
+// rcptMaxSize returns the recipient_max_sizes limit for the address, 0 if it doesn't have one
+func rcptMaxSize(address string) int64 {
+	for rcpt, limit := range cfg.RecipientMaxSizes {
+		if strings.EqualFold(rcpt, address) {
+			return limit
+		}
+	}
+	return 0
+}
+
+// SetSize is called with the size the client declared with MAIL FROM
+func (e *env) SetSize(size int64) {
+	e.declared = size
+}
+
+// checkRcptSize refuses the recipient if the declared size is over its limit
+// Local recipients are looked up by the address they are listed as, so
+// user+folder@ shares the user's limit, and relayed ones by their address.
+// The limit is remembered so that Close can check the real size.
+func (e *env) checkRcptSize(rcpt, user string, local bool) error {
+	address := rcpt
+	if local {
+		address = user
+	}
+	limit := rcptMaxSize(address)
+	if limit == 0 {
+		return nil
+	}
+	if e.declared > limit {
+		logDebugf("Declared size %d is over %s's limit of %d", e.declared, rcpt, limit)
+		reject(e.clientIP, e.conn, e.from, rcpt, events.ReasonTooBig, errRcptTooBig.Error())
+		return errRcptTooBig
+	}
+	if e.sizeLimits == nil {
+		e.sizeLimits = make(map[string]int64)
+	}
+	e.sizeLimits[rcpt] = limit
+	return nil
+}
+
+// dropOversized refuses the recipients the message turned out to be too big for
+// They aren't relayed, forwarded, piped, or queued while held, and Close
+// aborts their deliveries. If the message is too big for all of the
+// recipients it is rejected.
+func (e *env) dropOversized() error {
+	for rcpt, limit := range e.sizeLimits {
+		if e.size <= limit {
+			continue
+		}
+		e.conn.logf("Message of %d bytes is over %s's limit of %d", e.size, rcpt, limit)
+		if e.tooBig == nil {
+			e.tooBig = make(map[string]bool)
+		}
+		e.tooBig[rcpt] = true
+	}
+	if len(e.tooBig) == 0 {
+		return nil
+	}
+	if len(e.tooBig) == len(e.rcpts) {
+		reject(e.clientIP, e.conn, e.from, "", events.ReasonTooBig, errRcptTooBig.Error())
+		return errRcptTooBig
+	}
+	for rcpt := range e.tooBig {
+		reject(e.clientIP, e.conn, e.from, rcpt, events.ReasonTooBig, errRcptTooBig.Error())
+		e.rcptErrors[rcpt] = errRcptTooBig
+	}
+	var relayRcpts []string
+	for _, rcpt := range e.relayRcpts {
+		if !e.tooBig[rcpt] {
+			relayRcpts = append(relayRcpts, rcpt)
+		}
+	}
+	e.relayRcpts = relayRcpts
+	var forwards []forwardRcpt
+	for _, f := range e.forwards {
+		if !e.tooBig[f.rcpt] {
+			forwards = append(forwards, f)
+		}
+	}
+	e.forwards = forwards
+	var pipes []pipeRcpt
+	for _, p := range e.pipes {
+		if !e.tooBig[p.rcpt] {
+			pipes = append(pipes, p)
+		}
+	}
+	e.pipes = pipes
+	var held []queuedDelivery
+	for _, q := range e.held {
+		if !e.tooBig[q.Rcpt] {
+			held = append(held, q)
+		}
+	}
+	e.held = held
+	return nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckRcptSizes(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	cfg.MaxMessageSize = 1000
+	for _, limit := range []int64{0, -1, 1001} {
+		cfg.RecipientMaxSizes = map[string]int64{"pager@domain.com": limit}
+		if err := checkRcptSizes(); err == nil {
+			t.Errorf("Bad limit %d accepted", limit)
+		}
+	}
+	cfg.RecipientMaxSizes = map[string]int64{"pager@domain.com": 1000}
+	if err := checkRcptSizes(); err != nil {
+		t.Errorf("Good limit refused: %s", err)
+	}
+	if rcptMaxSize("PAGER@domain.com") != 1000 || rcptMaxSize("bcl@domain.com") != 0 {
+		t.Error("Wrong limits looked up")
+	}
+}
+
+func TestRcptSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com", "pager@domain.com"}
+	cfg.RecipientMaxSizes = map[string]int64{"Pager@domain.com": 100}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	count := func(user string) int {
+		files, _ := ioutil.ReadDir(filepath.Join(dir, user, "new"))
+		return len(files)
+	}
+
+	// With SIZE the recipient is refused at RCPT time
+	c, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Hello("client"); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := c.Text.Cmd("MAIL FROM:<sender@domain.com> SIZE=1000")
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	c.Text.EndResponse(id)
+	if err != nil {
+		t.Fatalf("MAIL with SIZE refused: %s", err)
+	}
+	if err := c.Rcpt("pager@domain.com"); err == nil || !strings.HasPrefix(err.Error(), "552") || !strings.Contains(err.Error(), "5.3.4") {
+		t.Errorf("Recipient over its limit not refused: %v", err)
+	}
+	if err := c.Rcpt("bcl@domain.com"); err != nil {
+		t.Errorf("Recipient without a limit refused: %s", err)
+	}
+	c.Quit()
+
+	// Without SIZE it is refused at DATA time, and without bounces to tell the
+	// sender about pager the whole message is refused
+	big := []byte("Subject: test\r\n\r\n" + strings.Repeat("x", 200) + "\r\n")
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com", "pager@domain.com"}, big); err == nil || !strings.HasPrefix(err.Error(), "552") {
+		t.Errorf("Message over the limit not refused: %v", err)
+	}
+	if count("bcl") != 0 || count("pager") != 0 {
+		t.Errorf("Wrong deliveries: bcl %d, pager %d", count("bcl"), count("pager"))
+	}
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"pager@domain.com"}, big); err == nil || !strings.HasPrefix(err.Error(), "552") {
+		t.Errorf("Message over the limit not refused: %v", err)
+	}
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com", "pager@domain.com"}, []byte("Subject: test\r\n\r\nHi\r\n")); err != nil {
+		t.Errorf("Small message refused: %s", err)
+	}
+	if count("bcl") != 1 || count("pager") != 1 {
+		t.Errorf("Wrong deliveries: bcl %d, pager %d", count("bcl"), count("pager"))
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net"
+	"regexp"
+)
+
+// receivedFromRE matches the from clause of a Received header, up to the by clause
+var receivedFromRE = regexp.MustCompile(`(?is)^\s*from\s+(.*?)(?:\s+by\s|;|$)`)
+
+// receivedIPRE matches an address literal like [192.168.1.1] or [IPv6:2001:db8::1]
+var receivedIPRE = regexp.MustCompile(`\[(?:IPv6:)?([0-9a-fA-F:.]+)\]`)
+
+// receivedIP returns the IP of the sending host from the from clause of a Received header
+// It returns nil if there is no from clause or it has no address literal.
+func receivedIP(value string) net.IP {
+	m := receivedFromRE.FindStringSubmatch(value)
+	if m == nil {
+		return nil
+	}
+	for _, lit := range receivedIPRE.FindAllStringSubmatch(m[1], -1) {
+		if ip := net.ParseIP(lit[1]); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// trustedRelay returns true if the IP is one of ours, so its Received header can be believed
+func trustedRelay(ip net.IP) bool {
+	return ip.IsLoopback() || hostAllowed(ip)
+}
+
+// originatingIP walks the Received chain, newest first, and returns the first
+// address that was handed the message by an untrusted host.
+/*
+   When mail is relayed to letterbox by fetchmail or another internal forwarder
+   the client IP is the forwarder, not the host that actually sent the message.
+   Each Received header added by a trusted relay names the host it received the
+   message from, so the chain is followed until it leaves the trusted hosts.
+
+   A trusted relay's header without an address literal doesn't say where the
+   message came from, and the headers below it were written by whoever sent it,
+   so the origin is unknown and nil is returned.
+*/
+func originatingIP(clientIP net.IP, received []string) net.IP {
+	origin := clientIP
+	for _, r := range received {
+		// A nil clientIP is a local socket, which is trusted
+		if origin != nil && !trustedRelay(origin) {
+			break
+		}
+		origin = receivedIP(r)
+		if origin == nil {
+			return nil
+		}
+	}
+	return origin
+}
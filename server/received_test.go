@@ -0,0 +1,73 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"net"
+	"testing"
+)
+
+func TestReceivedIP(t *testing.T) {
+	tests := []struct {
+		value string
+		ip    string
+	}{
+		{"from mail.example.com (mail.example.com [203.0.113.5]) by mx.example.org with ESMTP id 1234; Tue, 1 Sep 2020 10:00:00 +0000", "203.0.113.5"},
+		{"from [IPv6:2001:db8::25] (unknown)\r\n\tby relay.example.org with SMTP; Tue, 1 Sep 2020 10:00:00 +0000", "2001:db8::25"},
+		{"from localhost by box.lan with POP3 (fetchmail-6.4.1); Tue, 1 Sep 2020 10:00:00 +0000", ""},
+		{"by box.lan (Postfix, from userid 0) id 1234; Tue, 1 Sep 2020 10:00:00 +0000", ""},
+		{"from box.lan by other.lan ([10.0.0.1]); Tue, 1 Sep 2020 10:00:00 +0000", ""},
+	}
+
+	for _, tt := range tests {
+		ip := receivedIP(tt.value)
+		if tt.ip == "" {
+			if ip != nil {
+				t.Errorf("Unexpected IP %s from %q", ip, tt.value)
+			}
+			continue
+		}
+		if !ip.Equal(net.ParseIP(tt.ip)) {
+			t.Errorf("Wrong IP from %q: got %s, expected %s", tt.value, ip, tt.ip)
+		}
+	}
+}
+
+func TestOriginatingIP(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	allowedList = access.List{Networks: []*net.IPNet{lan}}
+	defer func() { allowedList = access.List{} }()
+
+	received := []string{
+		"from fetch.lan (fetch.lan [192.168.1.10]) by letterbox.lan; Tue, 1 Sep 2020 10:00:02 +0000",
+		"from mail.example.com (mail.example.com [203.0.113.5]) by fetch.lan; Tue, 1 Sep 2020 10:00:01 +0000",
+		"from spoofed.example.com ([198.51.100.7]) by mail.example.com; Tue, 1 Sep 2020 10:00:00 +0000",
+	}
+
+	// Relayed by a trusted host, follow the chain until it leaves the LAN
+	ip := originatingIP(net.ParseIP("192.168.1.20"), received)
+	if !ip.Equal(net.ParseIP("203.0.113.5")) {
+		t.Errorf("Wrong originating IP: %s", ip)
+	}
+
+	// Untrusted client, the Received headers cannot be believed
+	ip = originatingIP(net.ParseIP("10.1.1.1"), received)
+	if !ip.Equal(net.ParseIP("10.1.1.1")) {
+		t.Errorf("Wrong originating IP for untrusted client: %s", ip)
+	}
+
+	// A trusted hop without an address stops the chain, the spoofed header below it isn't believed
+	hidden := []string{
+		"from fetch.lan (fetch.lan [192.168.1.10]) by letterbox.lan; Tue, 1 Sep 2020 10:00:02 +0000",
+		"from localhost by fetch.lan with POP3 (fetchmail-6.4.1); Tue, 1 Sep 2020 10:00:01 +0000",
+		"from spoofed.example.com ([198.51.100.7]) by mail.example.com; Tue, 1 Sep 2020 10:00:00 +0000",
+	}
+	if ip = originatingIP(net.ParseIP("192.168.1.20"), hidden); ip != nil {
+		t.Errorf("Spoofed originating IP believed: %s", ip)
+	}
+
+	// No Received headers
+	ip = originatingIP(net.ParseIP("192.168.1.20"), nil)
+	if !ip.Equal(net.ParseIP("192.168.1.20")) {
+		t.Errorf("Wrong originating IP with no Received headers: %s", ip)
+	}
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/bcl/letterbox/smtpd"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// relayTimeout limits how long a relay connection can take
+const relayTimeout = 5 * time.Minute
+
+// errRelayLimit is the reply for recipients over the relay caps when there is no queue to hold them
+var errRelayLimit = smtpd.SMTPError("451 4.7.0 Error: relay limit reached, try again later")
+
+// relayCounter remembers when recipients were relayed, to keep under the hourly and daily caps
+type relayCounter struct {
+	sync.Mutex
+	sent []time.Time
+}
+
+// relayCaps counts the recipients relayed to the smarthost
+var relayCaps = &relayCounter{}
+
+// take reserves up to n recipients under max_hourly and max_daily, returning how many may be relayed now
+// The caps are over the hour and day before now, not clock hours, so a
+// burst at the end of one hour can't be followed by another at the start
+// of the next.
+func (r *relayCounter) take(n int, now time.Time) int {
+	r.Lock()
+	defer r.Unlock()
+	for len(r.sent) > 0 && now.Sub(r.sent[0]) >= 24*time.Hour {
+		r.sent = r.sent[1:]
+	}
+	allowed := n
+	limit := func(max int, window time.Duration) {
+		if max <= 0 {
+			return
+		}
+		count := 0
+		for _, t := range r.sent {
+			if now.Sub(t) < window {
+				count++
+			}
+		}
+		if max-count < allowed {
+			allowed = max - count
+		}
+	}
+	limit(cfg.Relay.MaxHourly, time.Hour)
+	limit(cfg.Relay.MaxDaily, 24*time.Hour)
+	if allowed < 0 {
+		allowed = 0
+	}
+	for i := 0; i < allowed; i++ {
+		r.sent = append(r.sent, now)
+	}
+	return allowed
+}
+
+// release gives back the last n recipients taken, when they aren't relayed after all
+func (r *relayCounter) release(n int) {
+	r.Lock()
+	defer r.Unlock()
+	if n > len(r.sent) {
+		n = len(r.sent)
+	}
+	r.sent = r.sent[:len(r.sent)-n]
+}
+
+// relayMatch returns true if the address matches one of the patterns
+// A pattern is an address, a domain, or a domain starting with . which also
+// matches its subdomains.
+func relayMatch(patterns []string, address string) bool {
+	address = strings.ToLower(address)
+	domain := address[strings.LastIndex(address, "@")+1:]
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		switch {
+		case p == "":
+			continue
+		case strings.Contains(p, "@"):
+			if p == address || (p[0] == '@' && p[1:] == domain) {
+				return true
+			}
+		case p[0] == '.':
+			if domain == p[1:] || strings.HasSuffix(domain, p) {
+				return true
+			}
+		case p == domain:
+			return true
+		}
+	}
+	return false
+}
+
+// relayAllowed returns true if mail for the recipient can be relayed to the smarthost
+/*
+   Example TOML:
+
+   [relay]
+   host = "smtp.provider.com"
+   port = 587
+   username = "letterbox"
+   password = "secret"
+   require_tls = true
+   allow = ["mydomain.com", ".example.org"]
+   deny = ["ceo@mydomain.com"]
+   max_hourly = 100
+   max_daily = 500
+*/
+func relayAllowed(rcpt string) bool {
+	if cfg.Relay.Host == "" || !strings.Contains(rcpt, "@") {
+		return false
+	}
+	if relayMatch(cfg.Relay.Deny, rcpt) {
+		return false
+	}
+	return len(cfg.Relay.Allow) == 0 || relayMatch(cfg.Relay.Allow, rcpt)
+}
+
+// enhancedCodeRE matches a reply that starts with an RFC 3463 enhanced status code
+var enhancedCodeRE = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}( |$)`)
+
+// relayError converts an error from the smarthost into the reply for the client
+// Replies from the smarthost are passed on so that permanent failures stay
+// permanent, anything else is temporary. Replies without an enhanced status
+// code get the undefined one for their class, like 5.0.0.
+func relayError(err error) error {
+	if te, ok := err.(*textproto.Error); ok {
+		msg := te.Msg
+		if !enhancedCodeRE.MatchString(msg) {
+			msg = fmt.Sprintf("%d.0.0 %s", te.Code/100, msg)
+		}
+		return smtpd.SMTPError(fmt.Sprintf("%d %s", te.Code, msg))
+	}
+	return smtpd.SMTPError("451 4.4.1 Error: relay failed: " + err.Error())
+}
+
+// relayMessage sends the message to the smarthost and returns the error for each recipient that failed
+// helo is the name to greet the smarthost with, normally the hostname of the
+// listener the message arrived on, so that it matches the Received header.
+func relayMessage(helo, from string, rcpts []string, data []byte) map[string]error {
+	failed := make(map[string]error)
+	failAll := func(err error) map[string]error {
+		for _, rcpt := range rcpts {
+			if failed[rcpt] == nil {
+				failed[rcpt] = relayError(err)
+			}
+		}
+		return failed
+	}
+
+	port := cfg.Relay.Port
+	if port == 0 {
+		port = 25
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(cfg.Relay.Host, strconv.Itoa(port)), 30*time.Second)
+	if err != nil {
+		return failAll(err)
+	}
+	conn.SetDeadline(time.Now().Add(relayTimeout))
+	c, err := smtp.NewClient(conn, cfg.Relay.Host)
+	if err != nil {
+		conn.Close()
+		return failAll(err)
+	}
+	defer c.Close()
+
+	if helo == "" {
+		helo = localHostname()
+	}
+	if err := c.Hello(helo); err != nil {
+		return failAll(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: cfg.Relay.Host}); err != nil {
+			return failAll(err)
+		}
+	} else if cfg.Relay.RequireTLS {
+		return failAll(fmt.Errorf("%s does not support STARTTLS", cfg.Relay.Host))
+	}
+	if cfg.Relay.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.Relay.Username, cfg.Relay.Password, cfg.Relay.Host)); err != nil {
+			return failAll(err)
+		}
+	}
+
+	// net/smtp adds BODY=8BITMIME and SMTPUTF8 to MAIL when the smarthost has
+	// them, a message that needs one it doesn't have can't be sent as it is.
+	if err := relayExtensionsMissing(c, from, rcpts, data); err != nil {
+		for _, rcpt := range rcpts {
+			failed[rcpt] = err
+		}
+		return failed
+	}
+	if err := c.Mail(from); err != nil {
+		return failAll(err)
+	}
+	accepted := 0
+	for _, rcpt := range rcpts {
+		if err := c.Rcpt(rcpt); err != nil {
+			failed[rcpt] = relayError(err)
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		return failed
+	}
+	w, err := c.Data()
+	if err != nil {
+		return failAll(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return failAll(err)
+	}
+	if err := w.Close(); err != nil {
+		return failAll(err)
+	}
+	c.Quit()
+	return failed
+}
+
+// relayExtensionsMissing returns an error if the message needs SMTPUTF8 or 8BITMIME and the smarthost doesn't have it
+// Addresses that aren't ASCII need SMTPUTF8, and a message with 8-bit bytes
+// needs 8BITMIME. letterbox doesn't convert them, the message is refused.
+func relayExtensionsMissing(c *smtp.Client, from string, rcpts []string, data []byte) error {
+	utf8 := !isASCII([]byte(from))
+	for _, rcpt := range rcpts {
+		utf8 = utf8 || !isASCII([]byte(rcpt))
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); utf8 && !ok {
+		return smtpd.SMTPError(fmt.Sprintf("553 5.6.7 Error: %s does not support SMTPUTF8", cfg.Relay.Host))
+	}
+	if ok, _ := c.Extension("8BITMIME"); !isASCII(data) && !ok {
+		return smtpd.SMTPError(fmt.Sprintf("554 5.6.3 Error: %s does not support 8BITMIME", cfg.Relay.Host))
+	}
+	return nil
+}
+
+// isASCII returns true if data only has ASCII characters
+func isASCII(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/smtpd"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelayAllowed(t *testing.T) {
+	defer func() { cfg.Relay = config.Relay{} }()
+	if relayAllowed("user@remote.com") {
+		t.Error("Relay allowed without a relay host")
+	}
+
+	cfg.Relay = config.Relay{
+		Host:  "smtp.provider.com",
+		Allow: []string{"remote.com", ".example.org", "one@other.com"},
+		Deny:  []string{"ceo@remote.com", "@secret.example.org"},
+	}
+	allowed := []string{"user@remote.com", "User@REMOTE.com", "user@example.org", "user@mail.example.org", "one@other.com"}
+	for _, rcpt := range allowed {
+		if !relayAllowed(rcpt) {
+			t.Errorf("Relay to %s not allowed", rcpt)
+		}
+	}
+	denied := []string{"ceo@remote.com", "user@secret.example.org", "two@other.com", "user@notremote.com", "user"}
+	for _, rcpt := range denied {
+		if relayAllowed(rcpt) {
+			t.Errorf("Relay to %s allowed", rcpt)
+		}
+	}
+
+	cfg.Relay.Allow = nil
+	if !relayAllowed("anyone@anywhere.com") || relayAllowed("ceo@remote.com") {
+		t.Error("Empty allow list should allow everything that isn't denied")
+	}
+}
+
+// smarthostEnvelope records the message received by the test smarthost
+type smarthostEnvelope struct {
+	helo  string
+	rcpts []string
+	data  bytes.Buffer
+	done  chan *smarthostEnvelope
+}
+
+func (e *smarthostEnvelope) AddRecipient(rcpt smtpd.MailAddress) error {
+	if strings.HasPrefix(rcpt.Email(), "bad@") {
+		return smtpd.SMTPError("550 5.1.1 No such user")
+	}
+	if strings.HasPrefix(rcpt.Email(), "busy@") {
+		return smtpd.SMTPError("450 4.2.1 Too many messages, slow down")
+	}
+	e.rcpts = append(e.rcpts, rcpt.Email())
+	return nil
+}
+func (e *smarthostEnvelope) BeginData() error        { return nil }
+func (e *smarthostEnvelope) Write(line []byte) error { e.data.Write(line); return nil }
+func (e *smarthostEnvelope) Close() error            { e.done <- e; return nil }
+
+func TestRelayError(t *testing.T) {
+	tests := []struct {
+		err   error
+		reply string
+	}{
+		{&textproto.Error{Code: 550, Msg: "5.1.1 No such user"}, "550 5.1.1 No such user"},
+		{&textproto.Error{Code: 550, Msg: "No such user"}, "550 5.0.0 No such user"},
+		{&textproto.Error{Code: 452, Msg: "Too many recipients"}, "452 4.0.0 Too many recipients"},
+		{errors.New("connection refused"), "451 4.4.1 Error: relay failed: connection refused"},
+	}
+	for _, tt := range tests {
+		if reply := relayError(tt.err).Error(); reply != tt.reply {
+			t.Errorf("relayError(%v) = %q, expected %q", tt.err, reply, tt.reply)
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+
+	// The smarthost requires AUTH
+	smarthost, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer smarthost.Close()
+	received := make(chan *smarthostEnvelope, 1)
+	sh := &smtpd.Server{
+		Hostname: "smarthost",
+		OnAuth: func(c smtpd.Connection, username, password string) bool {
+			return username == "letterbox" && password == "secret"
+		},
+		AllowInsecureAuth: true,
+		OnNewMail: func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+			if c.AuthUser() == "" {
+				return nil, smtpd.SMTPError("530 5.7.0 Authentication required")
+			}
+			return &smarthostEnvelope{helo: c.Hello(), done: received}, nil
+		},
+	}
+	go sh.Serve(smarthost)
+	_, port, _ := net.SplitHostPort(smarthost.Addr().String())
+
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	cfg.Relay.Host = "127.0.0.1"
+	cfg.Relay.Port, _ = strconv.Atoi(port)
+	cfg.Relay.Username = "letterbox"
+	cfg.Relay.Password = "secret"
+	cfg.Relay.Deny = []string{"denied.com"}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := &smtpd.Server{
+		Hostname:        "localhost",
+		OnNewConnection: onNewConnection,
+		OnNewMail:       onNewMail,
+	}
+	go s.Serve(ln)
+
+	client, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Mail("sender@domain.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"bcl@domain.com", "friend@remote.com"} {
+		if err := client.Rcpt(rcpt); err != nil {
+			t.Fatalf("RCPT TO %s failed: %s", rcpt, err)
+		}
+	}
+	if err := client.Rcpt("user@denied.com"); err == nil {
+		t.Error("Relay to a denied domain was accepted")
+	}
+	w, err := client.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Subject: split\r\n\r\n.leading dot\r\nHello\r\n"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Message not accepted: %s", err)
+	}
+
+	env := <-received
+	if env.helo != "localhost" {
+		t.Errorf("Relay greeted the smarthost as %q instead of the listener's hostname", env.helo)
+	}
+	if len(env.rcpts) != 1 || env.rcpts[0] != "friend@remote.com" {
+		t.Errorf("Smarthost got the wrong recipients: %v", env.rcpts)
+	}
+	if !strings.HasPrefix(env.data.String(), "Received: ") || !strings.HasSuffix(env.data.String(), "\r\nSubject: split\r\n\r\n.leading dot\r\nHello\r\n") {
+		t.Errorf("Smarthost got the wrong message: %q", env.data.String())
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new")); len(files) != 1 {
+		t.Error("Local recipient not delivered")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "friend")); !os.IsNotExist(err) {
+		t.Error("Relayed recipient was delivered locally")
+	}
+
+	// Failures from the smarthost are passed back to the client
+	failed := relayMessage("", "sender@domain.com", []string{"bad@remote.com"}, []byte("Subject: test\r\n\r\n"))
+	if err := failed["bad@remote.com"]; err == nil || !strings.HasPrefix(err.Error(), "550 5.1.1") {
+		t.Errorf("Smarthost rejection not passed on: %v", err)
+	}
+	cfg.Relay.Password = "wrong"
+	failed = relayMessage("", "sender@domain.com", []string{"friend@remote.com"}, []byte("Subject: test\r\n\r\n"))
+	if err := failed["friend@remote.com"]; err == nil {
+		t.Error("Relay with the wrong password succeeded")
+	}
+}
+
+func TestRelayCapsTake(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	cfg.Relay.MaxHourly = 3
+	cfg.Relay.MaxDaily = 5
+	caps := &relayCounter{}
+	now := time.Now()
+	if n := caps.take(2, now); n != 2 {
+		t.Errorf("took %d of 2, expected 2", n)
+	}
+	if n := caps.take(2, now.Add(time.Minute)); n != 1 {
+		t.Errorf("took %d of 2 at the hourly cap, expected 1", n)
+	}
+	if n := caps.take(1, now.Add(59*time.Minute)); n != 0 {
+		t.Errorf("took %d over the hourly cap", n)
+	}
+	// The first two have left the hour, but the day only has room for two more
+	if n := caps.take(3, now.Add(time.Hour)); n != 2 {
+		t.Errorf("took %d of 3 at the daily cap, expected 2", n)
+	}
+	if n := caps.take(1, now.Add(23*time.Hour)); n != 0 {
+		t.Errorf("took %d over the daily cap", n)
+	}
+	if n := caps.take(1, now.Add(24*time.Hour)); n != 1 {
+		t.Errorf("took %d after a day, expected 1", n)
+	}
+}
+
+func TestRelayCaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+		relayCaps = &relayCounter{}
+	}()
+	cmdline.Maildirs = dir
+
+	smarthost, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer smarthost.Close()
+	received := make(chan *smarthostEnvelope, 1)
+	sh := &smtpd.Server{
+		Hostname: "smarthost",
+		OnNewMail: func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+			return &smarthostEnvelope{helo: c.Hello(), done: received}, nil
+		},
+	}
+	go sh.Serve(smarthost)
+	_, port, _ := net.SplitHostPort(smarthost.Addr().String())
+
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Relay.Host = "127.0.0.1"
+	cfg.Relay.Port, _ = strconv.Atoi(port)
+	cfg.Relay.MaxHourly = 1
+	parseHosts()
+	relayCaps = &relayCounter{}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+
+	// Without a queue the message is refused for now, so the recipient under the cap doesn't get it twice
+	rcpts := []string{"one@remote.com", "two@remote.com"}
+	message := []byte("Subject: capped\r\n\r\nHello\r\n")
+	err = smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", rcpts, message)
+	if err == nil || !strings.HasPrefix(err.Error(), "451") || !strings.Contains(err.Error(), "4.7.0") {
+		t.Errorf("Recipient over the cap not deferred: %v", err)
+	}
+	select {
+	case env := <-received:
+		t.Errorf("Smarthost got %v from a refused message", env.rcpts)
+	default:
+	}
+	if n := relayCaps.take(1, time.Now()); n != 1 {
+		t.Error("Refused message used up the relay cap")
+	}
+
+	// With a queue they are held until the cap allows them
+	relayCaps = &relayCounter{}
+	cfg.Queue.Dir = filepath.Join(dir, "queue")
+	if err := setupQueue(); err != nil {
+		t.Fatal(err)
+	}
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", rcpts, message); err != nil {
+		t.Fatalf("Message not accepted: %s", err)
+	}
+	<-received
+	entries, _ := filepath.Glob(filepath.Join(cfg.Queue.Dir, "*.json"))
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 queued message: %v", entries)
+	}
+	now := time.Now()
+	if err := processQueue(now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	env := <-received
+	if len(env.rcpts) != 1 || env.rcpts[0] != "two@remote.com" {
+		t.Errorf("Smarthost got %v from the queue, expected two@remote.com", env.rcpts)
+	}
+	if env.helo != "mx.domain.com" {
+		t.Errorf("Queued relay greeted the smarthost as %q", env.helo)
+	}
+	if !strings.HasSuffix(env.data.String(), "\r\nSubject: capped\r\n\r\nHello\r\n") {
+		t.Errorf("Smarthost got the wrong message from the queue: %q", env.data.String())
+	}
+	if entries, _ := filepath.Glob(filepath.Join(cfg.Queue.Dir, "*.json")); len(entries) != 0 {
+		t.Errorf("Relayed message still queued: %v", entries)
+	}
+}
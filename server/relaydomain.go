@@ -0,0 +1,192 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/smtpd"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// relayConnectWait limits how long a message waits for one of its domain's relay connections to be free
+const relayConnectWait = time.Minute
+
+// errDomainDeferred is the reply for recipients whose domain is over its limits, or backing off after a 421 or 450
+var errDomainDeferred = smtpd.SMTPError("451 4.7.0 Error: relaying to this domain is deferred, try again later")
+
+// domainState is what is known about relaying to one recipient domain
+type domainState struct {
+	open     int         // connections to the smarthost open for the domain
+	sent     []time.Time // when messages were relayed to the domain in the last hour
+	failures int         // 421 and 450 replies in a row
+	until    time.Time   // nothing is relayed to the domain before this, after a 421 or 450
+}
+
+// domainLimiter keeps relaying to each recipient domain under its [relay.domains] limits
+type domainLimiter struct {
+	sync.Mutex
+	domains map[string]*domainState
+}
+
+// relayDomains limits the messages relayed to each recipient domain
+var relayDomains = &domainLimiter{domains: make(map[string]*domainState)}
+
+// relayDomain returns the lowercase domain of the recipient
+func relayDomain(rcpt string) string {
+	return strings.ToLower(rcpt[strings.LastIndex(rcpt, "@")+1:])
+}
+
+// domainLimits returns the limits for relaying to the domain
+/*
+   Example TOML:
+
+   [relay.domains."gmail.com"]
+   max_connections = 2
+   max_per_minute = 10
+   max_hourly = 200
+
+   [relay.domains."*"]
+   max_connections = 5
+
+   The "*" limits apply to each domain that isn't listed on its own.
+*/
+func domainLimits(domain string) config.RelayDomain {
+	for name, limits := range cfg.Relay.Domains {
+		if strings.EqualFold(name, domain) {
+			return limits
+		}
+	}
+	return cfg.Relay.Domains["*"]
+}
+
+// groupByDomain splits the recipients by domain, keeping the order the domains are first seen in
+func groupByDomain(rcpts []string) ([]string, map[string][]string) {
+	var domains []string
+	groups := make(map[string][]string)
+	for _, rcpt := range rcpts {
+		domain := relayDomain(rcpt)
+		if _, ok := groups[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		groups[domain] = append(groups[domain], rcpt)
+	}
+	return domains, groups
+}
+
+// state returns the domain's state, which must be called with the limiter locked
+func (d *domainLimiter) state(domain string) *domainState {
+	st, ok := d.domains[domain]
+	if !ok {
+		st = &domainState{}
+		d.domains[domain] = st
+	}
+	return st
+}
+
+// admit returns the recipients whose domains can be sent a message now, and the ones that have to wait
+// Each admitted domain counts one message against its max_per_minute and
+// max_hourly. A domain that replied 421 or 450 waits out its backoff.
+func (d *domainLimiter) admit(rcpts []string, now time.Time) ([]string, []string) {
+	d.Lock()
+	defer d.Unlock()
+	var admitted, deferred []string
+	domains, groups := groupByDomain(rcpts)
+	for _, domain := range domains {
+		st := d.state(domain)
+		for len(st.sent) > 0 && now.Sub(st.sent[0]) >= time.Hour {
+			st.sent = st.sent[1:]
+		}
+		limits := domainLimits(domain)
+		minute := 0
+		for _, t := range st.sent {
+			if now.Sub(t) < time.Minute {
+				minute++
+			}
+		}
+		switch {
+		case now.Before(st.until):
+			logDebugf("Backing off from %s until %s", domain, st.until.Format(time.RFC3339))
+		case limits.MaxPerMinute > 0 && minute >= limits.MaxPerMinute, limits.MaxHourly > 0 && len(st.sent) >= limits.MaxHourly:
+			logDebugf("Relay rate limit reached for %s", domain)
+		default:
+			st.sent = append(st.sent, now)
+			admitted = append(admitted, groups[domain]...)
+			continue
+		}
+		deferred = append(deferred, groups[domain]...)
+	}
+	return admitted, deferred
+}
+
+// release gives back the messages admitted for the recipients' domains, when they aren't relayed after all
+func (d *domainLimiter) release(rcpts []string) {
+	d.Lock()
+	defer d.Unlock()
+	domains, _ := groupByDomain(rcpts)
+	for _, domain := range domains {
+		if st := d.state(domain); len(st.sent) > 0 {
+			st.sent = st.sent[:len(st.sent)-1]
+		}
+	}
+}
+
+// connect waits for one of the domain's max_connections to be free and takes it, returning false if it waited too long
+func (d *domainLimiter) connect(domain string) bool {
+	deadline := time.Now().Add(relayConnectWait)
+	for {
+		d.Lock()
+		st := d.state(domain)
+		if max := domainLimits(domain).MaxConnections; max <= 0 || st.open < max {
+			st.open++
+			d.Unlock()
+			return true
+		}
+		d.Unlock()
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// finished frees the domain's connection, and starts backing off from it if the smarthost replied 421 or 450
+// The backoff grows like the queue's retries while the replies keep coming,
+// and is reset by a message that gets through without one.
+func (d *domainLimiter) finished(domain string, failed map[string]error, now time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	st := d.state(domain)
+	st.open--
+	for _, err := range failed {
+		if reply := err.Error(); strings.HasPrefix(reply, "421") || strings.HasPrefix(reply, "450") {
+			st.failures++
+			st.until = now.Add(retryDelay(st.failures))
+			log.Printf("Relaying to %s got %s, backing off until %s", domain, reply, st.until.Format(time.RFC3339))
+			return
+		}
+	}
+	st.failures = 0
+	st.until = time.Time{}
+}
+
+// relayByDomain relays the message to the smarthost in one transaction for each recipient domain, returning the error for each recipient that failed
+// Domains whose connections stay busy too long are failed with errDomainDeferred.
+func relayByDomain(helo, from string, rcpts []string, data []byte) map[string]error {
+	failed := make(map[string]error)
+	domains, groups := groupByDomain(rcpts)
+	for _, domain := range domains {
+		if !relayDomains.connect(domain) {
+			for _, rcpt := range groups[domain] {
+				failed[rcpt] = errDomainDeferred
+			}
+			continue
+		}
+		f := relayMessage(helo, from, groups[domain], data)
+		relayDomains.finished(domain, f, time.Now())
+		for rcpt, err := range f {
+			failed[rcpt] = err
+		}
+	}
+	return failed
+}
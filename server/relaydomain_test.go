@@ -0,0 +1,168 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/smtpd"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDomainAdmit(t *testing.T) {
+	defer func() {
+		cfg = config.Config{}
+		relayDomains = &domainLimiter{domains: make(map[string]*domainState)}
+	}()
+	cfg.Relay.Domains = map[string]config.RelayDomain{
+		"Gmail.com": {MaxPerMinute: 2, MaxHourly: 3},
+		"*":         {MaxHourly: 1},
+	}
+	now := time.Now()
+
+	// One message for each domain, however many of its recipients it has
+	rcpts := []string{"a@gmail.com", "b@GMAIL.com", "c@other.com"}
+	admitted, deferred := relayDomains.admit(rcpts, now)
+	if !reflect.DeepEqual(admitted, rcpts) || deferred != nil {
+		t.Errorf("Wrong first admit: %v, %v", admitted, deferred)
+	}
+	admitted, deferred = relayDomains.admit(rcpts, now)
+	if !reflect.DeepEqual(admitted, []string{"a@gmail.com", "b@GMAIL.com"}) || !reflect.DeepEqual(deferred, []string{"c@other.com"}) {
+		t.Errorf("Wrong second admit: %v, %v", admitted, deferred)
+	}
+	if admitted, _ := relayDomains.admit([]string{"a@gmail.com"}, now); admitted != nil {
+		t.Error("Admitted over max_per_minute")
+	}
+	if admitted, _ := relayDomains.admit([]string{"a@gmail.com"}, now.Add(time.Minute)); admitted == nil {
+		t.Error("Not admitted after a minute")
+	}
+	if admitted, _ := relayDomains.admit([]string{"a@gmail.com"}, now.Add(2*time.Minute)); admitted != nil {
+		t.Error("Admitted over max_hourly")
+	}
+
+	// A released message doesn't count
+	relayDomains.release([]string{"a@gmail.com"})
+	if admitted, _ := relayDomains.admit([]string{"a@gmail.com"}, now.Add(2*time.Minute)); admitted == nil {
+		t.Error("Released message still counted")
+	}
+	if admitted, _ := relayDomains.admit([]string{"c@other.com"}, now.Add(time.Hour)); admitted == nil {
+		t.Error("Not admitted after an hour")
+	}
+}
+
+func TestDomainBackoff(t *testing.T) {
+	defer func() { relayDomains = &domainLimiter{domains: make(map[string]*domainState)} }()
+	now := time.Now()
+	relayDomains.connect("remote.com")
+	relayDomains.finished("remote.com", map[string]error{"a@remote.com": smtpd.SMTPError("421 4.7.0 Try again later")}, now)
+	if admitted, _ := relayDomains.admit([]string{"a@remote.com"}, now.Add(30*time.Second)); admitted != nil {
+		t.Error("Admitted while backing off")
+	}
+	if admitted, _ := relayDomains.admit([]string{"a@remote.com"}, now.Add(time.Minute)); admitted == nil {
+		t.Error("Not admitted after backing off")
+	}
+
+	// The backoff doubles while the domain keeps deferring, and a message that gets through resets it
+	relayDomains.connect("remote.com")
+	relayDomains.finished("remote.com", map[string]error{"a@remote.com": smtpd.SMTPError("450 4.2.1 Slow down")}, now)
+	if admitted, _ := relayDomains.admit([]string{"a@remote.com"}, now.Add(90*time.Second)); admitted != nil {
+		t.Error("Backoff didn't grow")
+	}
+	relayDomains.connect("remote.com")
+	relayDomains.finished("remote.com", map[string]error{"b@remote.com": smtpd.SMTPError("550 5.1.1 No such user")}, now)
+	if admitted, _ := relayDomains.admit([]string{"a@remote.com"}, now); admitted == nil {
+		t.Error("Backoff not reset")
+	}
+}
+
+func TestDomainConnections(t *testing.T) {
+	defer func() {
+		cfg = config.Config{}
+		relayDomains = &domainLimiter{domains: make(map[string]*domainState)}
+	}()
+	cfg.Relay.Domains = map[string]config.RelayDomain{"remote.com": {MaxConnections: 1}}
+	if !relayDomains.connect("remote.com") {
+		t.Fatal("First connection refused")
+	}
+	start := time.Now()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		relayDomains.finished("remote.com", nil, time.Now())
+	}()
+	if !relayDomains.connect("remote.com") {
+		t.Fatal("Second connection refused")
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Error("Second connection didn't wait for the first")
+	}
+	if !relayDomains.connect("other.com") {
+		t.Error("Connection to another domain refused")
+	}
+}
+
+func TestRelayBackoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+		relayDomains = &domainLimiter{domains: make(map[string]*domainState)}
+	}()
+	cmdline.Maildirs = dir
+
+	smarthost, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer smarthost.Close()
+	received := make(chan *smarthostEnvelope, 2)
+	sh := &smtpd.Server{
+		Hostname: "smarthost",
+		OnNewMail: func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+			return &smarthostEnvelope{helo: c.Hello(), done: received}, nil
+		},
+	}
+	go sh.Serve(smarthost)
+	_, port, _ := net.SplitHostPort(smarthost.Addr().String())
+
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	cfg.Relay.Host = "127.0.0.1"
+	cfg.Relay.Port, _ = strconv.Atoi(port)
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+
+	// The 450 for busy@slow.com has letterbox back off from slow.com, but not from remote.com
+	message := []byte("Subject: relayed\r\n\r\nHello\r\n")
+	err = smtp.SendMail(ln.Addr().String(), nil, "bcl@domain.com", []string{"busy@slow.com"}, message)
+	if err == nil || !strings.HasPrefix(err.Error(), "450") {
+		t.Errorf("Smarthost's 450 not passed on: %v", err)
+	}
+	err = smtp.SendMail(ln.Addr().String(), nil, "bcl@domain.com", []string{"user@slow.com"}, message)
+	if err == nil || !strings.HasPrefix(err.Error(), "451") {
+		t.Errorf("Message relayed while backing off: %v", err)
+	}
+	if err := smtp.SendMail(ln.Addr().String(), nil, "bcl@domain.com", []string{"user@remote.com"}, message); err != nil {
+		t.Errorf("Message to another domain refused: %s", err)
+	}
+	if env := <-received; strings.Join(env.rcpts, ",") != "user@remote.com" {
+		t.Errorf("Smarthost got %v", env.rcpts)
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"log"
+	"os"
+	"sync"
+)
+
+// configLock protects the parts of the config that are replaced by reloadConfig
+// These are cfg.Hosts, cfg.ExemptHosts, cfg.Emails, cfg.Groups, allowedList,
+// exemptList, proxyList, and fileHosts which is replaced by reloadHostsFiles.
+var configLock sync.RWMutex
+
+// currentEmails returns the email whitelist
+// Envelopes keep the list they started with, so a reload doesn't change the
+// rules for mail that is already being received.
+func currentEmails() []string {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return cfg.Emails
+}
+
+// currentGroups returns the groups of addresses
+func currentGroups() map[string][]string {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return cfg.Groups
+}
+
+// diffLists returns the entries that are only in new and the entries that are only in old
+func diffLists(old, new []string) ([]string, []string) {
+	inOld := make(map[string]bool)
+	for _, s := range old {
+		inOld[s] = true
+	}
+	inNew := make(map[string]bool)
+	var added, removed []string
+	for _, s := range new {
+		inNew[s] = true
+		if !inOld[s] {
+			added = append(added, s)
+		}
+	}
+	for _, s := range old {
+		if !inNew[s] {
+			removed = append(removed, s)
+		}
+	}
+	return added, removed
+}
+
+// logDiff logs the changes to one of the config's lists
+func logDiff(name string, old, new []string) {
+	added, removed := diffLists(old, new)
+	for _, s := range added {
+		log.Printf("Added to %s: %s", name, s)
+	}
+	for _, s := range removed {
+		log.Printf("Removed from %s: %s", name, s)
+	}
+}
+
+// reloadConfig reads the config file again and replaces the hosts, exempt hosts, emails, and groups
+// Hostnames in the hosts list are looked up again before anything is replaced,
+// and the config is kept if there is an error. Connections that are already
+// open keep going, new connections use the new lists. Other settings need a
+// restart to change.
+func reloadConfig() {
+	f, err := os.Open(cmdline.Config)
+	if err != nil {
+		log.Printf("Error reloading config, keeping the old one: %s", err)
+		return
+	}
+	newCfg, err := readConfig(f)
+	f.Close()
+	if err != nil {
+		log.Printf("Error reloading config, keeping the old one: %s", err)
+		return
+	}
+	allowed := access.Resolve(configHosts(newCfg.Hosts))
+	exempt := access.Resolve(newCfg.ExemptHosts)
+
+	configLock.Lock()
+	oldHosts, oldExempt, oldEmails := cfg.Hosts, cfg.ExemptHosts, cfg.Emails
+	cfg.Hosts, cfg.ExemptHosts, cfg.Emails, cfg.Groups = newCfg.Hosts, newCfg.ExemptHosts, newCfg.Emails, newCfg.Groups
+	allowedList, exemptList = allowed, exempt
+	configLock.Unlock()
+
+	log.Printf("Reloaded config from %s", cmdline.Config)
+	logDiff("hosts", oldHosts, newCfg.Hosts)
+	logDiff("exempt_hosts", oldExempt, newCfg.ExemptHosts)
+	logDiff("emails", oldEmails, newCfg.Emails)
+}
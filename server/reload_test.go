@@ -0,0 +1,71 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffLists(t *testing.T) {
+	added, removed := diffLists([]string{"a", "b", "c"}, []string{"b", "c", "d"})
+	if !reflect.DeepEqual(added, []string{"d"}) || !reflect.DeepEqual(removed, []string{"a"}) {
+		t.Errorf("Wrong diff: added %v removed %v", added, removed)
+	}
+	added, removed = diffLists(nil, nil)
+	if added != nil || removed != nil {
+		t.Errorf("Wrong diff of empty lists: added %v removed %v", added, removed)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "letterbox-*.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	configFile := cmdline.Config
+	defer func() {
+		cmdline.Config = configFile
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Config = f.Name()
+
+	cfg.Hosts = []string{"192.168.1.0/24"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	parseHosts()
+	oldEmails := currentEmails()
+
+	ioutil.WriteFile(f.Name(), []byte(`
+hosts = ["10.0.0.0/8"]
+emails = ["bcl@domain.com", "alice@domain.com"]
+`), 0600)
+	out := captureOutput(reloadConfig, false)
+	for _, s := range []string{"Added to hosts: 10.0.0.0/8", "Removed from hosts: 192.168.1.0/24", "Added to emails: alice@domain.com"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Missing %q in log:\n%s", s, out)
+		}
+	}
+	if hostAllowed(net.ParseIP("192.168.1.1")) || !hostAllowed(net.ParseIP("10.1.2.3")) {
+		t.Error("Hosts not reloaded")
+	}
+	if len(currentEmails()) != 2 {
+		t.Errorf("Emails not reloaded: %v", currentEmails())
+	}
+	if len(oldEmails) != 1 {
+		t.Errorf("Emails from before the reload changed: %v", oldEmails)
+	}
+
+	// A broken config keeps the current one
+	ioutil.WriteFile(f.Name(), []byte(`hosts = [`), 0600)
+	out = captureOutput(reloadConfig, false)
+	if !strings.Contains(out, "keeping the old one") || !hostAllowed(net.ParseIP("10.1.2.3")) {
+		t.Errorf("Config not kept after a bad reload:\n%s", out)
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// defaultMaxDelay is used when max_delay isn't set
+const defaultMaxDelay = 60 * time.Second
+
+// reputationSaveInterval is how often the scores are pruned and saved
+const reputationSaveInterval = time.Minute
+
+// How much is added to a client's score for each kind of bad behavior
+const (
+	rejectPenalty = 1 // a rejected connection or recipient
+	junkPenalty   = 1 // a message the spam filter or a milter marked as junk
+	spamPenalty   = 3 // a message rejected as spam
+	virusPenalty  = 5 // a message with a virus
+)
+
+// reputationEntry is the score for a single IP, as of the Updated time
+type reputationEntry struct {
+	Score   float64   `json:"score"`
+	Updated time.Time `json:"updated"`
+}
+
+// reputationDB tracks the bad behavior of client IPs
+// Scores are incremented when a client is rejected, and decay over time.
+type reputationDB struct {
+	sync.Mutex
+	entries  map[string]*reputationEntry
+	halfLife time.Duration
+	path     string // Path to save the scores to, or "" to only keep them in memory
+	changed  bool   // true if the scores have changed since they were saved
+}
+
+var reputation = newReputationDB("", 0)
+
+// newReputationDB returns an empty reputationDB
+// If halfLife is 0 it uses a default of 24 hours.
+func newReputationDB(path string, halfLife time.Duration) *reputationDB {
+	if halfLife == 0 {
+		halfLife = 24 * time.Hour
+	}
+	return &reputationDB{
+		entries:  make(map[string]*reputationEntry),
+		halfLife: halfLife,
+		path:     path,
+	}
+}
+
+// decayed returns the entry's score decayed to time now
+func (r *reputationDB) decayed(e *reputationEntry, now time.Time) float64 {
+	elapsed := now.Sub(e.Updated)
+	if elapsed <= 0 {
+		return e.Score
+	}
+	return e.Score * math.Pow(0.5, float64(elapsed)/float64(r.halfLife))
+}
+
+// score returns the current score for an IP, 0 is a client with no recent bad behavior
+func (r *reputationDB) score(ip net.IP) float64 {
+	r.Lock()
+	defer r.Unlock()
+	e, ok := r.entries[ip.String()]
+	if !ok {
+		return 0
+	}
+	return r.decayed(e, time.Now())
+}
+
+// penalize adds to an IP's score
+// The scores are saved by flush.
+func (r *reputationDB) penalize(ip net.IP, amount float64) {
+	if ip == nil || hostExempt(ip) {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	e, ok := r.entries[ip.String()]
+	if !ok {
+		e = &reputationEntry{}
+		r.entries[ip.String()] = e
+	}
+	e.Score = r.decayed(e, now) + amount
+	e.Updated = now
+	r.changed = true
+	logDebugf("Reputation of %s is now %0.2f", ip, e.Score)
+}
+
+// flush drops the scores that have decayed away, and saves the scores if they have changed
+func (r *reputationDB) flush(now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	for ip, e := range r.entries {
+		if r.decayed(e, now) < 0.01 {
+			delete(r.entries, ip)
+			r.changed = true
+		}
+	}
+	if !r.changed {
+		return
+	}
+	if err := r.save(); err != nil {
+		log.Printf("Error saving reputation scores: %s", err)
+		return
+	}
+	r.changed = false
+}
+
+// runReputation prunes and saves the scores every reputationSaveInterval, and once more when the context is done
+func runReputation(ctx context.Context) {
+	ticker := time.NewTicker(reputationSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			reputation.flush(time.Now())
+			return
+		case now := <-ticker.C:
+			reputation.flush(now)
+		}
+	}
+}
+
+// load reads the scores from the state file, a missing file is not an error
+func (r *reputationDB) load() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	return json.Unmarshal(data, &r.entries)
+}
+
+// save writes the scores to the state file
+// It must be called with the lock held.
+func (r *reputationDB) save() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(r.entries)
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// setupReputation creates the reputation database from the config and loads the saved scores
+func setupReputation() error {
+	var statePath string
+	if cfg.StateDir != "" {
+		statePath = path.Join(cfg.StateDir, "reputation.json")
+	}
+	reputation = newReputationDB(statePath, cfg.Reputation.HalfLife.Duration)
+	return reputation.load()
+}
+
+// scaledDelay multiplies the delay by factor, limited to max_delay
+func scaledDelay(d time.Duration, factor float64) time.Duration {
+	maxDelay := cfg.Reputation.MaxDelay.Duration
+	if maxDelay == 0 {
+		maxDelay = defaultMaxDelay
+	}
+	scaled := time.Duration(float64(d) * factor)
+	if scaled > maxDelay {
+		return maxDelay
+	}
+	return scaled
+}
+
+// greetingDelay delays the banner by greeting_delay for each point of the client's score
+// A client with no recent bad behavior is not delayed at all.
+func greetingDelay(ip net.IP) {
+	if cfg.Reputation.GreetingDelay.Duration == 0 || ip == nil || hostExempt(ip) {
+		return
+	}
+	score := reputation.score(ip)
+	if d := scaledDelay(cfg.Reputation.GreetingDelay.Duration, score); d > 0 {
+		logDebugf("Delaying greeting to %s by %s, reputation %0.2f", ip, d, score)
+		time.Sleep(d)
+	}
+}
+
+// tarpit delays the response to a client with a bad reputation
+// The delay is tarpit_delay at tarpit_score and grows as the score does.
+func tarpit(ip net.IP) {
+	if cfg.Reputation.TarpitScore <= 0 || ip == nil || hostExempt(ip) {
+		return
+	}
+	score := reputation.score(ip)
+	if score < cfg.Reputation.TarpitScore {
+		return
+	}
+	d := scaledDelay(cfg.Reputation.TarpitDelay.Duration, score/cfg.Reputation.TarpitScore)
+	logDebugf("Tarpitting %s for %s, reputation %0.2f", ip, d, score)
+	time.Sleep(d)
+}
+
+// lowReputation returns true if the client's score is at or above greylist_score
+// Its mail is greylisted even if the greylist isn't enabled for everyone.
+func lowReputation(ip net.IP) bool {
+	if cfg.Reputation.GreylistScore <= 0 || ip == nil || hostExempt(ip) {
+		return false
+	}
+	return reputation.score(ip) >= cfg.Reputation.GreylistScore
+}
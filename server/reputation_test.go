@@ -0,0 +1,111 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestReputationDecay(t *testing.T) {
+	r := newReputationDB("", time.Hour)
+	e := &reputationEntry{Score: 8, Updated: time.Now().Add(-2 * time.Hour)}
+	if score := r.decayed(e, time.Now()); score < 1.99 || score > 2.01 {
+		t.Fatalf("Wrong decayed score: %f", score)
+	}
+
+	ip := net.ParseIP("192.168.1.1")
+	if r.score(ip) != 0 {
+		t.Fatal("Unknown IP should have a score of 0")
+	}
+	r.penalize(ip, 1)
+	r.penalize(ip, 1)
+	if score := r.score(ip); score < 1.99 || score > 2.0 {
+		t.Fatalf("Wrong score after penalties: %f", score)
+	}
+}
+
+func TestReputationSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newReputationDB(path.Join(dir, "reputation.json"), 0)
+	r.penalize(net.ParseIP("10.0.0.1"), 3)
+	r.penalize(net.ParseIP("2001:db8::1"), 1)
+	if _, err := os.Stat(path.Join(dir, "reputation.json")); err == nil {
+		t.Error("Scores saved before flush")
+	}
+	r.flush(time.Now())
+
+	loaded := newReputationDB(path.Join(dir, "reputation.json"), 0)
+	if err := loaded.load(); err != nil {
+		t.Fatalf("Error loading scores: %s", err)
+	}
+	if score := loaded.score(net.ParseIP("10.0.0.1")); score < 2.99 {
+		t.Errorf("Wrong score for 10.0.0.1: %f", score)
+	}
+	if score := loaded.score(net.ParseIP("2001:db8::1")); score < 0.99 {
+		t.Errorf("Wrong score for 2001:db8::1: %f", score)
+	}
+
+	// A missing file is not an error
+	missing := newReputationDB(path.Join(dir, "missing.json"), 0)
+	if err := missing.load(); err != nil {
+		t.Errorf("Error loading missing file: %s", err)
+	}
+}
+
+func TestReputationFlush(t *testing.T) {
+	r := newReputationDB("", time.Hour)
+	r.penalize(net.ParseIP("10.0.0.1"), 1)
+	r.penalize(net.ParseIP("10.0.0.2"), 1000)
+
+	// Scores that have decayed away are dropped even without a state_dir
+	r.flush(time.Now().Add(10 * time.Hour))
+	if len(r.entries) != 1 || r.entries["10.0.0.2"] == nil {
+		t.Errorf("Wrong scores after flush: %v", r.entries)
+	}
+}
+
+func TestLowReputation(t *testing.T) {
+	defer func() {
+		cfg = config.Config{}
+		reputation = newReputationDB("", 0)
+		greylistTriples = newGreylistDB("")
+	}()
+	cfg.Reputation.GreylistScore = 3
+	ip := net.ParseIP("192.168.1.5")
+	reputation.penalize(ip, 2)
+	e := &env{from: "sender@remote.com", clientIP: ip, client: testConn{}}
+	if lowReputation(ip) || e.greylisted("bcl@domain.com", time.Now()) {
+		t.Error("Client below greylist_score greylisted")
+	}
+	reputation.penalize(ip, 2)
+	if !lowReputation(ip) || !e.greylisted("bcl@domain.com", time.Now()) {
+		t.Error("Client at greylist_score not greylisted")
+	}
+}
+
+func TestScaledDelay(t *testing.T) {
+	if d := scaledDelay(time.Second, 2.5); d != 2500*time.Millisecond {
+		t.Errorf("Wrong scaled delay: %s", d)
+	}
+	if d := scaledDelay(time.Second, 0); d != 0 {
+		t.Errorf("Wrong delay for a score of 0: %s", d)
+	}
+	if d := scaledDelay(time.Second, 1000); d != defaultMaxDelay {
+		t.Errorf("Delay not limited to default: %s", d)
+	}
+
+	cfg.Reputation.MaxDelay.Duration = 5 * time.Second
+	defer func() { cfg.Reputation.MaxDelay.Duration = 0 }()
+	if d := scaledDelay(time.Second, 1000); d != 5*time.Second {
+		t.Errorf("Delay not limited to max_delay: %s", d)
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bcl/letterbox/smtpd"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The status of a message for one of its recipients
+const (
+	resultDelivered = "delivered" // delivered, discarded by a filter, piped, forwarded, or relayed
+	resultDeferred  = "deferred"  // queued or held, or the client has to send it again
+	resultRejected  = "rejected"  // it won't be delivered to the recipient
+)
+
+// maxResults is how many of the recent delivery results are kept
+const maxResults = 200
+
+// deliveryResult is what happened to a message for one of its recipients
+type deliveryResult struct {
+	Time         time.Time `json:"time"`
+	Conn         string    `json:"conn"`
+	QueueID      string    `json:"queue_id,omitempty"`
+	From         string    `json:"from,omitempty"`
+	Rcpt         string    `json:"rcpt"`
+	Status       string    `json:"status"`                 // delivered, deferred, or rejected
+	Paths        []string  `json:"paths,omitempty"`        // maildir files and mboxes it was delivered to
+	Dispositions []string  `json:"dispositions,omitempty"` // what was done with each copy, like delivered, queued, or relayed
+	Reason       string    `json:"reason,omitempty"`       // why it was deferred or rejected
+	Reply        string    `json:"reply"`                  // the LMTP reply for the recipient
+	Tags         []string  `json:"tags,omitempty"`         // policy tags of the message
+}
+
+// rcptOutcome is what Close did with the copies of the message for a recipient
+type rcptOutcome struct {
+	dispositions []string
+	paths        []string
+}
+
+// newDeliveryResult returns the result for a recipient from its delivery error and what was done with its copies
+// A recipient without an error whose copies were all queued or held is
+// deferred, but it is accepted, the client doesn't have to send it again.
+func newDeliveryResult(rcpt string, err error, outcome rcptOutcome) deliveryResult {
+	r := deliveryResult{Rcpt: rcpt, Status: resultDelivered, Paths: outcome.paths, Dispositions: outcome.dispositions}
+	if err == nil {
+		r.Reply = fmt.Sprintf("250 2.1.5 <%s> Ok", rcpt)
+		for _, d := range outcome.dispositions {
+			if d != "queued" && d != "held" {
+				return r
+			}
+		}
+		if len(outcome.dispositions) > 0 {
+			r.Status = resultDeferred
+			r.Reason = outcome.dispositions[0]
+			r.Reply += ": " + r.Reason
+		}
+		return r
+	}
+
+	reply := "451 4.3.0 Error: delivery failed"
+	r.Reason = err.Error()
+	if se, ok := err.(smtpd.SMTPError); ok {
+		reply = string(se)
+		r.Reason = replyText(reply)
+	}
+	r.Status = resultDeferred
+	if strings.HasPrefix(reply, "5") {
+		r.Status = resultRejected
+	}
+	r.Reply = rcptReply(reply, rcpt)
+	return r
+}
+
+// replyText returns the text of an SMTP reply, without its codes
+func replyText(reply string) string {
+	fields := strings.SplitN(reply, " ", 3)
+	if len(fields) == 3 && strings.Contains(fields[1], ".") {
+		return fields[2]
+	}
+	if len(fields) > 1 {
+		return strings.Join(fields[1:], " ")
+	}
+	return reply
+}
+
+// rcptReply adds the recipient to an SMTP reply after its codes, so each line of an LMTP reply says who it is for
+func rcptReply(reply, rcpt string) string {
+	fields := strings.SplitN(reply, " ", 3)
+	if len(fields) == 3 && strings.Contains(fields[1], ".") {
+		return fmt.Sprintf("%s %s <%s> %s", fields[0], fields[1], rcpt, fields[2])
+	}
+	return fmt.Sprintf("%s <%s> %s", fields[0], rcpt, replyText(reply))
+}
+
+// noteOutcome remembers what was done with a copy of the message for the recipient
+func (e *env) noteOutcome(rcpt, disposition, path string) {
+	if e.outcomes == nil {
+		e.outcomes = make(map[string]*rcptOutcome)
+	}
+	o := e.outcomes[rcpt]
+	if o == nil {
+		o = &rcptOutcome{}
+		e.outcomes[rcpt] = o
+	}
+	o.dispositions = append(o.dispositions, disposition)
+	if disposition == "delivered" && path != "" {
+		o.paths = append(o.paths, path)
+	}
+}
+
+// recordResults works out the result for each recipient once Close is done
+// Each one is logged, added to the journal, and kept for /results and the LMTP replies.
+func (e *env) recordResults() {
+	now := time.Now()
+	e.results = nil
+	for i, err := range e.RecipientErrors() {
+		rcpt := e.rcpts[i].Email()
+		var outcome rcptOutcome
+		if o := e.outcomes[rcpt]; o != nil {
+			outcome = *o
+		}
+		r := newDeliveryResult(rcpt, err, outcome)
+		r.Time, r.Conn, r.QueueID, r.From, r.Tags = now, e.conn.id, e.conn.queueID, e.from, e.tags
+		e.results = append(e.results, r)
+
+		logEvent(e.conn, "result", "rcpt", "<"+rcpt+">", "status", r.Status, "reason", r.Reason)
+		var ip string
+		if e.clientIP != nil {
+			ip = e.clientIP.String()
+		}
+		writeJournal(journalEntry{
+			Time:        now,
+			Kind:        "result",
+			Conn:        e.conn.id,
+			QueueID:     e.conn.queueID,
+			IP:          ip,
+			From:        e.from,
+			Rcpt:        rcpt,
+			Size:        e.size,
+			Path:        strings.Join(r.Paths, " "),
+			Disposition: r.Status,
+			Reason:      r.Reason,
+			Tags:        e.tags,
+		})
+		recentResults.add(r)
+	}
+}
+
+// RecipientReplies returns the LMTP reply for each recipient, from the results of Close
+func (e *env) RecipientReplies() []string {
+	var replies []string
+	for _, r := range e.results {
+		replies = append(replies, r.Reply)
+	}
+	return replies
+}
+
+// resultLog is a ring buffer of the most recent delivery results
+type resultLog struct {
+	sync.Mutex
+	entries []deliveryResult
+	next    int // index the next result is written to once the buffer is full
+}
+
+var recentResults = &resultLog{}
+
+// add records a result, replacing the oldest one when the log is full
+func (l *resultLog) add(r deliveryResult) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.entries) < maxResults {
+		l.entries = append(l.entries, r)
+		return
+	}
+	l.entries[l.next] = r
+	l.next = (l.next + 1) % maxResults
+}
+
+// recent returns the results, oldest first, only for recipients containing rcpt if it isn't empty
+func (l *resultLog) recent(rcpt string) []deliveryResult {
+	l.Lock()
+	defer l.Unlock()
+	list := []deliveryResult{}
+	for i := range l.entries {
+		r := l.entries[(l.next+i)%len(l.entries)]
+		if rcpt == "" || strings.Contains(strings.ToLower(r.Rcpt), strings.ToLower(rcpt)) {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// serveResults serves the recent delivery results as JSON, only for some recipients with ?rcpt=bcl@domain.com
+func serveResults(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recentResults.recent(r.URL.Query().Get("rcpt")))
+}
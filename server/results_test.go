@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"github.com/bcl/letterbox/smtpd"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewDeliveryResult(t *testing.T) {
+	tests := []struct {
+		err     error
+		outcome rcptOutcome
+		status  string
+		reason  string
+		reply   string
+	}{
+		{nil, rcptOutcome{[]string{"delivered"}, []string{"/m/bcl/new/1"}}, resultDelivered, "", "250 2.1.5 <bcl@domain.com> Ok"},
+		{nil, rcptOutcome{[]string{"queued"}, nil}, resultDeferred, "queued", "250 2.1.5 <bcl@domain.com> Ok: queued"},
+		{nil, rcptOutcome{[]string{"queued", "relayed"}, nil}, resultDelivered, "", "250 2.1.5 <bcl@domain.com> Ok"},
+		{errMailboxFull, rcptOutcome{}, resultRejected, replyText(string(errMailboxFull)), ""},
+		{smtpd.SMTPError("552 5.3.4 Error: message too big"), rcptOutcome{}, resultRejected, "Error: message too big", "552 5.3.4 <bcl@domain.com> Error: message too big"},
+		{errors.New("maildir unavailable"), rcptOutcome{}, resultDeferred, "maildir unavailable", "451 4.3.0 <bcl@domain.com> Error: delivery failed"},
+	}
+	for _, tt := range tests {
+		r := newDeliveryResult("bcl@domain.com", tt.err, tt.outcome)
+		if r.Status != tt.status || r.Reason != tt.reason || tt.reply != "" && r.Reply != tt.reply {
+			t.Errorf("Wrong result for %v %v: %#v", tt.err, tt.outcome, r)
+		}
+		if !strings.Contains(r.Reply, "<bcl@domain.com>") {
+			t.Errorf("Reply doesn't name the recipient: %s", r.Reply)
+		}
+	}
+	r := newDeliveryResult("bcl@domain.com", nil, rcptOutcome{[]string{"delivered"}, []string{"/m/bcl/new/1"}})
+	if !reflect.DeepEqual(r.Paths, []string{"/m/bcl/new/1"}) {
+		t.Errorf("Wrong paths: %v", r.Paths)
+	}
+}
+
+func TestRcptReply(t *testing.T) {
+	tests := []struct {
+		reply    string
+		expected string
+	}{
+		{"451 4.3.0 Error: try again", "451 4.3.0 <bcl@domain.com> Error: try again"},
+		{"550 no such user", "550 <bcl@domain.com> no such user"},
+	}
+	for _, tt := range tests {
+		if reply := rcptReply(tt.reply, "bcl@domain.com"); reply != tt.expected {
+			t.Errorf("rcptReply(%q) = %q, expected %q", tt.reply, reply, tt.expected)
+		}
+	}
+}
+
+func TestRecentResults(t *testing.T) {
+	defer func() { recentResults = &resultLog{} }()
+	recentResults = &resultLog{}
+	for i := 0; i < maxResults+2; i++ {
+		rcpt := "bcl@domain.com"
+		if i%2 == 1 {
+			rcpt = "alice@domain.com"
+		}
+		recentResults.add(deliveryResult{Rcpt: rcpt, Conn: string(rune('a' + i%26))})
+	}
+	if n := len(recentResults.recent("")); n != maxResults {
+		t.Errorf("Wrong number of results: %d", n)
+	}
+	if all := recentResults.recent(""); all[0].Rcpt != "bcl@domain.com" || all[0].Conn != "c" {
+		t.Errorf("Oldest result not dropped: %#v", all[0])
+	}
+	if n := len(recentResults.recent("ALICE@")); n != maxResults/2 {
+		t.Errorf("Wrong number of results for alice: %d", n)
+	}
+
+	w := httptest.NewRecorder()
+	serveResults(w, httptest.NewRequest("GET", "/results?rcpt=nobody", nil))
+	if body := strings.TrimSpace(w.Body.String()); body != "[]" {
+		t.Errorf("Wrong results for nobody: %s", body)
+	}
+}
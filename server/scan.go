@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/delivery"
+	"github.com/bcl/letterbox/smtpd"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// defaultScanTimeout is used when the scan timeout isn't set
+const defaultScanTimeout = 60 * time.Second
+
+// asyncList is the resolved scan.async_hosts list
+var asyncList access.List
+
+// setupScan checks the [scan] config and looks up the async_hosts
+/*
+   Example TOML:
+
+   [scan]
+   command = ["/usr/bin/spamc", "-c"]
+   timeout = "30s"
+   async_hosts = ["192.168.1.0/24"]
+   folder = "Junk"
+*/
+func setupScan() error {
+	if len(cfg.Scan.Command) == 0 {
+		if len(cfg.Scan.AsyncHosts) > 0 {
+			return fmt.Errorf("scan.async_hosts needs a scan.command")
+		}
+		return nil
+	}
+	if !folderRE.MatchString(scanFolder()) {
+		return fmt.Errorf("bad scan folder name: %s", cfg.Scan.Folder)
+	}
+	asyncList = access.Resolve(cfg.Scan.AsyncHosts)
+	return nil
+}
+
+// scanEnabled returns true if there is a scanner
+func scanEnabled() bool {
+	return len(cfg.Scan.Command) > 0
+}
+
+// scanFolder returns the folder that spam is moved to after delivery
+func scanFolder() string {
+	if cfg.Scan.Folder == "" {
+		return "Junk"
+	}
+	return cfg.Scan.Folder
+}
+
+// scanAfterDelivery returns true if mail from the client should be accepted first and scanned later
+func scanAfterDelivery(ip net.IP) bool {
+	return asyncList.Contains(ip)
+}
+
+// runScanner runs the scanner on the message file and returns true if it is spam
+// Exit status 0 is clean and 1 is spam, anything else is an error.
+func runScanner(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	timeout := cfg.Scan.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultScanTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, cfg.Scan.Command[0], cfg.Scan.Command[1:]...)
+	cmd.Stdin = f
+	err = cmd.Run()
+	if err == nil {
+		return false, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 && ctx.Err() == nil {
+		return true, nil
+	}
+	return false, err
+}
+
+// errSpam is returned when the scanner says a message is spam
+var errSpam = smtpd.SMTPError("550 5.7.1 Message rejected as spam")
+
+// scanBeforeDelivery scans a message that hasn't been delivered yet
+// Spam is rejected. If the scanner fails the sender is asked to try again
+// later, so that nothing gets through unscanned.
+func scanBeforeDelivery(path string) error {
+	spam, err := runScanner(path)
+	if err != nil {
+		log.Printf("Error scanning message: %s", err)
+		return smtpd.SMTPError("451 4.3.0 Error: message could not be scanned")
+	}
+	if spam {
+		return errSpam
+	}
+	return nil
+}
+
+// scan scans the message before it is delivered or relayed
+// The first delivery's tmp file is scanned, or a copy of the message if it is
+// only being relayed or queued.
+func (e *env) scan() error {
+	for _, del := range e.deliveries {
+		if del != nil {
+			return scanBeforeDelivery(del.TmpPath())
+		}
+	}
+	f, err := ioutil.TempFile("", "letterbox-scan-")
+	if err != nil {
+		log.Printf("Error creating file to scan: %s", err)
+		return smtpd.SMTPError("451 4.3.0 Error: message could not be scanned")
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(e.data.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("Error writing file to scan: %s", err)
+		return smtpd.SMTPError("451 4.3.0 Error: message could not be scanned")
+	}
+	return scanBeforeDelivery(f.Name())
+}
+
+// scanDelivered scans a message after it has been delivered, moving it to the spam folder if needed
+// paths are the delivered copies of the message and users are the users they
+// were delivered to. Only the first copy is scanned. If the scanner fails the
+// message is left where it is. Spam counts against the reputation of clientIP.
+func scanDelivered(clientIP net.IP, paths, users []string) {
+	if len(paths) == 0 {
+		return
+	}
+	spam, err := runScanner(paths[0])
+	if err != nil {
+		log.Printf("Error scanning %s, leaving it in place: %s", paths[0], err)
+		return
+	}
+	if !spam {
+		return
+	}
+	reputation.penalize(clientIP, junkPenalty)
+	for i, path := range paths {
+		junk, err := maildirFolder(users[i], scanFolder())
+		if err != nil {
+			log.Printf("Error creating %s folder for %s: %s", scanFolder(), users[i], err)
+			continue
+		}
+		if err := delivery.Rename(path, filepath.Join(string(junk), "new", filepath.Base(path))); err != nil {
+			log.Printf("Error moving %s to %s: %s", path, junk, err)
+			continue
+		}
+		logDebugf("Moved spam %s to %s", filepath.Base(path), junk)
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testScanner flags messages containing SPAM, and fails on messages containing FAIL
+var testScanner = []string{"sh", "-c", `msg=$(cat); case "$msg" in *SPAM*) exit 1;; *FAIL*) exit 2;; esac`}
+
+func TestRunScanner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { cfg.Scan = config.Scan{} }()
+	cfg.Scan.Command = testScanner
+
+	tests := []struct {
+		body  string
+		spam  bool
+		isErr bool
+	}{
+		{"Hello", false, false},
+		{"Buy SPAM now", true, false},
+		{"FAIL", false, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "msg")
+		ioutil.WriteFile(path, []byte("Subject: test\r\n\r\n"+tt.body+"\r\n"), 0600)
+		spam, err := runScanner(path)
+		if spam != tt.spam || (err != nil) != tt.isErr {
+			t.Errorf("runScanner(%q) = %v, %v", tt.body, spam, err)
+		}
+	}
+
+	if err := scanBeforeDelivery(filepath.Join(dir, "msg")); err == nil || !strings.HasPrefix(err.Error(), "451") {
+		t.Errorf("Scanner failure not temporary: %v", err)
+	}
+
+	cfg.Scan.Command = []string{"sleep", "5"}
+	cfg.Scan.Timeout = config.Duration{Duration: 100 * time.Millisecond}
+	if _, err := runScanner(filepath.Join(dir, "msg")); err == nil {
+		t.Error("Scanner timeout did not return an error")
+	}
+}
+
+func TestScanDelivered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg.Scan = config.Scan{}
+		asyncList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Scan.Command = testScanner
+	cfg.Scan.AsyncHosts = []string{"192.168.1.0/24"}
+	if err := setupScan(); err != nil {
+		t.Fatal(err)
+	}
+	if !scanAfterDelivery(net.ParseIP("192.168.1.5")) || scanAfterDelivery(net.ParseIP("10.0.0.1")) {
+		t.Error("async_hosts not matched correctly")
+	}
+
+	deliver := func(user, body string) string {
+		d, err := userMaildir(user, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		del, err := newDelivery(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		del.Write([]byte("Subject: test\r\n\r\n" + body + "\r\n"))
+		if err := del.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return del.Path()
+	}
+
+	ham := deliver("bcl", "Hello")
+	scanDelivered(nil, []string{ham}, []string{"bcl"})
+	if _, err := os.Stat(ham); err != nil {
+		t.Errorf("Clean message was moved: %s", err)
+	}
+
+	spam := []string{deliver("bcl", "Buy SPAM now"), deliver("alice", "Buy SPAM now")}
+	scanDelivered(nil, spam, []string{"bcl", "alice"})
+	for i, user := range []string{"bcl", "alice"} {
+		if _, err := os.Stat(spam[i]); !os.IsNotExist(err) {
+			t.Errorf("Spam left in %s's inbox", user)
+		}
+		if _, err := os.Stat(filepath.Join(dir, user, ".Junk", "new", filepath.Base(spam[i]))); err != nil {
+			t.Errorf("Spam not moved to %s's Junk folder: %s", user, err)
+		}
+	}
+
+	cfg.Scan = config.Scan{AsyncHosts: []string{"192.168.1.0/24"}}
+	if err := setupScan(); err == nil {
+		t.Error("async_hosts without a command did not return an error")
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// scheduleRange is a set of days and a time of day range, in minutes since midnight
+// If end is before start the range wraps past midnight.
+type scheduleRange struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+// schedules holds the parsed [schedules] from the config
+var schedules map[string][]scheduleRange
+
+// scheduleLocation is the timezone that schedules are evaluated in
+var scheduleLocation = time.Local
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseDays parses a list of days like "Mon-Fri,Sun"
+func parseDays(spec string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(spec, ",") {
+		first, last := part, part
+		if i := strings.Index(part, "-"); i != -1 {
+			first, last = part[:i], part[i+1:]
+		}
+		start, ok := dayNames[strings.ToLower(first)]
+		if !ok {
+			return days, fmt.Errorf("unknown day %q", first)
+		}
+		end, ok := dayNames[strings.ToLower(last)]
+		if !ok {
+			return days, fmt.Errorf("unknown day %q", last)
+		}
+		for d := start; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == end {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseMinutes parses a time of day like 09:30 into minutes since midnight
+func parseMinutes(spec string) (int, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(spec, "%d:%d", &hours, &minutes); err != nil {
+		return 0, fmt.Errorf("bad time %q", spec)
+	}
+	if hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("bad time %q", spec)
+	}
+	return hours*60 + minutes, nil
+}
+
+// parseScheduleRange parses a range like "Mon-Fri 09:00-17:00"
+// Either part may be left out to mean every day or all day.
+func parseScheduleRange(spec string) (scheduleRange, error) {
+	r := scheduleRange{days: [7]bool{true, true, true, true, true, true, true}, end: 24 * 60}
+	for _, field := range strings.Fields(spec) {
+		if !strings.Contains(field, ":") {
+			days, err := parseDays(field)
+			if err != nil {
+				return r, err
+			}
+			r.days = days
+			continue
+		}
+		times := strings.SplitN(field, "-", 2)
+		if len(times) != 2 {
+			return r, fmt.Errorf("bad time range %q", field)
+		}
+		var err error
+		if r.start, err = parseMinutes(times[0]); err != nil {
+			return r, err
+		}
+		if r.end, err = parseMinutes(times[1]); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// contains returns true if the time is inside the range
+// The day of a range that wraps past midnight is the day it starts on.
+func (r scheduleRange) contains(t time.Time) bool {
+	minutes := t.Hour()*60 + t.Minute()
+	if r.start <= r.end {
+		return r.days[t.Weekday()] && minutes >= r.start && minutes < r.end
+	}
+	if minutes >= r.start {
+		return r.days[t.Weekday()]
+	}
+	return minutes < r.end && r.days[(t.Weekday()+6)%7]
+}
+
+// parseSchedules fills the global schedules from cfg.Schedules and sets the timezone
+/*
+   Example TOML:
+
+   timezone = "America/Los_Angeles"
+
+   [schedules]
+   workhours = ["Mon-Fri 09:00-17:00"]
+*/
+func parseSchedules() error {
+	scheduleLocation = time.Local
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return err
+		}
+		scheduleLocation = loc
+	}
+
+	schedules = make(map[string][]scheduleRange)
+	for name, specs := range cfg.Schedules {
+		for _, spec := range specs {
+			r, err := parseScheduleRange(spec)
+			if err != nil {
+				return fmt.Errorf("schedule %s: %s", name, err)
+			}
+			schedules[name] = append(schedules[name], r)
+		}
+	}
+	for rcpt, name := range cfg.RecipientSchedules {
+		if _, ok := schedules[strings.TrimPrefix(name, "!")]; !ok {
+			return fmt.Errorf("%s uses unknown schedule %q", rcpt, name)
+		}
+	}
+	for _, f := range cfg.Forwards {
+		if _, ok := schedules[strings.TrimPrefix(f.Schedule, "!")]; f.Schedule != "" && !ok {
+			return fmt.Errorf("forwards user %s uses unknown schedule %q", f.User, f.Schedule)
+		}
+	}
+	for _, p := range cfg.Pipes {
+		if _, ok := schedules[strings.TrimPrefix(p.Schedule, "!")]; p.Schedule != "" && !ok {
+			return fmt.Errorf("pipes user %s uses unknown schedule %q", p.User, p.Schedule)
+		}
+	}
+	return nil
+}
+
+// scheduleActive returns true if the named schedule includes the time
+// A name starting with ! is active whenever the schedule is not.
+func scheduleActive(name string, t time.Time) bool {
+	negate := strings.HasPrefix(name, "!")
+	t = t.In(scheduleLocation)
+	active := false
+	for _, r := range schedules[strings.TrimPrefix(name, "!")] {
+		if r.contains(t) {
+			active = true
+			break
+		}
+	}
+	return active != negate
+}
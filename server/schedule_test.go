@@ -0,0 +1,180 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScheduleRange(t *testing.T) {
+	r, err := parseScheduleRange("Mon-Fri 09:00-17:30")
+	if err != nil {
+		t.Fatalf("Error parsing range: %s", err)
+	}
+	if r.start != 9*60 || r.end != 17*60+30 {
+		t.Errorf("Wrong times: %d-%d", r.start, r.end)
+	}
+	if r.days != [7]bool{false, true, true, true, true, true, false} {
+		t.Errorf("Wrong days: %v", r.days)
+	}
+
+	r, err = parseScheduleRange("Fri-Mon")
+	if err != nil {
+		t.Fatalf("Error parsing days: %s", err)
+	}
+	if r.days != [7]bool{true, true, false, false, false, true, true} || r.start != 0 || r.end != 24*60 {
+		t.Errorf("Wrong wrapped days: %#v", r)
+	}
+
+	for _, bad := range []string{"Someday", "09:00", "25:00-26:00", "Mon 09:00-"} {
+		if _, err := parseScheduleRange(bad); err == nil {
+			t.Errorf("No error parsing %q", bad)
+		}
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	scheduleLocation = time.UTC
+	defer func() { scheduleLocation = time.Local }()
+	work, _ := parseScheduleRange("Mon-Fri 09:00-17:00")
+	night, _ := parseScheduleRange("Fri 22:00-06:00")
+	schedules = map[string][]scheduleRange{"work": {work}, "night": {night}}
+	defer func() { schedules = nil }()
+
+	// 2020-09-04 was a Friday
+	tests := []struct {
+		name   string
+		when   string
+		active bool
+	}{
+		{"work", "2020-09-04T10:00:00Z", true},
+		{"work", "2020-09-04T17:00:00Z", false},
+		{"work", "2020-09-05T10:00:00Z", false},
+		{"!work", "2020-09-05T10:00:00Z", true},
+		{"night", "2020-09-04T23:00:00Z", true},
+		{"night", "2020-09-05T05:59:00Z", true},
+		{"night", "2020-09-06T05:59:00Z", false},
+		{"missing", "2020-09-04T10:00:00Z", false},
+	}
+	for _, tt := range tests {
+		when, _ := time.Parse(time.RFC3339, tt.when)
+		if scheduleActive(tt.name, when) != tt.active {
+			t.Errorf("%s at %s should be %v", tt.name, tt.when, tt.active)
+		}
+	}
+}
+
+func TestParseSchedules(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	cfg.Schedules = map[string][]string{"work": {"Mon-Fri 09:00-17:00"}}
+	cfg.Forwards = []config.Forward{{User: "pager", To: []string{"phone@remote.com"}, Schedule: "!work"}}
+	cfg.Pipes = []config.Pipe{{User: "tickets", Command: []string{"cat"}, Schedule: "work"}}
+	if err := parseSchedules(); err != nil {
+		t.Errorf("Error parsing schedules: %s", err)
+	}
+	cfg.Forwards[0].Schedule = "weekend"
+	if err := parseSchedules(); err == nil {
+		t.Error("Unknown forward schedule not refused")
+	}
+	cfg.Forwards[0].Schedule = ""
+	cfg.Pipes[0].Schedule = "!weekend"
+	if err := parseSchedules(); err == nil {
+		t.Error("Unknown pipe schedule not refused")
+	}
+}
+
+func TestScheduledDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+		schedules = nil
+	}()
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com", "pager@domain.com"}
+	// off is never active, until it is changed below
+	cfg.Schedules = map[string][]string{"off": {"Mon 00:00-00:00"}}
+	cfg.RecipientSchedules = map[string]string{"bcl@domain.com": "off"}
+	cfg.Forwards = []config.Forward{{User: "pager", To: []string{"phone@remote.com"}, Schedule: "off"}}
+	cfg.Queue = config.Queue{Dir: filepath.Join(dir, "queue")}
+	if err := parseSchedules(); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupQueue(); err != nil {
+		t.Fatal(err)
+	}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	count := func(user string) int {
+		files, _ := ioutil.ReadDir(filepath.Join(cmdline.Maildirs, user, "new"))
+		return len(files)
+	}
+	message := []byte("Subject: test\r\n\r\nHello\r\n")
+
+	// Outside of its schedule the forward isn't used, and pager gets the message
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@remote.com", []string{"pager@domain.com"}, message); err != nil {
+		t.Fatalf("Message refused: %s", err)
+	}
+	if count("pager") != 1 {
+		t.Errorf("pager has %d messages", count("pager"))
+	}
+
+	// bcl's copy is accepted and queued until the schedule is active
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@remote.com", []string{"bcl@domain.com"}, message); err != nil {
+		t.Fatalf("Message refused: %s", err)
+	}
+	if count("bcl") != 0 {
+		t.Errorf("bcl has %d messages outside of the schedule", count("bcl"))
+	}
+	now := time.Now()
+	if err := processQueue(now.Add(30 * 24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if count("bcl") != 0 {
+		t.Errorf("bcl has %d messages outside of the schedule", count("bcl"))
+	}
+	if paths, _ := filepath.Glob(filepath.Join(cfg.Queue.Dir, "*.json")); len(paths) != 1 {
+		t.Errorf("Queue has %d entries", len(paths))
+	}
+	cfg.Schedules["off"] = []string{"00:00-24:00"}
+	if err := parseSchedules(); err != nil {
+		t.Fatal(err)
+	}
+	if err := processQueue(now.Add(31 * 24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if count("bcl") != 1 {
+		t.Errorf("bcl has %d messages inside of the schedule", count("bcl"))
+	}
+
+	// Without a queue the sender is asked to try again later
+	cfg.Schedules["off"] = []string{"Mon 00:00-00:00"}
+	cfg.Queue = config.Queue{}
+	if err := parseSchedules(); err != nil {
+		t.Fatal(err)
+	}
+	err = smtp.SendMail(ln.Addr().String(), nil, "sender@remote.com", []string{"bcl@domain.com"}, message)
+	if err == nil || !strings.HasPrefix(err.Error(), "450") {
+		t.Errorf("Message outside of the schedule not deferred: %v", err)
+	}
+}
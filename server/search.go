@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+// maxTextSize limits how much of a message's text is read for searching
+const maxTextSize = 10 * 1024 * 1024
+
+// decodeHeader decodes RFC 2047 encoded words in a header value
+func decodeHeader(value string) string {
+	dec := new(mime.WordDecoder)
+	decoded, err := dec.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// partReader returns a reader that undoes the Content-Transfer-Encoding
+func partReader(r io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// partText returns the text of a MIME part, descending into multiparts
+// Only text/plain and text/html parts are included, attachments are skipped.
+func partText(r io.Reader, contentType, encoding, disposition string) string {
+	if strings.HasPrefix(strings.ToLower(disposition), "attachment") {
+		return ""
+	}
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var text []string
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			t := partText(p, p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p.Header.Get("Content-Disposition"))
+			if t != "" {
+				text = append(text, t)
+			}
+		}
+		return strings.Join(text, "\n")
+	}
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return ""
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(partReader(r, encoding), maxTextSize))
+	if err != nil && len(data) == 0 {
+		return ""
+	}
+	return string(data)
+}
+
+// messageText returns the decoded text of the message's body
+func messageText(msg *mail.Message) string {
+	return partText(msg.Body, msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Header.Get("Content-Disposition"))
+}
+
+// matchesQuery returns true if every word of the query appears in the message's subject or text
+func matchesQuery(msg *mail.Message, words []string) bool {
+	text := strings.ToLower(decodeHeader(msg.Header.Get("Subject")) + "\n" + messageText(msg))
+	for _, w := range words {
+		if !strings.Contains(text, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// searchCommand searches the maildirs for messages containing all the words of a query
+/*
+   There is no index, every message under the maildirs is read and decoded.
+
+   letterbox search -q "invoice 2024" [-user bcl]
+*/
+func searchCommand(args []string) error {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	query := flags.String("q", "", "Words to search for in the subject and body")
+	user := flags.String("user", "", "Only search this user's maildir")
+	flags.Parse(args)
+	if *query == "" {
+		return fmt.Errorf("missing search query")
+	}
+	words := strings.Fields(strings.ToLower(*query))
+	if err := loadCommandConfig(); err != nil {
+		return err
+	}
+	if err := loadAliases(); err != nil {
+		return err
+	}
+
+	roots, err := userRoots(*user)
+	if err != nil {
+		return err
+	}
+	return walkRoots(roots, func(path string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		msg, err := mail.ReadMessage(f)
+		if err != nil {
+			logDebugf("Skipping %s: %s", path, err)
+			return nil
+		}
+		if matchesQuery(msg, words) {
+			fmt.Printf("%s\t%s\t%s\n", path, decodeHeader(msg.Header.Get("From")), decodeHeader(msg.Header.Get("Subject")))
+		}
+		return nil
+	})
+}
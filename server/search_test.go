@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+const multipartMessage = "From: Billing <billing@example.com>\r\n" +
+	"Subject: =?utf-8?q?Your_invoice?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"XXX\"\r\n" +
+	"\r\n" +
+	"--XXX\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Total for 2024 is $10=2E00\r\n" +
+	"--XXX\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Disposition: attachment; filename=\"secret.txt\"\r\n" +
+	"\r\n" +
+	"attached words\r\n" +
+	"--XXX--\r\n"
+
+func TestMessageText(t *testing.T) {
+	msg, err := mail.ReadMessage(strings.NewReader(multipartMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := messageText(msg)
+	if !strings.Contains(text, "Total for 2024 is $10.00") {
+		t.Errorf("Missing decoded text: %q", text)
+	}
+	if strings.Contains(text, "attached words") {
+		t.Errorf("Attachment included in text: %q", text)
+	}
+}
+
+func TestMatchesQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		match bool
+	}{
+		{"invoice 2024", true},
+		{"INVOICE", true},
+		{"invoice 2023", false},
+		{"attached", false},
+	}
+	for _, tt := range tests {
+		msg, err := mail.ReadMessage(strings.NewReader(multipartMessage))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matchesQuery(msg, strings.Fields(strings.ToLower(tt.query))) != tt.match {
+			t.Errorf("Query %q should be %v", tt.query, tt.match)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// secretPrefix marks a config value that is encrypted with the secret key
+const secretPrefix = "enc:"
+
+// secretKeyEnv is the environment variable that can hold the secret key instead of -secret-key
+const secretKeyEnv = "LETTERBOX_SECRET_KEY"
+
+// secretKey returns the AES-256 key from LETTERBOX_SECRET_KEY, or the -secret-key file
+// The key is 32 bytes encoded with base64, like the output of config genkey.
+func secretKey() ([]byte, error) {
+	encoded := os.Getenv(secretKeyEnv)
+	if encoded == "" && cmdline.SecretKey != "" {
+		data, err := ioutil.ReadFile(cmdline.SecretKey)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	if encoded == "" {
+		return nil, fmt.Errorf("no secret key, set %s or -secret-key", secretKeyEnv)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("the secret key must be 32 bytes encoded with base64")
+	}
+	return key, nil
+}
+
+// secretCipher returns the AES-GCM cipher for the key
+func secretCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSecret returns the value encrypted with the key, as enc: and the base64 of the nonce and ciphertext
+func encryptSecret(key []byte, value string) (string, error) {
+	gcm, err := secretCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return secretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret returns the plain value of an enc: value
+func decryptSecret(key []byte, value string) (string, error) {
+	gcm, err := secretCipher(key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, secretPrefix))
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("bad encrypted value")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("encrypted value can't be decrypted with the secret key")
+	}
+	return string(plain), nil
+}
+
+// decryptSecrets replaces every enc: string in the config tree with its plain value
+// Any setting can be encrypted, like the relay password or a webhook URL with
+// a token in it. It returns true if there were any, the key is only needed
+// when there are.
+func decryptSecrets(tree map[string]interface{}) (bool, error) {
+	var key []byte
+	found := false
+	var walk func(v interface{}) (interface{}, error)
+	walk = func(v interface{}) (interface{}, error) {
+		switch v := v.(type) {
+		case string:
+			if !strings.HasPrefix(v, secretPrefix) {
+				return v, nil
+			}
+			found = true
+			if key == nil {
+				var err error
+				if key, err = secretKey(); err != nil {
+					return nil, err
+				}
+			}
+			return decryptSecret(key, v)
+		case map[string]interface{}:
+			for k, item := range v {
+				plain, err := walk(item)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s", k, err)
+				}
+				v[k] = plain
+			}
+		case []map[string]interface{}:
+			for _, item := range v {
+				if _, err := walk(item); err != nil {
+					return nil, err
+				}
+			}
+		case []interface{}:
+			for i, item := range v {
+				plain, err := walk(item)
+				if err != nil {
+					return nil, err
+				}
+				v[i] = plain
+			}
+		}
+		return v, nil
+	}
+	_, err := walk(tree)
+	return found, err
+}
+
+// secretCommand prints a new secret key, or encrypts a value read from stdin
+/*
+   letterbox config genkey > /etc/letterbox/secret.key
+   letterbox -secret-key /etc/letterbox/secret.key config encrypt < password.txt
+*/
+func secretCommand(args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == "genkey":
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+		return nil
+	case len(args) == 1 && args[0] == "encrypt":
+		key, err := secretKey()
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(os.Stderr, "Value: ")
+		value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && value == "" {
+			return err
+		}
+		value = strings.TrimRight(value, "\r\n")
+		if value == "" {
+			return fmt.Errorf("empty value")
+		}
+		encrypted, err := encryptSecret(key, value)
+		if err != nil {
+			return err
+		}
+		fmt.Println(encrypted)
+		return nil
+	}
+	return fmt.Errorf("usage: config genkey | config encrypt < value")
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptSecret(t *testing.T) {
+	key := make([]byte, 32)
+	encrypted, err := encryptSecret(key, "hunter2")
+	if err != nil || !strings.HasPrefix(encrypted, secretPrefix) || strings.Contains(encrypted, "hunter2") {
+		t.Fatalf("Wrong encrypted value: %q %v", encrypted, err)
+	}
+	if plain, err := decryptSecret(key, encrypted); err != nil || plain != "hunter2" {
+		t.Errorf("Wrong decrypted value: %q %v", plain, err)
+	}
+	other := make([]byte, 32)
+	other[0] = 1
+	if _, err := decryptSecret(other, encrypted); err == nil {
+		t.Error("Value decrypted with the wrong key")
+	}
+	if _, err := decryptSecret(key, "enc:AAAA"); err == nil {
+		t.Error("Short value decrypted")
+	}
+}
+
+func TestConfigSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretKeyFile := cmdline.SecretKey
+	defer func() {
+		cmdline.SecretKey = secretKeyFile
+		os.Unsetenv(secretKeyEnv)
+	}()
+
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	password, _ := encryptSecret(key, "hunter2")
+	url, _ := encryptSecret(key, "https://hook.example.com/?token=abc")
+	arg, _ := encryptSecret(key, "--token=xyz")
+	config := `config_version = 1
+[relay]
+host = "smtp.isp.net"
+password = "` + password + `"
+
+[[backends]]
+name = "hook"
+type = "webhook"
+url = "` + url + `"
+
+[[plugins]]
+command = ["/usr/bin/policy", "` + arg + `"]
+`
+
+	// The key is needed when the config has encrypted values
+	os.Unsetenv(secretKeyEnv)
+	cmdline.SecretKey = ""
+	if _, err := readConfig(strings.NewReader(config)); err == nil || !strings.Contains(err.Error(), "no secret key") {
+		t.Errorf("Encrypted config read without a key: %v", err)
+	}
+	if _, err := readConfig(strings.NewReader("[relay]\nhost = \"smtp.isp.net\"\n")); err != nil {
+		t.Errorf("Plain config needs a key: %s", err)
+	}
+
+	// From a file
+	cmdline.SecretKey = filepath.Join(dir, "secret.key")
+	if err := ioutil.WriteFile(cmdline.SecretKey, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := readConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Relay.Password != "hunter2" || c.Relay.Host != "smtp.isp.net" || c.Backends[0].URL != "https://hook.example.com/?token=abc" || c.Plugins[0].Command[1] != "--token=xyz" {
+		t.Errorf("Wrong decrypted config: %#v %#v %#v", c.Relay, c.Backends, c.Plugins)
+	}
+
+	// The environment variable is used before the file
+	wrong := make([]byte, 32)
+	os.Setenv(secretKeyEnv, base64.StdEncoding.EncodeToString(wrong))
+	if _, err := readConfig(strings.NewReader(config)); err == nil {
+		t.Error("Config decrypted with the wrong key")
+	}
+	os.Setenv(secretKeyEnv, "short")
+	if _, err := readConfig(strings.NewReader(config)); err == nil {
+		t.Error("Bad key accepted")
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// sendOptions are the settings for sending a test message
+type sendOptions struct {
+	server   string        // host:port to connect to
+	helo     string        // name to greet the server with
+	startTLS bool          // use STARTTLS, and fail if the server doesn't offer it
+	insecure bool          // don't verify the server's certificate
+	user     string        // username for AUTH PLAIN, empty to not authenticate
+	password string        // password for AUTH PLAIN
+	timeout  time.Duration // limit for the whole conversation
+}
+
+// sendMessage returns a test message, padded with lines of text to at least size bytes
+func sendMessage(from string, rcpts []string, subject string, size int, now time.Time) []byte {
+	var b bytes.Buffer
+	b.Write(foldHeader("Date", now.Format(time.RFC1123Z)))
+	b.Write(foldHeader("From", "<"+from+">"))
+	b.Write(foldHeader("To", "<"+strings.Join(rcpts, ">, <")+">"))
+	b.Write(foldHeader("Subject", subject))
+	b.Write(foldHeader("Message-ID", fmt.Sprintf("<%d.send@%s>", now.UnixNano(), localHostname())))
+	b.WriteString("\r\nThis is a test message from letterbox send.\r\n")
+	const padding = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789\r\n"
+	for b.Len() < size {
+		b.WriteString(padding)
+	}
+	return b.Bytes()
+}
+
+// sendTestMessage sends the message to the server, printing each step to out
+func sendTestMessage(opts sendOptions, from string, rcpts []string, msg []byte, out io.Writer) error {
+	host, _, err := net.SplitHostPort(opts.server)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", opts.server, opts.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(opts.timeout))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	fmt.Fprintf(out, "Connected to %s\n", opts.server)
+	if err := client.Hello(opts.helo); err != nil {
+		return err
+	}
+
+	if opts.startTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s doesn't offer STARTTLS", opts.server)
+		}
+		if err := client.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: opts.insecure}); err != nil {
+			return err
+		}
+		state, _ := client.TLSConnectionState()
+		fmt.Fprintf(out, "STARTTLS: TLS %s with cipher %s\n", tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	}
+	if opts.user != "" {
+		if err := client.Auth(smtp.PlainAuth("", opts.user, opts.password, host)); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Authenticated as %s\n", opts.user)
+	}
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range rcpts {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("%s: %s", rcpt, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Sent %d bytes to %d recipients\n", len(msg), len(rcpts))
+	return client.Quit()
+}
+
+// sendCommand submits a test message to a server, to check a deployment from another host
+/*
+   letterbox send [-server host:port] [-from address] -to address[,address] [-starttls] [-insecure] [-user name] [-size bytes]
+
+   The password for -user is read from the LETTERBOX_PASSWORD environment
+   variable, so it isn't shown in the process list.
+*/
+func sendCommand(args []string) error {
+	flags := flag.NewFlagSet("send", flag.ExitOnError)
+	server := flags.String("server", "localhost:25", "Server to send the message to")
+	from := flags.String("from", "letterbox@"+localHostname(), "Envelope sender and From address")
+	to := flags.String("to", "", "Recipients, separated by commas")
+	subject := flags.String("subject", "letterbox test message", "Subject of the message")
+	helo := flags.String("helo", localHostname(), "Name to send in EHLO")
+	startTLS := flags.Bool("starttls", false, "Use STARTTLS")
+	insecure := flags.Bool("insecure", false, "Don't verify the server's certificate")
+	user := flags.String("user", "", "Authenticate with AUTH PLAIN as this user")
+	size := flags.Int("size", 0, "Pad the message to at least this many bytes")
+	timeout := flags.Duration("timeout", time.Minute, "Time limit for sending the message")
+	flags.Parse(args)
+	if *to == "" || flags.NArg() != 0 {
+		return fmt.Errorf("usage: send [-server host:port] [-from address] -to address[,address] [-starttls] [-insecure] [-user name] [-size bytes]")
+	}
+	var rcpts []string
+	for _, rcpt := range strings.Split(*to, ",") {
+		if rcpt = strings.TrimSpace(rcpt); rcpt != "" {
+			rcpts = append(rcpts, rcpt)
+		}
+	}
+	opts := sendOptions{
+		server:   *server,
+		helo:     *helo,
+		startTLS: *startTLS,
+		insecure: *insecure,
+		user:     *user,
+		password: os.Getenv("LETTERBOX_PASSWORD"),
+		timeout:  *timeout,
+	}
+	msg := sendMessage(*from, rcpts, *subject, *size, time.Now())
+	return sendTestMessage(opts, *from, rcpts, msg, os.Stdout)
+}
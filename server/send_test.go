@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"github.com/bcl/letterbox/config"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendMessage(t *testing.T) {
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	msg := sendMessage("sender@domain.com", []string{"bcl@domain.com", "alice@domain.com"}, "hello", 0, now)
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.Get("To") != "<bcl@domain.com>, <alice@domain.com>" || m.Header.Get("Subject") != "hello" || m.Header.Get("Date") != "Tue, 02 Jan 2024 15:04:05 +0000" {
+		t.Errorf("Wrong headers: %v", m.Header)
+	}
+	padded := sendMessage("sender@domain.com", []string{"bcl@domain.com"}, "hello", 10000, now)
+	if len(padded) < 10000 || len(padded) > 10000+100 || !bytes.HasSuffix(padded, []byte("\r\n")) {
+		t.Errorf("Padded message is %d bytes", len(padded))
+	}
+}
+
+func TestSendTestMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Emails = []string{"bcl@domain.com"}
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth = config.Auth{Users: map[string]string{"user": string(hash)}, RequireForUnlisted: true, Backoff: config.Duration{Duration: time.Millisecond}}
+	authLimits = newAuthLimiter()
+	if err := setupAuth(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.TLS.Cert, cfg.TLS.Key = writeTestCert(t, dir, "localhost")
+	serverTLS, err := setupTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", serverTLS).Serve(ln)
+
+	opts := sendOptions{server: ln.Addr().String(), helo: "client.lan", startTLS: true, insecure: true, user: "user", password: "password", timeout: 10 * time.Second}
+	msg := sendMessage("sender@domain.com", []string{"bcl@domain.com"}, "hello", 5000, time.Now())
+	var out bytes.Buffer
+	if err := sendTestMessage(opts, "sender@domain.com", []string{"bcl@domain.com"}, msg, &out); err != nil {
+		t.Fatalf("Sending failed: %s\n%s", err, out.String())
+	}
+	for _, line := range []string{"STARTTLS: TLS 1.3 with cipher", "Authenticated as user", "Sent "} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("%q missing from %q", line, out.String())
+		}
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new"))
+	if len(files) != 1 || files[0].Size() < 5000 {
+		t.Fatalf("Wrong delivery: %v", files)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "bcl", "new", files[0].Name()))
+	if !strings.Contains(string(data), "with ESMTPSA") {
+		t.Errorf("Received header doesn't show STARTTLS and AUTH: %q", data)
+	}
+
+	// A wrong password is reported
+	opts.password = "wrong"
+	if err := sendTestMessage(opts, "sender@domain.com", []string{"bcl@domain.com"}, msg, ioutil.Discard); err == nil || !strings.HasPrefix(err.Error(), "535") {
+		t.Errorf("Wrong password not reported: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bcl/letterbox/events"
+	"github.com/bcl/letterbox/smtpd"
+	"net"
+	"strings"
+)
+
+// domainResult is the result of checking that the sender's domain can receive mail
+type domainResult string
+
+// The results of checkSenderDomain
+const (
+	domainPass      domainResult = "pass"      // the domain has an MX or an address
+	domainNone      domainResult = "none"      // the domain doesn't exist, or has no MX or address
+	domainNullMX    domainResult = "nullmx"    // the domain says it doesn't accept mail, RFC 7505
+	domainTemperror domainResult = "temperror" // the domain's DNS couldn't be looked up
+)
+
+// senderDomainMode returns what to do with the result of the sender domain check
+/*
+   Example TOML:
+
+   sender_domain = "reject"
+
+   "off" doesn't check the sender's domain, and is the default. "mark" adds an
+   X-Sender-Domain header with the result, for the scanner to score. "reject"
+   also refuses MAIL FROM with 550 when the domain doesn't exist or can't receive
+   mail, and with 451 when its DNS couldn't be looked up.
+*/
+func senderDomainMode() string {
+	if cfg.SenderDomain == "" {
+		return "off"
+	}
+	return strings.ToLower(cfg.SenderDomain)
+}
+
+// checkSenderDomainMode checks the sender_domain setting
+func checkSenderDomainMode() error {
+	switch senderDomainMode() {
+	case "off", "mark", "reject":
+		return nil
+	}
+	return fmt.Errorf("unknown sender_domain setting: %s", cfg.SenderDomain)
+}
+
+// senderDomain returns the domain of the sender, "" for bounces and address literals
+func senderDomain(from string) string {
+	if from == "" {
+		return ""
+	}
+	domain := strings.ToLower(from[strings.LastIndex(from, "@")+1:])
+	if strings.HasPrefix(domain, "[") {
+		return ""
+	}
+	return domain
+}
+
+// checkSenderDomain looks up the MX records of the sender's domain, or its address if it has none
+// Bounces and address literals aren't checked, and return "".
+func checkSenderDomain(from string) domainResult {
+	domain := senderDomain(from)
+	if domain == "" {
+		return ""
+	}
+	if !validSPFDomain(domain) {
+		return domainNone
+	}
+	mxs, err := resolver.LookupMX(domain)
+	if err != nil {
+		logDebugf("Error looking up MX for %s: %s", domain, err)
+		return domainTemperror
+	}
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return domainNullMX
+	}
+	if len(mxs) > 0 {
+		return domainPass
+	}
+	// With no MX the domain's address is used, RFC 5321 section 5.1
+	ips, err := resolver.LookupIP(domain)
+	if err != nil {
+		logDebugf("Error looking up %s: %s", domain, err)
+		return domainTemperror
+	}
+	if len(ips) > 0 {
+		return domainPass
+	}
+	return domainNone
+}
+
+// senderDomainRejected returns an error if the sender's domain failed the check and sender_domain is reject
+func senderDomainRejected(clientIP net.IP, conn connInfo, from string, result domainResult) error {
+	if senderDomainMode() != "reject" {
+		return nil
+	}
+	switch result {
+	case domainNone, domainNullMX:
+		if clientIP != nil && !hostExempt(clientIP) {
+			reputation.penalize(clientIP, rejectPenalty)
+		}
+		reject(clientIP, conn, from, "", events.ReasonSenderDomain, "Sender domain "+senderDomain(from)+" can't receive mail")
+		return smtpd.SMTPError("550 5.1.8 Error: sender domain does not accept mail")
+	case domainTemperror:
+		reject(clientIP, conn, from, "", events.ReasonSenderDomain, "Sender domain "+senderDomain(from)+" could not be checked")
+		return smtpd.SMTPError("451 4.1.8 Error: sender domain could not be checked")
+	}
+	return nil
+}
+
+// senderDomainHeader returns the X-Sender-Domain header for the envelope, or nil if the domain wasn't checked
+func (e *env) senderDomainHeader() []byte {
+	if e.domainCheck == "" {
+		return nil
+	}
+	domain := senderDomain(e.from)
+	var comment string
+	switch e.domainCheck {
+	case domainPass:
+		comment = domain + " accepts mail"
+	case domainNone:
+		comment = domain + " has no MX or address records"
+	case domainNullMX:
+		comment = domain + " has a null MX"
+	default:
+		comment = "error looking up " + domain
+	}
+	return foldHeader("X-Sender-Domain", fmt.Sprintf("%s (%s)", e.domainCheck, comment))
+}
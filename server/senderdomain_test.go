@@ -0,0 +1,108 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckSenderDomain(t *testing.T) {
+	defer func(r dnsResolver) { resolver = r }(resolver)
+	resolver = fakeResolver{
+		mx: map[string][]string{
+			"mx.com":     {"mail.mx.com"},
+			"nullmx.com": {"."},
+		},
+		ip:   map[string][]string{"a.com": {"192.0.2.1"}},
+		fail: map[string]bool{"broken.com": true},
+	}
+	tests := []struct {
+		from   string
+		result domainResult
+	}{
+		{"user@mx.com", domainPass},
+		{"user@MX.com", domainPass},
+		{"user@a.com", domainPass},
+		{"user@nothing.com", domainNone},
+		{"user@localhost", domainNone},
+		{"user@nullmx.com", domainNullMX},
+		{"user@broken.com", domainTemperror},
+		{"user@[192.0.2.1]", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if result := checkSenderDomain(tt.from); result != tt.result {
+			t.Errorf("checkSenderDomain(%q) = %q, expected %q", tt.from, result, tt.result)
+		}
+	}
+}
+
+func TestSenderDomainMail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func(r dnsResolver) {
+		resolver = r
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}(resolver)
+	resolver = fakeResolver{
+		mx:   map[string][]string{"good.com": {"mail.good.com"}},
+		fail: map[string]bool{"broken.com": true},
+	}
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	cfg.SenderDomain = "reject"
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+
+	msg := []byte("Subject: test\r\n\r\nHello\r\n")
+	err = smtp.SendMail(ln.Addr().String(), nil, "sender@nothing.com", []string{"bcl@domain.com"}, msg)
+	if err == nil || !strings.HasPrefix(err.Error(), "550") || !strings.Contains(err.Error(), "5.1.8") {
+		t.Errorf("Mail from a missing domain not rejected: %v", err)
+	}
+	err = smtp.SendMail(ln.Addr().String(), nil, "sender@broken.com", []string{"bcl@domain.com"}, msg)
+	if err == nil || !strings.HasPrefix(err.Error(), "451") || !strings.Contains(err.Error(), "4.1.8") {
+		t.Errorf("Mail from a domain that couldn't be looked up not deferred: %v", err)
+	}
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@good.com", []string{"bcl@domain.com"}, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// mark only adds the header
+	cfg.SenderDomain = "mark"
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@nothing.com", []string{"bcl@domain.com"}, msg); err != nil {
+		t.Fatalf("Mail from a missing domain rejected with sender_domain = mark: %s", err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new"))
+	if len(files) != 2 {
+		t.Fatalf("%d messages delivered, expected 2", len(files))
+	}
+	var messages string
+	for _, f := range files {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "bcl", "new", f.Name()))
+		messages += string(data)
+	}
+	for _, h := range []string{"X-Sender-Domain: pass (good.com accepts mail)\r\n", "X-Sender-Domain: none (nothing.com has no MX or address records)\r\n"} {
+		if !strings.Contains(messages, h) {
+			t.Errorf("%q missing from %q", h, messages)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/bcl/letterbox/smtpd"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"os"
+	"os/user"
+	"strings"
+)
+
+// localConn is the smtpd.Connection for a message injected with letterbox sendmail
+// It looks like a client on the Unix socket, so the host checks are skipped,
+// and it is authenticated as the user running the command so that it isn't
+// greylisted or SPF checked.
+type localConn struct {
+	user string // name of the user running the command
+	id   string // random ID, like the ones smtpd gives connections
+}
+
+func (c localConn) Addr() net.Addr            { return &net.UnixAddr{Name: "sendmail", Net: "unix"} }
+func (c localConn) LocalAddr() net.Addr       { return &net.UnixAddr{Name: "sendmail", Net: "unix"} }
+func (c localConn) Close() error              { return nil }
+func (c localConn) TLS() *tls.ConnectionState { return nil }
+func (c localConn) AuthUser() string          { return c.user }
+func (c localConn) Hello() string             { return "localhost" }
+func (c localConn) LocalHostname() string     { return serverHostname() }
+func (c localConn) LMTP() bool                { return false }
+func (c localConn) ID() string                { return c.id }
+
+// localAddress is an address from the sendmail command line or the message's header
+type localAddress string
+
+func (a localAddress) Email() string { return string(a) }
+func (a localAddress) Hostname() string {
+	if i := strings.LastIndex(string(a), "@"); i != -1 {
+		return strings.ToLower(string(a)[i+1:])
+	}
+	return ""
+}
+
+// sendmailOptions are the settings from the sendmail command line
+type sendmailOptions struct {
+	from       string   // envelope sender, from -f
+	rcpts      []string // recipients from the command line
+	fromHeader bool     // -t, also send to the To, Cc, and Bcc addresses in the header
+	ignoreDots bool     // -i or -oi, a line with a single . doesn't end the message
+	config     string   // -C, path to the config file
+}
+
+// parseSendmailArgs parses the options that cron, mail, and other programs pass to sendmail
+// Options that only matter to a queueing MTA, like -odi and -oem, are ignored.
+func parseSendmailArgs(args []string) (sendmailOptions, error) {
+	var opts sendmailOptions
+	// value returns the option's value, attached like -froot or the next argument
+	value := func(i *int, arg string) (string, error) {
+		if len(arg) > 2 {
+			return arg[2:], nil
+		}
+		*i++
+		if *i == len(args) {
+			return "", fmt.Errorf("%s needs a value", arg)
+		}
+		return args[*i], nil
+	}
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			break
+		}
+		var err error
+		switch {
+		case arg == "-t":
+			opts.fromHeader = true
+		case arg == "-i" || arg == "-oi":
+			opts.ignoreDots = true
+		case strings.HasPrefix(arg, "-f") || strings.HasPrefix(arg, "-r"):
+			opts.from, err = value(&i, arg)
+		case strings.HasPrefix(arg, "-C"):
+			opts.config, err = value(&i, arg)
+		case strings.HasPrefix(arg, "-F"), strings.HasPrefix(arg, "-N"), strings.HasPrefix(arg, "-R"), strings.HasPrefix(arg, "-V"):
+			_, err = value(&i, arg)
+		case arg == "-bm" || strings.HasPrefix(arg, "-o") || strings.HasPrefix(arg, "-B"):
+		case strings.HasPrefix(arg, "-b"):
+			return opts, fmt.Errorf("unsupported mode %s", arg)
+		default:
+			return opts, fmt.Errorf("unknown option %s", arg)
+		}
+		if err != nil {
+			return opts, err
+		}
+	}
+	for _, arg := range args[i:] {
+		for _, rcpt := range strings.Split(arg, ",") {
+			if rcpt = strings.TrimSpace(rcpt); rcpt != "" {
+				opts.rcpts = append(opts.rcpts, rcpt)
+			}
+		}
+	}
+	return opts, nil
+}
+
+// sendmailReader reads the message from stdin one line at a time
+type sendmailReader struct {
+	r          *bufio.Reader
+	ignoreDots bool // a line with a single . doesn't end the message
+	done       bool
+}
+
+// next returns the next line of the message, or nil at the end of it
+func (sr *sendmailReader) next() ([]byte, error) {
+	if sr.done {
+		return nil, nil
+	}
+	line, err := sr.r.ReadBytes('\n')
+	if err == io.EOF {
+		sr.done = true
+	} else if err != nil {
+		return nil, err
+	}
+	if !sr.ignoreDots && bytes.Equal(bytes.TrimRight(line, "\r\n"), []byte(".")) {
+		sr.done = true
+		return nil, nil
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	return line, nil
+}
+
+// readHeader reads the message's header fields, up to the blank line
+// With fromHeader the To, Cc, and Bcc addresses are returned, and the Bcc
+// fields are left out of the header so the recipients don't see them.
+func (sr *sendmailReader) readHeader(fromHeader bool) ([][]byte, []string, error) {
+	var header [][]byte
+	for {
+		line, err := sr.next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if line == nil || len(bytes.TrimSpace(line)) == 0 {
+			break
+		}
+		header = append(header, line)
+	}
+	if !fromHeader {
+		return header, nil, nil
+	}
+	hdr, err := mail.ReadMessage(bytes.NewReader(append(bytes.Join(header, nil), '\r', '\n')))
+	if err != nil {
+		return nil, nil, err
+	}
+	var rcpts []string
+	for _, name := range []string{"To", "Cc", "Bcc"} {
+		if hdr.Header.Get(name) == "" {
+			continue
+		}
+		list, err := hdr.Header.AddressList(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", name, err)
+		}
+		for _, addr := range list {
+			rcpts = append(rcpts, addr.Address)
+		}
+	}
+	var kept [][]byte
+	bcc := false
+	for _, line := range header {
+		if line[0] != ' ' && line[0] != '\t' {
+			bcc = fieldName(string(line)) == "bcc"
+		}
+		if !bcc {
+			kept = append(kept, line)
+		}
+	}
+	return kept, rcpts, nil
+}
+
+// injectMessage delivers the message read from r, like a client sending it on the Unix socket
+// Recipients that are rejected are reported in the error, and the message is
+// still delivered to the rest of them.
+func injectMessage(conn localConn, opts sendmailOptions, r io.Reader) error {
+	sr := &sendmailReader{r: bufio.NewReader(r), ignoreDots: opts.ignoreDots}
+	header, headerRcpts, err := sr.readHeader(opts.fromHeader)
+	if err != nil {
+		return fmt.Errorf("error reading the message header: %s", err)
+	}
+	rcpts := append(append([]string{}, opts.rcpts...), headerRcpts...)
+	if len(rcpts) == 0 {
+		return errors.New("no recipients")
+	}
+
+	envelope, err := onNewMail(conn, localAddress(opts.from))
+	if err != nil {
+		return err
+	}
+	var rejected []string
+	for _, rcpt := range rcpts {
+		if err := envelope.AddRecipient(localAddress(rcpt)); err != nil {
+			rejected = append(rejected, fmt.Sprintf("%s: %s", rcpt, err))
+		}
+	}
+	if err := envelope.BeginData(); err != nil {
+		if len(rejected) > 0 {
+			return fmt.Errorf("not delivered to %s", strings.Join(rejected, ", "))
+		}
+		return err
+	}
+	// write sends a line to the envelope with a CRLF line ending, like smtpd does
+	write := func(line []byte) error {
+		line = append(bytes.TrimRight(line, "\r\n"), '\r', '\n')
+		if err := envelope.Write(line); err != nil {
+			envelope.(smtpd.Aborter).Abort()
+			return err
+		}
+		return nil
+	}
+	// The blank line is written even if the message has no body, to end the header
+	for _, line := range append(header, nil) {
+		if err := write(line); err != nil {
+			return err
+		}
+	}
+	for {
+		line, err := sr.next()
+		if err != nil {
+			envelope.(smtpd.Aborter).Abort()
+			return err
+		}
+		if line == nil {
+			break
+		}
+		if err := write(line); err != nil {
+			return err
+		}
+	}
+	if err := envelope.Close(); err != nil {
+		return err
+	}
+	if len(rejected) > 0 {
+		return fmt.Errorf("not delivered to %s", strings.Join(rejected, ", "))
+	}
+	return nil
+}
+
+// setupSendmail reads the config and sets up what delivery needs, without starting the server
+func setupSendmail() error {
+	f, err := os.Open(cmdline.Config)
+	if err != nil {
+		return err
+	}
+	cfg, err = readConfig(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %s", cmdline.Config, err)
+	}
+	if err := checkLogFormat(); err != nil {
+		return err
+	}
+	// Only the log file gets the log, so cron doesn't mail it to the user
+	var logOut io.Writer = ioutil.Discard
+	if cmdline.Logfile != "" {
+		f, err := openLogFile(cmdline.Logfile)
+		if err != nil {
+			return err
+		}
+		logFile, logOut = f, f
+	}
+	setupLogging(logOut)
+	parseHosts()
+	for _, setup := range []func() error{parseSchedules, loadPlugins, setupLua, loadAliases} {
+		if err := setup(); err != nil {
+			return err
+		}
+	}
+	for _, check := range configChecks {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	if err := setupQueue(); err != nil {
+		return err
+	}
+	return setupScan()
+}
+
+// sendmailCommand delivers a message from stdin, for programs like cron that run sendmail
+// It uses the same aliases, routing, and filters as mail arriving over SMTP,
+// so mail from the same host doesn't have to be sent to letterbox over
+// loopback. letterbox also runs this when it is installed as sendmail.
+/*
+   letterbox sendmail [-f sender] [-t] [-i] [-C letterbox.toml] [recipient ...]
+
+   Recipients are taken from the command line, and with -t also from the
+   To, Cc, and Bcc fields of the header. Bcc fields are removed. Unless -i
+   is used a line with a single . ends the message.
+*/
+func sendmailCommand(args []string) error {
+	opts, err := parseSendmailArgs(args)
+	if err != nil {
+		return fmt.Errorf("%s\nusage: sendmail [-f sender] [-t] [-i] [-C letterbox.toml] [recipient ...]", err)
+	}
+	if opts.config != "" {
+		cmdline.Config = opts.config
+	}
+	if err := setupSendmail(); err != nil {
+		return err
+	}
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if opts.from == "" {
+		opts.from = name + "@" + localHostname()
+	}
+	if logFile != nil {
+		defer logFile.Close()
+	}
+	return injectMessage(localConn{user: name, id: newLogID()}, opts, os.Stdin)
+}
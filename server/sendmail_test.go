@@ -0,0 +1,87 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSendmailArgs(t *testing.T) {
+	// What cron runs
+	opts, err := parseSendmailArgs([]string{"-FCronDaemon", "-i", "-B8BITMIME", "-oem", "-oi", "-t", "-f", "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.fromHeader || !opts.ignoreDots || opts.from != "root" || len(opts.rcpts) != 0 {
+		t.Errorf("Wrong options: %#v", opts)
+	}
+
+	opts, err = parseSendmailArgs([]string{"-fbcl@domain.com", "-C", "/etc/letterbox.toml", "--", "alice@domain.com,bob@domain.com", "bcl@domain.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.from != "bcl@domain.com" || opts.config != "/etc/letterbox.toml" || opts.fromHeader || opts.ignoreDots {
+		t.Errorf("Wrong options: %#v", opts)
+	}
+	if !reflect.DeepEqual(opts.rcpts, []string{"alice@domain.com", "bob@domain.com", "bcl@domain.com"}) {
+		t.Errorf("Wrong recipients: %v", opts.rcpts)
+	}
+
+	for _, args := range [][]string{{"-bs"}, {"-x"}, {"-f"}} {
+		if _, err := parseSendmailArgs(args); err == nil {
+			t.Errorf("parseSendmailArgs(%v) didn't fail", args)
+		}
+	}
+}
+
+func TestInjectMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg.Emails = nil
+	}()
+	cmdline.Maildirs = dir
+	cfg.Emails = []string{"bcl@domain.com", "alice@domain.com"}
+	conn := localConn{user: "cron", id: "c0ffee"}
+
+	// -t takes the recipients from the header, and hides the Bcc
+	msg := "To: bcl@domain.com\nBcc: alice@domain.com,\n nobody@domain.com\nSubject: test\n\nHello\n.\nafter the dot\n"
+	err = injectMessage(conn, sendmailOptions{from: "root@localhost", fromHeader: true, ignoreDots: true}, strings.NewReader(msg))
+	if err == nil || !strings.Contains(err.Error(), "nobody@domain.com") {
+		t.Errorf("Rejected recipient not reported: %v", err)
+	}
+	for _, user := range []string{"bcl", "alice"} {
+		files, err := ioutil.ReadDir(filepath.Join(dir, user, "new"))
+		if err != nil || len(files) != 1 {
+			t.Fatalf("Message not delivered to %s: %v", user, err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, user, "new", files[0].Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "Bcc") || !strings.Contains(string(data), "Subject: test\r\n\r\nHello\r\n.\r\nafter the dot\r\n") {
+			t.Errorf("Wrong message for %s: %q", user, data)
+		}
+	}
+
+	// Without -i a single dot ends the message
+	if err := injectMessage(conn, sendmailOptions{from: "root@localhost", rcpts: []string{"bcl@domain.com"}}, strings.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "bcl", "new"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Message not delivered: %v", err)
+	}
+
+	if err := injectMessage(conn, sendmailOptions{from: "root@localhost"}, strings.NewReader(msg)); err == nil {
+		t.Errorf("Message without recipients wasn't refused")
+	}
+}
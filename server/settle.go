@@ -0,0 +1,147 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/events"
+	"github.com/bcl/letterbox/smtpd"
+	"strings"
+	"time"
+)
+
+// errDeliveryFailed is the reply for a recipient whose copy couldn't be written after others were delivered
+var errDeliveryFailed = smtpd.SMTPError("451 4.3.0 Error: delivery failed")
+
+// refuseCopies finds the copies that Close won't deliver before any of them are, returning their indexes and why the first one was refused
+// Duplicates are dropped without an error. The recipients the message is too
+// big for, or whose mailboxes it doesn't fit in any more, are refused.
+func (e *env) refuseCopies(msgID string, now time.Time) (map[int]bool, error) {
+	skip := make(map[int]bool)
+	var refused error
+	if len(e.tooBig) > 0 {
+		refused = errRcptTooBig
+	}
+	for i, del := range e.deliveries {
+		rcpt := e.destRcpts[i]
+		if dedup.duplicate(rcpt, msgID, now) {
+			logDebugf("Dropping duplicate of %s for %s", msgID, rcpt)
+			skip[i] = true
+			continue
+		}
+		if e.tooBig[rcpt] {
+			skip[i] = true
+			continue
+		}
+		if del != nil && mailboxFull(e.destUsers[i], del.Size()) {
+			e.conn.logf("Message is too big for the space left in %s's mailbox", e.destUsers[i])
+			reject(e.clientIP, e.conn, e.from, rcpt, events.ReasonMailboxFull, errMailboxFull.Error())
+			if e.rcptErrors[rcpt] == nil {
+				e.rcptErrors[rcpt] = errMailboxFull
+			}
+			if refused == nil {
+				refused = errMailboxFull
+			}
+			skip[i] = true
+		}
+	}
+	return skip, refused
+}
+
+// refuseAll refuses the whole message before any of it has been delivered, so the client can send it again
+func (e *env) refuseAll(msgID string, err error) error {
+	for _, rcpt := range e.destRcpts {
+		dedup.forget(rcpt, msgID)
+	}
+	return e.abort(err)
+}
+
+// mboxLanded returns true if one of the landed deliveries was appended to an mbox, which can't be taken back
+func (e *env) mboxLanded(landed []landedDelivery) bool {
+	for _, l := range landed {
+		if e.deliveries[l.index].Mbox != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// committed returns true if some of the message's recipients have their copies, or have had them queued
+func (e *env) committed(landed bool) bool {
+	if landed {
+		return true
+	}
+	for _, rcpt := range e.rcpts {
+		if strings.Contains(rcpt.Email(), "@") && e.rcptErrors[rcpt.Email()] == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// settle returns the reply to the end of DATA, once Close has delivered what it could
+// An LMTP client gets a reply for each recipient, and an SMTP client that is
+// refused before anything was delivered sends the whole message again. Once
+// some of the recipients have their copies, refusing the message would have
+// them get it again when it is sent again, so it is accepted, and the
+// recipients that failed are queued to be retried if their error is
+// temporary, or bounced to the sender.
+func (e *env) settle(firstErr error, landed bool, retry map[string][]queuedDelivery, now time.Time) error {
+	if firstErr == nil || e.lmtp || !e.committed(landed) {
+		return firstErr
+	}
+	var queued []queuedDelivery
+	var queuedRcpts []string
+	var bounced []bounceRcpt
+	for _, rcpt := range e.rcpts {
+		err := e.rcptErrors[rcpt.Email()]
+		if err == nil {
+			continue
+		}
+		reply := string(errDeliveryFailed)
+		if se, ok := err.(smtpd.SMTPError); ok {
+			reply = string(se)
+		}
+		if strings.HasPrefix(reply, "4") && queueEnabled() && len(retry[rcpt.Email()]) > 0 {
+			queued = append(queued, retry[rcpt.Email()]...)
+			queuedRcpts = append(queuedRcpts, rcpt.Email())
+			continue
+		}
+		bounced = append(bounced, bounceRcpt{rcpt: rcpt.Email(), status: permanentStatus(replyStatus(reply)), diagnostic: reply})
+	}
+	if len(queued) > 0 {
+		// The rest of the message may already be queued under the message's ID
+		if err := enqueue(newLogID(), e.from, queued, e.traced(), len(e.received), now); err != nil {
+			e.conn.logf("Error queueing message: %s", err)
+			for _, rcpt := range queuedRcpts {
+				reply := e.rcptErrors[rcpt].Error()
+				bounced = append(bounced, bounceRcpt{rcpt: rcpt, status: permanentStatus(replyStatus(reply)), diagnostic: reply})
+			}
+		} else {
+			for _, rcpt := range queuedRcpts {
+				delete(e.rcptErrors, rcpt)
+				e.journalDelivery(rcpt, "queued", "")
+			}
+		}
+	}
+	if len(bounced) == 0 {
+		return nil
+	}
+	if !bouncesEnabled() {
+		var rcpts []string
+		for _, b := range bounced {
+			rcpts = append(rcpts, b.rcpt)
+		}
+		e.conn.logf("Not delivering to %s, the other recipients already have the message", strings.Join(rcpts, ", "))
+		return nil
+	}
+	if err := bounce(&queueEntry{ID: e.conn.queueID, From: e.from, Created: now}, bounced, e.traced(), now); err != nil {
+		e.conn.logf("Error queueing bounce: %s", err)
+	}
+	return nil
+}
+
+// permanentStatus returns the enhanced status code as a permanent failure, for a bounce
+func permanentStatus(status string) string {
+	if strings.HasPrefix(status, "4.") {
+		return "5" + status[1:]
+	}
+	return status
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPermanentStatus(t *testing.T) {
+	tests := map[string]string{
+		"4.3.0": "5.3.0",
+		"5.2.2": "5.2.2",
+		"5.0.0": "5.0.0",
+	}
+	for status, expected := range tests {
+		if s := permanentStatus(status); s != expected {
+			t.Errorf("permanentStatus(%q) = %q, expected %q", status, s, expected)
+		}
+	}
+}
+
+func TestSettle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+		deliveryBackend = nil
+	}()
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"alice@domain.com", "bcl@domain.com", "carol@domain.com"}
+	// The message fits in bcl's mailbox at RCPT time, but not once it has been sent
+	cfg.Quota = config.Quota{Users: map[string]config.UserQuota{"bcl": {Size: 100}}}
+	cfg.Queue = config.Queue{Dir: filepath.Join(dir, "queue"), Bounces: true}
+	// Bounces are relayed by the queue, which isn't run here
+	cfg.Relay.Host = "127.0.0.1"
+	if err := setupQueue(); err != nil {
+		t.Fatal(err)
+	}
+	// The backend can't store alice's copy for now
+	deliveryBackend = &testBackend{}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	count := func(user string) int {
+		files, _ := ioutil.ReadDir(filepath.Join(cmdline.Maildirs, user, "new"))
+		return len(files)
+	}
+	entries := func() []queueEntry {
+		paths, _ := filepath.Glob(filepath.Join(cfg.Queue.Dir, "*.json"))
+		var list []queueEntry
+		for _, path := range paths {
+			data, _ := ioutil.ReadFile(path)
+			var entry queueEntry
+			json.Unmarshal(data, &entry)
+			list = append(list, entry)
+		}
+		return list
+	}
+
+	// carol gets her copy, so the message is accepted instead of being sent
+	// again, alice is queued to be retried and bcl is bounced
+	rcpts := []string{"alice@domain.com", "bcl@domain.com", "carol@domain.com"}
+	message := []byte("Subject: test\r\n\r\n" + strings.Repeat("x", 200) + "\r\n")
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@remote.com", rcpts, message); err != nil {
+		t.Fatalf("Message refused after it was delivered: %s", err)
+	}
+	if count("alice") != 0 || count("bcl") != 0 || count("carol") != 1 {
+		t.Errorf("Wrong deliveries: alice %d, bcl %d, carol %d", count("alice"), count("bcl"), count("carol"))
+	}
+	var retried, bounced bool
+	for _, entry := range entries() {
+		switch {
+		case entry.From == "sender@remote.com" && len(entry.Deliveries) == 1 && entry.Deliveries[0].User == "alice":
+			retried = true
+		case entry.From == "" && len(entry.Deliveries) == 1 && entry.Deliveries[0].Rcpt == "sender@remote.com":
+			bounced = true
+		default:
+			t.Errorf("Unexpected queue entry: %+v", entry)
+		}
+	}
+	if !retried || !bounced {
+		t.Errorf("alice queued %v, bcl bounced %v", retried, bounced)
+	}
+
+	// Without bounces bcl can only be refused along with the whole message,
+	// before carol gets it, so she still has one copy when it is sent again
+	cfg.Queue = config.Queue{}
+	deliveryBackend = nil
+	rcpts = []string{"bcl@domain.com", "carol@domain.com"}
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@remote.com", rcpts, message); err == nil || !strings.HasPrefix(err.Error(), "552") {
+		t.Errorf("Message too big for bcl not refused: %v", err)
+	}
+	if count("carol") != 1 {
+		t.Errorf("carol has %d messages", count("carol"))
+	}
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@remote.com", []string{"carol@domain.com"}, message); err != nil {
+		t.Errorf("Message refused: %s", err)
+	}
+	if count("carol") != 2 {
+		t.Errorf("carol has %d messages", count("carol"))
+	}
+}
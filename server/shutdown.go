@@ -0,0 +1,128 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/smtpd"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// abortGrace is how long to wait for sessions to clean up after their connections are closed
+const abortGrace = 5 * time.Second
+
+// drainState tracks the listeners and the messages being received, so that
+// letterbox can stop accepting mail and let the messages finish before exiting
+var drainState = struct {
+	sync.Mutex
+	shutdown  bool
+	listeners []net.Listener
+	active    map[*env]smtpd.Connection // envelopes between BeginData and Close or Abort
+}{active: make(map[*env]smtpd.Connection)}
+
+// addListener records a listener to close when shutting down
+func addListener(ln net.Listener) {
+	drainState.Lock()
+	defer drainState.Unlock()
+	drainState.listeners = append(drainState.listeners, ln)
+}
+
+// resetDrain closes the listeners and forgets them, so that letterbox can be served again after a shutdown
+func resetDrain() {
+	drainState.Lock()
+	defer drainState.Unlock()
+	for _, ln := range drainState.listeners {
+		ln.Close()
+	}
+	drainState.listeners = nil
+	drainState.shutdown = false
+}
+
+// shuttingDown returns true once a shutdown has started
+func shuttingDown() bool {
+	drainState.Lock()
+	defer drainState.Unlock()
+	return drainState.shutdown
+}
+
+// trackData records that the envelope is receiving a message
+func trackData(e *env) {
+	drainState.Lock()
+	defer drainState.Unlock()
+	drainState.active[e] = e.client
+}
+
+// untrackData records that the envelope's message has been delivered or thrown away
+func untrackData(e *env) {
+	drainState.Lock()
+	defer drainState.Unlock()
+	delete(drainState.active, e)
+}
+
+// activeData returns the number of messages still being received
+func activeData() int {
+	drainState.Lock()
+	defer drainState.Unlock()
+	return len(drainState.active)
+}
+
+// drainTimeout returns how long to wait for messages to finish when shutting down
+/*
+   Example TOML:
+
+   drain_timeout = "1m"
+
+   It defaults to 30s.
+*/
+func drainTimeout() time.Duration {
+	if cfg.DrainTimeout.Duration > 0 {
+		return cfg.DrainTimeout.Duration
+	}
+	return 30 * time.Second
+}
+
+// waitForData waits until no messages are being received, or the timeout passes
+// It returns true if all of the messages finished.
+func waitForData(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for activeData() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// shutdown stops accepting mail and waits for the messages being received to finish
+// New connections are refused by closing the listeners, and clients that are
+// already connected get a 421 for their next message. Clients that are still
+// sending after the timeout are disconnected, which makes their sessions
+// remove the partly written messages from the maildirs. The reputation
+// scores are saved before it returns.
+func shutdown(timeout time.Duration) {
+	defer reputation.flush(time.Now())
+	drainState.Lock()
+	drainState.shutdown = true
+	for _, ln := range drainState.listeners {
+		ln.Close()
+	}
+	drainState.Unlock()
+
+	log.Printf("Shutting down, waiting for %d messages", activeData())
+	if waitForData(timeout) {
+		return
+	}
+
+	drainState.Lock()
+	log.Printf("Abandoning %d messages after %s", len(drainState.active), timeout)
+	for _, c := range drainState.active {
+		if c != nil {
+			c.Close()
+		}
+	}
+	drainState.Unlock()
+	if !waitForData(abortGrace) {
+		log.Printf("%d messages were not cleaned up", activeData())
+	}
+}
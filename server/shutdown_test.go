@@ -0,0 +1,116 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startDrainSession starts a server and a client that is part way through sending a message
+func startDrainSession(t *testing.T) (net.Listener, *textproto.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addListener(ln)
+	go newServer("localhost", nil).Serve(ln)
+
+	conn, err := textproto.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct {
+		cmd  string
+		code int
+	}{
+		{"", 220},
+		{"HELO localhost", 250},
+		{"MAIL FROM:<sender@domain.com>", 250},
+		{"RCPT TO:<bcl@domain.com>", 250},
+		{"DATA", 354},
+	} {
+		if step.cmd != "" {
+			conn.PrintfLine("%s", step.cmd)
+		}
+		if _, _, err := conn.ReadResponse(step.code); err != nil {
+			t.Fatalf("%s: %s", step.cmd, err)
+		}
+	}
+	conn.PrintfLine("Subject: draining")
+	return ln, conn
+}
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+		drainState.Lock()
+		drainState.shutdown = false
+		drainState.listeners = nil
+		drainState.Unlock()
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	parseHosts()
+
+	// A message that finishes within the timeout is delivered
+	ln, conn := startDrainSession(t)
+	defer conn.Close()
+	done := make(chan bool)
+	go func() {
+		shutdown(5 * time.Second)
+		done <- true
+	}()
+	for !shuttingDown() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		c.Close()
+		t.Error("New connection accepted while shutting down")
+	}
+	conn.PrintfLine("")
+	conn.PrintfLine("Hello")
+	conn.PrintfLine(".")
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatalf("Message not accepted while draining: %s", err)
+	}
+	conn.PrintfLine("MAIL FROM:<sender@domain.com>")
+	if _, _, err := conn.ReadResponse(421); err != nil {
+		t.Errorf("New message while shutting down: %s", err)
+	}
+	<-done
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new")); len(files) != 1 {
+		t.Errorf("Drained message not delivered")
+	}
+
+	// A message that is still being sent after the timeout is thrown away
+	drainState.Lock()
+	drainState.shutdown = false
+	drainState.Unlock()
+	_, stalled := startDrainSession(t)
+	defer stalled.Close()
+	shutdown(100 * time.Millisecond)
+	if n := activeData(); n != 0 {
+		t.Errorf("%d messages still active after shutdown", n)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "tmp")); len(files) != 0 {
+		t.Errorf("Abandoned message left in tmp: %v", files[0].Name())
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new")); len(files) != 1 {
+		t.Errorf("Abandoned message was delivered")
+	}
+}
@@ -0,0 +1,687 @@
+package server
+
+import (
+	"fmt"
+	"github.com/luksen/maildir"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// sieveFile is the name of the filter file in a user's maildir
+const sieveFile = ".letterbox-sieve"
+
+// sieveTest is a test in an if, elsif, or anyof/allof/not
+type sieveTest struct {
+	name    string       // header, address, envelope, exists, anyof, allof, not, true, or false
+	match   string       // :is, :contains, or :matches
+	part    string       // :all, :localpart, or :domain for address and envelope
+	headers []string     // header names, or from and to for envelope, to test
+	keys    []string     // values to compare the headers with
+	tests   []*sieveTest // tests for anyof, allof, and not
+}
+
+// sieveBranch is an if, elsif, or else block, else has no test
+type sieveBranch struct {
+	test  *sieveTest
+	block []sieveCommand
+}
+
+// sieveCommand is an action, or an if with its elsif and else branches
+type sieveCommand struct {
+	action   string // keep, fileinto, discard, stop, include, or if
+	folder   string // Maildir++ folder for fileinto
+	script   string // global script name for include
+	optional bool   // include doesn't log an error if the script is missing
+	branches []sieveBranch
+}
+
+// maxSieveIncludes limits how deeply scripts can include each other
+const maxSieveIncludes = 5
+
+// sieveScriptRE matches the names of global scripts
+var sieveScriptRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// sieveToken is a token from a Sieve script
+// kind is one of: word, tag, string, number, or the punctuation character itself.
+type sieveToken struct {
+	kind  string
+	value string
+	line  int
+}
+
+// sieveTokens splits a Sieve script into tokens
+func sieveTokens(script string) ([]sieveToken, error) {
+	var tokens []sieveToken
+	line := 1
+	for i := 0; i < len(script); {
+		c := script[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end == -1 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			line += strings.Count(script[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"':
+			var b strings.Builder
+			start := line
+			for i++; ; i++ {
+				if i >= len(script) {
+					return nil, fmt.Errorf("line %d: unterminated string", start)
+				}
+				if script[i] == '"' {
+					break
+				}
+				if script[i] == '\\' && i+1 < len(script) {
+					i++
+				}
+				if script[i] == '\n' {
+					line++
+				}
+				b.WriteByte(script[i])
+			}
+			i++
+			tokens = append(tokens, sieveToken{"string", b.String(), start})
+		case strings.ContainsRune("[](){},;", rune(c)):
+			tokens = append(tokens, sieveToken{string(c), string(c), line})
+			i++
+		case c == ':' || c == '_' || isAlnum(c):
+			j := i + 1
+			for j < len(script) && (script[j] == '_' || isAlnum(script[j])) {
+				j++
+			}
+			kind := "word"
+			if c == ':' {
+				kind = "tag"
+			} else if c >= '0' && c <= '9' {
+				kind = "number"
+			}
+			tokens = append(tokens, sieveToken{kind, strings.ToLower(script[i:j]), line})
+			i = j
+		default:
+			return nil, fmt.Errorf("line %d: unexpected %q", line, c)
+		}
+	}
+	return tokens, nil
+}
+
+// isAlnum returns true if c is an ASCII letter or digit
+func isAlnum(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// sieveParser parses the tokens of a Sieve script
+type sieveParser struct {
+	tokens []sieveToken
+	pos    int
+}
+
+// peek returns the next token without using it, with an empty kind at the end of the script
+func (p *sieveParser) peek() sieveToken {
+	if p.pos >= len(p.tokens) {
+		return sieveToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+// next returns the next token
+func (p *sieveParser) next() sieveToken {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// errorf returns an error for the next token
+func (p *sieveParser) errorf(format string, args ...interface{}) error {
+	t := p.peek()
+	if t.kind == "" {
+		return fmt.Errorf("end of script: "+format, args...)
+	}
+	return fmt.Errorf("line %d: "+format, append([]interface{}{t.line}, args...)...)
+}
+
+// expect uses the next token, returning an error if it isn't kind
+func (p *sieveParser) expect(kind string) (sieveToken, error) {
+	if p.peek().kind != kind {
+		return sieveToken{}, p.errorf("expected %s", kind)
+	}
+	return p.next(), nil
+}
+
+// stringList parses a string or a list of strings
+func (p *sieveParser) stringList() ([]string, error) {
+	if p.peek().kind == "string" {
+		return []string{p.next().value}, nil
+	}
+	if _, err := p.expect("["); err != nil {
+		return nil, p.errorf("expected a string or a list of strings")
+	}
+	var list []string
+	for {
+		s, err := p.expect("string")
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s.value)
+		if p.peek().kind == "]" {
+			p.next()
+			return list, nil
+		}
+		if _, err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// commands parses commands until the end of the block or script
+func (p *sieveParser) commands(block bool) ([]sieveCommand, error) {
+	var commands []sieveCommand
+	for {
+		t := p.peek()
+		if t.kind == "" && !block {
+			return commands, nil
+		}
+		if t.kind == "}" && block {
+			p.next()
+			return commands, nil
+		}
+		if t.kind != "word" {
+			return nil, p.errorf("expected a command")
+		}
+		p.next()
+		cmd := sieveCommand{action: t.value}
+		switch t.value {
+		case "require":
+			extensions, err := p.stringList()
+			if err != nil {
+				return nil, err
+			}
+			for _, ext := range extensions {
+				if ext != "fileinto" && ext != "envelope" && ext != "include" {
+					return nil, fmt.Errorf("line %d: unsupported extension %q", t.line, ext)
+				}
+			}
+		case "keep", "discard", "stop":
+			commands = append(commands, cmd)
+		case "fileinto":
+			s, err := p.expect("string")
+			if err != nil {
+				return nil, err
+			}
+			if cmd.folder, err = sieveFolder(s.value); err != nil {
+				return nil, fmt.Errorf("line %d: %s", s.line, err)
+			}
+			commands = append(commands, cmd)
+		case "include":
+			if err := p.include(&cmd); err != nil {
+				return nil, err
+			}
+			commands = append(commands, cmd)
+		case "if":
+			if err := p.ifBranches(&cmd); err != nil {
+				return nil, err
+			}
+			commands = append(commands, cmd)
+			continue
+		default:
+			return nil, fmt.Errorf("line %d: unsupported command %q", t.line, t.value)
+		}
+		if _, err := p.expect(";"); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// include parses the tags and script name of an include
+// Only :global scripts, from the filters global_dir, are supported. :once is
+// accepted and ignored, since a script's actions are only taken once anyway.
+func (p *sieveParser) include(cmd *sieveCommand) error {
+	global := false
+	for p.peek().kind == "tag" {
+		t := p.next()
+		switch t.value {
+		case ":global":
+			global = true
+		case ":optional":
+			cmd.optional = true
+		case ":once":
+		default:
+			return fmt.Errorf("line %d: unsupported include %s", t.line, t.value)
+		}
+	}
+	s, err := p.expect("string")
+	if err != nil {
+		return err
+	}
+	if !global {
+		return fmt.Errorf("line %d: only :global scripts can be included", s.line)
+	}
+	if !sieveScriptRE.MatchString(s.value) {
+		return fmt.Errorf("line %d: bad script name %q", s.line, s.value)
+	}
+	cmd.script = s.value
+	return nil
+}
+
+// ifBranches parses the test and block of an if, and any elsif and else after it
+func (p *sieveParser) ifBranches(cmd *sieveCommand) error {
+	for {
+		test, err := p.test()
+		if err != nil {
+			return err
+		}
+		block, err := p.block()
+		if err != nil {
+			return err
+		}
+		cmd.branches = append(cmd.branches, sieveBranch{test, block})
+		if p.peek().kind != "word" {
+			return nil
+		}
+		switch p.peek().value {
+		case "elsif":
+			p.next()
+			continue
+		case "else":
+			p.next()
+			block, err := p.block()
+			if err != nil {
+				return err
+			}
+			cmd.branches = append(cmd.branches, sieveBranch{nil, block})
+		}
+		return nil
+	}
+}
+
+// block parses the commands between { and }
+func (p *sieveParser) block() ([]sieveCommand, error) {
+	if _, err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	return p.commands(true)
+}
+
+// test parses a test
+func (p *sieveParser) test() (*sieveTest, error) {
+	t, err := p.expect("word")
+	if err != nil {
+		return nil, p.errorf("expected a test")
+	}
+	test := &sieveTest{name: t.value, match: ":is", part: ":all"}
+	switch t.value {
+	case "true", "false":
+	case "not":
+		inner, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		test.tests = []*sieveTest{inner}
+	case "anyof", "allof":
+		if _, err := p.expect("("); err != nil {
+			return nil, err
+		}
+		for {
+			inner, err := p.test()
+			if err != nil {
+				return nil, err
+			}
+			test.tests = append(test.tests, inner)
+			if p.peek().kind == ")" {
+				p.next()
+				break
+			}
+			if _, err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	case "exists":
+		if test.headers, err = p.stringList(); err != nil {
+			return nil, err
+		}
+	case "header", "address", "envelope":
+		for p.peek().kind == "tag" {
+			tag := p.next()
+			switch tag.value {
+			case ":is", ":contains", ":matches":
+				test.match = tag.value
+			case ":all", ":localpart", ":domain":
+				if t.value == "header" {
+					return nil, fmt.Errorf("line %d: %s is only used with address and envelope", tag.line, tag.value)
+				}
+				test.part = tag.value
+			default:
+				return nil, fmt.Errorf("line %d: unsupported tag %s", tag.line, tag.value)
+			}
+		}
+		if test.headers, err = p.stringList(); err != nil {
+			return nil, err
+		}
+		if t.value == "envelope" {
+			for i, part := range test.headers {
+				test.headers[i] = strings.ToLower(part)
+				if test.headers[i] != "from" && test.headers[i] != "to" {
+					return nil, fmt.Errorf("line %d: unsupported envelope part %q", t.line, part)
+				}
+			}
+		}
+		if test.keys, err = p.stringList(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("line %d: unsupported test %q", t.line, t.value)
+	}
+	return test, nil
+}
+
+// parseSieve parses a Sieve script
+func parseSieve(script string) ([]sieveCommand, error) {
+	tokens, err := sieveTokens(script)
+	if err != nil {
+		return nil, err
+	}
+	p := &sieveParser{tokens: tokens}
+	return p.commands(false)
+}
+
+// sieveFolder converts a fileinto folder name to a Maildir++ folder
+// Folders can be nested with / or ., like Alerts/Disk.
+func sieveFolder(name string) (string, error) {
+	folder := strings.Replace(name, "/", ".", -1)
+	if strings.EqualFold(folder, "INBOX") {
+		return "", nil
+	}
+	for _, part := range strings.Split(folder, ".") {
+		if part == "" {
+			return "", fmt.Errorf("bad folder name %q", name)
+		}
+	}
+	return folder, nil
+}
+
+// sieveMatch compares a header value with a key, ignoring case
+func sieveMatch(match, value, key string) bool {
+	value, key = strings.ToLower(value), strings.ToLower(key)
+	switch match {
+	case ":contains":
+		return strings.Contains(value, key)
+	case ":matches":
+		return globMatch(key, value)
+	}
+	return value == key
+}
+
+// globMatch matches a value against a pattern where * matches any run of characters and ? one character
+// A backslash makes the next character in the pattern literal.
+func globMatch(pattern, value string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for pattern = pattern[1:]; len(pattern) > 0 && pattern[0] == '*'; pattern = pattern[1:] {
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(value); i++ {
+				if globMatch(pattern, value[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if value == "" {
+				return false
+			}
+			pattern, value = pattern[1:], value[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+		}
+		if value == "" || pattern[0] != value[0] {
+			return false
+		}
+		pattern, value = pattern[1:], value[1:]
+	}
+	return value == ""
+}
+
+// headerValues returns the decoded values of a header
+func headerValues(headers mail.Header, name string) []string {
+	var dec mime.WordDecoder
+	var values []string
+	for _, v := range headers[textproto.CanonicalMIMEHeaderKey(name)] {
+		if decoded, err := dec.DecodeHeader(v); err == nil {
+			v = decoded
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// addressPart returns the :all, :localpart, or :domain part of an address
+func addressPart(address, part string) string {
+	i := strings.LastIndex(address, "@")
+	switch {
+	case part == ":localpart" && i != -1:
+		return address[:i]
+	case part == ":domain":
+		return address[i+1:]
+	}
+	return address
+}
+
+// addressValues returns the part of each address in a header
+func addressValues(headers mail.Header, name, part string) []string {
+	var values []string
+	for _, v := range headers[textproto.CanonicalMIMEHeaderKey(name)] {
+		addrs, err := mail.ParseAddressList(v)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			values = append(values, addressPart(addr.Address, part))
+		}
+	}
+	return values
+}
+
+// sieveMessage is what a Sieve script tests, the message's headers and its envelope
+// from is the envelope sender, "" for bounces, and to is the recipient.
+type sieveMessage struct {
+	headers mail.Header
+	from    string
+	to      string
+}
+
+// values returns the values the test compares with its keys
+func (t *sieveTest) values(msg *sieveMessage, name string) []string {
+	switch t.name {
+	case "address":
+		return addressValues(msg.headers, name, t.part)
+	case "envelope":
+		address := msg.from
+		if name == "to" {
+			address = msg.to
+		}
+		// The null sender only matches an empty key
+		if address == "" {
+			return []string{""}
+		}
+		return []string{addressPart(address, t.part)}
+	}
+	return headerValues(msg.headers, name)
+}
+
+// eval returns the result of the test on the message
+func (t *sieveTest) eval(msg *sieveMessage) bool {
+	switch t.name {
+	case "true":
+		return true
+	case "not":
+		return !t.tests[0].eval(msg)
+	case "anyof", "allof":
+		for _, inner := range t.tests {
+			if inner.eval(msg) == (t.name == "anyof") {
+				return t.name == "anyof"
+			}
+		}
+		return t.name == "allof"
+	case "exists":
+		for _, name := range t.headers {
+			if len(msg.headers[textproto.CanonicalMIMEHeaderKey(name)]) == 0 {
+				return false
+			}
+		}
+		return true
+	case "header", "address", "envelope":
+		for _, name := range t.headers {
+			for _, value := range t.values(msg, name) {
+				for _, key := range t.keys {
+					if sieveMatch(t.match, value, key) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// sieveResult collects the actions taken by a script
+type sieveResult struct {
+	folders  []string // folders to file the message into, "" for the inbox
+	canceled bool     // fileinto or discard cancels the implicit keep
+	depth    int      // number of includes being run
+}
+
+// file adds a folder to the result, once
+func (r *sieveResult) file(folder string) {
+	for _, f := range r.folders {
+		if f == folder {
+			return
+		}
+	}
+	r.folders = append(r.folders, folder)
+}
+
+// run runs the commands, returning false if the script stopped
+func (r *sieveResult) run(commands []sieveCommand, msg *sieveMessage) bool {
+	for _, cmd := range commands {
+		switch cmd.action {
+		case "keep":
+			r.file("")
+		case "fileinto":
+			r.file(cmd.folder)
+			r.canceled = true
+		case "discard":
+			r.canceled = true
+		case "stop":
+			return false
+		case "include":
+			if r.depth >= maxSieveIncludes {
+				log.Printf("Not including %s, scripts are nested too deeply", cmd.script)
+				continue
+			}
+			included, err := globalSieveScript(cmd.script)
+			if err != nil {
+				if !cmd.optional || !os.IsNotExist(err) {
+					log.Printf("Error including %s: %s", cmd.script, err)
+				}
+				continue
+			}
+			r.depth++
+			more := r.run(included, msg)
+			r.depth--
+			if !more {
+				return false
+			}
+		case "if":
+			for _, b := range cmd.branches {
+				if b.test == nil || b.test.eval(msg) {
+					if !r.run(b.block, msg) {
+						return false
+					}
+					break
+				}
+			}
+		}
+	}
+	return true
+}
+
+// sieveFolders runs the script on the message and returns the folders to deliver it to
+// "" is the inbox, and no folders means the message was discarded.
+func sieveFolders(commands []sieveCommand, msg *sieveMessage) []string {
+	var r sieveResult
+	r.run(commands, msg)
+	if !r.canceled {
+		r.file("")
+	}
+	return r.folders
+}
+
+// userFilter returns the user's filter, or their domain's if they don't have one
+// It returns nil if there is neither.
+func userFilter(user string, inbox maildir.Dir) ([]sieveCommand, error) {
+	data, err := ioutil.ReadFile(path.Join(string(inbox), sieveFile))
+	if os.IsNotExist(err) {
+		if script := domainScript(user); script != "" {
+			return globalSieveScript(script)
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseSieve(string(data))
+}
+
+// filterDirs returns the maildirs to deliver a message for the user's inbox to
+// The user's filter file, or their domain's default filter, decides which
+// folders it goes to. Without a filter, or if the filter can't be read or a
+// folder can't be created, it goes to the inbox.
+func filterDirs(user string, inbox maildir.Dir, msg *sieveMessage) []maildir.Dir {
+	commands, err := userFilter(user, inbox)
+	if err != nil {
+		log.Printf("Error in filter for %s, delivering to the inbox: %s", user, err)
+		return []maildir.Dir{inbox}
+	}
+	if commands == nil {
+		return []maildir.Dir{inbox}
+	}
+	dirs := []maildir.Dir{}
+	for _, folder := range sieveFolders(commands, msg) {
+		if folder == "" {
+			dirs = append(dirs, inbox)
+			continue
+		}
+		dir, err := maildirFolder(user, folder)
+		if err != nil {
+			log.Printf("Error creating %s folder for %s, delivering to the inbox: %s", folder, user, err)
+			dir = inbox
+		}
+		dirs = append(dirs, dir)
+	}
+	if len(dirs) == 0 {
+		logDebugf("Filter for %s discarded the message", user)
+	}
+	return dirs
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testSieve sorts cron mail, alerts, and device notifications
+const testSieve = `require ["fileinto"];
+# Cron mail
+if header :contains "subject" "Cron <" {
+	fileinto "Cron";
+	stop;
+}
+/* Monitoring */
+if anyof (address :domain "from" "nagios.example.com",
+          header :matches "subject" "*ALERT*") {
+	fileinto "Alerts/Urgent";
+} elsif address :localpart "from" ["printer", "nas"] {
+	fileinto "Devices";
+} elsif not exists "list-id" {
+	keep;
+} else {
+	discard;
+}
+if header :is "x-copy" "yes" {
+	keep;
+}
+`
+
+func TestSieveFolders(t *testing.T) {
+	commands, err := parseSieve(testSieve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		headers mail.Header
+		folders []string
+	}{
+		{mail.Header{"Subject": {"Cron <root@host> backup"}, "X-Copy": {"yes"}}, []string{"Cron"}},
+		{mail.Header{"From": {"Nagios <alerts@Nagios.Example.com>"}}, []string{"Alerts.Urgent"}},
+		{mail.Header{"Subject": {"=?utf-8?q?disk_ALERT_on_nas?="}}, []string{"Alerts.Urgent"}},
+		{mail.Header{"From": {"printer@home.lan"}}, []string{"Devices"}},
+		{mail.Header{"From": {"printer@home.lan"}, "X-Copy": {"YES"}}, []string{"Devices", ""}},
+		{mail.Header{"From": {"friend@example.com"}}, []string{""}},
+		{mail.Header{"From": {"list@example.com"}, "List-Id": {"<list.example.com>"}}, nil},
+		{mail.Header{"List-Id": {"<list.example.com>"}, "X-Copy": {"yes"}}, []string{""}},
+	}
+	for _, tt := range tests {
+		if folders := sieveFolders(commands, &sieveMessage{headers: tt.headers}); !reflect.DeepEqual(folders, tt.folders) {
+			t.Errorf("sieveFolders(%v) = %q, expected %q", tt.headers, folders, tt.folders)
+		}
+	}
+
+	for _, bad := range []string{
+		`fileinto "Junk"`,
+		`fileinto "../Junk";`,
+		`redirect "a@b.com";`,
+		`require "vacation";`,
+		`if header :regex "subject" "x" { stop; }`,
+		`if header "subject" { stop; }`,
+		`if size :over 100K { stop; }`,
+		`if envelope "auth" "bcl" { stop; }`,
+		`if header :domain "from" "x" { stop; }`,
+		`if true { stop;`,
+		`keep; "subject`,
+		`/* keep;`,
+	} {
+		if _, err := parseSieve(bad); err == nil {
+			t.Errorf("parseSieve(%q) accepted", bad)
+		}
+	}
+}
+
+func TestSieveEnvelope(t *testing.T) {
+	commands, err := parseSieve(`require ["envelope", "fileinto"];
+if envelope :is "from" "" {
+	fileinto "Bounces";
+} elsif envelope :domain "From" "cron.example.com" {
+	fileinto "Cron";
+} elsif envelope :localpart :matches "to" "*-alerts" {
+	fileinto "Alerts";
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The From header is forged, only the envelope is used
+	headers := mail.Header{"From": {"Friendly <friend@example.com>"}}
+	tests := []struct {
+		from    string
+		to      string
+		folders []string
+	}{
+		{"", "bcl@domain.com", []string{"Bounces"}},
+		{"root@CRON.example.com", "bcl@domain.com", []string{"Cron"}},
+		{"friend@example.com", "bcl-alerts@domain.com", []string{"Alerts"}},
+		{"friend@example.com", "bcl@domain.com", []string{""}},
+	}
+	for _, tt := range tests {
+		msg := &sieveMessage{headers, tt.from, tt.to}
+		if folders := sieveFolders(commands, msg); !reflect.DeepEqual(folders, tt.folders) {
+			t.Errorf("sieveFolders(%q, %q) = %q, expected %q", tt.from, tt.to, folders, tt.folders)
+		}
+	}
+}
+
+func TestSieveInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { cfg = config.Config{} }()
+	cfg.Filters.GlobalDir = dir
+	scripts := map[string]string{
+		"lists": `require "fileinto"; if exists "list-id" { fileinto "Lists"; stop; }`,
+		"loop":  `require "include"; include :global "loop";`,
+	}
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".sieve"), []byte(script), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commands, err := parseSieve(`require ["include", "fileinto"];
+include :global "lists";
+include :optional :global "missing";
+include :global "loop";
+fileinto "Other";`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		headers mail.Header
+		folders []string
+	}{
+		{mail.Header{"List-Id": {"<list.example.com>"}}, []string{"Lists"}},
+		{mail.Header{"Subject": {"hello"}}, []string{"Other"}},
+	}
+	for _, tt := range tests {
+		if folders := sieveFolders(commands, &sieveMessage{headers: tt.headers}); !reflect.DeepEqual(folders, tt.folders) {
+			t.Errorf("sieveFolders(%v) = %q, expected %q", tt.headers, folders, tt.folders)
+		}
+	}
+
+	for _, bad := range []string{
+		`include "lists";`,
+		`include :personal "lists";`,
+		`include :global "../lists";`,
+		`include :global;`,
+	} {
+		if _, err := parseSieve(bad); err == nil {
+			t.Errorf("parseSieve(%q) accepted", bad)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		match   bool
+	}{
+		{"*", "", true},
+		{"a*c", "abbbc", true},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"*alert*", "disk alert on nas", true},
+		{"*alert", "alert on nas", false},
+		{`\*x`, "*x", true},
+		{`\*x`, "ax", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.value); got != tt.match {
+			t.Errorf("globMatch(%q, %q) = %v", tt.pattern, tt.value, got)
+		}
+	}
+}
+
+func TestSieveMail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	parseHosts()
+	if err := os.MkdirAll(filepath.Join(dir, "bcl"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bcl", sieveFile), []byte(testSieve), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+
+	messages := []string{
+		"Subject: Cron <root@host> backup\r\n\r\nDone\r\n",
+		"From: printer@home.lan\r\nX-Copy: yes\r\nSubject: toner\r\n\r\nLow\r\n",
+		"List-Id: <list.example.com>\r\nSubject: news\r\n\r\nDiscarded\r\n",
+		"Subject: hello\r\n\r\nHi\r\n",
+	}
+	for _, msg := range messages {
+		if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com"}, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string][]string{
+		"new":          {"Subject: toner", "Subject: hello"},
+		".Cron/new":    {"Subject: Cron"},
+		".Devices/new": {"Subject: toner"},
+	}
+	for folder, subjects := range expected {
+		files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", folder))
+		if len(files) != len(subjects) {
+			t.Errorf("%d messages in %s, expected %d", len(files), folder, len(subjects))
+			continue
+		}
+		var all string
+		for _, f := range files {
+			data, _ := ioutil.ReadFile(filepath.Join(dir, "bcl", folder, f.Name()))
+			all += string(data)
+		}
+		for _, subject := range subjects {
+			if !strings.Contains(all, subject) {
+				t.Errorf("%s missing from %s", subject, folder)
+			}
+		}
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "tmp")); len(files) != 0 {
+		t.Errorf("%d messages left in tmp", len(files))
+	}
+
+	// A broken filter delivers to the inbox
+	if err := ioutil.WriteFile(filepath.Join(dir, "bcl", sieveFile), []byte("fileinto"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com"}, []byte(messages[0])); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new")); len(files) != 3 {
+		t.Errorf("%d messages in the inbox, expected 3", len(files))
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals waits for signals and acts on them
+/*
+   SIGHUP reloads the hosts, exempt hosts, emails, and groups from the config file, the TLS
+   certificate, and the aliases file
+
+   SIGTERM and SIGINT stop accepting mail, wait up to drain_timeout for the
+   messages being received to finish, and exit
+
+   SIGUSR1 reopens the log file, so that logrotate can rotate it
+
+   SIGUSR2 starts a new letterbox from the binary on disk and hands it the
+   listening sockets, then drains and exits once the new one is listening
+*/
+func handleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range ch {
+		switch sig {
+		case syscall.SIGHUP:
+			reloadConfig()
+			reloadCerts()
+			reloadAliases()
+		case syscall.SIGTERM, syscall.SIGINT:
+			notifyStopping()
+			shutdown(drainTimeout())
+			log.Println("letterbox: exiting")
+			os.Exit(0)
+		case syscall.SIGUSR1:
+			reopenLogFile()
+		case syscall.SIGUSR2:
+			if err := upgrade(); err != nil {
+				log.Printf("Error upgrading: %s", err)
+			}
+		}
+	}
+}
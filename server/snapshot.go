@@ -0,0 +1,222 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotDir is the directory under the maildirs that holds the snapshots
+// It is on the same filesystem as the maildirs so that messages can be hardlinked.
+const snapshotDir = ".snapshots"
+
+// snapshotManifest lists the messages in a snapshot
+type snapshotManifest struct {
+	User     string    `json:"user"`
+	Created  time.Time `json:"created"`
+	Messages []string  `json:"messages"` // paths relative to the user's maildir
+}
+
+// messageKey returns the unique part of a maildir filename, without the flags
+func messageKey(name string) string {
+	if i := strings.Index(name, ":"); i != -1 {
+		return name[:i]
+	}
+	return name
+}
+
+// linkOrCopy hardlinks src to dst, copying it if they are on different filesystems
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// userMessages returns the paths of the messages in the user's maildir, and its folders,
+// relative to the maildir. Messages still being delivered to tmp/ are skipped.
+func userMessages(userDir string) ([]string, error) {
+	var messages []string
+	err := walkMessages(userDir, func(path string) error {
+		rel, err := filepath.Rel(userDir, path)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, rel)
+		return nil
+	})
+	return messages, err
+}
+
+// createSnapshot hardlinks all of the messages in the user's maildir, userDir, into a new snapshot under root and returns its id
+func createSnapshot(root, userDir, user string, now time.Time) (string, error) {
+	if _, err := os.Stat(userDir); err != nil {
+		return "", err
+	}
+	messages, err := userMessages(userDir)
+	if err != nil {
+		return "", err
+	}
+
+	id := now.UTC().Format("20060102T150405Z")
+	dir := filepath.Join(root, snapshotDir, user, id)
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", err
+	}
+	for _, m := range messages {
+		dst := filepath.Join(dir, m)
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return "", err
+		}
+		if err := linkOrCopy(filepath.Join(userDir, m), dst); err != nil {
+			return "", err
+		}
+	}
+
+	manifest := snapshotManifest{User: user, Created: now, Messages: messages}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return id, ioutil.WriteFile(filepath.Join(dir, "manifest.json"), data, 0600)
+}
+
+// readManifest reads the manifest of one of the user's snapshots
+func readManifest(root, user, id string) (snapshotManifest, error) {
+	var manifest snapshotManifest
+	data, err := ioutil.ReadFile(filepath.Join(root, snapshotDir, user, filepath.Base(id), "manifest.json"))
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(data, &manifest)
+	return manifest, err
+}
+
+// listSnapshots returns the ids of the user's snapshots, oldest first
+func listSnapshots(root, user string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(root, snapshotDir, user))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(root, snapshotDir, user, e.Name(), "manifest.json")); err == nil {
+			ids = append(ids, e.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// restoreSnapshot puts back the messages from the snapshot that are missing from the maildir
+// Messages that are still in the maildir are left alone, even if their flags
+// have changed, and messages delivered since the snapshot are kept. It returns
+// the number of messages restored.
+func restoreSnapshot(root, userDir, user, id string) (int, error) {
+	manifest, err := readManifest(root, user, id)
+	if err != nil {
+		return 0, err
+	}
+	current, err := userMessages(userDir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	// Messages move between new/ and cur/ and change flags, so match on the folder and key
+	existing := make(map[string]bool)
+	for _, m := range current {
+		existing[filepath.Join(filepath.Dir(filepath.Dir(m)), messageKey(filepath.Base(m)))] = true
+	}
+
+	restored := 0
+	snapDir := filepath.Join(root, snapshotDir, user, filepath.Base(id))
+	for _, m := range manifest.Messages {
+		if existing[filepath.Join(filepath.Dir(filepath.Dir(m)), messageKey(filepath.Base(m)))] {
+			continue
+		}
+		dst := filepath.Join(userDir, m)
+		for _, sub := range []string{"tmp", "new", "cur"} {
+			if err := os.MkdirAll(filepath.Join(filepath.Dir(filepath.Dir(dst)), sub), 0700); err != nil {
+				return restored, err
+			}
+		}
+		if err := linkOrCopy(filepath.Join(snapDir, m), dst); err != nil {
+			return restored, err
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+// snapshotCommand creates, lists, and restores snapshots of a user's maildir
+/*
+   letterbox snapshot create <user>
+   letterbox snapshot list <user>
+   letterbox snapshot restore <user> <id>
+*/
+func snapshotCommand(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: snapshot create|list|restore <user> [id]")
+	}
+	if err := loadCommandConfig(); err != nil {
+		return err
+	}
+	user := filepath.Base(filepath.Clean(args[1]))
+	userDir, err := maildirPath(user)
+	if err != nil {
+		return err
+	}
+	switch {
+	case args[0] == "create" && len(args) == 2:
+		id, err := createSnapshot(cmdline.Maildirs, userDir, user, time.Now())
+		if err != nil {
+			return err
+		}
+		fmt.Println(id)
+	case args[0] == "list" && len(args) == 2:
+		ids, err := listSnapshots(cmdline.Maildirs, user)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			manifest, err := readManifest(cmdline.Maildirs, user, id)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\t%d messages\n", id, len(manifest.Messages))
+		}
+	case args[0] == "restore" && len(args) == 3:
+		n, err := restoreSnapshot(cmdline.Maildirs, userDir, user, args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored %d messages\n", n)
+	default:
+		return fmt.Errorf("usage: snapshot create|list|restore <user> [id]")
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeTestMessage writes a message file to the maildir, creating the directories
+func writeTestMessage(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	root, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	userDir := filepath.Join(root, "bcl")
+	writeTestMessage(t, filepath.Join(userDir, "new", "1000.1.host"), "one")
+	writeTestMessage(t, filepath.Join(userDir, "cur", "1001.1.host:2,S"), "two")
+	writeTestMessage(t, filepath.Join(userDir, ".Cron", "cur", "1002.1.host:2,"), "three")
+	writeTestMessage(t, filepath.Join(userDir, "tmp", "1003.1.host"), "partial")
+
+	id, err := createSnapshot(root, userDir, "bcl", time.Date(2020, 9, 4, 10, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %s", err)
+	}
+	if id != "20200904T100000Z" {
+		t.Errorf("Wrong snapshot id: %s", id)
+	}
+	ids, err := listSnapshots(root, "bcl")
+	if err != nil || !reflect.DeepEqual(ids, []string{id}) {
+		t.Fatalf("Wrong snapshot list: %v %v", ids, err)
+	}
+	manifest, err := readManifest(root, "bcl", id)
+	if err != nil || len(manifest.Messages) != 3 {
+		t.Fatalf("Wrong manifest: %#v %v", manifest, err)
+	}
+
+	// Snapshots are not searched as maildirs
+	count := 0
+	walkMessages(root, func(string) error { count++; return nil })
+	if count != 3 {
+		t.Errorf("Wrong number of messages in the maildirs: %d", count)
+	}
+
+	// Client reads one message, deletes the others, and a new one arrives
+	os.Rename(filepath.Join(userDir, "new", "1000.1.host"), filepath.Join(userDir, "cur", "1000.1.host:2,S"))
+	os.Remove(filepath.Join(userDir, "cur", "1001.1.host:2,S"))
+	os.RemoveAll(filepath.Join(userDir, ".Cron"))
+	writeTestMessage(t, filepath.Join(userDir, "new", "1004.1.host"), "four")
+
+	n, err := restoreSnapshot(root, userDir, "bcl", id)
+	if err != nil {
+		t.Fatalf("Error restoring snapshot: %s", err)
+	}
+	if n != 2 {
+		t.Errorf("Wrong number of messages restored: %d", n)
+	}
+	messages, _ := userMessages(userDir)
+	expected := []string{".Cron/cur/1002.1.host:2,", "cur/1000.1.host:2,S", "cur/1001.1.host:2,S", "new/1004.1.host"}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Wrong messages after restore: %v", messages)
+	}
+	if _, err := os.Stat(filepath.Join(userDir, ".Cron", "tmp")); err != nil {
+		t.Errorf("Restored folder is missing tmp: %s", err)
+	}
+}
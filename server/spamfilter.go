@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/bcl/letterbox/smtpd"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSpamFilterTimeout is used when the spam_filter timeout isn't set
+const defaultSpamFilterTimeout = 30 * time.Second
+
+// defaultGreylistDelay is used when the spam_filter greylist_delay isn't set
+const defaultGreylistDelay = 5 * time.Minute
+
+// greylistExpiry is how long a greylisted sender has to try again after the delay
+const greylistExpiry = 24 * time.Hour
+
+// spamFilterEnabled returns true if messages are checked by rspamd or spamd
+func spamFilterEnabled() bool {
+	return cfg.SpamFilter.Address != ""
+}
+
+// spamFilterType returns rspamd or spamd
+func spamFilterType() string {
+	if cfg.SpamFilter.Type == "" {
+		return "rspamd"
+	}
+	return strings.ToLower(cfg.SpamFilter.Type)
+}
+
+// spamFilterOnError returns what to do with messages that the filter couldn't check
+func spamFilterOnError() string {
+	if cfg.SpamFilter.OnError == "" {
+		return "defer"
+	}
+	return strings.ToLower(cfg.SpamFilter.OnError)
+}
+
+// spamFolder returns the folder that junk is delivered to
+func spamFolder() string {
+	if cfg.SpamFilter.Folder == "" {
+		return "Junk"
+	}
+	return cfg.SpamFilter.Folder
+}
+
+// checkSpamFilter checks the [spam_filter] config
+/*
+   Example TOML:
+
+   [spam_filter]
+   type = "rspamd"
+   address = "http://127.0.0.1:11333"
+   header_score = 5.0
+   junk_score = 6.0
+   greylist_score = 8.0
+   reject_score = 15.0
+   greylist_delay = "5m"
+   folder = "Junk"
+   on_error = "accept"
+   timeout = "30s"
+
+   Each message is checked before it is accepted and gets an X-Spam-Status
+   header with its score. At header_score it also gets X-Spam-Flag: YES, at
+   junk_score it is delivered to the recipients' Junk folders, at
+   greylist_score the first try from the client, sender, and recipients is
+   deferred for greylist_delay, and at reject_score it is rejected. spamd is
+   spamassassin's daemon, its address is host:port or a Unix socket path. If the
+   filter can't be reached, "defer" asks the sender to try again later and
+   "accept" delivers the message unchecked.
+*/
+func checkSpamFilter() error {
+	if !spamFilterEnabled() {
+		return nil
+	}
+	switch spamFilterType() {
+	case "rspamd":
+		if !strings.HasPrefix(cfg.SpamFilter.Address, "http://") && !strings.HasPrefix(cfg.SpamFilter.Address, "https://") {
+			return fmt.Errorf("rspamd address must be a http:// or https:// URL: %s", cfg.SpamFilter.Address)
+		}
+	case "spamd":
+	default:
+		return fmt.Errorf("unknown spam_filter type: %s", cfg.SpamFilter.Type)
+	}
+	if !folderRE.MatchString(spamFolder()) {
+		return fmt.Errorf("bad spam_filter folder name: %s", cfg.SpamFilter.Folder)
+	}
+	switch spamFilterOnError() {
+	case "defer", "accept":
+		return nil
+	}
+	return fmt.Errorf("unknown spam_filter on_error setting: %s", cfg.SpamFilter.OnError)
+}
+
+// spamFilterTimeout returns how long the filter can take
+func spamFilterTimeout() time.Duration {
+	if cfg.SpamFilter.Timeout.Duration == 0 {
+		return defaultSpamFilterTimeout
+	}
+	return cfg.SpamFilter.Timeout.Duration
+}
+
+// rspamdReply is the part of rspamd's /checkv2 reply that letterbox uses
+type rspamdReply struct {
+	Score float64 `json:"score"`
+}
+
+// rspamdCheck sends the message to rspamd's /checkv2 and returns its score
+// The envelope and client details are sent as headers, so rspamd doesn't
+// have to find them in the Received header.
+func (e *env) rspamdCheck(msg []byte) (float64, error) {
+	url := strings.TrimSuffix(cfg.SpamFilter.Address, "/") + "/checkv2"
+	req, err := http.NewRequest("POST", url, bytes.NewReader(msg))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("IP", e.clientIP.String())
+	req.Header.Set("Helo", e.conn.helo)
+	req.Header.Set("From", e.from)
+	for _, rcpt := range e.rcpts {
+		req.Header.Add("Rcpt", rcpt.Email())
+	}
+	if e.conn.authUser != "" {
+		req.Header.Set("User", e.conn.authUser)
+	}
+	client := &http.Client{Timeout: spamFilterTimeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("rspamd: %s", resp.Status)
+	}
+	var reply rspamdReply
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return 0, fmt.Errorf("rspamd: %s", err)
+	}
+	return reply.Score, nil
+}
+
+// spamdNetwork returns the network to dial for the spamd address
+func spamdNetwork(address string) string {
+	if strings.HasPrefix(address, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// spamdCheck sends the message to spamd with CHECK and returns its score
+func spamdCheck(msg []byte) (float64, error) {
+	timeout := spamFilterTimeout()
+	conn, err := net.DialTimeout(spamdNetwork(cfg.SpamFilter.Address), cfg.SpamFilter.Address, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := fmt.Fprintf(conn, "CHECK SPAMC/1.5\r\nContent-length: %d\r\n\r\n", len(msg)); err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return 0, err
+	}
+	r := textproto.NewReader(bufio.NewReader(io.LimitReader(conn, 64*1024)))
+	status, err := r.ReadLine()
+	if err != nil {
+		return 0, err
+	}
+	if f := strings.Fields(status); len(f) < 3 || !strings.HasPrefix(f[0], "SPAMD/") || f[1] != "0" {
+		return 0, fmt.Errorf("spamd: %s", status)
+	}
+	header, err := r.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	return parseSpamdHeader(header.Get("Spam"))
+}
+
+// parseSpamdHeader returns the score from spamd's Spam header, like "True ; 15.2 / 5.0"
+func parseSpamdHeader(value string) (float64, error) {
+	parts := strings.Split(value, ";")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("spamd: bad Spam header %q", value)
+	}
+	score := strings.TrimSpace(strings.SplitN(parts[1], "/", 2)[0])
+	f, err := strconv.ParseFloat(score, 64)
+	if err != nil {
+		return 0, fmt.Errorf("spamd: bad score %q", score)
+	}
+	return f, nil
+}
+
+// spamLevel returns true if the score has reached the threshold, which is disabled when it is 0
+func spamLevel(score, threshold float64) bool {
+	return threshold > 0 && score >= threshold
+}
+
+// spamCheck checks the message with rspamd or spamd, returning the spam headers to add
+// A message that can't be checked is deferred, or with on_error = "accept"
+// delivered with an unchecked X-Spam-Status. Messages over the greylist or
+// reject scores return an error, and e.junk is set for messages over the
+// junk score.
+func (e *env) spamCheck(now time.Time) ([]byte, error) {
+	var score float64
+	var err error
+	if spamFilterType() == "spamd" {
+		score, err = spamdCheck(e.traced())
+	} else {
+		score, err = e.rspamdCheck(e.data.Bytes())
+	}
+	if err != nil {
+		e.conn.logf("Error checking message with %s: %s", spamFilterType(), err)
+		if spamFilterOnError() == "accept" {
+			return foldHeader("X-Spam-Status", fmt.Sprintf("Unchecked (%s unavailable)", spamFilterType())), nil
+		}
+		return nil, smtpd.SMTPError("451 4.3.0 Error: message could not be checked for spam")
+	}
+	logDebugf("%s scored the message %.2f", spamFilterType(), score)
+	if spamLevel(score, cfg.SpamFilter.RejectScore) {
+		return nil, errSpam
+	}
+	if spamLevel(score, cfg.SpamFilter.GreylistScore) && greylist.tryLater(e.greylistKey(), now) {
+		return nil, errGreylisted
+	}
+	e.junk = spamLevel(score, cfg.SpamFilter.JunkScore)
+	if spamLevel(score, cfg.SpamFilter.HeaderScore) {
+		return append(foldHeader("X-Spam-Flag", "YES"), foldHeader("X-Spam-Status", fmt.Sprintf("Yes, score=%.2f", score))...), nil
+	}
+	return foldHeader("X-Spam-Status", fmt.Sprintf("No, score=%.2f", score)), nil
+}
+
+// errGreylisted is returned the first time a spammy message is sent
+var errGreylisted = smtpd.SMTPError("451 4.7.1 Error: greylisted, please try again later")
+
+// greylistKey returns the client IP, sender, and recipients of the message
+func (e *env) greylistKey() string {
+	rcpts := make([]string, len(e.rcpts))
+	for i, rcpt := range e.rcpts {
+		rcpts[i] = strings.ToLower(rcpt.Email())
+	}
+	sort.Strings(rcpts)
+	return e.clientIP.String() + " " + strings.ToLower(e.from) + " " + strings.Join(rcpts, ",")
+}
+
+// greylistCache remembers when each greylisted message was first tried
+type greylistCache struct {
+	sync.Mutex
+	first map[string]time.Time
+}
+
+var greylist = &greylistCache{first: make(map[string]time.Time)}
+
+// tryLater returns true if the message should be tried again later
+// The first try is deferred, and so are tries before the greylist_delay has
+// passed. A message that isn't tried again within a day starts over.
+func (g *greylistCache) tryLater(key string, now time.Time) bool {
+	delay := cfg.SpamFilter.GreylistDelay.Duration
+	if delay == 0 {
+		delay = defaultGreylistDelay
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	for k, first := range g.first {
+		if now.Sub(first) > delay+greylistExpiry {
+			delete(g.first, k)
+		}
+	}
+	first, ok := g.first[key]
+	if !ok {
+		g.first[key] = now
+		return true
+	}
+	return now.Sub(first) < delay
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSpamScore scores messages by the word in their body
+func testSpamScore(msg string) float64 {
+	for word, score := range map[string]float64{"viagra": 20, "lottery": 9, "offer": 7, "sale": 5.5} {
+		if strings.Contains(msg, word) {
+			return score
+		}
+	}
+	return 0.5
+}
+
+// startFakeSpamd serves CHECK on ln, scoring messages with testSpamScore
+func startFakeSpamd(ln net.Listener) {
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := textproto.NewReader(bufio.NewReader(c))
+				if line, err := r.ReadLine(); err != nil || line != "CHECK SPAMC/1.5" {
+					c.Write([]byte("SPAMD/1.1 76 Bad header line\r\n"))
+					return
+				}
+				header, err := r.ReadMIMEHeader()
+				if err != nil {
+					return
+				}
+				size, _ := strconv.Atoi(header.Get("Content-Length"))
+				msg := make([]byte, size)
+				if _, err := io.ReadFull(r.R, msg); err != nil {
+					return
+				}
+				score := testSpamScore(string(msg))
+				fmt.Fprintf(c, "SPAMD/1.1 0 EX_OK\r\nSpam: %v ; %.1f / 5.0\r\n\r\n", score >= 5, score)
+			}(c)
+		}
+	}()
+}
+
+func TestParseSpamdHeader(t *testing.T) {
+	if score, err := parseSpamdHeader("True ; 15.2 / 5.0"); score != 15.2 || err != nil {
+		t.Errorf("True = %v, %v", score, err)
+	}
+	if score, err := parseSpamdHeader("False ; -1.5 / 5.0"); score != -1.5 || err != nil {
+		t.Errorf("False = %v, %v", score, err)
+	}
+	for _, bad := range []string{"", "True", "True ; lots / 5.0"} {
+		if _, err := parseSpamdHeader(bad); err == nil {
+			t.Errorf("parseSpamdHeader(%q) accepted", bad)
+		}
+	}
+}
+
+func TestCheckSpamFilter(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	for _, c := range []config.SpamFilter{
+		{Address: "127.0.0.1:11333"},
+		{Address: "http://127.0.0.1:11333", Type: "bogofilter"},
+		{Address: "http://127.0.0.1:11333", Folder: "../Junk"},
+		{Address: "/run/spamd.sock", Type: "spamd", OnError: "tag"},
+	} {
+		cfg.SpamFilter = c
+		if err := checkSpamFilter(); err == nil {
+			t.Errorf("Bad spam_filter config accepted: %#v", c)
+		}
+	}
+	cfg.SpamFilter = config.SpamFilter{Address: "/run/spamd.sock", Type: "spamd", OnError: "accept", Folder: "Spam"}
+	if err := checkSpamFilter(); err != nil {
+		t.Errorf("Good spam_filter config refused: %s", err)
+	}
+}
+
+func TestGreylist(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	cfg.SpamFilter.GreylistDelay = config.Duration{Duration: 5 * time.Minute}
+	g := &greylistCache{first: make(map[string]time.Time)}
+	now := time.Now()
+	tests := []struct {
+		key   string
+		after time.Duration
+		later bool
+	}{
+		{"a", 0, true},
+		{"a", time.Minute, true},
+		{"b", time.Minute, true},
+		{"a", 6 * time.Minute, false},
+		{"a", 7 * time.Minute, false},
+		{"a", 30 * time.Hour, true},
+	}
+	for _, tt := range tests {
+		if got := g.tryLater(tt.key, now.Add(tt.after)); got != tt.later {
+			t.Errorf("tryLater(%q) after %s = %v", tt.key, tt.after, got)
+		}
+	}
+}
+
+func TestSpamFiltering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+		greylist = &greylistCache{first: make(map[string]time.Time)}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	parseHosts()
+
+	var rcpts []string
+	rspamd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/checkv2" || r.Header.Get("IP") != "127.0.0.1" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		rcpts = r.Header["Rcpt"]
+		msg, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, `{"action": "no action", "score": %.1f, "required_score": 15}`, testSpamScore(string(msg)))
+	}))
+	defer rspamd.Close()
+	spamd, err := net.Listen("unix", filepath.Join(dir, "spamd.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spamd.Close()
+	startFakeSpamd(spamd)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	send := func(body string) error {
+		return smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", []string{"bcl@domain.com"}, []byte("Subject: test\r\n\r\n"+body+"\r\n"))
+	}
+	// folder returns the messages delivered to the maildir folder, joined together
+	folder := func(name string) (int, string) {
+		files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", name, "new"))
+		var all string
+		for _, f := range files {
+			data, _ := ioutil.ReadFile(filepath.Join(dir, "bcl", name, "new", f.Name()))
+			all += string(data)
+		}
+		return len(files), all
+	}
+
+	for _, filter := range []config.SpamFilter{
+		{Address: rspamd.URL},
+		{Address: spamd.Addr().String(), Type: "spamd"},
+	} {
+		os.RemoveAll(filepath.Join(dir, "bcl"))
+		greylist = &greylistCache{first: make(map[string]time.Time)}
+		cfg.SpamFilter = filter
+		cfg.SpamFilter.HeaderScore = 5
+		cfg.SpamFilter.JunkScore = 6
+		cfg.SpamFilter.GreylistScore = 8
+		cfg.SpamFilter.RejectScore = 15
+		cfg.SpamFilter.GreylistDelay = config.Duration{Duration: time.Millisecond}
+
+		if err := send("hello"); err != nil {
+			t.Fatalf("%s: ham refused: %s", filter.Type, err)
+		}
+		if err := send("sale"); err != nil {
+			t.Fatalf("%s: marked message refused: %s", filter.Type, err)
+		}
+		if err := send("offer"); err != nil {
+			t.Fatalf("%s: junk refused: %s", filter.Type, err)
+		}
+		if err := send("viagra"); err == nil || !strings.HasPrefix(err.Error(), "550") {
+			t.Errorf("%s: spam not rejected: %v", filter.Type, err)
+		}
+		if err := send("lottery"); err == nil || !strings.HasPrefix(err.Error(), "451") {
+			t.Errorf("%s: spam not greylisted: %v", filter.Type, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if err := send("lottery"); err != nil {
+			t.Errorf("%s: greylisted spam refused when it was tried again: %s", filter.Type, err)
+		}
+
+		if n, data := folder(""); n != 2 || !strings.Contains(data, "X-Spam-Status: No, score=0.50\r\n") ||
+			!strings.Contains(data, "X-Spam-Flag: YES\r\nX-Spam-Status: Yes, score=5.50\r\n") {
+			t.Errorf("%s: wrong inbox: %d %q", filter.Type, n, data)
+		}
+		if n, data := folder(".Junk"); n != 2 || !strings.Contains(data, "score=7.00") || !strings.Contains(data, "score=9.00") {
+			t.Errorf("%s: wrong junk folder: %d %q", filter.Type, n, data)
+		}
+	}
+	if len(rcpts) != 1 || rcpts[0] != "bcl@domain.com" {
+		t.Errorf("Wrong recipients sent to rspamd: %v", rcpts)
+	}
+
+	// Without the filter the message is deferred, or delivered unchecked with on_error = "accept"
+	os.RemoveAll(filepath.Join(dir, "bcl"))
+	cfg.SpamFilter = config.SpamFilter{Address: "http://127.0.0.1:1"}
+	if err := send("hello"); err == nil || !strings.HasPrefix(err.Error(), "451") {
+		t.Errorf("Unchecked message not deferred: %v", err)
+	}
+	cfg.SpamFilter.OnError = "accept"
+	if err := send("hello"); err != nil {
+		t.Fatalf("Unchecked message refused with on_error = accept: %s", err)
+	}
+	if n, data := folder(""); n != 1 || !strings.Contains(data, "X-Spam-Status: Unchecked (rspamd unavailable)\r\n") {
+		t.Errorf("Unchecked message not tagged: %d %q", n, data)
+	}
+}
@@ -0,0 +1,580 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// spfResult is the result of an SPF check, from RFC 7208
+type spfResult string
+
+const (
+	spfNone      spfResult = "none"
+	spfNeutral   spfResult = "neutral"
+	spfPass      spfResult = "pass"
+	spfFail      spfResult = "fail"
+	spfSoftfail  spfResult = "softfail"
+	spfTemperror spfResult = "temperror"
+	spfPermerror spfResult = "permerror"
+)
+
+// spfLookupLimit is the most DNS lookups that a check may make, from includes,
+// redirects, and the a, mx, ptr, and exists mechanisms
+const spfLookupLimit = 10
+
+// dnsTimeout is how long to wait for each DNS lookup
+const dnsTimeout = 10 * time.Second
+
+// dnsResolver looks up the DNS records needed to check SPF and DKIM
+// Names that don't exist return no records and no error, errors are for
+// lookups that failed and could succeed later.
+type dnsResolver interface {
+	LookupTXT(name string) ([]string, error)
+	LookupIP(name string) ([]net.IP, error)
+	LookupMX(name string) ([]*net.MX, error)
+}
+
+// netResolver is a dnsResolver that uses the system's resolver
+type netResolver struct{}
+
+// notFound returns nil if the error is because the name doesn't exist
+func notFound(err error) error {
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return nil
+	}
+	return err
+}
+
+func (netResolver) LookupTXT(name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	txts, err := net.DefaultResolver.LookupTXT(ctx, name)
+	return txts, notFound(err)
+}
+
+func (netResolver) LookupIP(name string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	var ips []net.IP
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, notFound(err)
+}
+
+func (netResolver) LookupMX(name string) ([]*net.MX, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	mxs, err := net.DefaultResolver.LookupMX(ctx, name)
+	return mxs, notFound(err)
+}
+
+// resolver is used for all of the DNS lookups, the tests replace it
+var resolver dnsResolver = netResolver{}
+
+// spfError stops a check with a temperror or permerror result
+type spfError struct {
+	result spfResult
+	msg    string
+}
+
+func (e *spfError) Error() string {
+	return string(e.result) + ": " + e.msg
+}
+
+// permError returns an error that makes the check's result permerror
+func permError(format string, args ...interface{}) error {
+	return &spfError{spfPermerror, fmt.Sprintf(format, args...)}
+}
+
+// tempError returns an error that makes the check's result temperror
+func tempError(err error) error {
+	return &spfError{spfTemperror, err.Error()}
+}
+
+// spfMode returns what to do with the SPF result
+/*
+   Example TOML:
+
+   spf = "mark"
+
+   "off" doesn't check SPF, and is the default. "mark" adds a Received-SPF
+   header to the message, and "reject" also refuses MAIL FROM with 550 when
+   the result is fail, and with 451 when the sender's DNS couldn't be checked.
+*/
+func spfMode() string {
+	if cfg.SPF == "" {
+		return "off"
+	}
+	return strings.ToLower(cfg.SPF)
+}
+
+// checkSPFMode checks the spf setting
+func checkSPFMode() error {
+	switch spfMode() {
+	case "off", "mark", "reject":
+		return nil
+	}
+	return fmt.Errorf("unknown spf setting: %s", cfg.SPF)
+}
+
+// spfSender returns the address SPF checks, postmaster@ the HELO name for bounces
+func spfSender(from, helo string) string {
+	if from == "" {
+		return "postmaster@" + helo
+	}
+	return from
+}
+
+// spfCheck is the state of one SPF check
+type spfCheck struct {
+	ip      net.IP
+	sender  string
+	helo    string
+	lookups int
+}
+
+// checkSPF checks whether the IP may send mail from the sender's domain
+func checkSPF(ip net.IP, from, helo string) spfResult {
+	sender := spfSender(from, helo)
+	domain := strings.ToLower(sender[strings.LastIndex(sender, "@")+1:])
+	if ip == nil || !validSPFDomain(domain) {
+		return spfNone
+	}
+	c := &spfCheck{ip: ip, sender: sender, helo: helo}
+	result, err := c.checkHost(domain)
+	if e, ok := err.(*spfError); ok {
+		logDebugf("SPF check of %s for %s: %s", domain, ip, e)
+		return e.result
+	}
+	return result
+}
+
+// validSPFDomain returns true if the domain is a fully qualified name that can have an SPF record
+func validSPFDomain(domain string) bool {
+	if len(domain) == 0 || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// countLookup counts a mechanism or modifier that needs a DNS lookup
+func (c *spfCheck) countLookup() error {
+	c.lookups++
+	if c.lookups > spfLookupLimit {
+		return permError("more than %d DNS lookups", spfLookupLimit)
+	}
+	return nil
+}
+
+// record returns the domain's SPF record, or "" if it doesn't have one
+func (c *spfCheck) record(domain string) (string, error) {
+	txts, err := resolver.LookupTXT(domain)
+	if err != nil {
+		return "", tempError(err)
+	}
+	var records []string
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+	if len(records) > 1 {
+		return "", permError("%s has %d SPF records", domain, len(records))
+	}
+	if len(records) == 0 {
+		return "", nil
+	}
+	return records[0], nil
+}
+
+// checkHost evaluates the domain's SPF record, the check_host() function of RFC 7208
+func (c *spfCheck) checkHost(domain string) (spfResult, error) {
+	record, err := c.record(domain)
+	if err != nil {
+		return "", err
+	}
+	if record == "" {
+		return spfNone, nil
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		// Modifiers are name=value, mechanisms can have = in their domain after a : or /
+		if i := strings.Index(term, "="); i != -1 && !strings.ContainsAny(term[:i], ":/") {
+			if strings.EqualFold(term[:i], "redirect") {
+				if redirect != "" {
+					return "", permError("%s has more than one redirect", domain)
+				}
+				redirect = term[i+1:]
+			}
+			// exp and unknown modifiers are ignored
+			continue
+		}
+
+		qualifier := spfPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = spfFail, term[1:]
+		case '~':
+			qualifier, term = spfSoftfail, term[1:]
+		case '?':
+			qualifier, term = spfNeutral, term[1:]
+		}
+		match, err := c.mechanism(domain, term)
+		if err != nil {
+			return "", err
+		}
+		if match {
+			return qualifier, nil
+		}
+	}
+
+	if redirect != "" {
+		if err := c.countLookup(); err != nil {
+			return "", err
+		}
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return "", err
+		}
+		result, err := c.checkHost(target)
+		if err == nil && result == spfNone {
+			return "", permError("redirect to %s, which has no SPF record", target)
+		}
+		return result, err
+	}
+	return spfNeutral, nil
+}
+
+// mechanism returns true if the client's IP matches the mechanism
+func (c *spfCheck) mechanism(domain, term string) (bool, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i != -1 {
+		name, arg = term[:i], term[i:]
+	}
+	switch strings.ToLower(name) {
+	case "all":
+		if arg != "" {
+			return false, permError("bad mechanism %q", term)
+		}
+		return true, nil
+
+	case "include":
+		if !strings.HasPrefix(arg, ":") {
+			return false, permError("bad mechanism %q", term)
+		}
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+		result, err := c.checkHost(target)
+		if err != nil {
+			if e, ok := err.(*spfError); ok && e.result == spfTemperror {
+				return false, err
+			}
+			return false, permError("include of %s: %s", target, err)
+		}
+		switch result {
+		case spfPass:
+			return true, nil
+		case spfNone:
+			return false, permError("include of %s, which has no SPF record", target)
+		}
+		return false, nil
+
+	case "a", "mx":
+		target, mask4, mask6, err := c.domainCIDR(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if strings.EqualFold(name, "mx") {
+			mxs, err := resolver.LookupMX(target)
+			if err != nil {
+				return false, tempError(err)
+			}
+			if len(mxs) > spfLookupLimit {
+				return false, permError("%s has more than %d MX records", target, spfLookupLimit)
+			}
+			hosts = nil
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			ips, err := resolver.LookupIP(host)
+			if err != nil {
+				return false, tempError(err)
+			}
+			for _, ip := range ips {
+				if c.ipMatches(ip, mask4, mask6) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, permError("bad mechanism %q", term)
+		}
+		network := arg[1:]
+		if !strings.Contains(network, "/") {
+			if strings.EqualFold(name, "ip4") {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		ip, ipnet, err := net.ParseCIDR(network)
+		if err != nil || (ip.To4() != nil) != strings.EqualFold(name, "ip4") {
+			return false, permError("bad mechanism %q", term)
+		}
+		return ipnet.Contains(c.ip), nil
+
+	case "exists":
+		if !strings.HasPrefix(arg, ":") {
+			return false, permError("bad mechanism %q", term)
+		}
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+		ips, err := resolver.LookupIP(target)
+		if err != nil {
+			return false, tempError(err)
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "ptr":
+		// RFC 7208 says not to use ptr, it is counted but never matches
+		return false, c.countLookup()
+	}
+	return false, permError("unknown mechanism %q", term)
+}
+
+// domainCIDR parses the optional :domain/cidr4//cidr6 argument of the a and mx mechanisms
+func (c *spfCheck) domainCIDR(arg, domain string) (string, int, int, error) {
+	mask4, mask6 := 32, 128
+	target := domain
+	if strings.HasPrefix(arg, ":") {
+		spec := arg[1:]
+		if i := strings.Index(spec, "/"); i != -1 {
+			spec, arg = spec[:i], spec[i:]
+		} else {
+			arg = ""
+		}
+		var err error
+		if target, err = c.expand(spec, domain); err != nil {
+			return "", 0, 0, err
+		}
+	}
+	if arg == "" {
+		return target, mask4, mask6, nil
+	}
+
+	cidr6 := ""
+	if i := strings.Index(arg, "//"); i != -1 {
+		arg, cidr6 = arg[:i], arg[i+2:]
+	}
+	var err error
+	if arg != "" {
+		if mask4, err = strconv.Atoi(strings.TrimPrefix(arg, "/")); err != nil || !strings.HasPrefix(arg, "/") || mask4 < 0 || mask4 > 32 {
+			return "", 0, 0, permError("bad ip4 cidr length %q", arg)
+		}
+	}
+	if cidr6 != "" {
+		if mask6, err = strconv.Atoi(cidr6); err != nil || mask6 < 0 || mask6 > 128 {
+			return "", 0, 0, permError("bad ip6 cidr length %q", cidr6)
+		}
+	}
+	return target, mask4, mask6, nil
+}
+
+// ipMatches returns true if ip, masked to the cidr length for its family, contains the client's IP
+func (c *spfCheck) ipMatches(ip net.IP, mask4, mask6 int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		if c.ip.To4() == nil {
+			return false
+		}
+		return (&net.IPNet{IP: ip4, Mask: net.CIDRMask(mask4, 32)}).Contains(c.ip)
+	}
+	if c.ip.To4() != nil {
+		return false
+	}
+	return (&net.IPNet{IP: ip, Mask: net.CIDRMask(mask6, 128)}).Contains(c.ip)
+}
+
+// expand expands the macros in a domain spec, like %{ir}.%{v}._spf.%{d2}
+func (c *spfCheck) expand(spec, domain string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		i++
+		if i == len(spec) {
+			return "", permError("bad macro in %q", spec)
+		}
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end == -1 {
+				return "", permError("bad macro in %q", spec)
+			}
+			value, err := c.macro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			return "", permError("bad macro in %q", spec)
+		}
+	}
+	return strings.TrimSuffix(b.String(), "."), nil
+}
+
+// macro returns the value of one macro, the part between %{ and }
+func (c *spfCheck) macro(m, domain string) (string, error) {
+	if m == "" {
+		return "", permError("empty macro")
+	}
+	at := strings.LastIndex(c.sender, "@")
+	var value string
+	switch m[0] {
+	case 's', 'S':
+		value = c.sender
+	case 'l', 'L':
+		value = c.sender[:at]
+		if value == "" {
+			value = "postmaster"
+		}
+	case 'o', 'O':
+		value = c.sender[at+1:]
+	case 'd', 'D':
+		value = domain
+	case 'i', 'I':
+		value = spfIPName(c.ip)
+	case 'v', 'V':
+		value = "ip6"
+		if c.ip.To4() != nil {
+			value = "in-addr"
+		}
+	case 'h', 'H':
+		value = c.helo
+	default:
+		return "", permError("unknown macro %q", m)
+	}
+
+	rest := m[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		keep, _ = strconv.Atoi(rest[:digits])
+		if keep == 0 {
+			return "", permError("bad macro %q", m)
+		}
+	}
+	rest = rest[digits:]
+	reverse := false
+	if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse, rest = true, rest[1:]
+	}
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", permError("bad macro %q", m)
+		}
+		delimiters = rest
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// spfIPName returns the IP the way the i macro uses it, IPv6 addresses are dotted nibbles
+func spfIPName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	var nibbles []string
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, strconv.FormatInt(int64(b>>4), 16), strconv.FormatInt(int64(b&0xf), 16))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// receivedSPFHeader returns the Received-SPF header for the envelope, or nil if SPF wasn't checked
+func (e *env) receivedSPFHeader() []byte {
+	if e.spf == "" {
+		return nil
+	}
+	sender := spfSender(e.from, e.conn.helo)
+	domain := sender[strings.LastIndex(sender, "@")+1:]
+	var comment string
+	switch e.spf {
+	case spfPass:
+		comment = fmt.Sprintf("domain of %s designates %s as permitted sender", sender, e.clientIP)
+	case spfFail, spfSoftfail:
+		comment = fmt.Sprintf("domain of %s does not designate %s as permitted sender", sender, e.clientIP)
+	case spfNeutral:
+		comment = fmt.Sprintf("%s is neither permitted nor denied by domain of %s", e.clientIP, sender)
+	case spfNone:
+		comment = fmt.Sprintf("%s does not publish an SPF record", domain)
+	default:
+		comment = fmt.Sprintf("error checking the SPF record of %s", domain)
+	}
+	hostname := e.conn.hostname
+	if hostname == "" {
+		hostname = localHostname()
+	}
+	return foldHeader("Received-SPF", fmt.Sprintf("%s (%s: %s)\r\n\tclient-ip=%s; envelope-from=\"%s\"; helo=%s;",
+		e.spf, hostname, comment, e.clientIP, sender, cleanHeloName(e.conn.helo)))
+}
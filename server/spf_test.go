@@ -0,0 +1,229 @@
+package server
+
+import (
+	"errors"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeResolver answers DNS lookups from maps, names in fail return an error
+type fakeResolver struct {
+	txt  map[string][]string
+	ip   map[string][]string
+	mx   map[string][]string
+	fail map[string]bool
+}
+
+func (r fakeResolver) LookupTXT(name string) ([]string, error) {
+	if r.fail[name] {
+		return nil, errors.New("timeout")
+	}
+	return r.txt[name], nil
+}
+
+func (r fakeResolver) LookupIP(name string) ([]net.IP, error) {
+	if r.fail[name] {
+		return nil, errors.New("timeout")
+	}
+	var ips []net.IP
+	for _, ip := range r.ip[name] {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	return ips, nil
+}
+
+func (r fakeResolver) LookupMX(name string) ([]*net.MX, error) {
+	if r.fail[name] {
+		return nil, errors.New("timeout")
+	}
+	var mxs []*net.MX
+	for _, host := range r.mx[name] {
+		mxs = append(mxs, &net.MX{Host: host})
+	}
+	return mxs, nil
+}
+
+// testSPFResolver has the records used by the SPF tests
+var testSPFResolver = fakeResolver{
+	txt: map[string][]string{
+		"ip.com":        {"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 -all"},
+		"soft.com":      {"some other record", "v=spf1 ~all"},
+		"neutral.com":   {"v=spf1 ip4:10.0.0.1"},
+		"include.com":   {"v=spf1 include:ip.com -all"},
+		"a.com":         {"v=spf1 a/24 a:other.a.com -all"},
+		"mx.com":        {"v=spf1 mx:mx.com//64 -all"},
+		"redirect.com":  {"v=spf1 redirect=ip.com"},
+		"exists.com":    {"v=spf1 exists:%{ir}.%{v}._spf.%{d} -all"},
+		"two.com":       {"v=spf1 -all", "v=spf1 +all"},
+		"bad.com":       {"v=spf1 ip4:192.0.2.300 -all"},
+		"unknown.com":   {"v=spf1 foo:bar -all"},
+		"loop.com":      {"v=spf1 include:loop.com -all"},
+		"missing.com":   {"v=spf1 include:nothing.com -all"},
+		"temp.com":      {"v=spf1 a:down.com -all"},
+		"MixedCase.com": {"V=SPF1 IP4:192.0.2.1 -ALL"},
+	},
+	ip: map[string][]string{
+		"a.com":                             {"198.51.100.1"},
+		"other.a.com":                       {"203.0.113.7"},
+		"mail.mx.com":                       {"2001:db8:1::1"},
+		"3.2.0.192.in-addr._spf.exists.com": {"127.0.0.2"},
+	},
+	mx: map[string][]string{
+		"mx.com": {"mail.mx.com"},
+	},
+	fail: map[string]bool{
+		"down.com":  true,
+		"flaky.com": true,
+	},
+}
+
+func TestCheckSPF(t *testing.T) {
+	defer func(r dnsResolver) { resolver = r }(resolver)
+	resolver = testSPFResolver
+
+	tests := []struct {
+		ip     string
+		from   string
+		result spfResult
+	}{
+		{"192.0.2.3", "sender@ip.com", spfPass},
+		{"2001:db8::1", "sender@ip.com", spfPass},
+		{"198.51.100.1", "sender@ip.com", spfFail},
+		{"198.51.100.1", "sender@soft.com", spfSoftfail},
+		{"198.51.100.1", "sender@neutral.com", spfNeutral},
+		{"198.51.100.1", "sender@none.com", spfNone},
+		{"192.0.2.3", "sender@include.com", spfPass},
+		{"198.51.100.1", "sender@include.com", spfFail},
+		{"198.51.100.200", "sender@a.com", spfPass},
+		{"203.0.113.7", "sender@a.com", spfPass},
+		{"203.0.113.8", "sender@a.com", spfFail},
+		{"2001:db8:1::ffff", "sender@mx.com", spfPass},
+		{"2001:db8:2::1", "sender@mx.com", spfFail},
+		{"192.0.2.3", "sender@redirect.com", spfPass},
+		{"192.0.2.3", "sender@exists.com", spfPass},
+		{"192.0.2.4", "sender@exists.com", spfFail},
+		{"192.0.2.3", "sender@two.com", spfPermerror},
+		{"192.0.2.3", "sender@bad.com", spfPermerror},
+		{"192.0.2.3", "sender@unknown.com", spfPermerror},
+		{"192.0.2.3", "sender@loop.com", spfPermerror},
+		{"192.0.2.3", "sender@missing.com", spfPermerror},
+		{"192.0.2.3", "sender@temp.com", spfTemperror},
+		{"192.0.2.3", "sender@flaky.com", spfTemperror},
+		{"192.0.2.1", "sender@MixedCase.com", spfNone},
+		{"192.0.2.3", "sender@localhost", spfNone},
+	}
+	for _, tt := range tests {
+		if result := checkSPF(net.ParseIP(tt.ip), tt.from, "mail.example.org"); result != tt.result {
+			t.Errorf("checkSPF(%s, %s) = %s, expected %s", tt.ip, tt.from, result, tt.result)
+		}
+	}
+
+	// Bounces are checked against the HELO name
+	if result := checkSPF(net.ParseIP("192.0.2.3"), "", "ip.com"); result != spfPass {
+		t.Errorf("Bounce from ip.com = %s", result)
+	}
+}
+
+func TestSPFMacros(t *testing.T) {
+	// The examples from RFC 7208 section 7.4
+	c := &spfCheck{ip: net.ParseIP("192.0.2.3"), sender: "strong-bad@email.example.com", helo: "mx.example.org"}
+	tests := map[string]string{
+		"%{s}":                   "strong-bad@email.example.com",
+		"%{o}":                   "email.example.com",
+		"%{d}":                   "email.example.com",
+		"%{d4}":                  "email.example.com",
+		"%{d3}":                  "email.example.com",
+		"%{d2}":                  "example.com",
+		"%{d1}":                  "com",
+		"%{dr}":                  "com.example.email",
+		"%{d2r}":                 "example.email",
+		"%{l}":                   "strong-bad",
+		"%{l-}":                  "strong.bad",
+		"%{lr}":                  "strong-bad",
+		"%{lr-}":                 "bad.strong",
+		"%{l1r-}":                "strong",
+		"%{ir}.%{v}._spf.%{d2}":  "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":   "bad.strong.lp._spf.example.com",
+		"%{h}%%%_%-":             "mx.example.org% %20",
+		"%{ir}.%{v}.%{l1r-}.lp.": "3.2.0.192.in-addr.strong.lp",
+	}
+	for spec, expected := range tests {
+		if got, err := c.expand(spec, "email.example.com"); err != nil || got != expected {
+			t.Errorf("expand(%q) = %q, %v expected %q", spec, got, err, expected)
+		}
+	}
+	for _, spec := range []string{"%{x}", "%{d0}", "%{", "%", "%a", "%{l*}"} {
+		if got, err := c.expand(spec, "email.example.com"); err == nil {
+			t.Errorf("expand(%q) = %q, expected an error", spec, got)
+		}
+	}
+
+	c.ip = net.ParseIP("2001:db8::cb01")
+	expected := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if got, _ := c.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com"); got != expected {
+		t.Errorf("IPv6 expand = %q, expected %q", got, expected)
+	}
+}
+
+func TestSPFMail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func(r dnsResolver) {
+		resolver = r
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}(resolver)
+	resolver = fakeResolver{txt: map[string][]string{
+		"good.com": {"v=spf1 ip4:127.0.0.1 -all"},
+		"bad.com":  {"v=spf1 -all"},
+	}}
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	cfg.SPF = "reject"
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+
+	err = smtp.SendMail(ln.Addr().String(), nil, "sender@bad.com", []string{"bcl@domain.com"}, []byte("Subject: test\r\n\r\nHello\r\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "550") || !strings.Contains(err.Error(), "5.7.23") {
+		t.Errorf("Mail failing SPF not rejected: %v", err)
+	}
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@good.com", []string{"bcl@domain.com"}, []byte("Subject: test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "bcl", "new"))
+	if len(files) != 1 {
+		t.Fatal("Message not delivered")
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "bcl", "new", files[0].Name()))
+	header := "Received-SPF: pass (mx.domain.com: domain of sender@good.com designates\r\n" +
+		" 127.0.0.1 as permitted sender)\r\n" +
+		"\tclient-ip=127.0.0.1; envelope-from=\"sender@good.com\"; helo=localhost;\r\nReceived: "
+	if !strings.Contains(string(data), header) {
+		t.Errorf("Received-SPF header missing: %q", data)
+	}
+
+	// mark only adds the header
+	cfg.SPF = "mark"
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@bad.com", []string{"bcl@domain.com"}, []byte("Subject: test\r\n\r\nHello\r\n")); err != nil {
+		t.Errorf("Mail failing SPF rejected with spf = mark: %s", err)
+	}
+}
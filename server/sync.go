@@ -0,0 +1,18 @@
+package server
+
+// syncEnabled returns true if messages are synced to disk before they are acknowledged
+/*
+   Example TOML:
+
+   sync = true
+
+   Each message file is fsynced before it is linked into the maildir's new
+   directory, and new is fsynced afterwards, so a message that has been
+   acknowledged with 250 survives a power failure. tmp isn't synced, a message
+   is only kept once it is in new. Mboxes are always synced, and a new mbox's
+   directory is synced with this. Messages spooled to the queue and their
+   envelopes are synced along with the queue directory.
+*/
+func syncEnabled() bool {
+	return cfg.Sync
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/delivery"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+	}()
+	cmdline.Maildirs = dir
+	cfg.Sync = true
+
+	d, err := userMaildir("bcl", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	del, err := newDelivery(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	del.Write([]byte("Subject: test\r\n\r\nHello\r\n"))
+	if err := del.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(del.Path()); err != nil || string(data) != "Subject: test\r\n\r\nHello\r\n" {
+		t.Errorf("Wrong message delivered: %q %v", data, err)
+	}
+
+	path := filepath.Join(dir, "queued.eml")
+	if err := writeFileAtomic(path, []byte("queued")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "queued" {
+		t.Errorf("Wrong file written: %q %v", data, err)
+	}
+
+	if err := delivery.SyncDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Syncing a missing directory didn't fail")
+	}
+}
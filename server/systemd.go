@@ -0,0 +1,139 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemdListeners picks up the sockets passed by a systemd socket unit
+/*
+   Example socket unit, letterbox.socket:
+
+   [Socket]
+   ListenStream=0.0.0.0:25
+   ListenStream=0.0.0.0:587
+
+   The sockets are matched with the listeners in the config by their address,
+   so letterbox can use port 25 without running as root. Sockets that aren't
+   used by the config are closed.
+*/
+func systemdListeners() error {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return fmt.Errorf("bad LISTEN_FDS: %s", os.Getenv("LISTEN_FDS"))
+	}
+	// They are only for this process, not a new letterbox started by an upgrade
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	upgradeState.Lock()
+	defer upgradeState.Unlock()
+	for i := 0; i < count; i++ {
+		f := os.NewFile(uintptr(3+i), fmt.Sprintf("systemd socket %d", i))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("systemd socket %d: %s", i, err)
+		}
+		key := ln.Addr().Network() + ":" + ln.Addr().String()
+		logDebugf("Using systemd socket %s", key)
+		upgradeState.inherited[key] = ln
+	}
+	return nil
+}
+
+// sameAddress returns true if a listener on addr is listening on the network and address from the config
+// Addresses that listen on all interfaces match each other, whether they are IPv4 or IPv6.
+func sameAddress(network, address string, addr net.Addr) bool {
+	if network != addr.Network() {
+		return false
+	}
+	if network == "unix" {
+		return address == addr.String()
+	}
+	want, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return false
+	}
+	got, ok := addr.(*net.TCPAddr)
+	if !ok || got.Port != want.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return got.IP == nil || got.IP.IsUnspecified()
+	}
+	return want.IP.Equal(got.IP)
+}
+
+// sdNotify sends a state change to systemd, if letterbox was started by systemd with Type=notify
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// Abstract sockets start with @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Error notifying systemd: %s", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Error notifying systemd: %s", err)
+	}
+}
+
+// watchdogInterval returns how often to tell systemd letterbox is alive, 0 if WatchdogSec isn't set
+// It is half of the watchdog timeout, as sd_watchdog_enabled recommends.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// notifyReady tells systemd letterbox is listening, and starts the watchdog keepalives
+// MAINPID is included because after an upgrade the new letterbox is the main process.
+// That needs NotifyAccess=all in the service unit.
+func notifyReady() {
+	sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	// A new letterbox started by an upgrade takes over the watchdog
+	os.Unsetenv("WATCHDOG_PID")
+	go func() {
+		for range time.Tick(interval) {
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
+
+// notifyStopping tells systemd letterbox is shutting down
+// It isn't sent when a new letterbox has taken over after an upgrade.
+func notifyStopping() {
+	upgradeState.Lock()
+	upgrading := upgradeState.upgrading
+	upgradeState.Unlock()
+	if !upgrading {
+		sdNotify("STOPPING=1")
+	}
+}
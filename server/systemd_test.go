@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSameAddress(t *testing.T) {
+	tests := []struct {
+		network string
+		address string
+		addr    net.Addr
+		same    bool
+	}{
+		{"tcp", ":25", &net.TCPAddr{IP: net.IPv6unspecified, Port: 25}, true},
+		{"tcp", "0.0.0.0:25", &net.TCPAddr{IP: net.IPv4zero, Port: 25}, true},
+		{"tcp", "0.0.0.0:25", &net.TCPAddr{IP: net.IPv4zero, Port: 587}, false},
+		{"tcp", "127.0.0.1:25", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 25}, true},
+		{"tcp", "127.0.0.1:25", &net.TCPAddr{IP: net.IPv4zero, Port: 25}, false},
+		{"tcp", "0.0.0.0:25", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 25}, false},
+		{"unix", "/run/letterbox.sock", &net.UnixAddr{Name: "/run/letterbox.sock", Net: "unix"}, true},
+		{"unix", "/run/letterbox.sock", &net.TCPAddr{IP: net.IPv4zero, Port: 25}, false},
+	}
+	for _, tt := range tests {
+		if same := sameAddress(tt.network, tt.address, tt.addr); same != tt.same {
+			t.Errorf("sameAddress(%s, %s, %s) = %v", tt.network, tt.address, tt.addr, same)
+		}
+	}
+}
+
+func TestSystemdListeners(t *testing.T) {
+	defer resetUpgradeState()
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	// Sockets for another process are ignored
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	if err := systemdListeners(); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv("LISTEN_FDS") != "1" {
+		t.Error("Environment for another process removed")
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "x")
+	if err := systemdListeners(); err == nil {
+		t.Error("Bad LISTEN_FDS accepted")
+	}
+
+	// A socket from systemd is used for the listener with the same address
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetUpgradeState()
+	upgradeState.inherited["tcp:"+ln.Addr().String()] = ln
+	port := ln.Addr().(*net.TCPAddr).Port
+	got, err := openListener("tcp", fmt.Sprintf("0.0.0.0:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != ln {
+		t.Error("systemd socket not used")
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	read := func() string {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	notifyReady()
+	if msg := read(); msg != fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()) {
+		t.Errorf("Ready notification is %q", msg)
+	}
+	notifyStopping()
+	if msg := read(); msg != "STOPPING=1" {
+		t.Errorf("Stopping notification is %q", msg)
+	}
+
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	if interval := watchdogInterval(); interval != 15*time.Second {
+		t.Errorf("Watchdog interval is %s, expected 15s", interval)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if interval := watchdogInterval(); interval != 0 {
+		t.Errorf("Watchdog for another process has interval %s", interval)
+	}
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTagSenders limits how many sender domains are kept for each tag
+const maxTagSenders = 50
+
+// tagEntry is what is known about the mail received for one user+tag address
+type tagEntry struct {
+	Count   int64            `json:"count"`
+	First   time.Time        `json:"first"`
+	Last    time.Time        `json:"last"`
+	Senders map[string]int64 `json:"senders"` // messages from each sender domain
+}
+
+// tagStats counts the messages delivered to each plus address tag
+// The sender domains show who has been given, or has been sold, a tagged
+// address. Entries are keyed by user+tag.
+type tagStats struct {
+	sync.Mutex
+	entries map[string]*tagEntry
+	path    string // Path to save the counts to, or "" to only keep them in memory
+}
+
+var plusTags = newTagStats("")
+
+// newTagStats returns an empty tagStats
+func newTagStats(path string) *tagStats {
+	return &tagStats{entries: make(map[string]*tagEntry), path: path}
+}
+
+// record counts a message from the sender to the user's tag, and saves the counts
+func (s *tagStats) record(user, tag, from string, now time.Time) {
+	if tag == "" {
+		return
+	}
+	domain := "<>"
+	if i := strings.LastIndex(from, "@"); i != -1 {
+		domain = strings.ToLower(from[i+1:])
+	}
+	s.Lock()
+	defer s.Unlock()
+	key := user + "+" + tag
+	e, ok := s.entries[key]
+	if !ok {
+		e = &tagEntry{First: now, Senders: make(map[string]int64)}
+		s.entries[key] = e
+	}
+	e.Count++
+	e.Last = now
+	if _, ok := e.Senders[domain]; ok || len(e.Senders) < maxTagSenders {
+		e.Senders[domain]++
+	}
+
+	if err := s.save(); err != nil {
+		log.Printf("Error saving tag counts: %s", err)
+	}
+}
+
+// snapshot returns a copy of the counts, only for the user's tags if user isn't empty
+func (s *tagStats) snapshot(user string) map[string]tagEntry {
+	s.Lock()
+	defer s.Unlock()
+	entries := make(map[string]tagEntry)
+	for key, e := range s.entries {
+		if user != "" && !strings.HasPrefix(key, user+"+") {
+			continue
+		}
+		c := *e
+		c.Senders = make(map[string]int64)
+		for domain, n := range e.Senders {
+			c.Senders[domain] = n
+		}
+		entries[key] = c
+	}
+	return entries
+}
+
+// load reads the counts from the state file, a missing file is not an error
+func (s *tagStats) load() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	return json.Unmarshal(data, &s.entries)
+}
+
+// save writes the counts to the state file
+// It must be called with the lock held.
+func (s *tagStats) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// tagStatsPath returns the file in the state_dir the counts are saved to, or "" without a state_dir
+func tagStatsPath() string {
+	if cfg.StateDir == "" {
+		return ""
+	}
+	return path.Join(cfg.StateDir, "tags.json")
+}
+
+// setupTags creates the tag counts and loads the saved ones
+func setupTags() error {
+	plusTags = newTagStats(tagStatsPath())
+	return plusTags.load()
+}
+
+// serveTagStats serves the tag counts as JSON, only for one user with ?user=bcl
+func serveTagStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plusTags.snapshot(r.URL.Query().Get("user")))
+}
+
+// tagsCommand prints the tag counts saved in the state_dir, the most used tags first
+/*
+   letterbox tags [-user bcl]
+*/
+func tagsCommand(args []string) error {
+	flags := flag.NewFlagSet("tags", flag.ExitOnError)
+	user := flags.String("user", "", "Only print this user's tags")
+	flags.Parse(args)
+
+	f, err := os.Open(cmdline.Config)
+	if err != nil {
+		return err
+	}
+	cfg, err = readConfig(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if tagStatsPath() == "" {
+		return fmt.Errorf("tag counts are only saved with a state_dir")
+	}
+	if err := setupTags(); err != nil {
+		return err
+	}
+	entries := plusTags.snapshot(*user)
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := entries[keys[i]], entries[keys[j]]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return keys[i] < keys[j]
+	})
+	for _, key := range keys {
+		fmt.Println(formatTagEntry(key, entries[key]))
+	}
+	return nil
+}
+
+// formatTagEntry returns a line with the tag's count, first and last message, and the busiest senders
+func formatTagEntry(key string, e tagEntry) string {
+	domains := make([]string, 0, len(e.Senders))
+	for domain := range e.Senders {
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if e.Senders[domains[i]] != e.Senders[domains[j]] {
+			return e.Senders[domains[i]] > e.Senders[domains[j]]
+		}
+		return domains[i] < domains[j]
+	})
+	var senders []string
+	for _, domain := range domains {
+		senders = append(senders, fmt.Sprintf("%s (%d)", domain, e.Senders[domain]))
+	}
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", key, e.Count, e.First.Format(time.RFC3339), e.Last.Format(time.RFC3339), strings.Join(senders, ", "))
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTagStatsSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tags.json")
+
+	first := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	s := newTagStats(path)
+	s.record("bcl", "shop", "news@shop.com", first)
+	s.record("bcl", "shop", "deals@Spammer.net", first.Add(time.Hour))
+	s.record("bcl", "shop", "news@shop.com", first.Add(2*time.Hour))
+	s.record("alice", "bank", "", first)
+	s.record("bcl", "", "a@b.com", first)
+
+	loaded := newTagStats(path)
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	entries := loaded.snapshot("bcl")
+	if len(entries) != 1 {
+		t.Fatalf("Wrong tags for bcl: %v", entries)
+	}
+	e := entries["bcl+shop"]
+	if e.Count != 3 || !e.First.Equal(first) || !e.Last.Equal(first.Add(2*time.Hour)) || e.Senders["shop.com"] != 2 || e.Senders["spammer.net"] != 1 {
+		t.Errorf("Wrong counts for bcl+shop: %#v", e)
+	}
+	if len(loaded.snapshot("")) != 2 || loaded.snapshot("")["alice+bank"].Senders["<>"] != 1 {
+		t.Errorf("Wrong counts: %v", loaded.snapshot(""))
+	}
+
+	line := formatTagEntry("bcl+shop", e)
+	if line != "bcl+shop\t3\t2024-01-02T15:04:05Z\t2024-01-02T17:04:05Z\tshop.com (2), spammer.net (1)" {
+		t.Errorf("Wrong line: %q", line)
+	}
+
+	// The number of sender domains is limited
+	for i := 0; i < maxTagSenders+10; i++ {
+		s.record("bcl", "leaked", fmt.Sprintf("x@domain%d.com", i), first)
+	}
+	if n := len(s.snapshot("bcl")["bcl+leaked"].Senders); n != maxTagSenders {
+		t.Errorf("Kept %d sender domains", n)
+	}
+}
+
+func TestTagStatsDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+		plusTags = newTagStats("")
+	}()
+	cmdline.Maildirs = dir
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com"}
+	parseHosts()
+	plusTags = newTagStats("")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	for _, rcpt := range []string{"bcl+shop@domain.com", "bcl+shop@domain.com", "bcl@domain.com"} {
+		if err := smtp.SendMail(ln.Addr().String(), nil, "news@shop.com", []string{rcpt}, []byte("Subject: deals\r\n\r\nBuy\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	serveTagStats(w, httptest.NewRequest("GET", "/tags?user=bcl", nil))
+	var entries map[string]tagEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries["bcl+shop"].Count != 2 || entries["bcl+shop"].Senders["shop.com"] != 2 {
+		t.Errorf("Wrong tag counts: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,3 @@
+module wasmfilter
+
+go 1.24
@@ -0,0 +1,85 @@
+// wasmfilter is the WebAssembly filter module used by the tests, built with
+// GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"unsafe"
+)
+
+type envelope struct {
+	Rcpt    string              `json:"rcpt"`
+	From    string              `json:"from"`
+	Headers map[string][]string `json:"headers"`
+}
+
+type header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type verdict struct {
+	Action  string   `json:"action"`
+	Message string   `json:"message,omitempty"`
+	Headers []header `json:"headers,omitempty"`
+}
+
+// buffers keeps the memory handed to letterbox from being collected
+var buffers [][]byte
+
+//go:wasmimport letterbox log
+func hostLog(ptr, size uint32)
+
+func logf(msg string) {
+	buf := []byte(msg)
+	buffers = append(buffers, buf)
+	hostLog(uint32(uintptr(unsafe.Pointer(&buf[0]))), uint32(len(buf)))
+}
+
+//go:wasmexport alloc
+func alloc(size uint32) uint32 {
+	buf := make([]byte, size+1)
+	buffers = append(buffers, buf)
+	return uint32(uintptr(unsafe.Pointer(&buf[0])))
+}
+
+func input(ptr, size uint32) envelope {
+	var env envelope
+	json.Unmarshal(unsafe.Slice((*byte)(unsafe.Pointer(uintptr(ptr))), size), &env)
+	return env
+}
+
+func reply(v verdict) uint64 {
+	out, _ := json.Marshal(v)
+	buffers = append(buffers, out)
+	return uint64(uintptr(unsafe.Pointer(&out[0])))<<32 | uint64(len(out))
+}
+
+//go:wasmexport rcpt
+func rcpt(ptr, size uint32) uint64 {
+	env := input(ptr, size)
+	if strings.HasPrefix(env.Rcpt, "blocked@") {
+		return reply(verdict{Action: "reject", Message: "Recipient blocked by policy"})
+	}
+	return reply(verdict{Action: "accept"})
+}
+
+//go:wasmexport data
+func data(ptr, size uint32) uint64 {
+	env := input(ptr, size)
+	subject := strings.Join(env.Headers["subject"], " ")
+	logf("checking " + subject)
+	switch subject {
+	case "later":
+		return reply(verdict{Action: "tempfail", Message: "Try again later"})
+	case "loop":
+		for {
+		}
+	case "bad header":
+		return reply(verdict{Action: "accept", Headers: []header{{Name: "X-Bad", Value: "one\r\nBcc: someone"}}})
+	}
+	return reply(verdict{Action: "accept", Headers: []header{{Name: "X-Policy", Value: "checked " + env.From}}})
+}
+
+func main() {}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"net/mail"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// msgIDRE matches a single <message-id> in a header
+var msgIDRE = regexp.MustCompile(`<[^<>\s]+>`)
+
+// threadMessage holds the threading headers of a message
+type threadMessage struct {
+	path string
+	id   string
+	refs []string // In-Reply-To and References ids
+	date time.Time
+}
+
+// readThreadMessage reads the threading headers from a message file
+func readThreadMessage(path string) (threadMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return threadMessage{}, err
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		return threadMessage{}, err
+	}
+	tm := threadMessage{
+		path: path,
+		id:   msgIDRE.FindString(msg.Header.Get("Message-Id")),
+		refs: msgIDRE.FindAllString(msg.Header.Get("In-Reply-To")+" "+msg.Header.Get("References"), -1),
+	}
+	tm.date, _ = msg.Header.Date()
+	return tm, nil
+}
+
+// findThread returns the messages in the same conversation as the message id, oldest first
+// Messages are in the same conversation if they are connected by their
+// Message-ID, In-Reply-To, and References headers.
+func findThread(msgs []threadMessage, id string) []threadMessage {
+	parent := make(map[string]string)
+	var find func(string) string
+	find = func(k string) string {
+		p, ok := parent[k]
+		if !ok || p == k {
+			return k
+		}
+		root := find(p)
+		parent[k] = root
+		return root
+	}
+	union := func(a, b string) {
+		parent[find(a)] = find(b)
+	}
+
+	// Messages without a Message-ID are keyed by their path
+	key := func(m threadMessage) string {
+		if m.id == "" {
+			return "path:" + m.path
+		}
+		return m.id
+	}
+	for _, m := range msgs {
+		for _, ref := range m.refs {
+			union(key(m), ref)
+		}
+	}
+
+	var thread []threadMessage
+	root := find(id)
+	for _, m := range msgs {
+		if find(key(m)) == root {
+			thread = append(thread, m)
+		}
+	}
+	sort.SliceStable(thread, func(i, j int) bool {
+		return thread[i].date.Before(thread[j].date)
+	})
+	return thread
+}
+
+// threadCommand prints the paths of all the messages in a message's conversation
+/*
+   letterbox thread <message-id>
+*/
+func threadCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: thread <message-id>")
+	}
+	id := args[0]
+	if m := msgIDRE.FindString(id); m != "" {
+		id = m
+	} else {
+		id = "<" + id + ">"
+	}
+
+	if err := loadCommandConfig(); err != nil {
+		return err
+	}
+	if err := loadAliases(); err != nil {
+		return err
+	}
+
+	roots, err := maildirRoots()
+	if err != nil {
+		return err
+	}
+	var msgs []threadMessage
+	err = walkRoots(roots, func(path string) error {
+		tm, err := readThreadMessage(path)
+		if err != nil {
+			logDebugf("Skipping %s: %s", path, err)
+			return nil
+		}
+		msgs = append(msgs, tm)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, m := range findThread(msgs, id) {
+		fmt.Println(m.path)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFindThread(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2020, 9, d, 0, 0, 0, 0, time.UTC) }
+	msgs := []threadMessage{
+		{path: "reply2", id: "<3@x>", refs: []string{"<1@x>", "<2@x>"}, date: day(3)},
+		{path: "start", id: "<1@x>", date: day(1)},
+		{path: "other", id: "<9@x>", date: day(2)},
+		{path: "reply1", id: "<2@x>", refs: []string{"<1@x>"}, date: day(2)},
+		{path: "noid", refs: []string{"<3@x>"}, date: day(4)},
+	}
+
+	var paths []string
+	for _, m := range findThread(msgs, "<2@x>") {
+		paths = append(paths, m.path)
+	}
+	expected := []string{"start", "reply1", "reply2", "noid"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Wrong thread: %v", paths)
+	}
+
+	thread := findThread(msgs, "<9@x>")
+	if len(thread) != 1 || thread[0].path != "other" {
+		t.Errorf("Wrong single message thread: %#v", thread)
+	}
+
+	if thread := findThread(msgs, "<missing@x>"); len(thread) != 0 {
+		t.Errorf("Thread for unknown id: %#v", thread)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// certStore holds the current certificate so that it can be replaced while the server is running
+type certStore struct {
+	sync.RWMutex
+	cert     *tls.Certificate
+	certFile string
+	keyFile  string
+}
+
+// certs is the certificate used for STARTTLS, nil if TLS isn't configured
+var certs *certStore
+
+// load reads the certificate and key files, replacing the current certificate
+// If there is an error the current certificate is kept.
+func (c *certStore) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.cert = &cert
+	c.Unlock()
+	return nil
+}
+
+// getCertificate returns the current certificate for a new TLS connection
+func (c *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
+
+// tlsVersion converts a version like "1.2" to its crypto/tls constant
+func tlsVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", version)
+}
+
+// tlsVersionName converts a crypto/tls version constant to a version like "1.2"
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// setupTLS loads the certificate and returns the TLS config for STARTTLS
+// It returns nil if no certificate is configured.
+/*
+   Example TOML:
+
+   [tls]
+   cert = "/etc/letterbox/cert.pem"
+   key = "/etc/letterbox/key.pem"
+   min_version = "1.2"
+   client_ca = "/etc/letterbox/clients.pem"
+*/
+func setupTLS() (*tls.Config, error) {
+	if cfg.TLS.Cert == "" && cfg.TLS.Key == "" {
+		return nil, nil
+	}
+	minVersion, err := tlsVersion(cfg.TLS.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	c := &certStore{certFile: cfg.TLS.Cert, keyFile: cfg.TLS.Key}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	certs = c
+	config := &tls.Config{
+		GetCertificate: c.getCertificate,
+		MinVersion:     minVersion,
+	}
+	if cfg.TLS.ClientCA != "" {
+		pool, err := loadClientCA(cfg.TLS.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if err := setupClientIdentities(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// reloadCerts reads the certificate files again, new connections will use the new certificate
+func reloadCerts() {
+	if certs == nil {
+		return
+	}
+	if err := certs.load(); err != nil {
+		log.Printf("Error reloading TLS certificate, keeping the old one: %s", err)
+		return
+	}
+	log.Printf("Reloaded TLS certificate %s", certs.certFile)
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/smtpd"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/smtp"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and key for localhost to dir
+func writeTestCert(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := path.Join(dir, "cert.pem")
+	keyFile := path.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestSetupTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		cfg.TLS = config.TLS{}
+		certs = nil
+	}()
+
+	// No certificate, no TLS
+	if c, err := setupTLS(); c != nil || err != nil {
+		t.Fatalf("Unexpected TLS config: %v %v", c, err)
+	}
+
+	cfg.TLS.Cert, cfg.TLS.Key = writeTestCert(t, dir, "first")
+	cfg.TLS.MinVersion = "1.3"
+	c, err := setupTLS()
+	if err != nil {
+		t.Fatalf("Error setting up TLS: %s", err)
+	}
+	if c.MinVersion != tls.VersionTLS13 {
+		t.Errorf("Wrong minimum version: %x", c.MinVersion)
+	}
+	cert, _ := c.GetCertificate(nil)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Subject.CommonName != "first" {
+		t.Errorf("Wrong certificate: %s", leaf.Subject.CommonName)
+	}
+
+	// Reloading picks up the new certificate
+	writeTestCert(t, dir, "second")
+	reloadCerts()
+	cert, _ = c.GetCertificate(nil)
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Subject.CommonName != "second" {
+		t.Errorf("Certificate not reloaded: %s", leaf.Subject.CommonName)
+	}
+
+	// A broken certificate keeps the old one
+	ioutil.WriteFile(cfg.TLS.Cert, []byte("broken"), 0600)
+	reloadCerts()
+	if cert, _ := c.GetCertificate(nil); cert == nil {
+		t.Error("Certificate lost after failed reload")
+	}
+
+	cfg.TLS.MinVersion = "2.0"
+	if _, err := setupTLS(); err == nil {
+		t.Error("Bad TLS version did not return an error")
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		cfg.TLS = config.TLS{}
+		certs = nil
+	}()
+
+	cfg.TLS.Cert, cfg.TLS.Key = writeTestCert(t, dir, "localhost")
+	serverTLS, err := setupTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	tlsUsed := make(chan bool, 1)
+	s := &smtpd.Server{
+		Hostname:  "localhost",
+		TLSConfig: serverTLS,
+		OnNewMail: func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
+			tlsUsed <- c.TLS() != nil
+			return &smtpd.BasicEnvelope{}, nil
+		},
+	}
+	go s.Serve(ln)
+
+	client, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		t.Fatal("STARTTLS not advertised")
+	}
+	if err := client.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("STARTTLS failed: %s", err)
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		t.Error("STARTTLS advertised after TLS started")
+	}
+	if err := client.Mail("sender@domain.com"); err != nil {
+		t.Fatalf("MAIL FROM failed: %s", err)
+	}
+	if !<-tlsUsed {
+		t.Error("Connection not using TLS")
+	}
+}
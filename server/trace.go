@@ -0,0 +1,167 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// localHostname returns the name letterbox uses for itself in headers and when relaying
+func localHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "localhost"
+	}
+	return hostname
+}
+
+// cleanHeloName removes anything from the client's HELO name that could break the Received header
+func cleanHeloName(helo string) string {
+	clean := strings.Map(func(r rune) rune {
+		if r > ' ' && r < 0x7f && r != '(' && r != ')' && r != ';' {
+			return r
+		}
+		return -1
+	}, helo)
+	if clean == "" {
+		return "unknown"
+	}
+	return clean
+}
+
+// maxHeaderLine is the longest line letterbox writes in the headers it adds, from RFC 5322 s2.1.1
+const maxHeaderLine = 78
+
+// foldHeader returns the header field, folded so that its lines aren't longer than maxHeaderLine
+// Lines are broken before a space or tab, so unfolding the field gives back
+// the value, and a word longer than a line is left on a line of its own.
+// Lines the value already breaks with CRLF are kept.
+func foldHeader(name, value string) []byte {
+	var b strings.Builder
+	for i, text := range strings.Split(name+": "+value, "\r\n") {
+		// The first line can't be broken before the field name's first word
+		minWords := 1
+		if i == 0 {
+			minWords = 2
+		}
+		var line string
+		for _, word := range foldWords(text) {
+			if len(line)+len(word) > maxHeaderLine && len(strings.Fields(line)) >= minWords && (word[0] == ' ' || word[0] == '\t') {
+				b.WriteString(line + "\r\n")
+				line = ""
+			}
+			line += word
+		}
+		b.WriteString(line + "\r\n")
+	}
+	return []byte(b.String())
+}
+
+// foldWords splits a line before each run of spaces and tabs, keeping them with the word that follows
+func foldWords(line string) []string {
+	var words []string
+	start := 0
+	for i := 1; i < len(line); i++ {
+		space := line[i] == ' ' || line[i] == '\t'
+		if space && line[i-1] != ' ' && line[i-1] != '\t' {
+			words = append(words, line[start:i])
+			start = i
+		}
+	}
+	return append(words, line[start:])
+}
+
+// receivedHeader returns the Received header for the message, folded onto several lines
+// The protocol follows RFC 3848, with S for STARTTLS and A for AUTH, and the
+// UTF8 prefix from RFC 6531 when SMTPUTF8 was used for a UTF-8 address. It is the
+// same for every recipient, so it doesn't have a for clause. The by clause uses
+// the hostname of the listener the client connected to. With TLS it ends with
+// the tls clause from RFC 8314, and a comment records who the client
+// authenticated as, by AUTH or by client certificate.
+func (e *env) receivedHeader(lmtp bool, now time.Time) []byte {
+	by := e.conn.hostname
+	if by == "" {
+		by = localHostname()
+	}
+	from := "local"
+	if e.clientIP != nil {
+		from = "[" + e.clientIP.String() + "]"
+	}
+	protocol := "ESMTP"
+	if lmtp {
+		protocol = "LMTP"
+	}
+	if e.usesSMTPUTF8() {
+		protocol = "UTF8" + strings.TrimPrefix(protocol, "E")
+	}
+	if e.conn.tlsVersion != "" {
+		protocol += "S"
+	}
+	if e.conn.authUser != "" || e.conn.identity != "" {
+		protocol += "A"
+	}
+
+	lines := []string{fmt.Sprintf("from %s (%s)", cleanHeloName(e.conn.helo), from)}
+	if e.conn.tlsVersion != "" {
+		lines = append(lines, fmt.Sprintf("\t(using TLS %s with cipher %s)", e.conn.tlsVersion, e.conn.tlsCipher))
+	}
+	if e.conn.authUser != "" {
+		lines = append(lines, fmt.Sprintf("\t(authenticated as %s)", cleanHeloName(e.conn.authUser)))
+	}
+	if e.conn.identity != "" {
+		lines = append(lines, fmt.Sprintf("\t(authenticated by certificate %s)", cleanHeloName(e.conn.identity)))
+	}
+	with := protocol
+	if e.conn.tlsCipher != "" {
+		with += " tls " + e.conn.tlsCipher
+	}
+	lines = append(lines,
+		fmt.Sprintf("\tby %s (letterbox) with %s;", by, with),
+		"\t"+now.Format(time.RFC1123Z))
+	return foldHeader("Received", strings.Join(lines, "\r\n"))
+}
+
+// SetMailParameters is called with the BODY and SMTPUTF8 parameters of MAIL FROM
+// The body is passed on as it is, 8-bit or not, so only SMTPUTF8 is kept.
+func (e *env) SetMailParameters(body string, smtputf8 bool) {
+	e.smtputf8 = smtputf8
+}
+
+// usesSMTPUTF8 returns true if MAIL had the SMTPUTF8 parameter and the sender or a recipient isn't ASCII
+// Some clients, like Go's net/smtp, send SMTPUTF8 whenever the server has it.
+func (e *env) usesSMTPUTF8() bool {
+	if !e.smtputf8 {
+		return false
+	}
+	utf8 := !isASCII([]byte(e.from))
+	for _, rcpt := range e.rcpts {
+		utf8 = utf8 || !isASCII([]byte(rcpt.Email()))
+	}
+	return utf8
+}
+
+// deliveryHeader returns the Return-Path and Delivered-To headers for delivering to the recipient
+func deliveryHeader(from, rcpt string) []byte {
+	return append(foldHeader("Return-Path", "<"+from+">"), foldHeader("Delivered-To", rcpt)...)
+}
+
+// untraced returns true if the recipient gets the message without the headers letterbox adds
+/*
+   Example TOML:
+
+   untraced_recipients = ["tickets@domain.com", "ingest"]
+
+   Entries are recipient addresses or users, after aliases. Their copy of the
+   message has no Return-Path, Delivered-To, Received, Received-SPF,
+   X-Sender-Domain, X-Date-Check, X-Virus-Status, or Authentication-Results
+   headers, so it is the same as the message that was sent.
+*/
+func untraced(rcpt, user string) bool {
+	for _, r := range cfg.UntracedRecipients {
+		if strings.EqualFold(r, rcpt) || r == user {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCleanHeloName(t *testing.T) {
+	tests := map[string]string{
+		"mail.domain.com":      "mail.domain.com",
+		"[192.168.1.1]":        "[192.168.1.1]",
+		"evil (fake); by here": "evilfakebyhere",
+		"":                     "unknown",
+		"\r\n":                 "unknown",
+	}
+	for helo, expected := range tests {
+		if got := cleanHeloName(helo); got != expected {
+			t.Errorf("cleanHeloName(%q) = %q, expected %q", helo, got, expected)
+		}
+	}
+}
+
+func TestFoldHeader(t *testing.T) {
+	if got := string(foldHeader("X-Spam-Status", "No, score=1.20")); got != "X-Spam-Status: No, score=1.20\r\n" {
+		t.Errorf("Short header folded: %q", got)
+	}
+
+	long := "pass (mx.domain.com: domain of a-rather-long-sender-name@example.com designates 192.168.1.1 as permitted sender)"
+	got := string(foldHeader("Received-SPF", long))
+	for _, line := range strings.Split(strings.TrimSuffix(got, "\r\n"), "\r\n") {
+		if len(line) > maxHeaderLine {
+			t.Errorf("Line too long: %q", line)
+		}
+	}
+	if unfolded := strings.Replace(got, "\r\n", "", -1); unfolded != "Received-SPF: "+long {
+		t.Errorf("Folded header doesn't unfold to the value: %q", got)
+	}
+
+	// Long words aren't split, and the lines the value already has are kept
+	word := strings.Repeat("x", 100)
+	if got := string(foldHeader("X-Long", word+" y\r\n\tz")); got != "X-Long: "+word+"\r\n y\r\n\tz\r\n" {
+		t.Errorf("Wrong folding around a long word: %q", got)
+	}
+	if got := string(foldHeader(strings.Repeat("X", 80), "y")); got != strings.Repeat("X", 80)+": y\r\n" {
+		t.Errorf("Long field name folded: %q", got)
+	}
+}
+
+func TestReceivedHeader(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 30, 0, 0, time.UTC)
+	e := &env{clientIP: net.ParseIP("192.168.1.1"), conn: connInfo{helo: "mail.domain.com", hostname: "mx.domain.com"}}
+	header := string(e.receivedHeader(false, now))
+	if header != "Received: from mail.domain.com ([192.168.1.1])\r\n\tby mx.domain.com (letterbox) with ESMTP;\r\n\tSun, 01 Mar 2020 12:30:00 +0000\r\n" {
+		t.Errorf("Wrong Received header: %q", header)
+	}
+
+	e = &env{conn: connInfo{helo: "client", tlsVersion: "TLS1.3", tlsCipher: "TLS_AES_128_GCM_SHA256", authUser: "user"}}
+	header = string(e.receivedHeader(true, now))
+	if !strings.HasPrefix(header, "Received: from client (local)\r\n\t(using TLS TLS1.3 with cipher TLS_AES_128_GCM_SHA256)\r\n") {
+		t.Errorf("Wrong Received header: %q", header)
+	}
+	if !strings.Contains(header, "\t(authenticated as user)\r\n\tby ") || !strings.Contains(header, "with LMTPSA tls TLS_AES_128_GCM_SHA256;") {
+		t.Errorf("Wrong protocol in Received header: %q", header)
+	}
+
+	e = &env{conn: connInfo{helo: "client", tlsVersion: "TLS1.2", tlsCipher: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", identity: "printer (office); x"}}
+	header = string(e.receivedHeader(false, now))
+	if !strings.Contains(header, "\t(authenticated by certificate printerofficex)\r\n") || !strings.Contains(header, "with ESMTPSA tls TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256;") {
+		t.Errorf("Wrong client certificate in Received header: %q", header)
+	}
+}
+
+func TestDeliveryHeader(t *testing.T) {
+	expected := "Return-Path: <sender@domain.com>\r\nDelivered-To: bcl@domain.com\r\n"
+	if got := string(deliveryHeader("sender@domain.com", "bcl@domain.com")); got != expected {
+		t.Errorf("deliveryHeader = %q, expected %q", got, expected)
+	}
+	if got := string(deliveryHeader("", "bcl@domain.com")); !strings.HasPrefix(got, "Return-Path: <>\r\n") {
+		t.Errorf("Null sender Return-Path = %q", got)
+	}
+}
+
+func TestUntraced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	os.Mkdir(cmdline.Maildirs, 0700)
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com", "tickets@domain.com", "ingest@domain.com"}
+	cfg.UntracedRecipients = []string{"Tickets@domain.com", "ingest"}
+	cfg.Queue.Dir = filepath.Join(dir, "queue")
+	parseHosts()
+	if err := setupQueue(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ingest's delivery fails and is queued
+	blocker := filepath.Join(cmdline.Maildirs, "ingest")
+	if err := ioutil.WriteFile(blocker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+
+	message := "Subject: ticket\r\nX-Ticket: 1234\r\n\r\nHello\r\n"
+	rcpts := []string{"bcl@domain.com", "tickets@domain.com", "ingest@domain.com"}
+	if err := smtp.SendMail(ln.Addr().String(), nil, "sender@domain.com", rcpts, []byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(blocker)
+	processQueue(time.Now().Add(time.Hour))
+
+	for _, user := range []string{"bcl", "tickets", "ingest"} {
+		files, _ := ioutil.ReadDir(filepath.Join(cmdline.Maildirs, user, "new"))
+		if len(files) != 1 {
+			t.Errorf("%d messages for %s, expected 1", len(files), user)
+			continue
+		}
+		data, _ := ioutil.ReadFile(filepath.Join(cmdline.Maildirs, user, "new", files[0].Name()))
+		if user == "bcl" {
+			if !strings.HasPrefix(string(data), "Return-Path: <sender@domain.com>\r\n") || !strings.Contains(string(data), "\r\nReceived: from ") {
+				t.Errorf("Trace headers missing for bcl: %q", data)
+			}
+		} else if string(data) != message {
+			t.Errorf("%s got %q, expected %q", user, data, message)
+		}
+	}
+}
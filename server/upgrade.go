@@ -0,0 +1,203 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// upgradeEnv passes the addresses of the listening sockets to a new letterbox
+// The sockets are passed as file descriptors starting at 3, in the same order.
+const upgradeEnv = "LETTERBOX_LISTENERS"
+
+// upgradeState tracks the listening sockets so they can be passed to a new letterbox
+var upgradeState = struct {
+	sync.Mutex
+	keys      []string                // network:address of each listener, as it was opened
+	listeners []net.Listener          // the listeners in the same order as keys
+	inherited map[string]net.Listener // sockets from the old letterbox that haven't been opened yet
+	upgraded  bool                    // this letterbox was started by an upgrade
+	upgrading bool                    // a new letterbox has been started and hasn't exited
+}{inherited: make(map[string]net.Listener)}
+
+// listenerFile is implemented by the listeners that can be passed to a new process
+type listenerFile interface {
+	File() (*os.File, error)
+}
+
+// inheritListeners makes the sockets passed by the old letterbox available to openListener
+// keys is the value of upgradeEnv, and files are the sockets in the same order.
+func inheritListeners(keys string, files []*os.File) error {
+	names := strings.Split(keys, ",")
+	if len(names) != len(files) {
+		return fmt.Errorf("%d listeners for %d sockets", len(names), len(files))
+	}
+	upgradeState.Lock()
+	defer upgradeState.Unlock()
+	for i, f := range files {
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", names[i], err)
+		}
+		upgradeState.inherited[names[i]] = ln
+	}
+	return nil
+}
+
+// setupUpgrade picks up the sockets passed by the old letterbox when it is upgrading
+func setupUpgrade() error {
+	keys := os.Getenv(upgradeEnv)
+	if keys == "" {
+		return nil
+	}
+	os.Unsetenv(upgradeEnv)
+	upgradeState.Lock()
+	upgradeState.upgraded = true
+	upgradeState.Unlock()
+	var files []*os.File
+	for i, name := range strings.Split(keys, ",") {
+		files = append(files, os.NewFile(uintptr(3+i), name))
+	}
+	return inheritListeners(keys, files)
+}
+
+// openListener listens on the address, using the old letterbox's or systemd's socket if there is one
+func openListener(network, address string) (net.Listener, error) {
+	key := network + ":" + address
+	upgradeState.Lock()
+	defer upgradeState.Unlock()
+	ln, ok := upgradeState.inherited[key]
+	delete(upgradeState.inherited, key)
+	if !ok {
+		// systemd's sockets are keyed by their address, which may be written differently
+		for k, inherited := range upgradeState.inherited {
+			if sameAddress(network, address, inherited.Addr()) {
+				ln, ok = inherited, true
+				delete(upgradeState.inherited, k)
+				break
+			}
+		}
+	}
+	if !ok {
+		if network == "unix" {
+			// Remove a socket left behind by a previous run, but nothing else
+			if fi, err := os.Lstat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				os.Remove(address)
+			}
+		}
+		var err error
+		if ln, err = net.Listen(network, address); err != nil {
+			return nil, err
+		}
+	}
+	upgradeState.keys = append(upgradeState.keys, key)
+	upgradeState.listeners = append(upgradeState.listeners, ln)
+	return ln, nil
+}
+
+// finishUpgrade closes the sockets from the old letterbox or systemd that aren't in the
+// config, and tells the old letterbox to drain and exit now that this one is listening
+func finishUpgrade() {
+	upgradeState.Lock()
+	defer upgradeState.Unlock()
+	for key, ln := range upgradeState.inherited {
+		log.Printf("Closing %s, it isn't in the config", key)
+		ln.Close()
+		delete(upgradeState.inherited, key)
+	}
+	if upgradeState.upgraded {
+		log.Printf("Upgrade finished, stopping the old letterbox (pid %d)", os.Getppid())
+		syscall.Kill(os.Getppid(), syscall.SIGTERM)
+		upgradeState.upgraded = false
+	}
+}
+
+// handoffFiles returns the addresses and files of the listeners to pass to a new letterbox
+func handoffFiles() (string, []*os.File, error) {
+	upgradeState.Lock()
+	defer upgradeState.Unlock()
+	var files []*os.File
+	for i, ln := range upgradeState.listeners {
+		lf, ok := ln.(listenerFile)
+		if !ok {
+			return "", nil, fmt.Errorf("can't pass %s to a new process", upgradeState.keys[i])
+		}
+		f, err := lf.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return "", nil, err
+		}
+		files = append(files, f)
+	}
+	return strings.Join(upgradeState.keys, ","), files, nil
+}
+
+// upgrade starts a new letterbox from the executable on disk, passing it the listening sockets
+/*
+   SIGUSR2 starts the new binary with the same arguments. Once it is listening
+   it sends SIGTERM to this letterbox, which drains and exits as usual. If the
+   new letterbox fails to start this one keeps running.
+*/
+func upgrade() error {
+	upgradeState.Lock()
+	if upgradeState.upgrading {
+		upgradeState.Unlock()
+		return fmt.Errorf("an upgrade is already running")
+	}
+	upgradeState.upgrading = true
+	upgradeState.Unlock()
+	done := func() {
+		upgradeState.Lock()
+		upgradeState.upgrading = false
+		upgradeState.Unlock()
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		done()
+		return err
+	}
+	keys, files, err := handoffFiles()
+	if err != nil {
+		done()
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	// The new letterbox owns the Unix socket now, so closing it here mustn't remove it
+	upgradeState.Lock()
+	for _, ln := range upgradeState.listeners {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	upgradeState.Unlock()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+keys)
+	if err := cmd.Start(); err != nil {
+		done()
+		return err
+	}
+	log.Printf("Started new letterbox %s as pid %d", exe, cmd.Process.Pid)
+	go func() {
+		err := cmd.Wait()
+		log.Printf("New letterbox exited, still running: %v", err)
+		done()
+	}()
+	return nil
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+// resetUpgradeState closes the listeners opened by a test and forgets them
+func resetUpgradeState() {
+	upgradeState.Lock()
+	defer upgradeState.Unlock()
+	for _, ln := range upgradeState.listeners {
+		ln.Close()
+	}
+	for _, ln := range upgradeState.inherited {
+		ln.Close()
+	}
+	upgradeState.keys = nil
+	upgradeState.listeners = nil
+	upgradeState.inherited = make(map[string]net.Listener)
+	upgradeState.upgraded = false
+}
+
+// acceptOne accepts a connection on the listener and closes it
+func acceptOne(ln net.Listener) {
+	if c, err := ln.Accept(); err == nil {
+		c.Close()
+	}
+}
+
+func TestUpgradeHandoff(t *testing.T) {
+	// Forget the listeners opened by other tests
+	resetUpgradeState()
+	defer resetUpgradeState()
+
+	// The old letterbox's listeners
+	tcp, err := openListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := openListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both listeners on port 0 have the same key, so pretend the second is on another address
+	upgradeState.keys[1] = "tcp:127.0.0.2:25"
+	keys, files, err := handoffFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != "tcp:127.0.0.1:0,tcp:127.0.0.2:25" || len(files) != 2 {
+		t.Fatalf("handoffFiles = %q, %d files", keys, len(files))
+	}
+	addr, removedAddr := tcp.Addr().String(), removed.Addr().String()
+	resetUpgradeState()
+
+	// The new letterbox picks them up
+	if err := inheritListeners(keys, files); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := openListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ln.Addr().String() != addr {
+		t.Errorf("Inherited listener is on %s, expected %s", ln.Addr(), addr)
+	}
+	go acceptOne(ln)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Inherited listener not accepting: %s", err)
+	}
+	c.Close()
+
+	// Listeners that aren't in the config any more are closed
+	finishUpgrade()
+	if c, err := net.Dial("tcp", removedAddr); err == nil {
+		c.Close()
+		t.Error("Unused inherited listener still open")
+	}
+	upgradeState.Lock()
+	if len(upgradeState.inherited) != 0 {
+		t.Errorf("%d inherited listeners left", len(upgradeState.inherited))
+	}
+	upgradeState.Unlock()
+}
+
+func TestInheritListeners(t *testing.T) {
+	defer resetUpgradeState()
+	if err := inheritListeners("tcp:127.0.0.1:25,tcp:127.0.0.1:26", []*os.File{}); err == nil {
+		t.Error("Mismatched sockets accepted")
+	}
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inheritListeners("tcp:127.0.0.1:25", []*os.File{f}); err == nil {
+		t.Error("File that isn't a socket accepted")
+	}
+}
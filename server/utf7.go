@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"unicode/utf16"
+)
+
+// utf7Encoding is the base64 alphabet of IMAP's modified UTF-7, with , instead of /
+var utf7Encoding = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+,").WithPadding(base64.NoPadding)
+
+// encodeMailboxName returns the folder name in IMAP's modified UTF-7 (RFC 3501 s5.1.3)
+// Dovecot and Courier keep Maildir++ folder names this way, so a folder
+// created for a UTF-8 name shows up under that name in IMAP clients. Names
+// that are printable ASCII without & are unchanged.
+func encodeMailboxName(name string) string {
+	var b strings.Builder
+	var run []rune
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		var buf []byte
+		for _, u := range utf16.Encode(run) {
+			buf = append(buf, byte(u>>8), byte(u))
+		}
+		b.WriteString("&" + utf7Encoding.EncodeToString(buf) + "-")
+		run = nil
+	}
+	for _, r := range name {
+		switch {
+		case r == '&':
+			flush()
+			b.WriteString("&-")
+		case r >= 0x20 && r <= 0x7e:
+			flush()
+			b.WriteRune(r)
+		default:
+			run = append(run, r)
+		}
+	}
+	flush()
+	return b.String()
+}
+
+// decodeMailboxName returns the UTF-8 folder name from IMAP's modified UTF-7
+func decodeMailboxName(name string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(name, '&')
+		if i == -1 {
+			b.WriteString(name)
+			return b.String(), nil
+		}
+		b.WriteString(name[:i])
+		name = name[i+1:]
+		end := strings.IndexByte(name, '-')
+		if end == -1 {
+			return "", errors.New("unterminated modified UTF-7")
+		}
+		if end == 0 {
+			b.WriteByte('&')
+			name = name[1:]
+			continue
+		}
+		buf, err := utf7Encoding.DecodeString(name[:end])
+		if err != nil || len(buf)%2 != 0 {
+			return "", errors.New("bad modified UTF-7")
+		}
+		units := make([]uint16, len(buf)/2)
+		for j := range units {
+			units[j] = uint16(buf[2*j])<<8 | uint16(buf[2*j+1])
+		}
+		b.WriteString(string(utf16.Decode(units)))
+		name = name[end+1:]
+	}
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestMailboxName(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"alerts", "alerts"},
+		{"lists.go", "lists.go"},
+		{"Entwürfe", "Entw&APw-rfe"},
+		{"Q&A", "Q&-A"},
+		{"日本語", "&ZeVnLIqe-"},
+		{"~peter/mail/台北/日本語", "~peter/mail/&U,BTFw-/&ZeVnLIqe-"},
+		{"😀", "&2D3eAA-"},
+	}
+	for _, tt := range tests {
+		if encoded := encodeMailboxName(tt.name); encoded != tt.encoded {
+			t.Errorf("encodeMailboxName(%q) = %q, expected %q", tt.name, encoded, tt.encoded)
+		}
+		if name, err := decodeMailboxName(tt.encoded); err != nil || name != tt.name {
+			t.Errorf("decodeMailboxName(%q) = %q %v, expected %q", tt.encoded, name, err, tt.name)
+		}
+	}
+	for _, bad := range []string{"Q&A", "&Jjo!", "&AP-"} {
+		if name, err := decodeMailboxName(bad); err == nil {
+			t.Errorf("decodeMailboxName(%q) = %q, expected an error", bad, name)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bcl/letterbox/config"
+	"github.com/bcl/letterbox/smtpd"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// defaultWasmTimeout is how long a WebAssembly filter's hook can take when the config doesn't say
+const defaultWasmTimeout = 5 * time.Second
+
+// wasmMemoryPages limits the memory of each WebAssembly filter instance, in 64KiB pages
+const wasmMemoryPages = 4096
+
+// wasmFilter is a compiled [[wasm_filters]] module
+type wasmFilter struct {
+	config   config.WasmFilter
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+}
+
+// wasmFilters holds the compiled modules, in the order they are listed
+var wasmFilters []*wasmFilter
+
+// wasmEnvelope is the JSON the hooks are passed
+type wasmEnvelope struct {
+	Hook       string              `json:"hook"`
+	ClientIP   string              `json:"client_ip,omitempty"`
+	OriginIP   string              `json:"origin_ip,omitempty"`
+	Helo       string              `json:"helo"`
+	TLSVersion string              `json:"tls_version,omitempty"`
+	TLSCipher  string              `json:"tls_cipher,omitempty"`
+	AuthUser   string              `json:"auth_user,omitempty"`
+	From       string              `json:"from"`
+	Rcpt       string              `json:"rcpt,omitempty"`
+	Recipients []string            `json:"recipients"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Size       int64               `json:"size,omitempty"`
+}
+
+// wasmHeader is a header the data hook adds to the message
+type wasmHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// wasmVerdict is the JSON the hooks return
+type wasmVerdict struct {
+	Action  string       `json:"action"`
+	Message string       `json:"message"`
+	Headers []wasmHeader `json:"headers"`
+}
+
+// wasmFilterName returns the filter's name for the log
+func wasmFilterName(f config.WasmFilter) string {
+	if f.Name == "" {
+		return f.Module
+	}
+	return f.Name
+}
+
+// wasmOnError returns what to do with messages the filter failed on
+func wasmOnError(f config.WasmFilter) string {
+	if f.OnError == "" {
+		return "defer"
+	}
+	return strings.ToLower(f.OnError)
+}
+
+// checkWasmFilters checks the [[wasm_filters]] config
+/*
+   Example TOML:
+
+   [[wasm_filters]]
+   name = "policy"
+   module = "/etc/letterbox/policy.wasm"
+   timeout = "2s"
+   on_error = "accept"
+
+   Each module is run in its own sandbox for every hook call, with no access
+   to files, the network, or the environment. It exports its memory, and
+   alloc(size i32) i32 which returns room for size bytes of input. The hooks
+   are rcpt(ptr, len i32) i64 and data(ptr, len i32) i64. They are passed a
+   wasmEnvelope as JSON, and return the pointer to a wasmVerdict as JSON in the
+   high 32 bits and its length in the low 32 bits. A module that doesn't export
+   a hook accepts. The host module "letterbox" has log(ptr, len i32) to write a
+   line to letterbox's log. WASI modules like Go's wasip1 reactors can be used,
+   their _initialize is run first.
+*/
+func checkWasmFilters() error {
+	for _, f := range cfg.WasmFilters {
+		if f.Module == "" {
+			return fmt.Errorf("wasm filter %s has no module", f.Name)
+		}
+		switch wasmOnError(f) {
+		case "defer", "accept":
+		default:
+			return fmt.Errorf("unknown on_error setting for wasm filter %s: %s", wasmFilterName(f), f.OnError)
+		}
+	}
+	return nil
+}
+
+// setupWasmFilters compiles the modules from the config, replacing the ones that were compiled before
+func setupWasmFilters() error {
+	for _, f := range wasmFilters {
+		f.runtime.Close(context.Background())
+	}
+	wasmFilters = nil
+	for _, fc := range cfg.WasmFilters {
+		f, err := compileWasmFilter(fc)
+		if err != nil {
+			return fmt.Errorf("wasm filter %s: %s", wasmFilterName(fc), err)
+		}
+		wasmFilters = append(wasmFilters, f)
+	}
+	return nil
+}
+
+// compileWasmFilter compiles the filter's module in a runtime of its own, with WASI and the letterbox host module
+func compileWasmFilter(fc config.WasmFilter) (*wasmFilter, error) {
+	code, err := ioutil.ReadFile(fc.Module)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true).WithMemoryLimitPages(wasmMemoryPages))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+	name := wasmFilterName(fc)
+	_, err = r.NewHostModuleBuilder("letterbox").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, m api.Module, ptr, size uint32) {
+			if msg, ok := m.Memory().Read(ptr, size); ok {
+				log.Printf("wasm filter %s: %s", name, msg)
+			}
+		}).
+		Export("log").
+		Instantiate(ctx)
+	if err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+	compiled, err := r.CompileModule(ctx, code)
+	if err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+	return &wasmFilter{config: fc, runtime: r, compiled: compiled}, nil
+}
+
+// call runs the hook in a new instance of the module, returning its verdict
+func (f *wasmFilter) call(hook string, input []byte) (wasmVerdict, error) {
+	var verdict wasmVerdict
+	timeout := f.config.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultWasmTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// Anonymous instances can run at the same time, and share nothing
+	mod, err := f.runtime.InstantiateModule(ctx, f.compiled, wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return verdict, err
+	}
+	defer mod.Close(context.Background())
+	fn := mod.ExportedFunction(hook)
+	if fn == nil {
+		verdict.Action = "accept"
+		return verdict, nil
+	}
+	alloc := mod.ExportedFunction("alloc")
+	if alloc == nil || mod.Memory() == nil {
+		return verdict, fmt.Errorf("module doesn't export alloc and its memory")
+	}
+	res, err := alloc.Call(ctx, uint64(len(input)))
+	if err != nil {
+		return verdict, err
+	}
+	ptr := uint32(res[0])
+	if !mod.Memory().Write(ptr, input) {
+		return verdict, fmt.Errorf("alloc returned memory out of range")
+	}
+	res, err = fn.Call(ctx, uint64(ptr), uint64(len(input)))
+	if err != nil {
+		return verdict, err
+	}
+	output, ok := mod.Memory().Read(uint32(res[0]>>32), uint32(res[0]))
+	if !ok {
+		return verdict, fmt.Errorf("%s returned memory out of range", hook)
+	}
+	if err := json.Unmarshal(output, &verdict); err != nil {
+		return verdict, fmt.Errorf("bad verdict from %s: %s", hook, err)
+	}
+	for _, h := range verdict.Headers {
+		if !validHeaderName(h.Name) || strings.ContainsAny(h.Value, "\r\n") {
+			return verdict, fmt.Errorf("bad header from %s: %q", hook, h.Name)
+		}
+	}
+	return verdict, nil
+}
+
+// validHeaderName returns true if the name can be used for a header field, RFC 5322 section 2.2
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c <= ' ' || c > '~' || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// wasmEnv returns the envelope passed to the hooks
+func (e *env) wasmEnv(hook, rcpt string, headers mail.Header) wasmEnvelope {
+	w := wasmEnvelope{
+		Hook:       hook,
+		Helo:       e.conn.helo,
+		TLSVersion: e.conn.tlsVersion,
+		TLSCipher:  e.conn.tlsCipher,
+		AuthUser:   e.conn.authUser,
+		From:       e.from,
+		Rcpt:       rcpt,
+		Recipients: []string{},
+	}
+	if e.clientIP != nil {
+		w.ClientIP = e.clientIP.String()
+	}
+	if e.originIP != nil {
+		w.OriginIP = e.originIP.String()
+	}
+	for _, r := range e.rcpts {
+		w.Recipients = append(w.Recipients, r.Email())
+	}
+	if headers != nil {
+		w.Headers = make(map[string][]string)
+		for name, values := range headers {
+			w.Headers[strings.ToLower(name)] = values
+		}
+		w.Size = e.size
+	}
+	return w
+}
+
+// runWasmFilters runs the hook in each filter, returning the headers they add or the first error
+// The actions are the same as the Lua hooks', "accept", "reject", "tempfail",
+// and "tag". A filter that fails asks the sender to try again later, or is
+// skipped with on_error = "accept".
+func (e *env) runWasmFilters(hook, rcpt string, headers mail.Header) ([]byte, error) {
+	if len(wasmFilters) == 0 {
+		return nil, nil
+	}
+	input, err := json.Marshal(e.wasmEnv(hook, rcpt, headers))
+	if err != nil {
+		return nil, err
+	}
+	var added []byte
+	for _, f := range wasmFilters {
+		name := wasmFilterName(f.config)
+		verdict, err := f.call(hook, input)
+		if err != nil {
+			e.conn.logf("Error running %s hook of wasm filter %s: %s", hook, name, err)
+			if wasmOnError(f.config) == "accept" {
+				continue
+			}
+			return nil, smtpd.SMTPError(fmt.Sprintf("451 4.3.0 Error running wasm filter %s", name))
+		}
+		msg := ""
+		if verdict.Message != "" {
+			msg = " " + strings.Join(strings.Fields(verdict.Message), " ")
+		}
+		switch verdict.Action {
+		case "reject":
+			return nil, smtpd.SMTPError("550 5.7.1" + msg)
+		case "tempfail":
+			return nil, smtpd.SMTPError("451 4.7.1" + msg)
+		case "tag":
+			if verdict.Message != "" {
+				e.addTag(verdict.Message)
+			}
+		}
+		for _, h := range verdict.Headers {
+			added = append(added, h.Name+": "+h.Value+"\r\n"...)
+		}
+	}
+	return added, nil
+}
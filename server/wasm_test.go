@@ -0,0 +1,124 @@
+package server
+
+import (
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckWasmFilters(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	bad := []config.WasmFilter{
+		{Name: "nothing"},
+		{Module: "/etc/letterbox/policy.wasm", OnError: "ignore"},
+	}
+	for _, f := range bad {
+		cfg.WasmFilters = []config.WasmFilter{f}
+		if err := checkWasmFilters(); err == nil {
+			t.Errorf("No error for %+v", f)
+		}
+	}
+	cfg.WasmFilters = []config.WasmFilter{{Module: "/etc/letterbox/policy.wasm", OnError: "Accept"}}
+	if err := checkWasmFilters(); err != nil {
+		t.Errorf("Error for a good filter: %s", err)
+	}
+}
+
+func TestValidHeaderName(t *testing.T) {
+	for _, name := range []string{"X-Policy", "Subject", "x_y"} {
+		if !validHeaderName(name) {
+			t.Errorf("%q is a valid header name", name)
+		}
+	}
+	for _, name := range []string{"", "X Policy", "X:Policy", "X-Pölicy", "X\r\nBcc"} {
+		if validHeaderName(name) {
+			t.Errorf("%q is not a valid header name", name)
+		}
+	}
+}
+
+// buildWasmFilter builds the test module in testdata/wasmfilter into dir
+func buildWasmFilter(t *testing.T, dir string) string {
+	module := filepath.Join(dir, "filter.wasm")
+	cmd := exec.Command("go", "build", "-buildmode=c-shared", "-o", module, ".")
+	cmd.Dir = filepath.Join("testdata", "wasmfilter")
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm", "GOFLAGS=")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("Can't build the test module: %s\n%s", err, out)
+	}
+	return module
+}
+
+func TestWasmFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() {
+		cmdline.Maildirs = maildirs
+		cfg = config.Config{}
+		allowedList = access.List{}
+		setupWasmFilters()
+	}()
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"bcl@domain.com", "blocked@domain.com"}
+	cfg.WasmFilters = []config.WasmFilter{{Name: "policy", Module: buildWasmFilter(t, dir), Timeout: config.Duration{Duration: time.Second}}}
+	if err := setupWasmFilters(); err != nil {
+		t.Fatal(err)
+	}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	send := func(rcpt, subject string) error {
+		message := []byte("Subject: " + subject + "\r\n\r\nHello\r\n")
+		return smtp.SendMail(ln.Addr().String(), nil, "sender@remote.com", []string{rcpt}, message)
+	}
+
+	// The rcpt hook refuses blocked, and the data hook adds its header
+	if err := send("blocked@domain.com", "test"); err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Errorf("Recipient not refused: %v", err)
+	}
+	if err := send("bcl@domain.com", "test"); err != nil {
+		t.Fatalf("Message refused: %s", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(cmdline.Maildirs, "bcl", "new", "*"))
+	if len(files) != 1 {
+		t.Fatalf("bcl has %d messages", len(files))
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	if !strings.Contains(string(data), "X-Policy: checked sender@remote.com\r\n") {
+		t.Errorf("Header not added: %q", data)
+	}
+
+	// A tempfail, a header that would add another, and a module that runs too long all defer the message
+	for _, subject := range []string{"later", "bad header", "loop"} {
+		if err := send("bcl@domain.com", subject); err == nil || !strings.HasPrefix(err.Error(), "451") {
+			t.Errorf("Message with subject %q not deferred: %v", subject, err)
+		}
+	}
+
+	// Unless the filter's failures are skipped
+	cfg.WasmFilters[0].OnError = "accept"
+	if err := setupWasmFilters(); err != nil {
+		t.Fatal(err)
+	}
+	if err := send("bcl@domain.com", "loop"); err != nil {
+		t.Errorf("Message refused: %s", err)
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// watchEvent is printed for each new message found by the watch command
+type watchEvent struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	Folder    string    `json:"folder,omitempty"`
+	Path      string    `json:"path"`
+	From      string    `json:"from,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	MessageID string    `json:"message_id,omitempty"`
+}
+
+// newWatchEvent describes the message at path
+func newWatchEvent(path string, now time.Time) watchEvent {
+	ev := watchEvent{Time: now, Path: path}
+	ev.User, ev.Folder = maildirUser(path)
+	f, err := os.Open(path)
+	if err != nil {
+		return ev
+	}
+	defer f.Close()
+	if msg, err := mail.ReadMessage(f); err == nil {
+		ev.From = decodeHeader(msg.Header.Get("From"))
+		ev.Subject = decodeHeader(msg.Header.Get("Subject"))
+		ev.MessageID = msg.Header.Get("Message-Id")
+	}
+	return ev
+}
+
+// findNewMessages returns the messages under the roots whose keys aren't in seen
+// seen is replaced by the keys of all the messages that are there now, so that
+// a message moving from new to cur or changing its flags isn't reported again.
+func findNewMessages(roots []string, seen map[string]bool, now time.Time) ([]watchEvent, map[string]bool, error) {
+	var events []watchEvent
+	current := make(map[string]bool)
+	err := walkRoots(roots, func(path string) error {
+		key := filepath.Join(filepath.Dir(filepath.Dir(path)), messageKey(filepath.Base(path)))
+		current[key] = true
+		if !seen[key] {
+			events = append(events, newWatchEvent(path, now))
+		}
+		return nil
+	})
+	return events, current, err
+}
+
+// watchCommand prints a JSON line to stdout for each new message delivered to the maildirs
+/*
+   The maildirs are checked every interval. Messages that are already there
+   when it starts are not printed.
+
+   letterbox watch [-interval 5s] [-user bcl]
+*/
+func watchCommand(args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	interval := flags.Duration("interval", 2*time.Second, "How often to check for new messages")
+	user := flags.String("user", "", "Only watch this user's maildir")
+	flags.Parse(args)
+
+	if err := loadCommandConfig(); err != nil {
+		return err
+	}
+	if err := loadAliases(); err != nil {
+		return err
+	}
+	roots, err := userRoots(*user)
+	if err != nil {
+		return err
+	}
+	_, seen, err := findNewMessages(roots, nil, time.Now())
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		time.Sleep(*interval)
+		var events []watchEvent
+		events, seen, err = findNewMessages(roots, seen, time.Now())
+		if err != nil {
+			return err
+		}
+		for _, ev := range events {
+			if err := enc.Encode(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
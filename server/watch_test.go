@@ -0,0 +1,63 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFindNewMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	defer func() { cmdline.Maildirs = maildirs }()
+	cmdline.Maildirs = dir
+
+	deliver := func(user, folder, header string) string {
+		d, err := userMaildir(user, folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		del, err := newDelivery(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		del.Write([]byte(header + "\r\n\r\nHello\r\n"))
+		if err := del.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return del.Path()
+	}
+
+	old := deliver("bcl", "", "Subject: old")
+	_, seen, err := findNewMessages([]string{dir}, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliver("bcl", "alerts", "Subject: =?utf-8?q?disk_full?=\r\nFrom: cron@host\r\nMessage-Id: <1@host>")
+	// Reading a message moves it to cur, which isn't new mail
+	if err := os.Rename(old, filepath.Join(dir, "bcl", "cur", filepath.Base(old)+":2,S")); err != nil {
+		t.Fatal(err)
+	}
+	events, seen, err := findNewMessages([]string{dir}, seen, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 new message: %#v", events)
+	}
+	ev := events[0]
+	if ev.User != "bcl" || ev.Folder != "alerts" || ev.Subject != "disk full" || ev.From != "cron@host" || ev.MessageID != "<1@host>" {
+		t.Errorf("Wrong event: %#v", ev)
+	}
+
+	if events, _, _ := findNewMessages([]string{dir}, seen, time.Now()); len(events) != 0 {
+		t.Errorf("Messages reported twice: %#v", events)
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/bcl/letterbox/config"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+// deliveryNotice is the JSON body of a webhook notice
+type deliveryNotice struct {
+	Rcpt     string    `json:"rcpt"`
+	User     string    `json:"user"`
+	From     string    `json:"from"`
+	Subject  string    `json:"subject"`
+	Path     string    `json:"path"`     // where the message was delivered
+	Filename string    `json:"filename"` // maildir filename of the message
+	Size     int64     `json:"size"`
+	QueueID  string    `json:"queue_id"`
+	Time     time.Time `json:"time"`
+}
+
+// defaultWebhookTimeout is used when the webhook timeout isn't set
+const defaultWebhookTimeout = 10 * time.Second
+
+// defaultWebhookRetries is used when the webhook retries isn't set
+const defaultWebhookRetries = 3
+
+// webhookRetryDelay is the wait before the first retry, it doubles after each one
+var webhookRetryDelay = 5 * time.Second
+
+// checkWebhook checks the [webhook] config
+func checkWebhook() error {
+	if cfg.Webhook.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(cfg.Webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook url must be an http or https URL")
+	}
+	if cfg.Webhook.Retries < 0 {
+		return fmt.Errorf("webhook retries can't be negative")
+	}
+	return nil
+}
+
+// notifyDelivered POSTs a notice about the delivery to the webhook, without waiting for it
+func notifyDelivered(conn connInfo, user, rcpt, from, path string, header mail.Header, size int64) {
+	if cfg.Webhook.URL == "" || (len(cfg.Webhook.Users) > 0 && !stringListed(cfg.Webhook.Users, user)) {
+		return
+	}
+	notice := deliveryNotice{
+		Rcpt:     rcpt,
+		User:     user,
+		From:     from,
+		Path:     path,
+		Filename: filepath.Base(path),
+		Size:     size,
+		QueueID:  conn.queueID,
+		Time:     time.Now().UTC(),
+	}
+	if header != nil {
+		notice.Subject = decodeHeader(header.Get("Subject"))
+	}
+	go sendWebhook(conn, cfg.Webhook, notice)
+}
+
+// sendWebhook POSTs the notice, and retries it while it fails
+// Failures are only logged, the message has already been delivered.
+func sendWebhook(conn connInfo, wh config.Webhook, notice deliveryNotice) {
+	body, err := json.Marshal(notice)
+	if err != nil {
+		log.Printf("Error encoding webhook notice: %s", err)
+		return
+	}
+	retries := wh.Retries
+	if retries == 0 {
+		retries = defaultWebhookRetries
+	}
+	delay := webhookRetryDelay
+	for try := 0; ; try++ {
+		err := postWebhook(wh, body)
+		if err == nil {
+			logDebugf("Webhook notified of delivery to %s", notice.Rcpt)
+			return
+		}
+		if try == retries {
+			conn.logf("Error notifying webhook of delivery to %s, giving up: %s", notice.Rcpt, err)
+			return
+		}
+		conn.logf("Error notifying webhook of delivery to %s, retrying in %s: %s", notice.Rcpt, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// postWebhook makes one try at POSTing the body, signed with the secret
+func postWebhook(wh config.Webhook, body []byte) error {
+	timeout := wh.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultWebhookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if wh.Secret != "" {
+		req.Header.Set("X-Letterbox-Signature", "sha256="+webhookSignature(wh.Secret, body))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", wh.URL, resp.Status)
+	}
+	return nil
+}
+
+// webhookSignature returns the hex HMAC-SHA256 of the body with the secret
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
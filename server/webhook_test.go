@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/bcl/letterbox/access"
+	"github.com/bcl/letterbox/config"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckWebhook(t *testing.T) {
+	defer func() { cfg = config.Config{} }()
+	for _, u := range []string{"ntfy.lan/mail", "ftp://ntfy.lan/mail", "https://"} {
+		cfg.Webhook = config.Webhook{URL: u}
+		if err := checkWebhook(); err == nil {
+			t.Errorf("Bad webhook url %q accepted", u)
+		}
+	}
+	cfg.Webhook = config.Webhook{URL: "https://ntfy.lan/mail", Retries: -1}
+	if err := checkWebhook(); err == nil {
+		t.Error("Negative webhook retries accepted")
+	}
+	cfg.Webhook = config.Webhook{URL: "https://ntfy.lan/mail"}
+	if err := checkWebhook(); err != nil {
+		t.Errorf("Good webhook refused: %s", err)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letterbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildirs := cmdline.Maildirs
+	retryDelay := webhookRetryDelay
+	defer func() {
+		cmdline.Maildirs = maildirs
+		webhookRetryDelay = retryDelay
+		cfg = config.Config{}
+		allowedList = access.List{}
+	}()
+	webhookRetryDelay = 10 * time.Millisecond
+
+	// The first try fails, so the notice is retried
+	notices := make(chan deliveryNotice, 2)
+	tries := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		if tries == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Letterbox-Signature") != "sha256="+webhookSignature("hunter2", body) {
+			t.Errorf("Wrong signature: %s", r.Header.Get("X-Letterbox-Signature"))
+		}
+		var notice deliveryNotice
+		if err := json.Unmarshal(body, &notice); err != nil {
+			t.Error(err)
+		}
+		notices <- notice
+	}))
+	defer ts.Close()
+
+	cmdline.Maildirs = filepath.Join(dir, "maildirs")
+	cfg.Hosts = []string{"127.0.0.1"}
+	cfg.Emails = []string{"monitoring@domain.com", "bcl@domain.com"}
+	cfg.Webhook = config.Webhook{URL: ts.URL, Secret: "hunter2", Users: []string{"monitoring"}}
+	parseHosts()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newServer("mx.domain.com", nil).Serve(ln)
+	msg := []byte("Subject: Disk full on nas\r\n\r\nHi\r\n")
+	if err := smtp.SendMail(ln.Addr().String(), nil, "alerts@domain.com", []string{"monitoring@domain.com", "bcl@domain.com"}, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case notice := <-notices:
+		files, _ := ioutil.ReadDir(filepath.Join(cmdline.Maildirs, "monitoring", "new"))
+		if len(files) != 1 || notice.Filename != files[0].Name() || notice.Path != filepath.Join(cmdline.Maildirs, "monitoring", "new", files[0].Name()) {
+			t.Errorf("Wrong path in notice: %s", notice.Path)
+		}
+		if notice.Rcpt != "monitoring@domain.com" || notice.User != "monitoring" || notice.From != "alerts@domain.com" ||
+			notice.Subject != "Disk full on nas" || notice.Size != files[0].Size() || notice.Time.IsZero() {
+			t.Errorf("Wrong notice: %#v", notice)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook not notified")
+	}
+	select {
+	case notice := <-notices:
+		t.Errorf("Notice for a user that isn't listed: %#v", notice)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,891 @@
+// Copyright 2011 The go-smtpd Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package smtpd implements an SMTP server. Hooks are provided to customize
+// its behavior.
+package smtpd
+
+// TODO:
+//  -- send 421 to connected clients on graceful server shutdown (s3.8)
+//
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	rcptToRE = regexp.MustCompile(`[Tt][Oo]:<(.+)>`)
+	//mailFromRE = regexp.MustCompile(`(?i)^from:\s*<(.*?)>`)
+	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:<(.*)>`)
+	sizeRE     = regexp.MustCompile(`(?i)\sSIZE=(\d+)`)
+	bodyRE     = regexp.MustCompile(`(?i)\sBODY=(\S*)`)
+	utf8RE     = regexp.MustCompile(`(?i)\sSMTPUTF8(\s|$)`)
+)
+
+// Server is an SMTP server.
+type Server struct {
+	Addr         string        // TCP address to listen on, ":25" if empty
+	Hostname     string        // optional Hostname to announce; "" to use system hostname
+	ReadTimeout  time.Duration // optional read timeout
+	WriteTimeout time.Duration // optional write timeout
+
+	// OnAuth, if non-nil, is used to advertise and handle AUTH PLAIN
+	// and LOGIN once the connection uses TLS. It returns true if the
+	// username and password are valid.
+	OnAuth func(c Connection, username, password string) bool
+
+	// AllowInsecureAuth lets clients use AUTH without TLS, sending their
+	// passwords in the clear.
+	AllowInsecureAuth bool
+
+	// OnAuthAttempt, if non-nil, is called with the username before
+	// OnAuth checks the password. If it returns non-nil the attempt is
+	// refused without checking the password.
+	OnAuthAttempt func(c Connection, username string) error
+
+	// TLSConfig, if non-nil, is used to advertise and handle STARTTLS.
+	TLSConfig *tls.Config
+
+	// MaxMessageSize, if non-zero, is the largest message in bytes that
+	// will be accepted. It is advertised with the SIZE extension, and
+	// larger messages are rejected with 552 and aborted.
+	MaxMessageSize int64
+
+	// LMTP makes the server speak LMTP (RFC 2033) instead of SMTP.
+	// Clients greet with LHLO, and get a reply for each recipient after DATA.
+	LMTP bool
+
+	// OnNewConnection, if non-nil, is called on new connections.
+	// If it returns non-nil, the connection is closed.
+	OnNewConnection func(c Connection) error
+
+	// OnClose, if non-nil, is called when a connection is closed,
+	// including connections that OnNewConnection rejected.
+	OnClose func(c Connection)
+
+	// OnNewMail must be defined and is called when a new message beings.
+	// (when a MAIL FROM line arrives)
+	OnNewMail func(c Connection, from MailAddress) (Envelope, error)
+
+	// OnCommand, if non-nil, is called with the verb of each command,
+	// or "UNKNOWN" for commands the server doesn't know.
+	OnCommand func(verb string)
+
+	// OnReply, if non-nil, is called with the 3 digit code of each reply.
+	OnReply func(code string)
+}
+
+// knownVerbs are the commands that are passed to OnCommand by name
+var knownVerbs = map[string]bool{
+	"HELO": true, "EHLO": true, "LHLO": true, "QUIT": true, "RSET": true, "NOOP": true,
+	"MAIL": true, "RCPT": true, "DATA": true, "STARTTLS": true, "AUTH": true,
+}
+
+// MailAddress is defined by
+type MailAddress interface {
+	Email() string    // email address, as provided
+	Hostname() string // canonical hostname, lowercase
+}
+
+// Connection is implemented by the SMTP library and provided to callers
+// customizing their own Servers.
+type Connection interface {
+	Addr() net.Addr
+
+	// LocalAddr returns the address the client connected to, the
+	// socket's path for a Unix socket.
+	LocalAddr() net.Addr
+	Close() error // to force-close a connection
+
+	// TLS returns the state of the TLS connection, or nil if STARTTLS
+	// has not been used.
+	TLS() *tls.ConnectionState
+
+	// AuthUser returns the authenticated username, or "" if the client
+	// has not authenticated.
+	AuthUser() string
+
+	// Hello returns the hostname the client sent with HELO, EHLO, or
+	// LHLO, or "" if it hasn't sent one yet.
+	Hello() string
+
+	// LocalHostname returns the hostname the server announced to the
+	// client in its banner.
+	LocalHostname() string
+
+	// LMTP returns true if the connection speaks LMTP, where each
+	// recipient gets its own reply to DATA.
+	LMTP() bool
+
+	// ID returns a random ID for the connection, so that the log lines
+	// for one client can be found.
+	ID() string
+}
+
+type Envelope interface {
+	AddRecipient(rcpt MailAddress) error
+	BeginData() error
+	Write(line []byte) error
+	Close() error
+}
+
+// Aborter is optionally implemented by an Envelope that needs to clean
+// up when the message is rejected during DATA, instead of being closed.
+type Aborter interface {
+	Abort()
+}
+
+// Sizer is optionally implemented by an Envelope that wants the size
+// the client declared with the SIZE parameter of MAIL, before any
+// recipients are added. It isn't called when no size was declared.
+type Sizer interface {
+	SetSize(size int64)
+}
+
+// MailParameters is optionally implemented by an Envelope that wants the
+// BODY and SMTPUTF8 parameters of MAIL (RFC 6152 and RFC 6531). body is
+// "7BIT" or "8BITMIME", or empty if the client didn't say.
+type MailParameters interface {
+	SetMailParameters(body string, smtputf8 bool)
+}
+
+// RecipientResults is optionally implemented by an Envelope to report
+// the result of delivering to each recipient for LMTP.
+type RecipientResults interface {
+	// RecipientErrors is called after Close, and returns the error for
+	// each successfully added recipient, in order. nil means the
+	// message was delivered to the recipient.
+	RecipientErrors() []error
+}
+
+// RecipientReplies is optionally implemented by an Envelope to choose
+// the LMTP reply for each recipient itself, instead of RecipientResults.
+type RecipientReplies interface {
+	// RecipientReplies is called after Close, and returns the reply line
+	// for each successfully added recipient, in order.
+	RecipientReplies() []string
+}
+
+type BasicEnvelope struct {
+	rcpts []MailAddress
+}
+
+func (e *BasicEnvelope) AddRecipient(rcpt MailAddress) error {
+	e.rcpts = append(e.rcpts, rcpt)
+	return nil
+}
+
+func (e *BasicEnvelope) BeginData() error {
+	if len(e.rcpts) == 0 {
+		return SMTPError("554 5.5.1 Error: no valid recipients")
+	}
+	return nil
+}
+
+func (e *BasicEnvelope) Write(line []byte) error {
+	log.Printf("Line: %q", string(line))
+	return nil
+}
+
+func (e *BasicEnvelope) Close() error {
+	return nil
+}
+
+func (srv *Server) hostname() string {
+	if srv.Hostname != "" {
+		return srv.Hostname
+	}
+	out, err := exec.Command("hostname").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// ListenAndServe listens on the TCP network address srv.Addr and then
+// calls Serve to handle requests on incoming connections.  If
+// srv.Addr is blank, ":25" is used.
+func (srv *Server) ListenAndServe() error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":25"
+	}
+	ln, e := net.Listen("tcp", addr)
+	if e != nil {
+		return e
+	}
+	return srv.Serve(ln)
+}
+
+func (srv *Server) Serve(ln net.Listener) error {
+	defer ln.Close()
+	for {
+		rw, e := ln.Accept()
+		if e != nil {
+			if ne, ok := e.(net.Error); ok && ne.Temporary() {
+				log.Printf("smtpd: Accept error: %v", e)
+				continue
+			}
+			return e
+		}
+		sess, err := srv.newSession(rw)
+		if err != nil {
+			continue
+		}
+		go sess.serve()
+	}
+}
+
+type session struct {
+	srv *Server
+	id  string
+	rwc net.Conn
+	br  *bufio.Reader
+	bw  *bufio.Writer
+
+	env Envelope // current envelope, or nil
+
+	helloType string
+	helloHost string
+	rcpts     int  // number of recipients accepted for the current envelope
+	smtputf8  bool // MAIL had the SMTPUTF8 parameter, so addresses can be UTF-8
+
+	tlsState *tls.ConnectionState // set after a successful STARTTLS
+	authUser string               // set after a successful AUTH
+}
+
+func (srv *Server) newSession(rwc net.Conn) (s *session, err error) {
+	id := make([]byte, 6)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+	s = &session{
+		srv: srv,
+		id:  hex.EncodeToString(id),
+		rwc: rwc,
+		br:  bufio.NewReader(rwc),
+		bw:  bufio.NewWriter(rwc),
+	}
+	return
+}
+
+func (s *session) errorf(format string, args ...interface{}) {
+	log.Printf("Client error: "+format, args...)
+}
+
+func (s *session) sendf(format string, args ...interface{}) {
+	if s.srv.WriteTimeout != 0 {
+		s.rwc.SetWriteDeadline(time.Now().Add(s.srv.WriteTimeout))
+	}
+	text := fmt.Sprintf(format, args...)
+	s.bw.WriteString(text)
+	s.bw.Flush()
+	s.replied(text)
+}
+
+// replied passes the code of a reply to OnReply
+func (s *session) replied(text string) {
+	if s.srv.OnReply != nil && len(text) >= 3 {
+		s.srv.OnReply(text[:3])
+	}
+}
+
+func (s *session) sendlinef(format string, args ...interface{}) {
+	s.sendf(format+"\r\n", args...)
+}
+
+func (s *session) sendSMTPErrorOrLinef(err error, format string, args ...interface{}) {
+	if se, ok := err.(SMTPError); ok {
+		s.sendlinef("%s", se.Error())
+		return
+	}
+	s.sendlinef(format, args...)
+}
+
+func (s *session) Addr() net.Addr {
+	return s.rwc.RemoteAddr()
+}
+
+func (s *session) LocalAddr() net.Addr { return s.rwc.LocalAddr() }
+
+func (s *session) Close() error { return s.rwc.Close() }
+
+func (s *session) TLS() *tls.ConnectionState { return s.tlsState }
+
+func (s *session) AuthUser() string { return s.authUser }
+
+func (s *session) Hello() string { return s.helloHost }
+
+func (s *session) LocalHostname() string { return s.srv.hostname() }
+
+func (s *session) LMTP() bool { return s.srv.LMTP }
+
+func (s *session) ID() string { return s.id }
+
+func (s *session) serve() {
+	defer s.rwc.Close()
+	if s.srv.OnClose != nil {
+		defer s.srv.OnClose(s)
+	}
+	// A listener that wraps its connections in TLS starts with TLS already in use
+	if tlsConn, ok := s.rwc.(*tls.Conn); ok {
+		if s.srv.ReadTimeout != 0 {
+			s.rwc.SetReadDeadline(time.Now().Add(s.srv.ReadTimeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			s.errorf("TLS handshake error: %v", err)
+			return
+		}
+		state := tlsConn.ConnectionState()
+		s.tlsState = &state
+	}
+	if onc := s.srv.OnNewConnection; onc != nil {
+		if err := onc(s); err != nil {
+			s.sendSMTPErrorOrLinef(err, "554 5.7.1 Error: connection rejected")
+			return
+		}
+	}
+	if s.srv.LMTP {
+		s.sendf("220 %s LMTP gosmtpd\r\n", s.srv.hostname())
+	} else {
+		s.sendf("220 %s ESMTP gosmtpd\r\n", s.srv.hostname())
+	}
+	for {
+		if s.srv.ReadTimeout != 0 {
+			s.rwc.SetReadDeadline(time.Now().Add(s.srv.ReadTimeout))
+		}
+		sl, err := s.br.ReadSlice('\n')
+		if err != nil {
+			s.errorf("read error: %v", err)
+			return
+		}
+		line := cmdLine(string(sl))
+		if err := line.checkValid(); err != nil {
+			s.sendlinef("500 5.5.2 Error: %v", err)
+			continue
+		}
+
+		if s.srv.OnCommand != nil {
+			if knownVerbs[line.Verb()] {
+				s.srv.OnCommand(line.Verb())
+			} else {
+				s.srv.OnCommand("UNKNOWN")
+			}
+		}
+
+		switch line.Verb() {
+		case "HELO", "EHLO":
+			if s.srv.LMTP {
+				s.sendlinef("500 5.5.1 Error: use LHLO")
+				continue
+			}
+			s.handleHello(line.Verb(), line.Arg())
+		case "LHLO":
+			if !s.srv.LMTP {
+				s.sendlinef("502 5.5.2 Error: command not recognized")
+				continue
+			}
+			s.handleHello(line.Verb(), line.Arg())
+		case "QUIT":
+			s.sendlinef("221 2.0.0 Bye")
+			return
+		case "RSET":
+			s.env = nil
+			s.sendlinef("250 2.0.0 OK")
+		case "NOOP":
+			s.sendlinef("250 2.0.0 OK")
+		case "MAIL":
+			arg := line.Arg() // "From:<foo@bar.com>"
+			m := mailFromRE.FindStringSubmatch(arg)
+			if m == nil {
+				log.Printf("invalid MAIL arg: %q", arg)
+				s.sendlinef("501 5.1.7 Bad sender address syntax")
+				continue
+			}
+			var size int64
+			if sm := sizeRE.FindStringSubmatch(arg); sm != nil {
+				n, err := strconv.ParseInt(sm[1], 10, 64)
+				if s.srv.MaxMessageSize > 0 && (err != nil || n > s.srv.MaxMessageSize) {
+					s.sendlinef("552 5.3.4 Error: message size exceeds limit")
+					continue
+				}
+				size = n
+			}
+			var body string
+			if bm := bodyRE.FindStringSubmatch(arg); bm != nil {
+				body = strings.ToUpper(bm[1])
+				if body != "7BIT" && body != "8BITMIME" {
+					s.sendlinef("555 5.5.4 Error: BODY=%s not supported", bm[1])
+					continue
+				}
+			}
+			smtputf8 := utf8RE.MatchString(arg)
+			if !smtputf8 && !isASCII(m[1]) {
+				s.sendlinef("553 5.6.7 Error: non-ASCII address needs SMTPUTF8")
+				continue
+			}
+			s.handleMailFrom(m[1], size, body, smtputf8)
+		case "RCPT":
+			s.handleRcpt(line)
+		case "DATA":
+			s.handleData()
+		case "STARTTLS":
+			s.handleStartTLS()
+		case "AUTH":
+			s.handleAuth(line.Arg())
+		default:
+			log.Printf("Client: %q, verhb: %q", line, line.Verb())
+			s.sendlinef("502 5.5.2 Error: command not recognized")
+		}
+	}
+}
+
+func (s *session) handleHello(greeting, host string) {
+	s.helloType = greeting
+	s.helloHost = host
+	fmt.Fprintf(s.bw, "250-%s\r\n", s.srv.hostname())
+	extensions := []string{}
+	if s.srv.TLSConfig != nil && s.tlsState == nil {
+		extensions = append(extensions, "250-STARTTLS")
+	}
+	if s.srv.OnAuth != nil && s.authSecure() {
+		extensions = append(extensions, "250-AUTH PLAIN LOGIN")
+	}
+	if s.srv.MaxMessageSize > 0 {
+		extensions = append(extensions, fmt.Sprintf("250-SIZE %d", s.srv.MaxMessageSize))
+	} else {
+		extensions = append(extensions, "250-SIZE")
+	}
+	extensions = append(extensions, "250-PIPELINING",
+		"250-ENHANCEDSTATUSCODES",
+		"250-8BITMIME",
+		"250 SMTPUTF8")
+	for _, ext := range extensions {
+		fmt.Fprintf(s.bw, "%s\r\n", ext)
+	}
+	s.bw.Flush()
+	s.replied("250")
+}
+
+func (s *session) handleMailFrom(email string, size int64, body string, smtputf8 bool) {
+	// TODO: 4.1.1.11.  If the server SMTP does not recognize or
+	// cannot implement one or more of the parameters associated
+	// qwith a particular MAIL FROM or RCPT TO command, it will return
+	// code 555.
+
+	if s.env != nil {
+		s.sendlinef("503 5.5.1 Error: nested MAIL command")
+		return
+	}
+	cb := s.srv.OnNewMail
+	if cb == nil {
+		log.Printf("smtp: Server.OnNewMail is nil; rejecting MAIL FROM")
+		s.sendlinef("451 4.3.5 Error: server not configured")
+		return
+	}
+	s.env = nil
+	env, err := cb(s, addrString(email))
+	if se, ok := err.(SMTPError); ok {
+		log.Printf("rejecting MAIL FROM %q: %v", email, err)
+		s.sendlinef("%s", se)
+		return
+	} else if err != nil {
+		log.Printf("rejecting MAIL FROM %q: %v", email, err)
+		s.sendlinef("451 4.3.0 Error: sender denied")
+
+		s.bw.Flush()
+		time.Sleep(100 * time.Millisecond)
+		s.rwc.Close()
+		return
+	}
+	s.env = env
+	if sz, ok := env.(Sizer); ok && size > 0 {
+		sz.SetSize(size)
+	}
+	if mp, ok := env.(MailParameters); ok {
+		mp.SetMailParameters(body, smtputf8)
+	}
+	s.rcpts = 0
+	s.smtputf8 = smtputf8
+	s.sendlinef("250 2.1.0 Ok")
+}
+
+func (s *session) handleRcpt(line cmdLine) {
+	// TODO: 4.1.1.11.  If the server SMTP does not recognize or
+	// cannot implement one or more of the parameters associated
+	// qwith a particular MAIL FROM or RCPT TO command, it will return
+	// code 555.
+
+	if s.env == nil {
+		s.sendlinef("503 5.5.1 Error: need MAIL command")
+		return
+	}
+	arg := line.Arg() // "To:<foo@bar.com>"
+	m := rcptToRE.FindStringSubmatch(arg)
+	if m == nil {
+		log.Printf("bad RCPT address: %q", arg)
+		s.sendlinef("501 5.1.3 Bad recipient address syntax")
+		return
+	}
+	if !s.smtputf8 && !isASCII(m[1]) {
+		s.sendlinef("553 5.6.7 Error: non-ASCII address needs SMTPUTF8")
+		return
+	}
+	err := s.env.AddRecipient(addrString(m[1]))
+	if err != nil {
+		s.sendSMTPErrorOrLinef(err, "550 5.1.1 Error: bad recipient")
+		return
+	}
+	s.rcpts++
+	s.sendlinef("250 2.1.0 Ok")
+}
+
+func (s *session) handleData() {
+	if s.env == nil {
+		s.sendlinef("503 5.5.1 Error: need RCPT command")
+		return
+	}
+	if err := s.env.BeginData(); err != nil {
+		// BeginData has already set up part of the message, so the client
+		// starts again with MAIL instead of repeating DATA
+		s.handleError(err)
+		s.env = nil
+		return
+	}
+	s.sendlinef("354 Go ahead")
+	var size int64
+	var dataErr error
+	for {
+		sl, err := s.br.ReadSlice('\n')
+		if err != nil {
+			s.errorf("read error: %v", err)
+			s.abortData()
+			return
+		}
+		if bytes.Equal(sl, []byte(".\r\n")) {
+			break
+		}
+		// After an error the rest of the message is read and thrown away,
+		// so that it isn't mistaken for commands.
+		if dataErr != nil {
+			continue
+		}
+		if sl[0] == '.' {
+			sl = sl[1:]
+		}
+		size += int64(len(sl))
+		if s.srv.MaxMessageSize > 0 && size > s.srv.MaxMessageSize {
+			dataErr = SMTPError("552 5.3.4 Error: message size exceeds limit")
+			continue
+		}
+		dataErr = s.env.Write(sl)
+	}
+	if dataErr != nil {
+		s.abortData()
+		if _, ok := dataErr.(SMTPError); !ok {
+			log.Printf("Error: %s", dataErr)
+			dataErr = SMTPError("451 4.3.0 Error: message not written")
+		}
+		if s.srv.LMTP {
+			for i := 0; i < s.rcpts; i++ {
+				s.sendlinef("%s", dataErr)
+			}
+		} else {
+			s.sendlinef("%s", dataErr)
+		}
+		return
+	}
+	err := s.env.Close()
+	if s.srv.LMTP {
+		s.sendRecipientResults(err)
+		s.env = nil
+		return
+	}
+	if err != nil {
+		s.handleError(err)
+		s.env = nil
+		return
+	}
+	s.sendlinef("250 2.0.0 Ok: queued")
+	s.env = nil
+}
+
+// abortData throws away the message being received, and the envelope.
+func (s *session) abortData() {
+	if a, ok := s.env.(Aborter); ok {
+		a.Abort()
+	}
+	s.env = nil
+}
+
+// sendRecipientResults sends the LMTP reply for each accepted recipient.
+// If the envelope can't report each recipient's result they all get the
+// result of Close.
+func (s *session) sendRecipientResults(closeErr error) {
+	if rr, ok := s.env.(RecipientReplies); ok {
+		replies := rr.RecipientReplies()
+		if len(replies) == s.rcpts {
+			for _, reply := range replies {
+				s.sendlinef("%s", reply)
+			}
+			return
+		}
+	}
+	var errs []error
+	if rr, ok := s.env.(RecipientResults); ok {
+		errs = rr.RecipientErrors()
+	}
+	for i := 0; i < s.rcpts; i++ {
+		err := closeErr
+		if i < len(errs) {
+			err = errs[i]
+		}
+		if err == nil {
+			s.sendlinef("250 2.1.5 Ok")
+			continue
+		}
+		if se, ok := err.(SMTPError); ok {
+			s.sendlinef("%s", se)
+			continue
+		}
+		log.Printf("Error: %s", err)
+		s.sendlinef("451 4.3.0 Error: delivery failed")
+	}
+}
+
+// handleStartTLS upgrades the connection to TLS. The client must start
+// over with EHLO afterwards (RFC 3207 s4.2).
+func (s *session) handleStartTLS() {
+	if s.srv.TLSConfig == nil {
+		s.sendlinef("502 5.5.2 Error: command not recognized")
+		return
+	}
+	if s.tlsState != nil {
+		s.sendlinef("503 5.5.1 Error: TLS already active")
+		return
+	}
+	s.sendlinef("220 2.0.0 Ready to start TLS")
+	tlsConn := tls.Server(s.rwc, s.srv.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		s.errorf("TLS handshake error: %v", err)
+		s.rwc.Close()
+		return
+	}
+	state := tlsConn.ConnectionState()
+	s.rwc = tlsConn
+	s.br = bufio.NewReader(tlsConn)
+	s.bw = bufio.NewWriter(tlsConn)
+	s.tlsState = &state
+	s.env = nil
+	s.helloType = ""
+	s.helloHost = ""
+}
+
+// readAuthLine reads a base64 encoded response to an AUTH challenge.
+// It returns false if the client cancelled or sent bad base64.
+func (s *session) readAuthLine() ([]byte, bool) {
+	sl, err := s.br.ReadSlice('\n')
+	if err != nil {
+		s.errorf("read error: %v", err)
+		return nil, false
+	}
+	line := strings.TrimSpace(string(sl))
+	if line == "*" {
+		s.sendlinef("501 5.7.0 Authentication cancelled")
+		return nil, false
+	}
+	data, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		s.sendlinef("501 5.5.2 Bad base64 encoding")
+		return nil, false
+	}
+	return data, true
+}
+
+// authSecure returns true if the client can send its password, because the
+// connection uses TLS or the server allows AUTH without it.
+func (s *session) authSecure() bool {
+	return s.tlsState != nil || s.srv.AllowInsecureAuth
+}
+
+// handleAuth handles the AUTH PLAIN and LOGIN mechanisms (RFC 4954, 4616)
+func (s *session) handleAuth(arg string) {
+	if s.srv.OnAuth == nil {
+		s.sendlinef("502 5.5.2 Error: command not recognized")
+		return
+	}
+	if !s.authSecure() {
+		s.sendlinef("538 5.7.11 Error: encryption required for requested authentication mechanism")
+		return
+	}
+	if s.authUser != "" {
+		s.sendlinef("503 5.5.1 Error: already authenticated")
+		return
+	}
+	if s.env != nil {
+		s.sendlinef("503 5.5.1 Error: AUTH not allowed during a mail transaction")
+		return
+	}
+	fields := strings.Fields(arg)
+	if len(fields) == 0 || len(fields) > 2 {
+		s.sendlinef("501 5.5.4 Syntax: AUTH mechanism [initial-response]")
+		return
+	}
+	initial := func(prompt string) ([]byte, bool) {
+		if len(fields) == 2 {
+			r := fields[1]
+			fields = fields[:1]
+			if r == "=" {
+				return []byte{}, true
+			}
+			data, err := base64.StdEncoding.DecodeString(r)
+			if err != nil {
+				s.sendlinef("501 5.5.2 Bad base64 encoding")
+				return nil, false
+			}
+			return data, true
+		}
+		s.sendlinef("334 %s", prompt)
+		return s.readAuthLine()
+	}
+
+	var username, password string
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		data, ok := initial("")
+		if !ok {
+			return
+		}
+		// authzid NUL authcid NUL passwd
+		parts := strings.Split(string(data), "\x00")
+		if len(parts) != 3 {
+			s.sendlinef("501 5.5.2 Bad PLAIN response")
+			return
+		}
+		if parts[0] != "" && parts[0] != parts[1] {
+			s.sendlinef("535 5.7.8 Authentication credentials invalid")
+			return
+		}
+		username, password = parts[1], parts[2]
+	case "LOGIN":
+		user, ok := initial(base64.StdEncoding.EncodeToString([]byte("Username:")))
+		if !ok {
+			return
+		}
+		s.sendlinef("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+		pass, ok := s.readAuthLine()
+		if !ok {
+			return
+		}
+		username, password = string(user), string(pass)
+	default:
+		s.sendlinef("504 5.5.4 Unrecognized authentication mechanism")
+		return
+	}
+
+	if s.srv.OnAuthAttempt != nil {
+		if err := s.srv.OnAuthAttempt(s, username); err != nil {
+			s.sendSMTPErrorOrLinef(err, "454 4.7.0 Error: authentication refused")
+			return
+		}
+	}
+	if !s.srv.OnAuth(s, username, password) {
+		s.sendlinef("535 5.7.8 Authentication credentials invalid")
+		return
+	}
+	s.authUser = username
+	s.sendlinef("235 2.7.0 Authentication successful")
+}
+
+func (s *session) handleError(err error) {
+	if se, ok := err.(SMTPError); ok {
+		s.sendlinef("%s", se)
+		return
+	}
+	log.Printf("Error: %s", err)
+	s.sendlinef("451 4.3.0 Error: local error in processing")
+	s.env = nil
+}
+
+type addrString string
+
+func (a addrString) Email() string {
+	return string(a)
+}
+
+func (a addrString) Hostname() string {
+	e := string(a)
+	if idx := strings.Index(e, "@"); idx != -1 {
+		return strings.ToLower(e[idx+1:])
+	}
+	return ""
+}
+
+// isASCII returns true if s only has ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+type cmdLine string
+
+func (cl cmdLine) checkValid() error {
+	if !strings.HasSuffix(string(cl), "\r\n") {
+		return errors.New(`line doesn't end in \r\n`)
+	}
+	// Check for verbs defined not to have an argument
+	// (RFC 5321 s4.1.1)
+	switch cl.Verb() {
+	case "RSET", "DATA", "QUIT":
+		if cl.Arg() != "" {
+			return errors.New("unexpected argument")
+		}
+	}
+	return nil
+}
+
+func (cl cmdLine) Verb() string {
+	s := string(cl)
+	if idx := strings.Index(s, " "); idx != -1 {
+		return strings.ToUpper(s[:idx])
+	}
+	return strings.ToUpper(s[:len(s)-2])
+}
+
+func (cl cmdLine) Arg() string {
+	s := string(cl)
+	if idx := strings.Index(s, " "); idx != -1 {
+		return strings.TrimRightFunc(s[idx+1:len(s)-2], unicode.IsSpace)
+	}
+	return ""
+}
+
+func (cl cmdLine) String() string {
+	return string(cl)
+}
+
+type SMTPError string
+
+func (e SMTPError) Error() string {
+	return string(e)
+}